@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+)
+
+// The values of bundle_rollover_mode.
+const (
+	FixedRollOverMode    = "fixed"
+	AdaptiveRollOverMode = "adaptive"
+)
+
+// adaptiveRollOver shortens the time a bundle is kept open while it holds an urgent event, such as an alert, so that
+// the alert reaches S3 (and whatever reads it from there, such as Splunk) within urgentInterval rather than waiting
+// behind bulk traffic. Bundles holding only bulk events, such as raw sensor events, are rolled over at the longer
+// bundle_bulk_rollover_interval instead, making fewer, larger uploads.
+type adaptiveRollOver struct {
+	urgentEvents   []string
+	urgentInterval time.Duration
+}
+
+func newAdaptiveRollOver() *adaptiveRollOver {
+	if config.BundleRollOverMode != AdaptiveRollOverMode {
+		return nil
+	}
+	return &adaptiveRollOver{urgentEvents: config.BundleUrgentEvents, urgentInterval: config.BundleUrgentRollOverInterval}
+}
+
+// urgent reports whether a formatted event has one of the urgent event types.
+func (a *adaptiveRollOver) urgent(message string) bool {
+	eventType := messageEventType(message)
+	for _, pattern := range a.urgentEvents {
+		if RoutingKeyMatches(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteMessage marks b as urgent if message is the first urgent event written to it since it was rolled over.
+func (a *adaptiveRollOver) noteMessage(b *bundleFile, message string) {
+	if a == nil || b.urgent {
+		return
+	}
+	b.urgent = a.urgent(message)
+}
+
+// due reports whether b holds an urgent event and has been open for urgentInterval, however small it is.
+func (a *adaptiveRollOver) due(b *bundleFile, now time.Time) bool {
+	return a != nil && b.urgent && now.Sub(b.output.lastRolledOver) >= a.urgentInterval
+}
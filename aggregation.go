@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AggregationRule summarizes the events whose type matches EventType (a routing key pattern such as
+// "ingress.event.netconn") by the values of GroupBy.
+type AggregationRule struct {
+	EventType string
+	GroupBy   []string
+}
+
+type Aggregations struct {
+	Rules     []AggregationRule
+	Window    time.Duration
+	MaxGroups int
+}
+
+// parseAggregations reads the [aggregate] section. Each key other than window and max_groups is an event type, with
+// a comma-separated list of the fields its events are grouped by as the value.
+func parseAggregations(section ini.Section, errs *ConfigurationError) Aggregations {
+	a := Aggregations{Window: time.Minute, MaxGroups: 100000}
+
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		val := section[key]
+		switch key {
+		case "window":
+			window, err := time.ParseDuration(val)
+			if err != nil || window < time.Second {
+				errs.addErrorString(fmt.Sprintf("Invalid aggregation window '%s': should be a duration of at least 1s",
+					val))
+			} else {
+				a.Window = window
+			}
+			continue
+		case "max_groups":
+			maxGroups, err := strconv.Atoi(val)
+			if err != nil || maxGroups < 1 {
+				errs.addErrorString(fmt.Sprintf("Invalid max_groups '%s' in [aggregate]: should be a positive number",
+					val))
+			} else {
+				a.MaxGroups = maxGroups
+			}
+			continue
+		}
+
+		rule := AggregationRule{EventType: key}
+		for _, field := range strings.Split(val, ",") {
+			if field = strings.TrimSpace(field); len(field) > 0 {
+				rule.GroupBy = append(rule.GroupBy, field)
+			}
+		}
+		if len(rule.GroupBy) == 0 {
+			errs.addErrorString(fmt.Sprintf("Missing fields to group %s events by in [aggregate]", key))
+			continue
+		}
+		a.Rules = append(a.Rules, rule)
+	}
+
+	return a
+}
+
+func (a *Aggregations) Empty() bool {
+	return len(a.Rules) == 0
+}
+
+// AggregationStatistics is shown on the status page as aggregation.
+type AggregationStatistics struct {
+	Groups     int   `json:"groups"`
+	Aggregated int64 `json:"events_aggregated"`
+	Summaries  int64 `json:"summaries_sent"`
+	Overflow   int64 `json:"events_not_aggregated"`
+}
+
+// aggregateGroup is a summary in progress: the first event of the group, to which the count is added when the window
+// ends.
+type aggregateGroup struct {
+	summary  map[string]interface{}
+	started  time.Time
+	count    int64
+	lastSeen interface{}
+}
+
+// aggregator holds back the events of the configured types and sends one summary per group instead: the first event
+// of the group, with
+//
+//	aggregate_count:           the number of events in the group
+//	aggregate_first_timestamp: the timestamp of the first event
+//	aggregate_last_timestamp:  the timestamp of the last event
+//	aggregate_window:          the length of the window, in seconds
+//
+// A group is sent once the window has passed since its first event. Once max_groups groups are waiting, the events
+// of new groups are passed through as they are.
+type aggregator struct {
+	Aggregations
+
+	groups map[string]*aggregateGroup
+	stats  AggregationStatistics
+	sync.Mutex
+}
+
+var eventAggregator *aggregator
+
+func newAggregator(aggregations Aggregations) *aggregator {
+	return &aggregator{Aggregations: aggregations, groups: make(map[string]*aggregateGroup)}
+}
+
+// groupKey returns the key of the group msg belongs to, or false if it isn't aggregated.
+func (a *aggregator) groupKey(msg map[string]interface{}) (string, bool) {
+	eventType, _ := msg["type"].(string)
+	for i, rule := range a.Rules {
+		if !RoutingKeyMatches(rule.EventType, eventType) {
+			continue
+		}
+		parts := make([]string, 0, len(rule.GroupBy)+2)
+		parts = append(parts, strconv.Itoa(i), eventType)
+		for _, field := range rule.GroupBy {
+			parts = append(parts, stringField(msg, field))
+		}
+		return strings.Join(parts, "\x00"), true
+	}
+	return "", false
+}
+
+// Add holds msg back in its group, returning false if it is not aggregated and should be sent as it is.
+func (a *aggregator) Add(msg map[string]interface{}, now time.Time) bool {
+	key, ok := a.groupKey(msg)
+	if !ok {
+		return false
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	group, ok := a.groups[key]
+	if !ok {
+		if len(a.groups) >= a.MaxGroups {
+			a.stats.Overflow++
+			return false
+		}
+		group = &aggregateGroup{summary: msg, started: now}
+		a.groups[key] = group
+	}
+	group.count++
+	group.lastSeen = msg["timestamp"]
+	a.stats.Aggregated++
+	return true
+}
+
+// expired removes and returns the summaries of the groups whose window has ended by now; all of them if all is set.
+func (a *aggregator) expired(now time.Time, all bool) []map[string]interface{} {
+	a.Lock()
+	defer a.Unlock()
+
+	var summaries []map[string]interface{}
+	for key, group := range a.groups {
+		if !all && now.Sub(group.started) < a.Window {
+			continue
+		}
+		delete(a.groups, key)
+
+		summary := group.summary
+		summary["aggregate_count"] = group.count
+		summary["aggregate_first_timestamp"] = summary["timestamp"]
+		summary["aggregate_last_timestamp"] = group.lastSeen
+		summary["aggregate_window"] = a.Window.Seconds()
+		summaries = append(summaries, summary)
+	}
+	a.stats.Summaries += int64(len(summaries))
+	return summaries
+}
+
+func (a *aggregator) send(ctx context.Context, summaries []map[string]interface{}) {
+	for _, summary := range summaries {
+		if err := outputMessage(ctx, summary); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Could not send aggregated event: %s", err)
+		}
+	}
+}
+
+// run sends the summaries of the groups as their windows end, until ctx is cancelled.
+func (a *aggregator) run(ctx context.Context) {
+	interval := a.Window / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			a.send(ctx, a.expired(now, false))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush sends the summaries of all the groups, however far into their windows, when the forwarder stops.
+func (a *aggregator) Flush(ctx context.Context) {
+	summaries := a.expired(time.Now(), true)
+	if len(summaries) > 0 {
+		log.Printf("Sending %d aggregated events", len(summaries))
+	}
+	a.send(ctx, summaries)
+}
+
+func (a *aggregator) Statistics() interface{} {
+	a.Lock()
+	defer a.Unlock()
+	stats := a.stats
+	stats.Groups = len(a.groups)
+	return stats
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/vaughan0/go-ini"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAggregations(t *testing.T) {
+	section := ini.Section{
+		"window":                "5m",
+		"ingress.event.netconn": "process_guid, remote_ip,remote_port",
+		"ingress.event.filemod": "",
+	}
+	errs := ConfigurationError{}
+	a := parseAggregations(section, &errs)
+	if len(errs.Errors) != 1 || !strings.Contains(errs.Errors[0], "ingress.event.filemod") {
+		t.Errorf("Expected an error for the rule without fields, got %v", errs.Errors)
+	}
+	if a.Window != 5*time.Minute || a.MaxGroups != 100000 || len(a.Rules) != 1 ||
+		strings.Join(a.Rules[0].GroupBy, ",") != "process_guid,remote_ip,remote_port" {
+		t.Errorf("Unexpected aggregations %+v", a)
+	}
+
+	errs = ConfigurationError{}
+	parseAggregations(ini.Section{"window": "10ms", "max_groups": "none"}, &errs)
+	if len(errs.Errors) != 2 {
+		t.Errorf("Expected errors for the window and max_groups, got %v", errs.Errors)
+	}
+}
+
+func netconnEvent(remoteIP string, timestamp int) map[string]interface{} {
+	return map[string]interface{}{"type": "ingress.event.netconn", "process_guid": "00000001-0000-0b44-01d3-c5e1c5b6d4a0",
+		"remote_ip": remoteIP, "remote_port": 443, "timestamp": timestamp}
+}
+
+func TestAggregator(t *testing.T) {
+	a := newAggregator(Aggregations{Window: time.Minute, MaxGroups: 2,
+		Rules: []AggregationRule{{EventType: "ingress.event.netconn", GroupBy: []string{"process_guid", "remote_ip"}}}})
+	start := time.Now()
+
+	if a.Add(map[string]interface{}{"type": "ingress.event.procstart"}, start) {
+		t.Error("Expected events of other types to be sent as they are")
+	}
+	for i := 0; i < 3; i++ {
+		if !a.Add(netconnEvent("10.0.0.1", 100+i), start.Add(time.Duration(i)*time.Second)) {
+			t.Fatal("Expected the netconn to be aggregated")
+		}
+	}
+	a.Add(netconnEvent("10.0.0.2", 110), start.Add(30*time.Second))
+	if a.Add(netconnEvent("10.0.0.3", 111), start.Add(30*time.Second)) {
+		t.Error("Expected the events of groups beyond max_groups to be sent as they are")
+	}
+
+	if summaries := a.expired(start.Add(59*time.Second), false); len(summaries) != 0 {
+		t.Errorf("Expected no summaries before the window ends, got %v", summaries)
+	}
+	summaries := a.expired(start.Add(time.Minute), false)
+	if len(summaries) != 1 {
+		t.Fatalf("Expected one summary, got %v", summaries)
+	}
+	summary := summaries[0]
+	if summary["remote_ip"] != "10.0.0.1" || summary["aggregate_count"] != int64(3) ||
+		summary["aggregate_first_timestamp"] != 100 || summary["aggregate_last_timestamp"] != 102 ||
+		summary["aggregate_window"] != 60.0 {
+		t.Errorf("Unexpected summary %v", summary)
+	}
+
+	if summaries := a.expired(start.Add(time.Minute), true); len(summaries) != 1 ||
+		summaries[0]["remote_ip"] != "10.0.0.2" {
+		t.Errorf("Expected the remaining group to be flushed, got %v", summaries)
+	}
+
+	stats := a.Statistics().(AggregationStatistics)
+	if stats.Groups != 0 || stats.Aggregated != 4 || stats.Summaries != 2 || stats.Overflow != 1 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
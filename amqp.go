@@ -4,14 +4,15 @@ import (
 	"fmt"
 	"github.com/streadway/amqp"
 	"log"
+	"sync"
 )
 
 /*
  * AMQP bookkeeping
  */
 
-func NewConsumer(amqpURI, queueName, ctag string, bindToRawExchange bool,
-	routingKeys []string) (*Consumer, <-chan amqp.Delivery, error) {
+func NewConsumer(amqpURI, queueName, ctag string, queueOptions QueueOptions, bindToRawExchange bool,
+	routingKeys []string, customBindings []CustomBinding) (*Consumer, <-chan amqp.Delivery, error) {
 	c := &Consumer{
 		conn:    nil,
 		channel: nil,
@@ -60,16 +61,30 @@ func NewConsumer(amqpURI, queueName, ctag string, bindToRawExchange bool,
 
 	queue, err := c.channel.QueueDeclare(
 		queueName,
-		false, // durable,
-		true,  // delete when unused
+		queueOptions.Durable,
+		queueOptions.AutoDelete,
 		false, // exclusive
 		false, // nowait
-		nil,   // arguments
+		queueOptions.arguments(),
 	)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Queue declare: %s", err)
 	}
 
+	if err = setQos(c.channel, queueOptions); err != nil {
+		return nil, nil, err
+	}
+	for i := 1; i < queueOptions.Channels; i++ {
+		channel, err := c.conn.Channel()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Channel: %s", err)
+		}
+		if err = setQos(channel, queueOptions); err != nil {
+			return nil, nil, err
+		}
+		c.extra = append(c.extra, channel)
+	}
+
 	if bindToRawExchange {
 		err = c.channel.QueueBind(queueName, "", "api.rawsensordata", false, nil)
 		if err != nil {
@@ -86,25 +101,98 @@ func NewConsumer(amqpURI, queueName, ctag string, bindToRawExchange bool,
 		log.Printf("Subscribed to %s", key)
 	}
 
-	deliveries, err := c.channel.Consume(
-		queue.Name,
-		c.tag,
-		true,  // automatic ack
-		false, // exclusive
-		false, // noLocal
-		false, // noWait
-		nil,   // arguments
-	)
+	if err = bindCustomExchanges(c.channel, queueName, customBindings); err != nil {
+		return nil, nil, err
+	}
 
+	deliveries, err := c.consume(queue.Name, queueOptions)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Queue consume: %s", err)
+		return nil, nil, err
 	}
 
 	return c, deliveries, nil
 }
 
+// setQos applies the prefetch limits of queueOptions to channel. They are not global: they apply to the consumer on
+// the channel, so each consumer channel has a limit of its own.
+func setQos(channel *amqp.Channel, queueOptions QueueOptions) error {
+	if queueOptions.PrefetchCount == 0 && queueOptions.PrefetchSize == 0 {
+		return nil
+	}
+	if err := channel.Qos(queueOptions.PrefetchCount, queueOptions.PrefetchSize, false); err != nil {
+		if queueOptions.PrefetchSize > 0 {
+			return fmt.Errorf("Qos: %s (RabbitMQ does not support prefetch_size)", err)
+		}
+		return fmt.Errorf("Qos: %s", err)
+	}
+	return nil
+}
+
+// channels returns the consumer's channels and the consumer tag used on each.
+func (c *Consumer) channels() ([]*amqp.Channel, []string) {
+	channels, tags := []*amqp.Channel{c.channel}, []string{c.tag}
+	for i, channel := range c.extra {
+		channels = append(channels, channel)
+		tags = append(tags, fmt.Sprintf("%s-%d", c.tag, i+2))
+	}
+	return channels, tags
+}
+
+// consume starts consuming from the queue, as it does when the consumer is created and again after being cancelled.
+// With several channels, their deliveries are merged into one channel, closed once all of theirs are.
+func (c *Consumer) consume(queueName string, queueOptions QueueOptions) (<-chan amqp.Delivery, error) {
+	channels, tags := c.channels()
+	consumed := make([]<-chan amqp.Delivery, len(channels))
+	for i, channel := range channels {
+		deliveries, err := channel.Consume(
+			queueName,
+			tags[i],
+			!queueOptions.ManualAck,
+			false, // exclusive
+			false, // noLocal
+			false, // noWait
+			nil,   // arguments
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Queue consume: %s", err)
+		}
+		consumed[i] = deliveries
+	}
+	if len(consumed) == 1 {
+		return consumed[0], nil
+	}
+
+	merged := make(chan amqp.Delivery)
+	var wg sync.WaitGroup
+	wg.Add(len(consumed))
+	for _, deliveries := range consumed {
+		go func(deliveries <-chan amqp.Delivery) {
+			defer wg.Done()
+			for delivery := range deliveries {
+				merged <- delivery
+			}
+		}(deliveries)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged, nil
+}
+
+// cancel stops the consumers on every channel; the broker delivers nothing more until consume is called again.
+func (c *Consumer) cancel(noWait bool) error {
+	channels, tags := c.channels()
+	for i, channel := range channels {
+		if err := channel.Cancel(tags[i], noWait); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Consumer) Shutdown() error {
-	if err := c.channel.Cancel(c.tag, true); err != nil {
+	if err := c.cancel(true); err != nil {
 		return fmt.Errorf("Consumer cancel failed: %s", err)
 	}
 
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ATT&CK technique IDs named in a watchlist, feed or report, such as T1059 or T1059.001
+var attackTechniquePattern = regexp.MustCompile(`\bT\d{4}(\.\d{3})?\b`)
+var attackTechniqueID = regexp.MustCompile(`^T\d{4}(\.\d{3})?$`)
+
+// the fields of watchlist and feed hits searched for technique IDs
+var attackNameFields = []string{"watchlist_name", "feed_name", "report_id", "report_title"}
+
+// AttackCondition holds if any of the glob patterns matches the field, in the event or in one of its "docs".
+type AttackCondition struct {
+	Field    string
+	Patterns []*regexp.Regexp
+}
+
+// AttackRule tags the events of EventTypes (routing key patterns) that meet every condition with Techniques.
+type AttackRule struct {
+	Name       string
+	Techniques []string
+	EventTypes []string
+	Conditions []AttackCondition
+}
+
+// the bundled rules, in the form of the [attack] section: techniques, event types and match conditions
+var bundledAttackRules = []struct {
+	name, techniques, types, match string
+}{
+	{"powershell", "T1059.001", "ingress.event.procstart,ingress.event.childproc",
+		`path:*\powershell.exe|*\pwsh.exe`},
+	{"encoded_powershell", "T1027,T1059.001", "ingress.event.procstart",
+		`command_line:*powershell* -e *|*powershell* -enc*|*powershell* -ec *`},
+	{"windows_command_shell", "T1059.003", "ingress.event.procstart,ingress.event.childproc", `path:*\cmd.exe`},
+	{"scheduled_task", "T1053.005", "ingress.event.procstart", `path:*\schtasks.exe`},
+	{"wmi", "T1047", "ingress.event.procstart", `path:*\wmic.exe`},
+	{"rundll32", "T1218.011", "ingress.event.procstart", `path:*\rundll32.exe`},
+	{"regsvr32", "T1218.010", "ingress.event.procstart", `path:*\regsvr32.exe`},
+	{"mshta", "T1218.005", "ingress.event.procstart", `path:*\mshta.exe`},
+	{"certutil_download", "T1105", "ingress.event.procstart", `command_line:*certutil*urlcache*`},
+	{"shadow_copy_deletion", "T1490", "ingress.event.procstart",
+		`command_line:*vssadmin*delete*shadows*|*wmic*shadowcopy*delete*`},
+	{"psexec", "T1569.002", "ingress.event.procstart", `path:*\psexec.exe|*\psexec64.exe|*\psexesvc.exe`},
+	{"account_discovery", "T1087", "ingress.event.procstart",
+		`path:*\net.exe|*\net1.exe,command_line:* user*|* group*`},
+	{"owner_discovery", "T1033", "ingress.event.procstart", `path:*\whoami.exe`},
+	{"run_keys", "T1547.001", "ingress.event.regmod", `path:*\currentversion\run*`},
+	{"startup_folder", "T1547.001", "ingress.event.filemod", `path:*\start menu\programs\startup\*`},
+	{"windows_service", "T1543.003", "ingress.event.regmod", `path:*\currentcontrolset\services\*`},
+	{"remote_desktop", "T1021.001", "ingress.event.netconn", `remote_port:3389`},
+	{"smb_admin_shares", "T1021.002", "ingress.event.netconn", `remote_port:445`},
+	{"lsass_memory", "T1003.001", "ingress.event.crossproc", `target_path:*\lsass.exe`},
+	{"process_injection", "T1055", "ingress.event.crossproc", `cross_process_type:remotethread`},
+}
+
+// globPattern compiles a case-insensitive glob, in which * matches any run of characters and ? any one character.
+func globPattern(glob string) (*regexp.Regexp, error) {
+	quoted := regexp.QuoteMeta(glob)
+	quoted = strings.Replace(quoted, `\*`, ".*", -1)
+	quoted = strings.Replace(quoted, `\?`, ".", -1)
+	return regexp.Compile("(?is)^" + quoted + "$")
+}
+
+func parseAttackConditions(val string) ([]AttackCondition, error) {
+	var conditions []AttackCondition
+	for _, match := range strings.Split(val, ",") {
+		parts := strings.SplitN(match, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("condition '%s' should look like (field):(pattern)|(pattern)...", match)
+		}
+		condition := AttackCondition{Field: strings.TrimSpace(parts[0])}
+		for _, glob := range strings.Split(parts[1], "|") {
+			pattern, err := globPattern(strings.TrimSpace(glob))
+			if err != nil {
+				return nil, err
+			}
+			condition.Patterns = append(condition.Patterns, pattern)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseAttackRules returns the bundled rules as changed and extended by the [attack] section. Keys take the form
+// techniques.<rule>, types.<rule> and match.<rule>; a rule named like a bundled one replaces the parts of it that
+// are given, and an empty techniques.<rule> turns a bundled rule off.
+func parseAttackRules(section ini.Section, errs *ConfigurationError) []AttackRule {
+	type ruleText struct {
+		techniques, types, match string
+		bundled                  bool
+	}
+	rules := make(map[string]*ruleText)
+	for _, bundled := range bundledAttackRules {
+		rules[bundled.name] = &ruleText{bundled.techniques, bundled.types, bundled.match, true}
+	}
+
+	for key, val := range section {
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid ATT&CK rule key '%s': should look like "+
+				"(techniques|types|match).(rule)", key))
+			continue
+		}
+		rule, ok := rules[parts[1]]
+		if !ok {
+			rule = &ruleText{}
+			rules[parts[1]] = rule
+		}
+		switch parts[0] {
+		case "techniques":
+			rule.techniques = val
+		case "types":
+			rule.types = val
+		case "match":
+			rule.match = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown ATT&CK rule key '%s': should look like "+
+				"(techniques|types|match).(rule)", key))
+		}
+	}
+
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parsed []AttackRule
+	for _, name := range names {
+		text := rules[name]
+		rule := AttackRule{Name: name, Techniques: splitList(text.techniques), EventTypes: splitList(text.types)}
+		if len(rule.Techniques) == 0 {
+			if !text.bundled {
+				errs.addErrorString(fmt.Sprintf("Missing techniques for ATT&CK rule %s: set techniques.%s", name,
+					name))
+			}
+			continue
+		}
+		for _, technique := range rule.Techniques {
+			if !attackTechniqueID.MatchString(technique) {
+				errs.addErrorString(fmt.Sprintf("Invalid ATT&CK technique '%s' in rule %s: should look like T1059 "+
+					"or T1059.001", technique, name))
+			}
+		}
+		if len(rule.EventTypes) == 0 {
+			errs.addErrorString(fmt.Sprintf("Missing event types for ATT&CK rule %s: set types.%s", name, name))
+			continue
+		}
+		if len(text.match) == 0 {
+			errs.addErrorString(fmt.Sprintf("Missing conditions for ATT&CK rule %s: set match.%s", name, name))
+			continue
+		}
+		conditions, err := parseAttackConditions(text.match)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid conditions for ATT&CK rule %s: %s", name, err))
+			continue
+		}
+		rule.Conditions = conditions
+		parsed = append(parsed, rule)
+	}
+	return parsed
+}
+
+func (condition *AttackCondition) matches(msg map[string]interface{}) bool {
+	matched := false
+	forEachContainer(msg, condition.Field, func(container map[string]interface{}) {
+		value := stringField(container, condition.Field)
+		for _, pattern := range condition.Patterns {
+			if pattern.MatchString(value) {
+				matched = true
+			}
+		}
+	})
+	return matched
+}
+
+func (rule *AttackRule) matches(eventType string, msg map[string]interface{}) bool {
+	applies := false
+	for _, pattern := range rule.EventTypes {
+		if RoutingKeyMatches(pattern, eventType) {
+			applies = true
+			break
+		}
+	}
+	if !applies {
+		return false
+	}
+	for _, condition := range rule.Conditions {
+		if !condition.matches(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// TagAttackTechniques adds an "attack_techniques" list to msg with the ATT&CK techniques of the rules it matches and
+// those named in the watchlist, feed or report of a hit.
+func TagAttackTechniques(rules []AttackRule, msg map[string]interface{}) {
+	eventType, _ := msg["type"].(string)
+	techniques := make(map[string]bool)
+
+	for i := range rules {
+		if rules[i].matches(eventType, msg) {
+			for _, technique := range rules[i].Techniques {
+				techniques[technique] = true
+			}
+		}
+	}
+
+	for _, field := range attackNameFields {
+		for _, technique := range attackTechniquePattern.FindAllString(stringField(msg, field), -1) {
+			techniques[technique] = true
+		}
+	}
+
+	if len(techniques) == 0 {
+		return
+	}
+	tags := make([]string, 0, len(techniques))
+	for technique := range techniques {
+		tags = append(tags, technique)
+	}
+	sort.Strings(tags)
+	msg["attack_techniques"] = tags
+}
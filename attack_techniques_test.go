@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/vaughan0/go-ini"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAttackRules(t *testing.T) {
+	errs := ConfigurationError{}
+	rules := parseAttackRules(ini.Section{}, &errs)
+	if len(errs.Errors) != 0 || len(rules) != len(bundledAttackRules) {
+		t.Fatalf("Expected the bundled rules to parse, got %d rules and errors %v", len(rules), errs.Errors)
+	}
+
+	rules = parseAttackRules(ini.Section{
+		"techniques.bits_jobs":        "T1197",
+		"types.bits_jobs":             "ingress.event.procstart",
+		"match.bits_jobs":             `path:*\bitsadmin.exe,command_line:*/transfer*|*/addfile*`,
+		"techniques.smb_admin_shares": "",
+		"types.remote_desktop":        "ingress.event.netconn,ingress.event.procstart",
+		"techniques.broken":           "1197",
+		"match.unnamed":               "path:*",
+	}, &errs)
+	if len(errs.Errors) != 3 {
+		t.Errorf("Expected errors for the invalid technique and its and the unnamed rule's missing parts, got %v",
+			errs.Errors)
+	}
+
+	byName := make(map[string]AttackRule)
+	for _, rule := range rules {
+		byName[rule.Name] = rule
+	}
+	if _, ok := byName["smb_admin_shares"]; ok {
+		t.Error("Expected an empty techniques key to turn the bundled rule off")
+	}
+	if rule := byName["remote_desktop"]; len(rule.EventTypes) != 2 || len(rule.Conditions) != 1 {
+		t.Errorf("Expected the rule's types to be replaced and its conditions kept, got %+v", rule)
+	}
+	if rule := byName["bits_jobs"]; len(rule.Conditions) != 2 || len(rule.Conditions[1].Patterns) != 2 {
+		t.Errorf("Unexpected rule %+v", rule)
+	}
+}
+
+func TestTagAttackTechniques(t *testing.T) {
+	errs := ConfigurationError{}
+	rules := parseAttackRules(ini.Section{}, &errs)
+
+	tests := []struct {
+		msg        map[string]interface{}
+		techniques []string
+	}{
+		{map[string]interface{}{"type": "ingress.event.procstart", "path": `C:\Windows\System32\WindowsPowerShell\v1.0\PowerShell.exe`,
+			"command_line": "powershell.exe -nop -enc SQBFAFgA"}, []string{"T1027", "T1059.001"}},
+		{map[string]interface{}{"type": "ingress.event.procstart", "path": `c:\windows\system32\net.exe`,
+			"command_line": "net user /domain"}, []string{"T1087"}},
+		{map[string]interface{}{"type": "ingress.event.procstart", "path": `c:\windows\system32\net.exe`,
+			"command_line": "net use z: \\\\fileserver\\share"}, nil},
+		{map[string]interface{}{"type": "ingress.event.regmod",
+			"path": `\registry\user\s-1-5-21\software\microsoft\windows\currentversion\run\updater`},
+			[]string{"T1547.001"}},
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_port": 3389}, []string{"T1021.001"}},
+		{map[string]interface{}{"type": "watchlist.hit.process", "watchlist_name": "T1003 - LSASS access (T1003.001)",
+			"docs": []map[string]interface{}{{"path": `c:\windows\system32\mshta.exe`}}}, []string{"T1003", "T1003.001"}},
+		{map[string]interface{}{"type": "ingress.event.filemod", "path": `c:\users\bob\powershell.exe`}, nil},
+	}
+	for _, test := range tests {
+		TagAttackTechniques(rules, test.msg)
+		techniques, _ := test.msg["attack_techniques"].([]string)
+		if !reflect.DeepEqual(techniques, test.techniques) {
+			t.Errorf("Expected techniques %v for %v, got %v", test.techniques, test.msg["type"], techniques)
+		}
+	}
+}
+
+func TestGlobPattern(t *testing.T) {
+	pattern, err := globPattern(`*\start menu\programs\startup\?*.lnk`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pattern.MatchString(strings.ToUpper(`C:\Users\bob\AppData\Roaming\Microsoft\Windows\Start Menu\Programs\Startup\a.lnk`)) {
+		t.Error("Expected the pattern to match regardless of case")
+	}
+	if pattern.MatchString(`c:\start menu\programs\startup\.lnk`) || pattern.MatchString(`c:\startup.lnk.exe`) {
+		t.Error("Expected ? to match one character and the pattern to be anchored")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"expvar"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+var auditedEvents = expvar.NewInt("audited_event_count")
+
+// auditLog copies a random sample of output events to a local file, so that the effect of transforms, redaction and
+// filters on real events can be checked. Once the file reaches maxSize it is moved to <file>.1, replacing the
+// previous one, and a new file is started. It also holds the dead letter file, which is written to in full.
+type auditLog struct {
+	sync.Mutex
+	fileName   string
+	sampleRate float64
+	maxSize    int64
+
+	file *os.File
+	size int64
+}
+
+var eventAudit *auditLog
+
+func newAuditLog(fileName string, sampleRate float64, maxSize int64) (*auditLog, error) {
+	a := &auditLog{fileName: fileName, sampleRate: sampleRate, maxSize: maxSize}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	fp, err := os.OpenFile(a.fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	a.file = fp
+	a.size = info.Size()
+	return nil
+}
+
+// Sample writes message to the audit file if it is picked for the sample.
+func (a *auditLog) Sample(message string) error {
+	if rand.Float64() >= a.sampleRate {
+		return nil
+	}
+	if err := a.Write(message); err != nil {
+		return err
+	}
+	auditedEvents.Add(1)
+	return nil
+}
+
+// Write writes message to the file, whatever the sample rate.
+func (a *auditLog) Write(message string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.maxSize > 0 && a.size+int64(len(message))+1 > a.maxSize && a.size > 0 {
+		a.file.Close()
+		if err := os.Rename(a.fileName, a.fileName+".1"); err != nil {
+			return err
+		}
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.WriteString(message + "\n")
+	a.size += int64(n)
+	return err
+}
+
+func (a *auditLog) Close() error {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.file.Close()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "audit.log")
+	audit, err := newAuditLog(fileName, 1, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range [...]string{"event 1", "event 2", "event 3", "event 4"} {
+		if err := audit.Sample(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit.Close()
+
+	// the first three events fill the file, which is then moved aside
+	previous, _ := ioutil.ReadFile(fileName + ".1")
+	current, _ := ioutil.ReadFile(fileName)
+	if string(previous) != "event 1\nevent 2\nevent 3\n" || string(current) != "event 4\n" {
+		t.Errorf("Unexpected audit files: %q and %q", previous, current)
+	}
+
+	// nothing is sampled at a rate of zero
+	audit, err = newAuditLog(fileName, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		audit.Sample("event")
+	}
+	audit.Close()
+	if current, _ := ioutil.ReadFile(fileName); strings.Count(string(current), "\n") != 1 {
+		t.Errorf("Events sampled at a rate of zero: %q", current)
+	}
+}
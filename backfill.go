@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var backfillStatistics = expvar.NewMap("backfill")
+
+// backfill content types by file extension. Single protobuf messages and JSON files carry no routing key, so the
+// name of the directory holding them is used, as in the layout of Cb's exported event archives:
+// <routing key>/<n>.protobuf. JSON events that have a "type" field keep it.
+var backfillFormats = map[string]struct {
+	contentType string
+	exchange    string
+}{
+	".zip":      {"application/zip", "api.rawsensordata"},
+	".bundle":   {"application/protobuf", "api.rawsensordata"},
+	".pb":       {"application/protobuf", "api.events"},
+	".protobuf": {"application/protobuf", "api.events"},
+	".json":     {"application/json", "api.events"},
+	".jsonl":    {"application/json", "api.events"},
+}
+
+// runBackfill pushes the events stored in the file or directory at path through the same processing and output as
+// events from the message bus, for loading historical events into a new destination. Directories are read
+// recursively in name order; files with unrecognized extensions are skipped.
+func runBackfill(ctx context.Context, path string) error {
+	var files []string
+	err := filepath.Walk(path, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, fileName)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	log.Printf("Backfilling %d files from %s", len(files), path)
+	for _, fileName := range files {
+		if err := backfillFile(ctx, fileName); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("Could not backfill %s: %s", fileName, err)
+			backfillStatistics.Add("failed_files", 1)
+			continue
+		}
+	}
+
+	log.Printf("Backfill from %s complete", path)
+	return nil
+}
+
+func backfillFile(ctx context.Context, fileName string) error {
+	format, ok := backfillFormats[strings.ToLower(filepath.Ext(fileName))]
+	if !ok {
+		backfillStatistics.Add("skipped_files", 1)
+		return nil
+	}
+	routingKey := filepath.Base(filepath.Dir(fileName))
+
+	if format.contentType != "application/json" {
+		body, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		if err = processMessage(ctx, body, routingKey, format.contentType, nil, format.exchange); err != nil {
+			return err
+		}
+		backfillStatistics.Add("messages", 1)
+		backfillStatistics.Add("files", 1)
+		return nil
+	}
+
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	// one or more JSON objects, such as one per line
+	decoder := json.NewDecoder(fp)
+	for {
+		var body json.RawMessage
+		if err = decoder.Decode(&body); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid JSON: %s", err)
+		}
+
+		var event struct {
+			Type string `json:"type"`
+		}
+		key := routingKey
+		if json.Unmarshal(body, &event) == nil && len(event.Type) > 0 {
+			key = event.Type
+		}
+
+		if err = processMessage(ctx, bytes.TrimSpace(body), key, format.contentType, nil, format.exchange); err != nil {
+			return err
+		}
+		backfillStatistics.Add("messages", 1)
+	}
+
+	backfillStatistics.Add("files", 1)
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func copyBackfillFile(t *testing.T, src, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dst, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunBackfill(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config = Configuration{OutputFormat: JSONOutputFormat}
+
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	copyBackfillFile(t, "tests/raw_data/protobuf/ingress.event.childproc/0.protobuf",
+		filepath.Join(dir, "ingress.event.childproc", "0.protobuf"))
+	copyBackfillFile(t, "tests/raw_data/json/watchlist.hit.process/0.json",
+		filepath.Join(dir, "watchlist.hit.process", "0.json"))
+	if err = ioutil.WriteFile(filepath.Join(dir, "export.jsonl"),
+		[]byte("{\"type\": \"custom.one\"}\n{\"type\": \"custom.two\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "README.txt"), []byte("not events"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]int)
+	done := make(chan struct{})
+	go func() {
+		for message := range results {
+			var msg map[string]interface{}
+			if err := json.Unmarshal([]byte(message), &msg); err != nil {
+				t.Error(err)
+				continue
+			}
+			types[msg["type"].(string)]++
+		}
+		close(done)
+	}()
+
+	err = runBackfill(context.Background(), dir)
+	close(results)
+	<-done
+	results = make(chan string, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, eventType := range [...]string{"ingress.event.childproc", "watchlist.hit.process", "custom.one",
+		"custom.two"} {
+		if types[eventType] == 0 {
+			t.Errorf("No %s events were forwarded: %v", eventType, types)
+		}
+	}
+}
+
+func TestEventExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bundle := `{"type":"ingress.event.netconn","timestamp":1788267600,"n":1}
+{"type":"ingress.event.netconn","timestamp":1788181200,"n":2}
+{"type":"ingress.event.procstart","timestamp":1788267600,"n":3}
+LEEF:1.0|CB|CB|5.1|ingress.event.netconn|n=4	timestamp=1788267601
+`
+	if err = ioutil.WriteFile(filepath.Join(dir, "event-forwarder.2026-09-01T13:00:00"), []byte(bundle), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// binary events from an event archive are skipped
+	copyBackfillFile(t, "tests/raw_data/protobuf/ingress.event.childproc/0.protobuf",
+		filepath.Join(dir, "ingress.event.childproc", "0.protobuf"))
+	// a pretty-printed event from an event archive, with its type given by the directory
+	if err = os.MkdirAll(filepath.Join(dir, "ingress.event.netconn"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "ingress.event.netconn", "0.json"),
+		[]byte("{\n  \"timestamp\": 1788267602,\n  \"n\": 5\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := parseEventExportFilter("2026-09-01", "2026-09-02", "ingress.event.netconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	summary, err := runEventExport(dir, filter, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"type":"ingress.event.netconn","timestamp":1788267600,"n":1}
+LEEF:1.0|CB|CB|5.1|ingress.event.netconn|n=4	timestamp=1788267601
+{"timestamp":1788267602,"n":5}
+`
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+	if summary.Events != 5 || summary.Exported != 3 || summary.SkippedFiles != 1 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+
+	// a file exported to in the directory isn't read
+	fp, err := os.Create(filepath.Join(dir, "export.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if exported, err := runEventExport(dir, filter, fp); err != nil || exported != summary {
+		t.Errorf("Expected the summary %+v exporting to %s, got %+v (%v)", summary, fp.Name(), exported, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the backlog is checked against the pause thresholds
+const backpressureCheckInterval = 5 * time.Second
+
+// BackpressureStatistics is shown on the status page as backpressure.
+type BackpressureStatistics struct {
+	Paused           bool      `json:"paused"`
+	Reason           string    `json:"reason,omitempty"`
+	PausedSince      time.Time `json:"paused_since"`
+	Pauses           int64     `json:"pauses"`
+	PausedTime       string    `json:"paused_time"`
+	HoldingAreaFiles int       `json:"holding_area_files"`
+	BufferBytes      int64     `json:"buffer_bytes"`
+}
+
+// backpressureMonitor stops consuming from the message bus while the output is backed up - more than maxFiles files
+// waiting in the holding area, or more than maxBufferBytes waiting in the event buffer - so that the events wait in
+// RabbitMQ instead of on the forwarder's disk. Consumption resumes once the backlog has drained below half of each
+// threshold. A threshold of 0 is not checked.
+//
+// Stopping the message processors is enough for a queue whose messages are acknowledged manually with a prefetch
+// limit: the broker delivers no more than prefetch_count unacknowledged messages. Otherwise the broker would keep
+// pushing messages to the AMQP client, so the consumer is cancelled while paused (see messageProcessingLoop) and
+// started again when the backlog drains.
+type backpressureMonitor struct {
+	maxFiles       int
+	maxBufferBytes int64
+	gate           *consumptionGate
+
+	// backlogs returns the number of files in the holding area and the bytes in the event buffer
+	backlogs func() (int, int64)
+	// changes receives true when consumption pauses and false when it resumes
+	changes chan bool
+
+	stats      BackpressureStatistics
+	pausedTime time.Duration
+	sync.Mutex
+}
+
+var backpressure *backpressureMonitor
+
+func newBackpressureMonitor(maxFiles int, maxBufferBytes int64, gate *consumptionGate) *backpressureMonitor {
+	return &backpressureMonitor{
+		maxFiles:       maxFiles,
+		maxBufferBytes: maxBufferBytes,
+		gate:           gate,
+		backlogs:       outputBacklogs,
+		changes:        make(chan bool, 1),
+	}
+}
+
+// outputBacklogs returns the files waiting in the holding area of a bundled output, and the bytes waiting in the
+// event buffer.
+func outputBacklogs() (int, int64) {
+	files := 0
+	if bundled, ok := outputHandler.(*BundledOutput); ok {
+		snapshot := bundled.Snapshot()
+		files = snapshot.FilesQueued + snapshot.FilesHeld
+	}
+	var bufferBytes int64
+	if buffer != nil {
+		stats := buffer.Statistics().(EventBufferStatistics)
+		bufferBytes = stats.MemoryBytes + stats.SpilledBytes
+	}
+	return files, bufferBytes
+}
+
+func (b *backpressureMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(backpressureCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			b.check(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check pauses or resumes consumption according to the backlog.
+func (b *backpressureMonitor) check(now time.Time) {
+	files, bufferBytes := b.backlogs()
+
+	b.Lock()
+	defer b.Unlock()
+	b.stats.HoldingAreaFiles, b.stats.BufferBytes = files, bufferBytes
+
+	if !b.stats.Paused {
+		var reasons []string
+		if b.maxFiles > 0 && files > b.maxFiles {
+			reasons = append(reasons, fmt.Sprintf("%d files waiting in the holding area", files))
+		}
+		if b.maxBufferBytes > 0 && bufferBytes > b.maxBufferBytes {
+			reasons = append(reasons, fmt.Sprintf("%d bytes waiting in the event buffer", bufferBytes))
+		}
+		if len(reasons) == 0 {
+			return
+		}
+		b.stats.Paused, b.stats.Reason, b.stats.PausedSince = true, strings.Join(reasons, ", "), now
+		b.stats.Pauses++
+		log.Printf("WARNING: the output is backed up (%s); pausing consumption until it drains", b.stats.Reason)
+	} else {
+		if (b.maxFiles > 0 && files > b.maxFiles/2) || (b.maxBufferBytes > 0 && bufferBytes > b.maxBufferBytes/2) {
+			return
+		}
+		b.pausedTime += now.Sub(b.stats.PausedSince)
+		log.Printf("The output backlog has drained after %s; resuming consumption",
+			now.Sub(b.stats.PausedSince).Round(time.Second))
+		b.stats.Paused, b.stats.Reason = false, ""
+	}
+
+	b.gate.Throttle(b.stats.Paused)
+	// only the latest change matters to the consumer
+	select {
+	case <-b.changes:
+	default:
+	}
+	b.changes <- b.stats.Paused
+}
+
+func (b *backpressureMonitor) Statistics() interface{} {
+	b.Lock()
+	defer b.Unlock()
+	stats := b.stats
+	paused := b.pausedTime
+	if stats.Paused {
+		paused += time.Since(stats.PausedSince)
+	}
+	stats.PausedTime = paused.Round(time.Second).String()
+	return stats
+}
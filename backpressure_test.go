@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackpressureMonitor(t *testing.T) {
+	gate := &consumptionGate{}
+	monitor := newBackpressureMonitor(100, 1000, gate)
+	files, bufferBytes := 0, int64(0)
+	monitor.backlogs = func() (int, int64) { return files, bufferBytes }
+
+	now := time.Now()
+	files = 100
+	monitor.check(now)
+	if gate.Throttled() || len(monitor.changes) != 0 {
+		t.Fatal("Expected consumption to continue at the threshold")
+	}
+
+	files = 101
+	monitor.check(now)
+	if !gate.Throttled() || !<-monitor.changes {
+		t.Fatal("Expected consumption to pause above the threshold")
+	}
+	if stats := monitor.Statistics().(BackpressureStatistics); !stats.Paused || stats.Pauses != 1 ||
+		stats.Reason != "101 files waiting in the holding area" {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+
+	// the backlog has to drain below half of every threshold
+	files, bufferBytes = 50, 501
+	monitor.check(now.Add(time.Minute))
+	if !gate.Throttled() {
+		t.Fatal("Expected consumption to stay paused until the buffer drains")
+	}
+	bufferBytes = 500
+	monitor.check(now.Add(2 * time.Minute))
+	if gate.Throttled() || <-monitor.changes {
+		t.Fatal("Expected consumption to resume once the backlog drained")
+	}
+	if stats := monitor.Statistics().(BackpressureStatistics); stats.Paused || stats.PausedTime != "2m0s" {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
+
+func TestConsumptionGateThrottle(t *testing.T) {
+	gate := &consumptionGate{}
+	gate.Pause()
+	gate.Throttle(true)
+	gate.Resume()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if gate.Paused() || gate.Wait(ctx) == nil {
+		t.Fatal("Expected the gate to stay closed while throttled")
+	}
+
+	gate.Throttle(false)
+	if err := gate.Wait(context.Background()); err != nil {
+		t.Errorf("Expected the gate to open, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// batchShutdownTimeout bounds how long a batching output takes, once stopped, to send the events it still has.
+const batchShutdownTimeout = 10 * time.Second
+
+// batchSender is the loop of the outputs that send events in batches over HTTP (Loki, OTLP). Events are sent in
+// batches of up to size events, or whatever has arrived within wait of the first. A batch that send reports worth
+// sending again is sent again after a pause until it is accepted, holding up processing meanwhile; any other batch
+// that can't be sent is dropped. Once the output is stopped, the batch being collected or retried and the events
+// still waiting are each sent once, with a context of their own, as the loop's is cancelled by then.
+type batchSender struct {
+	loop *outputLoop
+	size int
+	wait time.Duration
+	// the output, for log messages
+	name string
+
+	send func(ctx context.Context, batch []string) (retry bool, err error)
+	// keep the output's statistics of batches sent again and events dropped
+	retried func(err error)
+	dropped func(events int, err error)
+}
+
+// run must be started in its own goroutine by the output's Go method.
+func (s *batchSender) run(messages <-chan string, errorChan chan<- error) {
+	defer s.loop.exited()
+
+	for {
+		select {
+		case <-s.loop.ctx.Done():
+			s.flush(messages, nil)
+			return
+
+		case message := <-messages:
+			batch := s.collect(messages, message)
+			if err := s.deliver(batch); err != nil {
+				if s.loop.ctx.Err() != nil {
+					s.flush(messages, batch)
+					return
+				}
+				errorChan <- err
+			}
+		}
+	}
+}
+
+// collect starts a batch with first, and adds the events arriving in messages within wait, up to size.
+func (s *batchSender) collect(messages <-chan string, first string) []string {
+	batch := []string{first}
+	timer := time.NewTimer(s.wait)
+	defer timer.Stop()
+
+	for len(batch) < s.size {
+		select {
+		case message := <-messages:
+			batch = append(batch, message)
+		case <-timer.C:
+			return batch
+		case <-s.loop.ctx.Done():
+			return batch
+		}
+	}
+	return batch
+}
+
+// deliver sends batch, and sends it again after a pause while it is worth it, until it is accepted or the output is
+// stopped. A batch interrupted by the output stopping is left to flush.
+func (s *batchSender) deliver(batch []string) error {
+	for {
+		if s.loop.ctx.Err() != nil {
+			return s.loop.ctx.Err()
+		}
+		retry, err := s.send(s.loop.ctx, batch)
+		if err == nil {
+			return nil
+		}
+		if s.loop.ctx.Err() != nil {
+			return err
+		}
+		if !retry {
+			s.dropped(len(batch), err)
+			return err
+		}
+
+		s.retried(err)
+		log.Printf("Could not send %d events to %s: %s. Will try again in 5 seconds.", len(batch), s.name, err)
+
+		select {
+		case <-time.After(5 * time.Second):
+		case <-s.loop.ctx.Done():
+			return s.loop.ctx.Err()
+		}
+	}
+}
+
+// flush sends batch, then the events waiting in messages, in batches of up to size, trying each once within
+// batchShutdownTimeout.
+func (s *batchSender) flush(messages <-chan string, batch []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), batchShutdownTimeout)
+	defer cancel()
+
+	send := func(batch []string) {
+		if _, err := s.send(ctx, batch); err != nil {
+			s.dropped(len(batch), err)
+			log.Printf("Error writing to %s during shutdown: %s", s.name, err)
+		}
+	}
+	if len(batch) >= s.size {
+		send(batch)
+		batch = nil
+	}
+	drainMessages(messages, func(message string) error {
+		if batch = append(batch, message); len(batch) >= s.size {
+			send(batch)
+			batch = nil
+		}
+		return nil
+	})
+	if len(batch) > 0 {
+		send(batch)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// binaries waiting to be archived; further binarystore.file.added events are not archived while the queue is full
+const binaryArchiveQueueSize = 1000
+
+var md5Pattern = regexp.MustCompile(`^[0-9A-Fa-f]{32}$`)
+
+// binaryStore is where the binary archive keeps samples: an S3 bucket or a local directory.
+type binaryStore interface {
+	Exists(ctx context.Context, name string) (bool, error)
+	Put(ctx context.Context, name string, fp *os.File) error
+	String() string
+}
+
+type s3BinaryStore struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func (s *s3BinaryStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket),
+		Key: aws.String(s.prefix + name)})
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *s3BinaryStore) Put(ctx context.Context, name string, fp *os.File) error {
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{Bucket: aws.String(s.bucket),
+		Key: aws.String(s.prefix + name), Body: fp, ContentType: aws.String("application/zip")})
+	return err
+}
+
+func (s *s3BinaryStore) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+type dirBinaryStore struct {
+	dir string
+}
+
+func (d *dirBinaryStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(d.dir, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put moves the downloaded file into the directory, under a temporary name first so that a partial copy is never
+// mistaken for the sample.
+func (d *dirBinaryStore) Put(ctx context.Context, name string, fp *os.File) error {
+	fn := filepath.Join(d.dir, name)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(fn+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, fp); err != nil {
+		out.Close()
+		os.Remove(fn + ".tmp")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(fn + ".tmp")
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func (d *dirBinaryStore) String() string {
+	return d.dir
+}
+
+// newBinaryStore returns the store for destination: s3://<bucket>/<prefix>, optionally with ?region=<region>, or a
+// local directory.
+func newBinaryStore(destination string) (binaryStore, error) {
+	if !strings.HasPrefix(destination, "s3://") {
+		return &dirBinaryStore{dir: destination}, nil
+	}
+
+	location, err := url.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+	if len(location.Host) == 0 {
+		return nil, fmt.Errorf("no bucket in %s", destination)
+	}
+	region := location.Query().Get("region")
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+	prefix := strings.TrimPrefix(location.Path, "/")
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3BinaryStore{client: newS3Client(region), bucket: location.Host, prefix: prefix}, nil
+}
+
+// BinaryArchiveStatistics is shown on the status page as binary_archive.
+type BinaryArchiveStatistics struct {
+	Destination     string    `json:"destination"`
+	Queued          int       `json:"queued"`
+	Archived        int64     `json:"archived"`
+	AlreadyArchived int64     `json:"already_archived"`
+	TooLarge        int64     `json:"too_large"`
+	Dropped         int64     `json:"dropped"`
+	Failed          int64     `json:"failed"`
+	LastArchiveTime time.Time `json:"last_archive_time"`
+	LastError       string    `json:"last_error,omitempty"`
+	LastErrorTime   time.Time `json:"last_error_time"`
+}
+
+// binaryArchive downloads the binaries of binarystore.file.added events from the Cb Response server's API, as the
+// zip files the server keeps them in, and saves them to the store as <MD5>.zip. Binaries already in the store are
+// not downloaded again.
+type binaryArchive struct {
+	serverURL string
+	token     string
+	maxSize   int64
+	client    *http.Client
+	store     binaryStore
+
+	queue chan string
+	stats BinaryArchiveStatistics
+	sync.Mutex
+}
+
+var binaries *binaryArchive
+
+func newBinaryArchive(serverURL, token string, maxSize int64, store binaryStore) *binaryArchive {
+	return &binaryArchive{
+		serverURL: strings.TrimRight(serverURL, "/"),
+		token:     token,
+		maxSize:   maxSize,
+		client:    &http.Client{Timeout: 10 * time.Minute, Transport: httpTransport()},
+		store:     store,
+		queue:     make(chan string, binaryArchiveQueueSize),
+		stats:     BinaryArchiveStatistics{Destination: store.String()},
+	}
+}
+
+// Add queues the binary of msg to be archived if it is a binarystore.file.added event, returning whether it is one.
+func (b *binaryArchive) Add(msg map[string]interface{}) bool {
+	if eventType, _ := msg["type"].(string); eventType != "binarystore.file.added" {
+		return false
+	}
+	md5 := strings.ToUpper(stringField(msg, "md5"))
+	if !md5Pattern.MatchString(md5) {
+		return true
+	}
+
+	select {
+	case b.queue <- md5:
+	default:
+		b.Lock()
+		b.stats.Dropped++
+		b.Unlock()
+	}
+	return true
+}
+
+// run archives the queued binaries until ctx is cancelled.
+func (b *binaryArchive) run(ctx context.Context) {
+	for {
+		select {
+		case md5 := <-b.queue:
+			if err := b.archive(ctx, md5); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Could not archive binary %s: %s", md5, err)
+				b.recordError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *binaryArchive) recordError(err error) {
+	b.Lock()
+	defer b.Unlock()
+	b.stats.Failed++
+	b.stats.LastError = err.Error()
+	b.stats.LastErrorTime = time.Now()
+}
+
+func (b *binaryArchive) archive(ctx context.Context, md5 string) error {
+	name := md5 + ".zip"
+	exists, err := b.store.Exists(ctx, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		b.Lock()
+		b.stats.AlreadyArchived++
+		b.Unlock()
+		return nil
+	}
+
+	fp, err := ioutil.TempFile("", "cb-event-forwarder-binary-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	size, err := b.download(ctx, md5, fp)
+	if err != nil {
+		return err
+	}
+	if b.maxSize > 0 && size > b.maxSize {
+		b.Lock()
+		b.stats.TooLarge++
+		b.Unlock()
+		return nil
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := b.store.Put(ctx, name, fp); err != nil {
+		return err
+	}
+
+	b.Lock()
+	b.stats.Archived++
+	b.stats.LastArchiveTime = time.Now()
+	b.Unlock()
+	return nil
+}
+
+// download writes the binary's zip file to w, up to one byte past maxSize, and returns the number of bytes written.
+func (b *binaryArchive) download(ctx context.Context, md5 string, w io.Writer) (int64, error) {
+	req, err := http.NewRequest("GET", b.serverURL+"/api/v1/binary/"+md5, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Auth-Token", b.token)
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return 0, fmt.Errorf("%s: check the [binaries] api_token", resp.Status)
+	default:
+		return 0, fmt.Errorf("%s fetching the binary from %s", resp.Status, b.serverURL)
+	}
+
+	var body io.Reader = resp.Body
+	if b.maxSize > 0 {
+		body = io.LimitReader(resp.Body, b.maxSize+1)
+	}
+	return io.Copy(w, body)
+}
+
+func (b *binaryArchive) Statistics() interface{} {
+	b.Lock()
+	defer b.Unlock()
+	stats := b.stats
+	stats.Queued = len(b.queue)
+	return stats
+}
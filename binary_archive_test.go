@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBinaryArchive(t *testing.T) {
+	const md5 = "445C3E95C8CB05403AEDAEC3BAAA3A1D"
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/binary/" + md5:
+			downloads++
+			w.Write([]byte("PK zip contents"))
+		case "/api/v1/binary/00000000000000000000000000000000":
+			w.Write([]byte(strings.Repeat("x", 100)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	archive := newBinaryArchive(server.URL+"/", "secret", 50, &dirBinaryStore{dir: dir})
+
+	if archive.Add(map[string]interface{}{"type": "binaryinfo.observed", "md5": md5}) {
+		t.Error("Expected only binarystore.file.added events to be archived")
+	}
+	if !archive.Add(map[string]interface{}{"type": "binarystore.file.added", "md5": strings.ToLower(md5)}) {
+		t.Fatal("Expected the binary to be queued")
+	}
+	if queued := archive.Statistics().(BinaryArchiveStatistics).Queued; queued != 1 {
+		t.Fatalf("Expected one binary queued, got %d", queued)
+	}
+
+	ctx := context.Background()
+	if err := archive.archive(ctx, <-archive.queue); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, md5+".zip"))
+	if err != nil || string(contents) != "PK zip contents" {
+		t.Errorf("Expected the binary in the archive, got %q (%v)", contents, err)
+	}
+
+	if err := archive.archive(ctx, md5); err != nil || downloads != 1 {
+		t.Errorf("Expected an archived binary not to be downloaded again, got %d downloads (%v)", downloads, err)
+	}
+	if err := archive.archive(ctx, "00000000000000000000000000000000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.archive(ctx, "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"); err == nil {
+		t.Error("Expected an error for a binary the server doesn't have")
+	}
+
+	stats := archive.Statistics().(BinaryArchiveStatistics)
+	if stats.Archived != 1 || stats.AlreadyArchived != 1 || stats.TooLarge != 1 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+
+	archive.token = "wrong"
+	if err := archive.archive(ctx, "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"); err == nil || !strings.Contains(err.Error(), "api_token") {
+		t.Errorf("Expected an error about the API token, got %v", err)
+	}
+}
+
+func TestNewBinaryStore(t *testing.T) {
+	store, err := newBinaryStore("s3://samples/cb?region=us-west-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3Store, ok := store.(*s3BinaryStore); !ok || s3Store.bucket != "samples" || s3Store.prefix != "cb/" ||
+		*s3Store.client.Config.Region != "us-west-2" {
+		t.Errorf("Unexpected store %+v", store)
+	}
+
+	if store, err := newBinaryStore("/var/cb/data/event-forwarder/binaries"); err != nil || store.String() !=
+		"/var/cb/data/event-forwarder/binaries" {
+		t.Errorf("Expected a directory store, got %v (%v)", store, err)
+	}
+}
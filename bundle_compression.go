@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// The values of bundle_compression.
+const (
+	NoBundleCompression   = "none"
+	GzipBundleCompression = "gzip"
+	ZstdBundleCompression = "zstd"
+)
+
+// the suffixes added to the names of compressed bundles
+var bundleCompressionSuffixes = map[string]string{GzipBundleCompression: ".gz", ZstdBundleCompression: ".zst"}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+const (
+	// the largest dictionary -train-zstd-dictionary builds, the size the zstd command line tool trains by default
+	zstdDictionarySize = 112640
+	// the fewest events a dictionary can be trained on
+	zstdDictionaryMinSamples = 100
+)
+
+// loadZstdDictionary reads a dictionary trained by -train-zstd-dictionary, or by zstd --train, and checks that it
+// can be used.
+func loadZstdDictionary(fn string) ([]byte, error) {
+	dictionary, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dictionary))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a zstd dictionary: %s", fn, err)
+	}
+	encoder.Close()
+	return dictionary, nil
+}
+
+// compressedBundleTmpSuffix is added to the name of a bundle for its compressed copy while it is being written.
+const compressedBundleTmpSuffix = ".compress.tmp"
+
+// compressBundle replaces a rolled-over bundle with a compressed copy, named with the suffix of the compression,
+// and returns the new name. If it can't, the bundle is left as it was. The copy only takes its name once it is
+// complete, so that a bundle found with its compressed copy after a crash can be removed; see adoptWritingDirectory.
+func compressBundle(fileName, compression string) (string, error) {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return fileName, err
+	}
+	defer in.Close()
+
+	tmp := fileName + compressedBundleTmpSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fileName, err
+	}
+
+	var w io.WriteCloser
+	if compression == GzipBundleCompression {
+		w = gzip.NewWriter(out)
+	} else {
+		options := []zstd.EOption{zstd.WithEncoderLevel(config.ZstdLevel)}
+		if len(config.ZstdDictionary) > 0 {
+			options = append(options, zstd.WithEncoderDict(config.ZstdDictionary))
+		}
+		if w, err = zstd.NewWriter(out, options...); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return fileName, err
+		}
+	}
+
+	_, err = io.Copy(w, in)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	compressed := fileName + bundleCompressionSuffixes[compression]
+	if err == nil {
+		if _, err = os.Lstat(compressed); err == nil {
+			err = fmt.Errorf("%s already exists", compressed)
+		} else if os.IsNotExist(err) {
+			err = os.Rename(tmp, compressed)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fileName, err
+	}
+
+	in.Close()
+	if err := os.Remove(fileName); err != nil {
+		os.Remove(compressed)
+		return fileName, err
+	}
+	return compressed, nil
+}
+
+// hasCompressedCopy reports whether a bundle has been compressed by compressBundle.
+func hasCompressedCopy(fileName string) bool {
+	for _, suffix := range bundleCompressionSuffixes {
+		if _, err := os.Lstat(fileName + suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// bundleCompressionOfHeader returns the compression of a file starting with header, or "" if it isn't compressed.
+func bundleCompressionOfHeader(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, zstdMagic):
+		return ZstdBundleCompression
+	case bytes.HasPrefix(header, gzipMagic):
+		return GzipBundleCompression
+	}
+	return ""
+}
+
+func bundleCompressionOf(r *bufio.Reader) string {
+	header, _ := r.Peek(len(zstdMagic))
+	return bundleCompressionOfHeader(header)
+}
+
+// newBundleDecompressor returns a reader of the decompressed contents of a bundle compressed with compression. zstd
+// bundles compressed with a dictionary need the same dictionary.
+func newBundleDecompressor(r io.Reader, compression string, dictionary []byte) (io.ReadCloser, error) {
+	if compression == GzipBundleCompression {
+		return gzip.NewReader(r)
+	}
+
+	var options []zstd.DOption
+	if len(dictionary) > 0 {
+		options = append(options, zstd.WithDecoderDicts(dictionary))
+	}
+	decoder, err := zstd.NewReader(r, options...)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// checkCompressedStraggler returns why a compressed file can't be read to the end, or nil if it can, or was
+// compressed with a dictionary other than zstd_dictionary.
+func checkCompressedStraggler(fp *os.File, compression string) error {
+	r, err := newBundleDecompressor(fp, compression, config.ZstdDictionary)
+	if err != nil {
+		return fmt.Errorf("the file is not %s compressed: %s", compression, err)
+	}
+	defer r.Close()
+
+	if _, err := io.Copy(ioutil.Discard, r); err != nil && !errors.Is(err, zstd.ErrUnknownDictionary) {
+		return fmt.Errorf("the file can't be decompressed: %s", err)
+	}
+	return nil
+}
+
+// trainZstdDictionary runs -train-zstd-dictionary: it builds a zstd dictionary from the events in the files at path,
+// which are read like those of -export, and writes it to outputFile.
+func trainZstdDictionary(path, outputFile string) error {
+	var events bytes.Buffer
+	summary, err := runEventExport(path, eventExportFilter{}, &events)
+	if err != nil {
+		return err
+	}
+	samples := bytes.Split(bytes.TrimSuffix(events.Bytes(), []byte("\n")), []byte("\n"))
+	if summary.Exported < zstdDictionaryMinSamples {
+		return fmt.Errorf("found %d events in %s: at least %d are needed to train a dictionary", summary.Exported,
+			path, zstdDictionaryMinSamples)
+	}
+
+	dictionary, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: zstdDictionarySize,
+		HashBytes:   6,
+		ZstdLevel:   config.ZstdLevel,
+	})
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(dictionary); err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote a %d byte dictionary trained on %d events from %d files to %s", len(dictionary),
+		summary.Exported, summary.Files, outputFile)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBundleCompression(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config = Configuration{ZstdLevel: zstd.SpeedDefault}
+
+	var lines strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&lines, `{"type":"ingress.event.netconn","timestamp":%d,"remote_ip":"10.1.2.%d","direction":"outbound",`+
+			`"process_guid":"00000001-0000-0a1c-01d4-%012d","cb_server":"cbserver"}`+"\n", 1788270000+i, i%250, i)
+	}
+
+	dir := t.TempDir()
+	samples := filepath.Join(dir, "samples", "event-forwarder.2026-09-01T13:00:00")
+	os.Mkdir(filepath.Dir(samples), 0700)
+	if err := ioutil.WriteFile(samples, []byte(lines.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dictionaryFile := filepath.Join(dir, "cb-events.dict")
+	if err := trainZstdDictionary(filepath.Dir(samples), dictionaryFile); err != nil {
+		t.Fatal(err)
+	}
+	dictionary, err := loadZstdDictionary(dictionaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ZstdDictionary = dictionary
+
+	bundles := filepath.Join(dir, "bundles")
+	os.Mkdir(bundles, 0700)
+	for i, test := range []struct {
+		compression string
+		indexed     bool
+	}{
+		{GzipBundleCompression, false},
+		{ZstdBundleCompression, false},
+		{ZstdBundleCompression, true},
+	} {
+		fileName := filepath.Join(bundles, fmt.Sprintf("event-forwarder.%d", i))
+		if err := ioutil.WriteFile(fileName, []byte(lines.String()), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if test.indexed {
+			if err := indexBundle(fileName); err != nil {
+				t.Fatal(err)
+			}
+		}
+		compressed, err := compressBundle(fileName, test.compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed != fileName+bundleCompressionSuffixes[test.compression] {
+			t.Errorf("%d: unexpected name %s", i, compressed)
+		}
+		if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+			t.Errorf("%d: expected the uncompressed bundle to be removed, got %v", i, err)
+		}
+		if err := checkStraggler(compressed); err != nil {
+			t.Errorf("%d: expected a compressed bundle to pass the straggler check, got %s", i, err)
+		}
+	}
+
+	filter, err := parseEventExportFilter("", "", "ingress.event.netconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	summary, err := runEventExport(bundles, filter, &out)
+	if err != nil || summary.Files != 3 || summary.Exported != 600 || out.String() != strings.Repeat(lines.String(), 3) {
+		t.Errorf("Unexpected export of compressed bundles %+v (%v)", summary, err)
+	}
+
+	// a bundle cut short by a crash can't be decompressed to the end
+	compressed := filepath.Join(bundles, "event-forwarder.1.zst")
+	b, err := ioutil.ReadFile(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(compressed, b[:len(b)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStraggler(compressed); err == nil {
+		t.Errorf("Expected a truncated compressed bundle to fail the straggler check")
+	}
+}
+
+func TestInterruptedBundleCompression(t *testing.T) {
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+
+	// a bundle compressed by a run that stopped before removing it, and one it was compressing
+	writing := filepath.Join(behavior.directory, writingSubdirectory)
+	os.Mkdir(writing, 0700)
+	compressed := filepath.Join(writing, "event-forwarder.2017-01-01T00:00:00")
+	compressing := filepath.Join(writing, "event-forwarder.2017-01-01T00:05:00")
+	for _, fn := range [...]string{compressed, compressing, compressing + compressedBundleTmpSuffix} {
+		if err := ioutil.WriteFile(fn, []byte(testBundleEvent), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := compressBundle(compressed, GzipBundleCompression); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(compressed, []byte(testBundleEvent), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	defer output.closeBundles()
+	var queued []string
+	for _, upload := range output.filesToUpload {
+		queued = append(queued, filepath.Base(upload.fileName))
+	}
+	if strings.Join(queued, ",") != "event-forwarder.2017-01-01T00:00:00.gz,event-forwarder.2017-01-01T00:05:00" {
+		t.Errorf("Expected the compressed copy and the bundle that wasn't compressed to be queued, got %v", queued)
+	}
+	if _, err := os.Stat(compressing + compressedBundleTmpSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial compressed copy to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files in the holding area are always named event-forwarder.<name>, so that files left by a previous run can be
+// recognized; with a bundle name template, <name> is the rendered template and is used as the uploaded name.
+const bundleFilePrefix = "event-forwarder."
+
+const defaultBundleTimestampLayout = "2006-01-02T15:04:05"
+
+var bundleNameToken = regexp.MustCompile(`\{([a-z_]+)(?::([^}]*))?\}`)
+
+// bundleNameFields are the values available to a bundle name template.
+type bundleNameFields struct {
+	Hostname  string
+	Tenant    string
+	EventType string
+	Sequence  int64
+	Timestamp time.Time
+}
+
+// validateBundleNameTemplate checks that a template only uses known tokens and renders to a single path component.
+func validateBundleNameTemplate(template string) error {
+	if strings.Contains(template, "/") {
+		return fmt.Errorf("bundle names cannot contain '/'; use object_prefix in [s3] for directories")
+	}
+	for _, match := range bundleNameToken.FindAllStringSubmatch(template, -1) {
+		switch match[1] {
+		case "hostname", "tenant", "event_type", "sequence", "timestamp":
+		default:
+			return fmt.Errorf("unknown token {%s}", match[1])
+		}
+	}
+	if rendered := bundleNameToken.ReplaceAllString(template, ""); strings.ContainsAny(rendered, "{}") {
+		return fmt.Errorf("unbalanced braces")
+	}
+	return nil
+}
+
+func renderBundleName(template string, fields bundleNameFields) string {
+	return bundleNameToken.ReplaceAllStringFunc(template, func(token string) string {
+		match := bundleNameToken.FindStringSubmatch(token)
+		switch match[1] {
+		case "hostname":
+			return fields.Hostname
+		case "tenant":
+			return fields.Tenant
+		case "event_type":
+			return fields.EventType
+		case "sequence":
+			if len(match[2]) > 0 {
+				// zero-padded to the given width
+				if width, err := strconv.Atoi(match[2]); err == nil {
+					return fmt.Sprintf("%0*d", width, fields.Sequence)
+				}
+			}
+			return strconv.FormatInt(fields.Sequence, 10)
+		case "timestamp":
+			layout := match[2]
+			if len(layout) == 0 {
+				layout = defaultBundleTimestampLayout
+			}
+			return fields.Timestamp.Format(layout)
+		}
+		return token
+	})
+}
+
+// renameBundle renames a rolled-over file in the writing directory to the name given by the output's template, adding
+// a numeric suffix if a file of that name is already waiting to be uploaded in the holding area.
+func (o *BundledOutput) renameBundle(fileName string, family string, started time.Time) (string, error) {
+	eventType := family
+	if len(eventType) == 0 {
+		eventType = "all"
+	}
+
+	o.bundleSequence++
+	name := renderBundleName(config.BundleNameTemplate, bundleNameFields{
+		Hostname:  o.hostname,
+		Tenant:    config.ServerName,
+		EventType: eventType,
+		Sequence:  o.bundleSequence,
+		Timestamp: started,
+	})
+
+	newName := bundleFilePrefix + name
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(o.tempFileDirectory, newName)); os.IsNotExist(err) {
+			break
+		}
+		newName = fmt.Sprintf("%s%s.%d", bundleFilePrefix, name, i)
+	}
+
+	newName = filepath.Join(filepath.Dir(fileName), newName)
+	if err := os.Rename(fileName, newName); err != nil {
+		return "", err
+	}
+	return newName, nil
+}
+
+// bundleUploadName returns the name a file in the holding area is uploaded as.
+func bundleUploadName(fileName string) string {
+	base := filepath.Base(fileName)
+	if len(config.BundleNameTemplate) > 0 {
+		return strings.TrimPrefix(base, bundleFilePrefix)
+	}
+	return base
+}
+
+// validateRemotePath checks that a template for the path bundles are uploaded to (as remote_path in [sftp] or
+// [ftps]) only uses the tokens it can: {name}, the bundle's name, and {hostname}, {tenant} and {timestamp}, the time
+// of the upload.
+func validateRemotePath(template string) error {
+	if !strings.Contains(template, "{name}") {
+		return errors.New("the remote path must include {name}, or bundles would overwrite each other")
+	}
+	for _, match := range bundleNameToken.FindAllStringSubmatch(template, -1) {
+		switch match[1] {
+		case "name", "hostname", "tenant", "timestamp":
+		default:
+			return fmt.Errorf("unknown token {%s}", match[1])
+		}
+	}
+	return nil
+}
+
+func renderRemotePath(template string, name string, fields bundleNameFields) string {
+	return bundleNameToken.ReplaceAllStringFunc(template, func(token string) string {
+		if match := bundleNameToken.FindStringSubmatch(token); match[1] == "name" {
+			return name
+		}
+		return renderBundleName(token, fields)
+	})
+}
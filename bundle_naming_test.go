@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenderBundleName(t *testing.T) {
+	fields := bundleNameFields{
+		Hostname:  "fwd-1",
+		Tenant:    "cbserver",
+		EventType: "all",
+		Sequence:  42,
+		Timestamp: time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	cases := map[string]string{
+		"{tenant}-{hostname}-{timestamp}-{sequence:6}.json": "cbserver-fwd-1-2017-03-04T05:06:07-000042.json",
+		"{event_type}.{timestamp:20060102-1504}":            "all.20170304-0506",
+		"static-{sequence}":                                 "static-42",
+	}
+	for template, expected := range cases {
+		if err := validateBundleNameTemplate(template); err != nil {
+			t.Errorf("Template %s rejected: %s", template, err)
+		}
+		if name := renderBundleName(template, fields); name != expected {
+			t.Errorf("Expected %s to render as %s, got %s", template, expected, name)
+		}
+	}
+
+	for _, template := range [...]string{"{customer}-{timestamp}", "{hostname}/{timestamp}", "{hostname"} {
+		if err := validateBundleNameTemplate(template); err == nil {
+			t.Errorf("Expected template %s to be rejected", template)
+		}
+	}
+}
+
+func TestBundleUploadName(t *testing.T) {
+	defer func(saved string) { config.BundleNameTemplate = saved }(config.BundleNameTemplate)
+
+	config.BundleNameTemplate = ""
+	name := bundleUploadName("/tmp/event-forwarder.2017-03-04T05:06:07")
+	if name != "event-forwarder.2017-03-04T05:06:07" {
+		t.Errorf("Unexpected upload name %s", name)
+	}
+
+	config.BundleNameTemplate = "{hostname}-{timestamp}.json"
+	name = bundleUploadName("/tmp/event-forwarder.fwd-1-2017-03-04T05:06:07.json")
+	if name != "fwd-1-2017-03-04T05:06:07.json" {
+		t.Errorf("Unexpected upload name %s", name)
+	}
+}
+
+func TestRenameBundle(t *testing.T) {
+	defer func(saved string) { config.BundleNameTemplate = saved }(config.BundleNameTemplate)
+	config.BundleNameTemplate = "{hostname}-{timestamp:20060102}"
+
+	dir, err := ioutil.TempDir("", "bundle_naming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := &BundledOutput{tempFileDirectory: dir, hostname: "fwd-1"}
+	started := time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	var names []string
+	for _, fn := range [...]string{"event-forwarder.a", "event-forwarder.b"} {
+		path := filepath.Join(dir, fn)
+		if err := ioutil.WriteFile(path, []byte(testBundleEvent), 0600); err != nil {
+			t.Fatal(err)
+		}
+		name, err := output.renameBundle(path, "", started)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.Base(name))
+	}
+
+	// the second file started at the same time gets a suffix rather than replacing the first
+	if names[0] != "event-forwarder.fwd-1-20170304" || names[1] != "event-forwarder.fwd-1-20170304.1" {
+		t.Errorf("Unexpected bundle names %v", names)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+// reorderMaxEvents is how many events a bundle holds back for reordering at most; beyond it, the earliest are
+// written, in order, however recent.
+const reorderMaxEvents = 100000
+
+type reorderedEvent struct {
+	message   string
+	timestamp time.Time
+	received  time.Time
+	// the order the event arrived in, so that events with the same timestamp keep it
+	sequence int64
+}
+
+type reorderHeap []reorderedEvent
+
+func (h reorderHeap) Len() int { return len(h) }
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].timestamp.Equal(h[j].timestamp) {
+		return h[i].sequence < h[j].sequence
+	}
+	return h[i].timestamp.Before(h[j].timestamp)
+}
+func (h reorderHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *reorderHeap) Push(x interface{}) { *h = append(*h, x.(reorderedEvent)) }
+func (h *reorderHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// reorderBuffer holds the events on their way into a bundle for up to bundle_reorder_window, so that they are written
+// in timestamp order: an event is written once an event more than the window later has arrived, or once it has waited
+// the window itself, whichever is first. Events that arrive more out of order than the window are written late,
+// out of order, rather than dropped. Events without a timestamp are ordered by when they arrived. The events held
+// are only in memory: if the forwarder is killed, they are lost, like events still queued for the output.
+type reorderBuffer struct {
+	window   time.Duration
+	events   reorderHeap
+	newest   time.Time
+	sequence int64
+
+	// updated atomically; read by the status page
+	held int64
+	late int64
+}
+
+func newReorderBuffer(window time.Duration) *reorderBuffer {
+	if window <= 0 {
+		return nil
+	}
+	return &reorderBuffer{window: window}
+}
+
+// add holds back a formatted event received at now.
+func (r *reorderBuffer) add(message string, now time.Time) {
+	_, timestamp, ok, _ := exportedEventFields(message)
+	if !ok {
+		timestamp = now
+	}
+	if timestamp.Before(r.newest.Add(-r.window)) {
+		atomic.AddInt64(&r.late, 1)
+	}
+	// an event from a sensor whose clock is far ahead is put in order, but doesn't move the others along further than
+	// the window from now, or reordering would stop until the clock caught up with it
+	newest := timestamp
+	if limit := now.Add(r.window); newest.After(limit) {
+		newest = limit
+	}
+	if newest.After(r.newest) {
+		r.newest = newest
+	}
+	r.sequence++
+	heap.Push(&r.events, reorderedEvent{message: message, timestamp: timestamp, received: now, sequence: r.sequence})
+	atomic.StoreInt64(&r.held, int64(len(r.events)))
+}
+
+// release returns the events that are ready to be written at now, in order.
+func (r *reorderBuffer) release(now time.Time) []string {
+	if r == nil {
+		return nil
+	}
+	var ready []string
+	for len(r.events) > 0 {
+		next := r.events[0]
+		if len(r.events) <= reorderMaxEvents && next.timestamp.After(r.newest.Add(-r.window)) &&
+			now.Sub(next.received) < r.window {
+			break
+		}
+		ready = append(ready, heap.Pop(&r.events).(reorderedEvent).message)
+	}
+	atomic.StoreInt64(&r.held, int64(len(r.events)))
+	return ready
+}
+
+// releaseAll returns every event held, in order.
+func (r *reorderBuffer) releaseAll() []string {
+	if r == nil {
+		return nil
+	}
+	ready := make([]string, 0, len(r.events))
+	for len(r.events) > 0 {
+		ready = append(ready, heap.Pop(&r.events).(reorderedEvent).message)
+	}
+	atomic.StoreInt64(&r.held, 0)
+	return ready
+}
+
+// statistics returns the number of events held and of those that arrived too late to be put in order. It is safe to
+// call while events are added.
+func (r *reorderBuffer) statistics() (int64, int64) {
+	if r == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&r.held), atomic.LoadInt64(&r.late)
+}
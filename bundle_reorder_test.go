@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func reorderTestEvent(timestamp int) string {
+	return fmt.Sprintf(`{"type":"ingress.event.procstart","timestamp":%d}`, timestamp)
+}
+
+func TestReorderBuffer(t *testing.T) {
+	r := newReorderBuffer(10 * time.Second)
+	now := time.Unix(1500000012, 0)
+
+	for _, timestamp := range []int{1500000005, 1500000001, 1500000003} {
+		r.add(reorderTestEvent(timestamp), now)
+	}
+	if ready := r.release(now); len(ready) != 0 {
+		t.Errorf("Expected the events to be held, got %v", ready)
+	}
+
+	// an event more than the window later lets the earlier events through, in order
+	r.add(reorderTestEvent(1500000012), now)
+	expected := []string{reorderTestEvent(1500000001)}
+	if ready := r.release(now); !reflect.DeepEqual(ready, expected) {
+		t.Errorf("Expected %v, got %v", expected, ready)
+	}
+
+	// an event far too late is counted, and written first
+	r.add(reorderTestEvent(1499999000), now)
+	if held, late := r.statistics(); held != 4 || late != 1 {
+		t.Errorf("Expected 4 events held and 1 late, got %d and %d", held, late)
+	}
+
+	// after waiting the window, every event is written
+	expected = []string{reorderTestEvent(1499999000), reorderTestEvent(1500000003), reorderTestEvent(1500000005),
+		reorderTestEvent(1500000012)}
+	if ready := r.release(now.Add(10 * time.Second)); !reflect.DeepEqual(ready, expected) {
+		t.Errorf("Expected %v, got %v", expected, ready)
+	}
+	if held, _ := r.statistics(); held != 0 {
+		t.Errorf("Expected no events held, got %d", held)
+	}
+
+	// events without a timestamp keep the order they arrived in
+	r.add("LEEF:1.0|CB|CB|5.1|ingress.event.procstart|cb_version=624", now)
+	r.add("LEEF:1.0|CB|CB|5.1|ingress.event.netconn|cb_version=624", now)
+	if ready := r.releaseAll(); len(ready) != 2 || !strings.Contains(ready[0], "procstart") {
+		t.Errorf("Expected the events in the order they arrived, got %v", ready)
+	}
+
+	// an event from far in the future is held like the others, and doesn't let the events after it through
+	r.add(reorderTestEvent(1600000000), now)
+	r.add(reorderTestEvent(1500000019), now)
+	r.add(reorderTestEvent(1500000020), now)
+	if ready := r.release(now); len(ready) != 0 {
+		t.Errorf("Expected the events to be held, got %v", ready)
+	}
+	expected = []string{reorderTestEvent(1500000019), reorderTestEvent(1500000020), reorderTestEvent(1600000000)}
+	if ready := r.release(now.Add(10 * time.Second)); !reflect.DeepEqual(ready, expected) {
+		t.Errorf("Expected %v, got %v", expected, ready)
+	}
+
+	if newReorderBuffer(0) != nil {
+		t.Error("Expected no buffer without a window")
+	}
+}
+
+func TestBundledOutputReorder(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.BundleReorderWindow = time.Hour
+
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	defer output.closeBundles()
+
+	for _, timestamp := range []int{1500000003, 1500000001, 1500000002} {
+		if err := output.output(reorderTestEvent(timestamp)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := output.Snapshot(); stats.EventsHeld != 3 {
+		t.Errorf("Expected 3 events held, got %+v", stats)
+	}
+
+	if err := output.writeReordered(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(behavior.directory, writingSubdirectory, "event-forwarder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := reorderTestEvent(1500000001) + "\n" + reorderTestEvent(1500000002) + "\n" +
+		reorderTestEvent(1500000003) + "\n"
+	if string(b) != expected {
+		t.Errorf("Expected the events in timestamp order, got %q", b)
+	}
+}
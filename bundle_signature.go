@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// The detached signature of a bundle is kept next to it, in a file with the same name and this suffix, and uploaded
+// with it.
+const signatureSuffix = ".sig"
+
+func signaturePath(fileName string) string {
+	return fileName + signatureSuffix
+}
+
+func isSignatureFile(fileName string) bool {
+	return strings.HasSuffix(fileName, signatureSuffix)
+}
+
+// loadSigningKey reads a PEM private key: RSA (PKCS #1 or PKCS #8), ECDSA (SEC 1 or PKCS #8) or Ed25519 (PKCS #8).
+func loadSigningKey(fileName string) (crypto.Signer, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not hold a PEM private key", fileName)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("%s does not hold a signing key", fileName)
+	}
+	return nil, fmt.Errorf("%s holds a %s, not a private key", fileName, block.Type)
+}
+
+// signBundle writes the detached signature of the bundle at fileName. The signature is of the file's contents in
+// the form openssl produces and checks: with an RSA or ECDSA key, of their SHA-256 digest (RSA with PKCS #1 v1.5
+// padding), and with an Ed25519 key, of the contents themselves.
+func signBundle(signer crypto.Signer, fileName string) error {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	var signature []byte
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		signature, err = signer.Sign(rand.Reader, contents, crypto.Hash(0))
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		digest := sha256.Sum256(contents)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		err = errors.New("unsupported key type")
+	}
+	if err != nil {
+		return fmt.Errorf("could not sign %s: %s", fileName, err)
+	}
+
+	// written through a temporary file, so that a crash never leaves a truncated signature behind
+	tmpName := signaturePath(fileName) + ".tmp"
+	if err := ioutil.WriteFile(tmpName, signature, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, signaturePath(fileName))
+}
+
+func removeSignature(fileName string) {
+	if err := os.Remove(signaturePath(fileName)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing signature for %s: %s", fileName, err.Error())
+	}
+}
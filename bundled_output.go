@@ -0,0 +1,900 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// UploadBehavior is implemented by outputs that collect events into files and upload each file as a whole. The
+// BundledOutput takes care of writing the files, rolling them over and retrying failed uploads.
+type UploadBehavior interface {
+	// Initialize parses the output's connection string and returns the directory used to hold files until they
+	// have been uploaded.
+	Initialize(connString string) (string, error)
+	// Upload sends the contents of fp, which holds the events written to fileName. The BundledOutput closes fp and
+	// removes the file after a successful upload. The upload should be abandoned if ctx is cancelled.
+	Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus
+	// Statistics returns destination-specific information for the status page.
+	Statistics() interface{}
+	Key() string
+	String() string
+}
+
+type UploadStatus struct {
+	fileName string
+	result   error
+
+	// the size of the file, filled in by the BundledOutput
+	size int64
+}
+
+type BundledOutput struct {
+	behavior UploadBehavior
+
+	tempFileDirectory string
+	rollOverDuration  time.Duration
+	uploadTimeout     time.Duration
+	maxFileSize       int64
+
+	// files smaller than minFileSize are kept open past their roll over time, until they are maxFileAge old; empty
+	// files are not uploaded at all
+	minFileSize int64
+	maxFileAge  time.Duration
+
+	// how often temp files are synced to disk
+	syncPolicy fileSyncPolicy
+
+	// the files events are being written to, by event type family; changed by the output's goroutine while holding
+	// the lock, so that Snapshot can read it
+	bundles          map[string]*bundleFile
+	splitByEventType bool
+
+	// with alignRollOver, files are rolled over at multiples of rollOverDuration (on the hour, at :05, ...)
+	alignRollOver bool
+
+	// set with bundle_rollover_mode=adaptive, to roll over files holding urgent events sooner
+	adaptive        *adaptiveRollOver
+	urgentRollOvers int64
+
+	// signs each file as it is rolled over, if bundle_signing_key is set
+	signer crypto.Signer
+
+	// notified of each upload, if [upload_hooks] has any
+	hooks *uploadHooks
+
+	// set with watch_holding_area, to pick up files dropped into the holding area while the forwarder runs
+	watch *holdingAreaWatch
+
+	// when the holding area was last checked for files older than holding_area_max_age
+	lastExpiryCheck time.Time
+
+	// used to render config.BundleNameTemplate
+	hostname       string
+	bundleSequence int64
+
+	// updated atomically; read by the status page
+	uploadErrors      int64
+	successfulUploads int64
+	filesQuarantined  int64
+	filesExpired      int64
+
+	fileResultChan chan UploadStatus
+	loop           *outputLoop
+
+	// the lock protects the upload queue and error details, which are read by the status page while the output's
+	// goroutine updates them
+	lastUploadError         string
+	lastUploadErrorTime     time.Time
+	lastUploadErrorCategory UploadErrorCategory
+	errorsByCategory        map[UploadErrorCategory]int64
+	filesToUpload           []*queuedUpload
+	uploadsInProgress       map[string]*queuedUpload
+	sync.RWMutex
+}
+
+// queuedUpload is a file in the holding area waiting to be uploaded. Files that failed with an error that is not
+// retried are held until the forwarder restarts. While the file is being uploaded, deadline and cancel belong to the
+// context passed to the UploadBehavior.
+type queuedUpload struct {
+	fileName    string
+	attempts    int
+	nextAttempt time.Time
+	held        bool
+
+	deadline time.Time
+	cancel   context.CancelFunc
+
+	// the events in the file whose latency is measured, delivered once it has been uploaded
+	latency latencyBatch
+}
+
+type BundleStatistics struct {
+	FilesUploaded     int64                  `json:"files_uploaded"`
+	FilesQuarantined  int64                  `json:"files_quarantined"`
+	FilesExpired      int64                  `json:"files_expired"`
+	UrgentRollOvers   int64                  `json:"urgent_rollovers,omitempty"`
+	EventsHeld        int64                  `json:"reorder_events_held,omitempty"`
+	LateEvents        int64                  `json:"reorder_late_events,omitempty"`
+	FilesQueued       int                    `json:"files_queued"`
+	FilesHeld         int                    `json:"files_held"`
+	UploadsInProgress int                    `json:"uploads_in_progress"`
+	StuckUploads      int                    `json:"stuck_uploads"`
+	UploadErrors      int64                  `json:"upload_errors"`
+	ErrorsByCategory  map[string]int64       `json:"upload_errors_by_category"`
+	LastErrorTime     time.Time              `json:"last_error_time"`
+	LastErrorText     string                 `json:"last_error_text"`
+	LastErrorCategory string                 `json:"last_error_category"`
+	HoldingArea       interface{}            `json:"file_holding_area"`
+	EventTypeFiles    map[string]interface{} `json:"event_type_files,omitempty"`
+	StorageStats      interface{}            `json:"storage_statistics"`
+	Signed            bool                   `json:"files_signed"`
+}
+
+func NewBundledOutput(behavior UploadBehavior) *BundledOutput {
+	return &BundledOutput{behavior: behavior}
+}
+
+func (o *BundledOutput) uploadOne(ctx context.Context, fileName string) {
+	if o.signer != nil {
+		// files left by a run without signing, or whose signature could not be written when they were rolled over
+		if _, err := os.Stat(signaturePath(fileName)); os.IsNotExist(err) {
+			if err = signBundle(o.signer, fileName); err != nil {
+				o.reportUpload(o.loop.ctx, UploadStatus{fileName: fileName, result: err})
+				return
+			}
+		}
+	}
+
+	fp, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
+	if err != nil {
+		o.reportUpload(o.loop.ctx, UploadStatus{fileName: fileName, result: err})
+		return
+	}
+
+	var size int64
+	if info, err := fp.Stat(); err == nil {
+		size = info.Size()
+	}
+	uploadStatus := o.behavior.Upload(ctx, fileName, fp)
+	fp.Close()
+
+	if uploadStatus.result == nil && o.signer != nil {
+		uploadStatus = o.uploadSignature(ctx, fileName)
+	}
+
+	if uploadStatus.result == nil {
+		err = os.Remove(fileName)
+		if err != nil {
+			log.Printf("error removing %s: %s", fileName, err.Error())
+		}
+		removeRetryState(fileName)
+		removeSignature(fileName)
+	}
+
+	uploadStatus.size = size
+	o.reportUpload(o.loop.ctx, uploadStatus)
+}
+
+// uploadSignature uploads the signature of fileName next to it. A failure is reported against the bundle, so that
+// both are uploaded again.
+func (o *BundledOutput) uploadSignature(ctx context.Context, fileName string) UploadStatus {
+	fp, err := os.Open(signaturePath(fileName))
+	if err != nil {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+	defer fp.Close()
+
+	uploadStatus := o.behavior.Upload(ctx, signaturePath(fileName), fp)
+	return UploadStatus{fileName: fileName, result: uploadStatus.result}
+}
+
+// notifyHooks tells the upload hooks, if there are any, the result of an upload.
+func (o *BundledOutput) notifyHooks(uploadStatus UploadStatus, category UploadErrorCategory, retrying bool) {
+	if o.hooks == nil {
+		return
+	}
+
+	notification := UploadNotification{
+		Result:      "success",
+		FileName:    bundleUploadName(uploadStatus.fileName),
+		Size:        uploadStatus.size,
+		Destination: o.behavior.String(),
+		Time:        time.Now(),
+	}
+	if uploadStatus.result != nil {
+		notification.Result = "failure"
+		notification.Error = uploadStatus.result.Error()
+		notification.ErrorCategory = category.String()
+		notification.Retrying = retrying
+	}
+	o.hooks.notify(notification)
+}
+
+// reportUpload passes the result of an upload back to the output's goroutine, unless the output has stopped.
+func (o *BundledOutput) reportUpload(ctx context.Context, uploadStatus UploadStatus) {
+	select {
+	case o.fileResultChan <- uploadStatus:
+	case <-ctx.Done():
+		if uploadStatus.result != nil {
+			log.Printf("Upload of %s abandoned: %s", uploadStatus.fileName, uploadStatus.result)
+		}
+	}
+}
+
+// isHoldingAreaBundle reports whether fn, in the holding area, is a file of events waiting to be uploaded.
+func isHoldingAreaBundle(fn string) bool {
+	if !strings.HasPrefix(fn, "event-forwarder") || isRetryStateFile(fn) || isSignatureFile(fn) {
+		return false
+	}
+	// skip retry state being saved
+	return !strings.HasSuffix(fn, retryStateSuffix+".tmp") && !strings.HasSuffix(fn, signatureSuffix+".tmp") &&
+		!strings.HasSuffix(fn, indexedBundleTmpSuffix) && !strings.HasSuffix(fn, compressedBundleTmpSuffix)
+}
+
+// splitTempFileDirectory splits the (temp-file-directory): that may start the connection string of an uploading
+// output from the rest, which starts with scheme:// if scheme is set. Without one, files are held in
+// /var/cb/data/event-forwarder.
+func splitTempFileDirectory(connString, scheme string) (string, string) {
+	if len(scheme) == 0 || !strings.HasPrefix(connString, scheme+"://") {
+		if parts := strings.SplitN(connString, ":", 2); len(parts) == 2 {
+			return parts[0], parts[1]
+		}
+	}
+	return "/var/cb/data/event-forwarder", connString
+}
+
+// queueStragglers adds files left in the holding area by a previous run to the upload queue, restoring their retry
+// state. Files are queued in order of their next attempt, oldest file first, so the backlog is worked through in the
+// same order after every restart. Files that are corrupt are moved to the quarantine instead; see checkStraggler.
+func (o *BundledOutput) queueStragglers() {
+	files := make(map[string]bool)
+	var retryStates, signatures []string
+
+	// files in subdirectories are picked up too (left there by an operator, or an older layout), apart from the
+	// quarantine, expired files, the files being written and the S3 output's index objects
+	quarantine := filepath.Join(o.tempFileDirectory, quarantineDirectory)
+	archive := o.archiveDirectory()
+	writing := o.writingDirectory()
+	index := filepath.Join(o.tempFileDirectory, s3IndexDirectory)
+	filepath.Walk(o.tempFileDirectory, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if fileName == quarantine || fileName == archive || fileName == writing || fileName == index {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		fn := info.Name()
+		if !strings.HasPrefix(fn, "event-forwarder") {
+			return nil
+		}
+
+		if isRetryStateFile(fn) {
+			retryStates = append(retryStates, fileName)
+			return nil
+		}
+		if isSignatureFile(fn) {
+			signatures = append(signatures, fileName)
+			return nil
+		}
+		// a bundle that was being indexed when the forwarder stopped is still there as lines
+		if strings.HasSuffix(fn, indexedBundleTmpSuffix) {
+			os.Remove(fileName)
+			return nil
+		}
+
+		if isHoldingAreaBundle(fn) {
+			files[fileName] = true
+		}
+		return nil
+	})
+
+	// retry state or a signature for a file that no longer exists was left behind by an interrupted upload
+	for _, fileName := range retryStates {
+		if !files[strings.TrimSuffix(fileName, retryStateSuffix)] {
+			os.Remove(fileName)
+		}
+	}
+	for _, fileName := range signatures {
+		if !files[strings.TrimSuffix(fileName, signatureSuffix)] {
+			os.Remove(fileName)
+		}
+	}
+
+	uploads := make([]*queuedUpload, 0, len(files))
+	for fileName := range files {
+		if err := checkStraggler(fileName); err != nil {
+			o.quarantine(fileName, err)
+			continue
+		}
+		uploads = append(uploads, loadRetryState(fileName))
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if !uploads[i].nextAttempt.Equal(uploads[j].nextAttempt) {
+			return uploads[i].nextAttempt.Before(uploads[j].nextAttempt)
+		}
+		// by name rather than path, so that files in subdirectories take their place in time
+		if a, b := filepath.Base(uploads[i].fileName), filepath.Base(uploads[j].fileName); a != b {
+			return a < b
+		}
+		return uploads[i].fileName < uploads[j].fileName
+	})
+
+	o.Lock()
+	defer o.Unlock()
+
+	o.filesToUpload = append(o.filesToUpload, uploads...)
+}
+
+func (o *BundledOutput) Initialize(connString string) error {
+	o.fileResultChan = make(chan UploadStatus)
+	o.filesToUpload = make([]*queuedUpload, 0)
+	o.uploadsInProgress = make(map[string]*queuedUpload)
+	o.errorsByCategory = make(map[UploadErrorCategory]int64)
+
+	// maximum file size before we trigger an upload is ~10MB.
+	o.maxFileSize = 10 * 1024 * 1024
+
+	// roll over duration defaults to five minutes
+	o.rollOverDuration = 5 * time.Minute
+	if config.BundleRollOverInterval > 0 {
+		o.rollOverDuration = config.BundleRollOverInterval
+	}
+	o.alignRollOver = config.BundleAlignRollOver
+	if o.adaptive = newAdaptiveRollOver(); o.adaptive != nil {
+		o.rollOverDuration = config.BundleBulkRollOverInterval
+	}
+	o.minFileSize = config.BundleMinSize
+	o.maxFileAge = config.BundleMaxAge
+	o.syncPolicy = fileSyncPolicy{
+		mode:     config.TempFileSync,
+		bytes:    config.TempFileSyncBytes,
+		interval: config.TempFileSyncInterval,
+	}
+	o.splitByEventType = config.BundleByEventType
+	o.bundles = make(map[string]*bundleFile)
+
+	o.uploadTimeout = config.UploadTimeout
+	if o.uploadTimeout <= 0 {
+		o.uploadTimeout = 5 * time.Minute
+	}
+
+	var err error
+	if len(config.BundleSigningKey) > 0 {
+		if o.signer, err = loadSigningKey(config.BundleSigningKey); err != nil {
+			return fmt.Errorf("Could not load bundle_signing_key: %s", err)
+		}
+		if err = checkFIPSSigningKey(o.signer); err != nil {
+			return fmt.Errorf("Could not use bundle_signing_key: %s", err)
+		}
+	}
+	if o.hooks, err = newUploadHooks(config.UploadHooks); err != nil {
+		return err
+	}
+	o.tempFileDirectory, err = o.behavior.Initialize(connString)
+	if err != nil {
+		return err
+	}
+
+	if len(config.BundleNameTemplate) > 0 {
+		if o.hostname, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	if err = os.MkdirAll(o.tempFileDirectory, 0700); err != nil {
+		return err
+	}
+	if err = o.adoptWritingDirectory(); err != nil {
+		return err
+	}
+
+	// events of unknown type go to the default file even when bundles are split by event type
+	if _, err = o.openBundle(""); err != nil {
+		return err
+	}
+	err = o.openFamilyBundles()
+
+	// find files in the output directory that haven't been uploaded yet and add them to the list
+	// we ignore any errors that may occur during this process
+	o.queueStragglers()
+
+	return err
+}
+
+func (o *BundledOutput) output(message string) error {
+	b, err := o.bundleFor(message)
+	if err != nil {
+		return err
+	}
+	if b.reorder == nil {
+		return o.write(b, message)
+	}
+
+	now := time.Now()
+	b.reorder.add(message, now)
+	return o.writeEvents(b, b.reorder.release(now))
+}
+
+// write appends a message to a bundle, first rolling it over if the message would make it too big.
+func (o *BundledOutput) write(b *bundleFile, message string) error {
+	if b.size+int64(len(message)) > o.maxFileSize {
+		err := o.rollOver(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	// first try to write the message to our output file
+	b.size += int64(len(message))
+	o.adaptive.noteMessage(b, message)
+	if c, received, ok := latencySLOs.take(message); ok {
+		b.latency = b.latency.add(c, received)
+	}
+	return b.output.output(message)
+}
+
+func (o *BundledOutput) writeEvents(b *bundleFile, messages []string) error {
+	for _, message := range messages {
+		if err := o.write(b, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReordered writes the events of every bundle held back for reordering.
+func (o *BundledOutput) writeReordered() error {
+	for _, b := range o.bundles {
+		if err := o.writeEvents(b, b.reorder.releaseAll()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextPartitionEnd returns the first rollover boundary after now. Boundaries are multiples of the rollover duration
+// since the zero time, so they fall on the same minutes past the hour (or, for a duration of a day, at midnight UTC)
+// on every forwarder.
+func (o *BundledOutput) nextPartitionEnd(now time.Time) time.Time {
+	if o.rollOverDuration <= 0 {
+		return now
+	}
+	return now.Truncate(o.rollOverDuration).Add(o.rollOverDuration)
+}
+
+func (o *BundledOutput) rollOverDue(b *bundleFile, now time.Time) bool {
+	if o.adaptive.due(b, now) {
+		return true
+	}
+
+	// during quiet periods, keep appending to a small file rather than uploading lots of nearly empty ones
+	if b.size < o.minFileSize {
+		if b.size == 0 || o.maxFileAge <= 0 {
+			return false
+		}
+		return now.Sub(b.output.lastRolledOver) >= o.maxFileAge
+	}
+
+	if o.alignRollOver {
+		return !now.Before(b.partitionEnd)
+	}
+	return now.Sub(b.output.lastRolledOver) > o.rollOverDuration
+}
+
+func (o *BundledOutput) rollOver(b *bundleFile) error {
+	started := b.output.lastRolledOver
+	fn, err := b.output.rollOverFile("2006-01-02T15:04:05")
+
+	if err != nil {
+		return err
+	}
+
+	if len(config.BundleNameTemplate) > 0 {
+		if fn, err = o.renameBundle(fn, b.family, started); err != nil {
+			return err
+		}
+	}
+
+	if config.BundleFormat == IndexedBundleFormat {
+		if err := indexBundle(fn); err != nil {
+			log.Printf("Could not index %s: %s; uploading it as lines", fn, err)
+		}
+	}
+	if config.BundleCompression != NoBundleCompression {
+		if fn, err = compressBundle(fn, config.BundleCompression); err != nil {
+			log.Printf("Could not compress %s: %s; uploading it uncompressed", fn, err)
+		}
+	}
+
+	// sign the file as soon as it is complete; if that fails, it is signed before it is uploaded
+	if o.signer != nil {
+		if err := signBundle(o.signer, fn); err != nil {
+			log.Printf("Error signing %s: %s", fn, err)
+		}
+	}
+
+	// only now does the file appear in the holding area, complete
+	if fn, err = o.handOff(fn); err != nil {
+		return err
+	}
+
+	if o.alignRollOver {
+		now := time.Now()
+		if !now.Before(b.partitionEnd) {
+			// name the new file after the start of its partition rather than the moment it was opened
+			b.output.lastRolledOver = now.Truncate(o.rollOverDuration)
+			b.partitionEnd = o.nextPartitionEnd(now)
+		}
+	}
+
+	o.startUpload(&queuedUpload{fileName: fn, latency: b.latency})
+	b.size, b.latency = 0, nil
+	if b.urgent {
+		atomic.AddInt64(&o.urgentRollOvers, 1)
+		b.urgent = false
+	}
+
+	// a family file reopened from a run with split bundles receives no more events
+	if len(b.family) > 0 && !o.splitByEventType {
+		b.output.close()
+		os.Remove(b.output.outputFileName)
+		o.Lock()
+		delete(o.bundles, b.family)
+		o.Unlock()
+	}
+
+	return nil
+}
+
+// rollOverBundles rolls over every bundle, with all the events held back for reordering, or with due set only those
+// whose time is up, with the held events that are ready.
+func (o *BundledOutput) rollOverBundles(due bool) error {
+	now := time.Now()
+	for _, b := range o.bundles {
+		var held []string
+		if due {
+			held = b.reorder.release(now)
+		} else {
+			held = b.reorder.releaseAll()
+		}
+		if err := o.writeEvents(b, held); err != nil {
+			return err
+		}
+		if due && !o.rollOverDue(b, now) {
+			continue
+		}
+		if err := o.rollOver(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *BundledOutput) syncBundles(now time.Time) error {
+	for _, b := range o.bundles {
+		if err := b.output.syncIfDue(now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *BundledOutput) closeBundles() {
+	for _, b := range o.bundles {
+		b.output.close()
+	}
+}
+
+func (o *BundledOutput) Key() string {
+	return fmt.Sprintf("%s:%s", o.behavior.Key(), o.tempFileDirectory)
+}
+
+func (o *BundledOutput) String() string {
+	return o.behavior.String()
+}
+
+// ConfirmsDelivery reports that the events written to a bundle are delivered when it has been uploaded.
+func (o *BundledOutput) ConfirmsDelivery() bool {
+	return true
+}
+
+// nextUpload removes and returns the first file in the upload queue that is due to be retried.
+func (o *BundledOutput) nextUpload(now time.Time) (*queuedUpload, bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	for i, upload := range o.filesToUpload {
+		if upload.held || upload.nextAttempt.After(now) {
+			continue
+		}
+		o.filesToUpload = append(o.filesToUpload[:i], o.filesToUpload[i+1:]...)
+		return upload, true
+	}
+	return nil, false
+}
+
+// startUpload uploads a file in a new goroutine. The upload is cancelled if it takes longer than the upload timeout,
+// when CancelUpload is called for the file, or when the output shuts down.
+func (o *BundledOutput) startUpload(upload *queuedUpload) {
+	ctx, cancel := context.WithTimeout(o.loop.ctx, o.uploadTimeout)
+
+	o.Lock()
+	upload.deadline, _ = ctx.Deadline()
+	upload.cancel = cancel
+	o.uploadsInProgress[upload.fileName] = upload
+	o.Unlock()
+
+	logDebugf("Uploading %s to %s (attempt %d)", upload.fileName, o.behavior.String(), upload.attempts+1)
+	go o.uploadOne(ctx, upload.fileName)
+}
+
+func (o *BundledOutput) finishUpload(fileName string) *queuedUpload {
+	o.Lock()
+	defer o.Unlock()
+
+	upload, ok := o.uploadsInProgress[fileName]
+	if !ok {
+		return &queuedUpload{fileName: fileName}
+	}
+	upload.cancel()
+	upload.cancel = nil
+	delete(o.uploadsInProgress, fileName)
+	return upload
+}
+
+// CancelUpload cancels the upload of fileName if it is in progress. The file is retried later like any other failed
+// upload.
+func (o *BundledOutput) CancelUpload(fileName string) bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	upload, ok := o.uploadsInProgress[fileName]
+	if ok {
+		upload.cancel()
+	}
+	return ok
+}
+
+// recordUploadError classifies a failed upload and requeues the file according to the retry policy for its category.
+func (o *BundledOutput) recordUploadError(fileName string, err error) (UploadErrorCategory, *queuedUpload) {
+	category := classifyUploadError(o.behavior, err)
+	policy := uploadRetryPolicies[category]
+
+	upload := o.finishUpload(fileName)
+	upload.attempts++
+	if policy.retry {
+		upload.nextAttempt = time.Now().Add(policy.delay(upload.attempts))
+	} else {
+		upload.held = true
+	}
+
+	if saveErr := saveRetryState(upload, category, err); saveErr != nil {
+		log.Printf("error saving retry state for %s: %s", fileName, saveErr.Error())
+	}
+
+	atomic.AddInt64(&o.uploadErrors, 1)
+	uploadErrorCategories.Add(category.String(), 1)
+	recentErrors.add(ErrorCategoryUpload, fmt.Sprintf("Could not upload %s (%s error): %s", filepath.Base(fileName),
+		category, err))
+
+	o.Lock()
+	defer o.Unlock()
+
+	o.lastUploadError = err.Error()
+	o.lastUploadErrorTime = time.Now()
+	o.lastUploadErrorCategory = category
+	o.errorsByCategory[category]++
+	o.filesToUpload = append(o.filesToUpload, upload)
+
+	return category, upload
+}
+
+func (o *BundledOutput) Flush(ctx context.Context) error {
+	return o.loop.Flush(ctx)
+}
+
+// Snapshot returns a consistent copy of the output's statistics. It is safe to call while the output is running.
+func (o *BundledOutput) Snapshot() BundleStatistics {
+	o.RLock()
+	defer o.RUnlock()
+
+	stats := BundleStatistics{
+		FilesUploaded:     atomic.LoadInt64(&o.successfulUploads),
+		FilesQuarantined:  atomic.LoadInt64(&o.filesQuarantined),
+		FilesExpired:      atomic.LoadInt64(&o.filesExpired),
+		UrgentRollOvers:   atomic.LoadInt64(&o.urgentRollOvers),
+		UploadsInProgress: len(o.uploadsInProgress),
+		UploadErrors:      atomic.LoadInt64(&o.uploadErrors),
+		ErrorsByCategory:  make(map[string]int64),
+		LastErrorTime:     o.lastUploadErrorTime,
+		LastErrorText:     o.lastUploadError,
+		StorageStats:      o.behavior.Statistics(),
+		Signed:            o.signer != nil,
+	}
+	for _, upload := range o.filesToUpload {
+		if upload.held {
+			stats.FilesHeld++
+		} else {
+			stats.FilesQueued++
+		}
+	}
+	// an upload is stuck if it is still running after its context expired: the UploadBehavior is ignoring cancellation
+	now := time.Now()
+	for _, upload := range o.uploadsInProgress {
+		if now.After(upload.deadline) {
+			stats.StuckUploads++
+		}
+	}
+	for category, count := range o.errorsByCategory {
+		stats.ErrorsByCategory[category.String()] = count
+	}
+	if len(o.lastUploadError) > 0 {
+		stats.LastErrorCategory = o.lastUploadErrorCategory.String()
+	}
+	for family, b := range o.bundles {
+		held, late := b.reorder.statistics()
+		stats.EventsHeld += held
+		stats.LateEvents += late
+		if len(family) == 0 {
+			stats.HoldingArea = b.output.Statistics()
+			continue
+		}
+		if stats.EventTypeFiles == nil {
+			stats.EventTypeFiles = make(map[string]interface{})
+		}
+		stats.EventTypeFiles[family] = b.output.Statistics()
+	}
+	return stats
+}
+
+func (o *BundledOutput) Statistics() interface{} {
+	return o.Snapshot()
+}
+
+// Shutdown stops the output without waiting for uploads in progress. The current file is left in the holding area
+// and, like any files that were not uploaded, is picked up again when the forwarder restarts. The upload hooks are
+// given the time to send the notifications they have queued.
+func (o *BundledOutput) Shutdown() error {
+	o.loop.Shutdown()
+	o.closeBundles()
+	if o.hooks != nil && o.loop != nil {
+		o.hooks.wait()
+	}
+	return nil
+}
+
+func (o *BundledOutput) Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error {
+	if _, ok := o.bundles[""]; !ok {
+		return errors.New(o.behavior.String() + " output not initialized")
+	}
+
+	o.loop = newOutputLoop(ctx)
+	if o.hooks != nil {
+		go o.hooks.run(o.loop.ctx)
+	}
+	if config.WatchHoldingArea {
+		watch, err := newHoldingAreaWatch(o.tempFileDirectory)
+		if err != nil {
+			log.Printf("Could not watch %s for new files: %s", o.tempFileDirectory, err)
+		} else {
+			o.watch = watch
+		}
+	}
+
+	go func() {
+		defer o.loop.exited()
+
+		refreshTicker := time.NewTicker(1 * time.Second)
+		defer refreshTicker.Stop()
+		defer o.closeBundles()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		defer signal.Stop(hup)
+		defer o.watch.close()
+
+		for {
+			select {
+			case <-o.loop.ctx.Done():
+				if err := drainMessages(messages, o.output); err != nil {
+					log.Printf("Error writing to %s during shutdown: %s", o.tempFileDirectory, err)
+				}
+				if err := o.writeReordered(); err != nil {
+					log.Printf("Error writing to %s during shutdown: %s", o.tempFileDirectory, err)
+				}
+				return
+
+			case message := <-messages:
+				if err := o.output(message); err != nil {
+					errorChan <- err
+					return
+				}
+
+			case <-refreshTicker.C:
+				if err := o.syncBundles(time.Now()); err != nil {
+					errorChan <- err
+					return
+				}
+
+				if err := o.rollOverBundles(true); err != nil {
+					errorChan <- err
+					return
+				}
+
+				o.queueSettledFiles(time.Now())
+				o.expireFiles(time.Now())
+				if upload, ok := o.nextUpload(time.Now()); ok {
+					o.startUpload(upload)
+				}
+
+			case event, ok := <-o.watch.events():
+				if ok {
+					o.watch.noticeFile(event, time.Now())
+				} else {
+					o.watch = nil
+				}
+
+			case err := <-o.watch.errors():
+				log.Printf("Error watching %s for new files: %s", o.tempFileDirectory, err)
+
+			case fileResult := <-o.fileResultChan:
+				if fileResult.result != nil {
+					category, upload := o.recordUploadError(fileResult.fileName, fileResult.result)
+					if upload.held {
+						log.Printf("Error uploading file %s (%s): %s. The file will not be retried.", fileResult.fileName,
+							category, fileResult.result)
+					} else {
+						log.Printf("Error uploading file %s (%s): %s. Retrying at %s.", fileResult.fileName, category,
+							fileResult.result, upload.nextAttempt.Format(time.RFC3339))
+					}
+					o.notifyHooks(fileResult, category, !upload.held)
+				} else {
+					upload := o.finishUpload(fileResult.fileName)
+					latencySLOs.deliveredBatch(upload.latency, time.Now())
+					atomic.AddInt64(&o.successfulUploads, 1)
+					log.Printf("Successfully uploaded file %s to %s.", fileResult.fileName, o.behavior.String())
+					o.notifyHooks(fileResult, UploadErrorUnknown, false)
+				}
+
+			case <-hup:
+				// flush to the destination immediately
+				log.Printf("Received SIGHUP, sending data to %s immediately.", o.behavior.String())
+				if err := o.rollOverBundles(false); err != nil {
+					errorChan <- err
+					return
+				}
+
+			case result := <-o.loop.flushes:
+				log.Printf("Flush requested, sending data to %s immediately.", o.behavior.String())
+				err := o.rollOverBundles(false)
+				result <- err
+				if err != nil {
+					errorChan <- err
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
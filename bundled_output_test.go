@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the contents of the bundles tests leave in the holding area; stragglers must hold whole events to be uploaded
+const testBundleEvent = "{\"type\":\"ingress.event.procstart\"}\n"
+
+// testUploadBehavior records uploads; if block is set, each upload waits for its context to be cancelled.
+type testUploadBehavior struct {
+	directory string
+	block     bool
+	uploads   chan string
+	cancelled chan string
+}
+
+func newTestUploadBehavior(t *testing.T, block bool) *testUploadBehavior {
+	dir, err := ioutil.TempDir("", "bundled_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testUploadBehavior{
+		directory: dir,
+		block:     block,
+		uploads:   make(chan string, 10),
+		cancelled: make(chan string, 10),
+	}
+}
+
+func (b *testUploadBehavior) Initialize(connString string) (string, error) {
+	return b.directory, nil
+}
+
+func (b *testUploadBehavior) Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus {
+	b.uploads <- fileName
+	if b.block {
+		<-ctx.Done()
+		b.cancelled <- fileName
+		return UploadStatus{fileName: fileName, result: ctx.Err()}
+	}
+	return UploadStatus{fileName: fileName}
+}
+
+func (b *testUploadBehavior) Statistics() interface{} { return nil }
+func (b *testUploadBehavior) Key() string             { return "test" }
+func (b *testUploadBehavior) String() string          { return "test uploader" }
+
+func TestBundledOutputShutdownCancelsUploads(t *testing.T) {
+	behavior := newTestUploadBehavior(t, true)
+	defer os.RemoveAll(behavior.directory)
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// roll over (and upload) on the first tick
+	output.rollOverDuration = 0
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+
+	messages <- "event"
+
+	select {
+	case <-behavior.uploads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload was not started")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		output.Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-behavior.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload in progress was not cancelled by Shutdown")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestBundledOutputSnapshot(t *testing.T) {
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	output.rollOverDuration = 0
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	// the status page reads statistics while the output's goroutine is uploading files
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := output.Snapshot()
+		if stats.FilesUploaded > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No files uploaded: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingUploadBehavior fails every upload with err
+type failingUploadBehavior struct {
+	*testUploadBehavior
+	err error
+}
+
+func (b *failingUploadBehavior) Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus {
+	b.uploads <- fileName
+	return UploadStatus{fileName: fileName, result: b.err}
+}
+
+func TestBundledOutputHoldsClientErrors(t *testing.T) {
+	behavior := &failingUploadBehavior{newTestUploadBehavior(t, false), &os.PathError{Op: "open", Err: os.ErrPermission}}
+	defer os.RemoveAll(behavior.directory)
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	output.rollOverDuration = 0
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	messages <- "event"
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := output.Snapshot()
+		if stats.FilesHeld > 0 {
+			if stats.LastErrorCategory != "client" || stats.ErrorsByCategory["client"] == 0 {
+				t.Errorf("Expected the upload error to be classified as a client error: %+v", stats)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No files held: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBundledOutputRestoresRetryState(t *testing.T) {
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	failed := filepath.Join(behavior.directory, "event-forwarder.2017-01-01T00:00:00")
+	fresh := filepath.Join(behavior.directory, "event-forwarder.2017-01-01T00:05:00")
+	held := filepath.Join(behavior.directory, "event-forwarder.2017-01-01T00:10:00")
+	for _, fn := range [...]string{failed, fresh, held} {
+		if err := ioutil.WriteFile(fn, []byte(testBundleEvent), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uploadErr := errors.New("upload failed")
+	if err := saveRetryState(&queuedUpload{fileName: failed, attempts: 3, nextAttempt: later}, UploadErrorNetwork,
+		uploadErr); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveRetryState(&queuedUpload{fileName: held, attempts: 1, held: true}, UploadErrorClient,
+		uploadErr); err != nil {
+		t.Fatal(err)
+	}
+	// left behind by a file that was uploaded before the retry state could be removed
+	orphan := filepath.Join(behavior.directory, "event-forwarder.2016-12-31T00:00:00"+retryStateSuffix)
+	if err := ioutil.WriteFile(orphan, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(output.filesToUpload) != 3 {
+		t.Fatalf("Expected three files to be queued, got %d", len(output.filesToUpload))
+	}
+	// files that are due come first, oldest first; the file that is backing off comes last
+	expected := []string{fresh, held, failed}
+	for i, upload := range output.filesToUpload {
+		if upload.fileName != expected[i] {
+			t.Errorf("Expected %s at position %d of the queue, got %s", expected[i], i, upload.fileName)
+		}
+	}
+	if upload := output.filesToUpload[2]; upload.attempts != 3 || !upload.nextAttempt.Equal(later) {
+		t.Errorf("Retry state was not restored: %+v", upload)
+	}
+	if upload := output.filesToUpload[1]; upload.held || upload.attempts != 1 {
+		t.Errorf("Held file should be retried after a restart: %+v", upload)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("Orphaned retry state was not removed")
+	}
+}
+
+// contentsUploadBehavior records what was uploaded under each name
+type contentsUploadBehavior struct {
+	*testUploadBehavior
+	contents map[string][]byte
+	sync.Mutex
+}
+
+func (b *contentsUploadBehavior) Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus {
+	contents, err := ioutil.ReadAll(fp)
+	if err != nil {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+	b.Lock()
+	b.contents[filepath.Base(fileName)] = contents
+	b.Unlock()
+	return b.testUploadBehavior.Upload(ctx, fileName, fp)
+}
+
+func TestBundledOutputSignsBundles(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	behavior := &contentsUploadBehavior{testUploadBehavior: newTestUploadBehavior(t, false),
+		contents: make(map[string][]byte)}
+	defer os.RemoveAll(behavior.directory)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(behavior.directory, "signing.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+	config.BundleSigningKey = keyFile
+
+	// left by a run without signing, so it is signed before it is uploaded
+	bundle := filepath.Join(behavior.directory, "event-forwarder.2017-01-01T00:00:00")
+	if err := ioutil.WriteFile(bundle, []byte(testBundleEvent), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	for _, expected := range []string{bundle, signaturePath(bundle)} {
+		select {
+		case fileName := <-behavior.uploads:
+			if fileName != expected {
+				t.Errorf("Expected %s to be uploaded, got %s", expected, fileName)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not uploaded", expected)
+		}
+	}
+
+	behavior.Lock()
+	defer behavior.Unlock()
+	name := filepath.Base(bundle)
+	if !ed25519.Verify(public, behavior.contents[name], behavior.contents[name+signatureSuffix]) {
+		t.Error("The uploaded signature does not match the bundle")
+	}
+	if !output.Snapshot().Signed {
+		t.Error("Signing is not reported in the statistics")
+	}
+}
+
+func TestBundledOutputUploadTimeout(t *testing.T) {
+	behavior := newTestUploadBehavior(t, true)
+	defer os.RemoveAll(behavior.directory)
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	output.rollOverDuration = 0
+	output.uploadTimeout = 50 * time.Millisecond
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	select {
+	case <-behavior.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload was not cancelled after the upload timeout")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := output.Snapshot()
+		if stats.ErrorsByCategory["network"] > 0 {
+			if stats.FilesHeld > 0 {
+				t.Errorf("Timed out uploads should be retried: %+v", stats)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out upload was not recorded as a network error: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stuckUploadBehavior ignores cancellation, so its uploads only finish when release is closed
+type stuckUploadBehavior struct {
+	*testUploadBehavior
+	release chan struct{}
+}
+
+func (b *stuckUploadBehavior) Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus {
+	b.uploads <- fileName
+	<-b.release
+	return UploadStatus{fileName: fileName}
+}
+
+func TestBundledOutputStuckUploads(t *testing.T) {
+	behavior := &stuckUploadBehavior{newTestUploadBehavior(t, false), make(chan struct{})}
+	defer os.RemoveAll(behavior.directory)
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	output.rollOverDuration = 0
+	output.uploadTimeout = 10 * time.Millisecond
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+	defer close(behavior.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := output.Snapshot()
+		if stats.StuckUploads > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Upload ignoring its timeout was not reported as stuck: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBundledOutputAlignedRollOver(t *testing.T) {
+	output := &BundledOutput{rollOverDuration: 5 * time.Minute, alignRollOver: true}
+
+	now := time.Date(2017, 1, 1, 10, 7, 30, 0, time.UTC)
+	bundle := &bundleFile{partitionEnd: output.nextPartitionEnd(now)}
+	if !bundle.partitionEnd.Equal(time.Date(2017, 1, 1, 10, 10, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the partition to end at 10:10, got %s", bundle.partitionEnd)
+	}
+
+	if output.rollOverDue(bundle, now.Add(2*time.Minute)) {
+		t.Error("Roll over before the end of the partition")
+	}
+	if !output.rollOverDue(bundle, time.Date(2017, 1, 1, 10, 10, 0, 0, time.UTC)) {
+		t.Error("No roll over at the end of the partition")
+	}
+}
+
+func TestBundledOutputMinimumSize(t *testing.T) {
+	output := &BundledOutput{rollOverDuration: 5 * time.Minute, minFileSize: 1024, maxFileAge: time.Hour}
+
+	started := time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)
+	bundle := &bundleFile{output: &FileOutput{lastRolledOver: started}}
+
+	if output.rollOverDue(bundle, started.Add(2*time.Hour)) {
+		t.Error("Roll over of an empty file")
+	}
+
+	bundle.size = 100
+	if output.rollOverDue(bundle, started.Add(10*time.Minute)) {
+		t.Error("Roll over of a file below the minimum size")
+	}
+	if !output.rollOverDue(bundle, started.Add(time.Hour)) {
+		t.Error("No roll over of a small file past its maximum age")
+	}
+
+	bundle.size = 2048
+	if !output.rollOverDue(bundle, started.Add(10*time.Minute)) {
+		t.Error("No roll over of a file above the minimum size")
+	}
+}
+
+func TestBundledOutputAdaptiveRollOver(t *testing.T) {
+	output := &BundledOutput{rollOverDuration: 15 * time.Minute, minFileSize: 1024, maxFileAge: time.Hour,
+		adaptive: &adaptiveRollOver{urgentEvents: []string{"alert.#"}, urgentInterval: 30 * time.Second}}
+
+	started := time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)
+	bundle := &bundleFile{output: &FileOutput{lastRolledOver: started}, size: 2048}
+
+	output.adaptive.noteMessage(bundle, `{"type":"ingress.event.netconn"}`)
+	if bundle.urgent || output.rollOverDue(bundle, started.Add(10*time.Minute)) {
+		t.Error("Roll over of a file of bulk events before the bulk interval")
+	}
+	if !output.rollOverDue(bundle, started.Add(16*time.Minute)) {
+		t.Error("No roll over of a file of bulk events after the bulk interval")
+	}
+
+	// urgent files are rolled over whatever their size
+	bundle.size = 100
+	output.adaptive.noteMessage(bundle, "LEEF:1.0|CB|CB|5.1|alert.watchlist.hit.query.process|cb_server=cbserver")
+	output.adaptive.noteMessage(bundle, `{"type":"ingress.event.netconn"}`)
+	if !bundle.urgent {
+		t.Fatal("Expected an alert to make the file urgent")
+	}
+	if output.rollOverDue(bundle, started.Add(20*time.Second)) {
+		t.Error("Roll over of an urgent file before the urgent interval")
+	}
+	if !output.rollOverDue(bundle, started.Add(30*time.Second)) {
+		t.Error("No roll over of an urgent file after the urgent interval")
+	}
+}
+
+func TestBundledOutputWritingDirectory(t *testing.T) {
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+
+	// the file being written by an older version, in the holding area itself, and a file rolled over by a run that
+	// stopped before handing it off
+	legacy := filepath.Join(behavior.directory, "event-forwarder")
+	writing := filepath.Join(behavior.directory, writingSubdirectory)
+	rolledOver := filepath.Join(writing, "event-forwarder.2017-01-01T00:00:00")
+	os.Mkdir(writing, 0700)
+	for _, fn := range [...]string{legacy, rolledOver, rolledOver + indexedBundleTmpSuffix} {
+		if err := ioutil.WriteFile(fn, []byte(testBundleEvent), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	if len(output.filesToUpload) != 1 || filepath.Dir(output.filesToUpload[0].fileName) != behavior.directory {
+		t.Fatalf("Expected the rolled-over file to be handed off and queued, got %+v", output.filesToUpload)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(writing, "event-forwarder")); err != nil || string(b) != testBundleEvent {
+		t.Errorf("Expected the older version's file to be appended to in the writing directory, got %q (%v)", b, err)
+	}
+	if _, err := os.Stat(rolledOver + indexedBundleTmpSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the file being indexed to be removed, got %v", err)
+	}
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+	if err := output.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := ioutil.ReadDir(writing)
+	if len(names) != 1 || names[0].Name() != "event-forwarder" {
+		t.Errorf("Expected only the file being written in the writing directory, got %v", names)
+	}
+}
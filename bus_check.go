@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cbConfSettings are the settings in the Cb Response server's cb.conf that decide which events it publishes.
+type cbConfSettings struct {
+	// DatastoreBroadcastEventTypes: the sensor event types published to api.events as ingress.event.<type>
+	BroadcastEventTypes []string
+	// EnableRawSensorDataBroadcast: sensor event bundles are published to api.rawsensordata
+	RawSensorBroadcast bool
+	// EnableSolrBinaryInfoNotifications: binaryinfo.* events are published
+	BinaryInfoNotifications bool
+}
+
+func readCbConf(fn string) (cbConfSettings, error) {
+	var settings cbConfSettings
+	input, err := ini.LoadFile(fn)
+	if err != nil {
+		return settings, err
+	}
+
+	get := func(key string) string {
+		val, _ := input.Get("", key)
+		return strings.Trim(strings.TrimSpace(val), `"'`)
+	}
+	for _, eventType := range strings.Split(get("DatastoreBroadcastEventTypes"), ",") {
+		if eventType = strings.ToLower(strings.TrimSpace(eventType)); len(eventType) > 0 {
+			settings.BroadcastEventTypes = append(settings.BroadcastEventTypes, eventType)
+		}
+	}
+	settings.RawSensorBroadcast, _ = strconv.ParseBool(get("EnableRawSensorDataBroadcast"))
+	settings.BinaryInfoNotifications, _ = strconv.ParseBool(get("EnableSolrBinaryInfoNotifications"))
+	return settings, nil
+}
+
+// busCheckResult is the outcome of one check: PASS, WARN or FAIL.
+type busCheckResult struct {
+	Result string
+	Check  string
+	Detail string
+}
+
+// checkCbConf compares the events the server publishes, according to its cb.conf, with the events the forwarder
+// subscribes to: a subscription to events the server doesn't publish is the most common reason no events arrive.
+func checkCbConf(settings cbConfSettings, eventTypes []string, rawExchange bool) []busCheckResult {
+	var results []busCheckResult
+	broadcast := make(map[string]bool)
+	for _, eventType := range settings.BroadcastEventTypes {
+		broadcast[eventType] = true
+	}
+
+	if rawExchange {
+		if settings.RawSensorBroadcast {
+			results = append(results, busCheckResult{"PASS", "raw sensor exchange",
+				"EnableRawSensorDataBroadcast is set"})
+		} else {
+			results = append(results, busCheckResult{"FAIL", "raw sensor exchange",
+				"use_raw_sensor_exchange is set, but EnableRawSensorDataBroadcast is not True in cb.conf"})
+		}
+	}
+
+	subscribed := make(map[string]bool)
+	for _, routingKey := range eventTypes {
+		switch {
+		case strings.HasPrefix(routingKey, "ingress.event."):
+			sensorType := strings.TrimPrefix(routingKey, "ingress.event.")
+			subscribed[sensorType] = true
+			if strings.ContainsAny(sensorType, "*#") {
+				// a wildcard matches whichever types are broadcast
+				if len(broadcast) > 0 {
+					for eventType := range broadcast {
+						subscribed[eventType] = true
+					}
+					results = append(results, busCheckResult{"PASS", routingKey,
+						"DatastoreBroadcastEventTypes is set"})
+				} else {
+					results = append(results, busCheckResult{"FAIL", routingKey,
+						"DatastoreBroadcastEventTypes is empty in cb.conf, so the server publishes no sensor events"})
+				}
+			} else if broadcast[sensorType] || broadcast["*"] {
+				results = append(results, busCheckResult{"PASS", routingKey,
+					"listed in DatastoreBroadcastEventTypes"})
+			} else {
+				results = append(results, busCheckResult{"FAIL", routingKey,
+					fmt.Sprintf("%s is not listed in DatastoreBroadcastEventTypes in cb.conf, so the server does not "+
+						"publish these events", sensorType)})
+			}
+		case strings.HasPrefix(routingKey, "binaryinfo."):
+			if settings.BinaryInfoNotifications {
+				results = append(results, busCheckResult{"PASS", routingKey,
+					"EnableSolrBinaryInfoNotifications is set"})
+			} else {
+				results = append(results, busCheckResult{"FAIL", routingKey,
+					"EnableSolrBinaryInfoNotifications is not True in cb.conf, so the server does not publish " +
+						"these events"})
+			}
+		}
+	}
+
+	// every sensor event broadcast loads the server, whether or not anything consumes it
+	var unused []string
+	for _, eventType := range settings.BroadcastEventTypes {
+		if !subscribed[eventType] && eventType != "*" && !rawExchange {
+			unused = append(unused, eventType)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		results = append(results, busCheckResult{"WARN", "DatastoreBroadcastEventTypes",
+			fmt.Sprintf("the server broadcasts %s, which the forwarder does not subscribe to; removing them "+
+				"reduces the load on the server", strings.Join(unused, ", "))})
+	}
+	return results
+}
+
+// observeBus subscribes a temporary queue to the forwarder's events and counts the events received by exchange and
+// routing key, as <exchange>:<routing key>, until ctx is done.
+func observeBus(ctx context.Context) (map[string]int, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	queueName := "cb-event-forwarder:check-bus:" + hex.EncodeToString(id)
+	c, deliveries, err := NewConsumer(config.AMQPURL(), queueName, "check-bus", QueueOptions{AutoDelete: true},
+		config.UseRawSensorExchange, config.EventTypes, config.CustomBindings)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Shutdown()
+
+	counts := make(map[string]int)
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return counts, fmt.Errorf("the connection closed while waiting for events")
+			}
+			counts[delivery.Exchange+":"+delivery.RoutingKey]++
+		case <-ctx.Done():
+			return counts, nil
+		}
+	}
+}
+
+// checkObservedEvents reports, for each subscription, the number of events received while observing the bus. A
+// subscription is a routing key on api.events, or <exchange>:<routing key> for a custom binding.
+func checkObservedEvents(counts map[string]int, subscriptions []string, duration time.Duration) []busCheckResult {
+	var results []busCheckResult
+	for _, subscription := range subscriptions {
+		exchange, pattern := "api.events", subscription
+		if i := strings.Index(subscription, ":"); i >= 0 {
+			exchange, pattern = subscription[:i], subscription[i+1:]
+		}
+
+		received := 0
+		for key, count := range counts {
+			parts := strings.SplitN(key, ":", 2)
+			if parts[0] == exchange && RoutingKeyMatches(pattern, parts[1]) {
+				received += count
+			}
+		}
+
+		if received > 0 {
+			results = append(results, busCheckResult{"PASS", subscription,
+				fmt.Sprintf("%d events received in %s", received, duration)})
+		} else {
+			results = append(results, busCheckResult{"WARN", subscription,
+				fmt.Sprintf("no events received in %s; the server may not publish them, or there was no such "+
+					"activity on the endpoints", duration)})
+		}
+	}
+	return results
+}
+
+// runBusCheck checks that the Cb Response server publishes the events the forwarder subscribes to: first against
+// cb.conf, if it can be read, then by watching the bus for duration. It prints each result and returns whether none
+// failed.
+func runBusCheck(ctx context.Context, cbConfFile string, duration time.Duration) bool {
+	var results []busCheckResult
+	if settings, err := readCbConf(cbConfFile); err != nil {
+		fmt.Printf("SKIP  cb.conf: %s; on a forwarder installed apart from the server, copy /etc/cb/cb.conf from "+
+			"the master node and give it with -cb-conf\n", err)
+	} else {
+		results = checkCbConf(settings, config.EventTypes, config.UseRawSensorExchange)
+	}
+
+	subscriptions := config.subscriptionKeys()
+	if config.UseRawSensorExchange {
+		subscriptions = append(subscriptions, "api.rawsensordata:#")
+	}
+	fmt.Printf("Watching %s for %s for events of %d subscriptions...\n", config.AMQPHostname, duration,
+		len(subscriptions))
+	observeCtx, cancel := context.WithTimeout(ctx, duration)
+	counts, err := observeBus(observeCtx)
+	cancel()
+	if err != nil {
+		results = append(results, busCheckResult{"FAIL", "message bus", err.Error()})
+	} else {
+		results = append(results, checkObservedEvents(counts, subscriptions, duration)...)
+	}
+
+	passed := true
+	for _, result := range results {
+		fmt.Printf("%-4s  %s: %s\n", result.Result, result.Check, result.Detail)
+		if result.Result == "FAIL" {
+			passed = false
+		}
+	}
+	return passed
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCbConf(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "cb.conf")
+	contents := "RabbitMQUser=cb\nDatastoreBroadcastEventTypes=procstart, NetConn,filemod\n" +
+		"EnableRawSensorDataBroadcast=True\nEnableSolrBinaryInfoNotifications='False'\n"
+	if err := ioutil.WriteFile(fn, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := readCbConf(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(settings.BroadcastEventTypes, ",") != "procstart,netconn,filemod" || !settings.RawSensorBroadcast ||
+		settings.BinaryInfoNotifications {
+		t.Errorf("Unexpected settings %+v", settings)
+	}
+}
+
+func busCheckResults(results []busCheckResult) map[string]string {
+	byCheck := make(map[string]string)
+	for _, result := range results {
+		byCheck[result.Check] = result.Result
+	}
+	return byCheck
+}
+
+func TestCheckCbConf(t *testing.T) {
+	settings := cbConfSettings{BroadcastEventTypes: []string{"procstart", "netconn", "regmod"}}
+	results := busCheckResults(checkCbConf(settings, []string{"watchlist.#", "ingress.event.procstart",
+		"ingress.event.filemod", "binaryinfo.#"}, false))
+	expected := map[string]string{
+		"ingress.event.procstart":      "PASS",
+		"ingress.event.filemod":        "FAIL",
+		"binaryinfo.#":                 "FAIL",
+		"DatastoreBroadcastEventTypes": "WARN",
+	}
+	for check, result := range expected {
+		if results[check] != result {
+			t.Errorf("Expected %s for %s, got %q", result, check, results[check])
+		}
+	}
+	if _, ok := results["watchlist.#"]; ok {
+		t.Error("Expected no check of events that need no setting in cb.conf")
+	}
+
+	results = busCheckResults(checkCbConf(settings, []string{"ingress.event.*"}, false))
+	if results["ingress.event.*"] != "PASS" || len(results) != 1 {
+		t.Errorf("Expected a wildcard to use every type broadcast, got %v", results)
+	}
+
+	results = busCheckResults(checkCbConf(cbConfSettings{}, nil, true))
+	if results["raw sensor exchange"] != "FAIL" {
+		t.Errorf("Expected the raw sensor exchange to need EnableRawSensorDataBroadcast, got %v", results)
+	}
+}
+
+func TestCheckObservedEvents(t *testing.T) {
+	counts := map[string]int{
+		"api.events:ingress.event.procstart": 12,
+		"api.events:watchlist.hit.process":   3,
+		"api.rawsensordata:":                 40,
+		"cb.alerts:alert.high":               2,
+	}
+	results := checkObservedEvents(counts, []string{"watchlist.#", "ingress.event.procstart", "ingress.event.netconn",
+		"api.rawsensordata:#", "cb.alerts:alert.*"}, time.Minute)
+	expected := map[string]string{
+		"watchlist.#":             "PASS",
+		"ingress.event.procstart": "PASS",
+		"ingress.event.netconn":   "WARN",
+		"api.rawsensordata:#":     "PASS",
+		"cb.alerts:alert.*":       "PASS",
+	}
+	byCheck := busCheckResults(results)
+	for check, result := range expected {
+		if byCheck[check] != result {
+			t.Errorf("Expected %s for %s, got %q", result, check, byCheck[check])
+		}
+	}
+	for _, result := range results {
+		if result.Check == "ingress.event.procstart" && !strings.HasPrefix(result.Detail, "12 events") {
+			t.Errorf("Expected the number of events received, got %s", result.Detail)
+		}
+	}
+}
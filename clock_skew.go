@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// clockSkewSensors is how many sensors the skew is counted for separately; the skewed events of any further sensors
+// are counted in the totals only.
+const clockSkewSensors = 1000
+
+// ClockSkewStatistics is shown on the status page as clock_skew. Skews are the event timestamp less the time the
+// forwarder received the event, in seconds: positive for events from the future, negative for events from the past.
+type ClockSkewStatistics struct {
+	Tolerance     float64                     `json:"tolerance_seconds"`
+	Checked       int64                       `json:"checked"`
+	Ahead         int64                       `json:"ahead"`
+	Behind        int64                       `json:"behind"`
+	LargestAhead  float64                     `json:"largest_ahead_seconds"`
+	LargestBehind float64                     `json:"largest_behind_seconds"`
+	Sensors       map[string]*SensorClockSkew `json:"sensors,omitempty"`
+}
+
+// SensorClockSkew counts the skewed events of one sensor, named by computer_name, or sensor_id without it.
+type SensorClockSkew struct {
+	Ahead    int64     `json:"ahead"`
+	Behind   int64     `json:"behind"`
+	LastSkew float64   `json:"last_skew_seconds"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// clockSkew checks the timestamp of each event against the local clock when it is received. An event more than the
+// tolerance ahead or behind is annotated with clock_skew_seconds and counted, so that a sensor, Cb Response server or
+// forwarder host whose clock has drifted - which puts its events in the wrong place of every timeline a SIEM draws -
+// is noticed. Events are routinely a little behind, for the time they spent queued on the way, which the tolerance
+// has to allow for.
+type clockSkew struct {
+	tolerance time.Duration
+	stats     ClockSkewStatistics
+	sync.Mutex
+}
+
+// clockSkewDetector is nil unless clock_skew_tolerance is set.
+var clockSkewDetector *clockSkew
+
+func newClockSkew(tolerance time.Duration) *clockSkew {
+	return &clockSkew{
+		tolerance: tolerance,
+		stats: ClockSkewStatistics{
+			Tolerance: tolerance.Seconds(),
+			Sensors:   make(map[string]*SensorClockSkew),
+		},
+	}
+}
+
+// check compares the timestamp of msg with received, annotating msg if they are further apart than the tolerance.
+// Events without a timestamp are left alone.
+func (c *clockSkew) check(msg map[string]interface{}, received time.Time) {
+	if c == nil {
+		return
+	}
+	value, ok := msg["timestamp"]
+	if !ok {
+		return
+	}
+	timestamp, ok := parseEventTimestamp(fmt.Sprint(value))
+	if !ok {
+		return
+	}
+
+	skew := timestamp.Sub(received)
+	c.Lock()
+	defer c.Unlock()
+
+	c.stats.Checked++
+	if skew <= c.tolerance && skew >= -c.tolerance {
+		return
+	}
+	seconds := math.Round(skew.Seconds()*1000) / 1000
+	msg["clock_skew_seconds"] = seconds
+
+	if skew > 0 {
+		c.stats.Ahead++
+		c.stats.LargestAhead = math.Max(c.stats.LargestAhead, seconds)
+	} else {
+		c.stats.Behind++
+		c.stats.LargestBehind = math.Min(c.stats.LargestBehind, seconds)
+	}
+
+	sensor := clockSkewSensor(msg)
+	s, ok := c.stats.Sensors[sensor]
+	if !ok {
+		if len(c.stats.Sensors) >= clockSkewSensors {
+			return
+		}
+		s = &SensorClockSkew{}
+		c.stats.Sensors[sensor] = s
+		log.Printf("WARNING: the clock of %s is %.3f seconds off the forwarder's, beyond clock_skew_tolerance (%s); "+
+			"its events are annotated with clock_skew_seconds", sensor, seconds, c.tolerance)
+	}
+	if skew > 0 {
+		s.Ahead++
+	} else {
+		s.Behind++
+	}
+	s.LastSkew, s.LastSeen = seconds, received
+}
+
+func clockSkewSensor(msg map[string]interface{}) string {
+	if name, ok := msg["computer_name"]; ok {
+		return fmt.Sprint(name)
+	}
+	if id, ok := msg["sensor_id"]; ok {
+		return fmt.Sprintf("sensor %v", id)
+	}
+	return "unknown sensor"
+}
+
+func (c *clockSkew) Statistics() interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	stats := c.stats
+	stats.Sensors = make(map[string]*SensorClockSkew, len(c.stats.Sensors))
+	for name, s := range c.stats.Sensors {
+		copied := *s
+		stats.Sensors[name] = &copied
+	}
+	return stats
+}
+
+// annotate adds the number of skewed events to a heartbeat event.
+func (c *clockSkew) annotate(msg map[string]interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	msg["clock_skew_ahead"] = c.stats.Ahead
+	msg["clock_skew_behind"] = c.stats.Behind
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	skew := newClockSkew(5 * time.Minute)
+	received := time.Unix(1500000000, 0)
+
+	// within the tolerance, as a number decoded from JSON and as the seconds of a protobuf event
+	inTime := map[string]interface{}{"timestamp": json.Number("1499999900"), "computer_name": "host1"}
+	skew.check(inTime, received)
+	if _, ok := inTime["clock_skew_seconds"]; ok {
+		t.Errorf("Unexpected clock_skew_seconds on an event within the tolerance: %v", inTime)
+	}
+	protobuf := map[string]interface{}{"timestamp": 1500000120.5, "sensor_id": 7}
+	skew.check(protobuf, received)
+	if _, ok := protobuf["clock_skew_seconds"]; ok {
+		t.Errorf("Unexpected clock_skew_seconds on an event within the tolerance: %v", protobuf)
+	}
+
+	// an hour ahead, in milliseconds, and a day behind
+	ahead := map[string]interface{}{"timestamp": json.Number(strconv.Itoa(1500003600 * 1000)), "computer_name": "host1"}
+	skew.check(ahead, received)
+	if ahead["clock_skew_seconds"] != 3600.0 {
+		t.Errorf("Expected clock_skew_seconds of 3600, got %v", ahead["clock_skew_seconds"])
+	}
+	behind := map[string]interface{}{"timestamp": json.Number("1499913600"), "sensor_id": 7}
+	skew.check(behind, received)
+	if behind["clock_skew_seconds"] != -86400.0 {
+		t.Errorf("Expected clock_skew_seconds of -86400, got %v", behind["clock_skew_seconds"])
+	}
+
+	// events without a usable timestamp are not checked
+	skew.check(map[string]interface{}{"type": "ingress.event.procstart"}, received)
+	skew.check(map[string]interface{}{"timestamp": "yesterday"}, received)
+
+	stats := skew.Statistics().(ClockSkewStatistics)
+	if stats.Checked != 4 || stats.Ahead != 1 || stats.Behind != 1 {
+		t.Errorf("Unexpected counts %+v", stats)
+	}
+	if stats.LargestAhead != 3600 || stats.LargestBehind != -86400 {
+		t.Errorf("Unexpected largest skews %+v", stats)
+	}
+	if s := stats.Sensors["host1"]; s == nil || s.Ahead != 1 || s.LastSkew != 3600 {
+		t.Errorf("Unexpected skew of host1 %+v", s)
+	}
+	if s := stats.Sensors["sensor 7"]; s == nil || s.Behind != 1 || !s.LastSeen.Equal(received) {
+		t.Errorf("Unexpected skew of sensor 7 %+v", s)
+	}
+
+	heartbeat := make(map[string]interface{})
+	skew.annotate(heartbeat)
+	if heartbeat["clock_skew_ahead"] != int64(1) || heartbeat["clock_skew_behind"] != int64(1) {
+		t.Errorf("Unexpected heartbeat fields %v", heartbeat)
+	}
+}
+
+func TestClockSkewDisabled(t *testing.T) {
+	var skew *clockSkew
+	msg := map[string]interface{}{"timestamp": json.Number("0")}
+	skew.check(msg, time.Now())
+	if _, ok := msg["clock_skew_seconds"]; ok {
+		t.Errorf("Unexpected clock_skew_seconds without a tolerance: %v", msg)
+	}
+}
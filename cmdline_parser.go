@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// command line fields as they appear in raw sensor events (command_line) and in process documents (cmdline)
+var commandLineFields = [...]string{"command_line", "cmdline"}
+
+// powershell accepts any unambiguous prefix of -EncodedCommand, down to -e
+var powershellEncodedFlags = [...]string{"e", "ec", "en", "enc", "enco", "encod", "encode", "encoded", "encodedc",
+	"encodedco", "encodedcom", "encodedcomm", "encodedcomma", "encodedcomman", "encodedcommand"}
+
+// AddCommandLineFields splits the command line of process events into an argv array (<field>_argv) and extracts
+// common indicators from it: the script passed to powershell -EncodedCommand (powershell_encoded_command and its
+// decoded form, powershell_decoded_command), and the DLL and entry point run by rundll32 (rundll32_target and
+// rundll32_entrypoint).
+func AddCommandLineFields(msg map[string]interface{}) {
+	for _, field := range commandLineFields {
+		forEachContainer(msg, field, func(container map[string]interface{}) {
+			cmdline, ok := container[field].(string)
+			if !ok || len(cmdline) == 0 {
+				return
+			}
+
+			argv := SplitCommandLine(cmdline)
+			container[field+"_argv"] = argv
+			addCommandLineIndicators(argv, container)
+		})
+	}
+}
+
+func addCommandLineIndicators(argv []string, container map[string]interface{}) {
+	if len(argv) == 0 {
+		return
+	}
+
+	program := strings.ToLower(path.Base(strings.Replace(argv[0], "\\", "/", -1)))
+	program = strings.TrimSuffix(program, ".exe")
+
+	switch program {
+	case "powershell", "pwsh":
+		for i := 1; i < len(argv)-1; i++ {
+			if !isPowershellEncodedFlag(argv[i]) {
+				continue
+			}
+			container["powershell_encoded_command"] = argv[i+1]
+			if decoded, ok := decodePowershellCommand(argv[i+1]); ok {
+				container["powershell_decoded_command"] = decoded
+			}
+			break
+		}
+	case "rundll32":
+		if len(argv) > 1 {
+			// rundll32 <dll>,<entrypoint> [arguments]; the entry point is sometimes given as a separate argument
+			target := argv[1]
+			entrypoint := ""
+			if idx := strings.Index(target, ","); idx >= 0 {
+				target, entrypoint = target[:idx], target[idx+1:]
+			} else if len(argv) > 2 {
+				entrypoint = argv[2]
+			}
+			container["rundll32_target"] = strings.TrimSpace(target)
+			if entrypoint = strings.TrimSpace(entrypoint); len(entrypoint) > 0 {
+				container["rundll32_entrypoint"] = entrypoint
+			}
+		}
+	}
+}
+
+func isPowershellEncodedFlag(arg string) bool {
+	if len(arg) < 2 || (arg[0] != '-' && arg[0] != '/') {
+		return false
+	}
+	arg = strings.ToLower(arg[1:])
+	for _, flag := range powershellEncodedFlags {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePowershellCommand decodes the base64-encoded UTF-16LE script passed to powershell -EncodedCommand
+func decodePowershellCommand(encoded string) (string, bool) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw)%2 != 0 {
+		return "", false
+	}
+
+	u := make([]uint16, 0, len(raw)/2)
+	for i := 0; i < len(raw); i += 2 {
+		u = append(u, uint16(raw[i])|uint16(raw[i+1])<<8)
+	}
+	return string(utf16.Decode(u)), true
+}
+
+// SplitCommandLine splits a command line into arguments following the rules of the Windows CommandLineToArgvW
+// function. The program name (the first argument) ends at the first whitespace, or at the closing quote if it begins
+// with a quote. For the remaining arguments, whitespace separates arguments outside of quotes; 2n backslashes
+// followed by a quote produce n backslashes and toggle quoting, while 2n+1 backslashes followed by a quote produce n
+// backslashes and a literal quote. Within quotes, two consecutive quotes produce a literal quote.
+func SplitCommandLine(cmdline string) []string {
+	argv := make([]string, 0)
+	s := []rune(strings.TrimLeft(cmdline, " \t"))
+	if len(s) == 0 {
+		return argv
+	}
+
+	// program name
+	i := 0
+	if s[0] == '"' {
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			end++
+		}
+		argv = append(argv, string(s[1:end]))
+		i = end + 1
+	} else {
+		for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+			i++
+		}
+		argv = append(argv, string(s[:i]))
+	}
+
+	var current []rune
+	inQuotes := false
+	inArg := false
+
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if inArg {
+				argv = append(argv, string(current))
+				current = current[:0]
+				inArg = false
+			}
+			i++
+		case c == '\\':
+			backslashes := 0
+			for i < len(s) && s[i] == '\\' {
+				backslashes++
+				i++
+			}
+			inArg = true
+			if i < len(s) && s[i] == '"' {
+				current = append(current, []rune(strings.Repeat("\\", backslashes/2))...)
+				if backslashes%2 == 1 {
+					current = append(current, '"')
+					i++
+				}
+			} else {
+				current = append(current, []rune(strings.Repeat("\\", backslashes))...)
+			}
+		case c == '"':
+			inArg = true
+			if inQuotes && i+1 < len(s) && s[i+1] == '"' {
+				current = append(current, '"')
+				i += 2
+			} else {
+				inQuotes = !inQuotes
+				i++
+			}
+		default:
+			inArg = true
+			current = append(current, c)
+			i++
+		}
+	}
+
+	if inArg {
+		argv = append(argv, string(current))
+	}
+
+	return argv
+}
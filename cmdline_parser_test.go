@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := [...]struct {
+		cmdline  string
+		expected []string
+	}{
+		{`"C:\Program Files (x86)\Google\Update\GoogleUpdate.exe" /ua /installsource scheduler`,
+			[]string{`C:\Program Files (x86)\Google\Update\GoogleUpdate.exe`, "/ua", "/installsource", "scheduler"}},
+		{`C:\Windows\system32\svchost.exe -k netsvcs`, []string{`C:\Windows\system32\svchost.exe`, "-k", "netsvcs"}},
+		{`test.exe "a b c" d e`, []string{"test.exe", "a b c", "d", "e"}},
+		{`test.exe "ab\"c" "\\" d`, []string{"test.exe", `ab"c`, `\`, "d"}},
+		{`test.exe a\\\b d"e f"g h`, []string{"test.exe", `a\\\b`, "de fg", "h"}},
+		{`test.exe a\\\"b c d`, []string{"test.exe", `a\"b`, "c", "d"}},
+		{`test.exe a\\\\"b c" d e`, []string{"test.exe", `a\\b c`, "d", "e"}},
+		{`test.exe "" "a""b"`, []string{"test.exe", "", `a"b`}},
+		{`   `, []string{}},
+	}
+
+	for _, test := range tests {
+		argv := SplitCommandLine(test.cmdline)
+		if !reflect.DeepEqual(argv, test.expected) {
+			t.Errorf("SplitCommandLine(%s): expected %q, got %q", test.cmdline, test.expected, argv)
+		}
+	}
+}
+
+func TestCommandLineIndicators(t *testing.T) {
+	msg := map[string]interface{}{
+		"type":         "ingress.event.procstart",
+		"command_line": `powershell.exe -NoP -NonI -W Hidden -Enc dwBoAG8AYQBtAGkA`,
+		"docs": []map[string]interface{}{
+			{"cmdline": `C:\Windows\System32\rundll32.exe C:\Users\Public\evil.dll,DllRegisterServer`},
+		},
+	}
+	AddCommandLineFields(msg)
+
+	if msg["powershell_encoded_command"] != "dwBoAG8AYQBtAGkA" {
+		t.Errorf("Expected the encoded command to be extracted, got %v", msg["powershell_encoded_command"])
+	}
+	if msg["powershell_decoded_command"] != "whoami" {
+		t.Errorf("Expected the decoded command to be whoami, got %v", msg["powershell_decoded_command"])
+	}
+	if argv, ok := msg["command_line_argv"].([]string); !ok || len(argv) != 7 {
+		t.Errorf("Expected 7 arguments in command_line_argv, got %v", msg["command_line_argv"])
+	}
+
+	doc := msg["docs"].([]map[string]interface{})[0]
+	if doc["rundll32_target"] != `C:\Users\Public\evil.dll` || doc["rundll32_entrypoint"] != "DllRegisterServer" {
+		t.Errorf("Expected rundll32 target and entry point to be extracted, got %v", doc)
+	}
+}
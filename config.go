@@ -4,18 +4,28 @@ import (
 	"errors"
 	_ "expvar"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/vaughan0/go-ini"
 	"log"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// names of the built-in output types; see RegisterOutput
 const (
-	FileOutputType = iota
-	S3OutputType
-	TCPOutputType
-	UDPOutputType
-	SyslogOutputType
+	FileOutputType    = "file"
+	S3OutputType      = "s3"
+	TCPOutputType     = "tcp"
+	UDPOutputType     = "udp"
+	SyslogOutputType  = "syslog"
+	FluentdOutputType = "fluentd"
+	LokiOutputType    = "loki"
+	OTLPOutputType    = "otlp"
+	ShareOutputType   = "share"
+	SFTPOutputType    = "sftp"
+	FTPSOutputType    = "ftps"
 )
 
 const (
@@ -23,11 +33,14 @@ const (
 	JSONOutputFormat
 )
 
+// where events are spilled to disk when the buffer is full, unless buffer_spill_file is set
+const defaultBufferSpillFile = "/var/cb/data/event-forwarder/cb-event-forwarder.spill"
+
 type Configuration struct {
 	ServerName           string
 	AMQPHostname         string
 	DebugFlag            bool
-	OutputType           int
+	OutputType           string
 	OutputFormat         int
 	AMQPUsername         string
 	AMQPPassword         string
@@ -35,20 +48,360 @@ type Configuration struct {
 	OutputParameters     string
 	EventTypes           []string
 	HTTPServerPort       int
+	StatusErrorHistory   int
 	CbServerURL          string
 	UseRawSensorExchange bool
 
+	// the RabbitMQ management API, polled this often for the depth of the forwarder's queue; see queueDepthMonitor
+	RabbitMQManagementURL      string
+	RabbitMQManagementInterval time.Duration
+
+	// array-valued fields to split into one output event per element
+	ExplodeFields []string
+
+	// rename/map/coerce rules from the [transform] section
+	Transforms FieldTransforms
+
+	// split command lines into argv arrays and extract indicators
+	ParseCommandLines bool
+
+	// lowercase domain names and add registered domain/IDN fields
+	NormalizeDomains bool
+
+	// add the path and name of the process and its parent, remembered from procstart events; see processContextCache
+	ProcessContext          bool
+	ProcessContextCacheSize int
+	ProcessContextTypes     []string
+
+	// tag events with ATT&CK techniques from the bundled rules and the [attack] section; see TagAttackTechniques
+	AttackTechniques bool
+	AttackRules      []AttackRule
+
+	// a TraceSampleRate fraction of the events matching TraceFilter (every event if it is nil) are traced; see
+	// eventTrace
+	TraceSampleRate float64
+	TraceFilter     *AttackRule
+
+	// drop/mask/hash rules from the [redact] section
+	Redactions Redactions
+
+	// severity scales from the [severity] section for watchlist and feed hits
+	SeverityScores SeverityScores
+
+	// webhooks and commands triggered by events, from the [actions] section; see eventActions
+	EventActions       []EventAction
+	EventActionTimeout time.Duration
+
+	// events summarized by the rules in the [aggregate] section; see aggregator
+	Aggregations Aggregations
+
+	// local indicator lists from the [indicators] section
+	IndicatorLists          []IndicatorListConfig
+	IndicatorReloadInterval time.Duration
+	IndicatorPollInterval   time.Duration
+
+	// optional Lua script run against each event
+	ScriptFile    string
+	ScriptTimeout time.Duration
+
+	// limits on the resources the forwarder uses; see applyResourceLimits
+	MaxProcs      int
+	MemoryLimit   int64
+	MemoryBallast int64
+	NiceLevel     int
+
+	// formatting of json output; see marshalJSON
+	JSONPretty        bool
+	JSONEscapeHTML    bool
+	JSONOmitNull      bool
+	JSONFlatten       string
+	JSONFlattenArrays bool
+	JSONEnvelope      bool
+	// included in the envelope's metadata, to tell apart the events of several Cb servers or customers
+	Tenant string
+
+	// events are written to the output in OutputEncoding rather than UTF-8; see outputEncoder
+	OutputEncoding            string
+	OutputEncodingReplacement string
+
+	// text in events is cleaned up before it is formatted; see sanitizeMessage
+	SanitizeOutput            bool
+	SanitizeInvalidUTF8       string
+	SanitizeControlCharacters string
+
+	// formatted events larger than MaxEventSize are handled by OversizePolicy; see fitMessage
+	MaxEventSize      int
+	OversizePolicy    string
+	OversizeFields    []string
+	DeadLetterFile    string
+	DeadLetterMaxSize int64
+
+	// a sample of output events is copied to AuditFile; see auditLog
+	AuditFile       string
+	AuditSampleRate float64
+	AuditMaxSize    int64
+
+	// the network outputs archive events here while their connection is down; see outputFallback
+	OutputArchiveDirectory string
+	OutputArchiveFailures  int
+	OutputArchiveCooldown  time.Duration
+	OutputArchiveMaxSize   int64
+
+	// events are also sent to the shadow output until ShadowUntil; see mirrorOutput
+	ShadowOutputType       string
+	ShadowOutputParameters string
+	ShadowUntil            time.Time
+	// events are also sent to the tier output according to TierPolicies; see tieredOutput
+	TierOutputType       string
+	TierOutputParameters string
+	TierPolicies         TierPolicies
+
+	// the output is restarted if it hasn't sent any events for this long while events are waiting; 0 to never restart
+	OutputStallTimeout time.Duration
+
+	// a cb-event-forwarder.heartbeat event is sent to the output this often; 0 for none
+	HeartbeatInterval time.Duration
+	// a cb-event-forwarder.stats event for each event type is sent this often, to the output or to the file if it is
+	// set; 0 for none
+	StatsRollupInterval time.Duration
+	StatsRollupFile     string
+	// the expected band of events per second received, averaged over the window; 0 for no bound; see inputRate
+	InputRateLow    float64
+	InputRateHigh   float64
+	InputRateWindow time.Duration
+	// events with timestamps further than this from the local clock are annotated and counted; 0 for no check; see
+	// clockSkew
+	ClockSkewTolerance time.Duration
+	// the fields of the events sent are compared with those of this -schema-report baseline every interval; see
+	// dataContract
+	SchemaBaselineFile  string
+	SchemaBaseline      *schemaReport
+	SchemaCheckInterval time.Duration
+	// where to look for newer releases, and how often; see updateChecker
+	UpdateCheckURL      string
+	UpdateCheckInterval time.Duration
+	// how often a configuration fetched from a remote location is checked for changes; 0 to never check; see
+	// remoteConfig
+	RemoteConfigPollInterval time.Duration
+
+	// restrict TLS and signatures to FIPS-approved algorithms; see fipsMode
+	FIPSMode bool
+
+	// resolution of output endpoints; see lookupHost
+	DNSServers    []string
+	DNSTimeout    time.Duration
+	HostOverrides map[string]string
+
+	// the connection pool of the HTTP clients; see newHTTPTransport
+	HTTPMaxIdleConns        int
+	HTTPMaxIdleConnsPerHost int
+	HTTPIdleConnTimeout     time.Duration
+	HTTPKeepAlive           time.Duration
+	HTTP2                   bool
+
+	// proxies for HTTP connections, replacing the environment variables when set; see proxyFunc
+	HTTPProxy     string
+	HTTPSProxy    string
+	NoProxy       string
+	ProxyUsername string
+	ProxyPassword string
+
+	// buffering of events in memory, spilling to disk, between the message processors and the output
+	BufferMemorySize int64
+	BufferSpillFile  string
+	BufferSpillLimit int64
+	// consumption pauses while more files than this wait in the holding area, or more bytes in the buffer; 0 for no
+	// limit; see backpressureMonitor
+	PauseHoldingAreaFiles int
+	PauseBufferBytes      int64
+	// manually acknowledged messages processed in the last RedeliveryWindow are not processed again if the broker
+	// redelivers them; 0 to process every redelivery; see redeliveryCache
+	RedeliveryWindow    time.Duration
+	RedeliveryCacheSize int
+
+	// limit on a single file upload by a bundled output such as S3
+	UploadTimeout time.Duration
+	// how often a bundled output rolls over and uploads its file, and whether to do so on clock boundaries
+	BundleRollOverInterval time.Duration
+	BundleAlignRollOver    bool
+	// fixed or adaptive; see adaptiveRollOver
+	BundleRollOverMode           string
+	BundleUrgentEvents           []string
+	BundleUrgentRollOverInterval time.Duration
+	BundleBulkRollOverInterval   time.Duration
+	// files smaller than BundleMinSize are only rolled over by time once they are BundleMaxAge old
+	BundleMinSize int64
+	BundleMaxAge  time.Duration
+	// events are held back this long to write them to bundles in timestamp order; 0 to write them as they arrive; see
+	// reorderBuffer
+	BundleReorderWindow time.Duration
+	// when a bundled output's temp files are synced to disk
+	TempFileSync         FileSyncMode
+	TempFileSyncBytes    int64
+	TempFileSyncInterval time.Duration
+	// keep a separate file for each event type family
+	BundleByEventType bool
+	// PEM private key used to sign each bundle; see signBundle
+	BundleSigningKey string
+	// names for rolled-over files, such as "{hostname}-{timestamp}.json"; see renderBundleName
+	BundleNameTemplate string
+	// lines or indexed; see writeIndexedBundle
+	BundleFormat string
+	// none, gzip or zstd; see compressBundle
+	BundleCompression  string
+	ZstdLevel          zstd.EncoderLevel
+	ZstdDictionaryFile string
+	ZstdDictionary     []byte
+	// allow retrying and deleting files in the holding area through the status server
+	HoldingAreaChanges bool
+	// watch the holding area for files dropped into it; see holdingAreaWatch
+	WatchHoldingArea bool
+	// files older than HoldingAreaMaxAge (if set) are deleted or archived rather than uploaded; see expireFiles
+	HoldingAreaMaxAge           time.Duration
+	HoldingAreaExpiredAction    string
+	HoldingAreaArchiveDirectory string
+	// notifications of each upload by a bundled output; see uploadHooks
+	UploadHooks UploadHookConfig
+
+	// 0 for no limit; can be changed through the management API
+	MaxEventsPerSecond float64
+	// bearer token for the management API, which is disabled if empty
+	ManagementToken string
+	// serve runtime profiles at /debug/pprof/, with the management API token
+	DebugPprof bool
+
+	// binaries of binarystore.file.added events are downloaded with the API token and saved to the destination, an
+	// s3:// URL or a directory; see binaryArchive
+	BinaryArchiveDestination string
+	BinaryArchiveAPIToken    string
+	BinaryArchiveMaxSize     int64
+	// the binarystore.file.added events themselves are not forwarded
+	BinaryArchiveOnly bool
+
+	// forwarders in the same consumer group share one durable queue
+	ConsumerGroup string
+
+	// the pipelines run by this forwarder, and where their configurations are written; see pipelineSupervisor
+	Pipelines         []string
+	PipelineDirectory string
+	// the pipeline this forwarder runs, if it was started by a pipeline supervisor
+	PipelineName string
+
+	// bindings to exchanges other than api.events
+	CustomBindings []CustomBinding
+
+	// the latency objectives of classes of events, from [latency_slo]; see latencyTracker
+	LatencySLOs      []LatencySLO
+	LatencySLOWindow time.Duration
+
+	// consume from a durable, per-host queue with manual acknowledgements
+	DurableQueue bool
+
+	// AMQP queue overrides; see forwarderQueue
+	QueueName       string
+	QueueDurable    *bool
+	QueueAutoDelete *bool
+	QueueMessageTTL time.Duration
+	QueueMaxLength  int
+	// basic.qos applied to the consumer's channel; PrefetchCount overrides the default of the queue mode when set
+	PrefetchCount *int
+	PrefetchSize  int
+	// the number of channels consuming from the queue over the one connection
+	ConsumerChannels int
+
 	// this is a hack for S3 specific configuration
 	S3ServerSideEncryption  *string
 	S3CredentialProfileName *string
 	S3ACLPolicy             *string
 	S3ObjectPrefix          *string
 
+	// identifies this forwarder in the keys of the objects it uploads; see resolveInstanceID
+	S3InstanceID string
+
+	// S3 Object Lock applied to each uploaded bundle; see S3Behavior
+	S3ObjectLockMode      string
+	S3ObjectLockRetention time.Duration
+	S3LegalHold           bool
+
+	// an S3-compatible store (such as MinIO or Ceph) in place of AWS; see newS3Client
+	S3Endpoint       string
+	S3ForcePathStyle bool
+	S3Region         string
+	S3TLSVerify      bool
+
+	// uploads fail over to the secondary bucket after repeated failures of the primary; see s3Failover
+	S3SecondaryBucket string
+	S3FailoverAfter   int
+	S3FailbackAfter   time.Duration
+	S3ManifestFile    string
+
+	// an index of the bundles uploaded is kept in each prefix of the bucket; see s3Index
+	S3IndexObjects bool
+
+	// bundles are uploaded into Hive-style partitions of the hour, registered in the Glue table if one is set; see
+	// gluePartitions
+	S3PartitionKeys bool
+	S3GlueDatabase  string
+	S3GlueTable     string
+	S3GlueCatalogID string
+
 	// Syslog-specific configuration
 	SyslogTLSClientKey  *string
 	SyslogTLSClientCert *string
 	SyslogTLSCACert     *string
 	SyslogTLSVerify     bool
+
+	// options for the fluentd output, from the [fluentd] section; see FluentdOutput
+	FluentdTag        string
+	FluentdRequireAck bool
+	FluentdAckTimeout time.Duration
+	FluentdBatchSize  int
+
+	// options for the loki output, from the [loki] section; see LokiOutput
+	LokiLabels       []LokiLabel
+	LokiStaticLabels map[string]string
+	LokiBatchSize    int
+	LokiBatchWait    time.Duration
+	LokiTimeout      time.Duration
+	LokiTenantID     string
+	LokiUsername     string
+	LokiPassword     string
+
+	// options for the otlp output, from the [otlp] section; see OTLPOutput
+	OTLPProtocol           string
+	OTLPHeaders            map[string]string
+	OTLPCompression        string
+	OTLPServiceName        string
+	OTLPResourceAttributes map[string]string
+	OTLPAllAttributes      bool
+	OTLPAttributeFields    []string
+	OTLPBatchSize          int
+	OTLPBatchWait          time.Duration
+	OTLPTimeout            time.Duration
+
+	// options for the share output, from the [share] section; see ShareBehavior
+	ShareRequireMount  bool
+	ShareHealthTimeout time.Duration
+	ShareStaleRetries  int
+
+	// options for the sftp output, from the [sftp] section; see SFTPBehavior
+	SFTPPrivateKey            string
+	SFTPPrivateKeyPassphrase  string
+	SFTPPassword              string
+	SFTPKnownHosts            string
+	SFTPInsecureIgnoreHostKey bool
+	SFTPRemotePath            string
+	SFTPTimeout               time.Duration
+
+	// options for the ftps output, from the [ftps] section; see FTPSBehavior
+	FTPSPassword   string
+	FTPSCACert     string
+	FTPSTLSVerify  bool
+	FTPSClientCert string
+	FTPSClientKey  string
+	FTPSRemotePath string
+	FTPSTimeout    time.Duration
+	FTPSResume     bool
 }
 
 type ConfigurationError struct {
@@ -150,11 +503,452 @@ func (c *Configuration) parseEventTypes(input ini.File) {
 	}
 }
 
+// parseS3Endpoint reads the [s3] options for reaching an S3-compatible store rather than AWS.
+func (c *Configuration) parseS3Endpoint(input ini.File, errs *ConfigurationError) {
+	if val, ok := input.Get("s3", "endpoint"); ok && len(val) > 0 {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid endpoint '%s' in [s3]: should look like "+
+				"https://minio.example.com:9000", val))
+		} else {
+			c.S3Endpoint = val
+		}
+	}
+	c.S3Region, _ = input.Get("s3", "region")
+
+	c.S3TLSVerify = true
+	for key, dest := range map[string]*bool{"force_path_style": &c.S3ForcePathStyle, "tls_verify": &c.S3TLSVerify} {
+		if val, ok := input.Get("s3", key); ok {
+			boolval, err := strconv.ParseBool(val)
+			if err == nil {
+				*dest = boolval
+			} else {
+				errs.addErrorString(fmt.Sprintf("Unknown value for '%s' in [s3]: valid values are true, false, 1, 0",
+					key))
+			}
+		}
+	}
+}
+
+// parseOutputOptions reads the settings in the output type's own section, such as [s3] or [syslog].
+func (c *Configuration) parseOutputOptions(input ini.File, outType string, errs *ConfigurationError) {
+	switch outType {
+	case S3OutputType:
+		profileName, ok := input.Get("s3", "credential_profile")
+		if ok {
+			c.S3CredentialProfileName = &profileName
+		}
+
+		aclPolicy, ok := input.Get("s3", "acl_policy")
+		if ok {
+			c.S3ACLPolicy = &aclPolicy
+		}
+
+		sseType, ok := input.Get("s3", "server_side_encryption")
+		if ok {
+			c.S3ServerSideEncryption = &sseType
+		}
+
+		objectPrefix, ok := input.Get("s3", "object_prefix")
+		if ok {
+			c.S3ObjectPrefix = &objectPrefix
+		}
+
+		if val, ok := input.Get("s3", "instance_id"); ok && len(val) > 0 {
+			if val != InstanceIDAuto && val != InstanceIDHostname && !validInstanceID.MatchString(val) {
+				errs.addErrorString(fmt.Sprintf("Invalid instance_id '%s' in [s3]: should be auto, hostname or a name "+
+					"of letters, digits, '.', '_' and '-'", val))
+			} else {
+				c.S3InstanceID = val
+			}
+		}
+
+		if val, ok := input.Get("s3", "object_lock_mode"); ok && len(val) > 0 {
+			switch mode := strings.ToUpper(val); mode {
+			case "GOVERNANCE", "COMPLIANCE":
+				c.S3ObjectLockMode = mode
+			default:
+				errs.addErrorString(fmt.Sprintf("Unknown object_lock_mode '%s' in [s3]: valid values are governance, "+
+					"compliance", val))
+			}
+		}
+		if val, ok := input.Get("s3", "object_lock_retention"); ok && len(val) > 0 {
+			retention, err := parseRetentionPeriod(val)
+			if err != nil || retention <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid object_lock_retention '%s' in [s3]: should be a period such "+
+					"as 90d or 7y", val))
+			} else {
+				c.S3ObjectLockRetention = retention
+			}
+		}
+		if (len(c.S3ObjectLockMode) > 0) != (c.S3ObjectLockRetention > 0) {
+			errs.addErrorString("object_lock_mode and object_lock_retention in [s3] must be set together")
+		}
+		if val, ok := input.Get("s3", "legal_hold"); ok {
+			boolval, err := strconv.ParseBool(val)
+			if err == nil {
+				c.S3LegalHold = boolval
+			} else {
+				errs.addErrorString("Unknown value for 'legal_hold' in [s3]: valid values are true, false, 1, 0")
+			}
+		}
+
+		c.S3FailoverAfter, c.S3FailbackAfter = 3, 15*time.Minute
+		if val, ok := input.Get("s3", "secondary_bucket"); ok && len(val) > 0 {
+			if _, bucketName := parseSecondaryBucket(val, ""); len(bucketName) == 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid secondary_bucket '%s' in [s3]: should look like "+
+					"(region):(bucket-name), or a bucket name in the region of s3out", val))
+			} else {
+				c.S3SecondaryBucket = val
+			}
+		}
+		if val, ok := input.Get("s3", "failover_after"); ok {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				errs.addErrorString(fmt.Sprintf("Invalid failover_after '%s' in [s3]: should be a number of failed "+
+					"uploads of at least 1", val))
+			} else {
+				c.S3FailoverAfter = n
+			}
+		}
+		if val, ok := input.Get("s3", "failback_after"); ok {
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval < time.Minute {
+				errs.addErrorString(fmt.Sprintf("Invalid failback_after '%s' in [s3]: should be a duration of at "+
+					"least 1m, such as 15m", val))
+			} else {
+				c.S3FailbackAfter = interval
+			}
+		}
+		if val, ok := input.Get("s3", "manifest_file"); ok && len(val) > 0 {
+			c.S3ManifestFile = val
+		}
+
+		if val, ok := input.Get("s3", "index_objects"); ok {
+			boolval, err := strconv.ParseBool(val)
+			if err == nil {
+				c.S3IndexObjects = boolval
+			} else {
+				errs.addErrorString("Unknown value for 'index_objects' in [s3]: valid values are true, false, 1, 0")
+			}
+		}
+
+		if val, ok := input.Get("s3", "partition_keys"); ok {
+			boolval, err := strconv.ParseBool(val)
+			if err == nil {
+				c.S3PartitionKeys = boolval
+			} else {
+				errs.addErrorString("Unknown value for 'partition_keys' in [s3]: valid values are true, false, 1, 0")
+			}
+		}
+		c.S3GlueDatabase, _ = input.Get("s3", "glue_database")
+		c.S3GlueTable, _ = input.Get("s3", "glue_table")
+		c.S3GlueCatalogID, _ = input.Get("s3", "glue_catalog_id")
+		if (len(c.S3GlueDatabase) > 0) != (len(c.S3GlueTable) > 0) {
+			errs.addErrorString("glue_database and glue_table in [s3] should be set together")
+		} else if len(c.S3GlueTable) > 0 && !c.S3PartitionKeys {
+			errs.addErrorString("glue_table in [s3] needs partition_keys=true: only partitions can be registered")
+		}
+	case SyslogOutputType:
+		clientKeyFilename, ok := input.Get("syslog", "client_key")
+		if ok {
+			c.SyslogTLSClientKey = &clientKeyFilename
+		}
+
+		clientCertFilename, ok := input.Get("syslog", "client_cert")
+		if ok {
+			c.SyslogTLSClientCert = &clientCertFilename
+		}
+
+		caCertFilename, ok := input.Get("syslog", "ca_cert")
+		if ok {
+			c.SyslogTLSCACert = &caCertFilename
+		}
+
+		c.SyslogTLSVerify = true
+		tlsVerify, ok := input.Get("syslog", "tls_verify")
+		if ok {
+			if tlsVerify == "false" {
+				c.SyslogTLSVerify = false
+			}
+		}
+	case FluentdOutputType:
+		c.FluentdTag = "carbonblack.events"
+		if tag, ok := input.Get("fluentd", "tag"); ok {
+			c.FluentdTag = tag
+		}
+
+		if val, ok := input.Get("fluentd", "require_ack"); ok {
+			boolval, err := strconv.ParseBool(val)
+			if err == nil {
+				c.FluentdRequireAck = boolval
+			} else {
+				errs.addErrorString("Unknown value for 'require_ack' in [fluentd]: valid values are true, false, 1, 0")
+			}
+		}
+
+		c.FluentdAckTimeout = 30 * time.Second
+		if val, ok := input.Get("fluentd", "ack_timeout"); ok {
+			timeout, err := time.ParseDuration(val)
+			if err != nil || timeout <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid ack_timeout '%s' in [fluentd]: should be a duration such as 30s", val))
+			} else {
+				c.FluentdAckTimeout = timeout
+			}
+		}
+
+		c.FluentdBatchSize = 100
+		if val, ok := input.Get("fluentd", "batch_size"); ok {
+			size, err := strconv.Atoi(val)
+			if err != nil || size <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_size '%s' in [fluentd]: should be a number of events", val))
+			} else {
+				c.FluentdBatchSize = size
+			}
+		}
+	case LokiOutputType:
+		c.LokiLabels = []LokiLabel{{Name: "type", Field: "type"}}
+		if val, ok := input.Get("loki", "labels"); ok {
+			labels, err := parseLokiLabels(val)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid labels in [loki]: %s", err))
+			} else {
+				c.LokiLabels = labels
+			}
+		}
+
+		c.LokiStaticLabels = map[string]string{"job": "cb-event-forwarder"}
+		if val, ok := input.Get("loki", "static_labels"); ok {
+			labels, err := parseLokiStaticLabels(val)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid static_labels in [loki]: %s", err))
+			} else {
+				c.LokiStaticLabels = labels
+			}
+		}
+		if len(c.LokiLabels) == 0 && len(c.LokiStaticLabels) == 0 {
+			errs.addErrorString("The loki output needs at least one label: set labels or static_labels in [loki]")
+		}
+
+		c.LokiBatchSize = 500
+		if val, ok := input.Get("loki", "batch_size"); ok {
+			size, err := strconv.Atoi(val)
+			if err != nil || size <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_size '%s' in [loki]: should be a number of events", val))
+			} else {
+				c.LokiBatchSize = size
+			}
+		}
+
+		c.LokiBatchWait = time.Second
+		c.LokiTimeout = 30 * time.Second
+		for key, duration := range map[string]*time.Duration{"batch_wait": &c.LokiBatchWait, "timeout": &c.LokiTimeout} {
+			if val, ok := input.Get("loki", key); ok {
+				d, err := time.ParseDuration(val)
+				if err != nil || d <= 0 {
+					errs.addErrorString(fmt.Sprintf("Invalid %s '%s' in [loki]: should be a duration such as 5s", key, val))
+				} else {
+					*duration = d
+				}
+			}
+		}
+
+		c.LokiTenantID, _ = input.Get("loki", "tenant_id")
+		c.LokiUsername, _ = input.Get("loki", "username")
+		c.LokiPassword, _ = input.Get("loki", "password")
+	case OTLPOutputType:
+		c.OTLPProtocol = OTLPHTTPProtobuf
+		if val, ok := input.Get("otlp", "protocol"); ok {
+			switch val {
+			case OTLPGRPC, OTLPHTTPProtobuf, OTLPHTTPJSON:
+				c.OTLPProtocol = val
+			default:
+				errs.addErrorString(fmt.Sprintf("Unknown protocol '%s' in [otlp]: valid values are grpc, http/protobuf, "+
+					"http/json", val))
+			}
+		}
+
+		if val, ok := input.Get("otlp", "compression"); ok {
+			switch val {
+			case "gzip":
+				c.OTLPCompression = val
+			case "none":
+			default:
+				errs.addErrorString(fmt.Sprintf("Unknown compression '%s' in [otlp]: valid values are gzip, none", val))
+			}
+		}
+
+		for key, pairs := range map[string]*map[string]string{
+			"headers":             &c.OTLPHeaders,
+			"resource_attributes": &c.OTLPResourceAttributes,
+		} {
+			if val, ok := input.Get("otlp", key); ok {
+				parsed, err := parseOTLPKeyValues(val)
+				if err != nil {
+					errs.addErrorString(fmt.Sprintf("Invalid %s in [otlp]: %s", key, err))
+				} else {
+					*pairs = parsed
+				}
+			}
+		}
+
+		c.OTLPServiceName = "cb-event-forwarder"
+		if val, ok := input.Get("otlp", "service_name"); ok {
+			c.OTLPServiceName = val
+		}
+
+		c.OTLPAllAttributes = true
+		if val, ok := input.Get("otlp", "attributes"); ok {
+			switch val {
+			case "all":
+			case "none":
+				c.OTLPAllAttributes = false
+			default:
+				c.OTLPAllAttributes = false
+				for _, field := range strings.Split(val, ",") {
+					if field = strings.TrimSpace(field); len(field) > 0 {
+						c.OTLPAttributeFields = append(c.OTLPAttributeFields, field)
+					}
+				}
+			}
+		}
+
+		c.OTLPBatchSize = 512
+		if val, ok := input.Get("otlp", "batch_size"); ok {
+			size, err := strconv.Atoi(val)
+			if err != nil || size <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_size '%s' in [otlp]: should be a number of events", val))
+			} else {
+				c.OTLPBatchSize = size
+			}
+		}
+
+		c.OTLPBatchWait = time.Second
+		c.OTLPTimeout = 30 * time.Second
+		for key, duration := range map[string]*time.Duration{"batch_wait": &c.OTLPBatchWait, "timeout": &c.OTLPTimeout} {
+			if val, ok := input.Get("otlp", key); ok {
+				d, err := time.ParseDuration(val)
+				if err != nil || d <= 0 {
+					errs.addErrorString(fmt.Sprintf("Invalid %s '%s' in [otlp]: should be a duration such as 5s", key, val))
+				} else {
+					*duration = d
+				}
+			}
+		}
+	case ShareOutputType:
+		c.ShareRequireMount = true
+		if val, ok := input.Get("share", "require_mount"); ok {
+			boolval, err := strconv.ParseBool(val)
+			if err == nil {
+				c.ShareRequireMount = boolval
+			} else {
+				errs.addErrorString("Unknown value for 'require_mount' in [share]: valid values are true, false, 1, 0")
+			}
+		}
+
+		c.ShareHealthTimeout = 10 * time.Second
+		if val, ok := input.Get("share", "health_timeout"); ok {
+			timeout, err := time.ParseDuration(val)
+			if err != nil || timeout <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid health_timeout '%s' in [share]: should be a duration such as 10s",
+					val))
+			} else {
+				c.ShareHealthTimeout = timeout
+			}
+		}
+
+		c.ShareStaleRetries = 3
+		if val, ok := input.Get("share", "stale_retries"); ok {
+			retries, err := strconv.Atoi(val)
+			if err != nil || retries < 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid stale_retries '%s' in [share]: should be a number of retries", val))
+			} else {
+				c.ShareStaleRetries = retries
+			}
+		}
+	case SFTPOutputType:
+		c.SFTPPrivateKey, _ = input.Get("sftp", "private_key")
+		c.SFTPPrivateKeyPassphrase, _ = input.Get("sftp", "private_key_passphrase")
+		c.SFTPPassword, _ = input.Get("sftp", "password")
+
+		c.SFTPKnownHosts = "/etc/cb/integrations/event-forwarder/known_hosts"
+		if val, ok := input.Get("sftp", "known_hosts"); ok {
+			c.SFTPKnownHosts = val
+		}
+		if val, ok := input.Get("sftp", "insecure_ignore_host_key"); ok {
+			boolval, err := strconv.ParseBool(val)
+			if err == nil {
+				c.SFTPInsecureIgnoreHostKey = boolval
+			} else {
+				errs.addErrorString("Unknown value for 'insecure_ignore_host_key' in [sftp]: valid values are true, " +
+					"false, 1, 0")
+			}
+		}
+
+		c.SFTPRemotePath = "{name}"
+		if val, ok := input.Get("sftp", "remote_path"); ok {
+			if err := validateRemotePath(val); err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid remote_path '%s' in [sftp]: %s", val, err))
+			} else {
+				c.SFTPRemotePath = val
+			}
+		}
+
+		c.SFTPTimeout = 30 * time.Second
+		if val, ok := input.Get("sftp", "timeout"); ok {
+			timeout, err := time.ParseDuration(val)
+			if err != nil || timeout <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid timeout '%s' in [sftp]: should be a duration such as 30s", val))
+			} else {
+				c.SFTPTimeout = timeout
+			}
+		}
+	case FTPSOutputType:
+		c.FTPSPassword, _ = input.Get("ftps", "password")
+		c.FTPSCACert, _ = input.Get("ftps", "ca_cert")
+		c.FTPSClientCert, _ = input.Get("ftps", "client_cert")
+		c.FTPSClientKey, _ = input.Get("ftps", "client_key")
+
+		c.FTPSTLSVerify = true
+		c.FTPSResume = true
+		for key, dest := range map[string]*bool{"tls_verify": &c.FTPSTLSVerify, "resume": &c.FTPSResume} {
+			if val, ok := input.Get("ftps", key); ok {
+				boolval, err := strconv.ParseBool(val)
+				if err == nil {
+					*dest = boolval
+				} else {
+					errs.addErrorString(fmt.Sprintf("Unknown value for '%s' in [ftps]: valid values are true, false, "+
+						"1, 0", key))
+				}
+			}
+		}
+
+		c.FTPSRemotePath = "{name}"
+		if val, ok := input.Get("ftps", "remote_path"); ok {
+			if err := validateRemotePath(val); err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid remote_path '%s' in [ftps]: %s", val, err))
+			} else {
+				c.FTPSRemotePath = val
+			}
+		}
+
+		c.FTPSTimeout = 30 * time.Second
+		if val, ok := input.Get("ftps", "timeout"); ok {
+			timeout, err := time.ParseDuration(val)
+			if err != nil || timeout <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid timeout '%s' in [ftps]: should be a duration such as 30s", val))
+			} else {
+				c.FTPSTimeout = timeout
+			}
+		}
+	}
+}
+
 func ParseConfig(fn string) (Configuration, error) {
 	config := Configuration{}
 	errs := ConfigurationError{Empty: true}
 
-	input, err := ini.LoadFile(fn)
+	input, err := loadConfigFile(fn)
 	if err != nil {
 		return config, err
 	}
@@ -166,7 +960,54 @@ func ParseConfig(fn string) (Configuration, error) {
 	config.AMQPHostname = "localhost"
 	config.AMQPUsername = "cb"
 	config.HTTPServerPort = 33706
+	config.StatusErrorHistory = 50
 	config.AMQPPort = 5004
+	config.ScriptTimeout = 100 * time.Millisecond
+	config.UploadTimeout = 5 * time.Minute
+	config.BundleMaxAge = time.Hour
+	config.UpdateCheckInterval = 24 * time.Hour
+	config.InputRateWindow = 5 * time.Minute
+	config.SchemaCheckInterval = 15 * time.Minute
+	config.ConsumerChannels = 1
+	config.BundleFormat = LinesBundleFormat
+	config.BundleRollOverMode = FixedRollOverMode
+	config.BundleUrgentEvents = []string{"alert.#"}
+	config.BundleUrgentRollOverInterval = 30 * time.Second
+	config.BundleBulkRollOverInterval = 15 * time.Minute
+	config.BundleCompression = NoBundleCompression
+	config.ZstdLevel = zstd.SpeedDefault
+	config.ProcessContextCacheSize = 100000
+	config.BinaryArchiveMaxSize = 100 * 1024 * 1024
+	config.RedeliveryWindow = 10 * time.Minute
+	config.RedeliveryCacheSize = 100000
+	config.RabbitMQManagementInterval = 30 * time.Second
+	config.RemoteConfigPollInterval = 5 * time.Minute
+	config.PipelineDirectory = "/var/cb/data/event-forwarder/pipelines"
+	config.HoldingAreaExpiredAction = HoldingAreaExpiredArchive
+	config.BufferSpillFile = defaultBufferSpillFile
+	config.BufferSpillLimit = 1024 * 1024 * 1024
+	config.OutputArchiveFailures = 5
+	config.OutputArchiveCooldown = time.Minute
+	config.OutputArchiveMaxSize = 1024 * 1024 * 1024
+	config.AuditSampleRate = 0.001
+	config.HTTPMaxIdleConns = 100
+	config.HTTPMaxIdleConnsPerHost = 16
+	config.HTTPIdleConnTimeout = 90 * time.Second
+	config.HTTPKeepAlive = 30 * time.Second
+	config.HTTP2 = true
+	config.AuditMaxSize = 100 * 1024 * 1024
+	config.OversizePolicy = OversizeDrop
+	config.SanitizeInvalidUTF8 = InvalidUTF8Replace
+	config.OutputEncodingReplacement = "?"
+	config.JSONEscapeHTML = true
+	config.JSONFlatten = JSONNested
+	config.JSONFlattenArrays = true
+	config.SanitizeControlCharacters = ControlCharactersEscape
+	config.DeadLetterMaxSize = 100 * 1024 * 1024
+	config.TempFileSyncBytes = 1024 * 1024
+	config.TempFileSyncInterval = time.Second
+	config.IndicatorReloadInterval = time.Minute
+	config.IndicatorPollInterval = time.Hour
 
 	config.S3ACLPolicy = nil
 	config.S3ServerSideEncryption = nil
@@ -195,6 +1036,17 @@ func ParseConfig(fn string) (Configuration, error) {
 		}
 	}
 
+	val, ok = input.Get("bridge", "status_error_history")
+	if ok {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			errs.addErrorString(fmt.Sprintf("Invalid status_error_history '%s': should be a number of errors of at "+
+				"least 1", val))
+		} else {
+			config.StatusErrorHistory = n
+		}
+	}
+
 	val, ok = input.Get("bridge", "rabbit_mq_username")
 	if ok {
 		config.AMQPUsername = val
@@ -227,6 +1079,28 @@ func ParseConfig(fn string) (Configuration, error) {
 		config.AMQPHostname = val
 	}
 
+	val, ok = input.Get("bridge", "rabbit_mq_management_url")
+	if ok && len(val) > 0 {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid rabbit_mq_management_url '%s': should be an http or https URL "+
+				"such as http://cb-server:15672", val))
+		} else {
+			config.RabbitMQManagementURL = val
+		}
+	}
+
+	val, ok = input.Get("bridge", "rabbit_mq_management_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval < 5*time.Second {
+			errs.addErrorString(fmt.Sprintf("Invalid rabbit_mq_management_interval '%s': should be a duration of "+
+				"at least 5s, such as 30s", val))
+		} else {
+			config.RabbitMQManagementInterval = interval
+		}
+	}
+
 	val, ok = input.Get("bridge", "cb_server_url")
 	if ok {
 		if !strings.HasSuffix(val, "/") {
@@ -244,82 +1118,123 @@ func ParseConfig(fn string) (Configuration, error) {
 		}
 	}
 
+	for key, setting := range map[string]*bool{"json_pretty": &config.JSONPretty,
+		"json_escape_html": &config.JSONEscapeHTML, "json_omit_null": &config.JSONOmitNull,
+		"json_flatten_arrays": &config.JSONFlattenArrays, "json_envelope": &config.JSONEnvelope} {
+		if val, ok := input.Get("bridge", key); ok {
+			boolval, err := strconv.ParseBool(val)
+			if err == nil {
+				*setting = boolval
+			} else {
+				errs.addErrorString(fmt.Sprintf("Unknown value for '%s': valid values are true, false, 1, 0", key))
+			}
+		}
+	}
+
+	val, ok = input.Get("bridge", "tenant")
+	if ok {
+		config.Tenant = val
+	}
+
+	val, ok = input.Get("bridge", "json_flatten")
+	if ok {
+		switch val {
+		case JSONNested, JSONDotted, JSONUnderscore:
+			config.JSONFlatten = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown json_flatten '%s': valid values are nested, dotted, underscore", val))
+		}
+	}
+
 	outType, ok := input.Get("bridge", "output_type")
 	var parameterKey string
 	if ok {
 		outType = strings.TrimSpace(outType)
 		outType = strings.ToLower(outType)
 
-		switch outType {
-		case "file":
-			parameterKey = "outfile"
-			config.OutputType = FileOutputType
-		case "tcp":
-			parameterKey = "tcpout"
-			config.OutputType = TCPOutputType
-		case "udp":
-			parameterKey = "udpout"
-			config.OutputType = UDPOutputType
-		case "s3":
-			parameterKey = "s3out"
-			config.OutputType = S3OutputType
-
-			profileName, ok := input.Get("s3", "credential_profile")
-			if ok {
-				config.S3CredentialProfileName = &profileName
-			}
+		if registration, ok := LookupOutput(outType); ok {
+			config.OutputType = outType
+			parameterKey = registration.ParameterKey
+		} else {
+			errs.addErrorString(fmt.Sprintf("Unknown output type: %s (valid output types are %s)", outType,
+				strings.Join(RegisteredOutputs(), ", ")))
+		}
 
-			aclPolicy, ok := input.Get("s3", "acl_policy")
-			if ok {
-				config.S3ACLPolicy = &aclPolicy
-			}
+		config.parseOutputOptions(input, outType, &errs)
+	}
+	if len(parameterKey) > 0 {
+		val, ok = input.Get("bridge", parameterKey)
+		if !ok {
+			errs.addErrorString(fmt.Sprintf("Missing value for key %s, required by output type %s", val, outType))
+		} else {
+			config.OutputParameters = val
+		}
+	}
 
-			sseType, ok := input.Get("s3", "server_side_encryption")
-			if ok {
-				config.S3ServerSideEncryption = &sseType
-			}
+	// -replay-s3 reads from S3 whatever the output type
+	if profileName, ok := input.Get("s3", "credential_profile"); ok && config.S3CredentialProfileName == nil {
+		config.S3CredentialProfileName = &profileName
+	}
+	config.parseS3Endpoint(input, &errs)
 
-			objectPrefix, ok := input.Get("s3", "object_prefix")
-			if ok {
-				config.S3ObjectPrefix = &objectPrefix
+	val, ok = input.Get("bridge", "shadow_output_type")
+	if ok {
+		val = strings.ToLower(strings.TrimSpace(val))
+		if _, ok := LookupOutput(val); ok {
+			config.ShadowOutputType = val
+			if val != config.OutputType {
+				config.parseOutputOptions(input, val, &errs)
 			}
-		case "syslog":
-			parameterKey = "syslogout"
-			config.OutputType = SyslogOutputType
+		} else {
+			errs.addErrorString(fmt.Sprintf("Unknown shadow output type: %s (valid output types are %s)", val,
+				strings.Join(RegisteredOutputs(), ", ")))
+		}
 
-			clientKeyFilename, ok := input.Get("syslog", "client_key")
-			if ok {
-				config.SyslogTLSClientKey = &clientKeyFilename
-			}
-
-			clientCertFilename, ok := input.Get("syslog", "client_cert")
-			if ok {
-				config.SyslogTLSClientCert = &clientCertFilename
-			}
+		if val, ok := input.Get("bridge", "shadow_output"); ok {
+			config.ShadowOutputParameters = val
+		} else {
+			errs.addErrorString("Missing value for key shadow_output, required by shadow_output_type")
+		}
 
-			caCertFilename, ok := input.Get("syslog", "ca_cert")
-			if ok {
-				config.SyslogTLSCACert = &caCertFilename
+		if val, ok := input.Get("bridge", "shadow_until"); ok {
+			until, err := parseDateOrTime(val)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid shadow_until '%s': should be a date such as 2006-01-02, or a time such as 2006-01-02T15:04:05Z", val))
+			} else {
+				config.ShadowUntil = until
 			}
+		} else {
+			errs.addErrorString("Missing value for key shadow_until, required by shadow_output_type")
+		}
+	}
 
-			config.SyslogTLSVerify = true
-			tlsVerify, ok := input.Get("syslog", "tls_verify")
-			if ok {
-				if tlsVerify == "false" {
-					config.SyslogTLSVerify = false
-				}
+	val, ok = input.Get("bridge", "tier_output_type")
+	if ok {
+		val = strings.ToLower(strings.TrimSpace(val))
+		if _, ok := LookupOutput(val); ok {
+			config.TierOutputType = val
+			if val != config.OutputType && val != config.ShadowOutputType {
+				config.parseOutputOptions(input, val, &errs)
 			}
+		} else {
+			errs.addErrorString(fmt.Sprintf("Unknown tier output type: %s (valid output types are %s)", val,
+				strings.Join(RegisteredOutputs(), ", ")))
+		}
 
-		default:
-			errs.addErrorString(fmt.Sprintf("Unknown output type: %s", outType))
+		if val, ok := input.Get("bridge", "tier_output"); ok {
+			config.TierOutputParameters = val
+		} else {
+			errs.addErrorString("Missing value for key tier_output, required by tier_output_type")
 		}
+		config.TierPolicies = parseTierPolicies(input.Section("tier"), &errs)
 	}
-	if len(parameterKey) > 0 {
-		val, ok = input.Get("bridge", parameterKey)
-		if !ok {
-			errs.addErrorString(fmt.Sprintf("Missing value for key %s, required by output type %s", val, outType))
-		} else {
-			config.OutputParameters = val
+
+	if config.JSONPretty && config.OutputFormat == JSONOutputFormat {
+		for _, outType := range []string{config.OutputType, config.ShadowOutputType, config.TierOutputType} {
+			if registration, ok := LookupOutput(outType); ok && registration.WritesFiles {
+				errs.addErrorString(fmt.Sprintf("json_pretty can't be used with output type %s, whose files must "+
+					"have one event a line", outType))
+			}
 		}
 	}
 
@@ -339,7 +1254,1079 @@ func ParseConfig(fn string) (Configuration, error) {
 		}
 	}
 
-	config.parseEventTypes(input)
+	val, ok = input.Get("bridge", "explode_fields")
+	if ok {
+		for _, field := range strings.Split(val, ",") {
+			field = strings.TrimSpace(field)
+			if len(field) > 0 {
+				config.ExplodeFields = append(config.ExplodeFields, field)
+			}
+		}
+	}
+
+	val, ok = input.Get("bridge", "parse_command_lines")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.ParseCommandLines = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'parse_command_lines': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "normalize_domains")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.NormalizeDomains = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'normalize_domains': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "process_context")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.ProcessContext = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'process_context': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "attack_techniques")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.AttackTechniques = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'attack_techniques': valid values are true, false, 1, 0")
+		}
+	}
+
+	traceTypes, hasTypes := input.Get("bridge", "trace_types")
+	traceMatch, hasMatch := input.Get("bridge", "trace_match")
+	if hasTypes || hasMatch {
+		config.TraceFilter = &AttackRule{Name: "trace", EventTypes: splitList(traceTypes)}
+		if len(config.TraceFilter.EventTypes) == 0 {
+			config.TraceFilter.EventTypes = []string{"#"}
+		}
+		if hasMatch {
+			conditions, err := parseAttackConditions(traceMatch)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid trace_match '%s': %s", traceMatch, err))
+			}
+			config.TraceFilter.Conditions = conditions
+		}
+		config.TraceSampleRate = 1
+	}
+
+	val, ok = input.Get("bridge", "trace_sample_rate")
+	if ok {
+		rate, err := strconv.ParseFloat(val, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			errs.addErrorString(fmt.Sprintf("Invalid trace_sample_rate '%s': should be a fraction of events from 0 "+
+				"to 1, such as 0.0001", val))
+		} else {
+			config.TraceSampleRate = rate
+		}
+	}
+
+	val, ok = input.Get("bridge", "process_context_cache_size")
+	if ok {
+		size, err := strconv.Atoi(val)
+		if err != nil || size < 1 {
+			errs.addErrorString(fmt.Sprintf("Invalid process_context_cache_size '%s': should be a number of "+
+				"processes, such as 100000", val))
+		} else {
+			config.ProcessContextCacheSize = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "process_context_types")
+	if ok {
+		for _, eventType := range strings.Split(val, ",") {
+			if eventType = strings.TrimSpace(eventType); len(eventType) > 0 {
+				config.ProcessContextTypes = append(config.ProcessContextTypes, eventType)
+			}
+		}
+	}
+
+	val, ok = input.Get("bridge", "max_procs")
+	if ok {
+		procs, err := strconv.Atoi(val)
+		if err != nil || procs < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid max_procs '%s': should be a number of CPUs, or 0 for all of them", val))
+		} else {
+			config.MaxProcs = procs
+		}
+	}
+
+	val, ok = input.Get("bridge", "memory_limit")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid memory_limit '%s': should be a number of bytes, or 0 for no limit", val))
+		} else {
+			config.MemoryLimit = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "memory_ballast")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid memory_ballast '%s': should be a number of bytes", val))
+		} else {
+			config.MemoryBallast = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "nice")
+	if ok {
+		level, err := strconv.Atoi(val)
+		if err != nil || level < -20 || level > 19 {
+			errs.addErrorString(fmt.Sprintf("Invalid nice '%s': should be a number from -20 to 19", val))
+		} else {
+			config.NiceLevel = level
+		}
+	}
+
+	val, ok = input.Get("bridge", "output_encoding_replacement")
+	if ok {
+		config.OutputEncodingReplacement = val
+	}
+
+	val, ok = input.Get("bridge", "output_encoding")
+	if ok {
+		if _, err := newOutputEncoder(val, config.OutputEncodingReplacement); err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid output_encoding: %s", err))
+		} else {
+			config.OutputEncoding = val
+		}
+	}
+
+	val, ok = input.Get("bridge", "sanitize_output")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.SanitizeOutput = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'sanitize_output': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "sanitize_invalid_utf8")
+	if ok {
+		switch val {
+		case InvalidUTF8Replace, InvalidUTF8Transliterate, InvalidUTF8Drop:
+			config.SanitizeInvalidUTF8 = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown sanitize_invalid_utf8 '%s': valid values are replace, transliterate, drop", val))
+		}
+	}
+
+	val, ok = input.Get("bridge", "sanitize_control_characters")
+	if ok {
+		switch val {
+		case ControlCharactersEscape, ControlCharactersStrip, ControlCharactersKeep:
+			config.SanitizeControlCharacters = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown sanitize_control_characters '%s': valid values are escape, strip, keep", val))
+		}
+	}
+
+	val, ok = input.Get("bridge", "max_event_size")
+	if ok {
+		size, err := strconv.Atoi(val)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid max_event_size '%s': should be a number of bytes, or 0 for no limit", val))
+		} else {
+			config.MaxEventSize = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "oversize_policy")
+	if ok {
+		switch val {
+		case OversizeTruncate, OversizeSplit, OversizeDrop:
+			config.OversizePolicy = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown oversize_policy '%s': valid policies are truncate, split, drop", val))
+		}
+	}
+
+	val, ok = input.Get("bridge", "oversize_fields")
+	if ok {
+		for _, field := range strings.Split(val, ",") {
+			if field = strings.TrimSpace(field); len(field) > 0 {
+				config.OversizeFields = append(config.OversizeFields, field)
+			}
+		}
+	}
+
+	val, ok = input.Get("bridge", "dead_letter_file")
+	if ok {
+		config.DeadLetterFile = val
+	}
+
+	val, ok = input.Get("bridge", "dead_letter_max_size")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid dead_letter_max_size '%s': should be a number of bytes, or 0 for no limit", val))
+		} else {
+			config.DeadLetterMaxSize = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "audit_file")
+	if ok {
+		config.AuditFile = val
+	}
+
+	val, ok = input.Get("bridge", "audit_sample_rate")
+	if ok {
+		// either a fraction of events or a percentage, such as 0.1%
+		rate, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+		if err == nil && strings.HasSuffix(val, "%") {
+			rate /= 100
+		}
+		if err != nil || rate < 0 || rate > 1 {
+			errs.addErrorString(fmt.Sprintf("Invalid audit_sample_rate '%s': should be a fraction such as 0.001, or a percentage such as 0.1%%", val))
+		} else {
+			config.AuditSampleRate = rate
+		}
+	}
+
+	val, ok = input.Get("bridge", "audit_max_size")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid audit_max_size '%s': should be a number of bytes, or 0 for no limit", val))
+		} else {
+			config.AuditMaxSize = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "output_archive_directory")
+	if ok {
+		config.OutputArchiveDirectory = val
+	}
+
+	val, ok = input.Get("bridge", "output_archive_failures")
+	if ok {
+		failures, err := strconv.Atoi(val)
+		if err != nil || failures < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid output_archive_failures '%s': should be a number of failures, or 0 to never open the circuit breaker", val))
+		} else {
+			config.OutputArchiveFailures = failures
+		}
+	}
+
+	val, ok = input.Get("bridge", "output_archive_cooldown")
+	if ok {
+		cooldown, err := time.ParseDuration(val)
+		if err != nil || cooldown < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid output_archive_cooldown '%s': should be a duration such as 1m", val))
+		} else {
+			config.OutputArchiveCooldown = cooldown
+		}
+	}
+
+	val, ok = input.Get("bridge", "output_archive_max_size")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid output_archive_max_size '%s': should be a number of bytes, or 0 for no limit", val))
+		} else {
+			config.OutputArchiveMaxSize = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "output_stall_timeout")
+	if ok {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid output_stall_timeout '%s': should be a duration such as 5m, or 0 to never restart the output", val))
+		} else {
+			config.OutputStallTimeout = timeout
+		}
+	}
+
+	val, ok = input.Get("bridge", "heartbeat_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid heartbeat_interval '%s': should be a duration such as 5m, or 0 for no heartbeat", val))
+		} else {
+			config.HeartbeatInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "stats_rollup_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || (interval != 0 && interval < time.Minute) {
+			errs.addErrorString(fmt.Sprintf("Invalid stats_rollup_interval '%s': should be a duration of at least "+
+				"1m, such as 5m, or 0 for no statistics events", val))
+		} else {
+			config.StatsRollupInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "stats_rollup_file")
+	if ok {
+		config.StatsRollupFile = val
+	}
+
+	for _, option := range []struct {
+		key   string
+		bound *float64
+	}{{"input_rate_low", &config.InputRateLow}, {"input_rate_high", &config.InputRateHigh}} {
+		val, ok = input.Get("bridge", option.key)
+		if ok {
+			rate, err := strconv.ParseFloat(val, 64)
+			if err != nil || rate < 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid %s '%s': should be a number of events per second, or 0 "+
+					"for no bound", option.key, val))
+			} else {
+				*option.bound = rate
+			}
+		}
+	}
+	if config.InputRateHigh > 0 && config.InputRateLow >= config.InputRateHigh {
+		errs.addErrorString(fmt.Sprintf("input_rate_low (%g) should be below input_rate_high (%g)",
+			config.InputRateLow, config.InputRateHigh))
+	}
+
+	val, ok = input.Get("bridge", "input_rate_window")
+	if ok {
+		window, err := time.ParseDuration(val)
+		if err != nil || (window != time.Minute && window != 5*time.Minute && window != 15*time.Minute) {
+			errs.addErrorString(fmt.Sprintf("Invalid input_rate_window '%s': should be 1m, 5m or 15m", val))
+		} else {
+			config.InputRateWindow = window
+		}
+	}
+
+	val, ok = input.Get("bridge", "clock_skew_tolerance")
+	if ok {
+		tolerance, err := time.ParseDuration(val)
+		if err != nil || tolerance < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid clock_skew_tolerance '%s': should be a duration, such as 5m, "+
+				"or 0 for no check", val))
+		} else {
+			config.ClockSkewTolerance = tolerance
+		}
+	}
+
+	val, ok = input.Get("bridge", "schema_baseline")
+	if ok && len(val) > 0 {
+		baseline, err := loadSchemaBaseline(val)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid schema_baseline '%s': %s", val, err))
+		} else {
+			config.SchemaBaselineFile, config.SchemaBaseline = val, baseline
+		}
+	}
+
+	val, ok = input.Get("bridge", "schema_check_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval < time.Minute {
+			errs.addErrorString(fmt.Sprintf("Invalid schema_check_interval '%s': should be a duration of at least "+
+				"1m, such as 15m", val))
+		} else {
+			config.SchemaCheckInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "update_check_url")
+	if ok && len(val) > 0 {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid update_check_url '%s': should be an http or https URL", val))
+		} else {
+			config.UpdateCheckURL = val
+		}
+	}
+
+	val, ok = input.Get("bridge", "update_check_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval < time.Minute {
+			errs.addErrorString(fmt.Sprintf("Invalid update_check_interval '%s': should be a duration of at least "+
+				"1m, such as 24h", val))
+		} else {
+			config.UpdateCheckInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "remote_config_poll_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || (interval != 0 && interval < 10*time.Second) {
+			errs.addErrorString(fmt.Sprintf("Invalid remote_config_poll_interval '%s': should be a duration of at "+
+				"least 10s, such as 5m, or 0 to never check for changes", val))
+		} else {
+			config.RemoteConfigPollInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "fips_mode")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.FIPSMode = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'fips_mode': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "dns_servers")
+	if ok {
+		config.DNSServers = parseDNSServers(val, &errs)
+	}
+
+	val, ok = input.Get("bridge", "dns_timeout")
+	if ok {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid dns_timeout '%s': should be a duration such as 5s, or 0 for no limit", val))
+		} else {
+			config.DNSTimeout = timeout
+		}
+	}
+
+	config.HostOverrides = parseHostOverrides(input.Section("hosts"), &errs)
+
+	for key, setting := range map[string]*int{"http_max_idle_connections": &config.HTTPMaxIdleConns,
+		"http_max_idle_connections_per_host": &config.HTTPMaxIdleConnsPerHost} {
+		if val, ok := input.Get("bridge", key); ok {
+			count, err := strconv.Atoi(val)
+			if err != nil || count < 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid %s '%s': should be a number of connections, or 0 for no limit", key, val))
+			} else {
+				*setting = count
+			}
+		}
+	}
+
+	for key, setting := range map[string]*time.Duration{"http_idle_timeout": &config.HTTPIdleConnTimeout,
+		"http_keepalive": &config.HTTPKeepAlive} {
+		if val, ok := input.Get("bridge", key); ok {
+			duration, err := time.ParseDuration(val)
+			if err != nil || duration < 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid %s '%s': should be a duration such as 30s, or 0 to disable", key, val))
+			} else {
+				*setting = duration
+			}
+		}
+	}
+
+	val, ok = input.Get("bridge", "http2")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.HTTP2 = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'http2': valid values are true, false, 1, 0")
+		}
+	}
+
+	for _, key := range [...]string{"http_proxy", "https_proxy"} {
+		if val, ok := input.Get("bridge", key); ok && !validProxyURL(val) {
+			errs.addErrorString(fmt.Sprintf("Invalid %s '%s': should be a URL such as http://proxy.example.com:3128", key, val))
+		}
+	}
+	config.HTTPProxy, _ = input.Get("bridge", "http_proxy")
+	config.HTTPSProxy, _ = input.Get("bridge", "https_proxy")
+	config.NoProxy, _ = input.Get("bridge", "no_proxy")
+	config.ProxyUsername, _ = input.Get("bridge", "proxy_username")
+	config.ProxyPassword, _ = input.Get("bridge", "proxy_password")
+	if len(config.ProxyPassword) > 0 && len(config.ProxyUsername) == 0 {
+		errs.addErrorString("Missing value for key proxy_username, required by proxy_password")
+	}
+
+	val, ok = input.Get("bridge", "buffer_memory_size")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid buffer_memory_size '%s': should be a number of bytes, or 0 to disable buffering", val))
+		} else {
+			config.BufferMemorySize = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "buffer_spill_file")
+	if ok {
+		config.BufferSpillFile = val
+	}
+
+	val, ok = input.Get("bridge", "buffer_spill_limit")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid buffer_spill_limit '%s': should be a number of bytes, or 0 for no limit", val))
+		} else {
+			config.BufferSpillLimit = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "redelivery_window")
+	if ok {
+		window, err := time.ParseDuration(val)
+		if err != nil || window < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid redelivery_window '%s': should be a duration such as 10m, or 0 to process every redelivery", val))
+		} else {
+			config.RedeliveryWindow = window
+		}
+	}
+
+	val, ok = input.Get("bridge", "redelivery_cache_size")
+	if ok {
+		size, err := strconv.Atoi(val)
+		if err != nil || size < 1 {
+			errs.addErrorString(fmt.Sprintf("Invalid redelivery_cache_size '%s': should be a number of messages, such as 100000", val))
+		} else {
+			config.RedeliveryCacheSize = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "pause_holding_area_files")
+	if ok {
+		files, err := strconv.Atoi(val)
+		if err != nil || files < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid pause_holding_area_files '%s': should be a number of files, or 0 for no limit", val))
+		} else {
+			config.PauseHoldingAreaFiles = files
+		}
+	}
+
+	val, ok = input.Get("bridge", "pause_buffer_bytes")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid pause_buffer_bytes '%s': should be a number of bytes, or 0 for no limit", val))
+		} else {
+			config.PauseBufferBytes = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_rollover_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval < time.Second {
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_rollover_interval '%s': should be a duration such as 5m", val))
+		} else {
+			config.BundleRollOverInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_align_rollover")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.BundleAlignRollOver = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'bundle_align_rollover': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_rollover_mode")
+	if ok {
+		switch val {
+		case FixedRollOverMode, AdaptiveRollOverMode:
+			config.BundleRollOverMode = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_rollover_mode '%s': should be fixed or adaptive", val))
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_urgent_events")
+	if ok {
+		config.BundleUrgentEvents = splitList(val)
+	}
+
+	val, ok = input.Get("bridge", "bundle_urgent_rollover_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval < time.Second {
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_urgent_rollover_interval '%s': should be a duration of "+
+				"at least 1s, such as 30s", val))
+		} else {
+			config.BundleUrgentRollOverInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_bulk_rollover_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval < time.Second {
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_bulk_rollover_interval '%s': should be a duration of "+
+				"at least 1s, such as 15m", val))
+		} else {
+			config.BundleBulkRollOverInterval = interval
+		}
+	}
+
+	if config.BundleRollOverMode == AdaptiveRollOverMode {
+		if config.BundleAlignRollOver {
+			errs.addErrorString("bundle_rollover_mode=adaptive can't be used with bundle_align_rollover")
+		}
+		if config.BundleUrgentRollOverInterval > config.BundleBulkRollOverInterval {
+			errs.addErrorString(fmt.Sprintf("bundle_urgent_rollover_interval (%s) should not be longer than "+
+				"bundle_bulk_rollover_interval (%s)", config.BundleUrgentRollOverInterval,
+				config.BundleBulkRollOverInterval))
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_min_size")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_min_size '%s': should be a number of bytes, or 0 for no minimum", val))
+		} else {
+			config.BundleMinSize = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_max_age")
+	if ok {
+		age, err := time.ParseDuration(val)
+		if err != nil || age < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_max_age '%s': should be a duration such as 1h", val))
+		} else {
+			config.BundleMaxAge = age
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_reorder_window")
+	if ok {
+		window, err := time.ParseDuration(val)
+		if err != nil || window < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_reorder_window '%s': should be a duration such as 30s, "+
+				"or 0 to write events as they arrive", val))
+		} else {
+			config.BundleReorderWindow = window
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_signing_key")
+	if ok {
+		config.BundleSigningKey = val
+	}
+
+	val, ok = input.Get("bridge", "temp_file_sync")
+	if ok {
+		mode, err := parseFileSyncMode(val)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Unknown value for 'temp_file_sync': %s", err))
+		} else {
+			config.TempFileSync = mode
+		}
+	}
+
+	val, ok = input.Get("bridge", "temp_file_sync_bytes")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size <= 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid temp_file_sync_bytes '%s': should be a number of bytes", val))
+		} else {
+			config.TempFileSyncBytes = size
+		}
+	}
+
+	val, ok = input.Get("bridge", "temp_file_sync_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval <= 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid temp_file_sync_interval '%s': should be a duration such as 1s", val))
+		} else {
+			config.TempFileSyncInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_by_event_type")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.BundleByEventType = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'bundle_by_event_type': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_name_template")
+	if ok {
+		if err := validateBundleNameTemplate(val); err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_name_template '%s': %s", val, err))
+		} else {
+			config.BundleNameTemplate = val
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_format")
+	if ok {
+		switch val {
+		case LinesBundleFormat, IndexedBundleFormat:
+			config.BundleFormat = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_format '%s': should be lines or indexed", val))
+		}
+	}
+
+	val, ok = input.Get("bridge", "bundle_compression")
+	if ok {
+		switch val {
+		case NoBundleCompression, GzipBundleCompression, ZstdBundleCompression:
+			config.BundleCompression = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Invalid bundle_compression '%s': should be none, gzip or zstd", val))
+		}
+	}
+
+	val, ok = input.Get("bridge", "zstd_level")
+	if ok {
+		if valid, level := zstd.EncoderLevelFromString(val); valid {
+			config.ZstdLevel = level
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid zstd_level '%s': should be fastest, default, better or best",
+				val))
+		}
+	}
+
+	val, ok = input.Get("bridge", "zstd_dictionary")
+	if ok && len(val) > 0 {
+		dictionary, err := loadZstdDictionary(val)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Could not load zstd_dictionary: %s", err))
+		} else {
+			config.ZstdDictionaryFile = val
+			config.ZstdDictionary = dictionary
+		}
+	}
+
+	val, ok = input.Get("bridge", "allow_holding_area_changes")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.HoldingAreaChanges = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'allow_holding_area_changes': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "watch_holding_area")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.WatchHoldingArea = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'watch_holding_area': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "holding_area_max_age")
+	if ok {
+		age, err := parseRetentionPeriod(val)
+		if err != nil || age < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid holding_area_max_age '%s': should be a period such as 30d, or 0 "+
+				"to keep files until they are uploaded", val))
+		} else {
+			config.HoldingAreaMaxAge = age
+		}
+	}
+
+	val, ok = input.Get("bridge", "holding_area_expired_action")
+	if ok {
+		switch val {
+		case HoldingAreaExpiredArchive, HoldingAreaExpiredDelete:
+			config.HoldingAreaExpiredAction = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown holding_area_expired_action '%s': valid values are archive, "+
+				"delete", val))
+		}
+	}
+
+	val, ok = input.Get("bridge", "holding_area_archive_directory")
+	if ok {
+		config.HoldingAreaArchiveDirectory = val
+	}
+
+	val, ok = input.Get("bridge", "max_events_per_second")
+	if ok {
+		limit, err := strconv.ParseFloat(val, 64)
+		if err != nil || limit < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid max_events_per_second '%s': should be a number, or 0 for no limit", val))
+		} else {
+			config.MaxEventsPerSecond = limit
+		}
+	}
+
+	val, ok = input.Get("bridge", "consumer_group")
+	if ok {
+		if strings.ContainsAny(val, ": \t") {
+			errs.addErrorString(fmt.Sprintf("Invalid consumer_group '%s': should not contain colons or spaces", val))
+		} else {
+			config.ConsumerGroup = val
+		}
+	}
+
+	val, ok = input.Get("bridge", "pipelines")
+	if ok && len(val) > 0 {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			if !pipelineNamePattern.MatchString(name) {
+				errs.addErrorString(fmt.Sprintf("Invalid pipeline name '%s' in pipelines: should only contain "+
+					"letters, digits, - and _", name))
+				continue
+			}
+			config.Pipelines = append(config.Pipelines, name)
+		}
+	}
+
+	val, ok = input.Get("bridge", "pipeline_directory")
+	if ok && len(val) > 0 {
+		config.PipelineDirectory = val
+	}
+
+	val, ok = input.Get("bridge", "pipeline_name")
+	if ok {
+		config.PipelineName = val
+	}
+
+	val, ok = input.Get("bridge", "durable_queue")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.DurableQueue = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'durable_queue': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "queue_name")
+	if ok {
+		config.QueueName = val
+	}
+
+	val, ok = input.Get("bridge", "queue_durable")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.QueueDurable = &boolval
+		} else {
+			errs.addErrorString("Unknown value for 'queue_durable': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "queue_auto_delete")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.QueueAutoDelete = &boolval
+		} else {
+			errs.addErrorString("Unknown value for 'queue_auto_delete': valid values are true, false, 1, 0")
+		}
+	}
+
+	val, ok = input.Get("bridge", "queue_message_ttl")
+	if ok {
+		ttl, err := time.ParseDuration(val)
+		if err != nil || ttl < time.Millisecond {
+			errs.addErrorString(fmt.Sprintf("Invalid queue_message_ttl '%s': should be a duration such as 1h", val))
+		} else {
+			config.QueueMessageTTL = ttl
+		}
+	}
+
+	val, ok = input.Get("bridge", "queue_max_length")
+	if ok {
+		length, err := strconv.Atoi(val)
+		if err != nil || length < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid queue_max_length '%s': should be a number of messages, or 0 for no limit", val))
+		} else {
+			config.QueueMaxLength = length
+		}
+	}
+
+	val, ok = input.Get("bridge", "prefetch_count")
+	if ok {
+		count, err := strconv.Atoi(val)
+		if err != nil || count < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid prefetch_count '%s': should be a number of messages, or 0 for no limit", val))
+		} else {
+			config.PrefetchCount = &count
+		}
+	}
+
+	val, ok = input.Get("bridge", "consumer_channels")
+	if ok {
+		channels, err := strconv.Atoi(val)
+		if err != nil || channels < 1 || channels > maxConsumerChannels {
+			errs.addErrorString(fmt.Sprintf("Invalid consumer_channels '%s': should be a number from 1 to %d", val,
+				maxConsumerChannels))
+		} else {
+			config.ConsumerChannels = channels
+		}
+	}
+
+	val, ok = input.Get("bridge", "prefetch_size")
+	if ok {
+		size, err := strconv.Atoi(val)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid prefetch_size '%s': should be a number of bytes, or 0 for no "+
+				"limit", val))
+		} else {
+			config.PrefetchSize = size
+		}
+	}
+
+	val, ok = input.Get("management", "api_token")
+	if ok {
+		config.ManagementToken = val
+	}
+
+	if config.HoldingAreaChanges && len(config.ManagementToken) == 0 {
+		errs.addErrorString("allow_holding_area_changes requires an api_token")
+	}
+
+	val, ok = input.Get("management", "debug_pprof")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err != nil {
+			errs.addErrorString("Unknown value for 'debug_pprof': valid values are true, false, 1, 0")
+		} else if boolval && len(config.ManagementToken) == 0 {
+			errs.addErrorString("debug_pprof requires an api_token")
+		} else {
+			config.DebugPprof = boolval
+		}
+	}
+
+	val, ok = input.Get("binaries", "destination")
+	if ok {
+		config.BinaryArchiveDestination = val
+	}
+
+	val, ok = input.Get("binaries", "api_token")
+	if ok {
+		config.BinaryArchiveAPIToken = val
+	}
+
+	val, ok = input.Get("binaries", "max_size")
+	if ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid [binaries] max_size '%s': should be a number of bytes, or 0 for no limit", val))
+		} else {
+			config.BinaryArchiveMaxSize = size
+		}
+	}
+
+	val, ok = input.Get("binaries", "forward_events")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.BinaryArchiveOnly = !boolval
+		} else {
+			errs.addErrorString("Unknown value for 'forward_events': valid values are true, false, 1, 0")
+		}
+	}
+
+	if len(config.BinaryArchiveDestination) > 0 {
+		if len(config.BinaryArchiveAPIToken) == 0 {
+			errs.addErrorString("The [binaries] destination requires an api_token to download binaries with")
+		}
+		if len(config.CbServerURL) == 0 {
+			errs.addErrorString("The [binaries] destination requires cb_server_url to download binaries from")
+		}
+	}
+
+	config.Transforms = parseFieldTransforms(input.Section("transform"), &errs)
+
+	config.Redactions = parseRedactions(input.Section("redact"), &errs)
+
+	if config.AttackTechniques {
+		config.AttackRules = parseAttackRules(input.Section("attack"), &errs)
+	}
+
+	config.SeverityScores = parseSeverityScores(input.Section("severity"), &errs)
+
+	config.Aggregations = parseAggregations(input.Section("aggregate"), &errs)
+
+	config.EventActions, config.EventActionTimeout = parseEventActions(input.Section("actions"), &errs)
+
+	config.UploadHooks = parseUploadHooks(input.Section("upload_hooks"), &errs)
+
+	config.IndicatorLists = parseIndicatorLists(input.Section("indicators"), &errs)
+
+	val, ok = input.Get("indicators", "reload_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval <= 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid reload_interval '%s' in [indicators]: should be a duration such as 1m", val))
+		} else {
+			config.IndicatorReloadInterval = interval
+		}
+	}
+
+	val, ok = input.Get("indicators", "taxii_poll_interval")
+	if ok {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval <= 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid taxii_poll_interval '%s' in [indicators]: should be a duration such as 1h", val))
+		} else {
+			config.IndicatorPollInterval = interval
+		}
+	}
+
+	val, ok = input.Get("bridge", "script_file")
+	if ok {
+		config.ScriptFile = val
+	}
+
+	val, ok = input.Get("bridge", "script_timeout")
+	if ok {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout <= 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid script_timeout '%s': should be a duration such as 100ms", val))
+		} else {
+			config.ScriptTimeout = timeout
+		}
+	}
+
+	val, ok = input.Get("bridge", "upload_timeout")
+	if ok {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout <= 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid upload_timeout '%s': should be a duration such as 5m", val))
+		} else {
+			config.UploadTimeout = timeout
+		}
+	}
+
+	config.parseEventTypes(input)
+	config.CustomBindings = parseCustomBindings(input.Section("bindings"), &errs)
+	config.LatencySLOs, config.LatencySLOWindow = parseLatencySLOs(input.Section("latency_slo"), &errs)
+
+	// outputs keeping events in the same place would take each other's files
+	usedBy := make(map[string]string)
+	for option, path := range outputPaths(config, "output_type", config.OutputType, config.OutputParameters) {
+		usedBy[path] = option
+	}
+	for _, output := range []struct{ option, outType, connString string }{
+		{"shadow_output_type", config.ShadowOutputType, config.ShadowOutputParameters},
+		{"tier_output_type", config.TierOutputType, config.TierOutputParameters},
+	} {
+		for option, path := range outputPaths(config, output.option, output.outType, output.connString) {
+			if other, ok := usedBy[path]; ok {
+				errs.addErrorString(fmt.Sprintf("%s (%s) is already used by %s", path, option, other))
+			}
+			usedBy[path] = option
+		}
+	}
 
 	if !errs.Empty {
 		return config, errs
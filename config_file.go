@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/vaughan0/go-ini"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadConfigFile reads the configuration in fn. A file named .yaml, .yml or .toml holds the same sections and
+// options as the INI format, structured:
+//
+//	include: [outputs/*.yaml]
+//	bridge:
+//	  server_name: cbserver
+//	  events_watchlist: [watchlist.hit.process, watchlist.hit.binary]
+//	transform:
+//	  rename:
+//	    computer_name: hostname
+//
+// Lists are joined with commas and nested options with dots, so the example is read as events_watchlist=
+// watchlist.hit.process,watchlist.hit.binary in [bridge] and rename.computer_name=hostname in [transform]. The files
+// named by include, which may be patterns, relative to the including file, are read too: they can be YAML, TOML or
+// INI, and can include files of their own. An option may only be set in one of the files, so that the configuration
+// of each output or filter can be kept in a file of its own without one silently overriding another. Any other file
+// is read as INI, as it always has been.
+func loadConfigFile(fn string) (ini.File, error) {
+	if !isStructuredConfig(fn) {
+		return ini.LoadFile(fn)
+	}
+
+	loader := configLoader{file: make(ini.File), origins: make(map[string]string), loading: make(map[string]bool)}
+	if err := loader.load(fn); err != nil {
+		return nil, err
+	}
+	return loader.file, nil
+}
+
+func isStructuredConfig(fn string) bool {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+type configLoader struct {
+	file ini.File
+
+	// the file each option was set in, by section and option
+	origins map[string]string
+	// the files being read, to catch files that include each other
+	loading map[string]bool
+}
+
+func (l *configLoader) load(fn string) error {
+	path, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+	if l.loading[path] {
+		return fmt.Errorf("%s includes itself", fn)
+	}
+	l.loading[path] = true
+	defer delete(l.loading, path)
+
+	doc, err := readConfigDocument(fn)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var includes []string
+	for _, name := range names {
+		if name == "include" {
+			if includes, err = configIncludes(doc[name]); err != nil {
+				return fmt.Errorf("%s: %s", fn, err)
+			}
+			continue
+		}
+
+		var options map[string]interface{}
+		switch section := doc[name].(type) {
+		case map[string]interface{}:
+			options = section
+		case nil:
+			// an empty section
+		default:
+			return fmt.Errorf("%s: %s should be a section, with options of its own", fn, name)
+		}
+
+		flat := make(map[string]string)
+		if err := flattenConfigOptions("", options, flat); err != nil {
+			return fmt.Errorf("%s: [%s] %s", fn, name, err)
+		}
+		if _, ok := l.file[name]; !ok {
+			l.file[name] = make(ini.Section)
+		}
+		for key, val := range flat {
+			if origin, ok := l.origins[name+"\x00"+key]; ok {
+				return fmt.Errorf("%s: [%s] %s is already set in %s", fn, name, key, origin)
+			}
+			l.origins[name+"\x00"+key] = fn
+			l.file[name][key] = val
+		}
+	}
+
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(fn), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid include '%s': %s", fn, pattern, err)
+		}
+		// a pattern may match nothing, such as an empty directory of outputs, but a file must exist
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return fmt.Errorf("%s: included file %s does not exist", fn, pattern)
+		}
+		for _, match := range matches {
+			if err := l.load(match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readConfigDocument reads a YAML, TOML or INI file into sections of options.
+func readConfigDocument(fn string) (map[string]interface{}, error) {
+	if !isStructuredConfig(fn) {
+		file, err := ini.LoadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		doc := make(map[string]interface{}, len(file))
+		for name, section := range file {
+			options := make(map[string]interface{}, len(section))
+			for key, val := range section {
+				options[key] = val
+			}
+			doc[name] = options
+		}
+		return doc, nil
+	}
+
+	contents, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	doc := make(map[string]interface{})
+	if strings.ToLower(filepath.Ext(fn)) == ".toml" {
+		_, err = toml.Decode(string(contents), &doc)
+	} else {
+		err = yaml.Unmarshal(contents, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return doc, nil
+}
+
+func configIncludes(val interface{}) ([]string, error) {
+	switch val := val.(type) {
+	case string:
+		return []string{val}, nil
+	case []interface{}:
+		includes := make([]string, 0, len(val))
+		for _, include := range val {
+			s, ok := include.(string)
+			if !ok {
+				return nil, fmt.Errorf("include should be a file name or a list of them")
+			}
+			includes = append(includes, s)
+		}
+		return includes, nil
+	}
+	return nil, fmt.Errorf("include should be a file name or a list of them")
+}
+
+// flattenConfigOptions adds options to flat as INI options, with the names of nested options joined by dots.
+func flattenConfigOptions(prefix string, options map[string]interface{}, flat map[string]string) error {
+	for key, val := range options {
+		if len(prefix) > 0 {
+			key = prefix + "." + key
+		}
+		if nested, ok := val.(map[string]interface{}); ok {
+			if err := flattenConfigOptions(key, nested, flat); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, err := configValueString(val)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		flat[key] = s
+	}
+	return nil
+}
+
+// configValueString returns an option's value as it would be written in INI.
+func configValueString(val interface{}) (string, error) {
+	switch val := val.(type) {
+	case string:
+		return val, nil
+	case nil:
+		return "", nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case int:
+		return strconv.Itoa(val), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	case time.Time:
+		if val.Equal(val.Truncate(24 * time.Hour)) {
+			return val.Format("2006-01-02"), nil
+		}
+		return val.Format(time.RFC3339), nil
+	case []interface{}:
+		items := make([]string, 0, len(val))
+		for _, item := range val {
+			s, err := configValueString(item)
+			if err != nil || strings.Contains(s, ",") {
+				return "", fmt.Errorf("lists may only hold single values")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case fmt.Stringer:
+		// TOML's local dates and times
+		return val.String(), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", val)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, contents := range files {
+		fn := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadStructuredConfig(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"forwarder.yaml": `
+include:
+  - outputs/*.toml
+  - filters.ini
+bridge:
+  server_name: cbtest
+  http_server_port: 33706
+  events_watchlist: [watchlist.hit.process, watchlist.hit.binary]
+  parse_command_lines: true
+transform:
+  rename:
+    computer_name: hostname
+  map:
+    protocol: [6:tcp, 17:udp]
+s3:
+`,
+		"outputs/s3.toml": `
+[bridge]
+output_type = "s3"
+s3out = "my-bucket"
+upload_timeout = "10m"
+
+[s3]
+object_prefix = "events"
+`,
+		"filters.ini": "[redact]\nhash.username=all\n",
+	})
+
+	input, err := loadConfigFile(filepath.Join(dir, "forwarder.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{
+		"bridge": {
+			"server_name":         "cbtest",
+			"http_server_port":    "33706",
+			"events_watchlist":    "watchlist.hit.process,watchlist.hit.binary",
+			"parse_command_lines": "true",
+			"output_type":         "s3",
+			"s3out":               "my-bucket",
+			"upload_timeout":      "10m",
+		},
+		"transform": {"rename.computer_name": "hostname", "map.protocol": "6:tcp,17:udp"},
+		"s3":        {"object_prefix": "events"},
+		"redact":    {"hash.username": "all"},
+	}
+	for name, options := range expected {
+		for key, val := range options {
+			if got, ok := input.Get(name, key); !ok || got != val {
+				t.Errorf("Expected [%s] %s=%s, got %q", name, key, val, got)
+			}
+		}
+		if len(input[name]) != len(options) {
+			t.Errorf("Expected %d options in [%s], got %v", len(options), name, input[name])
+		}
+	}
+}
+
+func TestLoadStructuredConfigErrors(t *testing.T) {
+	tests := []struct {
+		files    map[string]string
+		expected string
+	}{
+		{
+			map[string]string{
+				"forwarder.yaml": "include: output.yaml\nbridge:\n  output_type: file\n",
+				"output.yaml":    "bridge:\n  output_type: s3\n",
+			},
+			"already set",
+		},
+		{
+			map[string]string{"forwarder.yaml": "include: missing.yaml\n"},
+			"does not exist",
+		},
+		{
+			map[string]string{
+				"forwarder.yaml": "include: other.yaml\n",
+				"other.yaml":     "include: forwarder.yaml\n",
+			},
+			"includes itself",
+		},
+		{
+			map[string]string{"forwarder.yaml": "server_name: cbtest\n"},
+			"should be a section",
+		},
+		{
+			map[string]string{"forwarder.toml": "[bridge]\nserver_name = \n"},
+			"forwarder.toml",
+		},
+	}
+	for _, test := range tests {
+		dir := writeConfigFiles(t, test.files)
+		fn := filepath.Join(dir, "forwarder.yaml")
+		if _, ok := test.files["forwarder.toml"]; ok {
+			fn = filepath.Join(dir, "forwarder.toml")
+		}
+		_, err := loadConfigFile(fn)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected an error containing %q, got %v", test.expected, err)
+		}
+	}
+}
+
+func TestExampleYAMLConfig(t *testing.T) {
+	input, err := loadConfigFile("conf/cb-event-forwarder.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := input.Get("bridge", "output_type"); val != "file" {
+		t.Errorf("Expected the example to include the file output, got output_type=%s", val)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// consumerGroupQueue returns the name and options of the queue shared by all forwarders in a consumer group. The
+// broker distributes messages between the forwarders consuming from the queue, so the group as a whole receives
+// each event once.
+//
+// Every forwarder binds the queue to the events it is configured for, so forwarders that share a queue must
+// subscribe to the same events: otherwise each would also receive (and forward) events the others subscribe to. The
+// queue name therefore includes a hash of the subscription, and a forwarder whose configuration differs from the
+// rest of its group consumes from a queue of its own.
+func consumerGroupQueue(group string, subscriptions []string, rawExchange bool) (string, QueueOptions) {
+	return fmt.Sprintf("cb-event-forwarder:group:%s:%s", group, subscriptionHash(subscriptions, rawExchange)),
+		QueueOptions{Durable: true, AutoDelete: false}
+}
+
+// subscriptionHash identifies the events a forwarder subscribes to, independent of the order they are configured in.
+func subscriptionHash(subscriptions []string, rawExchange bool) string {
+	keys := append([]string(nil), subscriptions...)
+	sort.Strings(keys)
+	if rawExchange {
+		keys = append(keys, "api.rawsensordata")
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return hex.EncodeToString(sum[:4])
+}
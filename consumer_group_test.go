@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConsumerGroupQueue(t *testing.T) {
+	name, options := consumerGroupQueue("soc", []string{"watchlist.#", "ingress.event.process"}, false)
+	if !strings.HasPrefix(name, "cb-event-forwarder:group:soc:") {
+		t.Errorf("Unexpected queue name %s", name)
+	}
+	if !options.Durable || options.AutoDelete {
+		t.Errorf("Consumer group queue should be durable and not deleted when unused: %+v", options)
+	}
+
+	// the order the events are configured in does not matter
+	reordered, _ := consumerGroupQueue("soc", []string{"ingress.event.process", "watchlist.#"}, false)
+	if reordered != name {
+		t.Errorf("Expected the same queue for the same subscription, got %s and %s", name, reordered)
+	}
+
+	different, _ := consumerGroupQueue("soc", []string{"watchlist.#"}, false)
+	raw, _ := consumerGroupQueue("soc", []string{"watchlist.#", "ingress.event.process"}, true)
+	if different == name || raw == name {
+		t.Errorf("Expected different subscriptions to use different queues: %s, %s, %s", name, different, raw)
+	}
+}
+
+func TestS3ObjectName(t *testing.T) {
+	defer func() { config.S3ObjectPrefix = nil }()
+
+	o := &S3Behavior{}
+	name := o.objectName("/var/cb/data/event-forwarder/event-forwarder.2017-01-01T00:00:00")
+	if name != "event-forwarder.2017-01-01T00:00:00" {
+		t.Errorf("Unexpected object name %s", name)
+	}
+
+	prefix := "forwarders"
+	config.S3ObjectPrefix = &prefix
+	o.instance = "fwd-1"
+	name = o.objectName("/tmp/event-forwarder.2017-01-01T00:00:00")
+	if name != "forwarders/fwd-1/event-forwarder.2017-01-01T00:00:00" {
+		t.Errorf("Unexpected object name %s", name)
+	}
+}
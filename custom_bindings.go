@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"github.com/vaughan0/go-ini"
+	"log"
+	"sort"
+	"strings"
+)
+
+// CustomBinding subscribes the forwarder's queue to an exchange other than api.events, such as one used by a custom
+// Cb Response integration to publish its own messages.
+type CustomBinding struct {
+	Name        string
+	Exchange    string
+	RoutingKeys []string
+	// assumed for messages published without a content type
+	ContentType string
+}
+
+func parseCustomBindings(section ini.Section, errs *ConfigurationError) []CustomBinding {
+	bindings := make(map[string]*CustomBinding)
+	get := func(name string) *CustomBinding {
+		if _, ok := bindings[name]; !ok {
+			bindings[name] = &CustomBinding{Name: name, ContentType: "application/json"}
+		}
+		return bindings[name]
+	}
+
+	for key, val := range section {
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid binding key '%s': should look like (option).(binding name)", key))
+			continue
+		}
+
+		switch parts[0] {
+		case "exchange":
+			get(parts[1]).Exchange = val
+		case "routing_keys":
+			for _, routingKey := range strings.Split(val, ",") {
+				routingKey = strings.TrimSpace(routingKey)
+				if len(routingKey) > 0 {
+					get(parts[1]).RoutingKeys = append(get(parts[1]).RoutingKeys, routingKey)
+				}
+			}
+		case "content_type":
+			get(parts[1]).ContentType = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown binding option '%s' in key %s", parts[0], key))
+		}
+	}
+
+	ret := make([]CustomBinding, 0, len(bindings))
+	for _, binding := range bindings {
+		if len(binding.Exchange) == 0 {
+			errs.addErrorString(fmt.Sprintf("Binding %s needs an exchange.%s", binding.Name, binding.Name))
+			continue
+		}
+		if binding.Exchange == "api.events" || binding.Exchange == "api.rawsensordata" {
+			errs.addErrorString(fmt.Sprintf("Binding %s: use the events_* options to subscribe to %s", binding.Name,
+				binding.Exchange))
+			continue
+		}
+		if len(binding.RoutingKeys) == 0 {
+			// fanout exchanges ignore the routing key; for topic exchanges, subscribe to everything
+			binding.RoutingKeys = []string{"#"}
+		}
+		ret = append(ret, *binding)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+
+	return ret
+}
+
+// bindCustomExchanges binds the queue to each custom binding. The exchanges are owned by the integrations that
+// publish to them, so they are not declared here: binding to an exchange that does not exist fails, naming the
+// binding in the error.
+func bindCustomExchanges(channel *amqp.Channel, queueName string, bindings []CustomBinding) error {
+	for _, binding := range bindings {
+		for _, routingKey := range binding.RoutingKeys {
+			if err := channel.QueueBind(queueName, routingKey, binding.Exchange, false, nil); err != nil {
+				return fmt.Errorf("QueueBind to exchange %s (binding %s): %s", binding.Exchange, binding.Name, err)
+			}
+			log.Printf("Subscribed to %s on exchange %s", routingKey, binding.Exchange)
+		}
+	}
+	return nil
+}
+
+// customBindingContentType returns the content type to assume for a message published to exchange without one.
+func customBindingContentType(bindings []CustomBinding, exchange string) string {
+	for _, binding := range bindings {
+		if binding.Exchange == exchange {
+			return binding.ContentType
+		}
+	}
+	return ""
+}
+
+// subscriptionKeys lists everything the forwarder's queue is bound to, in the form <exchange>:<routing key> for
+// custom bindings.
+func (c *Configuration) subscriptionKeys() []string {
+	keys := append([]string(nil), c.EventTypes...)
+	for _, binding := range c.CustomBindings {
+		for _, routingKey := range binding.RoutingKeys {
+			keys = append(keys, binding.Exchange+":"+routingKey)
+		}
+	}
+	return keys
+}
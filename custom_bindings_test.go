@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/vaughan0/go-ini"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCustomBindings(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[bindings]
+exchange.ticketing=custom.ticketing
+routing_keys.ticketing=ticket.created, ticket.closed
+exchange.audit=custom.audit
+content_type.audit=application/protobuf
+exchange.events=api.events
+routing_keys.orphan=foo.#
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errs ConfigurationError
+	bindings := parseCustomBindings(input.Section("bindings"), &errs)
+
+	expected := []CustomBinding{
+		{Name: "audit", Exchange: "custom.audit", RoutingKeys: []string{"#"}, ContentType: "application/protobuf"},
+		{Name: "ticketing", Exchange: "custom.ticketing", RoutingKeys: []string{"ticket.created", "ticket.closed"},
+			ContentType: "application/json"},
+	}
+	if !reflect.DeepEqual(bindings, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, bindings)
+	}
+	if len(errs.Errors) != 2 {
+		t.Errorf("Expected errors for the api.events binding and the binding without an exchange, got %v", errs.Errors)
+	}
+
+	if contentType := customBindingContentType(bindings, "custom.ticketing"); contentType != "application/json" {
+		t.Errorf("Unexpected content type %s", contentType)
+	}
+	if contentType := customBindingContentType(bindings, "api.events"); contentType != "" {
+		t.Errorf("Unexpected content type %s for a standard exchange", contentType)
+	}
+}
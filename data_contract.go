@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dataContractMinEvents is the number of events of a type that must be seen in an interval before a field the
+// baseline usually has can be reported missing from them.
+const dataContractMinEvents = 100
+
+// DataContractStatistics is shown on the status page as data_contract. It lists the differences found by the last
+// check, by event type.
+type DataContractStatistics struct {
+	Baseline      string              `json:"baseline"`
+	LastCheck     time.Time           `json:"last_check,omitempty"`
+	NewEventTypes []string            `json:"new_event_types,omitempty"`
+	NewFields     map[string][]string `json:"new_fields,omitempty"`
+	MissingFields map[string][]string `json:"missing_fields,omitempty"`
+	// the number of differences that have appeared since the forwarder started
+	Changes int64 `json:"changes_detected"`
+}
+
+// dataContract compares the fields of the events sent to the output with a baseline written by
+// -schema-report -schema-format json. Every interval, the fields of the events of each type sent in the interval are
+// compared with the baseline's: fields the baseline doesn't have are new, and fields at least half of the baseline's
+// events had are missing if none of the interval's events - at least dataContractMinEvents of them - had them. So
+// that a Cb Response server upgrade that renames a field doesn't silently break the searches built on it, each
+// difference is logged as a WARNING when it appears, and again when it goes away, and heartbeat events count the
+// current differences.
+type dataContract struct {
+	baseline *schemaReport
+	period   *schemaReport
+	// the differences found by the last check, as new:<type>:<field>, missing:<type>:<field> or type:<type>
+	reported map[string]bool
+	stats    DataContractStatistics
+	sync.Mutex
+}
+
+var contract *dataContract
+
+func loadSchemaBaseline(fn string) (*schemaReport, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var baseline schemaReport
+	if err := json.Unmarshal(b, &baseline); err != nil {
+		return nil, fmt.Errorf("%s is not a -schema-report -schema-format json report: %s", fn, err)
+	}
+	if len(baseline.EventTypes) == 0 {
+		return nil, fmt.Errorf("%s has no event types", fn)
+	}
+	return &baseline, nil
+}
+
+func newDataContract(baseline *schemaReport, fn string) *dataContract {
+	return &dataContract{
+		baseline: baseline,
+		period:   newSchemaReport(),
+		reported: make(map[string]bool),
+		stats:    DataContractStatistics{Baseline: fn},
+	}
+}
+
+// Observe records the fields of an event sent to the output. The forwarder's own events are not checked.
+func (c *dataContract) Observe(msg map[string]interface{}) {
+	if eventType, _ := msg["type"].(string); strings.HasPrefix(eventType, "cb-event-forwarder.") {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.period.add(msg)
+}
+
+// check compares the events observed since the last check with the baseline, and starts a new interval.
+func (c *dataContract) check(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	found := make(map[string]bool)
+	stats := DataContractStatistics{Baseline: c.stats.Baseline, LastCheck: now, Changes: c.stats.Changes,
+		NewFields: make(map[string][]string), MissingFields: make(map[string][]string)}
+	for eventType, observed := range c.period.EventTypes {
+		expected, ok := c.baseline.EventTypes[eventType]
+		if !ok {
+			found["type:"+eventType] = true
+			stats.NewEventTypes = append(stats.NewEventTypes, eventType)
+			continue
+		}
+		for name := range observed.Fields {
+			if _, ok := expected.Fields[name]; !ok {
+				found["new:"+eventType+":"+name] = true
+				stats.NewFields[eventType] = append(stats.NewFields[eventType], name)
+			}
+		}
+		if observed.Count < dataContractMinEvents {
+			continue
+		}
+		for name, field := range expected.Fields {
+			if _, ok := observed.Fields[name]; !ok && 2*field.Count >= expected.Count {
+				found["missing:"+eventType+":"+name] = true
+				stats.MissingFields[eventType] = append(stats.MissingFields[eventType], name)
+			}
+		}
+	}
+	sort.Strings(stats.NewEventTypes)
+	for _, fields := range [...]map[string][]string{stats.NewFields, stats.MissingFields} {
+		for _, names := range fields {
+			sort.Strings(names)
+		}
+	}
+
+	for _, difference := range sortedDifferences(found) {
+		if !c.reported[difference] {
+			stats.Changes++
+			log.Printf("WARNING: the events sent differ from the schema baseline %s: %s", c.stats.Baseline,
+				describeDifference(difference))
+		}
+	}
+	for _, difference := range sortedDifferences(c.reported) {
+		if !found[difference] {
+			log.Printf("The events sent match the schema baseline again: no longer %s", describeDifference(difference))
+		}
+	}
+
+	c.reported = found
+	c.stats = stats
+	c.period = newSchemaReport()
+}
+
+func sortedDifferences(differences map[string]bool) []string {
+	sorted := make([]string, 0, len(differences))
+	for difference := range differences {
+		sorted = append(sorted, difference)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func describeDifference(difference string) string {
+	parts := strings.SplitN(difference, ":", 3)
+	switch parts[0] {
+	case "type":
+		return "new event type " + parts[1]
+	case "new":
+		return fmt.Sprintf("new field %s in %s events", parts[2], parts[1])
+	default:
+		return fmt.Sprintf("field %s missing from %s events", parts[2], parts[1])
+	}
+}
+
+func (c *dataContract) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.check(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *dataContract) Statistics() interface{} {
+	c.Lock()
+	defer c.Unlock()
+	return c.stats
+}
+
+// annotate adds the number of differences found by the last check to a heartbeat event, if there are any.
+func (c *dataContract) annotate(msg map[string]interface{}) {
+	stats := c.Statistics().(DataContractStatistics)
+	count := func(fields map[string][]string) (n int) {
+		for _, names := range fields {
+			n += len(names)
+		}
+		return n
+	}
+	for field, n := range map[string]int{
+		"schema_new_event_types": len(stats.NewEventTypes),
+		"schema_new_fields":      count(stats.NewFields),
+		"schema_missing_fields":  count(stats.MissingFields),
+	} {
+		if n > 0 {
+			msg[field] = n
+		}
+	}
+}
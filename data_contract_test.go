@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDataContract(t *testing.T) {
+	baseline := newSchemaReport()
+	for i := 0; i < 10; i++ {
+		msg := map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "10.1.2.3",
+			"docs": []interface{}{map[string]interface{}{"md5": "x"}}}
+		if i == 0 {
+			msg["rarely"] = true
+		}
+		baseline.add(msg)
+	}
+
+	dir, err := ioutil.TempDir("", "data-contract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "schema.json")
+	fp, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := baseline.writeJSON(fp); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	loaded, err := loadSchemaBaseline(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contract := newDataContract(loaded, fn)
+	now := time.Now()
+	for i := 0; i < dataContractMinEvents; i++ {
+		contract.Observe(map[string]interface{}{"type": "ingress.event.netconn", "remote_address": "10.1.2.3",
+			"docs": []map[string]interface{}{{"md5": "x"}}})
+	}
+	contract.Observe(map[string]interface{}{"type": "ingress.event.procstart"})
+	contract.Observe(map[string]interface{}{"type": heartbeatEventType, "sequence": 1})
+	contract.check(now)
+
+	stats := contract.Statistics().(DataContractStatistics)
+	if fmt.Sprint(stats.NewEventTypes) != "[ingress.event.procstart]" ||
+		fmt.Sprint(stats.NewFields) != "map[ingress.event.netconn:[remote_address]]" ||
+		fmt.Sprint(stats.MissingFields) != "map[ingress.event.netconn:[remote_ip]]" || stats.Changes != 3 {
+		t.Errorf("Unexpected differences %+v", stats)
+	}
+	heartbeat := make(map[string]interface{})
+	contract.annotate(heartbeat)
+	if heartbeat["schema_new_fields"] != 1 || heartbeat["schema_missing_fields"] != 1 ||
+		heartbeat["schema_new_event_types"] != 1 {
+		t.Errorf("Unexpected heartbeat annotation %v", heartbeat)
+	}
+
+	// too few events to tell that a field is missing, and the differences that went away are cleared
+	contract.Observe(map[string]interface{}{"type": "ingress.event.netconn", "remote_address": "10.1.2.3"})
+	contract.check(now.Add(time.Minute))
+	stats = contract.Statistics().(DataContractStatistics)
+	if len(stats.NewEventTypes) != 0 || len(stats.MissingFields) != 0 || len(stats.NewFields) != 1 ||
+		stats.Changes != 3 {
+		t.Errorf("Unexpected differences %+v", stats)
+	}
+	heartbeat = make(map[string]interface{})
+	contract.annotate(heartbeat)
+	if _, ok := heartbeat["schema_missing_fields"]; ok {
+		t.Errorf("Expected no count of missing fields, got %v", heartbeat)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// dnsConfigured reports whether output endpoints are resolved by the forwarder, rather than left to the system
+// resolver when they are dialed.
+func dnsConfigured() bool {
+	return len(config.DNSServers) > 0 || config.DNSTimeout > 0 || len(config.HostOverrides) > 0
+}
+
+// forwarderResolver sends queries to the servers in dns_servers, in turn, or uses the system's resolver if there are
+// none.
+func forwarderResolver() *net.Resolver {
+	if len(config.DNSServers) == 0 {
+		return net.DefaultResolver
+	}
+
+	servers := config.DNSServers
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// the resolver dials once for each attempt, so a server that doesn't answer is skipped on the next one
+			server := servers[(atomic.AddUint32(&next, 1)-1)%uint32(len(servers))]
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// lookupHost returns the addresses of host: the address given for it in the [hosts] section, or those returned by
+// forwarderResolver within dns_timeout.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if address, ok := config.HostOverrides[strings.TrimSuffix(strings.ToLower(host), ".")]; ok {
+		return []string{address}, nil
+	}
+
+	if config.DNSTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.DNSTimeout)
+		defer cancel()
+	}
+	return forwarderResolver().LookupHost(ctx, host)
+}
+
+// dialContext connects to address (a host and port), resolving the host with lookupHost. Each of its addresses is
+// tried in turn. Without any DNS options, it dials as net.Dialer does.
+func dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialWith(ctx, &net.Dialer{}, network, address)
+}
+
+func dialWith(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !dnsConfigured() {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	addresses, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addresses {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveAddress returns address with its host replaced by the first of its addresses, for connections that are
+// dialed by a library which resolves names itself. Without any DNS options, address is returned unchanged.
+func resolveAddress(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !dnsConfigured() {
+		return address, nil
+	}
+
+	addresses, err := lookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addresses[0], port), nil
+}
+
+// parseDNSServers reads dns_servers, a comma-separated list of IP addresses with an optional port (53 by default).
+func parseDNSServers(value string, errs *ConfigurationError) []string {
+	var servers []string
+	for _, server := range strings.Split(value, ",") {
+		server = strings.TrimSpace(server)
+		if len(server) == 0 {
+			continue
+		}
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), "53"
+		}
+		if net.ParseIP(host) == nil {
+			errs.addErrorString(fmt.Sprintf("Invalid DNS server '%s' in dns_servers: should be an IP address, "+
+				"optionally with a port", server))
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(host, port))
+	}
+	return servers
+}
+
+// parseHostOverrides reads the [hosts] section, where each key is a host name and its value the IP address to
+// connect to instead of resolving it.
+func parseHostOverrides(section ini.Section, errs *ConfigurationError) map[string]string {
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	overrides := make(map[string]string)
+	for _, key := range keys {
+		address := strings.TrimSpace(section[key])
+		if net.ParseIP(address) == nil {
+			errs.addErrorString(fmt.Sprintf("Invalid address '%s' for host %s in [hosts]: should be an IP address",
+				section[key], key))
+			continue
+		}
+		overrides[strings.TrimSuffix(strings.ToLower(key), ".")] = address
+	}
+	if len(overrides) == 0 {
+		return nil
+	}
+	return overrides
+}
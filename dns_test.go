@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"github.com/vaughan0/go-ini"
+	"net"
+	"testing"
+)
+
+func TestHostOverrides(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	var errs ConfigurationError
+	config.HostOverrides = parseHostOverrides(ini.Section{"SIEM.example.com": "127.0.0.1", "bad.example.com": "nowhere"},
+		&errs)
+	if len(errs.Errors) != 1 {
+		t.Errorf("Expected an error for the invalid address, got %v", errs.Errors)
+	}
+	servers := parseDNSServers("10.0.0.53, 10.0.1.53:5353,::1", &errs)
+	if len(servers) != 3 || servers[0] != "10.0.0.53:53" || servers[1] != "10.0.1.53:5353" || servers[2] != "[::1]:53" {
+		t.Errorf("Unexpected DNS servers %v", servers)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// the name only resolves through the override
+	conn, err := dialContext(context.Background(), "tcp", net.JoinHostPort("siem.example.com.", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if address, err := resolveAddress(context.Background(), "siem.example.com:514"); err != nil ||
+		address != "127.0.0.1:514" {
+		t.Errorf("Expected siem.example.com to resolve to 127.0.0.1, got %s (%v)", address, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"net"
+	"strings"
+)
+
+// NormalizeDomains cleans up the domain names in netconn events (and the ioc_value of DNS feed hits) so they can be
+// matched consistently against threat intelligence: the domain is lowercased and any trailing dot removed. The
+// registered domain (eTLD+1, such as "example.co.uk" for "www.example.co.uk") is added as registered_domain, and
+// internationalized domain names are flagged with domain_is_idn, with the Unicode form in domain_unicode.
+func NormalizeDomains(msg map[string]interface{}) {
+	forEachContainer(msg, "domain", func(container map[string]interface{}) {
+		normalizeDomainField(container, "domain", "")
+	})
+
+	forEachContainer(msg, "ioc_value", func(container map[string]interface{}) {
+		if iocType, ok := container["ioc_type"].(string); ok && iocType == "dns" {
+			normalizeDomainField(container, "ioc_value", "ioc_")
+		}
+	})
+}
+
+func normalizeDomainField(container map[string]interface{}, field, prefix string) {
+	domain, ok := container[field].(string)
+	if !ok {
+		return
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if len(domain) == 0 || net.ParseIP(domain) != nil {
+		return
+	}
+	container[field] = domain
+
+	isIDN := false
+	for _, label := range strings.Split(domain, ".") {
+		if strings.HasPrefix(label, "xn--") {
+			isIDN = true
+			break
+		}
+	}
+
+	if !isIDN {
+		for _, r := range domain {
+			if r > 0x7f {
+				isIDN = true
+				break
+			}
+		}
+	}
+	container[prefix+"domain_is_idn"] = isIDN
+
+	// registered domain calculations are done on the ASCII (punycode) form
+	ascii := domain
+	if isIDN {
+		if a, err := idna.Lookup.ToASCII(domain); err == nil {
+			ascii = a
+		}
+		if u, err := idna.Lookup.ToUnicode(domain); err == nil {
+			container[prefix+"domain_unicode"] = u
+		}
+	}
+
+	if registered, err := publicsuffix.EffectiveTLDPlusOne(ascii); err == nil {
+		container[prefix+"registered_domain"] = registered
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeDomains(t *testing.T) {
+	msg := map[string]interface{}{
+		"type":   "ingress.event.netconn",
+		"domain": "WWW.Example.CO.UK.",
+	}
+	NormalizeDomains(msg)
+
+	if msg["domain"] != "www.example.co.uk" {
+		t.Errorf("Expected domain to be normalized, got %v", msg["domain"])
+	}
+	if msg["registered_domain"] != "example.co.uk" {
+		t.Errorf("Expected registered domain example.co.uk, got %v", msg["registered_domain"])
+	}
+	if msg["domain_is_idn"] != false {
+		t.Errorf("Expected domain_is_idn to be false, got %v", msg["domain_is_idn"])
+	}
+
+	msg = map[string]interface{}{
+		"type":   "ingress.event.netconn",
+		"domain": "mail.xn--bcher-kva.example",
+	}
+	NormalizeDomains(msg)
+
+	if msg["domain_is_idn"] != true || msg["domain_unicode"] != "mail.bücher.example" {
+		t.Errorf("Expected IDN domain to be flagged and decoded, got %v", msg)
+	}
+
+	msg = map[string]interface{}{
+		"type":      "feed.ingress.hit.process",
+		"ioc_type":  "dns",
+		"ioc_value": "Evil.Example.com",
+	}
+	NormalizeDomains(msg)
+
+	if msg["ioc_value"] != "evil.example.com" || msg["ioc_registered_domain"] != "example.com" {
+		t.Errorf("Expected DNS IOC to be normalized, got %v", msg)
+	}
+
+	msg = map[string]interface{}{"domain": "10.0.0.1"}
+	NormalizeDomains(msg)
+	if _, ok := msg["registered_domain"]; ok {
+		t.Errorf("IP addresses should not get a registered domain")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The categories of the errors kept by errorHistory.
+const (
+	// a message from the bus that could not be decoded or processed
+	ErrorCategoryEvent = "event"
+	// the connection to the message bus was lost
+	ErrorCategoryConnection = "connection"
+	// the output reported an error
+	ErrorCategoryOutput = "output"
+	// a file could not be uploaded from the holding area
+	ErrorCategoryUpload = "upload"
+)
+
+// RecentError is one of the errors shown on the status page as recent_errors.
+type RecentError struct {
+	Time     time.Time `json:"time"`
+	Category string    `json:"category"`
+	Message  string    `json:"message"`
+}
+
+// errorHistory keeps the last errors the forwarder ran into, however many are set by status_error_history, in a ring
+// buffer, so that what went wrong can be seen from the status server without access to the log.
+type errorHistory struct {
+	errors []RecentError
+	next   int
+	size   int
+	sync.Mutex
+}
+
+var recentErrors = newErrorHistory(50)
+
+func newErrorHistory(size int) *errorHistory {
+	return &errorHistory{size: size}
+}
+
+// add records an error, replacing the oldest once the history is full.
+func (h *errorHistory) add(category, message string) {
+	h.Lock()
+	defer h.Unlock()
+
+	e := RecentError{Time: time.Now(), Category: category, Message: message}
+	if len(h.errors) < h.size {
+		h.errors = append(h.errors, e)
+		return
+	}
+	h.errors[h.next] = e
+	h.next = (h.next + 1) % h.size
+}
+
+// Errors returns the errors, newest first.
+func (h *errorHistory) Errors() []RecentError {
+	h.Lock()
+	defer h.Unlock()
+
+	errors := make([]RecentError, 0, len(h.errors))
+	for i := len(h.errors) - 1; i >= 0; i-- {
+		errors = append(errors, h.errors[(h.next+i)%len(h.errors)])
+	}
+	return errors
+}
+
+func (h *errorHistory) Statistics() interface{} {
+	return h.Errors()
+}
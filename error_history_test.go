@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrorHistory(t *testing.T) {
+	h := newErrorHistory(5)
+	if errors := h.Errors(); len(errors) != 0 {
+		t.Fatalf("Expected no errors, got %+v", errors)
+	}
+	for i := 1; i <= 8; i++ {
+		h.add(ErrorCategoryUpload, strings.Repeat("x", i))
+	}
+	h.add(ErrorCategoryConnection, "Connection closed")
+
+	errors := h.Errors()
+	if len(errors) != 5 {
+		t.Fatalf("Expected the last 5 errors, got %+v", errors)
+	}
+	if errors[0].Category != ErrorCategoryConnection || errors[0].Message != "Connection closed" ||
+		errors[1].Message != "xxxxxxxx" || errors[4].Message != "xxxxx" || errors[4].Category != ErrorCategoryUpload {
+		t.Errorf("Expected the errors newest first, got %+v", errors)
+	}
+	if errors[0].Time.Before(errors[4].Time) {
+		t.Errorf("Expected the newest error first, got %s before %s", errors[0].Time, errors[4].Time)
+	}
+}
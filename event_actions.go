@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// the number of triggered actions that can wait to be run before they are dropped
+const eventActionQueueSize = 100
+
+// EventAction sends a webhook or runs a command for each event of EventTypes (routing key patterns) that meets
+// every condition, at most RateCount times per RateWindow.
+type EventAction struct {
+	Name       string
+	EventTypes []string
+	Conditions []AttackCondition
+	Webhook    string
+	Header     string
+	Command    string
+	Template   *template.Template
+	RateCount  int
+	RateWindow time.Duration
+}
+
+var actionTemplateFuncs = template.FuncMap{
+	// json encodes a value, so that templates can build valid JSON from any field
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// parseEventActions reads the [actions] section. Keys take the form <setting>.<action>, where the settings are
+// types, match, webhook, header, command, template and rate_limit; timeout applies to every action.
+func parseEventActions(section ini.Section, errs *ConfigurationError) ([]EventAction, time.Duration) {
+	timeout := 30 * time.Second
+	settings := make(map[string]map[string]string)
+	for key, val := range section {
+		if key == "timeout" {
+			var err error
+			if timeout, err = time.ParseDuration(val); err != nil || timeout <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid timeout '%s' in [actions]: should be a duration such as 30s",
+					val))
+				timeout = 30 * time.Second
+			}
+			continue
+		}
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid action key '%s': should look like (setting).(action)", key))
+			continue
+		}
+		if settings[parts[1]] == nil {
+			settings[parts[1]] = make(map[string]string)
+		}
+		settings[parts[1]][parts[0]] = val
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var actions []EventAction
+	for _, name := range names {
+		if action, ok := parseEventAction(name, settings[name], errs); ok {
+			actions = append(actions, action)
+		}
+	}
+	return actions, timeout
+}
+
+func parseEventAction(name string, settings map[string]string, errs *ConfigurationError) (EventAction, bool) {
+	action := EventAction{Name: name, EventTypes: splitList(settings["types"]), Command: settings["command"],
+		Header: settings["header"], RateCount: 60, RateWindow: time.Hour}
+	valid := true
+	invalid := func(format string, args ...interface{}) {
+		errs.addErrorString(fmt.Sprintf("Action %s: ", name) + fmt.Sprintf(format, args...))
+		valid = false
+	}
+
+	for setting := range settings {
+		switch setting {
+		case "types", "match", "webhook", "header", "command", "template", "rate_limit":
+		default:
+			invalid("unknown setting %s.%s", setting, name)
+		}
+	}
+
+	if len(action.EventTypes) == 0 {
+		invalid("missing types.%s: the event types the action is triggered by", name)
+	}
+	if val, ok := settings["match"]; ok {
+		conditions, err := parseAttackConditions(val)
+		if err != nil {
+			invalid("%s", err)
+		}
+		action.Conditions = conditions
+	}
+
+	if val, ok := settings["webhook"]; ok {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			invalid("webhook '%s' should be an http or https URL", val)
+		}
+		action.Webhook = val
+	}
+	if len(action.Webhook) == 0 && len(action.Command) == 0 {
+		invalid("set webhook.%s or command.%s", name, name)
+	} else if len(action.Webhook) > 0 && len(action.Command) > 0 {
+		invalid("set only one of webhook.%s and command.%s", name, name)
+	}
+	if len(action.Header) > 0 && !strings.Contains(action.Header, ":") {
+		invalid("header '%s' should look like (name): (value)", action.Header)
+	}
+
+	if val, ok := settings["template"]; ok {
+		tmpl, err := template.New(name).Funcs(actionTemplateFuncs).Parse(val)
+		if err != nil {
+			invalid("invalid template: %s", err)
+		}
+		action.Template = tmpl
+	}
+
+	if val, ok := settings["rate_limit"]; ok {
+		parts := strings.SplitN(val, "/", 2)
+		count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		var window time.Duration
+		if err == nil && len(parts) == 2 {
+			window, err = time.ParseDuration(strings.TrimSpace(parts[1]))
+		}
+		if err != nil || len(parts) != 2 || count < 1 || window <= 0 {
+			invalid("rate_limit '%s' should look like (count)/(duration), such as 10/1h", val)
+		}
+		action.RateCount, action.RateWindow = count, window
+	}
+
+	return action, valid
+}
+
+// EventActionStatistics is shown on the status page for each action, under event_actions.
+type EventActionStatistics struct {
+	Triggered     int64     `json:"triggered"`
+	Sent          int64     `json:"sent"`
+	Failed        int64     `json:"failed"`
+	RateLimited   int64     `json:"rate_limited"`
+	Dropped       int64     `json:"dropped"`
+	LastSentTime  time.Time `json:"last_sent_time"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+}
+
+type triggeredAction struct {
+	action    *EventAction
+	eventType string
+	payload   []byte
+}
+
+// eventActions runs the configured actions for the events that trigger them. The payload is rendered from the event
+// as it is forwarded, when it is triggered, and the webhook or command runs later, one at a time in a goroutine of
+// its own, so that a slow action never holds up the forwarder; if the actions fall behind, triggered actions are
+// dropped. An action that fails is logged and not retried.
+type eventActions struct {
+	actions []EventAction
+	timeout time.Duration
+	client  *http.Client
+	queue   chan triggeredAction
+
+	windowStart []time.Time
+	windowCount []int
+	stats       map[string]*EventActionStatistics
+	sync.Mutex
+}
+
+var actions *eventActions
+
+func newEventActions(configured []EventAction, timeout time.Duration) *eventActions {
+	a := &eventActions{
+		actions:     configured,
+		timeout:     timeout,
+		client:      &http.Client{Timeout: timeout, Transport: httpTransport()},
+		queue:       make(chan triggeredAction, eventActionQueueSize),
+		windowStart: make([]time.Time, len(configured)),
+		windowCount: make([]int, len(configured)),
+		stats:       make(map[string]*EventActionStatistics),
+	}
+	for _, action := range configured {
+		a.stats[action.Name] = &EventActionStatistics{}
+	}
+	return a
+}
+
+func (action *EventAction) matches(msg map[string]interface{}) bool {
+	eventType, _ := msg["type"].(string)
+	rule := AttackRule{EventTypes: action.EventTypes, Conditions: action.Conditions}
+	return rule.matches(eventType, msg)
+}
+
+// payload renders the template, or the event as JSON if the action has none.
+func (action *EventAction) payload(msg map[string]interface{}) ([]byte, error) {
+	if action.Template == nil {
+		return json.Marshal(msg)
+	}
+	var buf bytes.Buffer
+	if err := action.Template.Execute(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Trigger queues the actions msg triggers.
+func (a *eventActions) Trigger(msg map[string]interface{}, now time.Time) {
+	for i := range a.actions {
+		action := &a.actions[i]
+		if !action.matches(msg) {
+			continue
+		}
+
+		a.Lock()
+		stats := a.stats[action.Name]
+		stats.Triggered++
+		if now.Sub(a.windowStart[i]) >= action.RateWindow {
+			a.windowStart[i], a.windowCount[i] = now, 0
+		}
+		if a.windowCount[i] >= action.RateCount {
+			stats.RateLimited++
+			a.Unlock()
+			continue
+		}
+		a.windowCount[i]++
+		a.Unlock()
+
+		payload, err := action.payload(msg)
+		if err != nil {
+			a.recordResult(action, fmt.Errorf("could not render the template: %s", err))
+			continue
+		}
+		eventType, _ := msg["type"].(string)
+		select {
+		case a.queue <- triggeredAction{action, eventType, payload}:
+		default:
+			a.Lock()
+			stats.Dropped++
+			a.Unlock()
+			log.Printf("Actions are falling behind; dropped action %s for a %s event", action.Name, eventType)
+		}
+	}
+}
+
+// run runs the triggered actions until ctx is done.
+func (a *eventActions) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case triggered := <-a.queue:
+			actionCtx, cancel := context.WithTimeout(ctx, a.timeout)
+			var err error
+			if len(triggered.action.Webhook) > 0 {
+				err = a.postWebhook(actionCtx, triggered)
+			} else {
+				err = a.runCommand(actionCtx, triggered)
+			}
+			cancel()
+			if err != nil {
+				log.Printf("Action %s failed: %s", triggered.action.Name, err)
+			}
+			a.recordResult(triggered.action, err)
+		}
+	}
+}
+
+func (a *eventActions) recordResult(action *EventAction, err error) {
+	a.Lock()
+	defer a.Unlock()
+	stats := a.stats[action.Name]
+	if err != nil {
+		stats.Failed++
+		stats.LastError = err.Error()
+		stats.LastErrorTime = time.Now()
+	} else {
+		stats.Sent++
+		stats.LastSentTime = time.Now()
+	}
+}
+
+func (a *eventActions) postWebhook(ctx context.Context, triggered triggeredAction) error {
+	req, err := http.NewRequest("POST", triggered.action.Webhook, bytes.NewReader(triggered.payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if len(triggered.action.Header) > 0 {
+		parts := strings.SplitN(triggered.action.Header, ":", 2)
+		req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// runCommand runs the command with the payload on its standard input, and CB_ACTION and CB_EVENT_TYPE set in the
+// environment.
+func (a *eventActions) runCommand(ctx context.Context, triggered triggeredAction) error {
+	cmd := exec.CommandContext(ctx, triggered.action.Command)
+	cmd.Stdin = bytes.NewReader(triggered.payload)
+	cmd.Env = append(os.Environ(), "CB_ACTION="+triggered.action.Name, "CB_EVENT_TYPE="+triggered.eventType)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if len(output) > 512 {
+			output = output[:512]
+		}
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (a *eventActions) Statistics() interface{} {
+	a.Lock()
+	defer a.Unlock()
+	stats := make(map[string]EventActionStatistics, len(a.stats))
+	for name, actionStats := range a.stats {
+		stats[name] = *actionStats
+	}
+	return stats
+}
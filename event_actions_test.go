@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/vaughan0/go-ini"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEventActions(t *testing.T) {
+	errs := ConfigurationError{}
+	configured, timeout := parseEventActions(ini.Section{
+		"timeout":            "5s",
+		"types.ticket":       "watchlist.hit.#",
+		"match.ticket":       "watchlist_name:*ransomware*",
+		"webhook.ticket":     "https://tickets.example.com/api",
+		"template.ticket":    `{"title": {{json .watchlist_name}}}`,
+		"rate_limit.ticket":  "10/1h",
+		"types.both":         "feed.#",
+		"webhook.both":       "https://example.com",
+		"command.both":       "/bin/true",
+		"webhook.untyped":    "ftp://example.com",
+		"rate_limit.untyped": "often",
+		"template.broken":    "{{.x",
+		"types.broken":       "feed.#",
+		"command.broken":     "/bin/true",
+		"frequency.misspelt": "1",
+	}, &errs)
+
+	if timeout != 5*time.Second {
+		t.Errorf("Expected a timeout of 5s, got %s", timeout)
+	}
+	if len(configured) != 1 || configured[0].Name != "ticket" || configured[0].RateCount != 10 ||
+		configured[0].RateWindow != time.Hour || len(configured[0].Conditions) != 1 || configured[0].Template == nil {
+		t.Errorf("Expected only the ticket action to be valid, got %+v", configured)
+	}
+	for _, action := range []string{"both", "untyped", "broken", "misspelt"} {
+		found := false
+		for _, err := range errs.Errors {
+			if strings.HasPrefix(err, "Action "+action+":") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected an error for action %s, got %v", action, errs.Errors)
+		}
+	}
+}
+
+func TestEventActions(t *testing.T) {
+	received := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	errs := ConfigurationError{}
+	configured, timeout := parseEventActions(ini.Section{
+		"types.ticket":      "watchlist.hit.#",
+		"match.ticket":      "watchlist_name:*ransomware*",
+		"webhook.ticket":    server.URL,
+		"header.ticket":     "Authorization: Bearer secret",
+		"template.ticket":   `{"title": {{json (printf "%s on %s" .watchlist_name .hostname)}}}`,
+		"rate_limit.ticket": "2/1m",
+	}, &errs)
+	if len(errs.Errors) != 0 {
+		t.Fatal(errs.Errors)
+	}
+	a := newEventActions(configured, timeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.run(ctx)
+
+	hit := map[string]interface{}{"type": "watchlist.hit.process", "watchlist_name": "Ransomware \"Activity\"",
+		"hostname": "WIN-7"}
+	now := time.Now()
+	a.Trigger(map[string]interface{}{"type": "watchlist.hit.process", "watchlist_name": "Other"}, now)
+	a.Trigger(map[string]interface{}{"type": "feed.ingress.hit.process", "watchlist_name": "Ransomware"}, now)
+	for i := 0; i < 3; i++ {
+		a.Trigger(hit, now)
+	}
+	a.Trigger(hit, now.Add(time.Minute))
+
+	for i := 0; i < 3; i++ {
+		select {
+		case body := <-received:
+			var payload map[string]string
+			if err := json.Unmarshal([]byte(body), &payload); err != nil ||
+				payload["title"] != `Ransomware "Activity" on WIN-7` {
+				t.Errorf("Unexpected payload %s (%v)", body, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the webhook")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var stats EventActionStatistics
+	for time.Now().Before(deadline) {
+		if stats = a.Statistics().(map[string]EventActionStatistics)["ticket"]; stats.Sent == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.Triggered != 4 || stats.Sent != 3 || stats.RateLimited != 1 || stats.Failed != 0 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
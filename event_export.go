@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventExportFilter selects the events written by -export: those with a timestamp from from up to (but not
+// including) to, and a type matching one of types. A zero time leaves that end of the range open, and no types
+// matches every type. Types are patterns like the routing keys in the events_* options, such as ingress.event.*
+type eventExportFilter struct {
+	from  time.Time
+	to    time.Time
+	types []string
+}
+
+type eventExportSummary struct {
+	Files        int
+	SkippedFiles int
+	Events       int64
+	Exported     int64
+	Unreadable   int64
+}
+
+// capture archive files holding sensor events in binary form, which can't be filtered without processing them
+var exportBinaryExtensions = map[string]bool{".zip": true, ".bundle": true, ".pb": true, ".protobuf": true}
+
+// exportEvents runs -export, writing the events to outputFile, or to stdout if it is "-".
+func exportEvents(path, outputFile string, filter eventExportFilter) error {
+	w := os.Stdout
+	if outputFile != "-" {
+		fp, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		w = fp
+	}
+
+	summary, err := runEventExport(path, filter, w)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d of %d events from %d files (%d files skipped, %d unreadable events)", summary.Exported,
+		summary.Events, summary.Files, summary.SkippedFiles, summary.Unreadable)
+	return nil
+}
+
+func parseEventExportFilter(from, to, types string) (eventExportFilter, error) {
+	var filter eventExportFilter
+	var err error
+
+	if len(from) > 0 {
+		if filter.from, err = parseDateOrTime(from); err != nil {
+			return filter, fmt.Errorf("Invalid -export-from '%s': should be a date such as 2006-01-02, or a time such "+
+				"as 2006-01-02T15:04:05Z", from)
+		}
+	}
+	if len(to) > 0 {
+		if filter.to, err = parseDateOrTime(to); err != nil {
+			return filter, fmt.Errorf("Invalid -export-to '%s': should be a date such as 2006-01-02, or a time such "+
+				"as 2006-01-02T15:04:05Z", to)
+		}
+	}
+	for _, eventType := range strings.Split(types, ",") {
+		if eventType = strings.TrimSpace(eventType); len(eventType) > 0 {
+			filter.types = append(filter.types, eventType)
+		}
+	}
+	return filter, nil
+}
+
+func (f eventExportFilter) timeRange() bool {
+	return !f.from.IsZero() || !f.to.IsZero()
+}
+
+func (f eventExportFilter) matches(eventType string, timestamp time.Time, hasTimestamp bool) bool {
+	if f.timeRange() {
+		if !hasTimestamp || (!f.from.IsZero() && timestamp.Before(f.from)) ||
+			(!f.to.IsZero() && !timestamp.Before(f.to)) {
+			return false
+		}
+	}
+	return f.matchesType(eventType)
+}
+
+// matchesMinute reports whether events of eventType from the minute starting at minute can match f.
+func (f eventExportFilter) matchesMinute(eventType string, minute time.Time, hasTimestamp bool) bool {
+	if f.timeRange() {
+		if !hasTimestamp || (!f.from.IsZero() && !minute.Add(time.Minute).After(f.from)) ||
+			(!f.to.IsZero() && !minute.Before(f.to)) {
+			return false
+		}
+	}
+	return f.matchesType(eventType)
+}
+
+func (f eventExportFilter) matchesType(eventType string) bool {
+	if len(f.types) == 0 {
+		return true
+	}
+	for _, pattern := range f.types {
+		if RoutingKeyMatches(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// runEventExport writes the events in the file or directory at path that match filter to w, one per line. It reads
+// bundles and output files written by the forwarder (JSON or LEEF, one event per line, or indexed bundles, of which
+// only the events the index says can match are read), compressed or not, and the JSON files of Cb's event archives,
+// which hold one or more events in a <routing key>/ directory. Directories are read recursively in name order. If w
+// is a file, it isn't read, even if it is at path.
+func runEventExport(path string, filter eventExportFilter, w io.Writer) (eventExportSummary, error) {
+	var summary eventExportSummary
+
+	var output os.FileInfo
+	if fp, ok := w.(*os.File); ok {
+		output, _ = fp.Stat()
+	}
+	var files []string
+	err := filepath.Walk(path, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && (output == nil || !os.SameFile(info, output)) {
+			files = append(files, fileName)
+		}
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+	sort.Strings(files)
+
+	out := bufio.NewWriter(w)
+	for _, fileName := range files {
+		if exportBinaryExtensions[strings.ToLower(filepath.Ext(fileName))] {
+			summary.SkippedFiles++
+			continue
+		}
+		if err := exportFile(fileName, filter, out, &summary); err != nil {
+			log.Printf("Could not export %s: %s", fileName, err)
+			summary.SkippedFiles++
+			continue
+		}
+		summary.Files++
+	}
+	return summary, out.Flush()
+}
+
+func exportFile(fileName string, filter eventExportFilter, out *bufio.Writer, summary *eventExportSummary) error {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	// the type of archived events without a type field
+	routingKey := filepath.Base(filepath.Dir(fileName))
+
+	r := bufio.NewReader(fp)
+	compression := bundleCompressionOf(r)
+	if len(compression) > 0 {
+		decompressed, err := newBundleDecompressor(r, compression, config.ZstdDictionary)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		r = bufio.NewReader(decompressed)
+	}
+
+	if header, _ := r.Peek(len(indexedBundleMagic)); string(header) == indexedBundleMagic {
+		if len(compression) == 0 {
+			info, err := fp.Stat()
+			if err != nil {
+				return err
+			}
+			return exportIndexedBundle(fp, info.Size(), routingKey, filter, out, summary)
+		}
+		// the index can only be used once the bundle is decompressed
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return exportIndexedBundle(bytes.NewReader(b), int64(len(b)), routingKey, filter, out, summary)
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if event := bytes.TrimSpace(line); len(event) > 0 {
+			if bytes.HasPrefix(event, []byte("{")) && !json.Valid(event) {
+				// the rest of the file is a JSON document spread over several lines
+				return exportJSONDocuments(io.MultiReader(bytes.NewReader(line), r), routingKey, filter, out, summary)
+			}
+			if err := exportEvent(event, routingKey, filter, out, summary); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// exportIndexedBundle exports the events of an indexed bundle, reading only those in the index entries that can
+// match filter.
+func exportIndexedBundle(bundle io.ReaderAt, size int64, routingKey string, filter eventExportFilter,
+	out *bufio.Writer, summary *eventExportSummary) error {
+	index, err := readIndexedBundleIndex(bundle, size)
+	if err != nil {
+		return err
+	}
+
+	var offsets []uint64
+	for _, entry := range index.Entries {
+		eventType := entry.Type
+		if len(eventType) == 0 {
+			eventType = routingKey
+		}
+		if filter.matchesMinute(eventType, time.Unix(entry.Minute, 0), entry.Timed) {
+			offsets = append(offsets, entry.Offsets...)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	summary.Events += int64(index.Events) - int64(len(offsets))
+	for _, offset := range offsets {
+		e, err := readIndexedBundleEvent(bundle, size, offset)
+		if err != nil {
+			return err
+		}
+		if err := exportEvent(e.Event, routingKey, filter, out, summary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportJSONDocuments(r io.Reader, routingKey string, filter eventExportFilter, out *bufio.Writer,
+	summary *eventExportSummary) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var document json.RawMessage
+		if err := decoder.Decode(&document); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid JSON: %s", err)
+		}
+
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, document); err != nil {
+			return err
+		}
+		if err := exportEvent(compact.Bytes(), routingKey, filter, out, summary); err != nil {
+			return err
+		}
+	}
+}
+
+func exportEvent(event []byte, routingKey string, filter eventExportFilter, out *bufio.Writer,
+	summary *eventExportSummary) error {
+	summary.Events++
+	eventType, timestamp, hasTimestamp, ok := exportedEventFields(string(event))
+	if !ok {
+		summary.Unreadable++
+		return nil
+	}
+	if len(eventType) == 0 {
+		eventType = routingKey
+	}
+	if !filter.matches(eventType, timestamp, hasTimestamp) {
+		return nil
+	}
+
+	summary.Exported++
+	out.Write(event)
+	return out.WriteByte('\n')
+}
+
+// exportedEventFields returns the type and timestamp of a JSON event, enveloped or not, or a LEEF event.
+func exportedEventFields(event string) (string, time.Time, bool, bool) {
+	if strings.HasPrefix(event, "LEEF:") {
+		fields := strings.SplitN(event, "|", 6)
+		if len(fields) < 6 {
+			return "", time.Time{}, false, false
+		}
+		for _, attribute := range strings.Split(fields[5], "\t") {
+			if value := strings.TrimPrefix(attribute, "timestamp="); value != attribute {
+				timestamp, ok := parseEventTimestamp(value)
+				return fields[4], timestamp, ok, true
+			}
+		}
+		return fields[4], time.Time{}, false, true
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(event), &fields); err != nil {
+		return "", time.Time{}, false, false
+	}
+	var eventType string
+	if value, ok := jsonEventField(fields, "type"); ok && json.Unmarshal(value, &eventType) != nil {
+		return "", time.Time{}, false, false
+	}
+	// the timestamp may not be a number
+	value, _ := jsonEventField(fields, "timestamp")
+	timestamp, ok := parseEventTimestamp(jsonEventText(value))
+	return eventType, timestamp, ok, true
+}
+
+// parseEventTimestamp accepts seconds (or milliseconds) since the epoch, as written by the forwarder, or an RFC 3339
+// time.
+func parseEventTimestamp(value string) (time.Time, bool) {
+	if len(value) == 0 {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds > 1e11 {
+			seconds /= 1000
+		}
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)), true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
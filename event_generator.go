@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/carbonblack/cb-event-forwarder/sensor_events"
+	"github.com/golang/protobuf/proto"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var generatedEvents = expvar.NewMap("generated_events")
+
+// generatedEvent is a synthetic message, as it would be received from the message bus.
+type generatedEvent struct {
+	routingKey  string
+	contentType string
+	body        []byte
+}
+
+// generatedEventTypes builds a random event of each type the generator can produce: sensor events as protobuf
+// messages, and alerts, watchlist and feed hits and binary notifications as JSON, like the Cb server publishes them.
+var generatedEventTypes = map[string]func(g *eventGenerator) generatedEvent{
+	"ingress.event.procstart":           func(g *eventGenerator) generatedEvent { return g.process(true) },
+	"ingress.event.procend":             func(g *eventGenerator) generatedEvent { return g.process(false) },
+	"ingress.event.netconn":             (*eventGenerator).netconn,
+	"ingress.event.filemod":             (*eventGenerator).filemod,
+	"ingress.event.regmod":              (*eventGenerator).regmod,
+	"ingress.event.moduleload":          (*eventGenerator).moduleload,
+	"ingress.event.childproc":           (*eventGenerator).childproc,
+	"ingress.event.crossprocopen":       (*eventGenerator).crossprocopen,
+	"watchlist.hit.process":             (*eventGenerator).watchlistHit,
+	"alert.watchlist.hit.query.process": (*eventGenerator).alert,
+	"feed.ingress.hit.process":          (*eventGenerator).feedHit,
+	"binaryinfo.observed":               (*eventGenerator).binaryObserved,
+}
+
+var (
+	generatorHosts     = []string{"WIN-DESKTOP-01", "WIN-DESKTOP-02", "WIN-LAPTOP-17", "WIN-SERVER-DC1", "mac-build-3"}
+	generatorProcesses = []string{
+		`c:\windows\system32\svchost.exe`,
+		`c:\windows\explorer.exe`,
+		`c:\program files (x86)\google\chrome\application\chrome.exe`,
+		`c:\windows\system32\windowspowershell\v1.0\powershell.exe`,
+		`c:\windows\system32\cmd.exe`,
+		`c:\program files\microsoft office\root\office16\winword.exe`,
+	}
+	generatorFiles = []string{
+		`c:\users\administrator\appdata\local\temp\setup.tmp`,
+		`c:\users\administrator\documents\report.docx`,
+		`c:\windows\system32\drivers\etc\hosts`,
+		`c:\programdata\microsoft\windows defender\scans\history.log`,
+	}
+	generatorModules = []string{
+		`c:\windows\system32\ntdll.dll`,
+		`c:\windows\system32\kernel32.dll`,
+		`c:\windows\system32\advapi32.dll`,
+		`c:\windows\system32\ws2_32.dll`,
+	}
+	generatorRegistryKeys = []string{
+		`\registry\machine\software\microsoft\windows\currentversion\run\updater`,
+		`\registry\user\s-1-5-21-1-1000\software\microsoft\office\16.0\word\mru`,
+		`\registry\machine\system\currentcontrolset\services\bam\state`,
+	}
+	generatorDomains = []string{"www.google.com", "update.microsoft.com", "cdn.example.net", "tvrain.ru"}
+)
+
+// eventGenerator produces a random mix of realistic events, for testing the forwarder's output and the parsers
+// downstream of it without sensors. Each event type has a weight; a type with twice the weight of another is
+// generated twice as often.
+type eventGenerator struct {
+	rand    *rand.Rand
+	types   []string
+	weights []int
+	total   int
+}
+
+// newEventGenerator parses a mix such as "ingress.event.netconn:10,ingress.event.procstart:1"; a type without a weight
+// has a weight of 1, and "all" stands for every type.
+func newEventGenerator(mix string, seed int64) (*eventGenerator, error) {
+	g := &eventGenerator{rand: rand.New(rand.NewSource(seed))}
+
+	for _, part := range strings.Split(mix, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+
+		weight := 1
+		if i := strings.LastIndex(part, ":"); i >= 0 {
+			var err error
+			if weight, err = strconv.Atoi(part[i+1:]); err != nil || weight < 0 {
+				return nil, fmt.Errorf("Invalid weight in '%s': should be a whole number", part)
+			}
+			part = part[:i]
+		}
+
+		if part == "all" {
+			for _, eventType := range generatorEventTypeNames() {
+				g.add(eventType, weight)
+			}
+			continue
+		}
+		if _, ok := generatedEventTypes[part]; !ok {
+			return nil, fmt.Errorf("Cannot generate events of type '%s': valid types are all, %s", part,
+				strings.Join(generatorEventTypeNames(), ", "))
+		}
+		g.add(part, weight)
+	}
+
+	if g.total == 0 {
+		return nil, fmt.Errorf("No event types to generate")
+	}
+	return g, nil
+}
+
+func generatorEventTypeNames() []string {
+	names := make([]string, 0, len(generatedEventTypes))
+	for name := range generatedEventTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (g *eventGenerator) add(eventType string, weight int) {
+	g.types = append(g.types, eventType)
+	g.weights = append(g.weights, weight)
+	g.total += weight
+}
+
+// Next returns a random event of one of the generator's types.
+func (g *eventGenerator) Next() generatedEvent {
+	n := g.rand.Intn(g.total)
+	for i, weight := range g.weights {
+		if n < weight {
+			return generatedEventTypes[g.types[i]](g)
+		}
+		n -= weight
+	}
+	panic("Impossible: event weights do not add up")
+}
+
+// runGenerator sends count generated events (or, if count is 0, events until ctx is cancelled) through the usual
+// processing and output, at no more than rate events per second.
+func runGenerator(ctx context.Context, g *eventGenerator, rate float64, count int) error {
+	limiter := newEventRateLimiter(rate)
+	log.Printf("Generating events at %g per second", rate)
+
+	for sent := 0; count == 0 || sent < count; sent++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		event := g.Next()
+		if err := processMessage(ctx, event.body, event.routingKey, event.contentType, nil,
+			"api.events"); err != nil {
+			return err
+		}
+		generatedEvents.Add(event.routingKey, 1)
+	}
+	return nil
+}
+
+func (g *eventGenerator) pick(values []string) string {
+	return values[g.rand.Intn(len(values))]
+}
+
+func (g *eventGenerator) md5(seed string) []byte {
+	sum := md5.Sum([]byte(seed))
+	return sum[:]
+}
+
+func (g *eventGenerator) ipv4() uint32 {
+	return uint32(10<<24) | uint32(g.rand.Intn(1<<24))
+}
+
+// windowsTime is the FILETIME of a moment in the last minute.
+func (g *eventGenerator) windowsTime() int64 {
+	t := time.Now().Add(-time.Duration(g.rand.Int63n(int64(time.Minute))))
+	return t.UnixNano()/100 + 116444736000000000
+}
+
+// sensorEvent returns a protobuf event from a random process on a random sensor, with the given path in its strings.
+func (g *eventGenerator) sensorEvent(path string) *sensor_events.CbEventMsg {
+	sensor := g.rand.Intn(len(generatorHosts))
+	processPath := g.pick(generatorProcesses)
+
+	msg := &sensor_events.CbEventMsg{
+		Header: &sensor_events.CbHeaderMsg{
+			Version:            proto.Int32(4),
+			Timestamp:          proto.Int64(g.windowsTime()),
+			ProcessPid:         proto.Int32(int32(4 * (1 + g.rand.Intn(4096)))),
+			ProcessCreateTime:  proto.Int64(g.windowsTime() - int64(g.rand.Intn(36000000000))),
+			ProcessMd5:         g.md5(processPath),
+			ProcessPath:        proto.String(processPath),
+			FilepathStringGuid: proto.Int64(1),
+		},
+		Env: &sensor_events.CbEnvironmentMsg{
+			Endpoint: &sensor_events.CbEndpointEnvironmentMsg{
+				SensorId:       proto.Int32(int32(sensor + 1)),
+				SensorHostName: proto.String(generatorHosts[sensor]),
+			},
+			Server: &sensor_events.CbServerEnvironmentMsg{NodeId: proto.Int32(0)},
+		},
+	}
+	if len(path) > 0 {
+		msg.Strings = []*sensor_events.CbStringMsg{{Guid: proto.Int64(1), Utf8String: []byte(path)}}
+	}
+	return msg
+}
+
+func (g *eventGenerator) protobufEvent(routingKey string, msg *sensor_events.CbEventMsg) generatedEvent {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		panic(fmt.Sprintf("Impossible: cannot marshal generated %s event: %s", routingKey, err))
+	}
+	return generatedEvent{routingKey: routingKey, contentType: "application/protobuf", body: body}
+}
+
+func (g *eventGenerator) jsonEvent(routingKey string, msg map[string]interface{}) generatedEvent {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		panic(fmt.Sprintf("Impossible: cannot marshal generated %s event: %s", routingKey, err))
+	}
+	return generatedEvent{routingKey: routingKey, contentType: "application/json", body: body}
+}
+
+func (g *eventGenerator) process(created bool) generatedEvent {
+	// the path of a process event is that of the process itself
+	msg := g.sensorEvent("")
+	msg.Strings = []*sensor_events.CbStringMsg{{Guid: proto.Int64(1), Utf8String: []byte(msg.Header.GetProcessPath())}}
+	parent := g.pick(generatorProcesses)
+	msg.Process = &sensor_events.CbProcessMsg{
+		Created:          proto.Bool(created),
+		ParentPid:        proto.Int32(int32(4 * (1 + g.rand.Intn(4096)))),
+		ParentCreateTime: proto.Int64(g.windowsTime() - int64(g.rand.Intn(36000000000))),
+		ParentMd5:        g.md5(parent),
+		ParentPath:       proto.String(parent),
+		Commandline:      []byte(fmt.Sprintf(`"%s" --id=%d`, msg.Header.GetProcessPath(), g.rand.Intn(1000))),
+		Username:         proto.String(`CORP\user` + strconv.Itoa(g.rand.Intn(50))),
+		Uid:              proto.String("S-1-5-21-1-" + strconv.Itoa(1000+g.rand.Intn(50))),
+	}
+	if created {
+		msg.Process.Md5Hash = msg.Header.ProcessMd5
+		return g.protobufEvent("ingress.event.procstart", msg)
+	}
+	return g.protobufEvent("ingress.event.procend", msg)
+}
+
+func (g *eventGenerator) netconn() generatedEvent {
+	msg := g.sensorEvent("")
+	remote, local := g.ipv4(), g.ipv4()
+	port := []uint32{53, 80, 443, 445, 3389}[g.rand.Intn(5)]
+	protocol := sensor_events.CbNetConnMsg_ProtoTcp
+	if port == 53 {
+		protocol = sensor_events.CbNetConnMsg_ProtoUdp
+	}
+	msg.Network = &sensor_events.CbNetConnMsg{
+		Ipv4Address:     proto.Uint32(remote),
+		Port:            proto.Uint32(port),
+		Protocol:        &protocol,
+		Utf8Netpath:     []byte(g.pick(generatorDomains)),
+		Outbound:        proto.Bool(g.rand.Intn(4) > 0),
+		RemoteIpAddress: proto.Uint32(remote),
+		RemotePort:      proto.Uint32(port),
+		LocalIpAddress:  proto.Uint32(local),
+		LocalPort:       proto.Uint32(uint32(49152 + g.rand.Intn(16384))),
+	}
+	return g.protobufEvent("ingress.event.netconn", msg)
+}
+
+func (g *eventGenerator) filemod() generatedEvent {
+	path := g.pick(generatorFiles)
+	msg := g.sensorEvent(path)
+	actions := []sensor_events.CbFileModMsg_CbFileModAction{
+		sensor_events.CbFileModMsg_actionFileModCreate,
+		sensor_events.CbFileModMsg_actionFileModWrite,
+		sensor_events.CbFileModMsg_actionFileModDelete,
+		sensor_events.CbFileModMsg_actionFileModLastWrite,
+	}
+	action := actions[g.rand.Intn(len(actions))]
+	msg.Filemod = &sensor_events.CbFileModMsg{Action: &action}
+	if action == sensor_events.CbFileModMsg_actionFileModLastWrite {
+		fileType := sensor_events.CbFileModMsg_filetypePe
+		msg.Filemod.Md5Hash = g.md5(path)
+		msg.Filemod.Type = &fileType
+	}
+	return g.protobufEvent("ingress.event.filemod", msg)
+}
+
+func (g *eventGenerator) regmod() generatedEvent {
+	msg := g.sensorEvent("")
+	actions := []sensor_events.CbRegModMsg_CbRegModAction{
+		sensor_events.CbRegModMsg_actionRegModCreateKey,
+		sensor_events.CbRegModMsg_actionRegModWriteValue,
+		sensor_events.CbRegModMsg_actionRegModDeleteKey,
+		sensor_events.CbRegModMsg_actionRegModDeleteValue,
+	}
+	action := actions[g.rand.Intn(len(actions))]
+	msg.Regmod = &sensor_events.CbRegModMsg{
+		Action:      &action,
+		Utf8Regpath: []byte(g.pick(generatorRegistryKeys)),
+	}
+	return g.protobufEvent("ingress.event.regmod", msg)
+}
+
+func (g *eventGenerator) moduleload() generatedEvent {
+	path := g.pick(generatorModules)
+	msg := g.sensorEvent(path)
+	msg.Modload = &sensor_events.CbModuleLoadMsg{
+		HandlepathStringGuid: proto.Int64(1),
+		Md5Hash:              g.md5(path),
+	}
+	return g.protobufEvent("ingress.event.moduleload", msg)
+}
+
+func (g *eventGenerator) childproc() generatedEvent {
+	msg := g.sensorEvent("")
+	path := g.pick(generatorProcesses)
+	msg.Childproc = &sensor_events.CbChildProcessMsg{
+		Created:    proto.Bool(g.rand.Intn(2) == 0),
+		Md5Hash:    g.md5(path),
+		Path:       proto.String(path),
+		Pid:        proto.Int64(int64(4 * (1 + g.rand.Intn(4096)))),
+		CreateTime: proto.Int64(g.windowsTime()),
+	}
+	return g.protobufEvent("ingress.event.childproc", msg)
+}
+
+func (g *eventGenerator) crossprocopen() generatedEvent {
+	msg := g.sensorEvent("")
+	target := g.pick(generatorProcesses)
+	openType := sensor_events.CbCrossProcessOpenMsg_OpenProcessHandle
+	msg.Crossproc = &sensor_events.CbCrossProcessMsg{
+		Open: &sensor_events.CbCrossProcessOpenMsg{
+			Type:                 &openType,
+			TargetPid:            proto.Uint32(uint32(4 * (1 + g.rand.Intn(4096)))),
+			TargetProcCreateTime: proto.Uint64(uint64(g.windowsTime())),
+			RequestedAccess:      proto.Uint32(0x1fffff),
+			TargetProcPath:       proto.String(target),
+			TargetProcMd5:        g.md5(target),
+		},
+	}
+	return g.protobufEvent("ingress.event.crossprocopen", msg)
+}
+
+// processDoc describes a random process as the Cb server's process search does.
+func (g *eventGenerator) processDoc() map[string]interface{} {
+	sensor := g.rand.Intn(len(generatorHosts))
+	path := g.pick(generatorProcesses)
+	id := fmt.Sprintf("%08x-0000-%04x-01d1-%012x", sensor+1, g.rand.Intn(1<<16), g.rand.Int63n(1<<48))
+	return map[string]interface{}{
+		"sensor_id":     sensor + 1,
+		"hostname":      generatorHosts[sensor],
+		"process_name":  path[strings.LastIndex(path, `\`)+1:],
+		"path":          path,
+		"process_md5":   fmt.Sprintf("%x", g.md5(path)),
+		"process_pid":   4 * (1 + g.rand.Intn(4096)),
+		"username":      `CORP\user` + strconv.Itoa(g.rand.Intn(50)),
+		"id":            id,
+		"unique_id":     id + "-00000001",
+		"segment_id":    1,
+		"group":         "Default Group",
+		"os_type":       "windows",
+		"host_type":     "workstation",
+		"modload_count": g.rand.Intn(200),
+		"filemod_count": g.rand.Intn(50),
+		"regmod_count":  g.rand.Intn(50),
+		"netconn_count": g.rand.Intn(20),
+		"start":         time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+		"last_update":   time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func (g *eventGenerator) eventTimestamp() float64 {
+	return float64(time.Now().UnixNano()/int64(time.Millisecond)) / 1000
+}
+
+func (g *eventGenerator) watchlistHit() generatedEvent {
+	return g.jsonEvent("watchlist.hit.process", map[string]interface{}{
+		"server_name":     "cbserver",
+		"watchlist_id":    1 + g.rand.Intn(20),
+		"watchlist_name":  "Generated Watchlist",
+		"event_timestamp": g.eventTimestamp(),
+		"cb_version":      "6.1.0",
+		"docs":            []interface{}{g.processDoc()},
+	})
+}
+
+func (g *eventGenerator) alert() generatedEvent {
+	doc := g.processDoc()
+	return g.jsonEvent("alert.watchlist.hit.query.process", map[string]interface{}{
+		"alert_type":         "watchlist.hit.query.process",
+		"event_timestamp":    g.eventTimestamp(),
+		"watchlist_id":       strconv.Itoa(1 + g.rand.Intn(20)),
+		"watchlist_name":     "Generated Watchlist",
+		"feed_name":          "My Watchlists",
+		"ioc_type":           "query",
+		"status":             "Unresolved",
+		"report_score":       strconv.Itoa(g.rand.Intn(100)),
+		"alert_severity":     fmt.Sprintf("%.1f", g.rand.Float64()*100),
+		"sensor_id":          strconv.Itoa(doc["sensor_id"].(int)),
+		"hostname":           doc["hostname"],
+		"process_name":       doc["process_name"],
+		"process_path":       doc["path"],
+		"md5":                doc["process_md5"],
+		"process_id":         doc["id"],
+		"unique_id":          doc["unique_id"],
+		"username":           doc["username"],
+		"created_time":       time.Now().UTC().Format(time.RFC3339Nano),
+		"sensor_criticality": "1.0",
+	})
+}
+
+func (g *eventGenerator) feedHit() generatedEvent {
+	doc := g.processDoc()
+	return g.jsonEvent("feed.ingress.hit.process", map[string]interface{}{
+		"sensor_id":    doc["sensor_id"],
+		"hostname":     doc["hostname"],
+		"group":        "Default Group",
+		"feed_id":      1 + g.rand.Intn(30),
+		"feed_name":    "generatedfeed",
+		"report_id":    fmt.Sprintf("generated-%d", g.rand.Intn(10000)),
+		"report_score": g.rand.Intn(100),
+		"ioc_type":     "dns",
+		"ioc_value":    g.pick(generatorDomains),
+		"process_guid": doc["id"],
+		"timestamp":    g.eventTimestamp(),
+		"os_type":      "Windows",
+	})
+}
+
+func (g *eventGenerator) binaryObserved() generatedEvent {
+	return g.jsonEvent("binaryinfo.observed", map[string]interface{}{
+		"md5":             fmt.Sprintf("%X", g.md5(g.pick(generatorFiles)+strconv.Itoa(g.rand.Intn(1000)))),
+		"scores":          map[string]interface{}{},
+		"watchlists":      map[string]interface{}{},
+		"event_timestamp": g.eventTimestamp(),
+	})
+}
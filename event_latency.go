@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"hash/maphash"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencySLO is a class of events, set in [latency_slo], whose latency - the time from being received from the
+// message bus to being delivered by the output - should stay within Threshold for Percentile percent of them.
+type LatencySLO struct {
+	Name       string
+	EventTypes []string
+	Threshold  time.Duration
+	Percentile float64
+}
+
+const (
+	// how often the latencies are checked against their thresholds
+	latencyCheckInterval = 10 * time.Second
+	// events that haven't reached the output this long after being queued for it are assumed lost
+	latencyPendingMaxAge = time.Hour
+	// the window is kept as this many slots, the oldest replaced as time moves on
+	latencySlots = 5
+	// the histogram buckets are powers of 2 from latencyBucketBase: 10ms, 20ms ... about 6 hours, then everything
+	// slower
+	latencyBucketBase = 10 * time.Millisecond
+	latencyBuckets    = 22
+)
+
+func parseLatencySLOs(section ini.Section, errs *ConfigurationError) ([]LatencySLO, time.Duration) {
+	window := 5 * time.Minute
+	slos := make(map[string]*LatencySLO)
+	get := func(name string) *LatencySLO {
+		if _, ok := slos[name]; !ok {
+			slos[name] = &LatencySLO{Name: name, Percentile: 95}
+		}
+		return slos[name]
+	}
+
+	for key, val := range section {
+		if key == "window" {
+			d, err := time.ParseDuration(val)
+			if err != nil || d < latencySlots*time.Second {
+				errs.addErrorString(fmt.Sprintf("Invalid window '%s' in [latency_slo]: should be a duration of at "+
+					"least %ds", val, latencySlots))
+			} else {
+				window = d
+			}
+			continue
+		}
+
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid latency_slo key '%s': should look like (option).(class name)", key))
+			continue
+		}
+		switch parts[0] {
+		case "event_types":
+			get(parts[1]).EventTypes = splitList(val)
+		case "threshold":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				errs.addErrorString(fmt.Sprintf("Invalid %s '%s' in [latency_slo]: should be a duration", key, val))
+			} else {
+				get(parts[1]).Threshold = d
+			}
+		case "percentile":
+			p, err := strconv.ParseFloat(val, 64)
+			if err != nil || p <= 0 || p > 100 {
+				errs.addErrorString(fmt.Sprintf("Invalid %s '%s' in [latency_slo]: should be a percentage above 0 "+
+					"and up to 100", key, val))
+			} else {
+				get(parts[1]).Percentile = p
+			}
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown latency_slo option '%s' in key %s", parts[0], key))
+		}
+	}
+
+	ret := make([]LatencySLO, 0, len(slos))
+	for _, slo := range slos {
+		if len(slo.EventTypes) == 0 || slo.Threshold == 0 {
+			errs.addErrorString(fmt.Sprintf("Latency SLO %s needs event_types.%s and threshold.%s", slo.Name,
+				slo.Name, slo.Name))
+			continue
+		}
+		ret = append(ret, *slo)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, window
+}
+
+// latencyHistogram counts latencies in buckets of powers of 2.
+type latencyHistogram struct {
+	counts [latencyBuckets + 1]int64
+	max    time.Duration
+}
+
+func latencyBucket(latency time.Duration) int {
+	if latency <= latencyBucketBase {
+		return 0
+	}
+	bucket := int(math.Ceil(math.Log2(float64(latency) / float64(latencyBucketBase))))
+	if bucket > latencyBuckets {
+		return latencyBuckets
+	}
+	return bucket
+}
+
+func (h *latencyHistogram) add(latency time.Duration, count int64) {
+	h.counts[latencyBucket(latency)] += count
+	if latency > h.max {
+		h.max = latency
+	}
+}
+
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+func (h *latencyHistogram) total() int64 {
+	var total int64
+	for _, count := range h.counts {
+		total += count
+	}
+	return total
+}
+
+// quantile returns the latency that percentile percent of the latencies are within, to the upper bound of its
+// bucket, and never more than the largest latency.
+func (h *latencyHistogram) quantile(percentile float64) time.Duration {
+	total := h.total()
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(float64(total) * percentile / 100))
+	var seen int64
+	for i, count := range h.counts {
+		if seen += count; seen >= rank {
+			if bound := latencyBucketBase << uint(i); i < latencyBuckets && bound < h.max {
+				return bound
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// latencyClass keeps the latencies of the events of one LatencySLO over the window, in a slot a fraction of the
+// window long each.
+type latencyClass struct {
+	LatencySLO
+	slots     [latencySlots]latencyHistogram
+	slotIndex [latencySlots]int64
+
+	violated      bool
+	violatedSince time.Time
+	violations    int64
+}
+
+func (c *latencyClass) add(slot int64, latency time.Duration, count int64) {
+	i := slot % latencySlots
+	if c.slotIndex[i] != slot {
+		c.slots[i], c.slotIndex[i] = latencyHistogram{}, slot
+	}
+	c.slots[i].add(latency, count)
+}
+
+// window returns the latencies of the slots up to and including slot.
+func (c *latencyClass) window(slot int64) latencyHistogram {
+	var h latencyHistogram
+	for i := range c.slots {
+		if c.slotIndex[i] > slot-latencySlots {
+			h.merge(&c.slots[i])
+		}
+	}
+	return h
+}
+
+type pendingEvent struct {
+	class    *latencyClass
+	received time.Time
+}
+
+// latencyTracker measures the latency of the events of the classes set in [latency_slo], and flags each class whose
+// latency is over its threshold. An event is recorded, by a hash of its formatted text, when it is queued for the
+// output, and is looked up by the output when it takes it: bundled outputs deliver it when the file it is written
+// to has been uploaded, and the others once they have taken it. The methods of a nil *latencyTracker do nothing, so
+// without [latency_slo] events cost nothing but the call.
+type latencyTracker struct {
+	classes []*latencyClass
+	slot    time.Duration
+
+	seed    maphash.Seed
+	pending map[uint64][]pendingEvent
+	expired int64
+	sync.Mutex
+}
+
+var latencySLOs *latencyTracker
+
+func newLatencyTracker(slos []LatencySLO, window time.Duration) *latencyTracker {
+	t := &latencyTracker{slot: window / latencySlots, seed: maphash.MakeSeed(), pending: make(map[uint64][]pendingEvent)}
+	for _, slo := range slos {
+		t.classes = append(t.classes, &latencyClass{LatencySLO: slo})
+	}
+	return t
+}
+
+func (t *latencyTracker) hash(message string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(t.seed)
+	h.WriteString(message)
+	return h.Sum64()
+}
+
+func (t *latencyTracker) classOf(eventType string) *latencyClass {
+	for _, c := range t.classes {
+		for _, pattern := range c.EventTypes {
+			if RoutingKeyMatches(pattern, eventType) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// queued records that an event of eventType received at received has been queued for the output as message.
+func (t *latencyTracker) queued(eventType, message string, received time.Time) {
+	if t == nil || received.IsZero() {
+		return
+	}
+	c := t.classOf(eventType)
+	if c == nil {
+		return
+	}
+	key := t.hash(message)
+
+	t.Lock()
+	defer t.Unlock()
+	t.pending[key] = append(t.pending[key], pendingEvent{class: c, received: received})
+}
+
+// take returns the class of a message reaching the output, and when it was received, if its latency is measured.
+func (t *latencyTracker) take(message string) (*latencyClass, time.Time, bool) {
+	if t == nil {
+		return nil, time.Time{}, false
+	}
+	key := t.hash(message)
+
+	t.Lock()
+	defer t.Unlock()
+	events, ok := t.pending[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	if len(events) == 1 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = events[1:]
+	}
+	return events[0].class, events[0].received, true
+}
+
+func (t *latencyTracker) delivered(c *latencyClass, latency time.Duration, count int64, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	c.add(now.UnixNano()/int64(t.slot), latency, count)
+}
+
+// deliveredNow records that the output has delivered message, if its latency is measured.
+func (t *latencyTracker) deliveredNow(message string) {
+	if c, received, ok := t.take(message); ok {
+		now := time.Now()
+		t.delivered(c, now.Sub(received), 1, now)
+	}
+}
+
+// Go passes the events from in on to the output, recording each as delivered as the output takes it, for outputs
+// that don't confirm deliveries themselves.
+func (t *latencyTracker) Go(in <-chan string) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for message := range in {
+			out <- message
+			t.deliveredNow(message)
+		}
+	}()
+	return out
+}
+
+// run checks the latencies every latencyCheckInterval until ctx is cancelled.
+func (t *latencyTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(latencyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			t.check(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check forgets the events that have been pending too long, and flags the classes over their thresholds.
+func (t *latencyTracker) check(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	for key, events := range t.pending {
+		fresh := events[:0]
+		for _, e := range events {
+			if now.Sub(e.received) < latencyPendingMaxAge {
+				fresh = append(fresh, e)
+			} else {
+				t.expired++
+			}
+		}
+		if len(fresh) == 0 {
+			delete(t.pending, key)
+		} else {
+			t.pending[key] = fresh
+		}
+	}
+
+	slot := now.UnixNano() / int64(t.slot)
+	for _, c := range t.classes {
+		window := c.window(slot)
+		latency := window.quantile(c.Percentile)
+		violated := window.total() > 0 && latency > c.Threshold
+		if violated == c.violated {
+			continue
+		}
+		if violated {
+			log.Printf("WARNING: %g%% of %s events were delivered within %s over the last %s, above the %s "+
+				"threshold", c.Percentile, c.Name, latency, t.slot*latencySlots, c.Threshold)
+			c.violations++
+		} else {
+			log.Printf("%s events are delivered within their %s threshold again (over it since %s)", c.Name,
+				c.Threshold, c.violatedSince.Format(time.RFC3339))
+		}
+		c.violated, c.violatedSince = violated, now
+	}
+}
+
+type LatencyClassStatistics struct {
+	EventTypes    []string  `json:"event_types"`
+	Threshold     string    `json:"threshold"`
+	Percentile    float64   `json:"percentile"`
+	Delivered     int64     `json:"delivered"`
+	P50           float64   `json:"p50_seconds"`
+	P95           float64   `json:"p95_seconds"`
+	P99           float64   `json:"p99_seconds"`
+	Max           float64   `json:"max_seconds"`
+	Latency       float64   `json:"latency_seconds"`
+	Violated      bool      `json:"violated"`
+	ViolatedSince time.Time `json:"violated_since,omitempty"`
+	Violations    int64     `json:"violations"`
+}
+
+// LatencyStatistics is shown on the status page as latency_slo. The latencies are over the window, and Latency is
+// that of the percentile of the class, which is compared with its threshold.
+type LatencyStatistics struct {
+	Window   string                            `json:"window"`
+	Violated bool                              `json:"violated"`
+	Pending  int                               `json:"pending"`
+	Expired  int64                             `json:"expired"`
+	Classes  map[string]LatencyClassStatistics `json:"classes"`
+}
+
+func (t *latencyTracker) Statistics() interface{} {
+	t.Lock()
+	defer t.Unlock()
+
+	stats := LatencyStatistics{
+		Window:  (t.slot * latencySlots).String(),
+		Expired: t.expired,
+		Classes: make(map[string]LatencyClassStatistics, len(t.classes)),
+	}
+	for _, events := range t.pending {
+		stats.Pending += len(events)
+	}
+	slot := time.Now().UnixNano() / int64(t.slot)
+	for _, c := range t.classes {
+		window := c.window(slot)
+		class := LatencyClassStatistics{
+			EventTypes: c.EventTypes,
+			Threshold:  c.Threshold.String(),
+			Percentile: c.Percentile,
+			Delivered:  window.total(),
+			P50:        window.quantile(50).Seconds(),
+			P95:        window.quantile(95).Seconds(),
+			P99:        window.quantile(99).Seconds(),
+			Max:        window.max.Seconds(),
+			Latency:    window.quantile(c.Percentile).Seconds(),
+			Violated:   c.violated,
+			Violations: c.violations,
+		}
+		if c.violated {
+			class.ViolatedSince = c.violatedSince
+		}
+		stats.Classes[c.Name] = class
+		stats.Violated = stats.Violated || c.violated
+	}
+	return stats
+}
+
+// latencyBatch holds when the measured events written to a bundle were received, to the second, until the bundle
+// is uploaded and they are delivered.
+type latencyBatch map[*latencyClass]map[int64]int64
+
+func (b latencyBatch) add(c *latencyClass, received time.Time) latencyBatch {
+	if b == nil {
+		b = make(latencyBatch)
+	}
+	if b[c] == nil {
+		b[c] = make(map[int64]int64)
+	}
+	b[c][received.Unix()]++
+	return b
+}
+
+// deliveredBatch records that the events of a batch have been delivered at now.
+func (t *latencyTracker) deliveredBatch(b latencyBatch, now time.Time) {
+	if t == nil || len(b) == 0 {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	slot := now.UnixNano() / int64(t.slot)
+	for c, seconds := range b {
+		for second, count := range seconds {
+			c.add(slot, now.Sub(time.Unix(second, 0)), count)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"github.com/vaughan0/go-ini"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLatencySLOs(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`[latency_slo]
+event_types.alerts=alert.#, watchlist.hit.#
+threshold.alerts=1m
+percentile.alerts=99
+event_types.raw=ingress.event.#
+threshold.raw=15m
+window=10m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := ConfigurationError{Empty: true}
+	slos, window := parseLatencySLOs(input.Section("latency_slo"), &errs)
+	if !errs.Empty {
+		t.Fatal(errs)
+	}
+	if window != 10*time.Minute || len(slos) != 2 || slos[0].Name != "alerts" || slos[0].Percentile != 99 ||
+		len(slos[0].EventTypes) != 2 || slos[1].Threshold != 15*time.Minute || slos[1].Percentile != 95 {
+		t.Errorf("Unexpected latency SLOs %+v over %s", slos, window)
+	}
+
+	input, _ = ini.Load(strings.NewReader("[latency_slo]\nevent_types.alerts=alert.#\npercentile.raw=101\n"))
+	errs = ConfigurationError{Empty: true}
+	if parseLatencySLOs(input.Section("latency_slo"), &errs); errs.Empty || len(errs.Errors) != 2 {
+		t.Errorf("Expected a missing threshold and a bad percentile to be reported, got %v", errs)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	h.add(5*time.Millisecond, 90)
+	h.add(300*time.Millisecond, 9)
+	h.add(time.Minute, 1)
+
+	if h.total() != 100 || h.quantile(50) != 10*time.Millisecond || h.quantile(95) != 320*time.Millisecond ||
+		h.quantile(99.5) != time.Minute {
+		t.Errorf("Unexpected quantiles %s %s %s of %d", h.quantile(50), h.quantile(95), h.quantile(99.5), h.total())
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	tracker := newLatencyTracker([]LatencySLO{
+		{Name: "alerts", EventTypes: []string{"alert.#"}, Threshold: time.Second, Percentile: 95},
+	}, 5*time.Minute)
+	alerts := tracker.classes[0]
+
+	now := time.Now()
+	alert := `{"type":"alert.watchlist.hit.query.process","process_guid":"1"}`
+	tracker.queued("alert.watchlist.hit.query.process", alert, now.Add(-100*time.Millisecond))
+	tracker.queued("ingress.event.netconn", `{"type":"ingress.event.netconn"}`, now)
+	tracker.queued("alert.watchlist.hit.query.process", alert, time.Time{})
+	if len(tracker.pending) != 1 {
+		t.Fatalf("Expected only the received alert to be measured, got %+v", tracker.pending)
+	}
+
+	out := tracker.Go(func() <-chan string {
+		in := make(chan string, 1)
+		in <- alert
+		close(in)
+		return in
+	}())
+	if <-out != alert {
+		t.Fatal("Expected the event to be passed on")
+	}
+	// the event is delivered once it has been taken; wait for the tracker to see it
+	for range out {
+	}
+	if _, _, ok := tracker.take(alert); ok {
+		t.Error("Expected the delivered alert to be taken")
+	}
+
+	tracker.check(time.Now())
+	stats := tracker.Statistics().(LatencyStatistics)
+	if stats.Violated || stats.Classes["alerts"].Delivered != 1 || stats.Classes["alerts"].Latency > 0.5 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+
+	// a bundle of 20 alerts uploaded a minute after they were received
+	var batch latencyBatch
+	for i := 0; i < 20; i++ {
+		batch = batch.add(alerts, now.Add(-time.Minute))
+	}
+	tracker.deliveredBatch(batch, now)
+	tracker.check(now)
+	stats = tracker.Statistics().(LatencyStatistics)
+	if class := stats.Classes["alerts"]; !stats.Violated || !class.Violated || class.Delivered != 21 ||
+		class.Violations != 1 || class.Max < 59 {
+		t.Errorf("Expected the alerts to be over their threshold, got %+v", stats)
+	}
+
+	// with the slow alerts out of the window, the objective is met again
+	tracker.check(now.Add(6 * time.Minute))
+	if alerts.violated {
+		t.Error("Expected the alerts to be within their threshold once the window has passed")
+	}
+
+	tracker.queued("alert.watchlist.hit.query.process", alert, now.Add(-2*latencyPendingMaxAge))
+	tracker.check(now)
+	if stats = tracker.Statistics().(LatencyStatistics); stats.Pending != 0 || stats.Expired != 1 {
+		t.Errorf("Expected the lost event to expire, got %+v", stats)
+	}
+}
+
+func TestBundledOutputLatency(t *testing.T) {
+	defer func(saved *latencyTracker) { latencySLOs = saved }(latencySLOs)
+	latencySLOs = newLatencyTracker([]LatencySLO{
+		{Name: "alerts", EventTypes: []string{"alert.#"}, Threshold: time.Minute, Percentile: 95},
+	}, 5*time.Minute)
+
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	alert := `{"type":"alert.watchlist.hit.query.process","process_guid":"1"}`
+	latencySLOs.queued("alert.watchlist.hit.query.process", alert, time.Now().Add(-10*time.Second))
+	messages <- alert
+	if err := output.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-behavior.uploads
+
+	// the events are delivered once the loop has seen the upload succeed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		class := latencySLOs.Statistics().(LatencyStatistics).Classes["alerts"]
+		if class.Delivered == 1 {
+			if class.Max < 10 || class.Max > 20 {
+				t.Errorf("Expected a latency of about 10 seconds, got %+v", class)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The alert was not delivered: %+v", class)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/streadway/amqp"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 func processJson(routingKey string, indata []byte) ([]map[string]interface{}, error) {
@@ -175,3 +178,76 @@ func processTestEvents(t *testing.T, outputDir string, outputFunc outputMessageF
 		}
 	}
 }
+
+func TestSelfTestProcessing(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OutputFormat = JSONOutputFormat
+
+	test, err := newSelfTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := test.checkProcessing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(test.formatted, test.id) || !strings.Contains(test.formatted, selfTestRoutingKey) {
+		t.Errorf("Unexpected self-test event %s", test.formatted)
+	}
+}
+
+func TestEventGenerator(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OutputFormat = JSONOutputFormat
+
+	for _, eventType := range generatorEventTypeNames() {
+		g, err := newEventGenerator(eventType, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		event := g.Next()
+		if err := processMessage(context.Background(), event.body, event.routingKey, event.contentType, nil,
+			"api.events"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case formatted := <-results:
+			var msg map[string]interface{}
+			if err := json.Unmarshal([]byte(formatted), &msg); err != nil {
+				t.Errorf("Could not decode processed %s event: %s", eventType, err)
+				continue
+			}
+			if msg["type"] != eventType {
+				t.Errorf("Generated %s event was processed as %v: %s", eventType, msg["type"], formatted)
+			}
+		default:
+			t.Errorf("Generated %s event was dropped", eventType)
+		}
+		drainMessages(results, func(string) error { return nil })
+	}
+
+	if _, err := newEventGenerator("ingress.event.procstart:10,unknown", 1); err == nil {
+		t.Error("Expected an error for an unknown event type")
+	}
+	if _, err := newEventGenerator("all:0", 1); err == nil {
+		t.Error("Expected an error when every weight is 0")
+	}
+}
+
+func TestHeartbeatEvent(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	for _, format := range []int{JSONOutputFormat, LEEFOutputFormat} {
+		config.OutputFormat = format
+		if err := outputMessage(context.Background(), heartbeatEvent(7, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+
+		formatted := <-results
+		if !strings.Contains(formatted, heartbeatEventType) || !strings.Contains(formatted, "input_event_count") {
+			t.Errorf("Unexpected heartbeat event %s", formatted)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// tailBuffer is how many events wait for a slow tail client before further events are dropped for it.
+const tailBuffer = 1000
+
+// tailFilter selects the events whose field matches a path.Match pattern, as given to tail --filter field=pattern.
+type tailFilter struct {
+	field   string
+	pattern string
+}
+
+func parseTailFilter(s string) (tailFilter, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return tailFilter{}, fmt.Errorf("Invalid filter '%s': should be field=pattern, such as type=watchlist.hit.*", s)
+	}
+	f := tailFilter{field: s[:i], pattern: s[i+1:]}
+	if _, err := path.Match(f.pattern, ""); err != nil {
+		return tailFilter{}, fmt.Errorf("Invalid pattern in filter '%s': %s", s, err)
+	}
+	return f, nil
+}
+
+func (f tailFilter) matches(message string) bool {
+	value, ok := messageField(message, f.field)
+	if !ok {
+		return false
+	}
+	matched, _ := path.Match(f.pattern, value)
+	return matched
+}
+
+// messageField returns the value of a field of a formatted event, as text: a field of a JSON event, with the fields
+// of nested objects named like process.path, or of a LEEF event, where the event type is named type.
+func messageField(message, field string) (string, bool) {
+	if strings.HasPrefix(message, "LEEF:") {
+		header := strings.SplitN(message, "|", 6)
+		if field == "type" && len(header) > 4 {
+			return header[4], true
+		}
+		if len(header) < 6 {
+			return "", false
+		}
+		for _, attribute := range strings.Split(header[5], "\t") {
+			if strings.HasPrefix(attribute, field+"=") {
+				return attribute[len(field)+1:], true
+			}
+		}
+		return "", false
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(message), &value); err != nil {
+		return "", false
+	}
+	for _, name := range strings.Split(field, ".") {
+		container, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = container[name]; !ok {
+			return "", false
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	b, _ := json.Marshal(value)
+	return string(b), true
+}
+
+type tailClient struct {
+	filters []tailFilter
+	events  chan string
+	dropped int64
+}
+
+// eventTail copies the formatted events on their way to the output to the clients of GET /management/tail, those
+// of cb-event-forwarder tail. The output itself is left alone: a client too slow to keep up misses events, rather
+// than holding the output back. While nobody is tailing, sendMessage only pays for an atomic load.
+type eventTail struct {
+	clients map[*tailClient]struct{}
+	active  int32
+	sync.Mutex
+}
+
+var eventTails = newEventTail()
+
+func newEventTail() *eventTail {
+	return &eventTail{clients: make(map[*tailClient]struct{})}
+}
+
+func (t *eventTail) subscribe(filters []tailFilter) *tailClient {
+	c := &tailClient{filters: filters, events: make(chan string, tailBuffer)}
+
+	t.Lock()
+	defer t.Unlock()
+	t.clients[c] = struct{}{}
+	atomic.StoreInt32(&t.active, int32(len(t.clients)))
+	return c
+}
+
+func (t *eventTail) unsubscribe(c *tailClient) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.clients, c)
+	atomic.StoreInt32(&t.active, int32(len(t.clients)))
+}
+
+// publish offers a formatted event to the clients whose filters it matches.
+func (t *eventTail) publish(message string) {
+	if atomic.LoadInt32(&t.active) == 0 {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+clients:
+	for c := range t.clients {
+		for _, f := range c.filters {
+			if !f.matches(message) {
+				continue clients
+			}
+		}
+		select {
+		case c.events <- message:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+// serveTail streams the events matching the filter parameters of r, one a line, until the client goes away.
+func (t *eventTail) serveTail(w http.ResponseWriter, r *http.Request) {
+	var filters []tailFilter
+	for _, s := range r.URL.Query()["filter"] {
+		f, err := parseTailFilter(s)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		filters = append(filters, f)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, errors.New("the status server cannot stream events"))
+		return
+	}
+
+	c := t.subscribe(filters)
+	defer t.unsubscribe(c)
+	log.Printf("Tailing events for %s through the management API", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case message := <-c.events:
+			if _, err := io.WriteString(w, message+"\n"); err != nil {
+				return
+			}
+			// send whatever else is already waiting along with it
+			for len(c.events) > 0 {
+				if _, err := io.WriteString(w, <-c.events+"\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			t.Lock()
+			dropped := c.dropped
+			t.Unlock()
+			log.Printf("Stopped tailing events for %s; %d events were dropped because it fell behind", r.RemoteAddr,
+				dropped)
+			return
+		}
+	}
+}
+
+// tailFilterFlags collects the --filter flags of cb-event-forwarder tail.
+type tailFilterFlags []string
+
+func (f *tailFilterFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *tailFilterFlags) Set(s string) error {
+	if _, err := parseTailFilter(s); err != nil {
+		return err
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// runTail runs cb-event-forwarder tail: it streams the events a running forwarder sends to its output to standard
+// output, as they are sent, through the management API of the forwarder. The status server and the API token are
+// found in the configuration file of the forwarder, unless they are given.
+func runTail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	var filters tailFilterFlags
+	flags.Var(&filters, "filter", "Only show events with a field matching a pattern, given as field=pattern, such "+
+		"as type=watchlist.hit.*; may be given more than once, for events matching them all")
+	statusURL := flags.String("url", "", "URL of the status server of the forwarder, by default "+
+		"http://localhost:<http_server_port>")
+	token := flags.String("token", "", "The api_token of the forwarder, by default read from its configuration file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s tail [--filter field=pattern]... [configuration file]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if len(*statusURL) == 0 || len(*token) == 0 {
+		configLocation := "/etc/cb/integrations/event-forwarder/cb-event-forwarder.conf"
+		if flags.NArg() > 0 {
+			configLocation = flags.Arg(0)
+		}
+		input, err := loadConfigFile(configLocation)
+		if err != nil {
+			return err
+		}
+		if len(*statusURL) == 0 {
+			port := 33706
+			if val, ok := input.Get("bridge", "http_server_port"); ok {
+				if port, err = strconv.Atoi(val); err != nil {
+					return fmt.Errorf("Invalid http_server_port '%s' in %s", val, configLocation)
+				}
+			}
+			*statusURL = fmt.Sprintf("http://localhost:%d", port)
+		}
+		if len(*token) == 0 {
+			if *token, _ = input.Get("management", "api_token"); len(*token) == 0 {
+				return fmt.Errorf("tail needs the management API: set api_token in [management] of %s",
+					configLocation)
+			}
+		}
+	}
+
+	query := url.Values{"filter": []string(filters)}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(*statusURL, "/")+"/management/tail?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("could not tail events: %s %s", resp.Status, body.Error)
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
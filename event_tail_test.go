@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMessageField(t *testing.T) {
+	jsonEvent := `{"type":"watchlist.hit.process","process":{"path":"c:\\windows\\cmd.exe","pid":4},"sensor_id":12}`
+	leefEvent := "LEEF:1.0|CB|CB|5.1|alert.watchlist.hit.query.process|cb_server=cbserver\tsensor_id=12"
+
+	for _, test := range []struct {
+		message, field, value string
+		ok                    bool
+	}{
+		{jsonEvent, "type", "watchlist.hit.process", true},
+		{jsonEvent, "process.path", `c:\windows\cmd.exe`, true},
+		{jsonEvent, "sensor_id", "12", true},
+		{jsonEvent, "process.pid.x", "", false},
+		{jsonEvent, "computer_name", "", false},
+		{leefEvent, "type", "alert.watchlist.hit.query.process", true},
+		{leefEvent, "sensor_id", "12", true},
+		{leefEvent, "cb", "", false},
+	} {
+		if value, ok := messageField(test.message, test.field); value != test.value || ok != test.ok {
+			t.Errorf("Expected %s of %s to be %q (%t), got %q (%t)", test.field, test.message, test.value, test.ok,
+				value, ok)
+		}
+	}
+
+	if _, err := parseTailFilter("watchlist.hit.*"); err == nil {
+		t.Error("Expected a filter without a field to be rejected")
+	}
+	if _, err := parseTailFilter("type=[watchlist"); err == nil {
+		t.Error("Expected a filter with a bad pattern to be rejected")
+	}
+}
+
+func TestEventTail(t *testing.T) {
+	tail := newEventTail()
+	api := &managementAPI{token: "secret", consumption: &consumptionGate{}, limiter: newEventRateLimiter(0), tail: tail}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	query := url.Values{"filter": {"type=watchlist.hit.*", "sensor_id=1?"}}
+	req, _ := http.NewRequest("GET", server.URL+"/management/tail?"+query.Encode(), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a tail without the token to be refused, got %s", resp.Status)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected response %s", resp.Status)
+	}
+
+	// the client is subscribed by the time the response starts
+	events := []string{
+		`{"type":"ingress.event.netconn","sensor_id":12}`,
+		`{"type":"watchlist.hit.process","sensor_id":2}`,
+		`{"type":"watchlist.hit.process","sensor_id":12}`,
+		"LEEF:1.0|CB|CB|5.1|watchlist.hit.binary|sensor_id=13",
+	}
+	for _, event := range events {
+		tail.publish(event)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	for _, expected := range events[2:] {
+		if !lines.Scan() || lines.Text() != expected {
+			t.Fatalf("Expected %s, got %q (%v)", expected, lines.Text(), lines.Err())
+		}
+	}
+}
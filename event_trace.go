@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"log"
+	mathrand "math/rand"
+	"time"
+)
+
+var tracedEventCount = expvar.NewInt("traced_event_count")
+
+// eventTracer picks the events to trace: a sample of those matching the filter, or of every event if there is none.
+type eventTracer struct {
+	sampleRate float64
+	filter     *AttackRule
+}
+
+var tracer *eventTracer
+
+// eventTrace follows one event through processMessage. Each stage it reaches is logged as
+//
+//	TRACE <trace id> <event type>: <stage> +<time since the previous stage> (<time since the event was received>)
+//
+// and the event carries the trace ID in a "trace_id" field, so it can be looked for in the output. The methods of
+// a nil *eventTrace do nothing, so the stages of events that aren't traced cost nothing but the call.
+type eventTrace struct {
+	id        string
+	eventType string
+	start     time.Time
+	last      time.Time
+}
+
+// start returns the trace of msg, or nil if it is not traced.
+func (t *eventTracer) start(msg map[string]interface{}, routingKey, exchange string) *eventTrace {
+	if t == nil {
+		return nil
+	}
+	eventType, _ := msg["type"].(string)
+	if t.filter != nil && !t.filter.matches(eventType, msg) {
+		return nil
+	}
+	if t.sampleRate < 1 && mathrand.Float64() >= t.sampleRate {
+		return nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil
+	}
+	tracedEventCount.Add(1)
+	now := time.Now()
+	trace := &eventTrace{id: hex.EncodeToString(id), eventType: eventType, start: now, last: now}
+	msg["trace_id"] = trace.id
+	log.Printf("TRACE %s %s: received from %s with routing key %s", trace.id, eventType, exchange, routingKey)
+	return trace
+}
+
+func (t *eventTrace) stage(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	log.Printf("TRACE %s %s: %s +%s (%s)", t.id, t.eventType, name, now.Sub(t.last), now.Sub(t.start))
+	t.last = now
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEventTracer(t *testing.T) {
+	var nilTracer *eventTracer
+	if nilTracer.start(map[string]interface{}{}, "", "") != nil {
+		t.Fatal("Expected no trace without a tracer")
+	}
+
+	conditions, err := parseAttackConditions("remote_ip:10.1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := &eventTracer{sampleRate: 1, filter: &AttackRule{EventTypes: []string{"ingress.event.netconn"},
+		Conditions: conditions}}
+	if trace := tracer.start(map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "10.9.9.9"},
+		"ingress.event.netconn", "api.events"); trace != nil {
+		t.Error("Expected events not matching the filter not to be traced")
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	msg := map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "10.1.2.3"}
+	trace := tracer.start(msg, "ingress.event.netconn", "api.events")
+	if trace == nil || msg["trace_id"] != trace.id || len(trace.id) != 16 {
+		t.Fatalf("Expected the matching event to be traced, got %v", msg)
+	}
+	trace.stage("enriched")
+	var untraced *eventTrace
+	untraced.stage("enriched")
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "TRACE "+trace.id+" ingress.event.netconn: received from "+
+		"api.events") || !strings.Contains(lines[1], "TRACE "+trace.id+" ingress.event.netconn: enriched +") {
+		t.Errorf("Unexpected trace log %q", logged.String())
+	}
+
+	sampled := &eventTracer{sampleRate: 0.5}
+	traced := 0
+	for i := 0; i < 1000; i++ {
+		if sampled.start(map[string]interface{}{"type": "ingress.event.procstart"}, "", "") != nil {
+			traced++
+		}
+	}
+	if traced < 400 || traced > 600 {
+		t.Errorf("Expected about half the events to be traced, got %d of 1000", traced)
+	}
+}
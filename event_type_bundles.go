@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// bundleFile is a file in the writing directory that events are being appended to. Unless bundles are split by event
+// type, there is a single bundle with an empty family, held in event-forwarder; otherwise each family of event types
+// has its own file, event-forwarder-<family>, which is rolled over and uploaded independently.
+type bundleFile struct {
+	family       string
+	output       *FileOutput
+	size         int64
+	partitionEnd time.Time
+	// whether the file holds an urgent event; see adaptiveRollOver
+	urgent bool
+	// when the events written to the file whose latency is measured were received; see latencyTracker
+	latency latencyBatch
+	// holds events back to write them in timestamp order, if bundle_reorder_window is set
+	reorder *reorderBuffer
+}
+
+var currentFamilyFile = regexp.MustCompile(`^event-forwarder-([a-z0-9_]+)$`)
+var familyUnsafe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+func bundleFileName(family string) string {
+	if len(family) == 0 {
+		return "event-forwarder"
+	}
+	return "event-forwarder-" + family
+}
+
+// eventTypeFamily groups event types for separate bundles: raw sensor events by their kind (ingress.event.netconn
+// becomes netconn) and everything else by the first part of the type (alert, watchlist, feed, binaryinfo, ...).
+func eventTypeFamily(eventType string) string {
+	eventType = strings.ToLower(eventType)
+	if strings.HasPrefix(eventType, "ingress.event.") {
+		eventType = strings.TrimPrefix(eventType, "ingress.event.")
+	} else if i := strings.Index(eventType, "."); i >= 0 {
+		eventType = eventType[:i]
+	}
+	return strings.Trim(familyUnsafe.ReplaceAllString(eventType, "_"), "_")
+}
+
+// messageEventType returns the type of a formatted event: the event ID field of the LEEF header, or the "type" field
+// of a JSON event, in its envelope with json_envelope.
+func messageEventType(message string) string {
+	if strings.HasPrefix(message, "LEEF:") {
+		fields := strings.SplitN(message, "|", 6)
+		if len(fields) > 4 {
+			return fields[4]
+		}
+		return ""
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(message), &fields) != nil {
+		return ""
+	}
+	value, _ := jsonEventField(fields, "type")
+	var eventType string
+	json.Unmarshal(value, &eventType)
+	return eventType
+}
+
+func (o *BundledOutput) openBundle(family string) (*bundleFile, error) {
+	b := &bundleFile{
+		family:  family,
+		output:  &FileOutput{syncPolicy: o.syncPolicy},
+		reorder: newReorderBuffer(config.BundleReorderWindow),
+	}
+	if err := b.output.Initialize(filepath.Join(o.writingDirectory(), bundleFileName(family))); err != nil {
+		return nil, err
+	}
+	if info, err := b.output.outputFile.Stat(); err == nil {
+		b.size = info.Size()
+	}
+	b.partitionEnd = o.nextPartitionEnd(time.Now())
+
+	o.Lock()
+	o.bundles[family] = b
+	o.Unlock()
+	return b, nil
+}
+
+// openFamilyBundles reopens the per-family files left by a previous run, so that the events in them are rolled over
+// and uploaded like any others.
+func (o *BundledOutput) openFamilyBundles() error {
+	fp, err := os.Open(o.writingDirectory())
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	names, err := fp.Readdirnames(0)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if match := currentFamilyFile.FindStringSubmatch(name); match != nil {
+			if _, err := o.openBundle(match[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *BundledOutput) bundleFamily(message string) string {
+	if !o.splitByEventType {
+		return ""
+	}
+	return eventTypeFamily(messageEventType(message))
+}
+
+// bundleFor returns the bundle a message should be appended to, opening a new file for the first event of a family.
+func (o *BundledOutput) bundleFor(message string) (*bundleFile, error) {
+	family := o.bundleFamily(message)
+	if b, ok := o.bundles[family]; ok {
+		return b, nil
+	}
+	return o.openBundle(family)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventTypeFamily(t *testing.T) {
+	for message, family := range map[string]string{
+		`{"type": "ingress.event.netconn", "pid": 1}`:                 "netconn",
+		`{"type": "ingress.event.procstart"}`:                         "procstart",
+		`{"type": "alert.watchlist.hit.query.binary"}`:                "alert",
+		`{"type": "watchlist.storage.hit.process"}`:                   "watchlist",
+		`{"cb_server": "cbserver"}`:                                   "",
+		"LEEF:1.0|CB|CB|5.1|ingress.event.filemod|cb_server=cbserver": "filemod",
+		"not an event": "",
+		// json_envelope, with and without json_flatten
+		`{"event": {"type": "ingress.event.regmod"}, "meta": {"version": "3.8.0"}}`:    "regmod",
+		`{"event.type": "ingress.event.modload", "meta.version": "3.8.0"}`:             "modload",
+		`{"event_type": "alert.watchlist.hit.query.process", "meta_version": "3.8.0"}`: "alert",
+		`{"event_type": "ingress.event.netconn"}`:                                      "",
+	} {
+		if got := eventTypeFamily(messageEventType(message)); got != family {
+			t.Errorf("Expected family %q for %s, got %q", family, message, got)
+		}
+	}
+}
+
+func TestBundledOutputSplitsByEventType(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.BundleByEventType = true
+
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	output.rollOverDuration = 0
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	messages <- `{"type": "ingress.event.netconn"}` + "\n"
+	messages <- `{"type": "alert.watchlist.hit.query.process"}` + "\n"
+	messages <- `{"type": "ingress.event.netconn"}` + "\n"
+	messages <- `{"cb_server": "cbserver"}` + "\n"
+
+	uploaded := make(map[string]bool)
+	deadline := time.After(5 * time.Second)
+	for len(uploaded) < 3 {
+		select {
+		case fn := <-behavior.uploads:
+			base := filepath.Base(fn)
+			uploaded[base[:strings.Index(base, ".")]] = true
+		case <-deadline:
+			t.Fatalf("Expected a file per event type family, got %v", uploaded)
+		}
+	}
+	for _, name := range [...]string{"event-forwarder", "event-forwarder-netconn", "event-forwarder-alert"} {
+		if !uploaded[name] {
+			t.Errorf("No file uploaded for %s: %v", name, uploaded)
+		}
+	}
+}
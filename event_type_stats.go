@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsEventType is the type of the events sent by sendStatsRollups.
+const statsEventType = "cb-event-forwarder.stats"
+
+// the size at which the stats_rollup_file is rotated
+const statsRollupFileMaxSize = 100 * 1024 * 1024
+
+// EventTypeCounters counts the events of one type, as shown on the status page as event_types.
+type EventTypeCounters struct {
+	Received       int64 `json:"received"`
+	Forwarded      int64 `json:"forwarded"`
+	ForwardedBytes int64 `json:"forwarded_bytes"`
+}
+
+// eventTypeStatistics counts the events received from the message bus and forwarded to the output by type. Counting
+// is on the path of every event, so each type's counters are updated atomically rather than under a lock.
+type eventTypeStatistics struct {
+	counters sync.Map
+
+	// the counters at the last rollup, and when it was
+	lastRollup   map[string]EventTypeCounters
+	lastRollupAt time.Time
+	sync.Mutex
+}
+
+var eventTypeStats = newEventTypeStatistics(time.Now())
+
+func newEventTypeStatistics(now time.Time) *eventTypeStatistics {
+	return &eventTypeStatistics{lastRollup: make(map[string]EventTypeCounters), lastRollupAt: now}
+}
+
+func eventTypeOf(msg map[string]interface{}) string {
+	if eventType, ok := msg["type"].(string); ok && len(eventType) > 0 {
+		return eventType
+	}
+	return "unknown"
+}
+
+func (s *eventTypeStatistics) counter(eventType string) *EventTypeCounters {
+	if c, ok := s.counters.Load(eventType); ok {
+		return c.(*EventTypeCounters)
+	}
+	c, _ := s.counters.LoadOrStore(eventType, &EventTypeCounters{})
+	return c.(*EventTypeCounters)
+}
+
+// Received counts an event received from the message bus.
+func (s *eventTypeStatistics) Received(msg map[string]interface{}) {
+	atomic.AddInt64(&s.counter(eventTypeOf(msg)).Received, 1)
+}
+
+// Forwarded counts an event queued for the output, as size bytes; the forwarder's own events aren't counted.
+func (s *eventTypeStatistics) Forwarded(msg map[string]interface{}, size int) {
+	eventType := eventTypeOf(msg)
+	if strings.HasPrefix(eventType, "cb-event-forwarder.") {
+		return
+	}
+	c := s.counter(eventType)
+	atomic.AddInt64(&c.Forwarded, 1)
+	atomic.AddInt64(&c.ForwardedBytes, int64(size))
+}
+
+// snapshot returns the counters of every type seen so far.
+func (s *eventTypeStatistics) snapshot() map[string]EventTypeCounters {
+	snapshot := make(map[string]EventTypeCounters)
+	s.counters.Range(func(key, val interface{}) bool {
+		c := val.(*EventTypeCounters)
+		snapshot[key.(string)] = EventTypeCounters{
+			Received:       atomic.LoadInt64(&c.Received),
+			Forwarded:      atomic.LoadInt64(&c.Forwarded),
+			ForwardedBytes: atomic.LoadInt64(&c.ForwardedBytes),
+		}
+		return true
+	})
+	return snapshot
+}
+
+func (s *eventTypeStatistics) Statistics() interface{} {
+	return s.snapshot()
+}
+
+// rollup returns a statistics event for each type with events since the last rollup, in order of type. Each is a
+// flat record, so that it can be read from LEEF as well as JSON, and charted in the SIEM by event_type:
+//
+//	{"type": "cb-event-forwarder.stats", "event_type": "ingress.event.netconn", "interval": 300, "received": 150000,
+//	 "forwarded": 149820, "forwarded_bytes": 98234112, "events_per_second": 499.4, ...}
+func (s *eventTypeStatistics) rollup(now time.Time) []map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+
+	snapshot := s.snapshot()
+	interval := now.Sub(s.lastRollupAt).Seconds()
+	hostname, _ := os.Hostname()
+
+	eventTypes := make([]string, 0, len(snapshot))
+	for eventType := range snapshot {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+
+	var events []map[string]interface{}
+	for _, eventType := range eventTypes {
+		current, last := snapshot[eventType], s.lastRollup[eventType]
+		received, forwarded := current.Received-last.Received, current.Forwarded-last.Forwarded
+		if received == 0 && forwarded == 0 {
+			continue
+		}
+
+		msg := map[string]interface{}{
+			"type":               statsEventType,
+			"timestamp":          now.Unix(),
+			"interval":           int64(interval),
+			"event_type":         eventType,
+			"received":           received,
+			"forwarded":          forwarded,
+			"forwarded_bytes":    current.ForwardedBytes - last.ForwardedBytes,
+			"forwarder_hostname": hostname,
+		}
+		if interval > 0 {
+			msg["events_per_second"] = math.Round(float64(forwarded)/interval*100) / 100
+		}
+		events = append(events, msg)
+	}
+
+	s.lastRollup, s.lastRollupAt = snapshot, now
+	return events
+}
+
+// sendStatsRollups sends the statistics events every interval until ctx is cancelled: to file if it is set, or else
+// to the output, like heartbeats, without going through the script or filters.
+func sendStatsRollups(ctx context.Context, interval time.Duration, file *auditLog) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, msg := range eventTypeStats.rollup(now) {
+				if err := sendStatsEvent(ctx, msg, file); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Printf("Could not send statistics event: %s", err)
+					break
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func sendStatsEvent(ctx context.Context, msg map[string]interface{}, file *auditLog) error {
+	if file == nil {
+		return outputMessage(ctx, msg)
+	}
+
+	msg["cb_server"] = config.ServerName
+	outmsg, err := formatMessage(msg, time.Now())
+	if err != nil {
+		return err
+	}
+	return file.Write(outmsg)
+}
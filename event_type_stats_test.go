@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventTypeStatisticsRollup(t *testing.T) {
+	start := time.Now()
+	stats := newEventTypeStatistics(start)
+
+	netconn := map[string]interface{}{"type": "ingress.event.netconn"}
+	procstart := map[string]interface{}{"type": "ingress.event.procstart"}
+	for i := 0; i < 30; i++ {
+		stats.Received(netconn)
+		stats.Forwarded(netconn, 100)
+	}
+	stats.Received(procstart)
+	stats.Forwarded(map[string]interface{}{"type": heartbeatEventType}, 50)
+
+	events := stats.rollup(start.Add(time.Minute))
+	if len(events) != 2 {
+		t.Fatalf("Expected statistics for two event types, got %v", events)
+	}
+	first, second := events[0], events[1]
+	if first["type"] != statsEventType || first["event_type"] != "ingress.event.netconn" ||
+		first["received"] != int64(30) || first["forwarded"] != int64(30) || first["forwarded_bytes"] != int64(3000) ||
+		first["interval"] != int64(60) || first["events_per_second"] != 0.5 {
+		t.Errorf("Unexpected netconn statistics %v", first)
+	}
+	if second["event_type"] != "ingress.event.procstart" || second["received"] != int64(1) ||
+		second["forwarded"] != int64(0) {
+		t.Errorf("Unexpected procstart statistics %v", second)
+	}
+
+	// each rollup covers only its interval
+	stats.Received(netconn)
+	stats.Forwarded(netconn, 100)
+	events = stats.rollup(start.Add(2 * time.Minute))
+	if len(events) != 1 || events[0]["received"] != int64(1) || events[0]["forwarded_bytes"] != int64(100) {
+		t.Errorf("Expected one netconn event in the second rollup, got %v", events)
+	}
+	if len(stats.rollup(start.Add(3*time.Minute))) != 0 {
+		t.Error("Expected no statistics without events")
+	}
+
+	totals := stats.Statistics().(map[string]EventTypeCounters)
+	if totals["ingress.event.netconn"].Forwarded != 31 {
+		t.Errorf("Expected the totals to count every event, got %+v", totals)
+	}
+	if _, ok := totals[heartbeatEventType]; ok {
+		t.Error("Expected the forwarder's own events not to be counted")
+	}
+}
+
+func TestStatsRollupFile(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OutputFormat = JSONOutputFormat
+	config.ServerName = "cbtest"
+
+	fn := filepath.Join(t.TempDir(), "stats.json")
+	file, err := newAuditLog(fn, 1, statsRollupFileMaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := map[string]interface{}{"type": statsEventType, "event_type": "alert.watchlist.hit.process", "received": 2}
+	if err := sendStatsEvent(context.Background(), msg, file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	contents, _ := ioutil.ReadFile(fn)
+	var written map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(string(contents))), &written); err != nil {
+		t.Fatal(err)
+	}
+	if written["event_type"] != "alert.watchlist.hit.process" || written["cb_server"] != "cbtest" {
+		t.Errorf("Unexpected statistics record %v", written)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/carbonblack/cb-event-forwarder/deepcopy"
+)
+
+// explodeMessages splits each message containing one of the configured array-valued fields into one message per
+// array element. The remaining keys of the message (the "parent" metadata) are copied into each new message, and
+// the array itself is replaced by the single element. Watchlist and feed hits carry their payload inside a single
+// element "docs" array (see ProcessJSONMessage), so the configured fields are also searched for within that document.
+func explodeMessages(msgs []map[string]interface{}, fields []string) []map[string]interface{} {
+	if len(fields) == 0 {
+		return msgs
+	}
+
+	for _, field := range fields {
+		exploded := make([]map[string]interface{}, 0, len(msgs))
+		for _, msg := range msgs {
+			exploded = append(exploded, explodeField(msg, field)...)
+		}
+		msgs = exploded
+	}
+
+	return msgs
+}
+
+func explodeField(msg map[string]interface{}, field string) []map[string]interface{} {
+	if items, ok := msg[field].([]interface{}); ok && len(items) > 0 {
+		msgs := make([]map[string]interface{}, 0, len(items))
+		for i, item := range items {
+			newMsg := deepcopy.Iface(withoutKey(msg, field)).(map[string]interface{})
+			newMsg[field] = deepcopy.Iface(item)
+			newMsg[field+"_index"] = i
+			newMsg[field+"_count"] = len(items)
+			msgs = append(msgs, newMsg)
+		}
+		return msgs
+	}
+
+	docs, ok := msg["docs"].([]map[string]interface{})
+	if !ok || len(docs) != 1 {
+		return []map[string]interface{}{msg}
+	}
+
+	items, ok := docs[0][field].([]interface{})
+	if !ok || len(items) == 0 {
+		return []map[string]interface{}{msg}
+	}
+
+	msgs := make([]map[string]interface{}, 0, len(items))
+	for i, item := range items {
+		newMsg := deepcopy.Iface(withoutKey(msg, "docs")).(map[string]interface{})
+		newDoc := deepcopy.Iface(withoutKey(docs[0], field)).(map[string]interface{})
+		newDoc[field] = deepcopy.Iface(item)
+		newDoc[field+"_index"] = i
+		newDoc[field+"_count"] = len(items)
+		newMsg["docs"] = []map[string]interface{}{newDoc}
+		msgs = append(msgs, newMsg)
+	}
+	return msgs
+}
+
+// withoutKey returns a shallow copy of msg with key removed, so the array being exploded isn't deep copied once per
+// element.
+func withoutKey(msg map[string]interface{}, key string) map[string]interface{} {
+	ret := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		if k != key {
+			ret[k] = v
+		}
+	}
+	return ret
+}
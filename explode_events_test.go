@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestExplodeMessages(t *testing.T) {
+	exampleJsonInput := `{"server_name":"cbtest","docs":[{"md5":"6403B9CB0267A6EAB6950DEA178C6121","observed_filename":["c:\\windows\\syswow64\\wmploc.dll","c:\\windows\\system32\\wmploc.dll"],"host_count":1}],"watchlist_id":3,"watchlist_name":"Newly Loaded Modules","other_hostnames":["host1","host2","host3"]}`
+
+	var msg map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(exampleJsonInput)))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&msg); err != nil {
+		t.Error("Could not unmarshal test input")
+		return
+	}
+
+	msgs, err := ProcessJSONMessage(msg, "watchlist.hit.binary")
+	if err != nil {
+		t.Errorf("Error processing message: %s", err)
+		return
+	}
+
+	msgs = explodeMessages(msgs, []string{"other_hostnames", "observed_filename"})
+	if len(msgs) != 6 {
+		t.Errorf("Expected 6 exploded messages, got %d", len(msgs))
+		return
+	}
+
+	for i, msg := range msgs {
+		if msg["watchlist_name"] != "Newly Loaded Modules" {
+			t.Errorf("Message %d is missing the parent metadata: %v", i, msg)
+		}
+		if _, ok := msg["other_hostnames"].(string); !ok {
+			t.Errorf("Message %d other_hostnames was not exploded: %v", i, msg["other_hostnames"])
+		}
+
+		docs := msg["docs"].([]map[string]interface{})
+		if _, ok := docs[0]["observed_filename"].(string); !ok {
+			t.Errorf("Message %d observed_filename was not exploded: %v", i, docs[0]["observed_filename"])
+		}
+		if docs[0]["observed_filename_count"] != 2 {
+			t.Errorf("Message %d has wrong observed_filename_count: %v", i, docs[0]["observed_filename_count"])
+		}
+	}
+
+	if _, err := json.Marshal(msgs); err != nil {
+		t.Errorf("Could not marshal exploded messages: %s", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldTransforms holds the declarative transformations from the [transform] section of the configuration file.
+// They are applied to each event before it is handed to the output formatter, in the following order:
+// renames, then value maps, then type coercions. Value maps and coercions refer to the field names *after* renaming.
+type FieldTransforms struct {
+	Renames   []FieldRename
+	ValueMaps map[string]map[string]string
+	Coercions map[string]string
+}
+
+type FieldRename struct {
+	From string
+	To   string
+}
+
+var validCoercions = map[string]bool{
+	"string": true,
+	"int":    true,
+	"float":  true,
+	"bool":   true,
+}
+
+func (t *FieldTransforms) Empty() bool {
+	return len(t.Renames) == 0 && len(t.ValueMaps) == 0 && len(t.Coercions) == 0
+}
+
+// parseFieldTransforms reads the [transform] section. Keys take the form rename.<field>, map.<field> or
+// coerce.<field>; see the example configuration file for the format of each value.
+func parseFieldTransforms(section ini.Section, errs *ConfigurationError) FieldTransforms {
+	t := FieldTransforms{
+		ValueMaps: make(map[string]map[string]string),
+		Coercions: make(map[string]string),
+	}
+
+	// sort the keys so renames are applied in a predictable order
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		val := section[key]
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid transform key '%s': should look like (rename|map|coerce).(field)", key))
+			continue
+		}
+
+		field := parts[1]
+		switch parts[0] {
+		case "rename":
+			if len(val) == 0 {
+				errs.addErrorString(fmt.Sprintf("Missing new field name for transform %s", key))
+				continue
+			}
+			t.Renames = append(t.Renames, FieldRename{From: field, To: val})
+		case "map":
+			mapping := make(map[string]string)
+			for _, pair := range strings.Split(val, ",") {
+				kv := strings.SplitN(pair, ":", 2)
+				if len(kv) != 2 {
+					errs.addErrorString(fmt.Sprintf("Invalid value mapping '%s' for transform %s: should look like (value):(replacement)",
+						pair, key))
+					continue
+				}
+				mapping[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+			t.ValueMaps[field] = mapping
+		case "coerce":
+			val = strings.ToLower(val)
+			if !validCoercions[val] {
+				errs.addErrorString(fmt.Sprintf("Unknown type '%s' for transform %s: valid types are string, int, float, bool",
+					val, key))
+				continue
+			}
+			t.Coercions[field] = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown transform '%s' in key %s: valid transforms are rename, map, coerce",
+				parts[0], key))
+		}
+	}
+
+	return t
+}
+
+// Apply performs the configured transformations on msg in place. Fields that can't be coerced to the requested type
+// are left unchanged.
+func (t *FieldTransforms) Apply(msg map[string]interface{}) {
+	for _, rename := range t.Renames {
+		forEachContainer(msg, rename.From, func(container map[string]interface{}) {
+			container[rename.To] = container[rename.From]
+			delete(container, rename.From)
+		})
+	}
+
+	for field, mapping := range t.ValueMaps {
+		forEachContainer(msg, field, func(container map[string]interface{}) {
+			if replacement, ok := mapping[fmt.Sprintf("%v", container[field])]; ok {
+				container[field] = replacement
+			}
+		})
+	}
+
+	for field, typeName := range t.Coercions {
+		forEachContainer(msg, field, func(container map[string]interface{}) {
+			if coerced, err := coerceValue(container[field], typeName); err == nil {
+				container[field] = coerced
+			}
+		})
+	}
+}
+
+// forEachContainer calls fn for the event itself and for each entry in "docs" that contain the given field.
+func forEachContainer(msg map[string]interface{}, field string, fn func(map[string]interface{})) {
+	if _, ok := msg[field]; ok {
+		fn(msg)
+	}
+
+	if docs, ok := msg["docs"].([]map[string]interface{}); ok {
+		for _, doc := range docs {
+			if _, ok := doc[field]; ok {
+				fn(doc)
+			}
+		}
+	}
+}
+
+func coerceValue(value interface{}, typeName string) (interface{}, error) {
+	s := fmt.Sprintf("%v", value)
+
+	switch typeName {
+	case "string":
+		return s, nil
+	case "int":
+		if f, ok := value.(float64); ok {
+			return int64(f), nil
+		}
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return int64(f), nil
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		if n, ok := value.(json.Number); ok {
+			return n.String() != "0", nil
+		}
+		return strconv.ParseBool(s)
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown type %s", typeName))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/vaughan0/go-ini"
+	"strings"
+	"testing"
+)
+
+func TestFieldTransforms(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[transform]
+rename.computer_name=hostname
+map.protocol=6:tcp,17:udp
+coerce.port=string
+coerce.pid=int
+`))
+	if err != nil {
+		t.Fatalf("Could not parse test configuration: %s", err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	transforms := parseFieldTransforms(input.Section("transform"), &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %s", errs)
+	}
+
+	msg := map[string]interface{}{
+		"computer_name": "WIN-IA9NQ1GN8OI",
+		"protocol":      int32(6),
+		"port":          uint16(443),
+		"pid":           json.Number("3876"),
+		"docs": []map[string]interface{}{
+			{"computer_name": "JASON-WIN81-VM", "protocol": json.Number("17")},
+		},
+	}
+	transforms.Apply(msg)
+
+	if _, ok := msg["computer_name"]; ok {
+		t.Errorf("computer_name was not renamed")
+	}
+	if msg["hostname"] != "WIN-IA9NQ1GN8OI" {
+		t.Errorf("Expected hostname WIN-IA9NQ1GN8OI, got %v", msg["hostname"])
+	}
+	if msg["protocol"] != "tcp" {
+		t.Errorf("Expected protocol tcp, got %v", msg["protocol"])
+	}
+	if msg["port"] != "443" {
+		t.Errorf("Expected port to be coerced to the string 443, got %#v", msg["port"])
+	}
+	if msg["pid"] != int64(3876) {
+		t.Errorf("Expected pid to be coerced to int64 3876, got %#v", msg["pid"])
+	}
+
+	doc := msg["docs"].([]map[string]interface{})[0]
+	if doc["hostname"] != "JASON-WIN81-VM" || doc["protocol"] != "udp" {
+		t.Errorf("Transforms were not applied to docs: %v", doc)
+	}
+}
+
+func TestFieldTransformErrors(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[transform]
+coerce.port=datetime
+map.protocol=6
+frobnicate.pid=1
+`))
+	if err != nil {
+		t.Fatalf("Could not parse test configuration: %s", err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	parseFieldTransforms(input.Section("transform"), &errs)
+	if len(errs.Errors) != 3 {
+		t.Errorf("Expected 3 configuration errors, got %d: %s", len(errs.Errors), errs)
+	}
+}
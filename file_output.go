@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -18,19 +20,48 @@ type FileOutput struct {
 	fileOpenedAt   time.Time
 
 	lastRolledOver time.Time
+	loop           *outputLoop
+
+	// when to sync written data to disk; see fileSyncPolicy
+	syncPolicy    fileSyncPolicy
+	unsyncedBytes int64
+	lastSync      time.Time
+
+	// partial lines removed from the end of the file, left behind by a crash or a failed write
+	truncations    int64
+	truncatedBytes int64
+
 	sync.RWMutex
 }
 
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         FileOutputType,
+		ParameterKey: "outfile",
+		StatusType:   "file",
+		WritesFiles:  true,
+		Location:     func(connString string) string { return connString },
+		Factory:      func() OutputHandler { return &FileOutput{} },
+	})
+}
+
 type FileStatistics struct {
-	LastOpenTime time.Time `json:"last_open_time"`
-	FileName     string    `json:"file_name"`
+	LastOpenTime   time.Time `json:"last_open_time"`
+	FileName       string    `json:"file_name"`
+	Truncations    int64     `json:"partial_lines_truncated"`
+	TruncatedBytes int64     `json:"truncated_bytes"`
 }
 
 func (o *FileOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return FileStatistics{LastOpenTime: o.fileOpenedAt, FileName: o.outputFileName}
+	return FileStatistics{
+		LastOpenTime:   o.fileOpenedAt,
+		FileName:       o.outputFileName,
+		Truncations:    o.truncations,
+		TruncatedBytes: o.truncatedBytes,
+	}
 }
 
 func (o *FileOutput) Key() string {
@@ -49,6 +80,18 @@ func (o *FileOutput) Initialize(fileName string) error {
 	o.fileOpenedAt = time.Time{}
 	o.lastRolledOver = time.Time{}
 
+	// every event is written as a complete line, so a file that doesn't end in a newline was being written when
+	// the forwarder crashed
+	trimmed, err := trimPartialLine(fileName)
+	if err != nil {
+		return err
+	}
+	if trimmed > 0 {
+		log.Printf("Removed a partial line of %d bytes from the end of %s", trimmed, fileName)
+		o.truncations++
+		o.truncatedBytes += trimmed
+	}
+
 	fp, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return err
@@ -57,11 +100,13 @@ func (o *FileOutput) Initialize(fileName string) error {
 	o.outputFile = fp
 	o.fileOpenedAt = time.Now()
 	o.lastRolledOver = time.Now()
+	o.unsyncedBytes = 0
+	o.lastSync = time.Now()
 
 	return nil
 }
 
-func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
+func (o *FileOutput) Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error {
 	if o.outputFile == nil {
 		return errors.New("No output file specified")
 	}
@@ -71,7 +116,11 @@ func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
 		return err
 	}
 
+	o.loop = newOutputLoop(ctx)
+
 	go func() {
+		defer o.loop.exited()
+
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer refreshTicker.Stop()
 
@@ -83,6 +132,12 @@ func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
 
 		for {
 			select {
+			case <-o.loop.ctx.Done():
+				if err := drainMessages(messages, o.output); err != nil {
+					log.Printf("Error writing to %s during shutdown: %s", o.outputFileName, err)
+				}
+				return
+
 			case message := <-messages:
 				if err := o.output(message); err != nil {
 					errorChan <- err
@@ -105,6 +160,14 @@ func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
 					return
 				}
 
+			case result := <-o.loop.flushes:
+				log.Println("Flush requested, Rolling over file now.")
+				_, err := o.rollOverFile("2006-01-02T15:04:05")
+				result <- err
+				if err != nil {
+					errorChan <- err
+					return
+				}
 			}
 		}
 	}()
@@ -112,6 +175,16 @@ func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
 	return nil
 }
 
+func (o *FileOutput) Shutdown() error {
+	o.loop.Shutdown()
+	o.close()
+	return nil
+}
+
+func (o *FileOutput) Flush(ctx context.Context) error {
+	return o.loop.Flush(ctx)
+}
+
 func (o *FileOutput) String() string {
 	o.RLock()
 	defer o.RUnlock()
@@ -120,12 +193,74 @@ func (o *FileOutput) String() string {
 }
 
 func (o *FileOutput) output(s string) error {
-	_, err := o.outputFile.WriteString(s + "\n")
+	n, err := o.outputFile.WriteString(s + "\n")
 	// is the error temporary? reopen the file and see...
 	if err != nil {
+		if n > 0 {
+			// don't leave part of the event in the file
+			o.truncatePartialWrite(int64(n))
+		}
 		return err
 	}
-	return nil
+	return o.syncWritten(n)
+}
+
+func (o *FileOutput) truncatePartialWrite(n int64) {
+	info, err := o.outputFile.Stat()
+	if err != nil {
+		return
+	}
+	if err := o.outputFile.Truncate(info.Size() - n); err != nil {
+		log.Printf("Could not remove a partial write of %d bytes from %s: %s", n, o.outputFileName, err)
+		return
+	}
+
+	o.Lock()
+	o.truncations++
+	o.truncatedBytes += n
+	o.Unlock()
+}
+
+// trimPartialLine truncates fileName after its last newline, returning the number of bytes removed. A missing file
+// is not an error.
+func trimPartialLine(fileName string) (int64, error) {
+	fp, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	// search backwards from the end of the file for the last complete line
+	buf := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := fp.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+
+	if end == size {
+		return 0, nil
+	}
+	return size - end, fp.Truncate(end)
 }
 
 func (o *FileOutput) rollOverFile(tf string) (string, error) {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+var tempFileSyncs = expvar.NewInt("temp_file_sync_count")
+
+// FileSyncMode controls when data written to a bundled output's temp files is synced to disk. Events that have not
+// been synced can be lost if the host crashes, but every sync costs a disk write.
+type FileSyncMode int
+
+const (
+	// leave it to the operating system to write the data out
+	SyncNever FileSyncMode = iota
+	SyncPerMessage
+	// sync once a number of bytes have been written since the last sync
+	SyncPerBytes
+	// sync at most once per interval
+	SyncPerInterval
+)
+
+var fileSyncModes = map[string]FileSyncMode{
+	"never":    SyncNever,
+	"message":  SyncPerMessage,
+	"bytes":    SyncPerBytes,
+	"interval": SyncPerInterval,
+}
+
+func parseFileSyncMode(val string) (FileSyncMode, error) {
+	mode, ok := fileSyncModes[val]
+	if !ok {
+		return SyncNever, fmt.Errorf("valid values are never, message, bytes, interval")
+	}
+	return mode, nil
+}
+
+type fileSyncPolicy struct {
+	mode     FileSyncMode
+	bytes    int64
+	interval time.Duration
+}
+
+// syncWritten records n bytes written to the file and syncs it if the policy says so.
+func (o *FileOutput) syncWritten(n int) error {
+	o.unsyncedBytes += int64(n)
+
+	switch o.syncPolicy.mode {
+	case SyncPerMessage:
+		return o.sync()
+	case SyncPerBytes:
+		if o.unsyncedBytes >= o.syncPolicy.bytes {
+			return o.sync()
+		}
+	case SyncPerInterval:
+		return o.syncIfDue(time.Now())
+	}
+	return nil
+}
+
+// syncIfDue syncs data left unsynced for the policy's interval; it is also called periodically, so that the last
+// events before a quiet period are synced too.
+func (o *FileOutput) syncIfDue(now time.Time) error {
+	if o.syncPolicy.mode != SyncPerInterval || o.unsyncedBytes == 0 || now.Sub(o.lastSync) < o.syncPolicy.interval {
+		return nil
+	}
+	return o.sync()
+}
+
+func (o *FileOutput) sync() error {
+	if o.unsyncedBytes == 0 {
+		return nil
+	}
+	if err := o.outputFile.Sync(); err != nil {
+		return err
+	}
+	tempFileSyncs.Add(1)
+	o.unsyncedBytes = 0
+	o.lastSync = time.Now()
+	return nil
+}
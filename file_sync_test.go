@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileOutputSyncPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := &FileOutput{syncPolicy: fileSyncPolicy{mode: SyncPerBytes, bytes: 10}}
+	if err := output.Initialize(filepath.Join(dir, "event-forwarder")); err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+
+	syncs := tempFileSyncs.Value()
+	output.output("abcd")
+	if tempFileSyncs.Value() != syncs || output.unsyncedBytes != 5 {
+		t.Errorf("Synced before reaching the limit (%d bytes unsynced)", output.unsyncedBytes)
+	}
+	output.output("efghi")
+	if tempFileSyncs.Value() != syncs+1 || output.unsyncedBytes != 0 {
+		t.Errorf("Not synced after reaching the limit (%d bytes unsynced)", output.unsyncedBytes)
+	}
+
+	output.syncPolicy = fileSyncPolicy{mode: SyncPerInterval, interval: time.Minute}
+	output.output("abcd")
+	if err := output.syncIfDue(time.Now()); err != nil || output.unsyncedBytes == 0 {
+		t.Errorf("Synced before the interval passed")
+	}
+	if err := output.syncIfDue(time.Now().Add(time.Minute)); err != nil || output.unsyncedBytes != 0 {
+		t.Errorf("Not synced after the interval passed")
+	}
+}
+
+func TestParseFileSyncMode(t *testing.T) {
+	if mode, err := parseFileSyncMode("interval"); err != nil || mode != SyncPerInterval {
+		t.Errorf("Expected interval, got %v (%v)", mode, err)
+	}
+	if _, err := parseFileSyncMode("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+)
+
+// fipsCipherSuites are the TLS 1.2 cipher suites allowed in FIPS mode: ECDHE key exchange with AES-GCM.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+type FIPSStatus struct {
+	Enabled         bool   `json:"fips_mode"`
+	CryptoModule    string `json:"crypto_module"`
+	ModuleValidated bool   `json:"module_validated"`
+	Compliant       bool   `json:"compliant"`
+}
+
+// fipsMode reports whether cryptography is restricted to FIPS-approved algorithms: when fips_mode is set, and always
+// in builds using a validated crypto module.
+func fipsMode() bool {
+	return config.FIPSMode || cryptoModuleValidated()
+}
+
+// fipsStatus is published on the status page. The forwarder is only compliant when a validated module does the
+// cryptography; fips_mode on its own restricts the algorithms used, but not their implementation.
+func fipsStatus() interface{} {
+	return FIPSStatus{
+		Enabled:         fipsMode(),
+		CryptoModule:    cryptoModule,
+		ModuleValidated: cryptoModuleValidated(),
+		Compliant:       fipsMode() && cryptoModuleValidated(),
+	}
+}
+
+// restrictTLSConfig limits tlsConfig to TLS 1.2 with FIPS-approved cipher suites and curves, if in FIPS mode. TLS 1.3
+// is excluded because its cipher suites can't be configured, and include ChaCha20-Poly1305.
+func restrictTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	if !fipsMode() {
+		return tlsConfig
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+	tlsConfig.MaxVersion = tls.VersionTLS12
+	tlsConfig.CipherSuites = fipsCipherSuites
+	tlsConfig.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	return tlsConfig
+}
+
+// fipsSSHConfig limits SSH connections (to SFTP servers) to FIPS-approved key exchanges, ciphers and MACs.
+func fipsSSHConfig() ssh.Config {
+	return ssh.Config{
+		KeyExchanges: []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "diffie-hellman-group14-sha256"},
+		Ciphers:      []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr"},
+		MACs:         []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512"},
+	}
+}
+
+// checkFIPSSigningKey rejects keys FIPS mode doesn't allow for signatures: Ed25519 keys, RSA keys of fewer than 2048
+// bits and ECDSA keys on curves other than P-256, P-384 and P-521.
+func checkFIPSSigningKey(signer crypto.Signer) error {
+	if !fipsMode() {
+		return nil
+	}
+	switch key := signer.Public().(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA keys must be at least 2048 bits in FIPS mode, not %d", key.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return fmt.Errorf("ECDSA keys must use P-256, P-384 or P-521 in FIPS mode, not %s", key.Curve.Params().Name)
+		}
+	default:
+		return errors.New("only RSA and ECDSA keys can be used in FIPS mode")
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+	// restricts crypto/tls to FIPS-approved settings, whatever the tls.Config asks for
+	_ "crypto/tls/fipsonly"
+)
+
+// Built with GOEXPERIMENT=boringcrypto and -tags boringcrypto (make build-fips), cryptography is done by BoringCrypto,
+// a FIPS 140 validated module.
+const cryptoModule = "BoringCrypto"
+
+func cryptoModuleValidated() bool {
+	return boring.Enabled()
+}
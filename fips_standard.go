@@ -0,0 +1,10 @@
+//go:build !boringcrypto
+
+package main
+
+const cryptoModule = "Go"
+
+// cryptoModuleValidated reports whether cryptography is done by a FIPS 140 validated module; see fips_boring.go.
+func cryptoModuleValidated() bool {
+	return false
+}
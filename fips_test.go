@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestFIPSMode(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	config.FIPSMode = false
+	if !cryptoModuleValidated() {
+		if tlsConfig := restrictTLSConfig(&tls.Config{}); tlsConfig.MaxVersion != 0 || tlsConfig.CipherSuites != nil {
+			t.Errorf("TLS was restricted outside FIPS mode: %+v", tlsConfig)
+		}
+	}
+
+	config.FIPSMode = true
+	tlsConfig := restrictTLSConfig(&tls.Config{})
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.MaxVersion != tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 only, got versions %x to %x", tlsConfig.MinVersion, tlsConfig.MaxVersion)
+	}
+	for _, suite := range tlsConfig.CipherSuites {
+		if name := tls.CipherSuiteName(suite); name != "" && !strings.Contains(name, "_GCM_") {
+			t.Errorf("Cipher suite %s is not FIPS-approved", name)
+		}
+	}
+	if status := fipsStatus().(FIPSStatus); !status.Enabled || status.Compliant != cryptoModuleValidated() {
+		t.Errorf("Unexpected FIPS status %+v", status)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkFIPSSigningKey(edKey) == nil {
+		t.Error("Ed25519 key was accepted in FIPS mode")
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFIPSSigningKey(ecKey); err != nil {
+		t.Errorf("P-256 key was rejected in FIPS mode: %s", err)
+	}
+}
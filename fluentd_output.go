@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FluentdOutput sends events to a Fluentd or Fluent Bit aggregator with the forward protocol, in batches of up to
+// batchSize events as Forward mode messages. With requireAck, each batch is sent again until the aggregator
+// acknowledges it, so events wait in the forwarder (holding up processing) rather than being lost while the
+// aggregator is down or falling behind. See https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+type FluentdOutput struct {
+	address    string
+	tag        string
+	requireAck bool
+	ackTimeout time.Duration
+	batchSize  int
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	connectTime   time.Time
+	reconnectTime time.Time
+	connected     bool
+
+	sentEvents    int64
+	sentBatches   int64
+	droppedEvents int64
+	retries       int64
+	lastError     string
+
+	loop *outputLoop
+	sync.RWMutex
+}
+
+type FluentdStatistics struct {
+	LastOpenTime  time.Time `json:"last_open_time"`
+	Address       string    `json:"address"`
+	Tag           string    `json:"tag"`
+	RequireAck    bool      `json:"require_ack"`
+	Connected     bool      `json:"connected"`
+	SentEvents    int64     `json:"sent_events"`
+	SentBatches   int64     `json:"sent_batches"`
+	DroppedEvents int64     `json:"dropped_event_count"`
+	Retries       int64     `json:"retries"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         FluentdOutputType,
+		ParameterKey: "fluentdout",
+		StatusType:   "fluentd",
+		Factory:      func() OutputHandler { return &FluentdOutput{} },
+	})
+}
+
+// Initialize expects the aggregator's (hostname/IP):(port), for example fluentd.example.com:24224. The options in
+// the [fluentd] section are read from the configuration.
+func (o *FluentdOutput) Initialize(address string) error {
+	o.address = address
+	o.tag = config.FluentdTag
+	o.requireAck = config.FluentdRequireAck
+	o.ackTimeout = config.FluentdAckTimeout
+	if o.ackTimeout <= 0 {
+		o.ackTimeout = 30 * time.Second
+	}
+	o.batchSize = config.FluentdBatchSize
+	if o.batchSize <= 0 {
+		o.batchSize = 100
+	}
+	return o.connect(context.Background())
+}
+
+func (o *FluentdOutput) connect(ctx context.Context) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.conn.Close()
+		o.connected = false
+	}
+
+	conn, err := dialContext(ctx, "tcp", o.address)
+	if err != nil {
+		return fmt.Errorf("Error connecting to '%s': %s", o.address, err)
+	}
+	o.conn, o.reader = conn, bufio.NewReader(conn)
+	o.connected = true
+	o.connectTime = time.Now()
+	log.Printf("Connected to Fluentd at %s.", o.address)
+	return nil
+}
+
+func (o *FluentdOutput) closeAndScheduleReconnection(err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.conn.Close()
+		o.connected = false
+	}
+	o.lastError = err.Error()
+	o.reconnectTime = time.Now().Add(5 * time.Second)
+	log.Printf("Lost connection to Fluentd at %s: %s. Will try to reconnect at %s.", o.address, err, o.reconnectTime)
+}
+
+func (o *FluentdOutput) Key() string {
+	return o.String()
+}
+
+func (o *FluentdOutput) String() string {
+	return "Fluentd " + o.address
+}
+
+func (o *FluentdOutput) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return FluentdStatistics{
+		LastOpenTime:  o.connectTime,
+		Address:       o.address,
+		Tag:           o.tag,
+		RequireAck:    o.requireAck,
+		Connected:     o.connected,
+		SentEvents:    o.sentEvents,
+		SentBatches:   o.sentBatches,
+		DroppedEvents: o.droppedEvents,
+		Retries:       o.retries,
+		LastError:     o.lastError,
+	}
+}
+
+func (o *FluentdOutput) Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error {
+	if o.conn == nil {
+		return errors.New("Fluentd connection not open")
+	}
+
+	o.loop = newOutputLoop(ctx)
+
+	go func() {
+		// don't let a batch waiting for an unresponsive aggregator hold up shutdown indefinitely
+		<-o.loop.ctx.Done()
+
+		o.RLock()
+		defer o.RUnlock()
+		if o.connected {
+			o.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		}
+	}()
+
+	go func() {
+		defer o.loop.exited()
+
+		for {
+			select {
+			case <-o.loop.ctx.Done():
+				// each batch is tried once, rather than until it is acknowledged
+				batch := o.collect(messages, nil)
+				for len(batch) > 0 {
+					if err := o.send(batch); err != nil {
+						o.dropped(len(batch) + len(messages))
+						log.Printf("Error writing to %s during shutdown: %s", o.String(), err)
+						return
+					}
+					batch = o.collect(messages, nil)
+				}
+				return
+
+			case message := <-messages:
+				if err := o.deliver(o.collect(messages, []string{message})); err != nil {
+					errorChan <- err
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// collect adds the events waiting in messages to batch, up to batchSize.
+func (o *FluentdOutput) collect(messages <-chan string, batch []string) []string {
+	for len(batch) < o.batchSize {
+		select {
+		case message := <-messages:
+			batch = append(batch, message)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// deliver sends batch, reconnecting as needed. Without requireAck, a batch that can't be sent is dropped; with it,
+// the batch is sent until it is acknowledged, or the output is stopped.
+func (o *FluentdOutput) deliver(batch []string) error {
+	for {
+		o.RLock()
+		connected, reconnectTime := o.connected, o.reconnectTime
+		o.RUnlock()
+
+		var err error
+		if !connected {
+			if !o.requireAck && time.Now().Before(reconnectTime) {
+				o.dropped(len(batch))
+				return nil
+			}
+			select {
+			case <-time.After(time.Until(reconnectTime)):
+			case <-o.loop.ctx.Done():
+				o.dropped(len(batch))
+				return o.loop.ctx.Err()
+			}
+			if err = o.connect(o.loop.ctx); err != nil {
+				o.closeAndScheduleReconnection(err)
+				if !o.requireAck {
+					o.dropped(len(batch))
+					return err
+				}
+				continue
+			}
+		}
+
+		if err = o.send(batch); err == nil {
+			return nil
+		}
+		if !o.requireAck {
+			o.dropped(len(batch))
+			return err
+		}
+
+		o.Lock()
+		o.retries++
+		o.Unlock()
+		if o.loop.ctx.Err() != nil {
+			o.dropped(len(batch))
+			return err
+		}
+	}
+}
+
+func (o *FluentdOutput) dropped(events int) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.droppedEvents += int64(events)
+}
+
+// send writes batch as one Forward mode message, [tag, [[time, record], ...], options], and waits for its
+// acknowledgement if requireAck is set.
+func (o *FluentdOutput) send(batch []string) error {
+	o.RLock()
+	conn, reader, connected := o.conn, o.reader, o.connected
+	o.RUnlock()
+	if !connected {
+		return errors.New("not connected")
+	}
+
+	options := map[string]interface{}{"size": len(batch)}
+	var chunk string
+	if o.requireAck {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		options["chunk"] = chunk
+	}
+
+	b := appendMsgpackArrayHeader(nil, 3)
+	b = appendMsgpackString(b, o.tag)
+	b = appendMsgpackArrayHeader(b, len(batch))
+	now := time.Now()
+	for _, message := range batch {
+		record, eventTime := fluentdRecord(message, now)
+		b = appendMsgpackArrayHeader(b, 2)
+		b = appendMsgpackInt(b, eventTime)
+		b = appendMsgpack(b, record)
+	}
+	b = appendMsgpack(b, options)
+
+	conn.SetDeadline(time.Now().Add(o.ackTimeout))
+	_, err := conn.Write(b)
+	if err == nil && o.requireAck {
+		err = o.readAck(reader, chunk)
+	}
+	if err != nil {
+		o.closeAndScheduleReconnection(err)
+		return err
+	}
+
+	o.Lock()
+	o.sentEvents += int64(len(batch))
+	o.sentBatches++
+	o.Unlock()
+	return nil
+}
+
+func (o *FluentdOutput) readAck(reader *bufio.Reader, chunk string) error {
+	response, err := readMsgpack(reader)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement: %s", err)
+	}
+	if m, ok := response.(map[string]interface{}); !ok || m["ack"] != chunk {
+		return fmt.Errorf("unexpected acknowledgement %v", response)
+	}
+	return nil
+}
+
+// fluentdRecord returns the record for a formatted event, and its time in seconds since the epoch. JSON events are
+// sent as their fields, and timed by their timestamp field; LEEF events are sent as {"message": <event>}.
+func fluentdRecord(message string, now time.Time) (map[string]interface{}, int64) {
+	var record map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(message)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&record); err != nil {
+		return map[string]interface{}{"message": message}, now.Unix()
+	}
+
+	if timestamp, ok := record["timestamp"].(json.Number); ok {
+		if seconds, err := strconv.ParseFloat(timestamp.String(), 64); err == nil {
+			if seconds > 1e11 {
+				// milliseconds
+				seconds /= 1000
+			}
+			return record, int64(seconds)
+		}
+	}
+	return record, now.Unix()
+}
+
+func (o *FluentdOutput) Shutdown() error {
+	o.loop.Shutdown()
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.connected = false
+		return o.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// testFluentd accepts forward protocol messages, acknowledging them if asked to, and passes them on to messages.
+func testFluentd(t *testing.T, listener net.Listener, messages chan<- []interface{}) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		message, err := readMsgpack(r)
+		if err != nil {
+			return
+		}
+		forward, ok := message.([]interface{})
+		if !ok || len(forward) != 3 {
+			t.Errorf("Expected a Forward mode message, got %v", message)
+			return
+		}
+		if chunk, ok := forward[2].(map[string]interface{})["chunk"]; ok {
+			conn.Write(appendMsgpack(nil, map[string]interface{}{"ack": chunk}))
+		}
+		messages <- forward
+	}
+}
+
+func TestFluentdOutput(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.FluentdTag = "cb.test"
+	config.FluentdRequireAck = true
+	config.FluentdBatchSize = 10
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []interface{}, 10)
+	go testFluentd(t, listener, received)
+
+	output := &FluentdOutput{}
+	if err := output.Initialize(listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 10)
+	messages <- `{"type":"ingress.event.procstart","process_pid":1234,"timestamp":1700000000,"cmdline":"cmd.exe"}`
+	messages <- "LEEF:1.0|CB|CB|5.1|ingress.event.netconn|cb_server=cbserver"
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	var entries []interface{}
+	for len(entries) < 2 {
+		select {
+		case forward := <-received:
+			if forward[0] != "cb.test" {
+				t.Errorf("Expected tag cb.test, got %v", forward[0])
+			}
+			entries = append(entries, forward[1].([]interface{})...)
+		case err := <-errors:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d events were received", len(entries))
+		}
+	}
+
+	first := entries[0].([]interface{})
+	record := first[1].(map[string]interface{})
+	if first[0] != int64(1700000000) || record["process_pid"] != int64(1234) || record["cmdline"] != "cmd.exe" {
+		t.Errorf("Unexpected entry for the JSON event: %v", first)
+	}
+	second := entries[1].([]interface{})
+	if record := second[1].(map[string]interface{}); record["message"] == nil {
+		t.Errorf("Unexpected entry for the LEEF event: %v", second)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for output.Statistics().(FluentdStatistics).SentEvents != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Acknowledged events were not counted: %+v", output.Statistics())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/jlaffaye/ftp"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// FTPSBehavior uploads bundles to an FTP server over explicit TLS (AUTH TLS, with the data connections protected
+// too). Each bundle is uploaded to a temporary name next to its remote path and renamed into place once the server
+// holds all of it. An upload that fails part way leaves the temporary file behind, and the next attempt resumes it
+// from where it stopped (REST), rather than sending the whole bundle again over what is often a slow link.
+type FTPSBehavior struct {
+	address  string
+	host     string
+	user     string
+	hostname string
+
+	tlsConfig *tls.Config
+
+	resumedUploads int64
+	resumedBytes   int64
+	sync.RWMutex
+}
+
+type FTPSStatistics struct {
+	Address        string `json:"address"`
+	User           string `json:"user"`
+	RemotePath     string `json:"remote_path"`
+	ResumedUploads int64  `json:"resumed_uploads"`
+	ResumedBytes   int64  `json:"resumed_bytes"`
+}
+
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         FTPSOutputType,
+		ParameterKey: "ftpsout",
+		StatusType:   "ftps",
+		WritesFiles:  true,
+		Location:     ftpsHoldingArea,
+		Factory:      func() OutputHandler { return NewBundledOutput(&FTPSBehavior{}) },
+	})
+}
+
+// ftpsHoldingArea returns the temp-file-directory of an ftpsout connection string.
+func ftpsHoldingArea(connString string) string {
+	tempFileDirectory, _ := splitTempFileDirectory(connString, "ftps")
+	return tempFileDirectory
+}
+
+// Initialize expects ftps://user@host[:port], optionally preceded by (temp-file-directory): to hold bundles
+// somewhere other than /var/cb/data/event-forwarder until they are uploaded. The password and the other options in
+// the [ftps] section are read from the configuration.
+func (o *FTPSBehavior) Initialize(connString string) (string, error) {
+	tempFileDirectory, location := splitTempFileDirectory(connString, "ftps")
+
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "ftps" || len(u.Hostname()) == 0 || u.User == nil || len(u.User.Username()) == 0 {
+		return "", fmt.Errorf("Invalid connection string: '%s' should look like "+
+			"(temp-file-directory):ftps://(user)@(host):(port)", connString)
+	}
+	o.user = u.User.Username()
+	o.host = u.Hostname()
+	o.address = u.Host
+	if len(u.Port()) == 0 {
+		o.address = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	if o.hostname, err = os.Hostname(); err != nil {
+		return "", err
+	}
+	if o.tlsConfig, err = o.newTLSConfig(); err != nil {
+		return "", err
+	}
+
+	// check the server and credentials now, rather than on the first upload
+	conn, err := o.connect(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("Could not connect to %s: %w", o.address, err)
+	}
+	conn.Quit()
+	return tempFileDirectory, nil
+}
+
+func (o *FTPSBehavior) newTLSConfig() (*tls.Config, error) {
+	tlsConfig := restrictTLSConfig(&tls.Config{
+		ServerName: o.host,
+		// many servers insist that the data connections resume the control connection's TLS session
+		ClientSessionCache: tls.NewLRUClientSessionCache(16),
+	})
+
+	if !config.FTPSTLSVerify {
+		log.Printf("Disabling TLS verification for FTPS output at %s", o.address)
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if len(config.FTPSClientCert) > 0 && len(config.FTPSClientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(config.FTPSClientCert, config.FTPSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(config.FTPSCACert) > 0 {
+		caCert, err := ioutil.ReadFile(config.FTPSCACert)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = caCertPool
+	}
+	return tlsConfig, nil
+}
+
+func (o *FTPSBehavior) connect(ctx context.Context) (*ftp.ServerConn, error) {
+	address, err := resolveAddress(ctx, o.address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ftp.Dial(address,
+		ftp.DialWithContext(ctx),
+		ftp.DialWithTimeout(config.FTPSTimeout),
+		ftp.DialWithShutTimeout(config.FTPSTimeout),
+		ftp.DialWithExplicitTLS(o.tlsConfig.Clone()))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Login(o.user, config.FTPSPassword); err != nil {
+		conn.Quit()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (o *FTPSBehavior) Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus {
+	conn, err := o.connect(ctx)
+	if err != nil {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+	defer conn.Quit()
+
+	// the FTP client only takes a context for dialing: quitting abandons a command, and the reader stops the data
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Quit()
+		case <-done:
+		}
+	}()
+
+	err = o.upload(ctx, conn, fileName, fp)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return UploadStatus{fileName: fileName, result: err}
+}
+
+func (o *FTPSBehavior) upload(ctx context.Context, conn *ftp.ServerConn, fileName string, fp *os.File) error {
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	remotePath := renderRemotePath(config.FTPSRemotePath, bundleUploadName(fileName), bundleNameFields{
+		Hostname:  o.hostname,
+		Tenant:    config.ServerName,
+		Timestamp: time.Now(),
+	})
+	tmpPath := path.Join(path.Dir(remotePath), "."+path.Base(remotePath)+".part")
+	if err := makeFTPDirs(conn, path.Dir(remotePath)); err != nil {
+		return err
+	}
+
+	// resume what an earlier attempt left behind, if the server can
+	offset := int64(0)
+	if config.FTPSResume {
+		if size, err := conn.FileSize(tmpPath); err == nil && size > 0 && size <= info.Size() {
+			offset = size
+		}
+	}
+	if offset > 0 {
+		if _, err := fp.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if err = conn.StorFrom(tmpPath, contextReader{ctx, fp}, uint64(offset)); err != nil && isFTPPermanent(err) {
+			// the server doesn't support resuming uploads (REST); start again
+			log.Printf("Could not resume the upload of %s to %s: %s", fileName, o.address, err)
+			offset = 0
+		} else if err != nil {
+			return err
+		} else {
+			o.Lock()
+			o.resumedUploads++
+			o.resumedBytes += offset
+			o.Unlock()
+		}
+	}
+	if offset == 0 {
+		if _, err := fp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := conn.Stor(tmpPath, contextReader{ctx, fp}); err != nil {
+			return err
+		}
+	}
+
+	size, err := conn.FileSize(tmpPath)
+	if err != nil {
+		return err
+	}
+	if size != info.Size() {
+		// a bad resume; start from scratch next time
+		conn.Delete(tmpPath)
+		return fmt.Errorf("%s holds %d bytes rather than %d", tmpPath, size, info.Size())
+	}
+
+	// some servers won't rename over an existing file, left by an earlier upload whose result wasn't known
+	conn.Delete(remotePath)
+	return conn.Rename(tmpPath, remotePath)
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// makeFTPDirs creates dir and its parents, as MKD doesn't.
+func makeFTPDirs(conn *ftp.ServerConn, dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	if err := makeFTPDirs(conn, path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := conn.MakeDir(dir); err != nil {
+		// it may already exist; the upload will fail if it doesn't
+		if !isFTPPermanent(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isFTPPermanent reports whether err is a 5xx reply from the server, rather than a failure of the connection.
+func isFTPPermanent(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
+
+// ClassifyError treats a refused login (430, 530, 532) as an auth error, a server out of space (452, 552) as
+// throttled, so that it is retried more slowly, and the other transient (4xx) replies as network errors.
+func (o *FTPSBehavior) ClassifyError(err error) UploadErrorCategory {
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return UploadErrorAuth
+	}
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return UploadErrorUnknown
+	}
+
+	switch protoErr.Code {
+	case ftp.StatusInvalidCredentials, ftp.StatusNotLoggedIn, ftp.StatusStorNeedAccount:
+		return UploadErrorAuth
+	case ftp.Status452, ftp.StatusExceededStorage:
+		return UploadErrorThrottled
+	}
+	if protoErr.Code/100 == 4 {
+		return UploadErrorNetwork
+	}
+	return UploadErrorUnknown
+}
+
+func (o *FTPSBehavior) Key() string {
+	return fmt.Sprintf("%s@%s", o.user, o.address)
+}
+
+func (o *FTPSBehavior) String() string {
+	return "FTPS " + o.Key()
+}
+
+func (o *FTPSBehavior) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return FTPSStatistics{
+		Address:        o.address,
+		User:           o.user,
+		RemotePath:     config.FTPSRemotePath,
+		ResumedUploads: o.resumedUploads,
+		ResumedBytes:   o.resumedBytes,
+	}
+}
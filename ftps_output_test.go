@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFTPSServer serves FTP with explicit TLS from root to cbforwarder, until the listener is closed. It implements
+// just the commands the FTPS output uses.
+func testFTPSServer(t *testing.T, listener net.Listener, tlsConfig *tls.Config, password, root string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go testFTPSSession(t, conn, tlsConfig, password, root)
+	}
+}
+
+func testFTPSSession(t *testing.T, conn net.Conn, tlsConfig *tls.Config, password, root string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	local := func(name string) string {
+		return filepath.Join(root, filepath.FromSlash(name))
+	}
+
+	var data chan net.Conn
+	var offset int64
+	var renameFrom string
+	reply("220 ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+		command, arg := strings.ToUpper(parts[0]), ""
+		if len(parts) == 2 {
+			arg = parts[1]
+		}
+
+		switch command {
+		case "AUTH":
+			reply("234 AUTH TLS ok")
+			conn = tls.Server(conn, tlsConfig)
+			reader = bufio.NewReader(conn)
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			if arg != password {
+				reply("530 login incorrect")
+			} else {
+				reply("230 logged in")
+			}
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n REST STREAM\r\n211 End")
+		case "TYPE", "PBSZ", "PROT":
+			reply("200 ok")
+		case "EPSV":
+			dataListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data = make(chan net.Conn, 1)
+			go func(data chan net.Conn) {
+				defer dataListener.Close()
+				if conn, err := dataListener.Accept(); err == nil {
+					data <- tls.Server(conn, tlsConfig)
+				}
+			}(data)
+			reply("229 Entering Extended Passive Mode (|||%d|)", dataListener.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", offset)
+		case "STOR":
+			reply("150 ok")
+			dataConn := <-data
+			flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if offset > 0 {
+				flags = os.O_WRONLY
+			}
+			fp, err := os.OpenFile(local(arg), flags, 0644)
+			if err == nil {
+				fp.Seek(offset, io.SeekStart)
+				_, err = io.Copy(fp, dataConn)
+				fp.Close()
+			}
+			dataConn.Close()
+			offset = 0
+			if err != nil {
+				reply("451 %s", err)
+			} else {
+				reply("226 transfer complete")
+			}
+		case "SIZE":
+			if info, err := os.Stat(local(arg)); err != nil {
+				reply("550 no such file")
+			} else {
+				reply("213 %d", info.Size())
+			}
+		case "MKD":
+			if err := os.Mkdir(local(arg), 0755); err != nil {
+				reply("550 %s", err)
+			} else {
+				reply("257 \"%s\" created", arg)
+			}
+		case "DELE":
+			if err := os.Remove(local(arg)); err != nil {
+				reply("550 no such file")
+			} else {
+				reply("250 deleted")
+			}
+		case "RNFR":
+			renameFrom = arg
+			reply("350 ready for RNTO")
+		case "RNTO":
+			if err := os.Rename(local(renameFrom), local(arg)); err != nil {
+				reply("550 %s", err)
+			} else {
+				reply("250 renamed")
+			}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// testFTPSCertificate returns a self-signed certificate for 127.0.0.1, and the certificate in PEM format.
+func testFTPSCertificate(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestFTPSBehaviorUpload(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.Mkdir(root, 0755)
+	cert, certPEM := testFTPSCertificate(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go testFTPSServer(t, listener, &tls.Config{Certificates: []tls.Certificate{cert}}, "secret", root)
+
+	config.FTPSPassword = "secret"
+	config.FTPSCACert = filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(config.FTPSCACert, certPEM, 0644)
+	config.FTPSTLSVerify = true
+	config.FTPSRemotePath = "incoming/{tenant}/{name}"
+	config.FTPSTimeout = 10 * time.Second
+	config.FTPSResume = true
+	config.ServerName = "cbserver"
+
+	holdingArea := filepath.Join(dir, "holding")
+	os.Mkdir(holdingArea, 0755)
+	behavior := &FTPSBehavior{}
+	if _, err := behavior.Initialize(holdingArea + ":ftps://cbforwarder@" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(holdingArea, "event-forwarder.2026-10-14T12:00:00")
+	contents := strings.Repeat("{\"type\":\"ingress.event.procstart\"}\n", 100)
+	ioutil.WriteFile(fileName, []byte(contents), 0644)
+	upload := func() {
+		fp, err := os.Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		if status := behavior.Upload(context.Background(), fileName, fp); status.result != nil {
+			t.Fatal(status.result)
+		}
+	}
+	upload()
+
+	remoteDir := filepath.Join(root, "incoming", "cbserver")
+	uploaded, err := ioutil.ReadFile(filepath.Join(remoteDir, "event-forwarder.2026-10-14T12:00:00"))
+	if err != nil || string(uploaded) != contents {
+		t.Errorf("Expected the bundle on the server, got %d bytes (%v)", len(uploaded), err)
+	}
+
+	// an interrupted upload is resumed from what reached the server
+	os.Remove(filepath.Join(remoteDir, "event-forwarder.2026-10-14T12:00:00"))
+	ioutil.WriteFile(filepath.Join(remoteDir, ".event-forwarder.2026-10-14T12:00:00.part"), []byte(contents[:1000]),
+		0644)
+	upload()
+
+	uploaded, err = ioutil.ReadFile(filepath.Join(remoteDir, "event-forwarder.2026-10-14T12:00:00"))
+	if err != nil || string(uploaded) != contents {
+		t.Errorf("Expected the resumed bundle on the server, got %d bytes (%v)", len(uploaded), err)
+	}
+	if infos, _ := ioutil.ReadDir(remoteDir); len(infos) != 1 {
+		t.Errorf("Expected only the bundle on the server, found %d files", len(infos))
+	}
+	if stats := behavior.Statistics().(FTPSStatistics); stats.ResumedUploads != 1 || stats.ResumedBytes != 1000 {
+		t.Errorf("Expected one upload resumed from 1000 bytes, got %d from %d", stats.ResumedUploads,
+			stats.ResumedBytes)
+	}
+
+	// a wrong password is an auth error
+	config.FTPSPassword = "wrong"
+	_, err = (&FTPSBehavior{}).Initialize("ftps://cbforwarder@" + listener.Addr().String())
+	if err == nil {
+		t.Fatal("Expected a wrong password to be refused")
+	}
+	if category := behavior.ClassifyError(err); category != UploadErrorAuth {
+		t.Errorf("Expected a wrong password to be an auth error, got %s", category)
+	}
+
+	// as is a certificate that doesn't verify
+	_, otherPEM := testFTPSCertificate(t)
+	ioutil.WriteFile(config.FTPSCACert, otherPEM, 0644)
+	config.FTPSPassword = "secret"
+	_, err = (&FTPSBehavior{}).Initialize("ftps://cbforwarder@" + listener.Addr().String())
+	if err == nil {
+		t.Fatal("Expected an untrusted certificate to be refused")
+	}
+	if category := behavior.ClassifyError(err); category != UploadErrorAuth {
+		t.Errorf("Expected an untrusted certificate to be an auth error, got %s (%s)", category, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// glueBatchSize is the most partitions Glue creates in one BatchCreatePartition call.
+const glueBatchSize = 100
+
+// GluePartitionStatistics is shown in the S3 output's status as glue.
+type GluePartitionStatistics struct {
+	Database      string    `json:"database"`
+	Table         string    `json:"table"`
+	Registered    int64     `json:"partitions_registered"`
+	Pending       int       `json:"partitions_pending"`
+	LastErrorTime time.Time `json:"last_error_time,omitempty"`
+	LastErrorText string    `json:"last_error_text,omitempty"`
+}
+
+// s3PartitionValues returns the values of the partition keys dt and hour of the partition of now, as uploaded with
+// partition_keys.
+func s3PartitionValues(now time.Time) []string {
+	now = now.UTC()
+	return []string{now.Format("2006-01-02"), now.Format("15")}
+}
+
+// s3PartitionPath returns the Hive-style path of a partition, as in dt=2006-01-02/hour=15.
+func s3PartitionPath(values []string) string {
+	return "dt=" + values[0] + "/hour=" + values[1]
+}
+
+// gluePartitions registers the partitions the S3 output uploads to with partition_keys in a table of the AWS Glue
+// Data Catalog, as set with [s3] glue_database and glue_table, so that Athena and other Hive metastore clients query
+// new data as soon as it is uploaded, without waiting for a crawler or MSCK REPAIR TABLE. The table has to be
+// partitioned by dt and hour, both strings; the partitions take the table's storage descriptor - its format and
+// SerDe - with the location of the partition. Each partition is registered after the first bundle of it is uploaded;
+// partitions that could not be registered, whatever the reason, are tried again, in batches, with the next upload.
+type gluePartitions struct {
+	client    glueiface.GlueAPI
+	catalogID *string
+	database  string
+	table     string
+	// the location of the keys the partitions are in, as in s3://bucket/prefix/
+	location string
+
+	// the table's, once it has been read
+	storage *glue.StorageDescriptor
+	// the paths of the partitions registered (or found registered) since the forwarder started, and of the partitions
+	// to register with their values
+	registered map[string]bool
+	pending    map[string][]string
+	stats      GluePartitionStatistics
+	sync.Mutex
+}
+
+func newGluePartitions(client glueiface.GlueAPI, catalogID, database, table, location string) *gluePartitions {
+	p := &gluePartitions{
+		client:     client,
+		database:   database,
+		table:      table,
+		location:   location,
+		registered: make(map[string]bool),
+		pending:    make(map[string][]string),
+		stats:      GluePartitionStatistics{Database: database, Table: table},
+	}
+	if len(catalogID) > 0 {
+		p.catalogID = aws.String(catalogID)
+	}
+	return p
+}
+
+// newGlueClient connects to AWS Glue in region, with the credentials in [s3] credential_profile if it is set.
+func newGlueClient(region string) *glue.Glue {
+	awsConfig := &aws.Config{Region: aws.String(region), HTTPClient: &http.Client{Transport: httpTransport()}}
+	if fipsMode() {
+		awsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if config.S3CredentialProfileName != nil {
+		awsConfig.Credentials = s3Credentials(*config.S3CredentialProfileName)
+	}
+	return glue.New(session.New(awsConfig))
+}
+
+// add registers the partition with values, with any partitions still waiting to be, unless it is registered already.
+func (p *gluePartitions) add(ctx context.Context, values []string) {
+	p.Lock()
+	defer p.Unlock()
+
+	partition := s3PartitionPath(values)
+	if p.registered[partition] {
+		return
+	}
+	p.pending[partition] = values
+	if err := p.register(ctx); err != nil {
+		log.Printf("WARNING: Could not register partitions of %s.%s in the Glue Data Catalog: %s; they are tried "+
+			"again with the next upload", p.database, p.table, err)
+		p.stats.LastErrorTime, p.stats.LastErrorText = time.Now(), err.Error()
+	}
+}
+
+func (p *gluePartitions) register(ctx context.Context) error {
+	if p.storage == nil {
+		table, err := p.client.GetTableWithContext(ctx, &glue.GetTableInput{
+			CatalogId:    p.catalogID,
+			DatabaseName: aws.String(p.database),
+			Name:         aws.String(p.table),
+		})
+		if err != nil {
+			return err
+		}
+		if table.Table == nil || table.Table.StorageDescriptor == nil {
+			return errors.New("the table has no storage descriptor")
+		}
+		p.storage = table.Table.StorageDescriptor
+	}
+
+	partitions := make([]string, 0, len(p.pending))
+	for partition := range p.pending {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+
+	var failures []string
+	for len(partitions) > 0 {
+		batch := partitions
+		if len(batch) > glueBatchSize {
+			batch = batch[:glueBatchSize]
+		}
+		partitions = partitions[len(batch):]
+
+		inputs := make([]*glue.PartitionInput, 0, len(batch))
+		for _, partition := range batch {
+			storage := *p.storage
+			storage.Location = aws.String(p.location + partition + "/")
+			inputs = append(inputs, &glue.PartitionInput{
+				Values:            aws.StringSlice(p.pending[partition]),
+				StorageDescriptor: &storage,
+			})
+		}
+		out, err := p.client.BatchCreatePartitionWithContext(ctx, &glue.BatchCreatePartitionInput{
+			CatalogId:          p.catalogID,
+			DatabaseName:       aws.String(p.database),
+			TableName:          aws.String(p.table),
+			PartitionInputList: inputs,
+		})
+		if err != nil {
+			return err
+		}
+
+		failed := make(map[string]bool)
+		for _, e := range out.Errors {
+			var code, message string
+			if e.ErrorDetail != nil {
+				code, message = aws.StringValue(e.ErrorDetail.ErrorCode), aws.StringValue(e.ErrorDetail.ErrorMessage)
+			}
+			// a partition registered by a crawler, another forwarder or an earlier run is as good as new
+			if code == glue.ErrCodeAlreadyExistsException {
+				continue
+			}
+			values := aws.StringValueSlice(e.PartitionValues)
+			if len(values) != 2 {
+				return fmt.Errorf("unexpected error for partition %v: %s %s", values, code, message)
+			}
+			partition := s3PartitionPath(values)
+			failed[partition] = true
+			failures = append(failures, fmt.Sprintf("%s: %s %s", partition, code, message))
+		}
+		for _, partition := range batch {
+			if !failed[partition] {
+				delete(p.pending, partition)
+				p.registered[partition] = true
+				p.stats.Registered++
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (p *gluePartitions) Statistics() GluePartitionStatistics {
+	p.Lock()
+	defer p.Unlock()
+	stats := p.stats
+	stats.Pending = len(p.pending)
+	return stats
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGlue records the partitions created; those with a value in fail are refused.
+type testGlue struct {
+	glueiface.GlueAPI
+	down    bool
+	fail    map[string]bool
+	exists  map[string]bool
+	batches [][]string
+}
+
+func (g *testGlue) GetTableWithContext(ctx aws.Context, input *glue.GetTableInput,
+	opts ...request.Option) (*glue.GetTableOutput, error) {
+	if g.down {
+		return nil, errors.New("service unavailable")
+	}
+	return &glue.GetTableOutput{Table: &glue.TableData{StorageDescriptor: &glue.StorageDescriptor{
+		InputFormat: aws.String("org.apache.hadoop.mapred.TextInputFormat"),
+		Location:    aws.String("s3://cb-events/events/"),
+	}}}, nil
+}
+
+func (g *testGlue) BatchCreatePartitionWithContext(ctx aws.Context, input *glue.BatchCreatePartitionInput,
+	opts ...request.Option) (*glue.BatchCreatePartitionOutput, error) {
+	out := &glue.BatchCreatePartitionOutput{}
+	var batch []string
+	for _, partition := range input.PartitionInputList {
+		values := aws.StringValueSlice(partition.Values)
+		batch = append(batch, aws.StringValue(partition.StorageDescriptor.Location))
+		code := ""
+		if g.fail[values[1]] {
+			code = glue.ErrCodeInternalServiceException
+		} else if g.exists[values[1]] {
+			code = glue.ErrCodeAlreadyExistsException
+		}
+		if len(code) > 0 {
+			out.Errors = append(out.Errors, &glue.PartitionError{
+				PartitionValues: partition.Values,
+				ErrorDetail:     &glue.ErrorDetail{ErrorCode: aws.String(code), ErrorMessage: aws.String("refused")},
+			})
+		}
+	}
+	g.batches = append(g.batches, batch)
+	return out, nil
+}
+
+func TestGluePartitions(t *testing.T) {
+	client := &testGlue{down: true, fail: map[string]bool{"02": true}, exists: map[string]bool{"03": true}}
+	p := newGluePartitions(client, "", "security", "cb_events", "s3://cb-events/events/")
+	day := time.Date(2017, 1, 1, 0, 30, 0, 0, time.UTC)
+
+	// partitions are kept until the table can be read
+	p.add(context.Background(), s3PartitionValues(day))
+	if stats := p.Statistics(); stats.Pending != 1 || len(stats.LastErrorText) == 0 {
+		t.Errorf("Expected the partition to be pending, got %+v", stats)
+	}
+
+	// then registered together
+	client.down = false
+	p.add(context.Background(), s3PartitionValues(day.Add(time.Hour)))
+	if len(client.batches) != 1 || strings.Join(client.batches[0], ",") !=
+		"s3://cb-events/events/dt=2017-01-01/hour=00/,s3://cb-events/events/dt=2017-01-01/hour=01/" {
+		t.Fatalf("Unexpected batches %v", client.batches)
+	}
+
+	// a partition that is refused is tried again, and one that exists already is as good as registered
+	p.add(context.Background(), s3PartitionValues(day.Add(2*time.Hour)))
+	p.add(context.Background(), s3PartitionValues(day.Add(3*time.Hour)))
+	if stats := p.Statistics(); stats.Pending != 1 || stats.Registered != 3 ||
+		!strings.Contains(stats.LastErrorText, "dt=2017-01-01/hour=02: InternalServiceException refused") {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+	if len(client.batches) != 3 || len(client.batches[2]) != 2 {
+		t.Errorf("Expected the refused partition to be tried again with the next, got %v", client.batches)
+	}
+
+	// partitions registered aren't registered again
+	p.add(context.Background(), s3PartitionValues(day))
+	if len(client.batches) != 3 {
+		t.Errorf("Expected no more batches, got %v", client.batches)
+	}
+}
+
+func TestS3PartitionedObjectKey(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	prefix := "events"
+	config.S3ObjectPrefix = &prefix
+	config.S3PartitionKeys = true
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "event-forwarder.2017-01-01T14:55:00")
+	ioutil.WriteFile(fileName, []byte(testBundleEvent), 0600)
+	completed := time.Date(2017, 1, 1, 15, 0, 0, 0, time.FixedZone("EST", -5*3600))
+	os.Chtimes(fileName, completed, completed)
+
+	// the signature goes to the partition of its bundle
+	o := &S3Behavior{instance: "fwd-1"}
+	for _, name := range []string{fileName, signaturePath(fileName)} {
+		key := o.objectKey(name, bundleCompleted(name, time.Now()))
+		if expected := "events/fwd-1/dt=2017-01-01/hour=20/" + filepath.Base(name); key != expected {
+			t.Errorf("Expected %s, got %s", expected, key)
+		}
+	}
+	config.S3PartitionKeys = false
+	if key := o.objectKey(fileName, completed); key != "events/fwd-1/"+filepath.Base(fileName) {
+		t.Errorf("Unexpected key without partitions %s", key)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"os"
+	"time"
+)
+
+// heartbeatEventType is the type of the events sent by sendHeartbeats. Like the self-test's events, it matches none
+// of the event types Cb Response publishes.
+const heartbeatEventType = "cb-event-forwarder.heartbeat"
+
+var heartbeatCount = expvar.NewInt("heartbeat_count")
+
+// heartbeatEvent describes the state of the forwarder at now. The counters are flat fields, so they can be read from
+// LEEF as well as JSON output.
+func heartbeatEvent(sequence int64, now time.Time) map[string]interface{} {
+	msg := map[string]interface{}{
+		"type":               heartbeatEventType,
+		"timestamp":          now.Unix(),
+		"sequence":           sequence,
+		"forwarder_version":  version,
+		"uptime":             int64(now.Sub(status.StartTime).Seconds()),
+		"input_event_count":  status.InputEventCount.Value(),
+		"output_event_count": status.OutputEventCount.Value(),
+		"error_count":        status.ErrorCount.Value(),
+		"connected":          status.IsConnected,
+		"queued_events":      len(results),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		msg["forwarder_hostname"] = hostname
+	}
+	if buffer != nil {
+		stats := buffer.Statistics().(EventBufferStatistics)
+		msg["buffered_events"] = stats.MemoryEvents
+		msg["spilled_bytes"] = stats.SpilledBytes
+	}
+	ingestRate.annotate(msg)
+	if busQueue != nil {
+		busQueue.annotate(msg)
+	}
+	if contract != nil {
+		contract.annotate(msg)
+	}
+	if clockSkewDetector != nil {
+		clockSkewDetector.annotate(msg)
+	}
+	return msg
+}
+
+// sendHeartbeats sends a heartbeat event to the output every interval until ctx is cancelled. Heartbeats skip the
+// script and filters, which could otherwise drop them, but are formatted and sent like any other event, so a SIEM
+// that stops receiving them knows the whole pipeline has stopped.
+func sendHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := outputMessage(ctx, heartbeatEvent(heartbeatCount.Value()+1, now)); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Could not send heartbeat event: %s", err)
+				continue
+			}
+			heartbeatCount.Add(1)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HoldingArea is implemented by outputs that keep files on disk until they have been uploaded. Files are identified
+// by their base name within the holding area.
+type HoldingArea interface {
+	HoldingAreaFiles() []HoldingAreaFile
+	RetryFile(name string) error
+	DeleteFile(name string) error
+}
+
+type HoldingAreaFile struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Modified    time.Time `json:"modified"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	Held        bool      `json:"held"`
+	Uploading   bool      `json:"uploading"`
+}
+
+var (
+	errHoldingAreaFileNotFound = errors.New("no such file in the holding area")
+	errUploadInProgress        = errors.New("file is being uploaded")
+)
+
+// HoldingAreaFiles lists the files waiting to be uploaded and those being uploaded, in queue order.
+func (o *BundledOutput) HoldingAreaFiles() []HoldingAreaFile {
+	o.RLock()
+	uploads := make([]queuedUpload, 0, len(o.uploadsInProgress)+len(o.filesToUpload))
+	for _, upload := range o.uploadsInProgress {
+		uploads = append(uploads, *upload)
+	}
+	inProgress := len(uploads)
+	for _, upload := range o.filesToUpload {
+		uploads = append(uploads, *upload)
+	}
+	o.RUnlock()
+
+	now := time.Now()
+	files := make([]HoldingAreaFile, 0, len(uploads))
+	for i, upload := range uploads {
+		file := HoldingAreaFile{
+			Name:        filepath.Base(upload.fileName),
+			Attempts:    upload.attempts,
+			NextAttempt: upload.nextAttempt,
+			Held:        upload.held,
+			Uploading:   i < inProgress,
+		}
+		if info, err := os.Stat(upload.fileName); err == nil {
+			file.Size = info.Size()
+			file.Modified = info.ModTime()
+			file.AgeSeconds = now.Sub(info.ModTime()).Seconds()
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// findQueued returns the position of the named file in the upload queue. The caller must hold the lock.
+func (o *BundledOutput) findQueued(name string) (int, error) {
+	for i, upload := range o.filesToUpload {
+		if filepath.Base(upload.fileName) == name {
+			return i, nil
+		}
+	}
+	for fileName := range o.uploadsInProgress {
+		if filepath.Base(fileName) == name {
+			return -1, errUploadInProgress
+		}
+	}
+	return -1, errHoldingAreaFileNotFound
+}
+
+// RetryFile makes a file due for upload immediately, including files held after an error that is not retried.
+func (o *BundledOutput) RetryFile(name string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	i, err := o.findQueued(name)
+	if err != nil {
+		return err
+	}
+	upload := o.filesToUpload[i]
+	upload.held = false
+	upload.nextAttempt = time.Time{}
+
+	// move it to the front of the queue
+	copy(o.filesToUpload[1:i+1], o.filesToUpload[:i])
+	o.filesToUpload[0] = upload
+	return nil
+}
+
+// DeleteFile removes a file that cannot be uploaded (a "poison" file) from the queue and the holding area. The events
+// in the file are lost.
+func (o *BundledOutput) DeleteFile(name string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	i, err := o.findQueued(name)
+	if err != nil {
+		return err
+	}
+	upload := o.filesToUpload[i]
+
+	if err = os.Remove(upload.fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeRetryState(upload.fileName)
+	removeSignature(upload.fileName)
+	o.filesToUpload = append(o.filesToUpload[:i], o.filesToUpload[i+1:]...)
+
+	log.Printf("Deleted %s from the holding area after %d failed upload attempts", upload.fileName, upload.attempts)
+	return nil
+}
+
+// holdingAreaHandler serves the holding area of the output under /holding_area/. A GET of /holding_area/ lists the
+// files, a POST to /holding_area/<name>/retry uploads the file as soon as possible and a DELETE of
+// /holding_area/<name> deletes it. Retries and deletes are only accepted if allowChanges is set, from requests that
+// carry token, the management API's, as an "Authorization: Bearer" header; the listing is served to anyone, like the
+// rest of the status server.
+func holdingAreaHandler(area HoldingArea, allowChanges bool, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/holding_area"), "/")
+		parts := strings.Split(path, "/")
+
+		switch {
+		case len(path) == 0 && r.Method == "GET":
+			writeJSON(w, http.StatusOK, area.HoldingAreaFiles())
+		case !allowChanges && len(path) > 0:
+			writeJSONError(w, http.StatusForbidden, errors.New("changes to the holding area are not enabled"))
+		case len(path) > 0 && (len(token) == 0 || !bearerAuthorized(r, token)):
+			writeJSONError(w, http.StatusUnauthorized, errors.New("missing or invalid API token"))
+		case len(parts) == 2 && parts[1] == "retry" && r.Method == "POST":
+			writeHoldingAreaResult(w, area.RetryFile(parts[0]))
+		case len(parts) == 1 && r.Method == "DELETE":
+			writeHoldingAreaResult(w, area.DeleteFile(parts[0]))
+		default:
+			writeJSONError(w, http.StatusNotFound, errors.New("unknown request"))
+		}
+	})
+}
+
+func writeHoldingAreaResult(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "success"})
+	case errHoldingAreaFileNotFound:
+		writeJSONError(w, http.StatusNotFound, err)
+	case errUploadInProgress:
+		writeJSONError(w, http.StatusConflict, err)
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"status": "error", "error": err.Error()})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	holdingAreaExpiredCount = expvar.NewInt("holding_area_expired_count")
+	holdingAreaExpiredBytes = expvar.NewInt("holding_area_expired_bytes")
+)
+
+// what is done with a file that has been in the holding area longer than holding_area_max_age
+const (
+	HoldingAreaExpiredArchive = "archive"
+	HoldingAreaExpiredDelete  = "delete"
+)
+
+// the subdirectory of the holding area that expired files are archived to, unless holding_area_archive_directory is
+// set
+const expiredDirectory = "expired"
+
+// how often the holding area is checked for expired files
+const holdingAreaExpiryInterval = time.Minute
+
+// archiveDirectory returns where expired files are archived.
+func (o *BundledOutput) archiveDirectory() string {
+	if len(config.HoldingAreaArchiveDirectory) > 0 {
+		return config.HoldingAreaArchiveDirectory
+	}
+	return filepath.Join(o.tempFileDirectory, expiredDirectory)
+}
+
+// expireFiles removes the files waiting to be uploaded that were last written more than holding_area_max_age ago,
+// deleting or archiving them. Those are files that have failed to upload for as long as anyone could want them
+// uploaded: without a limit, an output whose destination is misconfigured retries and keeps events forever, until
+// the disk fills up. Files being uploaded are left until the upload finishes. Each file expired is logged loudly and
+// counted, on the status page and in holding_area_expired_count.
+func (o *BundledOutput) expireFiles(now time.Time) {
+	if config.HoldingAreaMaxAge <= 0 || now.Sub(o.lastExpiryCheck) < holdingAreaExpiryInterval {
+		return
+	}
+	o.lastExpiryCheck = now
+
+	o.Lock()
+	defer o.Unlock()
+
+	kept := o.filesToUpload[:0]
+	for _, upload := range o.filesToUpload {
+		info, err := os.Stat(upload.fileName)
+		if err != nil || now.Sub(info.ModTime()) <= config.HoldingAreaMaxAge {
+			kept = append(kept, upload)
+			continue
+		}
+
+		age := now.Sub(info.ModTime()).Truncate(time.Second)
+		if config.HoldingAreaExpiredAction == HoldingAreaExpiredDelete {
+			if err := os.Remove(upload.fileName); err != nil && !os.IsNotExist(err) {
+				log.Printf("Could not delete expired file %s: %s", upload.fileName, err)
+				kept = append(kept, upload)
+				continue
+			}
+			removeRetryState(upload.fileName)
+			removeSignature(upload.fileName)
+			log.Printf("WARNING: %s has been in the holding area for %s, longer than holding_area_max_age, after %d "+
+				"failed upload attempts; deleted it. The events in it are lost.", upload.fileName, age, upload.attempts)
+		} else {
+			destination, err := moveBundle(upload.fileName, o.archiveDirectory())
+			if err != nil {
+				log.Printf("Could not archive expired file %s: %s", upload.fileName, err)
+				kept = append(kept, upload)
+				continue
+			}
+			log.Printf("WARNING: %s has been in the holding area for %s, longer than holding_area_max_age, after %d "+
+				"failed upload attempts; moved it to %s. It will not be uploaded.", upload.fileName, age,
+				upload.attempts, destination)
+		}
+
+		atomic.AddInt64(&o.filesExpired, 1)
+		holdingAreaExpiredCount.Add(1)
+		holdingAreaExpiredBytes.Add(info.Size())
+	}
+	o.filesToUpload = kept
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpireFiles(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	old, recent := "event-forwarder.2026-08-01T00:00:00", "event-forwarder.2026-10-14T00:00:00"
+	output, dir := newHoldingAreaTestOutput(t, old, recent)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	os.Chtimes(filepath.Join(dir, old), now.Add(-60*24*time.Hour), now.Add(-60*24*time.Hour))
+	ioutil.WriteFile(signaturePath(filepath.Join(dir, old)), []byte("signature"), 0600)
+
+	// nothing is expired without a maximum age
+	config.HoldingAreaMaxAge = 0
+	output.expireFiles(now)
+	if len(output.filesToUpload) != 2 {
+		t.Fatalf("Expected both files to be kept, got %d", len(output.filesToUpload))
+	}
+
+	config.HoldingAreaMaxAge = 30 * 24 * time.Hour
+	config.HoldingAreaExpiredAction = HoldingAreaExpiredArchive
+	config.HoldingAreaArchiveDirectory = ""
+	output.expireFiles(now)
+	if len(output.filesToUpload) != 1 || output.filesToUpload[0].fileName != filepath.Join(dir, recent) {
+		t.Fatalf("Expected only the recent file to be kept, got %d", len(output.filesToUpload))
+	}
+	archived := filepath.Join(dir, expiredDirectory, old)
+	if _, err := os.Stat(archived); err != nil {
+		t.Errorf("Expected the old file to be archived: %s", err)
+	}
+	if _, err := os.Stat(signaturePath(archived)); err != nil {
+		t.Errorf("Expected the signature to be archived with the file: %s", err)
+	}
+	if stats := output.Snapshot(); stats.FilesExpired != 1 {
+		t.Errorf("Expected 1 file expired, got %d", stats.FilesExpired)
+	}
+
+	// the holding area isn't checked again until holdingAreaExpiryInterval has passed
+	os.Chtimes(filepath.Join(dir, recent), now.Add(-60*24*time.Hour), now.Add(-60*24*time.Hour))
+	config.HoldingAreaExpiredAction = HoldingAreaExpiredDelete
+	output.expireFiles(now.Add(time.Second))
+	if len(output.filesToUpload) != 1 {
+		t.Fatalf("Expected the holding area not to be checked again yet")
+	}
+	output.expireFiles(now.Add(holdingAreaExpiryInterval))
+	if len(output.filesToUpload) != 0 {
+		t.Fatalf("Expected the second file to be expired, got %d queued", len(output.filesToUpload))
+	}
+	if _, err := os.Stat(filepath.Join(dir, recent)); !os.IsNotExist(err) {
+		t.Errorf("Expected the second file to be deleted")
+	}
+
+	// archived files aren't picked up as stragglers
+	behavior := newTestUploadBehavior(t, false)
+	os.RemoveAll(behavior.directory)
+	behavior.directory = dir
+	restarted := NewBundledOutput(behavior)
+	if err := restarted.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.filesToUpload) != 0 {
+		t.Errorf("Expected archived files to be left alone, got %d queued", len(restarted.filesToUpload))
+	}
+}
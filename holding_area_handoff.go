@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the subdirectory of the holding area that events are written to. A file is only moved into the holding area, with
+// a rename, once it has been rolled over and is complete - renamed, indexed, compressed and signed - so that
+// uploads, the holding area watch and queueStragglers only ever see whole files, and never the ones being written.
+const writingSubdirectory = "writing"
+
+func (o *BundledOutput) writingDirectory() string {
+	return filepath.Join(o.tempFileDirectory, writingSubdirectory)
+}
+
+// handOff moves a rolled-over file, with its signature, from the writing directory into the holding area to be
+// uploaded, and returns its new name.
+func (o *BundledOutput) handOff(fileName string) (string, error) {
+	return moveBundle(fileName, o.tempFileDirectory)
+}
+
+// adoptWritingDirectory prepares the writing directory when the output starts. Files a previous run rolled over but
+// had not handed off yet, because it stopped part way through, are handed off now, as compressed copies only if
+// they were compressed. The files being written by versions that wrote them in the holding area itself are moved
+// into the writing directory, to be appended to.
+func (o *BundledOutput) adoptWritingDirectory() error {
+	dir := o.writingDirectory()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	names, err := fp.Readdirnames(0)
+	fp.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fileName := filepath.Join(dir, name)
+		switch {
+		case name == bundleFileName("") || currentFamilyFile.MatchString(name) || isSignatureFile(name):
+		case strings.HasSuffix(name, indexedBundleTmpSuffix) || strings.HasSuffix(name, compressedBundleTmpSuffix):
+			// the file it was indexing or compressing is still there
+			os.Remove(fileName)
+		case hasCompressedCopy(fileName):
+			// the file was compressed, but the run stopped before removing it
+			os.Remove(fileName)
+		default:
+			if _, err := o.handOff(fileName); err != nil {
+				log.Printf("Could not move %s into the holding area: %s", fileName, err)
+			}
+		}
+	}
+	// signatures handed off with their files are gone; the rest were left by a rollover that never finished
+	for _, name := range names {
+		if isSignatureFile(name) {
+			if _, err := os.Stat(strings.TrimSuffix(filepath.Join(dir, name), signatureSuffix)); os.IsNotExist(err) {
+				os.Remove(filepath.Join(dir, name))
+			}
+		}
+	}
+
+	fp, err = os.Open(o.tempFileDirectory)
+	if err != nil {
+		return err
+	}
+	names, err = fp.Readdirnames(0)
+	fp.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name != bundleFileName("") && !currentFamilyFile.MatchString(name) {
+			continue
+		}
+		fileName, current := filepath.Join(o.tempFileDirectory, name), filepath.Join(dir, name)
+		destination := current
+		if _, err := os.Lstat(current); err == nil {
+			// both kinds of version have written this file; upload the older one as it is rather than mix them
+			destination = fileName + "." + time.Now().Format(defaultBundleTimestampLayout)
+		}
+		if err := os.Rename(fileName, destination); err != nil {
+			log.Printf("Could not move %s into %s: %s", fileName, dir, err)
+		}
+	}
+	return nil
+}
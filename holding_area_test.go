@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newHoldingAreaTestOutput(t *testing.T, names ...string) (*BundledOutput, string) {
+	behavior := newTestUploadBehavior(t, false)
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(behavior.directory, name), []byte(testBundleEvent), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	return output, behavior.directory
+}
+
+func TestHoldingAreaHandler(t *testing.T) {
+	first, second := "event-forwarder.2017-01-01T00:00:00", "event-forwarder.2017-01-01T00:05:00"
+	output, dir := newHoldingAreaTestOutput(t, first, second)
+	defer os.RemoveAll(dir)
+	output.filesToUpload[1].held = true
+
+	server := httptest.NewServer(holdingAreaHandler(output, true, "secret"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/holding_area/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []HoldingAreaFile
+	err = json.NewDecoder(resp.Body).Decode(&files)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != first || files[0].Size != int64(len(testBundleEvent)) ||
+		!files[1].Held {
+		t.Fatalf("Unexpected holding area listing: %+v", files)
+	}
+
+	// changes need the API token
+	req, _ := http.NewRequest("DELETE", server.URL+"/holding_area/"+first, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a delete without the token to return 401, got %s", resp.Status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, first)); err != nil {
+		t.Error("File was deleted without the token")
+	}
+
+	req, _ = http.NewRequest("POST", server.URL+"/holding_area/"+second+"/retry", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Retry returned %s", resp.Status)
+	}
+	if upload := output.filesToUpload[0]; upload.held || filepath.Base(upload.fileName) != second {
+		t.Errorf("Retried file should be released and moved to the front of the queue: %+v", upload)
+	}
+
+	req, _ = http.NewRequest("DELETE", server.URL+"/holding_area/"+first, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Delete returned %s", resp.Status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, first)); !os.IsNotExist(err) {
+		t.Error("Deleted file is still in the holding area")
+	}
+	if len(output.filesToUpload) != 1 {
+		t.Errorf("Deleted file is still queued: %d files queued", len(output.filesToUpload))
+	}
+
+	req, _ = http.NewRequest("DELETE", server.URL+"/holding_area/"+first, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected deleting a missing file to return 404, got %s", resp.Status)
+	}
+}
+
+func TestHoldingAreaHandlerReadOnly(t *testing.T) {
+	name := "event-forwarder.2017-01-01T00:00:00"
+	output, dir := newHoldingAreaTestOutput(t, name)
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(holdingAreaHandler(output, false, "secret"))
+	defer server.Close()
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/holding_area/"+name, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected changes to be refused, got %s", resp.Status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+		t.Error("File was deleted although changes are not allowed")
+	}
+}
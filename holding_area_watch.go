@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// how long a file dropped into the holding area must go unchanged before it is uploaded, so that a file still being
+// copied in is not uploaded half written
+const holdingAreaSettleTime = 5 * time.Second
+
+// holdingAreaWatch watches the holding area for files that the output didn't write itself: files copied in by hand,
+// or left by another forwarder process that crashed. Without it they are only found by queueStragglers when the
+// forwarder starts.
+type holdingAreaWatch struct {
+	watcher *fsnotify.Watcher
+
+	// files seen being created or written to, and when they last were
+	pending map[string]time.Time
+}
+
+func newHoldingAreaWatch(directory string) (*holdingAreaWatch, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(directory); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return &holdingAreaWatch{watcher: watcher, pending: make(map[string]time.Time)}, nil
+}
+
+// events returns the watcher's events, or nil (which never delivers) if w is nil.
+func (w *holdingAreaWatch) events() <-chan fsnotify.Event {
+	if w == nil {
+		return nil
+	}
+	return w.watcher.Events
+}
+
+func (w *holdingAreaWatch) errors() <-chan error {
+	if w == nil {
+		return nil
+	}
+	return w.watcher.Errors
+}
+
+func (w *holdingAreaWatch) close() {
+	if w != nil {
+		w.watcher.Close()
+	}
+}
+
+// noticeFile records an event for a file in the holding area.
+func (w *holdingAreaWatch) noticeFile(event fsnotify.Event, now time.Time) {
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return
+	}
+	if fn := filepath.Base(event.Name); isHoldingAreaBundle(fn) {
+		w.pending[fn] = now
+	}
+}
+
+// queueSettledFiles adds the files dropped into the holding area that have settled to the upload queue, unless the
+// output knows about them already: the files it rolls over itself are seen by the watcher too.
+func (o *BundledOutput) queueSettledFiles(now time.Time) {
+	w := o.watch
+	if w == nil {
+		return
+	}
+
+	for fn, seen := range w.pending {
+		if now.Sub(seen) < holdingAreaSettleTime {
+			continue
+		}
+		delete(w.pending, fn)
+
+		fileName := filepath.Join(o.tempFileDirectory, fn)
+		if info, err := os.Stat(fileName); err != nil || !info.Mode().IsRegular() || o.queued(fileName) {
+			continue
+		}
+		if err := checkStraggler(fileName); err != nil {
+			o.quarantine(fileName, err)
+			continue
+		}
+		log.Printf("Found %s in the holding area; queueing it for upload", fileName)
+
+		o.Lock()
+		o.filesToUpload = append(o.filesToUpload, loadRetryState(fileName))
+		o.Unlock()
+	}
+}
+
+// queued reports whether fileName is waiting to be uploaded, or being uploaded.
+func (o *BundledOutput) queued(fileName string) bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	if _, ok := o.uploadsInProgress[fileName]; ok {
+		return true
+	}
+	for _, upload := range o.filesToUpload {
+		if upload.fileName == fileName {
+			return true
+		}
+	}
+	return false
+}
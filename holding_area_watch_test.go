@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHoldingAreaWatch(t *testing.T) {
+	output, dir := newHoldingAreaTestOutput(t)
+	defer os.RemoveAll(dir)
+
+	watch, err := newHoldingAreaWatch(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.close()
+	output.watch = watch
+
+	dropped := filepath.Join(dir, "event-forwarder.2026-10-14T12:00:00")
+	ioutil.WriteFile(dropped, []byte(testBundleEvent), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a bundle\n"), 0600)
+	// a file the output is already uploading
+	uploading := filepath.Join(dir, "event-forwarder.2026-10-14T11:55:00")
+	output.uploadsInProgress[uploading] = &queuedUpload{fileName: uploading}
+	ioutil.WriteFile(uploading, []byte(testBundleEvent), 0600)
+
+	deadline := time.After(5 * time.Second)
+	for len(watch.pending) < 2 {
+		select {
+		case event := <-watch.events():
+			watch.noticeFile(event, time.Now())
+		case <-deadline:
+			t.Fatalf("Expected to see both bundles being written, saw %v", watch.pending)
+		}
+	}
+
+	// nothing is queued while the file may still be being copied in
+	output.queueSettledFiles(time.Now())
+	if len(output.filesToUpload) != 0 {
+		t.Fatalf("Expected no files queued yet, got %d", len(output.filesToUpload))
+	}
+
+	output.queueSettledFiles(time.Now().Add(holdingAreaSettleTime))
+	if len(output.filesToUpload) != 1 || output.filesToUpload[0].fileName != dropped {
+		t.Fatalf("Expected %s to be queued, got %+v", dropped, output.filesToUpload)
+	}
+	if len(watch.pending) != 0 {
+		t.Errorf("Expected no more files pending, got %v", watch.pending)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"golang.org/x/net/http/httpproxy"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	sharedTransport     *http.Transport
+	sharedTransportOnce sync.Once
+)
+
+// httpTransport returns the transport shared by the forwarder's HTTP clients, so that connections (and their TLS
+// sessions) to the same host are reused by every output and feed, rather than each keeping its own pool.
+func httpTransport() *http.Transport {
+	sharedTransportOnce.Do(func() {
+		sharedTransport = newHTTPTransport()
+	})
+	return sharedTransport
+}
+
+// newHTTPTransport returns a transport for the forwarder's HTTP clients (S3 and TAXII feeds), with
+// restrictTLSConfig applied, requests sent through the configured proxy and hosts resolved by lookupHost. Its
+// connection pool is sized by the http_* options.
+func newHTTPTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = restrictTLSConfig(&tls.Config{})
+	transport.Proxy = proxyFunc()
+
+	// a negative KeepAlive turns TCP keep-alives off
+	keepAlive := config.HTTPKeepAlive
+	if keepAlive == 0 {
+		keepAlive = -1
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialWith(ctx, &net.Dialer{Timeout: 30 * time.Second, KeepAlive: keepAlive}, network, address)
+	}
+
+	transport.MaxIdleConns = config.HTTPMaxIdleConns
+	transport.MaxIdleConnsPerHost = config.HTTPMaxIdleConnsPerHost
+	if transport.MaxIdleConnsPerHost == 0 {
+		// 0 would mean http.DefaultMaxIdleConnsPerHost
+		transport.MaxIdleConnsPerHost = math.MaxInt32
+	}
+	transport.IdleConnTimeout = config.HTTPIdleConnTimeout
+	if !config.HTTP2 {
+		// an empty (rather than nil) TLSNextProto keeps the transport from negotiating HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+// proxyFunc chooses the proxy for each request. If any of http_proxy, https_proxy or no_proxy is set in the
+// configuration, they replace the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables; otherwise those are
+// used, as they would be by default. proxy_username and proxy_password are sent to proxies whose URLs don't hold
+// credentials of their own.
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	proxy := http.ProxyFromEnvironment
+	if len(config.HTTPProxy) > 0 || len(config.HTTPSProxy) > 0 || len(config.NoProxy) > 0 {
+		choose := (&httpproxy.Config{
+			HTTPProxy:  config.HTTPProxy,
+			HTTPSProxy: config.HTTPSProxy,
+			NoProxy:    config.NoProxy,
+		}).ProxyFunc()
+		proxy = func(req *http.Request) (*url.URL, error) {
+			return choose(req.URL)
+		}
+	}
+
+	if len(config.ProxyUsername) == 0 {
+		return proxy
+	}
+	username, password := config.ProxyUsername, config.ProxyPassword
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil || proxyURL.User != nil {
+			return proxyURL, err
+		}
+		withUser := *proxyURL
+		withUser.User = url.UserPassword(username, password)
+		return &withUser, nil
+	}
+}
+
+// validProxyURL checks the value of http_proxy or https_proxy: a URL such as http://proxy.example.com:3128, or, as
+// with the environment variables, just a host and port, which is taken as an http:// URL.
+func validProxyURL(value string) bool {
+	proxyURL, err := url.Parse(value)
+	if err != nil || len(proxyURL.Scheme) == 0 || len(proxyURL.Host) == 0 {
+		proxyURL, err = url.Parse("http://" + value)
+		if err != nil || len(proxyURL.Host) == 0 {
+			return false
+		}
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+		return true
+	}
+	return false
+}
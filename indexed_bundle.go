@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// The values of bundle_format.
+const (
+	LinesBundleFormat   = "lines"
+	IndexedBundleFormat = "indexed"
+)
+
+// indexedBundleMagic starts and ends every indexed bundle.
+const indexedBundleMagic = "CBEFIDX1"
+
+// indexedBundleTrailerSize is the size of the trailer: the offset of the index, then the magic.
+const indexedBundleTrailerSize = 8 + len(indexedBundleMagic)
+
+// indexedBundleMaxEvent is the longest event record read from an indexed bundle; a longer length prefix is taken for
+// corruption, rather than allocated.
+const indexedBundleMaxEvent = 256 << 20
+
+// the suffix of a bundle being indexed, which is never uploaded
+const indexedBundleTmpSuffix = ".index.tmp"
+
+// An indexed bundle (bundle_format=indexed) holds the same formatted events as a bundle of lines, as protobuf
+// records, followed by an index of where the events of each type and minute are, so that a reader after one type or
+// time range can seek straight to its events rather than parse every line. The layout is:
+//
+//	"CBEFIDX1"
+//	for each event: its length as a varint, then a BundleEvent
+//	a varint 0, ending the events
+//	a BundleIndex
+//	the offset of the BundleIndex from the start of the file, as a little-endian uint64
+//	"CBEFIDX1"
+//
+// with the messages
+//
+//	message BundleEvent {
+//	  string type = 1;
+//	  int64 timestamp_ms = 2;   // absent if the event has no timestamp
+//	  bytes event = 3;          // the event as formatted for output_format, without the newline
+//	}
+//
+//	message BundleIndex {
+//	  repeated IndexEntry entries = 1;
+//	  uint64 events = 2;
+//	}
+//
+//	message IndexEntry {
+//	  string type = 1;
+//	  int64 minute = 2;                        // the start of the minute, in seconds; absent for untimed events
+//	  repeated uint64 offsets = 3 [packed=true]; // of the events' length prefixes, in file order
+//	}
+//
+// Index entries are sorted by type, then minute.
+type indexedBundleEvent struct {
+	Type      string
+	Timestamp int64
+	Timed     bool
+	Event     []byte
+}
+
+type indexedBundleEntry struct {
+	Type    string
+	Minute  int64
+	Timed   bool
+	Offsets []uint64
+}
+
+type indexedBundleIndex struct {
+	Entries []indexedBundleEntry
+	Events  uint64
+}
+
+// the events and index are written with the protobuf encoding of the OTLP output, and read with
+// scanProtobufFields
+
+func (e indexedBundleEvent) marshal(b []byte) []byte {
+	if len(e.Type) > 0 {
+		b = appendProtoBytes(b, 1, []byte(e.Type))
+	}
+	if e.Timed {
+		b = appendProtoVarint(b, 2, uint64(e.Timestamp))
+	}
+	return appendProtoBytes(b, 3, e.Event)
+}
+
+func (i indexedBundleIndex) marshal(b []byte) []byte {
+	var entry, offsets []byte
+	for _, e := range i.Entries {
+		entry = entry[:0]
+		if len(e.Type) > 0 {
+			entry = appendProtoBytes(entry, 1, []byte(e.Type))
+		}
+		if e.Timed {
+			entry = appendProtoVarint(entry, 2, uint64(e.Minute))
+		}
+		offsets = offsets[:0]
+		for _, offset := range e.Offsets {
+			offsets = binary.AppendUvarint(offsets, offset)
+		}
+		entry = appendProtoBytes(entry, 3, offsets)
+		b = appendProtoBytes(b, 1, entry)
+	}
+	return appendProtoVarint(b, 2, i.Events)
+}
+
+func unmarshalIndexedBundleEvent(b []byte) indexedBundleEvent {
+	var e indexedBundleEvent
+	scanProtobufFields(b, func(field, wireType int, value uint64, data []byte) {
+		switch {
+		case field == 1 && wireType == pbWireLengthDelimited:
+			e.Type = string(data)
+		case field == 2 && wireType == pbWireVarint:
+			e.Timestamp, e.Timed = int64(value), true
+		case field == 3 && wireType == pbWireLengthDelimited:
+			e.Event = data
+		}
+	})
+	return e
+}
+
+func unmarshalIndexedBundleIndex(b []byte) indexedBundleIndex {
+	var index indexedBundleIndex
+	scanProtobufFields(b, func(field, wireType int, value uint64, data []byte) {
+		switch {
+		case field == 1 && wireType == pbWireLengthDelimited:
+			var e indexedBundleEntry
+			scanProtobufFields(data, func(field, wireType int, value uint64, data []byte) {
+				switch {
+				case field == 1 && wireType == pbWireLengthDelimited:
+					e.Type = string(data)
+				case field == 2 && wireType == pbWireVarint:
+					e.Minute, e.Timed = int64(value), true
+				case field == 3 && wireType == pbWireLengthDelimited:
+					for len(data) > 0 {
+						offset, n := binary.Uvarint(data)
+						if n <= 0 {
+							return
+						}
+						e.Offsets = append(e.Offsets, offset)
+						data = data[n:]
+					}
+				}
+			})
+			index.Entries = append(index.Entries, e)
+		case field == 2 && wireType == pbWireVarint:
+			index.Events = value
+		}
+	})
+	return index
+}
+
+// writeIndexedBundle writes the events of a bundle of lines read from r to w as an indexed bundle. The type and
+// timestamp of each event are those -export reads.
+func writeIndexedBundle(r io.Reader, w io.Writer) error {
+	type entryKey struct {
+		eventType string
+		minute    int64
+		timed     bool
+	}
+	entries := make(map[entryKey]*indexedBundleEntry)
+	var index indexedBundleIndex
+
+	out := bufio.NewWriter(w)
+	offset := uint64(len(indexedBundleMagic))
+	out.WriteString(indexedBundleMagic)
+
+	in := bufio.NewReader(r)
+	var record []byte
+	for {
+		line, err := in.ReadBytes('\n')
+		if event := bytes.TrimRight(line, "\r\n"); len(event) > 0 {
+			e := indexedBundleEvent{Event: event}
+			eventType, timestamp, timed, _ := exportedEventFields(string(event))
+			e.Type, e.Timed = eventType, timed
+			key := entryKey{eventType: eventType, timed: timed}
+			if timed {
+				e.Timestamp = timestamp.UnixNano() / 1e6
+				key.minute = timestamp.Truncate(time.Minute).Unix()
+			}
+
+			entry, ok := entries[key]
+			if !ok {
+				entry = &indexedBundleEntry{Type: key.eventType, Minute: key.minute, Timed: key.timed}
+				entries[key] = entry
+			}
+			entry.Offsets = append(entry.Offsets, offset)
+			index.Events++
+
+			record = e.marshal(record[:0])
+			prefix := binary.AppendUvarint(nil, uint64(len(record)))
+			out.Write(prefix)
+			out.Write(record)
+			offset += uint64(len(prefix) + len(record))
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	out.WriteByte(0)
+	offset++
+
+	for _, entry := range entries {
+		index.Entries = append(index.Entries, *entry)
+	}
+	sort.Slice(index.Entries, func(i, j int) bool {
+		a, b := index.Entries[i], index.Entries[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Timed != b.Timed {
+			return !a.Timed
+		}
+		return a.Minute < b.Minute
+	})
+
+	out.Write(index.marshal(nil))
+	trailer := binary.LittleEndian.AppendUint64(nil, offset)
+	out.Write(append(trailer, indexedBundleMagic...))
+	return out.Flush()
+}
+
+// indexBundle converts a rolled-over bundle of lines to an indexed bundle in place. If it can't, the bundle is left
+// as it was.
+func indexBundle(fileName string) error {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := fileName + indexedBundleTmpSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeIndexedBundle(in, out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fileName)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// isIndexedBundle reports whether the file of the given size ends like an indexed bundle.
+func isIndexedBundle(r io.ReaderAt, size int64) bool {
+	if size < int64(len(indexedBundleMagic)+indexedBundleTrailerSize) {
+		return false
+	}
+	magic := make([]byte, len(indexedBundleMagic))
+	if _, err := r.ReadAt(magic, size-int64(len(magic))); err != nil {
+		return false
+	}
+	return string(magic) == indexedBundleMagic
+}
+
+// readIndexedBundleIndex reads the index of an indexed bundle of the given size.
+func readIndexedBundleIndex(r io.ReaderAt, size int64) (indexedBundleIndex, error) {
+	var index indexedBundleIndex
+	header := make([]byte, len(indexedBundleMagic))
+	trailer := make([]byte, indexedBundleTrailerSize)
+	if size < int64(len(header)+len(trailer)) {
+		return index, errors.New("the file is too short to be an indexed bundle")
+	}
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return index, err
+	}
+	if _, err := r.ReadAt(trailer, size-int64(len(trailer))); err != nil {
+		return index, err
+	}
+	if string(header) != indexedBundleMagic || string(trailer[8:]) != indexedBundleMagic {
+		return index, errors.New("the file is not an indexed bundle")
+	}
+
+	start, end := binary.LittleEndian.Uint64(trailer), uint64(size)-uint64(len(trailer))
+	if start < uint64(len(header)) || start > end {
+		return index, fmt.Errorf("the index offset %d is outside the file", start)
+	}
+	b := make([]byte, end-start)
+	if _, err := r.ReadAt(b, int64(start)); err != nil {
+		return index, err
+	}
+	return unmarshalIndexedBundleIndex(b), nil
+}
+
+// readIndexedBundleEvent reads the event whose length prefix is at offset in an indexed bundle of the given size.
+func readIndexedBundleEvent(r io.ReaderAt, size int64, offset uint64) (indexedBundleEvent, error) {
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n, err := r.ReadAt(prefix, int64(offset))
+	if err != nil && err != io.EOF {
+		return indexedBundleEvent{}, err
+	}
+	length, prefixSize := binary.Uvarint(prefix[:n])
+	if prefixSize <= 0 || length == 0 {
+		return indexedBundleEvent{}, fmt.Errorf("there is no event at offset %d", offset)
+	}
+	start := offset + uint64(prefixSize)
+	if length > indexedBundleMaxEvent || start > uint64(size) || length > uint64(size)-start {
+		return indexedBundleEvent{}, fmt.Errorf("the event at offset %d is %d bytes long, past the end of the file",
+			offset, length)
+	}
+	record := make([]byte, length)
+	if _, err := r.ReadAt(record, int64(start)); err != nil {
+		return indexedBundleEvent{}, err
+	}
+	return unmarshalIndexedBundleEvent(record), nil
+}
+
+// readIndexedBundleEvents calls fn with each event of an indexed bundle read from r, in order, without the index,
+// so that bundles can be read as a stream.
+func readIndexedBundleEvents(r *bufio.Reader, fn func(indexedBundleEvent) error) error {
+	header := make([]byte, len(indexedBundleMagic))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != indexedBundleMagic {
+		return errors.New("not an indexed bundle")
+	}
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("the events are truncated: %s", err)
+		}
+		if length == 0 {
+			return nil
+		}
+		if length > indexedBundleMaxEvent {
+			return fmt.Errorf("the events are corrupt: an event is %d bytes long", length)
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return fmt.Errorf("the events are truncated: %s", err)
+		}
+		if err := fn(unmarshalIndexedBundleEvent(record)); err != nil {
+			return err
+		}
+	}
+}
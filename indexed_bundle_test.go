@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIndexedBundle(t *testing.T) {
+	events := []string{
+		`{"type":"ingress.event.procstart","timestamp":1788270000.5,"process_path":"c:\\windows\\cmd.exe"}`,
+		`{"type":"ingress.event.netconn","timestamp":1788270001,"remote_ip":"10.1.2.3"}`,
+		`{"type":"ingress.event.netconn","timestamp":1788270090,"remote_ip":"10.1.2.4"}`,
+		"LEEF:1.0|CB|CB|5.1|alert.watchlist.hit.query.process|cb_server=cbserver\ttimestamp=1788270002",
+		`{"type":"ingress.event.netconn","remote_ip":"10.1.2.5"}`,
+	}
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "event-forwarder.2026-09-01T13:00:00")
+	if err := ioutil.WriteFile(fileName, []byte(strings.Join(events, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexBundle(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileName + indexedBundleTmpSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be gone, got %v", err)
+	}
+	if err := checkStraggler(fileName); err != nil {
+		t.Errorf("Expected an indexed bundle to pass the straggler check, got %s", err)
+	}
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := readIndexedBundleIndex(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Events != 5 || len(index.Entries) != 5 {
+		t.Fatalf("Expected 5 events in 5 index entries, got %+v", index)
+	}
+	// events without a timestamp come before the minutes of their type
+	netconn := index.Entries[2]
+	if netconn.Type != "ingress.event.netconn" || !netconn.Timed || netconn.Minute != 1788270000 ||
+		len(netconn.Offsets) != 1 || index.Entries[1].Type != netconn.Type || index.Entries[1].Timed {
+		t.Errorf("Unexpected index entries %+v", index.Entries)
+	}
+	e, err := readIndexedBundleEvent(bytes.NewReader(b), int64(len(b)), netconn.Offsets[0])
+	if err != nil || string(e.Event) != events[1] || e.Timestamp != 1788270001000 {
+		t.Errorf("Unexpected event %+v (%v)", e, err)
+	}
+
+	var read []string
+	err = readIndexedBundleEvents(bufio.NewReader(bytes.NewReader(b)), func(e indexedBundleEvent) error {
+		read = append(read, string(e.Event))
+		return nil
+	})
+	if err != nil || strings.Join(read, "\n") != strings.Join(events, "\n") {
+		t.Errorf("Expected the events in order, got %q (%v)", read, err)
+	}
+
+	filter, err := parseEventExportFilter("2026-09-01T13:40:00Z", "2026-09-01T13:41:00Z", "ingress.event.netconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	summary, err := runEventExport(dir, filter, &out)
+	if err != nil || out.String() != events[1]+"\n" || summary.Events != 5 || summary.Exported != 1 {
+		t.Errorf("Unexpected export %q %+v (%v)", out.String(), summary, err)
+	}
+
+	if err := ioutil.WriteFile(fileName, b[:len(b)-3], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStraggler(fileName); err == nil {
+		t.Errorf("Expected a truncated indexed bundle to fail the straggler check")
+	}
+
+	// a corrupt length prefix is reported rather than allocated
+	corrupt := append([]byte(indexedBundleMagic), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 1)
+	err = readIndexedBundleEvents(bufio.NewReader(bytes.NewReader(corrupt)), func(indexedBundleEvent) error {
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Expected the events to be reported corrupt, got %v", err)
+	}
+	if _, err := readIndexedBundleEvent(bytes.NewReader(corrupt), int64(len(corrupt)), 8); err == nil {
+		t.Error("Expected an event past the end of the file to be reported")
+	}
+	// an index pointing past the events of a truncated bundle
+	end := netconn.Offsets[0] + 4
+	if _, err := readIndexedBundleEvent(bytes.NewReader(b[:end]), int64(end), netconn.Offsets[0]); err == nil {
+		t.Error("Expected a truncated event to be reported")
+	}
+}
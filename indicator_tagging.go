@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var indicatorHitCount = expvar.NewInt("indicator_hit_count")
+
+// fields checked against each type of indicator
+var (
+	md5IndicatorFields    = [...]string{"md5", "parent_md5", "process_md5", "target_md5"}
+	domainIndicatorFields = [...]string{"domain", "ioc_value"}
+	ipIndicatorFields     = [...]string{"ipv4", "remote_ip", "local_ip", "comms_ip", "interface_ip", "ioc_value"}
+)
+
+// IndicatorListConfig describes where an indicator list is loaded from: either a local file or a TAXII 2.1
+// collection.
+type IndicatorListConfig struct {
+	Name       string
+	FileName   string
+	Confidence int
+
+	TAXIIURL      string
+	TAXIIUsername string
+	TAXIIPassword string
+}
+
+// IndicatorList is a named set of md5s, domains and IP addresses. Lists are replaced as a whole when reloaded, and
+// never modified once they are visible to the message processors.
+type IndicatorList struct {
+	Name       string
+	Source     string
+	Confidence int
+	LoadedAt   time.Time
+
+	MD5s    map[string]bool
+	Domains map[string]bool
+	IPs     map[string]bool
+}
+
+type IndicatorListStatistics struct {
+	Source     string    `json:"source"`
+	Confidence int       `json:"confidence"`
+	LoadedAt   time.Time `json:"loaded_at"`
+	MD5s       int       `json:"md5_count"`
+	Domains    int       `json:"domain_count"`
+	IPs        int       `json:"ip_count"`
+}
+
+// IndicatorStore holds the indicator lists matched against events. Lists loaded from files are reloaded whenever the
+// file's modification time changes.
+type IndicatorStore struct {
+	lists     map[string]*IndicatorList
+	names     []string
+	files     []IndicatorListConfig
+	fileTimes map[string]time.Time
+	feeds     []*TAXIIFeed
+
+	sync.RWMutex
+}
+
+func NewIndicatorList(name, source string, confidence int) *IndicatorList {
+	return &IndicatorList{
+		Name:       name,
+		Source:     source,
+		Confidence: confidence,
+		LoadedAt:   time.Now(),
+		MD5s:       make(map[string]bool),
+		Domains:    make(map[string]bool),
+		IPs:        make(map[string]bool),
+	}
+}
+
+// Add classifies an indicator as an md5, IP address or domain name and adds it to the list.
+func (l *IndicatorList) Add(indicator string) {
+	indicator = strings.TrimSpace(indicator)
+	switch {
+	case len(indicator) == 0:
+		return
+	case len(indicator) == 32 && isHex(indicator):
+		l.MD5s[strings.ToUpper(indicator)] = true
+	case net.ParseIP(indicator) != nil:
+		l.IPs[net.ParseIP(indicator).String()] = true
+	default:
+		l.Domains[strings.TrimSuffix(strings.ToLower(indicator), ".")] = true
+	}
+}
+
+func (l *IndicatorList) Statistics() IndicatorListStatistics {
+	return IndicatorListStatistics{
+		Source:     l.Source,
+		Confidence: l.Confidence,
+		LoadedAt:   l.LoadedAt,
+		MD5s:       len(l.MD5s),
+		Domains:    len(l.Domains),
+		IPs:        len(l.IPs),
+	}
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseIndicatorLists reads the [indicators] section. Keys take the form <option>.<list name>, where option is one of
+// file, confidence, taxii_url, taxii_username or taxii_password.
+func parseIndicatorLists(section ini.Section, errs *ConfigurationError) []IndicatorListConfig {
+	lists := make(map[string]*IndicatorListConfig)
+	get := func(name string) *IndicatorListConfig {
+		if _, ok := lists[name]; !ok {
+			lists[name] = &IndicatorListConfig{Name: name, Confidence: 50}
+		}
+		return lists[name]
+	}
+
+	for key, val := range section {
+		if key == "reload_interval" || key == "taxii_poll_interval" {
+			continue
+		}
+
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid indicator key '%s': should look like (option).(list name)", key))
+			continue
+		}
+
+		switch parts[0] {
+		case "file":
+			get(parts[1]).FileName = val
+		case "confidence":
+			confidence, err := strconv.Atoi(val)
+			if err != nil || confidence < 0 || confidence > 100 {
+				errs.addErrorString(fmt.Sprintf("Invalid confidence '%s' for indicator list %s: should be between 0 and 100",
+					val, parts[1]))
+				continue
+			}
+			get(parts[1]).Confidence = confidence
+		case "taxii_url":
+			get(parts[1]).TAXIIURL = val
+		case "taxii_username":
+			get(parts[1]).TAXIIUsername = val
+		case "taxii_password":
+			get(parts[1]).TAXIIPassword = val
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown indicator option '%s' in key %s", parts[0], key))
+		}
+	}
+
+	ret := make([]IndicatorListConfig, 0, len(lists))
+	for _, list := range lists {
+		if (len(list.FileName) == 0) == (len(list.TAXIIURL) == 0) {
+			errs.addErrorString(fmt.Sprintf("Indicator list %s needs exactly one of file.%s or taxii_url.%s", list.Name,
+				list.Name, list.Name))
+			continue
+		}
+		ret = append(ret, *list)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+
+	return ret
+}
+
+func NewIndicatorStore(files []IndicatorListConfig) (*IndicatorStore, error) {
+	s := &IndicatorStore{
+		lists:     make(map[string]*IndicatorList),
+		fileTimes: make(map[string]time.Time),
+	}
+
+	for _, f := range files {
+		if len(f.TAXIIURL) > 0 {
+			s.feeds = append(s.feeds, NewTAXIIFeed(f))
+			continue
+		}
+
+		if err := s.loadFile(f); err != nil {
+			return nil, err
+		}
+		s.files = append(s.files, f)
+	}
+
+	return s, nil
+}
+
+func (s *IndicatorStore) loadFile(f IndicatorListConfig) error {
+	info, err := os.Stat(f.FileName)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.Open(f.FileName)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	list := NewIndicatorList(f.Name, f.FileName, f.Confidence)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		// allow CSV exports: the indicator is the first column
+		list.Add(strings.SplitN(line, ",", 2)[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Could not read indicator file %s: %s", f.FileName, err)
+	}
+
+	s.SetList(list)
+
+	s.Lock()
+	s.fileTimes[f.FileName] = info.ModTime()
+	s.Unlock()
+
+	log.Printf("Loaded indicator list %s from %s: %d md5s, %d domains, %d IPs", f.Name, f.FileName, len(list.MD5s),
+		len(list.Domains), len(list.IPs))
+	return nil
+}
+
+// SetList adds or replaces the named indicator list.
+func (s *IndicatorStore) SetList(list *IndicatorList) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.lists[list.Name]; !ok {
+		s.names = append(s.names, list.Name)
+		sort.Strings(s.names)
+	}
+	s.lists[list.Name] = list
+}
+
+// WatchFiles checks the indicator files for changes every interval.
+func (s *IndicatorStore) WatchFiles(interval time.Duration) {
+	if len(s.files) == 0 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		s.reloadChangedFiles()
+	}
+}
+
+// reloadChangedFiles reloads indicator files whose modification time has changed. Reload errors are logged and the
+// previously loaded version of the list is kept.
+func (s *IndicatorStore) reloadChangedFiles() {
+	for _, f := range s.files {
+		info, err := os.Stat(f.FileName)
+		if err != nil {
+			log.Printf("Could not check indicator file %s: %s", f.FileName, err)
+			continue
+		}
+
+		s.RLock()
+		changed := !info.ModTime().Equal(s.fileTimes[f.FileName])
+		s.RUnlock()
+
+		if changed {
+			if err := s.loadFile(f); err != nil {
+				log.Printf("Could not reload indicator file %s: %s", f.FileName, err)
+			}
+		}
+	}
+}
+
+// PollFeeds refreshes the lists pulled from TAXII collections immediately, then every interval. A failed poll is
+// logged and the list from the last successful poll is kept.
+func (s *IndicatorStore) PollFeeds(interval time.Duration) {
+	if len(s.feeds) == 0 {
+		return
+	}
+
+	s.pollFeeds()
+	for range time.Tick(interval) {
+		s.pollFeeds()
+	}
+}
+
+func (s *IndicatorStore) pollFeeds() {
+	for _, feed := range s.feeds {
+		list, err := feed.Poll()
+		if err != nil {
+			log.Printf("Could not poll TAXII collection %s for indicator list %s: %s", feed.url, feed.list.Name, err)
+			continue
+		}
+
+		s.SetList(list)
+		log.Printf("Loaded indicator list %s from %s: %d md5s, %d domains, %d IPs", list.Name, feed.url,
+			len(list.MD5s), len(list.Domains), len(list.IPs))
+	}
+}
+
+func (s *IndicatorStore) Statistics() interface{} {
+	s.RLock()
+	defer s.RUnlock()
+
+	ret := make(map[string]IndicatorListStatistics)
+	for name, list := range s.lists {
+		ret[name] = list.Statistics()
+	}
+	return ret
+}
+
+// Tag adds an "indicator_hits" array to msg describing each indicator list entry matched by the event.
+func (s *IndicatorStore) Tag(msg map[string]interface{}) {
+	s.RLock()
+	defer s.RUnlock()
+
+	hits := make([]map[string]interface{}, 0)
+	addHit := func(list *IndicatorList, field, value string) {
+		hits = append(hits, map[string]interface{}{
+			"list":       list.Name,
+			"confidence": list.Confidence,
+			"field":      field,
+			"value":      value,
+		})
+	}
+
+	for _, name := range s.names {
+		list := s.lists[name]
+
+		for _, field := range md5IndicatorFields {
+			forEachContainer(msg, field, func(container map[string]interface{}) {
+				if value, ok := container[field].(string); ok && list.MD5s[strings.ToUpper(value)] {
+					addHit(list, field, value)
+				}
+			})
+		}
+
+		for _, field := range domainIndicatorFields {
+			forEachContainer(msg, field, func(container map[string]interface{}) {
+				if value, ok := container[field].(string); ok && list.matchDomain(value) {
+					addHit(list, field, value)
+				}
+			})
+		}
+
+		for _, field := range ipIndicatorFields {
+			forEachContainer(msg, field, func(container map[string]interface{}) {
+				if value, ok := container[field].(string); ok {
+					if ip := net.ParseIP(value); ip != nil && list.IPs[ip.String()] {
+						addHit(list, field, value)
+					}
+				}
+			})
+		}
+	}
+
+	if len(hits) > 0 {
+		indicatorHitCount.Add(int64(len(hits)))
+		msg["indicator_hits"] = hits
+	}
+}
+
+// matchDomain reports whether the domain, or any domain it is a subdomain of, is in the list.
+func (l *IndicatorList) matchDomain(domain string) bool {
+	if len(l.Domains) == 0 {
+		return false
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for len(domain) > 0 {
+		if l.Domains[domain] {
+			return true
+		}
+		idx := strings.Index(domain, ".")
+		if idx < 0 {
+			break
+		}
+		domain = domain[idx+1:]
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndicatorTagging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indicators")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "incident.txt")
+	contents := "# incident 1234\n" +
+		"d41d8cd98f00b204e9800998ecf8427e\n" +
+		"Evil.Example.com.\n" +
+		"\n" +
+		"192.0.2.10,c2 server\n"
+	if err := ioutil.WriteFile(fileName, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewIndicatorStore([]IndicatorListConfig{{Name: "incident", FileName: fileName, Confidence: 90}})
+	if err != nil {
+		t.Fatalf("Could not load indicator list: %s", err)
+	}
+
+	msg := map[string]interface{}{
+		"type":      "ingress.event.netconn",
+		"md5":       "D41D8CD98F00B204E9800998ECF8427E",
+		"domain":    "www.evil.example.com",
+		"remote_ip": "192.0.2.10",
+		"local_ip":  "192.0.2.11",
+	}
+	store.Tag(msg)
+
+	hits, ok := msg["indicator_hits"].([]map[string]interface{})
+	if !ok || len(hits) != 3 {
+		t.Fatalf("Expected 3 indicator hits, got %v", msg["indicator_hits"])
+	}
+	for _, hit := range hits {
+		if hit["list"] != "incident" || hit["confidence"] != 90 {
+			t.Errorf("Unexpected list or confidence in hit %v", hit)
+		}
+	}
+
+	clean := map[string]interface{}{"type": "ingress.event.netconn", "domain": "example.com"}
+	store.Tag(clean)
+	if _, ok := clean["indicator_hits"]; ok {
+		t.Errorf("Parent domain of a listed domain should not match: %v", clean["indicator_hits"])
+	}
+
+	// hits inside docs are reported too
+	feedHit := map[string]interface{}{
+		"type": "feed.storage.hit.process",
+		"docs": []map[string]interface{}{{"process_md5": "d41d8cd98f00b204e9800998ecf8427e"}},
+	}
+	store.Tag(feedHit)
+	if hits, ok := feedHit["indicator_hits"].([]map[string]interface{}); !ok || len(hits) != 1 {
+		t.Errorf("Expected a hit on process_md5 in docs, got %v", feedHit["indicator_hits"])
+	}
+
+	// replacing the file is picked up on the next check
+	if err := ioutil.WriteFile(fileName, []byte("198.51.100.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fileName, later, later); err != nil {
+		t.Fatal(err)
+	}
+	store.reloadChangedFiles()
+
+	reloaded := map[string]interface{}{"remote_ip": "198.51.100.1", "md5": "d41d8cd98f00b204e9800998ecf8427e"}
+	store.Tag(reloaded)
+	if hits, ok := reloaded["indicator_hits"].([]map[string]interface{}); !ok || len(hits) != 1 ||
+		hits[0]["field"] != "remote_ip" {
+		t.Errorf("Expected only the remote_ip hit after reload, got %v", reloaded["indicator_hits"])
+	}
+}
+
+func TestTAXIIFeed(t *testing.T) {
+	pages := map[string]string{
+		"": `{"more": true, "next": "page2", "objects": [
+			{"type": "indicator", "pattern_type": "stix",
+			 "pattern": "[file:hashes.'MD5' = 'd41d8cd98f00b204e9800998ecf8427e'] OR [domain-name:value = 'evil.example.com']"},
+			{"type": "indicator", "pattern_type": "stix", "revoked": true,
+			 "pattern": "[domain-name:value = 'revoked.example.com']"}
+		]}`,
+		"page2": `{"more": false, "objects": [
+			{"type": "indicator", "pattern_type": "stix", "pattern": "[ipv4-addr:value = '192.0.2.10/32']"},
+			{"type": "indicator", "pattern_type": "stix", "pattern": "[ipv4-addr:value = '198.51.100.0/24']"},
+			{"type": "indicator", "pattern_type": "stix", "valid_until": "2001-01-01T00:00:00Z",
+			 "pattern": "[domain-name:value = 'expired.example.com']"},
+			{"type": "indicator", "pattern_type": "snort", "pattern": "alert tcp any any -> any any"}
+		]}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "forwarder" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api1/collections/intel/objects/" || r.URL.Query().Get("match[type]") != "indicator" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", taxiiMediaType)
+		fmt.Fprint(w, pages[r.URL.Query().Get("next")])
+	}))
+	defer server.Close()
+
+	feed := NewTAXIIFeed(IndicatorListConfig{
+		Name:          "isac",
+		Confidence:    70,
+		TAXIIURL:      server.URL + "/api1/collections/intel/",
+		TAXIIUsername: "forwarder",
+		TAXIIPassword: "secret",
+	})
+
+	list, err := feed.Poll()
+	if err != nil {
+		t.Fatalf("Could not poll TAXII feed: %s", err)
+	}
+
+	if len(list.MD5s) != 1 || !list.MD5s["D41D8CD98F00B204E9800998ECF8427E"] {
+		t.Errorf("Unexpected md5s from TAXII feed: %v", list.MD5s)
+	}
+	if len(list.Domains) != 1 || !list.Domains["evil.example.com"] {
+		t.Errorf("Unexpected domains from TAXII feed: %v", list.Domains)
+	}
+	if len(list.IPs) != 1 || !list.IPs["192.0.2.10"] {
+		t.Errorf("Unexpected IPs from TAXII feed: %v", list.IPs)
+	}
+
+	feed.list.TAXIIPassword = "wrong"
+	if _, err := feed.Poll(); err == nil {
+		t.Error("Expected an error polling with the wrong password")
+	}
+}
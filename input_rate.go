@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inputRateInterval is how often the input rates are updated.
+const inputRateInterval = 5 * time.Second
+
+const (
+	InputRateNormal = "normal"
+	InputRateLow    = "low"
+	InputRateHigh   = "high"
+)
+
+// InputRateStatistics is shown on the status page as input_rate. The rates are in events per second: the last
+// interval's, and moving averages over 1, 5 and 15 minutes that weigh recent intervals the most, like a load average.
+type InputRateStatistics struct {
+	PerSecond  float64   `json:"per_second"`
+	Average1m  float64   `json:"average_1m"`
+	Average5m  float64   `json:"average_5m"`
+	Average15m float64   `json:"average_15m"`
+	State      string    `json:"state"`
+	StateSince time.Time `json:"state_since"`
+	Low        float64   `json:"low,omitempty"`
+	High       float64   `json:"high,omitempty"`
+}
+
+// inputRate tracks the rate events arrive from the message bus, and warns when the average over the window strays
+// out of the expected band [low, high]: too few events point at sensors that have stopped reporting or a broken
+// subscription, too many at an event storm. Either bound may be 0, for none.
+type inputRate struct {
+	count int64
+
+	low, high float64
+	window    time.Duration
+
+	started  time.Time
+	lastTick time.Time
+	stats    InputRateStatistics
+	sync.Mutex
+}
+
+var ingestRate = newInputRate(0, 0, 5*time.Minute, time.Now())
+
+func newInputRate(low, high float64, window time.Duration, now time.Time) *inputRate {
+	return &inputRate{
+		low:      low,
+		high:     high,
+		window:   window,
+		started:  now,
+		lastTick: now,
+		stats: InputRateStatistics{
+			State:      InputRateNormal,
+			StateSince: now,
+			Low:        low,
+			High:       high,
+		},
+	}
+}
+
+// Add counts events received.
+func (r *inputRate) Add(events int) {
+	atomic.AddInt64(&r.count, int64(events))
+}
+
+// run updates the rates every inputRateInterval until ctx is cancelled.
+func (r *inputRate) run(ctx context.Context) {
+	ticker := time.NewTicker(inputRateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.tick(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tick updates the rates with the events counted since the last tick, and checks the average against the band.
+func (r *inputRate) tick(now time.Time) {
+	events := atomic.SwapInt64(&r.count, 0)
+
+	r.Lock()
+	defer r.Unlock()
+
+	elapsed := now.Sub(r.lastTick)
+	if elapsed <= 0 {
+		return
+	}
+	r.lastTick = now
+	rate := float64(events) / elapsed.Seconds()
+
+	r.stats.PerSecond = rate
+	r.stats.Average1m = movingAverage(r.stats.Average1m, rate, elapsed, time.Minute)
+	r.stats.Average5m = movingAverage(r.stats.Average5m, rate, elapsed, 5*time.Minute)
+	r.stats.Average15m = movingAverage(r.stats.Average15m, rate, elapsed, 15*time.Minute)
+
+	// the averages start from 0, so the rate can't be too low until they have had a window to catch up
+	if now.Sub(r.started) < r.window {
+		return
+	}
+
+	average := r.average()
+	state := InputRateNormal
+	if r.low > 0 && average < r.low {
+		state = InputRateLow
+	} else if r.high > 0 && average > r.high {
+		state = InputRateHigh
+	}
+	if state == r.stats.State {
+		return
+	}
+
+	switch state {
+	case InputRateLow:
+		log.Printf("WARNING: %.1f events per second received over the last %s, below input_rate_low=%g; check that "+
+			"sensors are reporting and the forwarder is subscribed to the right events", average, r.window, r.low)
+	case InputRateHigh:
+		log.Printf("WARNING: %.1f events per second received over the last %s, above input_rate_high=%g",
+			average, r.window, r.high)
+	default:
+		log.Printf("%.1f events per second received over the last %s, back within the expected rate (was %s "+
+			"since %s)", average, r.window, r.stats.State, r.stats.StateSince.Format(time.RFC3339))
+	}
+	r.stats.State, r.stats.StateSince = state, now
+}
+
+// average returns the moving average over the window, with the lock held.
+func (r *inputRate) average() float64 {
+	switch r.window {
+	case time.Minute:
+		return r.stats.Average1m
+	case 15 * time.Minute:
+		return r.stats.Average15m
+	}
+	return r.stats.Average5m
+}
+
+// movingAverage adds a rate measured over elapsed to an exponentially weighted moving average over window.
+func movingAverage(average, rate float64, elapsed, window time.Duration) float64 {
+	weight := 1 - math.Exp(-elapsed.Seconds()/window.Seconds())
+	return average + weight*(rate-average)
+}
+
+func (r *inputRate) Statistics() interface{} {
+	r.Lock()
+	defer r.Unlock()
+	return r.stats
+}
+
+// annotate adds the rates to a heartbeat event, with input_rate_state when the rate is out of its band.
+func (r *inputRate) annotate(msg map[string]interface{}) {
+	stats := r.Statistics().(InputRateStatistics)
+	msg["input_rate_1m"] = math.Round(stats.Average1m*100) / 100
+	msg["input_rate_5m"] = math.Round(stats.Average5m*100) / 100
+	msg["input_rate_15m"] = math.Round(stats.Average15m*100) / 100
+	if stats.State != InputRateNormal {
+		msg["input_rate_state"] = stats.State
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestInputRateAverages(t *testing.T) {
+	start := time.Now()
+	rate := newInputRate(0, 0, time.Minute, start)
+
+	// a steady 100 events per second for 15 minutes
+	now := start
+	for i := 0; i < 180; i++ {
+		now = now.Add(inputRateInterval)
+		rate.Add(500)
+		rate.tick(now)
+	}
+	stats := rate.Statistics().(InputRateStatistics)
+	if stats.PerSecond != 100 {
+		t.Errorf("Expected 100 events per second, got %g", stats.PerSecond)
+	}
+	// fifteen, three and one time constants of the averages
+	if math.Abs(stats.Average1m-100) > 0.01 || math.Abs(stats.Average5m-95) > 0.1 ||
+		math.Abs(stats.Average15m-63.2) > 0.1 {
+		t.Errorf("Unexpected averages %+v", stats)
+	}
+
+	// the 1 minute average reacts to a drop the fastest
+	now = now.Add(inputRateInterval)
+	rate.tick(now)
+	stats = rate.Statistics().(InputRateStatistics)
+	if stats.PerSecond != 0 || !(stats.Average1m < stats.Average5m && stats.Average5m < 100) {
+		t.Errorf("Unexpected averages after a drop %+v", stats)
+	}
+}
+
+func TestInputRateBand(t *testing.T) {
+	start := time.Now()
+	rate := newInputRate(10, 1000, time.Minute, start)
+	check := func(now time.Time, expected string) {
+		t.Helper()
+		if state := rate.Statistics().(InputRateStatistics).State; state != expected {
+			t.Errorf("Expected the input rate to be %s at %s, got %s", expected, now.Sub(start), state)
+		}
+	}
+
+	// no events arrive at first, but the rate isn't low until the average has had a window to catch up
+	now := start.Add(inputRateInterval)
+	rate.tick(now)
+	check(now, InputRateNormal)
+	for now.Sub(start) < time.Minute {
+		now = now.Add(inputRateInterval)
+		rate.tick(now)
+	}
+	check(now, InputRateLow)
+
+	msg := make(map[string]interface{})
+	rate.annotate(msg)
+	if msg["input_rate_state"] != InputRateLow {
+		t.Errorf("Expected the heartbeat to report the low rate, got %v", msg)
+	}
+
+	for i := 0; i < 24; i++ {
+		now = now.Add(inputRateInterval)
+		rate.Add(2500)
+		rate.tick(now)
+	}
+	check(now, InputRateNormal)
+
+	for i := 0; i < 24; i++ {
+		now = now.Add(inputRateInterval)
+		rate.Add(50000)
+		rate.tick(now)
+	}
+	check(now, InputRateHigh)
+
+	msg = make(map[string]interface{})
+	rate.annotate(msg)
+	if msg["input_rate_state"] != InputRateHigh || msg["input_rate_1m"].(float64) < 1000 {
+		t.Errorf("Expected the heartbeat to report the high rate, got %v", msg)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// the values of [s3] instance_id that aren't names
+const (
+	InstanceIDAuto     = "auto"
+	InstanceIDHostname = "hostname"
+)
+
+// the file, in the holding area, that keeps a generated instance ID across restarts
+const instanceIDFile = "instance-id"
+
+// characters allowed in an instance ID, which becomes part of object keys
+var validInstanceID = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// resolveInstanceID returns the identity a forwarder puts in the keys of the objects it uploads: the configured
+// name, the host's name, or with auto, a UUID generated the first time and kept in directory, so that the forwarder
+// keeps its identity when it is restarted or its host renamed.
+func resolveInstanceID(setting, directory string) (string, error) {
+	switch setting {
+	case InstanceIDHostname:
+		return os.Hostname()
+	case InstanceIDAuto:
+		return loadInstanceID(filepath.Join(directory, instanceIDFile))
+	}
+	return setting, nil
+}
+
+func loadInstanceID(fileName string) (string, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err == nil {
+		id := strings.TrimSpace(string(contents))
+		if !validInstanceID.MatchString(id) {
+			return "", fmt.Errorf("%s does not hold a valid instance ID", fileName)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return "", err
+	}
+	// written to a temporary file first, so that a crash can't leave an empty ID behind
+	if err := ioutil.WriteFile(fileName+".tmp", []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(fileName+".tmp", fileName); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
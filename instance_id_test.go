@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestResolveInstanceID(t *testing.T) {
+	dir := t.TempDir()
+
+	id, err := resolveInstanceID(InstanceIDAuto, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("Expected a version 4 UUID, got %s", id)
+	}
+
+	// the generated ID is kept across restarts
+	if again, err := resolveInstanceID(InstanceIDAuto, dir); err != nil || again != id {
+		t.Errorf("Expected the same instance ID %s, got %s (%v)", id, again, err)
+	}
+	// and isn't picked up as a bundle to upload
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 1 || infos[0].Name() != instanceIDFile {
+		t.Errorf("Expected only %s in the holding area, found %d files", instanceIDFile, len(infos))
+	}
+
+	hostname, _ := os.Hostname()
+	if id, _ := resolveInstanceID(InstanceIDHostname, dir); id != hostname {
+		t.Errorf("Expected the host's name %s, got %s", hostname, id)
+	}
+	if id, _ := resolveInstanceID("fwd-dc1-07", dir); id != "fwd-dc1-07" {
+		t.Errorf("Expected the configured name, got %s", id)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, instanceIDFile), []byte("../elsewhere\n"), 0644)
+	if _, err := resolveInstanceID(InstanceIDAuto, dir); err == nil {
+		t.Error("Expected an invalid instance ID in the file to be refused")
+	}
+}
+
+func TestS3InstanceID(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	config.S3Endpoint = server.URL
+	config.S3ForcePathStyle = true
+
+	config.S3InstanceID = "fwd-dc1-07"
+	config.ConsumerGroup = "soc"
+	o := &S3Behavior{}
+	if _, err := o.Initialize(t.TempDir() + ":us-east-1:cb-events"); err != nil {
+		t.Fatal(err)
+	}
+	if o.instance != "fwd-dc1-07" {
+		t.Errorf("Expected the configured instance ID to be used in a consumer group, got %s", o.instance)
+	}
+	name := o.objectName("/tmp/event-forwarder.2026-10-14T12:00:00")
+	if name != "fwd-dc1-07/event-forwarder.2026-10-14T12:00:00" {
+		t.Errorf("Unexpected object name %s", name)
+	}
+	if stats := o.Statistics().(S3Statistics); stats.InstanceID != "fwd-dc1-07" {
+		t.Errorf("Expected the instance ID in the statistics, got %q", stats.InstanceID)
+	}
+}
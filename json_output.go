@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Layouts for json output, chosen by json_flatten.
+const (
+	JSONNested     = "nested"
+	JSONDotted     = "dotted"
+	JSONUnderscore = "underscore"
+)
+
+// marshalJSON formats msg for json output. Keys are always written in sorted order (as encoding/json does for
+// maps), so the same event is always formatted the same way; the json_* options choose whether the event is wrapped
+// in an envelope, whether nested fields are flattened, indentation, HTML escaping and whether null fields are
+// written. received is the envelope's received_time.
+func marshalJSON(msg map[string]interface{}, received time.Time) ([]byte, error) {
+	if config.JSONEnvelope {
+		msg = envelopeMessage(msg, received)
+	}
+	if config.JSONOmitNull {
+		msg = omitNullFields(msg)
+	}
+	if config.JSONFlatten != JSONNested && len(config.JSONFlatten) > 0 {
+		separator := "."
+		if config.JSONFlatten == JSONUnderscore {
+			separator = "_"
+		}
+		msg = flattenFields(msg, separator, config.JSONFlattenArrays)
+	}
+	if config.JSONEscapeHTML && !config.JSONPretty {
+		return json.Marshal(msg)
+	}
+
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(config.JSONEscapeHTML)
+	if config.JSONPretty {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(msg); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// omitNullFields returns a copy of msg without its null fields, including those in nested maps and lists of maps.
+func omitNullFields(msg map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(msg))
+	for key, value := range msg {
+		if value == nil {
+			continue
+		}
+		copied[key] = omitNullValues(value)
+	}
+	return copied
+}
+
+func omitNullValues(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return omitNullFields(v)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i := range v {
+			// nulls in lists are kept, so the positions of the other items don't change
+			copied[i] = omitNullValues(v[i])
+		}
+		return copied
+	}
+	return value
+}
+
+// flattenFields returns a copy of msg with the fields of nested maps moved to the top level, their keys joined to
+// their parents' with separator: {"docs":{"pid":4}} becomes {"docs.pid":4}. With flattenArrays, the items of lists
+// are flattened too, keyed by their index ("docs.0.pid"); otherwise lists are kept, with any maps in them flattened.
+// Empty maps and lists are kept as they are.
+func flattenFields(msg map[string]interface{}, separator string, flattenArrays bool) map[string]interface{} {
+	flattened := make(map[string]interface{}, len(msg))
+	for key, value := range msg {
+		flattenValue(flattened, key, value, separator, flattenArrays)
+	}
+	return flattened
+}
+
+func flattenValue(flattened map[string]interface{}, key string, value interface{}, separator string,
+	flattenArrays bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			break
+		}
+		for childKey, childValue := range v {
+			flattenValue(flattened, key+separator+childKey, childValue, separator, flattenArrays)
+		}
+		return
+	case []interface{}:
+		if len(v) == 0 {
+			break
+		}
+		if flattenArrays {
+			for i, item := range v {
+				flattenValue(flattened, key+separator+strconv.Itoa(i), item, separator, flattenArrays)
+			}
+			return
+		}
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			if m, ok := item.(map[string]interface{}); ok {
+				items[i] = flattenFields(m, separator, flattenArrays)
+			} else {
+				items[i] = item
+			}
+		}
+		value = items
+	}
+	flattened[key] = value
+}
+
+var (
+	forwarderHostname     string
+	forwarderHostnameOnce sync.Once
+)
+
+// envelopeMessage wraps msg for json_envelope, as {"meta": {...}, "event": msg}, so that the forwarder's own fields
+// are kept apart from the event's. cb_server moves from the event to the metadata.
+func envelopeMessage(msg map[string]interface{}, received time.Time) map[string]interface{} {
+	forwarderHostnameOnce.Do(func() {
+		forwarderHostname, _ = os.Hostname()
+	})
+
+	meta := map[string]interface{}{
+		"forwarder":     forwarderHostname,
+		"version":       version,
+		"received_time": received.UTC().Format(time.RFC3339Nano),
+	}
+	if len(config.Tenant) > 0 {
+		meta["tenant"] = config.Tenant
+	}
+
+	event := make(map[string]interface{}, len(msg))
+	for key, value := range msg {
+		if key == "cb_server" {
+			meta[key] = value
+			continue
+		}
+		event[key] = value
+	}
+	return map[string]interface{}{"meta": meta, "event": event}
+}
+
+// jsonEventField returns the raw value of the event field name in a decoded JSON event, looking inside the envelope
+// of an event written with json_envelope: under "event", or as event.<name> or event_<name> if it was flattened too.
+// Envelopes are recognized by their metadata, whatever the current configuration, so bundles written before
+// json_envelope was changed are read too.
+func jsonEventField(fields map[string]json.RawMessage, name string) (json.RawMessage, bool) {
+	if value, ok := fields[name]; ok {
+		return value, true
+	}
+	if _, ok := fields["meta"]; ok {
+		var event map[string]json.RawMessage
+		if json.Unmarshal(fields["event"], &event) == nil {
+			value, ok := event[name]
+			return value, ok
+		}
+	}
+	for _, separator := range []string{".", "_"} {
+		if _, ok := fields["meta"+separator+"version"]; ok {
+			value, ok := fields["event"+separator+name]
+			return value, ok
+		}
+	}
+	return nil, false
+}
+
+// jsonEventText returns the text of a raw JSON value: a string unquoted, anything else as it is written.
+func jsonEventText(value json.RawMessage) string {
+	var text string
+	if json.Unmarshal(value, &text) == nil {
+		return text
+	}
+	return string(value)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONOutputOptions(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OutputFormat = JSONOutputFormat
+
+	msg := map[string]interface{}{
+		"type":    "ingress.event.procstart",
+		"cmdline": "cmd.exe /c dir > out.txt && type out.txt",
+		"parent":  nil,
+		"docs":    []interface{}{map[string]interface{}{"md5": nil, "pid": 4}},
+	}
+
+	tests := []struct {
+		pretty, escapeHTML, omitNull bool
+		expected                     string
+	}{
+		{false, true, false, `{"cmdline":"cmd.exe /c dir \u003e out.txt \u0026\u0026 type out.txt",` +
+			`"docs":[{"md5":null,"pid":4}],"parent":null,"type":"ingress.event.procstart"}`},
+		{false, false, true, `{"cmdline":"cmd.exe /c dir > out.txt && type out.txt","docs":[{"pid":4}],` +
+			`"type":"ingress.event.procstart"}`},
+		{true, false, true, "{\n  \"cmdline\": \"cmd.exe /c dir > out.txt && type out.txt\",\n  \"docs\": [\n    {\n" +
+			"      \"pid\": 4\n    }\n  ],\n  \"type\": \"ingress.event.procstart\"\n}"},
+	}
+	for _, test := range tests {
+		config.JSONPretty, config.JSONEscapeHTML, config.JSONOmitNull = test.pretty, test.escapeHTML, test.omitNull
+		formatted, err := formatMessage(msg, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if formatted != test.expected {
+			t.Errorf("pretty=%t escape_html=%t omit_null=%t: expected\n%s\ngot\n%s", test.pretty, test.escapeHTML,
+				test.omitNull, test.expected, formatted)
+		}
+	}
+	if msg["parent"] != nil || len(msg) != 4 {
+		t.Error("Omitting null fields changed the event")
+	}
+}
+
+func TestJSONEnvelope(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.Tenant = "acme"
+
+	msg := map[string]interface{}{"type": "ingress.event.procstart", "cb_server": "cbserver", "process_pid": 4}
+	received := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	wrapped := envelopeMessage(msg, received)
+
+	meta := wrapped["meta"].(map[string]interface{})
+	if meta["tenant"] != "acme" || meta["cb_server"] != "cbserver" || meta["version"] != version ||
+		meta["received_time"] != "2026-10-01T12:00:00Z" {
+		t.Errorf("Unexpected envelope metadata %v", meta)
+	}
+	event := wrapped["event"].(map[string]interface{})
+	if _, ok := event["cb_server"]; ok || event["process_pid"] != 4 || len(event) != 2 {
+		t.Errorf("Unexpected event in envelope %v", event)
+	}
+	if _, ok := msg["cb_server"]; !ok {
+		t.Error("Wrapping changed the event")
+	}
+
+	// the type and timestamp are found in the envelope, flattened or not, and the received time is the one given
+	config.OutputFormat, config.JSONEnvelope = JSONOutputFormat, true
+	msg["timestamp"] = 1500000000
+	for _, flatten := range []string{JSONNested, JSONDotted, JSONUnderscore} {
+		config.JSONFlatten = flatten
+		formatted, err := formatMessage(msg, received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventType, timestamp, _, _ := exportedEventFields(formatted)
+		if messageEventType(formatted) != "ingress.event.procstart" || eventType != "ingress.event.procstart" ||
+			timestamp.Unix() != 1500000000 || !strings.Contains(formatted, `"2026-10-01T12:00:00Z"`) {
+			t.Errorf("json_flatten=%s: unexpected type %q or timestamp %v of %s", flatten, messageEventType(formatted),
+				timestamp, formatted)
+		}
+	}
+}
+
+func TestFlattenFields(t *testing.T) {
+	msg := map[string]interface{}{
+		"type":   "ingress.event.netconn",
+		"docs":   []interface{}{map[string]interface{}{"pid": 4, "tags": []interface{}{"a", "b"}}},
+		"sensor": map[string]interface{}{"id": 7, "os": map[string]interface{}{"name": "windows"}},
+		"empty":  map[string]interface{}{},
+	}
+
+	flattened := flattenFields(msg, ".", true)
+	expected := map[string]interface{}{"type": "ingress.event.netconn", "docs.0.pid": 4, "docs.0.tags.0": "a",
+		"docs.0.tags.1": "b", "sensor.id": 7, "sensor.os.name": "windows", "empty": map[string]interface{}{}}
+	if !reflect.DeepEqual(flattened, expected) {
+		t.Errorf("Expected %v, got %v", expected, flattened)
+	}
+
+	flattened = flattenFields(msg, "_", false)
+	expected = map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": 7, "sensor_os_name": "windows",
+		"docs":  []interface{}{map[string]interface{}{"pid": 4, "tags": []interface{}{"a", "b"}}},
+		"empty": map[string]interface{}{}}
+	if !reflect.DeepEqual(flattened, expected) {
+		t.Errorf("Expected %v, got %v", expected, flattened)
+	}
+}
+
+func TestJSONPrettyOutputs(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"s3.conf": "[bridge]\nrabbit_mq_password=guest\njson_pretty=true\noutput_type=s3\ns3out=cb-events\n",
+		"tcp.conf": "[bridge]\nrabbit_mq_password=guest\njson_pretty=true\noutput_type=tcp\n" +
+			"tcpout=siem.example.com:514\n",
+	})
+	if _, err := ParseConfig(filepath.Join(dir, "s3.conf")); err == nil ||
+		!strings.Contains(err.Error(), "json_pretty can't be used with output type s3") {
+		t.Errorf("Expected json_pretty to be refused with the s3 output, got %v", err)
+	}
+	if _, err := ParseConfig(filepath.Join(dir, "tcp.conf")); err != nil {
+		t.Errorf("Expected json_pretty to be accepted with the tcp output, got %v", err)
+	}
+}
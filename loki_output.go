@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const lokiPushPath = "/loki/api/v1/push"
+
+// characters that may not appear in a Loki label name
+var lokiLabelInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// LokiOutput sends events to Grafana Loki's push API. Events are sent in batches of up to batchSize events, or
+// whatever has arrived within batchWait of the first, grouped into streams by their labels: the static labels plus
+// those extracted from the events' fields. A batch that Loki can't take (it is down, or rate limiting the forwarder)
+// is sent again until it is accepted, holding up processing meanwhile; a batch that Loki rejects is dropped.
+type LokiOutput struct {
+	url       string
+	client    *http.Client
+	labels    []LokiLabel
+	static    map[string]string
+	batchSize int
+	batchWait time.Duration
+
+	sentEvents    int64
+	sentBatches   int64
+	droppedEvents int64
+	retries       int64
+	lastError     string
+	lastSendTime  time.Time
+
+	loop *outputLoop
+	sync.RWMutex
+}
+
+// LokiLabel sets the label Name to the value of the event field Field, a dotted path for nested fields such as
+// docs.0.md5.
+type LokiLabel struct {
+	Name  string
+	Field string
+}
+
+type LokiStatistics struct {
+	URL           string    `json:"url"`
+	SentEvents    int64     `json:"sent_events"`
+	SentBatches   int64     `json:"sent_batches"`
+	DroppedEvents int64     `json:"dropped_event_count"`
+	Retries       int64     `json:"retries"`
+	LastSendTime  time.Time `json:"last_send_time"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         LokiOutputType,
+		ParameterKey: "lokiout",
+		StatusType:   "loki",
+		Factory:      func() OutputHandler { return &LokiOutput{} },
+	})
+}
+
+// Initialize expects the base URL of Loki (or of a gateway in front of it), for example http://loki.example.com:3100;
+// the push API's path is added unless the URL already has a path. The options in the [loki] section are read from
+// the configuration.
+func (o *LokiOutput) Initialize(location string) error {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("Invalid Loki URL '%s': should look like http://loki.example.com:3100", location)
+	}
+	if len(strings.Trim(u.Path, "/")) == 0 {
+		u.Path = lokiPushPath
+	}
+	o.url = u.String()
+
+	o.client = &http.Client{Timeout: config.LokiTimeout, Transport: httpTransport()}
+	o.labels = config.LokiLabels
+	o.static = config.LokiStaticLabels
+	o.batchSize = config.LokiBatchSize
+	if o.batchSize <= 0 {
+		o.batchSize = 500
+	}
+	o.batchWait = config.LokiBatchWait
+	if o.batchWait <= 0 {
+		o.batchWait = time.Second
+	}
+	return nil
+}
+
+func (o *LokiOutput) Key() string {
+	return o.url
+}
+
+func (o *LokiOutput) String() string {
+	return "Loki " + o.url
+}
+
+func (o *LokiOutput) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return LokiStatistics{
+		URL:           o.url,
+		SentEvents:    o.sentEvents,
+		SentBatches:   o.sentBatches,
+		DroppedEvents: o.droppedEvents,
+		Retries:       o.retries,
+		LastSendTime:  o.lastSendTime,
+		LastError:     o.lastError,
+	}
+}
+
+func (o *LokiOutput) Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error {
+	if o.client == nil {
+		return errors.New("Loki output not initialized")
+	}
+
+	o.loop = newOutputLoop(ctx)
+	sender := &batchSender{
+		loop:    o.loop,
+		size:    o.batchSize,
+		wait:    o.batchWait,
+		name:    o.String(),
+		send:    o.send,
+		retried: o.retried,
+		dropped: o.dropped,
+	}
+	go sender.run(messages, errorChan)
+
+	return nil
+}
+
+func (o *LokiOutput) retried(err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.retries++
+	o.lastError = err.Error()
+}
+
+func (o *LokiOutput) dropped(events int, err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.droppedEvents += int64(events)
+	o.lastError = err.Error()
+}
+
+// send pushes batch to Loki. Errors worth sending the batch again for (the request failed, Loki answered 429 Too
+// Many Requests or a 5xx status) are reported with retry set.
+func (o *LokiOutput) send(ctx context.Context, batch []string) (retry bool, err error) {
+	body, err := json.Marshal(map[string]interface{}{"streams": o.streams(batch, time.Now())})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if len(config.LokiTenantID) > 0 {
+		req.Header.Set("X-Scope-OrgID", config.LokiTenantID)
+	}
+	if len(config.LokiUsername) > 0 {
+		req.SetBasicAuth(config.LokiUsername, config.LokiPassword)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("Loki returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+		return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+	}
+
+	o.Lock()
+	o.sentEvents += int64(len(batch))
+	o.sentBatches++
+	o.lastSendTime = time.Now()
+	o.Unlock()
+	return false, nil
+}
+
+// streams groups the events in batch by their labels. Each event is timed by its timestamp field, or now if it has
+// none.
+func (o *LokiOutput) streams(batch []string, now time.Time) []*lokiStream {
+	var streams []*lokiStream
+	byLabels := make(map[string]*lokiStream)
+
+	for _, message := range batch {
+		fields := formattedEventFields(message)
+		labels := make(map[string]string, len(o.static)+len(o.labels))
+		for name, value := range o.static {
+			labels[name] = value
+		}
+		for _, label := range o.labels {
+			if value, ok := lookupField(fields, label.Field); ok && value != nil {
+				labels[label.Name] = fmt.Sprint(value)
+			}
+		}
+
+		timestamp := now
+		if value, ok := fields["timestamp"]; ok {
+			if t, ok := parseEventTimestamp(fmt.Sprint(value)); ok {
+				timestamp = t
+			}
+		}
+
+		key := lokiStreamKey(labels)
+		stream, ok := byLabels[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			byLabels[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(timestamp.UnixNano(), 10), message})
+	}
+	return streams
+}
+
+func lokiStreamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&key, "%s=%q,", name, labels[name])
+	}
+	return key.String()
+}
+
+// parseLokiLabels parses a comma separated list of event fields to use as labels, each optionally given a label
+// name, as in type,sensor=sensor_id,host=computer_name. Without a name, the label is named after the field, with
+// characters Loki doesn't allow in label names replaced by underscores.
+func parseLokiLabels(val string) ([]LokiLabel, error) {
+	var labels []LokiLabel
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		label := LokiLabel{Field: entry}
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			label.Name, label.Field = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		} else {
+			label.Name = lokiLabelInvalid.ReplaceAllString(entry, "_")
+		}
+		if !validLokiLabel(label.Name) || len(label.Field) == 0 {
+			return nil, fmt.Errorf("'%s' is not a valid label", entry)
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// parseLokiStaticLabels parses a comma separated list of name=value labels, as in job=cb-event-forwarder,env=prod.
+func parseLokiStaticLabels(val string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !validLokiLabel(strings.TrimSpace(parts[0])) {
+			return nil, fmt.Errorf("'%s' is not a valid label", entry)
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+func validLokiLabel(name string) bool {
+	return len(name) > 0 && !lokiLabelInvalid.MatchString(name) && (name[0] < '0' || name[0] > '9') &&
+		!strings.HasPrefix(name, "__")
+}
+
+func (o *LokiOutput) Shutdown() error {
+	o.loop.Shutdown()
+	return nil
+}
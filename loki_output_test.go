@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLokiOutput(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.LokiLabels = []LokiLabel{{Name: "type", Field: "type"}, {Name: "sensor", Field: "sensor.id"}}
+	config.LokiStaticLabels = map[string]string{"job": "cb-event-forwarder"}
+	config.LokiBatchSize = 10
+	config.LokiBatchWait = 50 * time.Millisecond
+	config.LokiTenantID = "soc"
+
+	requests := 0
+	pushed := make(chan []lokiStream, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != lokiPushPath || r.Header.Get("X-Scope-OrgID") != "soc" {
+			t.Errorf("Unexpected push to %s for tenant %s", r.URL.Path, r.Header.Get("X-Scope-OrgID"))
+		}
+		if requests == 1 {
+			// the batch should be sent again
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		var body struct {
+			Streams []lokiStream `json:"streams"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		pushed <- body.Streams
+	}))
+	defer server.Close()
+
+	output := &LokiOutput{}
+	if err := output.Initialize(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 10)
+	messages <- `{"type":"ingress.event.procstart","sensor":{"id":7},"timestamp":1700000000}`
+	messages <- `{"type":"ingress.event.procstart","sensor":{"id":7},"timestamp":1700000001}`
+	messages <- `{"type":"ingress.event.netconn","timestamp":1700000002}`
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	var streams []lokiStream
+	select {
+	case streams = <-pushed:
+	case err := <-errors:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("No events were pushed")
+	}
+
+	if len(streams) != 2 {
+		t.Fatalf("Expected 2 streams, got %v", streams)
+	}
+	procstart := streams[0]
+	if procstart.Stream["type"] != "ingress.event.procstart" || procstart.Stream["sensor"] != "7" ||
+		procstart.Stream["job"] != "cb-event-forwarder" || len(procstart.Values) != 2 {
+		t.Errorf("Unexpected stream %v", procstart)
+	}
+	if procstart.Values[0][0] != "1700000000000000000" {
+		t.Errorf("Expected the event's timestamp, got %s", procstart.Values[0][0])
+	}
+	netconn := streams[1]
+	if _, ok := netconn.Stream["sensor"]; ok || netconn.Stream["type"] != "ingress.event.netconn" {
+		t.Errorf("Unexpected stream %v", netconn)
+	}
+	if stats := output.Statistics().(LokiStatistics); stats.Retries != 1 {
+		t.Errorf("Expected 1 retry, got %+v", stats)
+	}
+}
+
+func TestLokiOutputShutdown(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.LokiBatchSize = 10
+	config.LokiBatchWait = time.Hour
+
+	pushed := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Streams []lokiStream `json:"streams"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		events := 0
+		for _, stream := range body.Streams {
+			events += len(stream.Values)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		pushed <- events
+	}))
+	defer server.Close()
+
+	output := &LokiOutput{}
+	if err := output.Initialize(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 10)
+	messages <- `{"type":"ingress.event.procstart","timestamp":1700000000}`
+	messages <- `{"type":"ingress.event.netconn","timestamp":1700000001}`
+	if err := output.Go(context.Background(), messages, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	for len(messages) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the batch still being collected is sent before the output stops
+	output.Shutdown()
+	select {
+	case events := <-pushed:
+		if events != 2 {
+			t.Errorf("Expected 2 events pushed, got %d", events)
+		}
+	default:
+		t.Fatal("The partial batch was not pushed on shutdown")
+	}
+	if stats := output.Statistics().(LokiStatistics); stats.SentEvents != 2 || stats.DroppedEvents != 0 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	labels, err := parseLokiLabels("type, host=computer_name,docs.0.md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LokiLabel{{"type", "type"}, {"host", "computer_name"}, {"docs_0_md5", "docs.0.md5"}}
+	if len(labels) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, labels)
+	}
+	for i := range expected {
+		if labels[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], labels[i])
+		}
+	}
+
+	for _, invalid := range []string{"host-name=computer_name", "__name__=type", "=type", "sensor="} {
+		if _, err := parseLokiLabels(invalid); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+	if _, err := parseLokiStaticLabels("job"); err == nil {
+		t.Error("Expected an error for a static label without a value")
+	}
+}
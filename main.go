@@ -2,33 +2,89 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"github.com/carbonblack/cb-event-forwarder/leef"
+	"github.com/paulbellamy/ratecounter"
 	"github.com/streadway/amqp"
 	"log"
 	"net"
 	"net/http"
-	//	_ "net/http/pprof"          // DEBUG: profiling support
-	"github.com/paulbellamy/ratecounter"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
 	checkConfiguration = flag.Bool("check", false, "Check the configuration file and exit")
 	debug              = flag.Bool("debug", false, "Enable debugging mode")
+	versionFlag        = flag.Bool("version", false, "Print the version and build information as JSON, then exit")
+	backfillPath       = flag.String("backfill", "", "Forward the events stored in this file or directory, then exit")
+	selfTestFlag       = flag.Bool("selftest", false,
+		"Send a test event through the message bus, processing and output, then exit")
+	generateMix = flag.String("generate", "",
+		"Process generated events instead of events from the message bus: all, or a list of type:weight such as "+
+			"ingress.event.netconn:10,ingress.event.procstart:1")
+	generateRate  = flag.Float64("generate-rate", 100, "Events generated per second, or 0 for no limit")
+	generateCount = flag.Int("generate-count", 0, "Number of events to generate before exiting, or 0 to run until stopped")
+	replayS3      = flag.String("replay-s3", "",
+		"Send the events in the JSON bundles uploaded to this S3 location, such as s3://bucket/prefix, then exit")
+	replayRegion = flag.String("replay-region", "us-east-1", "AWS region of the -replay-s3 bucket")
+	replayFrom   = flag.String("replay-from", "", "Replay bundles uploaded at or after this date or time")
+	replayTo     = flag.String("replay-to", "", "Replay bundles uploaded before this date or time")
+	exportPath   = flag.String("export", "",
+		"Write the events in this bundle directory or event archive that match -export-from, -export-to and "+
+			"-export-types to one file, then exit")
+	exportOutput = flag.String("export-file", "-", "File to write exported events to, or - for standard output")
+	exportFrom   = flag.String("export-from", "", "Export events at or after this date or time")
+	exportTo     = flag.String("export-to", "", "Export events before this date or time")
+	exportTypes  = flag.String("export-types", "", "Export events of these types, such as ingress.event.netconn,alert.#")
+
+	trainDictionaryPath = flag.String("train-zstd-dictionary", "",
+		"Build a zstd dictionary from the events in this bundle directory or file, write it to -zstd-dictionary, "+
+			"then exit")
+	zstdDictionaryFile = flag.String("zstd-dictionary", "",
+		"The dictionary file -train-zstd-dictionary writes, and -export decompresses zstd bundles with")
+
+	migrateConfigFile = flag.String("migrate-config", "",
+		"Translate the configuration file to the current format, with every option documented, and write it to this "+
+			"file (or - for standard output), then exit")
+
+	configCache = flag.String("config-cache", "/var/cb/data/event-forwarder/remote-config",
+		"Directory to keep the last configuration fetched in, when the configuration is given as a URL")
+
+	checkBusFlag = flag.Bool("check-bus", false,
+		"Check that the Cb Response server publishes the events the forwarder subscribes to, then exit")
+	cbConfFile       = flag.String("cb-conf", "/etc/cb/cb.conf", "The Cb Response server's cb.conf, for -check-bus")
+	checkBusDuration = flag.Duration("check-bus-duration", time.Minute, "How long -check-bus watches for events")
+
+	schemaReportFlag = flag.Bool("schema-report", false,
+		"Watch the events the forwarder subscribes to and write a report of the fields of each event type, then exit")
+	schemaDuration = flag.Duration("schema-duration", 5*time.Minute, "How long -schema-report watches for events")
+	schemaFormat   = flag.String("schema-format", "markdown", "Format of the -schema-report report: markdown or json")
+	schemaOutput   = flag.String("schema-file", "-",
+		"File to write the -schema-report report to, or - for standard output")
 )
 
 var version = "NOT FOR RELEASE"
 
 var wg sync.WaitGroup
 var config Configuration
+var scriptHook *ScriptHook
+var indicatorStore *IndicatorStore
+var outputHandler OutputHandler
+
+// controlled at runtime through the management API
+var consumption = &consumptionGate{}
+var outputRateLimiter = newEventRateLimiter(0)
 
 type Status struct {
 	InputEventCount  *expvar.Int
@@ -53,6 +109,13 @@ var status Status
 var (
 	results       chan string
 	output_errors chan error
+
+	// holds events while the output is slow, if buffer_memory_size is set
+	buffer *eventBuffer
+	// restarts the output if it stalls, if output_stall_timeout is set
+	watchdog *outputWatchdog
+	// copies events to the shadow output, if shadow_output_type is set
+	mirror *mirrorOutput
 )
 
 /*
@@ -108,14 +171,8 @@ type Consumer struct {
 	conn    *amqp.Connection
 	channel *amqp.Channel
 	tag     string
-}
-
-type OutputHandler interface {
-	Initialize(string) error
-	Go(messages <-chan string, errorChan chan<- error) error
-	String() string
-	Statistics() interface{}
-	Key() string
+	// the channels after the first, with consumer_channels; see consume
+	extra []*amqp.Channel
 }
 
 /*
@@ -125,10 +182,16 @@ type OutputHandler interface {
 // TODO: change this into an error channel
 func reportError(d string, errmsg string, err error) {
 	status.ErrorCount.Add(1)
+	recentErrors.add(ErrorCategoryEvent, fmt.Sprintf("%s when processing %s: %s", errmsg, d, err))
 	log.Printf("%s when processing %s: %s", errmsg, d, err)
 }
 
-func processMessage(body []byte, routingKey, contentType string, headers amqp.Table, exchangeName string) {
+// processMessage decodes a message from the bus and queues the events in it for the output. It returns an error only
+// if ctx was cancelled before all the events were queued, in which case the message should be delivered again;
+// messages that cannot be decoded are reported and dropped.
+func processMessage(ctx context.Context, body []byte, routingKey, contentType string, headers amqp.Table,
+	exchangeName string) error {
+	received := time.Now()
 	status.InputEventCount.Add(1)
 	//	status.EventCounter.Incr(1)
 
@@ -142,7 +205,7 @@ func processMessage(body []byte, routingKey, contentType string, headers amqp.Ta
 		msgs, err = ProcessRawZipBundle(routingKey, body, headers)
 		if err != nil {
 			reportError(routingKey, "Could not process raw zip bundle", err)
-			return
+			return nil
 		}
 	} else if contentType == "application/protobuf" {
 		// if we receive a protobuf through the raw sensor exchange, it's actually a protobuf "bundle" and not a
@@ -153,7 +216,9 @@ func processMessage(body []byte, routingKey, contentType string, headers amqp.Ta
 			msg, err := ProcessProtobufMessage(routingKey, body, headers)
 			if err != nil {
 				reportError(routingKey, "Could not process body", err)
-				return
+			}
+			if msg == nil {
+				return nil
 			}
 
 			msgs = make([]map[string]interface{}, 0, 1)
@@ -170,69 +235,247 @@ func processMessage(body []byte, routingKey, contentType string, headers amqp.Ta
 
 		if err := decoder.Decode(&msg); err != nil {
 			reportError(string(body), "Received error when unmarshaling JSON body", err)
-			return
+			return nil
 		}
 
 		msgs, err = ProcessJSONMessage(msg, routingKey)
 	} else {
 		reportError(string(body), "Unknown content-type", errors.New(contentType))
-		return
+		return nil
 	}
 
+	msgs = explodeMessages(msgs, config.ExplodeFields)
+	ingestRate.Add(len(msgs))
+
 	for _, msg := range msgs {
-		err = outputMessage(msg)
-		if err != nil {
+		trace := tracer.start(msg, routingKey, exchangeName)
+		eventTypeStats.Received(msg)
+		clockSkewDetector.check(msg, received)
+
+		if binaries != nil && binaries.Add(msg) && config.BinaryArchiveOnly {
+			trace.stage("binary archived; event not forwarded")
+			continue
+		}
+
+		if config.ParseCommandLines {
+			AddCommandLineFields(msg)
+		}
+
+		if config.NormalizeDomains {
+			NormalizeDomains(msg)
+		}
+
+		if processContexts != nil {
+			processContexts.Enrich(msg)
+		}
+
+		if indicatorStore != nil {
+			indicatorStore.Tag(msg)
+		}
+
+		if config.AttackTechniques {
+			TagAttackTechniques(config.AttackRules, msg)
+		}
+
+		if !config.SeverityScores.Empty() {
+			config.SeverityScores.Apply(msg)
+		}
+		trace.stage("enriched")
+
+		if !config.Transforms.Empty() {
+			config.Transforms.Apply(msg)
+			trace.stage("transformed")
+		}
+
+		if scriptHook != nil {
+			msg, err = scriptHook.Process(msg)
+			if err != nil {
+				reportError(routingKey, "Error running script", err)
+			}
+			if msg == nil {
+				trace.stage("dropped by the script")
+				continue
+			}
+			trace.stage("script run")
+		}
+
+		// redact last so that neither the transforms nor the script can reintroduce a redacted field
+		if !config.Redactions.Empty() {
+			config.Redactions.Apply(msg)
+		}
+
+		if config.SanitizeOutput {
+			sanitizeMessage(msg)
+		}
+		trace.stage("redacted and sanitized")
+
+		if actions != nil {
+			actions.Trigger(msg, time.Now())
+		}
+
+		if eventAggregator != nil && eventAggregator.Add(msg, time.Now()) {
+			trace.stage("held for aggregation")
+			continue
+		}
+
+		err = outputReceivedMessage(ctx, msg, received)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			trace.stage("not sent: " + err.Error())
 			reportError(string(body), "Error marshaling message", err)
+		} else {
+			trace.stage("queued for the output")
 		}
 	}
+
+	return nil
 }
 
-func outputMessage(msg map[string]interface{}) error {
-	var err error
+// outputMessage formats msg and queues it for the output. It gives up, returning ctx.Err(), if ctx is cancelled while
+// waiting for the output to accept the message.
+func outputMessage(ctx context.Context, msg map[string]interface{}) error {
+	return outputReceivedMessage(ctx, msg, time.Time{})
+}
 
-	//
-	// Marshal result into the correct output format
-	//
+// outputReceivedMessage is outputMessage for an event received from the message bus at received, so that its latency
+// can be measured (see latencyTracker).
+func outputReceivedMessage(ctx context.Context, msg map[string]interface{}, received time.Time) error {
 	msg["cb_server"] = config.ServerName
+	if contract != nil {
+		contract.Observe(msg)
+	}
 
-	var outmsg string
+	// the event is formatted with the same received time however many times it takes to fit max_event_size
+	formatted := received
+	if formatted.IsZero() {
+		formatted = time.Now()
+	}
+	outmsg, err := formatMessage(msg, formatted)
+	if len(outmsg) == 0 || err != nil {
+		return err
+	}
+	eventType, _ := msg["type"].(string)
+	if tier != nil {
+		tier.Send(msg, outmsg, formatted)
+	}
 
+	if config.MaxEventSize > 0 && len(outmsg) > config.MaxEventSize {
+		fitted, err := fitMessage(msg, outmsg, formatted)
+		if err != nil {
+			return err
+		}
+		for _, outmsg := range fitted {
+			if err := sendMessage(ctx, outmsg, eventType, received); err != nil {
+				return err
+			}
+			eventTypeStats.Forwarded(msg, len(outmsg))
+		}
+		return nil
+	}
+	if err := sendMessage(ctx, outmsg, eventType, received); err != nil {
+		return err
+	}
+	eventTypeStats.Forwarded(msg, len(outmsg))
+	return nil
+}
+
+// formatMessage marshals msg, received at received, into the configured output format.
+func formatMessage(msg map[string]interface{}, received time.Time) (string, error) {
 	switch config.OutputFormat {
 	case JSONOutputFormat:
-		var b []byte
-		b, err = json.Marshal(msg)
-		outmsg = string(b)
+		b, err := marshalJSON(msg, received)
+		return string(b), err
 	case LEEFOutputFormat:
-		outmsg, err = leef.Encode(msg)
+		return leef.Encode(msg)
 	default:
 		panic("Impossible: invalid output_format, exiting immediately")
 	}
+}
 
-	if len(outmsg) > 0 && err == nil {
-		status.OutputEventCount.Add(1)
-		//			status.OutputBytesPerSecond.Incr(int64(len(outmsg)))
-		results <- string(outmsg)
-	} else {
+// sendMessage queues a formatted event for the output.
+func sendMessage(ctx context.Context, outmsg, eventType string, received time.Time) error {
+	if eventEncoder != nil {
+		outmsg = eventEncoder.Encode(outmsg)
+	}
+	eventTails.publish(outmsg)
+	latencySLOs.queued(eventType, outmsg, received)
+
+	status.OutputEventCount.Add(1)
+	//			status.OutputBytesPerSecond.Incr(int64(len(outmsg)))
+	if eventAudit != nil {
+		if err := eventAudit.Sample(outmsg); err != nil {
+			log.Printf("Could not write event to audit file %s: %s", config.AuditFile, err)
+		}
+	}
+	if err := outputRateLimiter.Wait(ctx); err != nil {
 		return err
 	}
+	select {
+	case results <- string(outmsg):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	return nil
 }
 
-func worker(deliveries <-chan amqp.Delivery) {
+func messageProcessorCount() int {
+	// follows max_procs if it is set
+	return runtime.GOMAXPROCS(0) * 2
+}
+
+// worker processes deliveries until the channel is closed or ctx is cancelled. With manualAck, each delivery is
+// acknowledged once its events have been queued for the output; deliveries that were not fully processed are left
+// unacknowledged, and the broker delivers them again when the forwarder reconnects; redeliveries of messages that
+// had been processed are skipped (see redeliveryCache).
+func worker(ctx context.Context, deliveries <-chan amqp.Delivery, manualAck bool) {
 	defer wg.Done()
 
 	for delivery := range deliveries {
-		processMessage(delivery.Body, delivery.RoutingKey, delivery.ContentType, delivery.Headers, delivery.Exchange)
+		if consumption.Wait(ctx) != nil {
+			break
+		}
+		var key redeliveryKey
+		if redeliveries != nil {
+			key = deliveryKey(delivery)
+			if redeliveries.Duplicate(delivery, key, time.Now()) {
+				if err := delivery.Ack(false); err != nil {
+					log.Printf("Could not acknowledge message: %s", err)
+				}
+				continue
+			}
+		}
+
+		contentType := delivery.ContentType
+		if len(contentType) == 0 {
+			contentType = customBindingContentType(config.CustomBindings, delivery.Exchange)
+		}
+		err := processMessage(ctx, delivery.Body, delivery.RoutingKey, contentType, delivery.Headers,
+			delivery.Exchange)
+		if err != nil {
+			break
+		}
+		if redeliveries != nil {
+			redeliveries.Remember(key, time.Now())
+		}
+		if manualAck {
+			if err := delivery.Ack(false); err != nil {
+				log.Printf("Could not acknowledge message: %s", err)
+			}
+		}
 	}
 
 	log.Printf("Worker exiting")
 }
 
-func messageProcessingLoop(uri, queueName, consumerTag string) error {
+// messageProcessingLoop consumes events until the AMQP connection is lost or ctx is cancelled.
+func messageProcessingLoop(ctx context.Context, uri, queueName string, queueOptions QueueOptions,
+	consumerTag string) error {
 	connection_error := make(chan *amqp.Error, 1)
 
-	c, deliveries, err := NewConsumer(uri, queueName, consumerTag, config.UseRawSensorExchange, config.EventTypes)
+	c, deliveries, err := NewConsumer(uri, queueName, consumerTag, queueOptions, config.UseRawSensorExchange,
+		config.EventTypes, config.CustomBindings)
 	if err != nil {
 		status.LastConnectError = err.Error()
 		status.ErrorTime = time.Now()
@@ -244,18 +487,61 @@ func messageProcessingLoop(uri, queueName, consumerTag string) error {
 
 	c.conn.NotifyClose(connection_error)
 
-	numProcessors := runtime.NumCPU() * 2
+	numProcessors := messageProcessorCount()
 	log.Printf("Starting %d message processors\n", numProcessors)
 
 	wg.Add(numProcessors)
 	for i := 0; i < numProcessors; i++ {
-		go worker(deliveries)
+		go worker(ctx, deliveries, queueOptions.ManualAck)
+	}
+
+	// without a prefetch limit, stopping the processors doesn't stop the broker delivering, so while the output is
+	// backed up the consumer is cancelled; an auto-delete queue would be deleted with its last consumer, though
+	var pressureChanges <-chan bool
+	cancelled := false
+	if backpressure != nil && (!queueOptions.ManualAck || queueOptions.PrefetchCount == 0) && !queueOptions.AutoDelete {
+		pressureChanges = backpressure.changes
+		if consumption.Throttled() {
+			cancelled = c.cancel(false) == nil
+		}
 	}
 
 	for {
 		select {
+		case paused := <-pressureChanges:
+			if paused && !cancelled {
+				if err := c.cancel(false); err != nil {
+					log.Printf("Could not cancel the AMQP consumer: %s", err)
+				} else {
+					cancelled = true
+				}
+			} else if !paused && cancelled {
+				deliveries, err = c.consume(queueName, queueOptions)
+				if err != nil {
+					log.Printf("Could not resume consuming: %s", err)
+					c.Shutdown()
+					wg.Wait()
+					status.IsConnected = false
+					return err
+				}
+				cancelled = false
+				wg.Add(numProcessors)
+				for i := 0; i < numProcessors; i++ {
+					go worker(ctx, deliveries, queueOptions.ManualAck)
+				}
+			}
+		case <-ctx.Done():
+			log.Println("Stopping AMQP consumer")
+			if err := c.Shutdown(); err != nil {
+				log.Printf("Error stopping AMQP consumer: %s", err)
+			}
+			log.Println("Waiting for all workers to exit")
+			wg.Wait()
+			status.IsConnected = false
+			return ctx.Err()
 		case output_error := <-output_errors:
 			log.Printf("ERROR during output: %s", output_error.Error())
+			recentErrors.add(ErrorCategoryOutput, output_error.Error())
 
 			// hack to exit if the error happens while we are writing to a file
 			if config.OutputType == FileOutputType {
@@ -268,6 +554,7 @@ func messageProcessingLoop(uri, queueName, consumerTag string) error {
 			status.IsConnected = false
 			status.LastConnectError = close_error.Error()
 			status.ErrorTime = time.Now()
+			recentErrors.add(ErrorCategoryConnection, "Connection closed: "+close_error.Error())
 
 			log.Printf("Connection closed: %s", close_error.Error())
 			log.Println("Waiting for all workers to exit")
@@ -284,31 +571,16 @@ func messageProcessingLoop(uri, queueName, consumerTag string) error {
 	return nil
 }
 
-func startOutputs() error {
-	// Configure the specific output.
-	// Valid options are: 'udp', 'tcp', 'file', 's3', 'syslog'
-	var outputHandler OutputHandler
-
-	parameters := config.OutputParameters
-
-	switch config.OutputType {
-	case FileOutputType:
-		outputHandler = &FileOutput{}
-	case TCPOutputType:
-		outputHandler = &NetOutput{}
-		parameters = "tcp:" + parameters
-	case UDPOutputType:
-		outputHandler = &NetOutput{}
-		parameters = "udp:" + parameters
-	case S3OutputType:
-		outputHandler = &S3Output{}
-	case SyslogOutputType:
-		outputHandler = &SyslogOutput{}
-	default:
-		return errors.New(fmt.Sprintf("No valid output handler found (%d)", config.OutputType))
+func startOutputs(ctx context.Context) error {
+	// Configure the specific output; see RegisterOutput for the valid options
+	registration, ok := LookupOutput(config.OutputType)
+	if !ok {
+		return errors.New(fmt.Sprintf("No valid output handler found (%s)", config.OutputType))
 	}
 
-	err := outputHandler.Initialize(parameters)
+	outputHandler = registration.Factory()
+
+	err := outputHandler.Initialize(config.OutputParameters)
 	if err != nil {
 		return err
 	}
@@ -324,48 +596,288 @@ func startOutputs() error {
 			ret["format"] = "json"
 		}
 
-		switch config.OutputType {
-		case FileOutputType:
-			ret["type"] = "file"
-		case UDPOutputType:
-			ret["type"] = "net"
-		case TCPOutputType:
-			ret["type"] = "net"
-		case S3OutputType:
-			ret["type"] = "s3"
-		}
+		ret["type"] = registration.StatusType
 
 		return ret
 	}))
 
+	messages, report := (<-chan string)(results), (chan<- error)(output_errors)
+	if config.BufferMemorySize > 0 {
+		buffer, err = newEventBuffer(config.BufferMemorySize, config.BufferSpillLimit, config.BufferSpillFile)
+		if err != nil {
+			return err
+		}
+		expvar.Publish("event_buffer", expvar.Func(buffer.Statistics))
+
+		buffered := make(chan string)
+		buffer.Go(results, buffered)
+		messages = buffered
+	}
+
+	if len(config.ShadowOutputType) > 0 {
+		if time.Now().Before(config.ShadowUntil) {
+			mirror, err = newMirrorOutput(config.ShadowOutputType, config.ShadowOutputParameters, config.ShadowUntil)
+			if err != nil {
+				return fmt.Errorf("Could not initialize shadow output: %s", err)
+			}
+			expvar.Publish("shadow_output", expvar.Func(mirror.Statistics))
+
+			if messages, report, err = mirror.Go(ctx, messages, report); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("Shadow output period ended at %s; not sending events to it", config.ShadowUntil)
+		}
+	}
+
+	if len(config.TierOutputType) > 0 {
+		if tier, err = newTieredOutput(config.TierOutputType, config.TierOutputParameters,
+			config.TierPolicies); err != nil {
+			return fmt.Errorf("Could not initialize tier output: %s", err)
+		}
+		expvar.Publish("tier_output", expvar.Func(tier.Statistics))
+		if err = tier.Go(ctx); err != nil {
+			return err
+		}
+	}
+
 	log.Printf("Initialized output: %s\n", outputHandler.String())
-	return outputHandler.Go(results, output_errors)
+	if confirmer, ok := outputHandler.(DeliveryConfirmer); latencySLOs != nil && !(ok && confirmer.ConfirmsDelivery()) {
+		messages = latencySLOs.Go(messages)
+	}
+	if config.OutputStallTimeout > 0 {
+		watchdog = newOutputWatchdog(outputHandler, config.OutputParameters, config.OutputStallTimeout)
+		expvar.Publish("output_watchdog", expvar.Func(watchdog.Statistics))
+		return watchdog.Go(ctx, messages, report)
+	}
+	return outputHandler.Go(ctx, messages, report)
+}
+
+// stopOutputs shuts down the output once the message processors have stopped. Events still buffered are saved to
+// the spill file rather than written to the output.
+func stopOutputs() {
+	if buffer != nil {
+		buffer.Shutdown()
+	}
+	if mirror != nil {
+		mirror.Shutdown()
+	}
+	if tier != nil {
+		tier.Shutdown()
+	}
+	if watchdog != nil {
+		watchdog.Shutdown()
+	}
+
+	log.Printf("Shutting down output %s", outputHandler.String())
+	if err := outputHandler.Shutdown(); err != nil {
+		log.Printf("Error shutting down output: %s", err)
+	}
+}
+
+// cancelOnSignal cancels the consumer context when the forwarder is asked to exit.
+func cancelOnSignal(cancel context.CancelFunc) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-term
+	log.Printf("Received %s, shutting down", sig)
+	cancel()
+}
+
+// restartForwarder replaces the process with a new forwarder, started the same way, once this one has stopped.
+func restartForwarder() {
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Could not restart: %s", err)
+	}
+	log.Printf("Restarting with the new configuration")
+	if err := syscall.Exec(executable, os.Args, os.Environ()); err != nil {
+		log.Fatalf("Could not restart: %s", err)
+	}
 }
 
 func main() {
+	if *versionFlag {
+		b, _ := json.MarshalIndent(buildInfo(), "", "  ")
+		fmt.Println(string(b))
+		os.Exit(0)
+	}
+
+	if len(*trainDictionaryPath) > 0 {
+		if len(*zstdDictionaryFile) == 0 {
+			log.Fatal("-train-zstd-dictionary needs -zstd-dictionary, the file to write the dictionary to")
+		}
+		if err := trainZstdDictionary(*trainDictionaryPath, *zstdDictionaryFile); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// tailing reads events from a forwarder that is already running
+	if flag.Arg(0) == "tail" {
+		if err := runTail(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// exporting reads files the forwarder wrote earlier, and needs no configuration
+	if len(*exportPath) > 0 {
+		if len(*zstdDictionaryFile) > 0 {
+			dictionary, err := loadZstdDictionary(*zstdDictionaryFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			config.ZstdDictionary = dictionary
+		}
+		filter, err := parseEventExportFilter(*exportFrom, *exportTo, *exportTypes)
+		if err == nil {
+			err = exportEvents(*exportPath, *exportOutput, filter)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	queueName := fmt.Sprintf("cb-event-forwarder:%s:%d", hostname, os.Getpid())
-
 	configLocation := "/etc/cb/integrations/event-forwarder/cb-event-forwarder.conf"
 	if flag.NArg() > 0 {
 		configLocation = flag.Arg(0)
 	}
+
+	var remote *remoteConfig
+	if isRemoteConfig(configLocation) {
+		if remote, err = newRemoteConfig(configLocation, *configCache); err == nil {
+			configLocation, err = remote.load(context.Background())
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the configuration being migrated may not be valid until it has been
+	if len(*migrateConfigFile) > 0 {
+		if err := migrateConfigCommand(configLocation, *migrateConfigFile); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	config, err = ParseConfig(configLocation)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if len(config.Pipelines) > 0 {
+		if err := runPipelines(configLocation); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if len(config.PipelineName) > 0 {
+		log.SetPrefix(config.PipelineName + ": ")
+		log.SetFlags(log.Flags() | log.Lmsgprefix)
+	}
+
+	if err := applyResourceLimits(); err != nil {
+		log.Fatalf("Could not apply resource limits: %s", err)
+	}
+
+	queueName, queueOptions := forwarderQueue(hostname, os.Getpid())
+	if len(config.ConsumerGroup) > 0 {
+		log.Printf("Consuming from queue %s shared by consumer group %s", queueName, config.ConsumerGroup)
+	}
+	if warning := queueOptions.qosWarning(); len(warning) > 0 {
+		log.Println("WARNING: " + warning)
+	}
+	expvar.Publish("consumer_qos", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"manual_ack":     queueOptions.ManualAck,
+			"prefetch_count": queueOptions.PrefetchCount,
+			"prefetch_size":  queueOptions.PrefetchSize,
+			"channels":       queueOptions.Channels,
+		}
+	}))
+
+	if config.ScriptFile != "" {
+		scriptHook, err = NewScriptHook(config.ScriptFile, config.ScriptTimeout, messageProcessorCount())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded event processing script %s", config.ScriptFile)
+	}
+
+	if config.ProcessContext {
+		processContexts = newProcessContextCache(config.ProcessContextCacheSize, config.ProcessContextTypes)
+		expvar.Publish("process_context", expvar.Func(processContexts.Statistics))
+	}
+
+	if len(config.IndicatorLists) > 0 {
+		indicatorStore, err = NewIndicatorStore(config.IndicatorLists)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(config.AuditFile) > 0 {
+		eventAudit, err = newAuditLog(config.AuditFile, config.AuditSampleRate, config.AuditMaxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Copying %g%% of output events to %s", config.AuditSampleRate*100, config.AuditFile)
+	}
+
+	if len(config.OutputEncoding) > 0 {
+		eventEncoder, err = newOutputEncoder(config.OutputEncoding, config.OutputEncodingReplacement)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if eventEncoder != nil {
+			log.Printf("Writing events to the output in %s", config.OutputEncoding)
+		}
+	}
+
+	if len(config.DeadLetterFile) > 0 {
+		deadLetters, err = newAuditLog(config.DeadLetterFile, 1, config.DeadLetterMaxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if *checkConfiguration {
-		if err := startOutputs(); err != nil {
+		if err := startOutputs(context.Background()); err != nil {
 			log.Fatal(err)
 		}
 		os.Exit(0)
 	}
 
+	if *checkBusFlag {
+		if !runBusCheck(context.Background(), *cbConfFile, *checkBusDuration) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *schemaReportFlag {
+		if err := runSchemaReport(context.Background(), *schemaDuration, *schemaFormat, *schemaOutput); err != nil {
+			log.Fatalf("Could not write the schema report: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	if *selfTestFlag {
+		if !runSelfTest(context.Background()) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	addrs, err := net.InterfaceAddrs()
 
 	if err != nil {
@@ -382,7 +894,23 @@ func main() {
 	} else {
 		exportedVersion.Set(version)
 	}
+	expvar.Publish("build_info", expvar.Func(func() interface{} { return buildInfo() }))
 	expvar.Publish("debug", expvar.Func(func() interface{} { return *debug }))
+	expvar.Publish("fips", expvar.Func(fipsStatus))
+
+	if fipsMode() {
+		log.Printf("FIPS mode: TLS and signatures are restricted to FIPS-approved algorithms (%s crypto module)",
+			cryptoModule)
+		if !cryptoModuleValidated() {
+			log.Println("WARNING: fips_mode is set, but this build does not use a FIPS 140 validated crypto module; " +
+				"build with 'make build-fips' for a compliant forwarder")
+		}
+	}
+
+	if *debug || config.DebugFlag {
+		setLogLevel("debug")
+	}
+	outputRateLimiter.SetLimit(config.MaxEventsPerSecond)
 
 	for _, addr := range addrs {
 		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
@@ -391,10 +919,143 @@ func main() {
 	}
 
 	log.Printf("Configured to capture events: %v", config.EventTypes)
-	if err := startOutputs(); err != nil {
+	if config.ClockSkewTolerance > 0 {
+		clockSkewDetector = newClockSkew(config.ClockSkewTolerance)
+		expvar.Publish("clock_skew", expvar.Func(clockSkewDetector.Statistics))
+	}
+	if len(config.LatencySLOs) > 0 {
+		latencySLOs = newLatencyTracker(config.LatencySLOs, config.LatencySLOWindow)
+		expvar.Publish("latency_slo", expvar.Func(latencySLOs.Statistics))
+	}
+	// created before the outputs are started, as their goroutines use them
+	ingestRate = newInputRate(config.InputRateLow, config.InputRateHigh, config.InputRateWindow, time.Now())
+	expvar.Publish("input_rate", expvar.Func(ingestRate.Statistics))
+	recentErrors = newErrorHistory(config.StatusErrorHistory)
+	expvar.Publish("recent_errors", expvar.Func(recentErrors.Statistics))
+
+	// the output is stopped with Shutdown once the consumer has stopped, so it can write any events still queued
+	if err := startOutputs(context.Background()); err != nil {
 		log.Fatalf("Could not startOutputs: %s", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancelOnSignal(cancel)
+
+	go ingestRate.run(ctx)
+	go dashboard.run(ctx)
+	if latencySLOs != nil {
+		go latencySLOs.run(ctx)
+	}
+
+	expvar.Publish("status_schema_version", expvar.Func(func() interface{} { return statusSchemaVersion }))
+
+	if config.SchemaBaseline != nil {
+		contract = newDataContract(config.SchemaBaseline, config.SchemaBaselineFile)
+		expvar.Publish("data_contract", expvar.Func(contract.Statistics))
+		go contract.run(ctx, config.SchemaCheckInterval)
+	}
+
+	if len(config.RabbitMQManagementURL) > 0 {
+		busQueue = newQueueDepthMonitor(config.RabbitMQManagementURL, queueName, config.AMQPUsername,
+			config.AMQPPassword)
+		expvar.Publish("bus_queue", expvar.Func(busQueue.Statistics))
+		go busQueue.run(ctx, config.RabbitMQManagementInterval)
+	}
+
+	if config.HeartbeatInterval > 0 {
+		go sendHeartbeats(ctx, config.HeartbeatInterval)
+	}
+
+	expvar.Publish("event_types", expvar.Func(eventTypeStats.Statistics))
+	var statsFile *auditLog
+	if config.StatsRollupInterval > 0 {
+		if len(config.StatsRollupFile) > 0 {
+			if statsFile, err = newAuditLog(config.StatsRollupFile, 1, statsRollupFileMaxSize); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go sendStatsRollups(ctx, config.StatsRollupInterval, statsFile)
+	}
+
+	if config.TraceSampleRate > 0 {
+		tracer = &eventTracer{sampleRate: config.TraceSampleRate, filter: config.TraceFilter}
+	}
+
+	// messages acknowledged on delivery are never redelivered
+	if queueOptions.ManualAck && config.RedeliveryWindow > 0 {
+		redeliveries = newRedeliveryCache(config.RedeliveryWindow, config.RedeliveryCacheSize)
+		expvar.Publish("redelivery", expvar.Func(redeliveries.Statistics))
+	}
+
+	if config.PauseHoldingAreaFiles > 0 || config.PauseBufferBytes > 0 {
+		backpressure = newBackpressureMonitor(config.PauseHoldingAreaFiles, config.PauseBufferBytes, consumption)
+		expvar.Publish("backpressure", expvar.Func(backpressure.Statistics))
+		go backpressure.run(ctx)
+		if queueOptions.AutoDelete && (!queueOptions.ManualAck || queueOptions.PrefetchCount == 0) {
+			log.Println("WARNING: the queue is deleted when the forwarder disconnects, so while consumption is " +
+				"paused for the output backlog, events are held in memory rather than by RabbitMQ; set " +
+				"durable_queue or queue_auto_delete=false")
+		}
+	}
+
+	if len(config.BinaryArchiveDestination) > 0 {
+		store, err := newBinaryStore(config.BinaryArchiveDestination)
+		if err != nil {
+			log.Fatalf("Could not use the [binaries] destination: %s", err)
+		}
+		binaries = newBinaryArchive(config.CbServerURL, config.BinaryArchiveAPIToken, config.BinaryArchiveMaxSize,
+			store)
+		expvar.Publish("binary_archive", expvar.Func(binaries.Statistics))
+		go binaries.run(ctx)
+
+		subscribed := false
+		for _, eventType := range config.EventTypes {
+			if RoutingKeyMatches(eventType, "binarystore.file.added") {
+				subscribed = true
+			}
+		}
+		if !subscribed {
+			log.Println("WARNING: the [binaries] destination is set, but events_binary_upload is not; no binaries " +
+				"will be archived")
+		}
+	}
+
+	if len(config.EventActions) > 0 {
+		actions = newEventActions(config.EventActions, config.EventActionTimeout)
+		expvar.Publish("event_actions", expvar.Func(actions.Statistics))
+		go actions.run(ctx)
+	}
+
+	if !config.Aggregations.Empty() {
+		eventAggregator = newAggregator(config.Aggregations)
+		expvar.Publish("aggregation", expvar.Func(eventAggregator.Statistics))
+		go eventAggregator.run(ctx)
+	}
+
+	if len(config.UpdateCheckURL) > 0 {
+		checker := newUpdateChecker(config.UpdateCheckURL)
+		expvar.Publish("update_check", expvar.Func(checker.Statistics))
+		go checker.run(ctx, config.UpdateCheckInterval)
+	}
+
+	// a changed configuration is applied by stopping as if asked to, then starting the forwarder again
+	var restart int32
+	if remote != nil {
+		expvar.Publish("remote_config", expvar.Func(remote.Statistics))
+		if config.RemoteConfigPollInterval > 0 {
+			go remote.watch(ctx, config.RemoteConfigPollInterval, func() {
+				atomic.StoreInt32(&restart, 1)
+				cancel()
+			})
+		}
+	}
+
+	if indicatorStore != nil {
+		expvar.Publish("indicator_lists", expvar.Func(indicatorStore.Statistics))
+		go indicatorStore.WatchFiles(config.IndicatorReloadInterval)
+		go indicatorStore.PollFeeds(config.IndicatorPollInterval)
+	}
+
 	dirs := [...]string{
 		"/usr/share/cb/integrations/event-forwarder/content",
 		"./static",
@@ -412,6 +1073,30 @@ func main() {
 		}
 	}
 
+	http.Handle("/status", statusDashboardHandler(dashboard, recentErrors, outputHandler, hostname))
+	http.Handle("/status/v1", statusAPIHandler(outputHandler, recentErrors, hostname))
+	log.Printf("Status dashboard available at http://%s:%d/status", hostname, config.HTTPServerPort)
+
+	if area, ok := outputHandler.(HoldingArea); ok {
+		http.Handle("/holding_area/", holdingAreaHandler(area, config.HoldingAreaChanges, config.ManagementToken))
+	}
+
+	if len(config.ManagementToken) > 0 {
+		http.Handle("/management/", &managementAPI{
+			token:       config.ManagementToken,
+			consumption: consumption,
+			limiter:     outputRateLimiter,
+			output:      outputHandler,
+			tail:        eventTails,
+		})
+		log.Printf("Management API available at http://%s:%d/management/", hostname, config.HTTPServerPort)
+	}
+
+	if config.DebugPprof {
+		http.Handle("/debug/pprof/", &profilingHandler{token: config.ManagementToken})
+		log.Printf("Profiles available at http://%s:%d/debug/pprof/", hostname, config.HTTPServerPort)
+	}
+
 	if *debug {
 		http.HandleFunc("/debug/sendmessage", func(w http.ResponseWriter, r *http.Request) {
 			if r.Method == "POST" {
@@ -426,7 +1111,7 @@ func main() {
 					return
 				}
 
-				err = outputMessage(parsedMsg)
+				err = outputMessage(r.Context(), parsedMsg)
 				if err != nil {
 					errMsg, _ := json.Marshal(map[string]string{"status": "error", "error": err.Error()})
 					_, _ = w.Write(errMsg)
@@ -434,7 +1119,7 @@ func main() {
 				}
 				log.Printf("Sent test message: %s\n", string(msg))
 			} else {
-				err = outputMessage(map[string]interface{}{
+				err = outputMessage(r.Context(), map[string]interface{}{
 					"type":    "debug.message",
 					"message": fmt.Sprintf("Debugging test message sent at %s", time.Now().String()),
 				})
@@ -453,10 +1138,61 @@ func main() {
 
 	go http.ListenAndServe(fmt.Sprintf(":%d", config.HTTPServerPort), nil)
 
-	log.Println("Starting AMQP loop")
-	for {
-		err := messageProcessingLoop(config.AMQPURL(), queueName, "go-event-consumer")
-		log.Printf("AMQP loop exited: %s. Sleeping for 30 seconds then retrying.", err)
-		time.Sleep(30 * time.Second)
+	if len(*backfillPath) > 0 {
+		if err := runBackfill(ctx, *backfillPath); err != nil {
+			log.Printf("Backfill stopped: %s", err)
+		}
+	} else if len(*replayS3) > 0 {
+		source, err := parseS3ReplaySource(*replayS3, *replayFrom, *replayTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runS3Replay(ctx, newS3Client(*replayRegion), source); err != nil {
+			log.Printf("Replay stopped: %s", err)
+		}
+	} else if len(*generateMix) > 0 {
+		generator, err := newEventGenerator(*generateMix, time.Now().UnixNano())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runGenerator(ctx, generator, *generateRate, *generateCount); err != nil {
+			log.Printf("Event generator stopped: %s", err)
+		}
+	} else {
+		log.Println("Starting AMQP loop")
+		for ctx.Err() == nil {
+			err := messageProcessingLoop(ctx, config.AMQPURL(), queueName, queueOptions, "go-event-consumer")
+			if ctx.Err() != nil {
+				break
+			}
+
+			log.Printf("AMQP loop exited: %s. Sleeping for 30 seconds then retrying.", err)
+			select {
+			case <-time.After(30 * time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	if eventAggregator != nil {
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 30*time.Second)
+		eventAggregator.Flush(flushCtx)
+		cancelFlush()
+	}
+
+	stopOutputs()
+
+	if eventAudit != nil {
+		eventAudit.Close()
+	}
+	if deadLetters != nil {
+		deadLetters.Close()
+	}
+	if statsFile != nil {
+		statsFile.Close()
+	}
+
+	if atomic.LoadInt32(&restart) != 0 {
+		restartForwarder()
 	}
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// consumptionGate stops the message processors taking messages from the AMQP consumer while it is closed. It is
+// closed for two reasons, kept apart: paused, by the management API, and throttled, by the backpressure monitor while
+// the output is backed up. Processing resumes once the gate is neither paused nor throttled. While it is paused, the
+// consumer is left running, so that anything the broker delivers in the meantime is buffered by the AMQP client
+// (no more than prefetch_count, if messages are acknowledged manually); pausing is meant for short maintenance
+// windows. While it is throttled, the consumer may also be cancelled; see backpressureMonitor.
+type consumptionGate struct {
+	sync.Mutex
+	paused    bool
+	throttled bool
+	resume    chan struct{}
+}
+
+// update opens or closes the gate after paused or throttled changed; the lock must be held.
+func (g *consumptionGate) update(wasClosed bool) {
+	closed := g.paused || g.throttled
+	if closed && !wasClosed {
+		g.resume = make(chan struct{})
+	} else if !closed && wasClosed {
+		close(g.resume)
+	}
+}
+
+func (g *consumptionGate) Pause() {
+	g.Lock()
+	defer g.Unlock()
+
+	wasClosed := g.paused || g.throttled
+	g.paused = true
+	g.update(wasClosed)
+}
+
+func (g *consumptionGate) Resume() {
+	g.Lock()
+	defer g.Unlock()
+
+	wasClosed := g.paused || g.throttled
+	g.paused = false
+	g.update(wasClosed)
+}
+
+// Throttle closes the gate, or opens it again if throttled is false, on behalf of the backpressure monitor.
+func (g *consumptionGate) Throttle(throttled bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	wasClosed := g.paused || g.throttled
+	g.throttled = throttled
+	g.update(wasClosed)
+}
+
+// Paused reports whether the management API has paused processing.
+func (g *consumptionGate) Paused() bool {
+	g.Lock()
+	defer g.Unlock()
+
+	return g.paused
+}
+
+// Throttled reports whether the backpressure monitor has stopped processing.
+func (g *consumptionGate) Throttled() bool {
+	g.Lock()
+	defer g.Unlock()
+
+	return g.throttled
+}
+
+// Wait returns once consumption is neither paused nor throttled, or when ctx is cancelled.
+func (g *consumptionGate) Wait(ctx context.Context) error {
+	g.Lock()
+	closed, resume := g.paused || g.throttled, g.resume
+	g.Unlock()
+
+	if !closed {
+		return nil
+	}
+
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// debugLogging is set (atomically) when the log level is "debug"; logDebugf messages are discarded otherwise.
+var debugLogging int32
+
+func setLogLevel(level string) error {
+	switch strings.ToLower(level) {
+	case "debug":
+		atomic.StoreInt32(&debugLogging, 1)
+	case "info":
+		atomic.StoreInt32(&debugLogging, 0)
+	default:
+		return fmt.Errorf("Unknown log level '%s': valid levels are info, debug", level)
+	}
+	return nil
+}
+
+func logLevel() string {
+	if atomic.LoadInt32(&debugLogging) != 0 {
+		return "debug"
+	}
+	return "info"
+}
+
+func logDebugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&debugLogging) != 0 {
+		log.Printf(format, v...)
+	}
+}
+
+// managementAPI controls the forwarder at runtime. Every request must carry the configured token as an
+// "Authorization: Bearer <token>" header.
+type managementAPI struct {
+	token       string
+	consumption *consumptionGate
+	limiter     *eventRateLimiter
+	output      OutputHandler
+	tail        *eventTail
+}
+
+type ManagementStatus struct {
+	Paused             bool    `json:"paused"`
+	LogLevel           string  `json:"log_level"`
+	MaxEventsPerSecond float64 `json:"max_events_per_second"`
+}
+
+func (m *managementAPI) authorized(r *http.Request) bool {
+	return bearerAuthorized(r, m.token)
+}
+
+// bearerAuthorized reports whether r carries token in an "Authorization: Bearer" header.
+func bearerAuthorized(r *http.Request, token string) bool {
+	expected := "Bearer " + token
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+func (m *managementAPI) status() ManagementStatus {
+	return ManagementStatus{
+		Paused:             m.consumption.Paused(),
+		LogLevel:           logLevel(),
+		MaxEventsPerSecond: m.limiter.Limit(),
+	}
+}
+
+// ServeHTTP handles requests under /management/. GET /management/status returns the current settings and GET
+// /management/tail streams the events sent to the output; POSTs to pause and resume stop and restart event
+// processing, flush rolls over the output's current file, log_level sets the level given in the "level" parameter
+// and rate_limit sets the "events_per_second" parameter (0 for no limit).
+func (m *managementAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !m.authorized(r) {
+		writeJSONError(w, http.StatusUnauthorized, errors.New("missing or invalid API token"))
+		return
+	}
+
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/management"), "/")
+	if action == "status" && r.Method == "GET" {
+		writeJSON(w, http.StatusOK, m.status())
+		return
+	}
+	if action == "tail" && r.Method == "GET" {
+		m.tail.serveTail(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s requires POST", action))
+		return
+	}
+
+	switch action {
+	case "pause":
+		m.consumption.Pause()
+		log.Println("Event processing paused through the management API")
+	case "resume":
+		m.consumption.Resume()
+		log.Println("Event processing resumed through the management API")
+	case "flush":
+		flusher, ok := m.output.(Flusher)
+		if !ok {
+			writeJSONError(w, http.StatusNotImplemented, fmt.Errorf("%s cannot be flushed", m.output.String()))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		if err := flusher.Flush(ctx); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	case "log_level":
+		if err := setLogLevel(r.FormValue("level")); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Printf("Log level set to %s through the management API", logLevel())
+	case "rate_limit":
+		limit, err := strconv.ParseFloat(r.FormValue("events_per_second"), 64)
+		if err != nil || limit < 0 {
+			writeJSONError(w, http.StatusBadRequest,
+				fmt.Errorf("Invalid events_per_second '%s': should be a number, or 0 for no limit",
+					r.FormValue("events_per_second")))
+			return
+		}
+		m.limiter.SetLimit(limit)
+		log.Printf("Output rate limit set to %g events per second through the management API", limit)
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown action '%s'", action))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m.status())
+}
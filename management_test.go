@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func managementRequest(t *testing.T, server *httptest.Server, method, action, token string,
+	params url.Values) (*http.Response, ManagementStatus) {
+	req, err := http.NewRequest(method, server.URL+"/management/"+action, strings.NewReader(params.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var status ManagementStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	return resp, status
+}
+
+func TestManagementAPI(t *testing.T) {
+	defer setLogLevel("info")
+
+	api := &managementAPI{
+		token:       "secret",
+		consumption: &consumptionGate{},
+		limiter:     newEventRateLimiter(0),
+		output:      &NetOutput{},
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	if resp, _ := managementRequest(t, server, "GET", "status", "wrong", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a request with the wrong token to be refused, got %s", resp.Status)
+	}
+	if resp, _ := managementRequest(t, server, "POST", "pause", "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a request without a token to be refused, got %s", resp.Status)
+	}
+	if api.consumption.Paused() {
+		t.Fatal("Unauthorized request paused consumption")
+	}
+
+	if _, status := managementRequest(t, server, "POST", "pause", "secret", nil); !status.Paused {
+		t.Error("Consumption was not paused")
+	}
+	if _, status := managementRequest(t, server, "POST", "resume", "secret", nil); status.Paused {
+		t.Error("Consumption was not resumed")
+	}
+
+	_, status := managementRequest(t, server, "POST", "log_level", "secret", url.Values{"level": {"debug"}})
+	if status.LogLevel != "debug" {
+		t.Errorf("Expected log level debug, got %s", status.LogLevel)
+	}
+	resp, _ := managementRequest(t, server, "POST", "log_level", "secret", url.Values{"level": {"chatty"}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown log level to be rejected, got %s", resp.Status)
+	}
+
+	_, status = managementRequest(t, server, "POST", "rate_limit", "secret", url.Values{"events_per_second": {"250"}})
+	if status.MaxEventsPerSecond != 250 || api.limiter.Limit() != 250 {
+		t.Errorf("Rate limit was not changed: %+v", status)
+	}
+
+	// network outputs have nothing to flush
+	if resp, _ := managementRequest(t, server, "POST", "flush", "secret", nil); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected flush to be unsupported for a network output, got %s", resp.Status)
+	}
+}
+
+func TestProfilingHandler(t *testing.T) {
+	server := httptest.NewServer(&profilingHandler{token: "secret"})
+	defer server.Close()
+
+	get := func(path, token string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("/debug/pprof/heap", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a profile without a token to be refused, got %s", resp.Status)
+	}
+	if resp := get("/debug/pprof/heap", "secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a heap profile, got %s", resp.Status)
+	}
+	if resp := get("/debug/pprof/profile?seconds=0.1", "secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a CPU profile, got %s", resp.Status)
+	}
+	if resp := get("/debug/pprof/nonexistent", "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an unknown profile to be not found, got %s", resp.Status)
+	}
+}
+
+func TestConsumptionGate(t *testing.T) {
+	gate := &consumptionGate{}
+	if err := gate.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	gate.Pause()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := gate.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected Wait to block while paused, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- gate.Wait(context.Background()) }()
+	gate.Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Resume")
+	}
+}
+
+func TestEventRateLimiter(t *testing.T) {
+	limiter := newEventRateLimiter(10)
+	now := time.Now()
+	limiter.last = now
+
+	// the first second's worth of events is let through, then events are spaced 100ms apart
+	for i := 0; i < 10; i++ {
+		if delay := limiter.reserve(now); delay != 0 {
+			t.Fatalf("Event %d delayed by %s within the burst", i, delay)
+		}
+	}
+	if delay := limiter.reserve(now); delay != 100*time.Millisecond {
+		t.Errorf("Expected the event after the burst to wait 100ms, got %s", delay)
+	}
+
+	limiter.SetLimit(0)
+	if delay := limiter.reserve(now); delay != 0 {
+		t.Errorf("Events should not be delayed without a limit, got %s", delay)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the example configuration, documenting every option; migrated configurations are written in its layout
+//
+//go:embed conf/cb-event-forwarder.example.ini
+var exampleConfiguration string
+
+// configMigration translates an option of an older configuration: moving it to NewSection and NewKey, or with
+// neither set, dropping it. Note is written into the migrated configuration to explain the change.
+type configMigration struct {
+	Section    string
+	Key        string
+	NewSection string
+	NewKey     string
+	Note       string
+}
+
+// configMigrations are the options that have changed since 3.x, in the order they are applied.
+var configMigrations = []configMigration{
+	{
+		Section: "bridge",
+		Key:     "message_processor_count",
+		Note: "message_processor_count is no longer used: events are processed by two workers per CPU. " +
+			"Use max_procs to limit the CPUs used.",
+	},
+}
+
+// an option line in the example configuration, commented out or not
+var configOptionLine = regexp.MustCompile(`^(#\s*)?([a-z0-9_]+)\s*=(.*)$`)
+
+// migrateConfig translates the configuration in oldFile to the current format, and writes it to newFile. The result
+// is the example configuration, with its documentation of every option, filled in with the options set in
+// oldFile: each option replaces the example's line for it, options the example doesn't have are added at the end of
+// their section, and the example's own settings that oldFile doesn't have are commented out, so that the forwarder
+// behaves as it did. newFile must not exist; it is parsed afterwards, and any problems with it are returned.
+func migrateConfig(oldFile, newFile string) ([]string, error) {
+	old, err := ini.LoadFile(oldFile)
+	if err != nil {
+		return nil, err
+	}
+	notes := applyConfigMigrations(old)
+
+	var migrated strings.Builder
+	fmt.Fprintf(&migrated, "# Migrated from %s by cb-event-forwarder %s on %s.\n", oldFile, version,
+		time.Now().Format("2006-01-02"))
+	for _, note := range notes {
+		fmt.Fprintf(&migrated, "# %s\n", note)
+	}
+	fmt.Fprintln(&migrated)
+	writeMigratedConfig(&migrated, old, oldFile)
+
+	if newFile == "-" {
+		_, err = io.WriteString(os.Stdout, migrated.String())
+		return notes, err
+	}
+	if _, err := os.Stat(newFile); err == nil {
+		return notes, fmt.Errorf("%s already exists", newFile)
+	}
+	tmpFile := newFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(migrated.String()), 0600); err != nil {
+		return notes, err
+	}
+	if err := os.Rename(tmpFile, newFile); err != nil {
+		os.Remove(tmpFile)
+		return notes, err
+	}
+
+	if _, err := ParseConfig(newFile); err != nil {
+		return notes, fmt.Errorf("%s was written, but is not valid: %s", newFile, err)
+	}
+	return notes, nil
+}
+
+// applyConfigMigrations translates the options in configMigrations, and returns notes of the changes.
+func applyConfigMigrations(file ini.File) []string {
+	var notes []string
+	for _, migration := range configMigrations {
+		section, ok := file[migration.Section]
+		if !ok {
+			continue
+		}
+		val, ok := section[migration.Key]
+		if !ok {
+			continue
+		}
+		delete(section, migration.Key)
+
+		if len(migration.NewKey) > 0 {
+			if _, ok := file[migration.NewSection]; !ok {
+				file[migration.NewSection] = make(ini.Section)
+			}
+			file[migration.NewSection][migration.NewKey] = val
+		}
+		notes = append(notes, fmt.Sprintf("[%s] %s=%s: %s", migration.Section, migration.Key, val, migration.Note))
+	}
+	return notes
+}
+
+// writeMigratedConfig writes the example configuration filled in with the options in file.
+func writeMigratedConfig(w io.Writer, file ini.File, oldFile string) {
+	written := make(map[string]map[string]bool)
+	section := ""
+
+	// the options of section that weren't in the example are added at its end
+	finishSection := func() {
+		var extra []string
+		for key := range file[section] {
+			if !written[section][key] {
+				extra = append(extra, key)
+			}
+		}
+		if len(extra) == 0 {
+			return
+		}
+		sort.Strings(extra)
+		fmt.Fprintf(w, "# from %s\n", oldFile)
+		for _, key := range extra {
+			fmt.Fprintf(w, "%s=%s\n", key, file[section][key])
+		}
+		fmt.Fprintln(w)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(exampleConfiguration))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			finishSection()
+			section = strings.Trim(trimmed, "[]")
+			written[section] = make(map[string]bool)
+			fmt.Fprintln(w, line)
+			continue
+		}
+
+		match := configOptionLine.FindStringSubmatch(line)
+		if match == nil {
+			fmt.Fprintln(w, line)
+			continue
+		}
+		key, commented := match[2], len(match[1]) > 0
+		if val, ok := file[section][key]; ok && !written[section][key] {
+			written[section][key] = true
+			fmt.Fprintf(w, "%s=%s\n", key, val)
+		} else if commented {
+			fmt.Fprintln(w, line)
+		} else {
+			// the forwarder's default applies to what the old configuration didn't set
+			fmt.Fprintf(w, "# %s\n", line)
+		}
+	}
+	finishSection()
+
+	// sections the example doesn't have, such as the indicator lists' own
+	var extra []string
+	for name := range file {
+		if _, ok := written[name]; !ok && len(name) > 0 && len(file[name]) > 0 {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		section = name
+		written[section] = make(map[string]bool)
+		fmt.Fprintf(w, "\n[%s]\n", section)
+		finishSection()
+	}
+}
+
+// migrateConfigCommand runs -migrate-config, reporting on standard error.
+func migrateConfigCommand(oldFile, newFile string) error {
+	notes, err := migrateConfig(oldFile, newFile)
+	for _, note := range notes {
+		fmt.Fprintln(os.Stderr, note)
+	}
+	if err != nil {
+		return err
+	}
+	if newFile != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote %s; check it, then replace %s with it\n", newFile, oldFile)
+	}
+	return nil
+}
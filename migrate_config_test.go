@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/vaughan0/go-ini"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const oldTestConfiguration = `[bridge]
+message_processor_count=4
+server_name=cbtest
+debug=1
+rabbit_mq_username=cb
+rabbit_mq_password=secret
+cb_server_hostname=cb.example.com
+output_type=file
+outfile=/var/cb/data/event_bridge_output.json
+output_format=json
+events_watchlist=ALL
+undocumented_option=yes
+
+[syslog]
+tls_verify=false
+
+[site]
+name=datacenter-1
+`
+
+func TestMigrateConfig(t *testing.T) {
+	dir := t.TempDir()
+	oldFile, newFile := filepath.Join(dir, "old.conf"), filepath.Join(dir, "new.conf")
+	ioutil.WriteFile(oldFile, []byte(oldTestConfiguration), 0600)
+
+	notes, err := migrateConfig(oldFile, newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || !strings.Contains(notes[0], "message_processor_count") {
+		t.Errorf("Expected a note about message_processor_count, got %v", notes)
+	}
+
+	contents, _ := ioutil.ReadFile(newFile)
+	migrated := string(contents)
+	for _, expected := range []string{
+		"server_name=cbtest\n",
+		"cb_server_hostname=cb.example.com\n",
+		// the example's own settings that weren't in the old configuration are commented out
+		"# events_raw_sensor=ALL\n",
+		// and the documentation of options that weren't set is kept
+		"# heartbeat_interval=5m\n",
+		"# from " + oldFile + "\nundocumented_option=yes\n",
+		"\n[site]\n",
+	} {
+		if !strings.Contains(migrated, expected) {
+			t.Errorf("Expected the migrated configuration to contain %q", expected)
+		}
+	}
+
+	// the migrated configuration has the same options, in the same sections, apart from those migrated
+	input, err := ini.Load(strings.NewReader(migrated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := ini.Load(strings.NewReader(oldTestConfiguration))
+	for name, section := range old {
+		for key, val := range section {
+			if key == "message_processor_count" {
+				if _, ok := input.Get(name, key); ok {
+					t.Errorf("Expected message_processor_count to be removed")
+				}
+				continue
+			}
+			if migratedVal, ok := input.Get(name, key); !ok || migratedVal != val {
+				t.Errorf("Expected [%s] %s=%s, got %s", name, key, val, migratedVal)
+			}
+		}
+	}
+	for name, section := range input {
+		for key := range section {
+			if _, ok := old.Get(name, key); !ok {
+				t.Errorf("Unexpected [%s] %s in the migrated configuration", name, key)
+			}
+		}
+	}
+
+	// an existing file isn't overwritten
+	if _, err := migrateConfig(oldFile, newFile); err == nil {
+		t.Errorf("Expected migrating to an existing file to fail")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// shadowQueueSize is the number of events the shadow output can fall behind by before events are dropped for it.
+const shadowQueueSize = 1000
+
+// mirrorOutput sends each event to the shadow output as well as the main output while a migration is being checked,
+// and counts where the two diverge: events the shadow output was sent, dropped because it had fallen behind, and the
+// errors each output reported. The shadow output never holds up the main output, and is shut down at until.
+type mirrorOutput struct {
+	shadow OutputHandler
+	until  time.Time
+
+	in             <-chan string
+	primary        chan string
+	primaryErrors  chan error
+	report         chan<- error
+	shadowMessages chan string
+	shadowErrors   chan error
+
+	// the event taken from in that the main output hasn't accepted yet
+	held    string
+	holding bool
+
+	primaryEvents   int64
+	primaryFailures int64
+	shadowEvents    int64
+	shadowDropped   int64
+	shadowFailures  int64
+	lastShadowError string
+	ended           bool
+
+	stop          chan struct{}
+	done          chan struct{}
+	shadowStopped chan struct{}
+	sync.Mutex
+}
+
+type MirrorOutputStatistics struct {
+	Until            time.Time   `json:"until"`
+	Ended            bool        `json:"ended"`
+	Shadow           string      `json:"shadow_output"`
+	PrimaryEvents    int64       `json:"primary_events"`
+	ShadowEvents     int64       `json:"shadow_events"`
+	ShadowDropped    int64       `json:"shadow_dropped_events"`
+	EventDifference  int64       `json:"event_difference"`
+	PrimaryErrors    int64       `json:"primary_errors"`
+	ShadowErrors     int64       `json:"shadow_errors"`
+	LastShadowError  string      `json:"last_shadow_error,omitempty"`
+	ShadowStatistics interface{} `json:"shadow_status,omitempty"`
+}
+
+// newMirrorOutput initializes the shadow output that events will be copied to until until.
+func newMirrorOutput(outputType, parameters string, until time.Time) (*mirrorOutput, error) {
+	registration, ok := LookupOutput(outputType)
+	if !ok {
+		return nil, errors.New("No valid output handler found (" + outputType + ")")
+	}
+
+	shadow := registration.Factory()
+	if err := shadow.Initialize(parameters); err != nil {
+		return nil, err
+	}
+
+	return &mirrorOutput{
+		shadow:         shadow,
+		until:          until,
+		primary:        make(chan string),
+		primaryErrors:  make(chan error),
+		shadowMessages: make(chan string, shadowQueueSize),
+		shadowErrors:   make(chan error),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+		shadowStopped:  make(chan struct{}),
+	}, nil
+}
+
+// Go starts the shadow output and copies events from in to it. It returns the channels the main output should read
+// its events from and report its errors to; errors from the main output are passed on to report.
+func (m *mirrorOutput) Go(ctx context.Context, in <-chan string, report chan<- error) (<-chan string, chan<- error,
+	error) {
+	m.in, m.report = in, report
+
+	if err := m.shadow.Go(ctx, m.shadowMessages, m.shadowErrors); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Sending events to shadow output %s until %s", m.shadow.String(), m.until)
+
+	go m.forwardErrors()
+	go m.run()
+	return m.primary, m.primaryErrors, nil
+}
+
+// Shutdown passes on the events already queued for the main output, and stops the shadow output. The main output is
+// stopped by its own Shutdown afterwards.
+func (m *mirrorOutput) Shutdown() {
+	close(m.stop)
+	<-m.done
+
+	m.Lock()
+	ended := m.ended
+	m.Unlock()
+	if !ended {
+		m.stopShadow()
+	}
+	<-m.shadowStopped
+}
+
+func (m *mirrorOutput) Statistics() interface{} {
+	m.Lock()
+	defer m.Unlock()
+
+	stats := MirrorOutputStatistics{
+		Until:           m.until,
+		Ended:           m.ended,
+		Shadow:          m.shadow.String(),
+		PrimaryEvents:   m.primaryEvents,
+		ShadowEvents:    m.shadowEvents,
+		ShadowDropped:   m.shadowDropped,
+		EventDifference: m.primaryEvents - m.shadowEvents,
+		PrimaryErrors:   m.primaryFailures,
+		ShadowErrors:    m.shadowFailures,
+		LastShadowError: m.lastShadowError,
+	}
+	if !m.ended {
+		stats.ShadowStatistics = m.shadow.Statistics()
+	}
+	return stats
+}
+
+func (m *mirrorOutput) run() {
+	defer close(m.done)
+
+	end := time.NewTimer(time.Until(m.until))
+	defer end.Stop()
+
+	for {
+		receive, send := m.in, m.primary
+		if m.holding {
+			receive = nil
+		} else {
+			send = nil
+		}
+
+		select {
+		case <-m.stop:
+			m.passOn()
+			return
+		case message := <-receive:
+			m.held, m.holding = message, true
+			m.mirror(message)
+		case send <- m.held:
+			m.sent()
+		case <-end.C:
+			m.Lock()
+			m.ended = true
+			m.Unlock()
+
+			log.Printf("Shadow output period ended; no longer sending events to %s", m.shadow.String())
+			go m.stopShadow()
+		}
+	}
+}
+
+// mirror copies message to the shadow output, unless it has fallen too far behind.
+func (m *mirrorOutput) mirror(message string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.ended {
+		return
+	}
+	select {
+	case m.shadowMessages <- message:
+		m.shadowEvents++
+	default:
+		m.shadowDropped++
+	}
+}
+
+func (m *mirrorOutput) sent() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.held, m.holding = "", false
+	m.primaryEvents++
+}
+
+func (m *mirrorOutput) stopShadow() {
+	defer close(m.shadowStopped)
+
+	if err := m.shadow.Shutdown(); err != nil {
+		log.Printf("Error shutting down shadow output %s: %s", m.shadow.String(), err)
+	}
+}
+
+// forwardErrors counts the errors from both outputs. Those from the main output are passed on; those from the
+// shadow output are only logged, so they can't affect the main output.
+func (m *mirrorOutput) forwardErrors() {
+	// the main output's errors are passed on until the mirror stops, and the shadow output's until it has stopped
+	primaryErrors, done := m.primaryErrors, m.done
+	shadowErrors, shadowStopped := m.shadowErrors, m.shadowStopped
+
+	for primaryErrors != nil || shadowErrors != nil {
+		select {
+		case err := <-primaryErrors:
+			m.Lock()
+			m.primaryFailures++
+			m.Unlock()
+
+			select {
+			case m.report <- err:
+			case <-done:
+			}
+		case err := <-shadowErrors:
+			m.Lock()
+			m.shadowFailures++
+			m.lastShadowError = err.Error()
+			m.Unlock()
+
+			log.Printf("Error from shadow output %s: %s", m.shadow.String(), err)
+		case <-done:
+			primaryErrors, done = nil, nil
+		case <-shadowStopped:
+			shadowErrors, shadowStopped = nil, nil
+		}
+	}
+}
+
+// passOn sends the events already queued for the output to it, so that it writes them when it shuts down.
+func (m *mirrorOutput) passOn() {
+	deadline := time.After(outputShutdownTimeout)
+	send := func(message string) error {
+		select {
+		case m.primary <- message:
+			m.sent()
+			return nil
+		case <-deadline:
+			return errors.New("the output did not take it")
+		}
+	}
+
+	if m.holding {
+		if err := send(m.held); err != nil {
+			log.Printf("Dropping queued events: %s", err)
+			return
+		}
+	}
+	err := drainMessages(m.in, func(message string) error {
+		m.mirror(message)
+		return send(message)
+	})
+	if err != nil {
+		log.Printf("Dropping queued events: %s", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorOutputCopiesEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shadowFile := filepath.Join(dir, "shadow.json")
+
+	m, err := newMirrorOutput(FileOutputType, shadowFile, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan string, 10)
+	primary, _, err := m.Go(context.Background(), in, make(chan error))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in <- "first"
+	in <- "second"
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case message := <-primary:
+			if message != expected {
+				t.Errorf("Expected %s, got %s", expected, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("The event was not passed to the main output")
+		}
+	}
+
+	m.Shutdown()
+	stats := m.Statistics().(MirrorOutputStatistics)
+	if stats.PrimaryEvents != 2 || stats.ShadowEvents != 2 || stats.EventDifference != 0 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+	contents, err := ioutil.ReadFile(shadowFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "first\nsecond\n" {
+		t.Errorf("Unexpected shadow output %q", contents)
+	}
+
+	if _, err := parseDateOrTime("2026-12-31"); err != nil {
+		t.Error(err)
+	}
+	if _, err := parseDateOrTime("next week"); err == nil {
+		t.Error("Expected an error for an invalid date")
+	}
+}
+
+func TestShadowOutputPaths(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	base := "[bridge]\nrabbit_mq_password=guest\noutput_type=s3\ns3out=cb-events\nshadow_output_type=s3\n" +
+		"shadow_until=2026-12-31\n"
+	dir := writeConfigFiles(t, map[string]string{
+		"shared.conf": base + "shadow_output=cb-events-new\n",
+		"own.conf":    base + "shadow_output=/var/cb/data/event-forwarder-shadow:us-east-1:cb-events-new\n",
+	})
+
+	// both would default to the same holding area
+	if _, err := ParseConfig(filepath.Join(dir, "shared.conf")); err == nil || !strings.Contains(err.Error(),
+		"/var/cb/data/event-forwarder (the files of shadow_output_type) is already used by the files of output_type") {
+		t.Errorf("Expected the shadow output's holding area to be refused, got %v", err)
+	}
+	if _, err := ParseConfig(filepath.Join(dir, "own.conf")); err != nil {
+		t.Errorf("Expected a shadow output with its own holding area to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The MessagePack encoding used by the Fluentd forward protocol; only the types that appear in events (and in the
+// protocol's own messages) are supported. See https://github.com/msgpack/msgpack/blob/master/spec.md
+
+func appendMsgpack(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int:
+		return appendMsgpackInt(b, int64(v))
+	case int32:
+		return appendMsgpackInt(b, int64(v))
+	case int64:
+		return appendMsgpackInt(b, v)
+	case uint32:
+		return appendMsgpackInt(b, int64(v))
+	case uint64:
+		if v > math.MaxInt64 {
+			return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+		}
+		return appendMsgpackInt(b, int64(v))
+	case float32:
+		return appendMsgpackFloat(b, float64(v))
+	case float64:
+		return appendMsgpackFloat(b, v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i)
+		}
+		if f, err := v.Float64(); err == nil {
+			return appendMsgpackFloat(b, f)
+		}
+		return appendMsgpackString(b, v.String())
+	case string:
+		return appendMsgpackString(b, v)
+	case []byte:
+		return appendMsgpackBinary(b, v)
+	case []string:
+		b = appendMsgpackArrayHeader(b, len(v))
+		for _, item := range v {
+			b = appendMsgpackString(b, item)
+		}
+		return b
+	case []interface{}:
+		b = appendMsgpackArrayHeader(b, len(v))
+		for _, item := range v {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case map[string]interface{}:
+		b = appendMsgpackMapHeader(b, len(v))
+		for key, item := range v {
+			b = appendMsgpackString(b, key)
+			b = appendMsgpack(b, item)
+		}
+		return b
+	}
+	return appendMsgpackString(b, fmt.Sprint(value))
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+}
+
+func appendMsgpackFloat(b []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackBinary(b []byte, data []byte) []byte {
+	switch n := len(data); {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, data...)
+}
+
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+}
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+}
+
+// readMsgpack decodes one value: maps are returned as map[string]interface{} (other keys are formatted as strings),
+// arrays as []interface{}, integers as int64, floats as float64, strings as string and binary data as []byte.
+// Extension types, such as Fluentd's EventTime, are returned as []byte.
+func readMsgpack(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(r, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(r, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		data, err := readMsgpackBytes(r, int(c&0x1f))
+		return string(data), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readMsgpackLength(r, c-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, n)
+	case 0xca:
+		bits, err := readMsgpackUint(r, 4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := readMsgpackUint(r, 8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		i, err := readMsgpackUint(r, 1<<(c-0xcc))
+		return int64(i), err
+	case 0xd0:
+		i, err := readMsgpackUint(r, 1)
+		return int64(int8(i)), err
+	case 0xd1:
+		i, err := readMsgpackUint(r, 2)
+		return int64(int16(i)), err
+	case 0xd2:
+		i, err := readMsgpackUint(r, 4)
+		return int64(int32(i)), err
+	case 0xd3:
+		i, err := readMsgpackUint(r, 8)
+		return int64(i), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// fixext: a type byte and 1, 2, 4, 8 or 16 bytes of data
+		return readMsgpackBytes(r, 1+(1<<(c-0xd4)))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readMsgpackLength(r, c-0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, 1+n)
+	case 0xd9, 0xda, 0xdb:
+		n, err := readMsgpackLength(r, c-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readMsgpackBytes(r, n)
+		return string(data), err
+	case 0xdc, 0xdd:
+		n, err := readMsgpackLength(r, c-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n)
+	case 0xde, 0xdf:
+		n, err := readMsgpackLength(r, c-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n)
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%02x", c)
+}
+
+// readMsgpackLength reads a length of 1, 2 or 4 bytes, for size 0, 1 or 2.
+func readMsgpackLength(r *bufio.Reader, size byte) (int, error) {
+	n, err := readMsgpackUint(r, 1<<size)
+	if err == nil && n > math.MaxInt32 {
+		err = errors.New("MessagePack value too large")
+	}
+	return int(n), err
+}
+
+func readMsgpackUint(r *bufio.Reader, size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func readMsgpackBytes(r *bufio.Reader, n int) ([]byte, error) {
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+func readMsgpackArray(r *bufio.Reader, n int) ([]interface{}, error) {
+	items := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		item, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := key.(string); ok {
+			m[s] = value
+		} else {
+			m[fmt.Sprint(key)] = value
+		}
+	}
+	return m, nil
+}
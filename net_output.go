@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -27,21 +28,72 @@ type NetOutput struct {
 	droppedEventCount           int64
 	droppedEventSinceConnection int64
 
+	// archives events while the connection is down, if output_archive_directory is set
+	fallback *outputFallback
+
+	loop *outputLoop
 	sync.RWMutex
 }
 
+// TCPOutput and UDPOutput are configured with just (hostname/IP):(port); the protocol is implied by the output type.
+type TCPOutput struct {
+	NetOutput
+}
+
+type UDPOutput struct {
+	NetOutput
+}
+
+func (o *TCPOutput) Initialize(netConn string) error {
+	return o.NetOutput.Initialize("tcp:" + netConn)
+}
+
+func (o *UDPOutput) Initialize(netConn string) error {
+	return o.NetOutput.Initialize("udp:" + netConn)
+}
+
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         TCPOutputType,
+		ParameterKey: "tcpout",
+		StatusType:   "net",
+		Archives:     true,
+		Factory:      func() OutputHandler { return &TCPOutput{} },
+	})
+	RegisterOutput(OutputRegistration{
+		Name:         UDPOutputType,
+		ParameterKey: "udpout",
+		StatusType:   "net",
+		Archives:     true,
+		Factory:      func() OutputHandler { return &UDPOutput{} },
+	})
+}
+
 type NetStatistics struct {
 	LastOpenTime      time.Time `json:"last_open_time"`
 	Protocol          string    `json:"connection_protocol"`
 	RemoteHostname    string    `json:"remote_hostname"`
 	DroppedEventCount int64     `json:"dropped_event_count"`
 	Connected         bool      `json:"connected"`
+
+	Archive *OutputFallbackStatistics `json:"archive,omitempty"`
 }
 
 // Initialize() expects a connection string in the following format:
 // (protocol):(hostname/IP):(port)
 // for example: tcp:destination.server.example.com:512
 func (o *NetOutput) Initialize(netConn string) error {
+	if o.fallback == nil {
+		var err error
+		if o.fallback, err = newOutputFallback(netConn); err != nil {
+			return err
+		}
+	}
+	return o.connect(context.Background(), netConn)
+}
+
+// connect (re)opens the connection described by netConn. The dial is abandoned if ctx is cancelled.
+func (o *NetOutput) connect(ctx context.Context, netConn string) error {
 	o.Lock()
 	defer o.Unlock()
 
@@ -61,7 +113,7 @@ func (o *NetOutput) Initialize(netConn string) error {
 	}
 
 	var err error
-	o.outputSocket, err = net.Dial(o.protocolName, o.remoteHostname)
+	o.outputSocket, err = dialContext(ctx, o.protocolName, o.remoteHostname)
 
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error connecting to '%s': %s", netConn, err))
@@ -116,18 +168,23 @@ func (o *NetOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return NetStatistics{
+	stats := NetStatistics{
 		LastOpenTime:      o.connectTime,
 		Protocol:          o.protocolName,
 		RemoteHostname:    o.remoteHostname,
 		DroppedEventCount: o.droppedEventCount,
 		Connected:         o.connected,
 	}
+	if o.fallback != nil {
+		archive := o.fallback.Statistics()
+		stats.Archive = &archive
+	}
+	return stats
 }
 
 func (o *NetOutput) output(m string) error {
-	if o.addNewline {
-		m = m + "\r\n"
+	if o.fallback != nil {
+		return o.fallback.Send(m, o.connected, o.write)
 	}
 
 	if !o.connected {
@@ -135,6 +192,13 @@ func (o *NetOutput) output(m string) error {
 		atomic.AddInt64(&o.droppedEventCount, 1)
 		return nil
 	}
+	return o.write(m)
+}
+
+func (o *NetOutput) write(m string) error {
+	if o.addNewline {
+		m = m + "\r\n"
+	}
 
 	_, err := o.outputSocket.Write([]byte(m))
 	if err != nil {
@@ -143,12 +207,27 @@ func (o *NetOutput) output(m string) error {
 	return err
 }
 
-func (o *NetOutput) Go(messages <-chan string, errorChan chan<- error) error {
+func (o *NetOutput) Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error {
 	if o.outputSocket == nil {
 		return errors.New("Output socket not open")
 	}
 
+	o.loop = newOutputLoop(ctx)
+
 	go func() {
+		// don't let a write blocked on an unresponsive peer hold up shutdown indefinitely
+		<-o.loop.ctx.Done()
+
+		o.RLock()
+		defer o.RUnlock()
+		if o.connected {
+			o.outputSocket.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		}
+	}()
+
+	go func() {
+		defer o.loop.exited()
+
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer refreshTicker.Stop()
 
@@ -159,18 +238,25 @@ func (o *NetOutput) Go(messages <-chan string, errorChan chan<- error) error {
 
 		for {
 			select {
+			case <-o.loop.ctx.Done():
+				if err := drainMessages(messages, o.output); err != nil {
+					log.Printf("Error writing to %s during shutdown: %s", o.String(), err)
+				}
+				return
+
 			case message := <-messages:
 				if err := o.output(message); err != nil {
 					errorChan <- err
 				}
 
-			case <-refreshTicker.C:
-				if !o.connected && time.Now().After(o.reconnectTime) {
-					err := o.Initialize(o.netConn)
+			case now := <-refreshTicker.C:
+				if !o.connected && now.After(o.reconnectTime) && !o.fallback.Open(now) {
+					err := o.connect(o.loop.ctx, o.netConn)
 					if err != nil {
 						o.closeAndScheduleReconnection()
 					}
 				}
+				o.fallback.Replay(o.connected, o.write)
 			}
 		}
 
@@ -178,3 +264,17 @@ func (o *NetOutput) Go(messages <-chan string, errorChan chan<- error) error {
 
 	return nil
 }
+
+func (o *NetOutput) Shutdown() error {
+	o.loop.Shutdown()
+	o.fallback.Close()
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.connected = false
+		return o.outputSocket.Close()
+	}
+	return nil
+}
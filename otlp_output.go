@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP protocols, as in OTEL_EXPORTER_OTLP_PROTOCOL
+const (
+	OTLPGRPC         = "grpc"
+	OTLPHTTPProtobuf = "http/protobuf"
+	OTLPHTTPJSON     = "http/json"
+)
+
+const (
+	otlpLogsPath = "/v1/logs"
+	otlpGRPCPath = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+
+	// SeverityNumber values
+	otlpSeverityInfo = 9
+	otlpSeverityWarn = 13
+)
+
+// OTLPOutput exports events as OpenTelemetry log records, over OTLP/HTTP (protobuf or JSON) or OTLP/gRPC, to an
+// OpenTelemetry Collector or any other OTLP receiver. Each event becomes a log record whose body is the formatted
+// event, with the event's type as its event name, its timestamp as its time, and its fields as attributes. Events
+// are exported in batches of up to batchSize, or whatever has arrived within batchWait of the first. A batch the
+// receiver can't take is exported again until it is accepted, holding up processing meanwhile, as the OTLP
+// specification asks of the throttling and retryable responses; a batch it rejects is dropped.
+type OTLPOutput struct {
+	url       string
+	protocol  string
+	client    *http.Client
+	resource  []otlpKeyValue
+	batchSize int
+	batchWait time.Duration
+
+	sentEvents     int64
+	sentBatches    int64
+	droppedEvents  int64
+	rejectedEvents int64
+	retries        int64
+	lastError      string
+	lastSendTime   time.Time
+
+	loop *outputLoop
+	sync.RWMutex
+}
+
+type OTLPStatistics struct {
+	URL            string    `json:"url"`
+	Protocol       string    `json:"protocol"`
+	SentEvents     int64     `json:"sent_events"`
+	SentBatches    int64     `json:"sent_batches"`
+	DroppedEvents  int64     `json:"dropped_event_count"`
+	RejectedEvents int64     `json:"rejected_event_count"`
+	Retries        int64     `json:"retries"`
+	LastSendTime   time.Time `json:"last_send_time"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// otlpKeyValue is an attribute. Value is a string, bool, int64, float64, []interface{} (of these) or []otlpKeyValue
+// (a map), or nil for an empty value.
+type otlpKeyValue struct {
+	Key   string
+	Value interface{}
+}
+
+type otlpLogRecord struct {
+	Time         time.Time
+	ObservedTime time.Time
+	Severity     int
+	SeverityText string
+	EventName    string
+	Body         string
+	Attributes   []otlpKeyValue
+}
+
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         OTLPOutputType,
+		ParameterKey: "otlpout",
+		StatusType:   "otlp",
+		Factory:      func() OutputHandler { return &OTLPOutput{} },
+	})
+}
+
+// Initialize expects the receiver's URL, for example http://otel-collector.example.com:4318 for OTLP/HTTP or
+// http://otel-collector.example.com:4317 for OTLP/gRPC (https for a receiver using TLS). With OTLP/HTTP, /v1/logs
+// is added unless the URL already has a path. The options in the [otlp] section are read from the configuration.
+func (o *OTLPOutput) Initialize(location string) error {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("Invalid OTLP URL '%s': should look like http://otel-collector.example.com:4318", location)
+	}
+
+	o.protocol = config.OTLPProtocol
+	if len(o.protocol) == 0 {
+		o.protocol = OTLPHTTPProtobuf
+	}
+	transport := httpTransport()
+	if o.protocol == OTLPGRPC {
+		u.Path = strings.TrimSuffix(u.Path, "/") + otlpGRPCPath
+		transport = grpcTransport()
+	} else if len(strings.Trim(u.Path, "/")) == 0 {
+		u.Path = otlpLogsPath
+	}
+	o.url = u.String()
+	o.client = &http.Client{Timeout: config.OTLPTimeout, Transport: transport}
+
+	o.resource = otlpResource()
+	o.batchSize = config.OTLPBatchSize
+	if o.batchSize <= 0 {
+		o.batchSize = 512
+	}
+	o.batchWait = config.OTLPBatchWait
+	if o.batchWait <= 0 {
+		o.batchWait = time.Second
+	}
+	return nil
+}
+
+// grpcTransport returns a transport for OTLP/gRPC, which needs HTTP/2 whatever the http2 option says: negotiated
+// with TLS for https URLs, and spoken from the start (h2c) for http URLs, as gRPC clients do.
+func grpcTransport() *http.Transport {
+	transport := httpTransport().Clone()
+	transport.TLSNextProto = nil
+	transport.ForceAttemptHTTP2 = true
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}
+
+// otlpResource returns the attributes of the resource the log records come from: the forwarder, on this host.
+func otlpResource() []otlpKeyValue {
+	attributes := map[string]string{
+		"service.name":    config.OTLPServiceName,
+		"service.version": version,
+	}
+	if len(attributes["service.name"]) == 0 {
+		attributes["service.name"] = "cb-event-forwarder"
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		attributes["host.name"] = hostname
+	}
+	if len(config.ServerName) > 0 {
+		attributes["cb.server"] = config.ServerName
+	}
+	for key, value := range config.OTLPResourceAttributes {
+		attributes[key] = value
+	}
+
+	resource := make([]otlpKeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		resource = append(resource, otlpKeyValue{Key: key, Value: value})
+	}
+	sort.Slice(resource, func(i, j int) bool { return resource[i].Key < resource[j].Key })
+	return resource
+}
+
+func (o *OTLPOutput) Key() string {
+	return o.url
+}
+
+func (o *OTLPOutput) String() string {
+	return "OTLP " + o.url
+}
+
+func (o *OTLPOutput) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return OTLPStatistics{
+		URL:            o.url,
+		Protocol:       o.protocol,
+		SentEvents:     o.sentEvents,
+		SentBatches:    o.sentBatches,
+		DroppedEvents:  o.droppedEvents,
+		RejectedEvents: o.rejectedEvents,
+		Retries:        o.retries,
+		LastSendTime:   o.lastSendTime,
+		LastError:      o.lastError,
+	}
+}
+
+func (o *OTLPOutput) Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error {
+	if o.client == nil {
+		return errors.New("OTLP output not initialized")
+	}
+
+	o.loop = newOutputLoop(ctx)
+	sender := &batchSender{
+		loop:    o.loop,
+		size:    o.batchSize,
+		wait:    o.batchWait,
+		name:    o.String(),
+		send:    o.send,
+		retried: o.retried,
+		dropped: o.dropped,
+	}
+	go sender.run(messages, errorChan)
+
+	return nil
+}
+
+func (o *OTLPOutput) retried(err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.retries++
+	o.lastError = err.Error()
+}
+
+func (o *OTLPOutput) dropped(events int, err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.droppedEvents += int64(events)
+	o.lastError = err.Error()
+}
+
+// send exports batch. Errors worth exporting the batch again for are reported with retry set: failed requests, and
+// the responses the OTLP specification lists as retryable.
+func (o *OTLPOutput) send(ctx context.Context, batch []string) (retry bool, err error) {
+	records := make([]otlpLogRecord, len(batch))
+	now := time.Now()
+	for i, message := range batch {
+		records[i] = otlpRecord(message, now)
+	}
+
+	var body []byte
+	if o.protocol == OTLPHTTPJSON {
+		if body, err = json.Marshal(otlpRequestJSON(o.resource, records)); err != nil {
+			return false, err
+		}
+	} else {
+		body = otlpRequestProtobuf(o.resource, records)
+	}
+
+	var rejected int64
+	var message string
+	if o.protocol == OTLPGRPC {
+		rejected, message, retry, err = o.exportGRPC(ctx, body)
+	} else {
+		rejected, message, retry, err = o.exportHTTP(ctx, body)
+	}
+	if err != nil {
+		return retry, err
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	o.sentEvents += int64(len(batch)) - rejected
+	o.sentBatches++
+	o.lastSendTime = time.Now()
+	if rejected > 0 {
+		// a partial success: the receiver took the rest of the batch, and these shouldn't be sent again
+		o.rejectedEvents += rejected
+		o.lastError = fmt.Sprintf("%d events rejected: %s", rejected, message)
+		log.Printf("%s rejected %d events: %s", o.String(), rejected, message)
+	}
+	return false, nil
+}
+
+func (o *OTLPOutput) newRequest(ctx context.Context, contentType string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range config.OTLPHeaders {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+func (o *OTLPOutput) exportHTTP(ctx context.Context, body []byte) (int64, string, bool, error) {
+	contentType := "application/x-protobuf"
+	if o.protocol == OTLPHTTPJSON {
+		contentType = "application/json"
+	}
+	gzipped := config.OTLPCompression == "gzip"
+	if gzipped {
+		body = gzipBytes(body)
+	}
+
+	req, err := o.newRequest(ctx, contentType, body)
+	if err != nil {
+		return 0, "", false, err
+	}
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return 0, "", true, err
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("OTLP receiver returned %s: %s", resp.Status, otlpHTTPErrorMessage(response))
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return 0, "", true, err
+		}
+		return 0, "", false, err
+	}
+
+	if o.protocol == OTLPHTTPJSON {
+		var partial struct {
+			PartialSuccess struct {
+				RejectedLogRecords json.Number `json:"rejectedLogRecords"`
+				ErrorMessage       string      `json:"errorMessage"`
+			} `json:"partialSuccess"`
+		}
+		if json.Unmarshal(response, &partial) == nil {
+			var rejected int64
+			if s := strings.Trim(partial.PartialSuccess.RejectedLogRecords.String(), `"`); len(s) > 0 {
+				rejected, _ = strconv.ParseInt(s, 10, 64)
+			}
+			return rejected, partial.PartialSuccess.ErrorMessage, false, nil
+		}
+		return 0, "", false, nil
+	}
+	rejected, message := otlpPartialSuccess(response)
+	return rejected, message, false, nil
+}
+
+// otlpHTTPErrorMessage returns the message of the google.rpc.Status an OTLP/HTTP receiver sends with an error, or
+// the response as it is if it is not one.
+func otlpHTTPErrorMessage(response []byte) string {
+	var status struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(response, &status) == nil && len(status.Message) > 0 {
+		return status.Message
+	}
+	var message string
+	scanProtobufFields(response, func(field, wireType int, value uint64, data []byte) {
+		if field == 2 && wireType == pbWireLengthDelimited {
+			message = string(data)
+		}
+	})
+	if len(message) > 0 {
+		return message
+	}
+	return strings.TrimSpace(string(response))
+}
+
+// grpc-status codes that OTLP exporters retry
+var otlpRetryableGRPCStatus = map[string]bool{
+	"1":  true, // CANCELLED
+	"4":  true, // DEADLINE_EXCEEDED
+	"8":  true, // RESOURCE_EXHAUSTED, sent by receivers shedding load
+	"10": true, // ABORTED
+	"11": true, // OUT_OF_RANGE
+	"14": true, // UNAVAILABLE
+	"15": true, // DATA_LOSS
+}
+
+// exportGRPC makes the LogsService/Export call: the request is sent as a single length-prefixed message, and the
+// call's status read from the grpc-status trailer (or header, for a response without a body).
+func (o *OTLPOutput) exportGRPC(ctx context.Context, body []byte) (int64, string, bool, error) {
+	frame := make([]byte, 5, 5+len(body))
+	gzipped := config.OTLPCompression == "gzip"
+	if gzipped {
+		body = gzipBytes(body)
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+	frame = append(frame, body...)
+
+	req, err := o.newRequest(ctx, "application/grpc", frame)
+	if err != nil {
+		return 0, "", false, err
+	}
+	req.Header.Set("TE", "trailers")
+	if gzipped {
+		req.Header.Set("grpc-encoding", "gzip")
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return 0, "", true, err
+	}
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return 0, "", true, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", resp.StatusCode/100 == 5, fmt.Errorf("OTLP receiver returned %s", resp.Status)
+	}
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	if status != "0" {
+		err = fmt.Errorf("OTLP receiver returned gRPC status %s: %s", status, message)
+		return 0, "", otlpRetryableGRPCStatus[status], err
+	}
+
+	if len(response) < 5 || response[0] != 0 {
+		// no response message (or a compressed one, which only counts partial successes), so the whole batch was
+		// accepted
+		return 0, "", false, nil
+	}
+	length := binary.BigEndian.Uint32(response[1:5])
+	if int(length) > len(response)-5 {
+		return 0, "", false, nil
+	}
+	rejected, message := otlpPartialSuccess(response[5 : 5+length])
+	return rejected, message, false, nil
+}
+
+// otlpPartialSuccess reads the partial_success of an ExportLogsServiceResponse.
+func otlpPartialSuccess(response []byte) (rejected int64, message string) {
+	scanProtobufFields(response, func(field, wireType int, value uint64, data []byte) {
+		if field != 1 || wireType != pbWireLengthDelimited {
+			return
+		}
+		scanProtobufFields(data, func(field, wireType int, value uint64, data []byte) {
+			switch {
+			case field == 1 && wireType == pbWireVarint:
+				rejected = int64(value)
+			case field == 2 && wireType == pbWireLengthDelimited:
+				message = string(data)
+			}
+		})
+	})
+	return rejected, message
+}
+
+func gzipBytes(data []byte) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+// otlpRecord maps a formatted event to a log record. Watchlist, feed and alert hits are given WARN severity, and
+// other events INFO.
+func otlpRecord(message string, now time.Time) otlpLogRecord {
+	record := otlpLogRecord{
+		Time:         now,
+		ObservedTime: now,
+		Severity:     otlpSeverityInfo,
+		SeverityText: "INFO",
+		Body:         message,
+	}
+
+	fields := formattedEventFields(message)
+	if eventType, ok := fields["type"].(string); ok {
+		record.EventName = eventType
+		if strings.HasPrefix(eventType, "alert.") || strings.Contains(eventType, ".hit.") {
+			record.Severity, record.SeverityText = otlpSeverityWarn, "WARN"
+		}
+	}
+	if value, ok := fields["timestamp"]; ok {
+		if t, ok := parseEventTimestamp(fmt.Sprint(value)); ok {
+			record.Time = t
+		}
+	}
+
+	if config.OTLPAllAttributes {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if fields[name] != nil {
+				record.Attributes = append(record.Attributes, otlpKeyValue{Key: name, Value: otlpValue(fields[name])})
+			}
+		}
+	} else {
+		for _, field := range config.OTLPAttributeFields {
+			if value, ok := lookupField(fields, field); ok && value != nil {
+				record.Attributes = append(record.Attributes, otlpKeyValue{Key: field, Value: otlpValue(value)})
+			}
+		}
+	}
+	return record
+}
+
+// otlpValue converts a decoded JSON value to an attribute value.
+func otlpValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = otlpValue(item)
+		}
+		return values
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := make([]otlpKeyValue, len(keys))
+		for i, key := range keys {
+			values[i] = otlpKeyValue{Key: key, Value: otlpValue(v[key])}
+		}
+		return values
+	case string, bool, int64, float64, nil:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+// the protobuf encoding of an ExportLogsServiceRequest; see opentelemetry/proto/collector/logs/v1/logs_service.proto
+
+func otlpRequestProtobuf(resource []otlpKeyValue, records []otlpLogRecord) []byte {
+	var resourceMsg []byte
+	for _, kv := range resource {
+		resourceMsg = appendProtoBytes(resourceMsg, 1, appendProtoKeyValue(nil, kv))
+	}
+
+	scope := appendProtoBytes(nil, 1, []byte("cb-event-forwarder"))
+	scope = appendProtoBytes(scope, 2, []byte(version))
+	scopeLogs := appendProtoBytes(nil, 1, scope)
+	for _, record := range records {
+		scopeLogs = appendProtoBytes(scopeLogs, 2, appendProtoLogRecord(nil, record))
+	}
+
+	resourceLogs := appendProtoBytes(nil, 1, resourceMsg)
+	resourceLogs = appendProtoBytes(resourceLogs, 2, scopeLogs)
+	return appendProtoBytes(nil, 1, resourceLogs)
+}
+
+func appendProtoLogRecord(b []byte, record otlpLogRecord) []byte {
+	b = appendProtoFixed64(b, 1, uint64(record.Time.UnixNano()))
+	b = appendProtoVarint(b, 2, uint64(record.Severity))
+	b = appendProtoBytes(b, 3, []byte(record.SeverityText))
+	b = appendProtoBytes(b, 5, appendProtoAnyValue(nil, record.Body))
+	for _, kv := range record.Attributes {
+		b = appendProtoBytes(b, 6, appendProtoKeyValue(nil, kv))
+	}
+	b = appendProtoFixed64(b, 11, uint64(record.ObservedTime.UnixNano()))
+	if len(record.EventName) > 0 {
+		b = appendProtoBytes(b, 12, []byte(record.EventName))
+	}
+	return b
+}
+
+func appendProtoKeyValue(b []byte, kv otlpKeyValue) []byte {
+	b = appendProtoBytes(b, 1, []byte(kv.Key))
+	return appendProtoBytes(b, 2, appendProtoAnyValue(nil, kv.Value))
+}
+
+func appendProtoAnyValue(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return appendProtoBytes(b, 1, []byte(v))
+	case bool:
+		if v {
+			return appendProtoVarint(b, 2, 1)
+		}
+		return appendProtoVarint(b, 2, 0)
+	case int64:
+		return appendProtoVarint(b, 3, uint64(v))
+	case float64:
+		return appendProtoFixed64(b, 4, math.Float64bits(v))
+	case []interface{}:
+		var array []byte
+		for _, item := range v {
+			array = appendProtoBytes(array, 1, appendProtoAnyValue(nil, item))
+		}
+		return appendProtoBytes(b, 5, array)
+	case []otlpKeyValue:
+		var list []byte
+		for _, kv := range v {
+			list = appendProtoBytes(list, 1, appendProtoKeyValue(nil, kv))
+		}
+		return appendProtoBytes(b, 6, list)
+	}
+	// an empty value
+	return b
+}
+
+func appendProtoVarint(b []byte, field int, value uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|pbWireVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+func appendProtoFixed64(b []byte, field int, value uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|pbWireFixed64)
+	return binary.LittleEndian.AppendUint64(b, value)
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|pbWireLengthDelimited)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// the JSON encoding of an ExportLogsServiceRequest, in which 64-bit integers are strings
+
+func otlpRequestJSON(resource []otlpKeyValue, records []otlpLogRecord) map[string]interface{} {
+	logRecords := make([]interface{}, len(records))
+	for i, record := range records {
+		logRecord := map[string]interface{}{
+			"timeUnixNano":         strconv.FormatInt(record.Time.UnixNano(), 10),
+			"observedTimeUnixNano": strconv.FormatInt(record.ObservedTime.UnixNano(), 10),
+			"severityNumber":       record.Severity,
+			"severityText":         record.SeverityText,
+			"body":                 otlpAnyValueJSON(record.Body),
+			"attributes":           otlpKeyValuesJSON(record.Attributes),
+		}
+		if len(record.EventName) > 0 {
+			logRecord["eventName"] = record.EventName
+		}
+		logRecords[i] = logRecord
+	}
+
+	return map[string]interface{}{
+		"resourceLogs": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpKeyValuesJSON(resource)},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope":      map[string]interface{}{"name": "cb-event-forwarder", "version": version},
+				"logRecords": logRecords,
+			}},
+		}},
+	}
+}
+
+func otlpKeyValuesJSON(kvs []otlpKeyValue) []interface{} {
+	values := make([]interface{}, len(kvs))
+	for i, kv := range kvs {
+		values[i] = map[string]interface{}{"key": kv.Key, "value": otlpAnyValueJSON(kv.Value)}
+	}
+	return values
+}
+
+func otlpAnyValueJSON(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = otlpAnyValueJSON(item)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case []otlpKeyValue:
+		return map[string]interface{}{"kvlistValue": map[string]interface{}{"values": otlpKeyValuesJSON(v)}}
+	}
+	return map[string]interface{}{}
+}
+
+// parseOTLPKeyValues parses a comma separated list of name=value pairs, as in OTEL_EXPORTER_OTLP_HEADERS and
+// OTEL_RESOURCE_ATTRIBUTES. Values may be percent-encoded.
+func parseOTLPKeyValues(val string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, entry := range strings.Split(val, ",") {
+		if len(strings.TrimSpace(entry)) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || len(name) == 0 {
+			return nil, fmt.Errorf("'%s' should look like name=value", strings.TrimSpace(entry))
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("'%s' has an invalid percent-encoded value", strings.TrimSpace(entry))
+		}
+		pairs[name] = value
+	}
+	return pairs, nil
+}
+
+func (o *OTLPOutput) Shutdown() error {
+	o.loop.Shutdown()
+	return nil
+}
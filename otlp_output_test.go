@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// otlpTestRecords returns the event name, body and attribute keys of the log records in a protobuf
+// ExportLogsServiceRequest.
+func otlpTestRecords(request []byte) (names, bodies []string, attributes [][]string) {
+	scanProtobufFields(request, func(field, wireType int, value uint64, resourceLogs []byte) {
+		scanProtobufFields(resourceLogs, func(field, wireType int, value uint64, scopeLogs []byte) {
+			if field != 2 {
+				return
+			}
+			scanProtobufFields(scopeLogs, func(field, wireType int, value uint64, record []byte) {
+				if field != 2 {
+					return
+				}
+				var name, body string
+				var keys []string
+				scanProtobufFields(record, func(field, wireType int, value uint64, data []byte) {
+					switch field {
+					case 5:
+						scanProtobufFields(data, func(field, wireType int, value uint64, data []byte) {
+							body = string(data)
+						})
+					case 6:
+						scanProtobufFields(data, func(field, wireType int, value uint64, data []byte) {
+							if field == 1 {
+								keys = append(keys, string(data))
+							}
+						})
+					case 12:
+						name = string(data)
+					}
+				})
+				names, bodies, attributes = append(names, name), append(bodies, body), append(attributes, keys)
+			})
+		})
+	})
+	return names, bodies, attributes
+}
+
+func runOTLPOutput(t *testing.T, server *httptest.Server, events ...string) *OTLPOutput {
+	output := &OTLPOutput{}
+	if err := output.Initialize(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, len(events))
+	for _, event := range events {
+		messages <- event
+	}
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+func TestOTLPOutputGRPC(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OTLPProtocol = OTLPGRPC
+	config.OTLPAllAttributes = true
+	config.OTLPBatchWait = 50 * time.Millisecond
+	config.OTLPHeaders = map[string]string{"authorization": "Bearer secret"}
+
+	received := make(chan []byte, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCPath || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Unexpected %s request to %s", r.Proto, r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("Malformed gRPC message %v", body)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		// a partial success: one record rejected
+		response := appendProtoBytes(nil, 1, appendProtoVarint(nil, 1, 1))
+		frame := append([]byte{0, 0, 0, 0, byte(len(response))}, response...)
+		w.Write(frame)
+		w.Header().Set("Grpc-Status", "0")
+		received <- body[5:]
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	output := runOTLPOutput(t, server,
+		`{"type":"watchlist.hit.process","process_pid":1234,"timestamp":1700000000,"docs":[{"md5":"abc"}]}`,
+		`{"type":"ingress.event.netconn","timestamp":1700000001}`)
+	defer output.Shutdown()
+
+	var request []byte
+	select {
+	case request = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("No events were exported")
+	}
+
+	names, bodies, attributes := otlpTestRecords(request)
+	if len(names) != 2 || names[0] != "watchlist.hit.process" || names[1] != "ingress.event.netconn" {
+		t.Fatalf("Unexpected log records %v", names)
+	}
+	if bodies[1] != `{"type":"ingress.event.netconn","timestamp":1700000001}` {
+		t.Errorf("Expected the event as the body, got %s", bodies[1])
+	}
+	if len(attributes[0]) != 4 || attributes[0][0] != "docs" || attributes[0][3] != "type" {
+		t.Errorf("Unexpected attributes %v", attributes[0])
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for output.Statistics().(OTLPStatistics).RejectedEvents != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Rejected events were not counted: %+v", output.Statistics())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOTLPOutputHTTPJSON(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OTLPProtocol = OTLPHTTPJSON
+	config.OTLPAllAttributes = false
+	config.OTLPAttributeFields = []string{"sensor.id"}
+	config.OTLPBatchWait = 50 * time.Millisecond
+	config.OTLPResourceAttributes = map[string]string{"deployment.environment": "test"}
+
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpLogsPath || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected %s request to %s", r.Header.Get("Content-Type"), r.URL.Path)
+		}
+		var request map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("{}"))
+		received <- request
+	}))
+	defer server.Close()
+
+	output := runOTLPOutput(t, server, `{"type":"alert.watchlist.hit.ingress.process","sensor":{"id":7},"timestamp":1}`)
+	defer output.Shutdown()
+
+	var request map[string]interface{}
+	select {
+	case request = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("No events were exported")
+	}
+
+	resourceLogs := request["resourceLogs"].([]interface{})[0].(map[string]interface{})
+	resource, _ := json.Marshal(resourceLogs["resource"])
+	if !strings.Contains(string(resource), `"key":"deployment.environment"`) {
+		t.Errorf("Unexpected resource %s", resource)
+	}
+	record := resourceLogs["scopeLogs"].([]interface{})[0].(map[string]interface{})["logRecords"].([]interface{})[0]
+	encoded, _ := json.Marshal(record)
+	for _, expected := range []string{`"timeUnixNano":"1000000000"`, `"severityText":"WARN"`,
+		`"attributes":[{"key":"sensor.id","value":{"intValue":"7"}}]`} {
+		if !strings.Contains(string(encoded), expected) {
+			t.Errorf("Expected %s in %s", expected, encoded)
+		}
+	}
+}
+
+func TestOTLPOutputShutdown(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OTLPProtocol = OTLPHTTPJSON
+	config.OTLPBatchSize = 10
+	config.OTLPBatchWait = time.Hour
+
+	exported := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("{}"))
+		exported <- strings.Count(string(body), `"timeUnixNano"`)
+	}))
+	defer server.Close()
+
+	output := runOTLPOutput(t, server, `{"type":"ingress.event.procstart","timestamp":1}`,
+		`{"type":"ingress.event.netconn","timestamp":2}`)
+	time.Sleep(100 * time.Millisecond)
+
+	// the batch still being collected is exported before the output stops
+	output.Shutdown()
+	select {
+	case records := <-exported:
+		if records != 2 {
+			t.Errorf("Expected 2 records exported, got %d", records)
+		}
+	default:
+		t.Fatal("The partial batch was not exported on shutdown")
+	}
+	if stats := output.Statistics().(OTLPStatistics); stats.SentEvents != 2 || stats.DroppedEvents != 0 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"strings"
+	"unicode/utf8"
+)
+
+var unencodableCharacters = expvar.NewInt("unencodable_character_count")
+
+// outputEncoder converts formatted events from UTF-8 to output_encoding, for collectors that can't read UTF-8.
+// Characters the encoding can't represent are written as replacement.
+type outputEncoder struct {
+	name        string
+	encoding    encoding.Encoding
+	replacement string
+}
+
+var eventEncoder *outputEncoder
+
+// asciiText is the ASCII an encoding has to write unchanged: the JSON and LEEF syntax of events, and the line endings
+// the outputs separate them with.
+var asciiText = func() []byte {
+	text := []byte("\t\r\n")
+	for c := byte(' '); c <= '~'; c++ {
+		text = append(text, c)
+	}
+	return text
+}()
+
+// newOutputEncoder looks up an encoding by its IANA name or alias, such as ISO-8859-1, latin1, windows-1252,
+// Shift_JIS or EUC-KR. UTF-8 needs no encoder, so nil is returned for it. Encodings that don't write ASCII as it is,
+// such as UTF-16, UTF-32 and EBCDIC, are refused: each event would start with its own byte order mark, and the
+// outputs couldn't separate them with newlines.
+func newOutputEncoder(name, replacement string) (*outputEncoder, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding '%s'", name)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("encoding '%s' is not supported", name)
+	}
+	if canonical, err := ianaindex.IANA.Name(enc); err == nil && strings.EqualFold(canonical, "UTF-8") {
+		return nil, nil
+	}
+	if encoded, err := enc.NewEncoder().Bytes(asciiText); err != nil || !bytes.Equal(encoded, asciiText) {
+		return nil, fmt.Errorf("encoding '%s' is not supported: it is not ASCII compatible", name)
+	}
+
+	e := &outputEncoder{name: name, encoding: enc}
+	if replacement, err = enc.NewEncoder().String(replacement); err != nil {
+		return nil, fmt.Errorf("the replacement '%s' can't be written in %s", replacement, name)
+	}
+	e.replacement = replacement
+	return e, nil
+}
+
+// Encode converts message, replacing the characters the encoding can't represent.
+func (e *outputEncoder) Encode(message string) string {
+	if encoded, err := e.encoding.NewEncoder().String(message); err == nil {
+		return encoded
+	}
+
+	// one character at a time, to find the ones that can't be encoded
+	var b strings.Builder
+	encoder := e.encoding.NewEncoder()
+	var buf [utf8.UTFMax]byte
+	for _, r := range message {
+		encoded, err := encoder.Bytes(buf[:utf8.EncodeRune(buf[:], r)])
+		if err != nil {
+			unencodableCharacters.Add(1)
+			b.WriteString(e.replacement)
+			encoder.Reset()
+			continue
+		}
+		b.Write(encoded)
+	}
+	return b.String()
+}
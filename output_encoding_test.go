@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputEncoder(t *testing.T) {
+	encoder, err := newOutputEncoder("Shift_JIS", "?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded := encoder.Encode(`{"path":"C:\\ユーザー\\a.txt"}`); encoded != "{\"path\":\"C:\\\\\x83\x86\x81[\x83U\x81[\\\\a.txt\"}" {
+		t.Errorf("Unexpected Shift_JIS encoding %q", encoded)
+	}
+
+	encoder, err = newOutputEncoder("latin1", "?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded := encoder.Encode("résumé ✓ €"); encoded != "r\xe9sum\xe9 ? ?" {
+		t.Errorf("Unexpected Latin-1 encoding %q", encoded)
+	}
+
+	if encoder, err := newOutputEncoder("UTF-8", "?"); err != nil || encoder != nil {
+		t.Errorf("Expected no encoder for UTF-8, got %v (%v)", encoder, err)
+	}
+	if _, err := newOutputEncoder("klingon", "?"); err == nil {
+		t.Error("Expected an error for an unknown encoding")
+	}
+
+	// events in encodings that don't write ASCII as it is can't be separated by newlines
+	for _, name := range []string{"UTF-16", "UTF-16LE", "UTF-16BE", "UTF-32", "IBM037"} {
+		if _, err := newOutputEncoder(name, "?"); err == nil || !strings.Contains(err.Error(), "is not supported") {
+			t.Errorf("Expected %s to be refused, got %v", name, err)
+		}
+	}
+}
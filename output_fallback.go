@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outputArchiveFileSize is the size at which a new archive file is started, so that replayed files can be deleted
+// before the whole archive has been sent.
+const outputArchiveFileSize = 16 * 1024 * 1024
+
+// outputReplayTime limits how long each replay holds up the output's loop.
+const outputReplayTime = 500 * time.Millisecond
+
+const outputArchiveSuffix = ".events"
+
+var errOutputArchiveFull = errors.New("output archive is full")
+
+// outputFallback is a circuit breaker for the network outputs. While the output is disconnected, or after a write
+// fails, events are appended to files in an archive directory instead of being dropped, and replayed in order once
+// the output is sending again; while there are events in the archive, new events are archived too. After
+// failureThreshold consecutive failures the breaker opens: for cooldown the output makes no attempt to reconnect or
+// replay, so a struggling receiver isn't hammered. Archived events are sent at least once: a file that was being
+// replayed when the forwarder stopped is sent again from the start.
+type outputFallback struct {
+	directory        string
+	failureThreshold int
+	cooldown         time.Duration
+	maxSize          int64
+
+	// archive files, oldest first; the last may be open for writing
+	files       []string
+	size        int64
+	writer      *os.File
+	writerBytes int64
+	reader      *bufio.Reader
+	readerFile  *os.File
+	// an event read from the archive that couldn't be sent
+	next    string
+	hasNext bool
+
+	failures  int
+	openUntil time.Time
+
+	trips         int64
+	archivedCount int64
+	replayedCount int64
+	droppedCount  int64
+	lastError     string
+	sync.Mutex
+}
+
+type OutputFallbackStatistics struct {
+	Directory     string    `json:"directory"`
+	Open          bool      `json:"circuit_open"`
+	OpenUntil     time.Time `json:"open_until,omitempty"`
+	Trips         int64     `json:"trips"`
+	ArchivedBytes int64     `json:"archived_bytes"`
+	ArchivedCount int64     `json:"archived_event_count"`
+	ReplayedCount int64     `json:"replayed_event_count"`
+	DroppedCount  int64     `json:"dropped_event_count"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// outputArchiveLocation returns the archive directory of a network output, given as <output type>:<connection
+// string>: each output (of a pipeline, shadow or tier output) archives events in a subdirectory of directory named
+// after it, as in tcp_siem.example.com_514, so that outputs don't replay or delete each other's events.
+func outputArchiveLocation(directory, output string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, output)
+	return filepath.Join(directory, name)
+}
+
+// newOutputFallback returns the configured fallback for the network output given as <output type>:<connection
+// string>, or nil if output_archive_directory isn't set. Events left in the archive by the last run are replayed
+// before any new ones, with those archived in output_archive_directory itself by versions that shared it between
+// outputs, which the first output to start takes.
+func newOutputFallback(output string) (*outputFallback, error) {
+	if len(config.OutputArchiveDirectory) == 0 {
+		return nil, nil
+	}
+
+	f := &outputFallback{
+		directory:        outputArchiveLocation(config.OutputArchiveDirectory, output),
+		failureThreshold: config.OutputArchiveFailures,
+		cooldown:         config.OutputArchiveCooldown,
+		maxSize:          config.OutputArchiveMaxSize,
+	}
+	if err := os.MkdirAll(f.directory, 0700); err != nil {
+		return nil, err
+	}
+
+	shared, err := filepath.Glob(filepath.Join(config.OutputArchiveDirectory, "*"+outputArchiveSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, fileName := range shared {
+		if err := os.Rename(fileName, filepath.Join(f.directory, filepath.Base(fileName))); err != nil &&
+			!os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	infos, err := ioutil.ReadDir(f.directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), outputArchiveSuffix) {
+			f.files = append(f.files, filepath.Join(f.directory, info.Name()))
+			f.size += info.Size()
+		}
+	}
+	// the file names are timestamps, so these are in the order they were written
+	sort.Strings(f.files)
+	if f.size > 0 {
+		log.Printf("Replaying %d bytes of events archived in %s", f.size, f.directory)
+	}
+	return f, nil
+}
+
+// Open reports whether the breaker is open, in which case the output should not try to reconnect.
+func (f *outputFallback) Open(now time.Time) bool {
+	if f == nil {
+		return false
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	return now.Before(f.openUntil)
+}
+
+// Send writes message with write, or archives it if the output is disconnected, the breaker is open, or older events
+// are waiting in the archive. A message that write fails to send is archived, and the write's error returned.
+func (f *outputFallback) Send(message string, connected bool, write func(string) error) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if !connected || f.pending() || time.Now().Before(f.openUntil) {
+		return f.archive(message)
+	}
+
+	if err := write(message); err != nil {
+		f.failed(err)
+		if archiveErr := f.archive(message); archiveErr != nil {
+			log.Printf("Could not archive event: %s", archiveErr)
+		}
+		return err
+	}
+	f.failures = 0
+	return nil
+}
+
+// Replay sends archived events with write, oldest first, until the archive is empty, a write fails, or it has run
+// for outputReplayTime.
+func (f *outputFallback) Replay(connected bool, write func(string) error) {
+	if f == nil || !connected {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	deadline := time.Now().Add(outputReplayTime)
+	for f.pending() && time.Now().Before(deadline) && !time.Now().Before(f.openUntil) {
+		if !f.hasNext {
+			if err := f.readNext(); err != nil {
+				f.lastError = err.Error()
+				log.Printf("Could not read archived events: %s", err)
+				return
+			}
+			if !f.hasNext {
+				continue
+			}
+		}
+
+		if err := write(f.next); err != nil {
+			f.failed(err)
+			return
+		}
+		f.failures = 0
+		f.size -= int64(len(f.next)) + 1
+		f.next, f.hasNext = "", false
+		f.replayedCount++
+
+		if !f.pending() {
+			log.Printf("Replayed all events archived in %s", f.directory)
+		}
+	}
+}
+
+func (f *outputFallback) Statistics() OutputFallbackStatistics {
+	f.Lock()
+	defer f.Unlock()
+
+	stats := OutputFallbackStatistics{
+		Directory:     f.directory,
+		Open:          time.Now().Before(f.openUntil),
+		Trips:         f.trips,
+		ArchivedBytes: f.size,
+		ArchivedCount: f.archivedCount,
+		ReplayedCount: f.replayedCount,
+		DroppedCount:  f.droppedCount,
+		LastError:     f.lastError,
+	}
+	if stats.Open {
+		stats.OpenUntil = f.openUntil
+	}
+	return stats
+}
+
+// Close closes the archive file being written when the output shuts down. Replaying carries on from the same event
+// if the output is started again.
+func (f *outputFallback) Close() {
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.closeWriter()
+}
+
+func (f *outputFallback) pending() bool {
+	return f.hasNext || len(f.files) > 0
+}
+
+// failed counts a failed write, opening the breaker after failureThreshold of them in a row.
+func (f *outputFallback) failed(err error) {
+	f.failures++
+	f.lastError = err.Error()
+	if f.failureThreshold > 0 && f.failures >= f.failureThreshold {
+		f.openUntil = time.Now().Add(f.cooldown)
+		f.failures = 0
+		f.trips++
+		log.Printf("Output failed %d times in a row; archiving events to %s until %s", f.failureThreshold,
+			f.directory, f.openUntil)
+	}
+}
+
+func (f *outputFallback) archive(message string) error {
+	if f.maxSize > 0 && f.size+int64(len(message))+1 > f.maxSize {
+		f.droppedCount++
+		return errOutputArchiveFull
+	}
+
+	if f.writer == nil || f.writerBytes >= outputArchiveFileSize {
+		f.closeWriter()
+		fileName := filepath.Join(f.directory, fmt.Sprintf("%020d%s", time.Now().UnixNano(), outputArchiveSuffix))
+		fp, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			f.droppedCount++
+			f.lastError = err.Error()
+			return err
+		}
+		f.writer, f.writerBytes = fp, 0
+		f.files = append(f.files, fileName)
+	}
+
+	n, err := f.writer.WriteString(message + "\n")
+	f.writerBytes += int64(n)
+	f.size += int64(n)
+	if err != nil {
+		f.droppedCount++
+		f.lastError = err.Error()
+		// start a new file rather than append to a partial line
+		f.closeWriter()
+		return err
+	}
+	f.archivedCount++
+	return nil
+}
+
+func (f *outputFallback) closeWriter() {
+	if f.writer != nil {
+		f.writer.Close()
+		f.writer = nil
+	}
+}
+
+// readNext reads the oldest archived event, deleting each archive file once it has been read.
+func (f *outputFallback) readNext() error {
+	if f.reader == nil {
+		// only read complete files; new events go to a new file
+		if len(f.files) == 1 {
+			f.closeWriter()
+		}
+		fp, err := os.Open(f.files[0])
+		if os.IsNotExist(err) {
+			f.files = f.files[1:]
+			return nil
+		} else if err != nil {
+			return err
+		}
+		f.readerFile, f.reader = fp, bufio.NewReader(fp)
+	}
+
+	line, err := f.reader.ReadString('\n')
+	if err == nil {
+		f.next, f.hasNext = strings.TrimSuffix(line, "\n"), true
+		return nil
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	// a partial line is left only if the archive couldn't be written
+	f.size -= int64(len(line))
+	f.readerFile.Close()
+	f.readerFile, f.reader = nil, nil
+	if err := os.Remove(f.files[0]); err != nil {
+		return err
+	}
+	f.files = f.files[1:]
+	return nil
+}
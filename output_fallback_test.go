@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOutputFallbackArchivesAndReplays(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	dir, err := ioutil.TempDir("", "output-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.OutputArchiveDirectory = dir
+	config.OutputArchiveFailures = 3
+	config.OutputArchiveCooldown = time.Hour
+
+	f, err := newOutputFallback("tcp:receiver:514")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	receiverUp := true
+	write := func(message string) error {
+		if !receiverUp {
+			return errors.New("connection refused")
+		}
+		sent = append(sent, message)
+		return nil
+	}
+
+	f.Send("0", true, write)
+	receiverUp = false
+	if err := f.Send("1", true, write); err == nil {
+		t.Error("Expected the failed write to be reported")
+	}
+	// once an event is archived, later ones are archived behind it
+	for i := 2; i < 5; i++ {
+		f.Send(strconv.Itoa(i), true, write)
+	}
+	f.Send("5", false, write)
+
+	// each failed replay counts towards opening the breaker
+	f.Replay(true, write)
+	f.Replay(true, write)
+	if !f.Open(time.Now()) {
+		t.Errorf("Expected the circuit breaker to open: %+v", f.Statistics())
+	}
+
+	receiverUp = true
+	f.Replay(true, write)
+	if len(sent) != 1 {
+		t.Errorf("Expected no events to be replayed while the breaker is open, got %v", sent)
+	}
+
+	// events archived by one run are replayed by the next
+	f.Close()
+	f, err = newOutputFallback("tcp:receiver:514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Replay(true, write)
+	f.Send("6", true, write)
+
+	expected := []string{"0", "1", "2", "3", "4", "5", "6"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Expected %v, got %v", expected, sent)
+	}
+	if stats := f.Statistics(); stats.ArchivedBytes != 0 || stats.ReplayedCount != 5 {
+		t.Errorf("Expected an empty archive, got %+v", stats)
+	}
+	if files, _ := ioutil.ReadDir(f.directory); len(files) != 0 {
+		t.Errorf("Expected replayed archive files to be removed, found %d", len(files))
+	}
+}
+
+func TestOutputFallbackDirectories(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	dir := t.TempDir()
+	config.OutputArchiveDirectory = dir
+
+	// events archived by a version that shared the directory between outputs
+	legacy := filepath.Join(dir, fmt.Sprintf("%020d%s", 1, outputArchiveSuffix))
+	if err := ioutil.WriteFile(legacy, []byte("0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tcp, err := newOutputFallback("tcp:siem.example.com:514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	syslog, err := newOutputFallback("syslog:tcp+tls:siem.example.com:6514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syslog.Close()
+
+	if tcp.directory != filepath.Join(dir, "tcp_siem.example.com_514") ||
+		syslog.directory != filepath.Join(dir, "syslog_tcp_tls_siem.example.com_6514") {
+		t.Errorf("Unexpected archive directories %s and %s", tcp.directory, syslog.directory)
+	}
+	if tcp.Statistics().ArchivedBytes != 2 || syslog.Statistics().ArchivedBytes != 0 {
+		t.Errorf("Expected the first output to take the shared archive, got %+v and %+v", tcp.Statistics(),
+			syslog.Statistics())
+	}
+}
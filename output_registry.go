@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// OutputHandler is implemented by every output. Initialize is passed the value of the output's parameter key from
+// the [bridge] section of the configuration file; Go starts a goroutine that writes messages to the output until
+// ctx is cancelled or Shutdown is called. Either way, messages still buffered in the channel are written, network
+// calls in progress (such as uploads) are cancelled, and the output's files and connections are released.
+type OutputHandler interface {
+	Initialize(string) error
+	Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error
+	String() string
+	Statistics() interface{}
+	Key() string
+	Shutdown() error
+}
+
+// OutputFactory returns a new, uninitialized output handler.
+type OutputFactory func() OutputHandler
+
+type OutputRegistration struct {
+	// value of output_type that selects this output
+	Name string
+	// key in the [bridge] section holding the output's connection string, such as "outfile" or "tcpout"
+	ParameterKey string
+	// reported as the output type on the status page
+	StatusType string
+	// whether the output writes events to files, one a line, which are read back a line at a time (to check them
+	// after a crash, to replay, export or index them), so events can't be written over several lines with json_pretty
+	WritesFiles bool
+	// returns the file or directory the output keeps its events in, given its connection string, for outputs that
+	// keep events on disk; no two forwarders may share it
+	Location func(connString string) string
+	// whether the output archives events in output_archive_directory while its destination can't be reached; see
+	// outputArchiveLocation
+	Archives bool
+	Factory  OutputFactory
+}
+
+var outputRegistry = make(map[string]OutputRegistration)
+
+// RegisterOutput makes an output available as an output_type. Outputs register themselves from an init function in
+// their own source file, so a new output can be added without changes to the configuration parser or main().
+func RegisterOutput(registration OutputRegistration) {
+	if _, ok := outputRegistry[registration.Name]; ok {
+		panic(fmt.Sprintf("Output type %s registered twice", registration.Name))
+	}
+	outputRegistry[registration.Name] = registration
+}
+
+func LookupOutput(name string) (OutputRegistration, bool) {
+	registration, ok := outputRegistry[name]
+	return registration, ok
+}
+
+// RegisteredOutputs returns the names of all registered output types, sorted.
+func RegisteredOutputs() []string {
+	names := make([]string, 0, len(outputRegistry))
+	for name := range outputRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// outputLoop lets an output's Shutdown method stop the goroutine started by Go and wait for it to exit. Its context
+// is cancelled by Shutdown or by the context passed to Go, and should be used for any network calls the output makes.
+// A nil outputLoop (the output was never started) shuts down immediately.
+type outputLoop struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	// requests from Flush; the output's goroutine rolls over its file and replies with the result
+	flushes chan chan error
+}
+
+func newOutputLoop(ctx context.Context) *outputLoop {
+	l := &outputLoop{stopped: make(chan struct{}), flushes: make(chan chan error)}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	return l
+}
+
+// Flusher is implemented by outputs that can be asked to send the events they have collected immediately, as they
+// do on SIGHUP.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// DeliveryConfirmer is implemented by outputs that tell the latency tracker themselves when the events they were
+// given have been delivered, rather than once they have taken them; see latencyTracker.
+type DeliveryConfirmer interface {
+	ConfirmsDelivery() bool
+}
+
+// Flush asks the output's goroutine to roll over and waits for it to finish.
+func (l *outputLoop) Flush(ctx context.Context) error {
+	if l == nil {
+		return errors.New("output not started")
+	}
+
+	result := make(chan error, 1)
+	select {
+	case l.flushes <- result:
+	case <-l.stopped:
+		return errors.New("output stopped")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exited must be called (deferred) by the output's goroutine. It cancels the loop's context, so that goroutines
+// started by the output finish even if the loop stopped because of an error.
+func (l *outputLoop) exited() {
+	l.cancel()
+	close(l.stopped)
+}
+
+func (l *outputLoop) Shutdown() {
+	if l == nil {
+		return
+	}
+	l.cancel()
+	<-l.stopped
+}
+
+// drainMessages passes the messages still buffered in the channel to output, returning the first error.
+func drainMessages(messages <-chan string, output func(string) error) error {
+	for {
+		select {
+		case message := <-messages:
+			if err := output(message); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputRegistry(t *testing.T) {
+	for _, name := range [...]string{FileOutputType, S3OutputType, TCPOutputType, UDPOutputType, SyslogOutputType} {
+		registration, ok := LookupOutput(name)
+		if !ok {
+			t.Errorf("Output type %s is not registered", name)
+			continue
+		}
+		if registration.Factory() == nil || len(registration.ParameterKey) == 0 {
+			t.Errorf("Incomplete registration for output type %s: %+v", name, registration)
+		}
+	}
+
+	if _, ok := LookupOutput("carrier-pigeon"); ok {
+		t.Error("Unexpected registration for unknown output type")
+	}
+}
+
+func TestFileOutputShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registration, _ := LookupOutput(FileOutputType)
+	output := registration.Factory()
+
+	fileName := filepath.Join(dir, "events.json")
+	if err := output.Initialize(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages still buffered when Shutdown is called are written before the output stops
+	messages := make(chan string, 10)
+	errors := make(chan error, 1)
+	for _, m := range [...]string{"one", "two", "three"} {
+		messages <- m
+	}
+
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(strings.Fields(string(contents)), ",") != "one,two,three" {
+		t.Errorf("Expected all buffered messages to be written, got %q", contents)
+	}
+}
+
+func TestFileOutputFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := &FileOutput{}
+	if err := output.Initialize(filepath.Join(dir, "events.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	messages <- "one"
+	if err := output.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "events.json.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected the file to be rolled over once, found %v", files)
+	}
+}
+
+func TestFileOutputTrimsPartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the forwarder crashed while writing the third event
+	fileName := filepath.Join(dir, "event-forwarder")
+	if err := ioutil.WriteFile(fileName, []byte("{\"a\": 1}\n{\"b\": 2}\n{\"c\":"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := &FileOutput{}
+	if err := output.Initialize(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.output(`{"d": 4}`); err != nil {
+		t.Fatal(err)
+	}
+	output.close()
+
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "{\"a\": 1}\n{\"b\": 2}\n{\"d\": 4}\n" {
+		t.Errorf("Partial line was not removed: %q", contents)
+	}
+
+	stats := output.Statistics().(FileStatistics)
+	if stats.Truncations != 1 || stats.TruncatedBytes != 5 {
+		t.Errorf("Truncation not recorded: %+v", stats)
+	}
+}
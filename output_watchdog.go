@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+var outputRestarts = expvar.NewInt("output_restart_count")
+
+// outputShutdownTimeout limits how long the watchdog waits for a stalled output to shut down before restarting it,
+// and how long it waits to pass events on when the forwarder stops.
+var outputShutdownTimeout = 30 * time.Second
+
+// outputWatchdog passes events from the message processors (or the buffer) to the output, and restarts the output
+// if it stops making progress: events are waiting, but for stallTimeout the output has taken none of them, or has
+// reported an error for every one it took. The output is restarted in place with Shutdown, Initialize and Go, so
+// the management API and the status page keep working with the same output.
+type outputWatchdog struct {
+	output       OutputHandler
+	parameters   string
+	stallTimeout time.Duration
+
+	ctx    context.Context
+	in     <-chan string
+	out    chan string
+	errs   chan error
+	report chan<- error
+
+	// the event taken from in that the output hasn't accepted yet
+	held    string
+	holding bool
+
+	accepted     int64
+	failed       int64
+	lastProgress time.Time
+	restarts     int64
+	lastRestart  time.Time
+	lastError    string
+
+	stop chan struct{}
+	done chan struct{}
+	sync.Mutex
+}
+
+type OutputWatchdogStatistics struct {
+	StallTimeout  string    `json:"stall_timeout"`
+	Stalled       bool      `json:"stalled"`
+	LastProgress  time.Time `json:"last_progress"`
+	Restarts      int64     `json:"restarts"`
+	LastRestart   time.Time `json:"last_restart,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	EventsWaiting int       `json:"events_waiting"`
+}
+
+func newOutputWatchdog(output OutputHandler, parameters string, stallTimeout time.Duration) *outputWatchdog {
+	return &outputWatchdog{
+		output:       output,
+		parameters:   parameters,
+		stallTimeout: stallTimeout,
+		out:          make(chan string),
+		errs:         make(chan error),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Go starts the output, reading events from in and sending its errors on to report, and watches it until Shutdown
+// is called.
+func (w *outputWatchdog) Go(ctx context.Context, in <-chan string, report chan<- error) error {
+	w.ctx, w.in, w.report = ctx, in, report
+	w.lastProgress = time.Now()
+
+	if err := w.output.Go(ctx, w.out, w.errs); err != nil {
+		return err
+	}
+
+	go w.forwardErrors()
+	go w.run()
+	return nil
+}
+
+// Shutdown passes on the events already queued for the output and stops watching it. The output itself is stopped
+// by its own Shutdown afterwards, as it would be without a watchdog.
+func (w *outputWatchdog) Shutdown() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *outputWatchdog) Statistics() interface{} {
+	w.Lock()
+	defer w.Unlock()
+
+	waiting := len(w.in)
+	if w.holding {
+		waiting++
+	}
+	return OutputWatchdogStatistics{
+		StallTimeout:  w.stallTimeout.String(),
+		Stalled:       w.stalled(time.Now()),
+		LastProgress:  w.lastProgress,
+		Restarts:      w.restarts,
+		LastRestart:   w.lastRestart,
+		LastError:     w.lastError,
+		EventsWaiting: waiting,
+	}
+}
+
+// forwardErrors counts the errors the output reports before passing them on.
+func (w *outputWatchdog) forwardErrors() {
+	for {
+		select {
+		case err := <-w.errs:
+			w.Lock()
+			w.failed++
+			w.Unlock()
+
+			select {
+			case w.report <- err:
+			case <-w.done:
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *outputWatchdog) run() {
+	defer close(w.done)
+
+	// check a few times per timeout, so a stall is noticed soon after stallTimeout has passed
+	checkTicker := time.NewTicker(w.stallTimeout / 4)
+	defer checkTicker.Stop()
+	accepted, failed := w.counts()
+
+	for {
+		receive, send := w.in, w.out
+		if w.holding {
+			receive = nil
+		} else {
+			send = nil
+		}
+
+		select {
+		case <-w.stop:
+			w.passOn()
+			return
+		case message := <-receive:
+			w.hold(message)
+		case send <- w.held:
+			w.release()
+		case now := <-checkTicker.C:
+			// progress is an event taken without an error to go with it
+			nowAccepted, nowFailed := w.counts()
+			if nowAccepted-accepted > nowFailed-failed {
+				w.Lock()
+				w.lastProgress = now
+				w.Unlock()
+			}
+			accepted, failed = nowAccepted, nowFailed
+
+			w.Lock()
+			stalled := w.stalled(now)
+			w.Unlock()
+			if stalled {
+				w.restart()
+				accepted, failed = w.counts()
+			}
+		}
+	}
+}
+
+func (w *outputWatchdog) counts() (int64, int64) {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.accepted, w.failed
+}
+
+func (w *outputWatchdog) hold(message string) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.held, w.holding = message, true
+}
+
+func (w *outputWatchdog) release() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.held, w.holding = "", false
+	w.accepted++
+}
+
+// stalled must be called with the lock held.
+func (w *outputWatchdog) stalled(now time.Time) bool {
+	return (w.holding || len(w.in) > 0) && now.Sub(w.lastProgress) >= w.stallTimeout
+}
+
+// restart stops the output and starts it again. An event the output hadn't taken is kept and sent once it has
+// restarted.
+func (w *outputWatchdog) restart() {
+	log.Printf("Output %s has not sent any events for %s; restarting it", w.output.String(), w.stallTimeout)
+	err := w.restartOutput()
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.restarts++
+	w.lastRestart = time.Now()
+	// whether or not the restart worked, wait another stallTimeout before trying again
+	w.lastProgress = w.lastRestart
+	outputRestarts.Add(1)
+
+	if err != nil {
+		w.lastError = err.Error()
+		log.Printf("Could not restart output %s: %s", w.output.String(), err)
+		return
+	}
+	w.lastError = ""
+	log.Printf("Restarted output %s", w.output.String())
+}
+
+func (w *outputWatchdog) restartOutput() error {
+	stopped := make(chan error, 1)
+	go func() { stopped <- w.output.Shutdown() }()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			log.Printf("Error shutting down stalled output %s: %s", w.output.String(), err)
+		}
+	case <-time.After(outputShutdownTimeout):
+		return errors.New("the output did not shut down")
+	}
+
+	if err := w.output.Initialize(w.parameters); err != nil {
+		return err
+	}
+	return w.output.Go(w.ctx, w.out, w.errs)
+}
+
+// passOn sends the events already queued for the output to it, so that it writes them when it shuts down.
+func (w *outputWatchdog) passOn() {
+	deadline := time.After(outputShutdownTimeout)
+	send := func(message string) error {
+		select {
+		case w.out <- message:
+			return nil
+		case <-deadline:
+			return errors.New("the output did not take it")
+		}
+	}
+
+	if w.holding {
+		if err := send(w.held); err != nil {
+			log.Printf("Dropping queued events for %s: %s", w.output.String(), err)
+			return
+		}
+		w.release()
+	}
+	if err := drainMessages(w.in, send); err != nil {
+		log.Printf("Dropping queued events for %s: %s", w.output.String(), err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// stallingOutput takes no events until it has been initialized twice, like a network output whose connection has
+// stopped accepting data until it reconnects.
+type stallingOutput struct {
+	initialized int
+	loop        *outputLoop
+	received    chan string
+}
+
+func (o *stallingOutput) Initialize(string) error {
+	o.initialized++
+	return nil
+}
+
+func (o *stallingOutput) Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error {
+	o.loop = newOutputLoop(ctx)
+	stuck := o.initialized < 2
+
+	go func() {
+		defer o.loop.exited()
+
+		for {
+			if stuck {
+				<-o.loop.ctx.Done()
+				return
+			}
+			select {
+			case message := <-messages:
+				o.received <- message
+			case <-o.loop.ctx.Done():
+				drainMessages(messages, func(message string) error {
+					o.received <- message
+					return nil
+				})
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (o *stallingOutput) String() string          { return "stalling output" }
+func (o *stallingOutput) Statistics() interface{} { return nil }
+func (o *stallingOutput) Key() string             { return "stalling" }
+
+func (o *stallingOutput) Shutdown() error {
+	o.loop.Shutdown()
+	return nil
+}
+
+func TestOutputWatchdogRestartsStalledOutput(t *testing.T) {
+	output := &stallingOutput{received: make(chan string, 10)}
+	output.Initialize("")
+
+	in := make(chan string, 10)
+	w := newOutputWatchdog(output, "", 100*time.Millisecond)
+	if err := w.Go(context.Background(), in, make(chan error)); err != nil {
+		t.Fatal(err)
+	}
+
+	in <- "first"
+	in <- "second"
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case message := <-output.received:
+			if message != expected {
+				t.Errorf("Expected %s, got %s", expected, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The output was not restarted")
+		}
+	}
+
+	stats := w.Statistics().(OutputWatchdogStatistics)
+	if stats.Restarts != 1 || output.initialized != 2 || len(stats.LastError) > 0 {
+		t.Errorf("Expected one restart, got %+v after %d initializations", stats, output.initialized)
+	}
+
+	// events queued when the forwarder stops are written by the output as it shuts down
+	in <- "third"
+	w.Shutdown()
+	output.Shutdown()
+	if message := <-output.received; message != "third" {
+		t.Errorf("Expected third, got %s", message)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Policies for events larger than max_event_size once formatted.
+const (
+	OversizeTruncate = "truncate"
+	OversizeSplit    = "split"
+	OversizeDrop     = "drop"
+)
+
+// truncationMarker ends a field shortened by the truncate policy.
+const truncationMarker = "...[truncated]"
+
+var oversizeEvents = expvar.NewMap("oversize_events")
+
+// deadLetters holds the events dropped for their size, if dead_letter_file is set.
+var deadLetters *auditLog
+
+// fitMessage applies the oversize_policy to msg, whose formatted form outmsg is larger than max_event_size, and
+// returns the formatted events to send in its place. Events that can't be made small enough are dropped, and written
+// to the dead letter file. The events are formatted as received at received.
+func fitMessage(msg map[string]interface{}, outmsg string, received time.Time) ([]string, error) {
+	var fitted []string
+	var err error
+
+	switch config.OversizePolicy {
+	case OversizeTruncate:
+		var truncated string
+		if truncated, err = truncateMessage(msg, len(outmsg), received); err == nil {
+			fitted = []string{truncated}
+			oversizeEvents.Add("truncated", 1)
+		}
+	case OversizeSplit:
+		if fitted, err = splitMessage(msg, received); err == nil {
+			oversizeEvents.Add("split", 1)
+		}
+	default:
+		err = errors.New("oversize_policy is drop")
+	}
+	if err == nil {
+		return fitted, nil
+	}
+
+	oversizeEvents.Add("dropped", 1)
+	if deadLetters == nil {
+		return nil, nil
+	}
+	if err := deadLetters.Write(outmsg); err != nil {
+		return nil, fmt.Errorf("could not write oversize event to %s: %s", config.DeadLetterFile, err)
+	}
+	oversizeEvents.Add("dead_lettered", 1)
+	return nil, nil
+}
+
+// oversizeFields returns the string fields of msg that may be truncated or split, longest first: those named in
+// oversize_fields, or every string field if none are named.
+func oversizeFields(msg map[string]interface{}) []string {
+	var fields []string
+	if len(config.OversizeFields) > 0 {
+		for _, field := range config.OversizeFields {
+			if _, ok := msg[field].(string); ok {
+				fields = append(fields, field)
+			}
+		}
+	} else {
+		for field, value := range msg {
+			if _, ok := value.(string); ok {
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		li, lj := len(msg[fields[i]].(string)), len(msg[fields[j]].(string))
+		if li != lj {
+			return li > lj
+		}
+		return fields[i] < fields[j]
+	})
+	return fields
+}
+
+// truncateMessage shortens the oversize fields of msg, longest first, until it fits in max_event_size. size is the
+// length of the formatted event; the fields that were shortened are listed in truncated_fields.
+func truncateMessage(msg map[string]interface{}, size int, received time.Time) (string, error) {
+	var truncated []string
+	for _, field := range oversizeFields(msg) {
+		value := msg[field].(string)
+		// formatting can make a field longer than its value (escaping in JSON), and truncated_fields makes the event
+		// longer, so this may take more than one pass
+		for excess := size - config.MaxEventSize; excess > 0 && len(value) > 0; excess = size - config.MaxEventSize {
+			keep := len(value) - excess - len(truncationMarker)
+			if keep < 0 {
+				keep = 0
+			}
+			value = truncateUTF8(value, keep)
+			msg[field] = value + truncationMarker
+			if len(truncated) == 0 || truncated[len(truncated)-1] != field {
+				truncated = append(truncated, field)
+			}
+			msg["truncated_fields"] = strings.Join(truncated, ",")
+
+			outmsg, err := formatMessage(msg, received)
+			if err != nil {
+				return "", err
+			}
+			if len(outmsg) <= config.MaxEventSize {
+				return outmsg, nil
+			}
+			size = len(outmsg)
+		}
+	}
+	return "", errors.New("the event is too large even with its fields truncated")
+}
+
+// splitMessage divides the longest oversize field of msg between several events, each a copy of msg with a part of
+// the field. The parts carry split_id (the same for all of them), split_part and split_parts, so the field can be
+// put back together downstream.
+func splitMessage(msg map[string]interface{}, received time.Time) ([]string, error) {
+	fields := oversizeFields(msg)
+	if len(fields) == 0 {
+		return nil, errors.New("the event has no field to split")
+	}
+	field := fields[0]
+	value := msg[field].(string)
+
+	id, err := newSplitID()
+	if err != nil {
+		return nil, err
+	}
+	msg[field] = ""
+	msg["split_id"] = id
+	msg["split_part"] = 0
+	msg["split_parts"] = 0
+	empty, err := formatMessage(msg, received)
+	if err != nil {
+		return nil, err
+	}
+
+	// escaping in the formatted event can make a part longer than expected, in which case the field is split into
+	// smaller parts
+	chunk := config.MaxEventSize - len(empty) - 8
+	for chunk > 0 {
+		parts := splitUTF8(value, chunk)
+		var split []string
+		overshoot := 0
+		for i, part := range parts {
+			msg[field] = part
+			msg["split_part"] = i + 1
+			msg["split_parts"] = len(parts)
+			outmsg, err := formatMessage(msg, received)
+			if err != nil {
+				return nil, err
+			}
+			if len(outmsg) > config.MaxEventSize && len(outmsg)-config.MaxEventSize > overshoot {
+				overshoot = len(outmsg) - config.MaxEventSize
+			}
+			split = append(split, outmsg)
+		}
+		if overshoot == 0 {
+			return split, nil
+		}
+		chunk -= overshoot
+	}
+	return nil, errors.New("the rest of the event is larger than max_event_size")
+}
+
+// truncateUTF8 returns the first n bytes of s, less any partial character at the end.
+func truncateUTF8(s string, n int) string {
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// splitUTF8 divides s into parts of at most n bytes, without dividing characters.
+func splitUTF8(s string, n int) []string {
+	var parts []string
+	for len(s) > n {
+		part := truncateUTF8(s, n)
+		if len(part) == 0 {
+			// n is smaller than the next character
+			part = s[:n]
+		}
+		parts = append(parts, part)
+		s = s[len(part):]
+	}
+	return append(parts, s)
+}
+
+func newSplitID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func oversizeTestEvent() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "ingress.event.procstart",
+		"process_pid": 1234,
+		"cmdline":     "powershell.exe -EncodedCommand " + strings.Repeat("QQBCAEMA\"é", 200),
+		"path":        "c:\\windows\\system32\\windowspowershell\\v1.0\\powershell.exe",
+	}
+}
+
+func TestOversizeEvents(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OutputFormat = JSONOutputFormat
+	config.MaxEventSize = 512
+	config.OversizeFields = []string{"cmdline"}
+
+	config.OversizePolicy = OversizeTruncate
+	msg := oversizeTestEvent()
+	outmsg, _ := formatMessage(msg, time.Now())
+	fitted, err := fitMessage(msg, outmsg, time.Now())
+	if err != nil || len(fitted) != 1 {
+		t.Fatalf("Expected one truncated event, got %v (%v)", fitted, err)
+	}
+	var truncated map[string]interface{}
+	if err := json.Unmarshal([]byte(fitted[0]), &truncated); err != nil {
+		t.Fatal(err)
+	}
+	if len(fitted[0]) > config.MaxEventSize || truncated["truncated_fields"] != "cmdline" ||
+		!strings.HasSuffix(truncated["cmdline"].(string), truncationMarker) {
+		t.Errorf("Unexpected truncated event (%d bytes): %s", len(fitted[0]), fitted[0])
+	}
+
+	// an event that needs several fields truncated keeps as much of them as fits
+	config.OversizeFields = nil
+	msg = map[string]interface{}{"type": "ingress.event.procstart", "cmdline": strings.Repeat("a", 300),
+		"path": strings.Repeat("p", 280), "username": strings.Repeat("u", 260)}
+	several, _ := formatMessage(msg, time.Now())
+	fitted, err = fitMessage(msg, several, time.Now())
+	if err != nil || len(fitted) != 1 {
+		t.Fatalf("Expected one truncated event, got %v (%v)", fitted, err)
+	}
+	truncated = nil
+	if err := json.Unmarshal([]byte(fitted[0]), &truncated); err != nil {
+		t.Fatal(err)
+	}
+	if len(fitted[0]) > config.MaxEventSize || len(fitted[0]) < config.MaxEventSize-32 ||
+		truncated["truncated_fields"] != "cmdline,path" || truncated["username"] != msg["username"] {
+		t.Errorf("Unexpected truncated event (%d bytes): %s", len(fitted[0]), fitted[0])
+	}
+	config.OversizeFields = []string{"cmdline"}
+
+	config.OversizePolicy = OversizeSplit
+	msg = oversizeTestEvent()
+	fitted, err = fitMessage(msg, outmsg, time.Now())
+	if err != nil || len(fitted) < 2 {
+		t.Fatalf("Expected the event to be split, got %v (%v)", fitted, err)
+	}
+	var cmdline string
+	for i, part := range fitted {
+		var split map[string]interface{}
+		if err := json.Unmarshal([]byte(part), &split); err != nil {
+			t.Fatal(err)
+		}
+		if len(part) > config.MaxEventSize || split["split_part"] != float64(i+1) ||
+			split["split_parts"] != float64(len(fitted)) || split["path"] == nil {
+			t.Errorf("Unexpected part %d (%d bytes): %s", i+1, len(part), part)
+		}
+		cmdline += split["cmdline"].(string)
+	}
+	if cmdline != oversizeTestEvent()["cmdline"] {
+		t.Error("The parts of the split field don't add up to the original")
+	}
+
+	dir, err := ioutil.TempDir("", "oversize_events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := deadLetters
+	defer func() { deadLetters = saved }()
+	config.DeadLetterFile = filepath.Join(dir, "dead-letters.log")
+	if deadLetters, err = newAuditLog(config.DeadLetterFile, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer deadLetters.Close()
+
+	// the rest of the event doesn't fit either
+	config.MaxEventSize = 64
+	config.OversizePolicy = OversizeTruncate
+	fitted, err = fitMessage(oversizeTestEvent(), outmsg, time.Now())
+	if err != nil || len(fitted) != 0 {
+		t.Fatalf("Expected the event to be dropped, got %v (%v)", fitted, err)
+	}
+	written, err := ioutil.ReadFile(config.DeadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != outmsg+"\n" {
+		t.Errorf("The dropped event was not written to the dead letter file: %s", written)
+	}
+}
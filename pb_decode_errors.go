@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"github.com/streadway/amqp"
+)
+
+// reasons protobuf sensor events fail to decode, used as keys of the protobuf_decode_errors counters
+const (
+	decodeErrorUnmarshal   = "unmarshal"
+	decodeErrorEnvironment = "environment"
+	decodeErrorUnknownType = "unknown_event_type"
+	decodeErrorTruncated   = "truncated_bundle"
+)
+
+var protobufDecodeErrors = expvar.NewMap("protobuf_decode_errors")
+
+// protobuf field numbers used for partial decoding; see sensor_events.proto
+const (
+	pbEventHeaderField    = 1
+	pbEventEnvField       = 13
+	pbHeaderTimestamp     = 4
+	pbHeaderProcessPid    = 10
+	pbEnvEndpointField    = 1
+	pbEndpointSensorId    = 1
+	pbEndpointSensorHost  = 2
+	pbWireVarint          = 0
+	pbWireFixed64         = 1
+	pbWireLengthDelimited = 2
+	pbWireFixed32         = 5
+)
+
+// partialProtobufMessage builds a minimal event for a protobuf message that could not be decoded, so the failure is
+// visible downstream rather than the event disappearing. Whatever can still be recovered from the raw bytes (the
+// timestamp, pid and sensor id and hostname) is included, falling back to the AMQP headers for the sensor.
+func partialProtobufMessage(routingKey string, body []byte, headers amqp.Table, reason string,
+	err error) map[string]interface{} {
+
+	protobufDecodeErrors.Add(reason, 1)
+
+	outmsg := map[string]interface{}{
+		"type":                routingKey,
+		"decode_error":        true,
+		"decode_error_reason": reason,
+	}
+	if err != nil {
+		outmsg["decode_error_message"] = err.Error()
+	}
+
+	if env, err := createEnvMessage(headers); err == nil {
+		if env.Endpoint.SensorId != nil {
+			outmsg["sensor_id"] = env.Endpoint.GetSensorId()
+		}
+		if env.Endpoint.SensorHostName != nil {
+			outmsg["computer_name"] = env.Endpoint.GetSensorHostName()
+		}
+	}
+
+	scanProtobufFields(body, func(field, wireType int, value uint64, data []byte) {
+		switch {
+		case field == pbEventHeaderField && wireType == pbWireLengthDelimited:
+			scanProtobufFields(data, func(field, wireType int, value uint64, data []byte) {
+				if wireType != pbWireVarint {
+					return
+				}
+				switch field {
+				case pbHeaderTimestamp:
+					outmsg["timestamp"] = WindowsTimeToUnixTime(int64(value))
+				case pbHeaderProcessPid:
+					outmsg["pid"] = int32(value)
+				}
+			})
+		case field == pbEventEnvField && wireType == pbWireLengthDelimited:
+			scanProtobufFields(data, func(field, wireType int, value uint64, data []byte) {
+				if field != pbEnvEndpointField || wireType != pbWireLengthDelimited {
+					return
+				}
+				scanProtobufFields(data, func(field, wireType int, value uint64, data []byte) {
+					switch {
+					case field == pbEndpointSensorId && wireType == pbWireVarint:
+						outmsg["sensor_id"] = int32(value)
+					case field == pbEndpointSensorHost && wireType == pbWireLengthDelimited:
+						outmsg["computer_name"] = GetUnicodeFromUTF8(data)
+					}
+				})
+			})
+		}
+	})
+
+	return outmsg
+}
+
+// scanProtobufFields calls fn for each field at the top level of a protobuf-encoded message, stopping at the first
+// malformed field. Varint and fixed-width values are passed in value, and length-delimited fields in data.
+func scanProtobufFields(buf []byte, fn func(field, wireType int, value uint64, data []byte)) {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return
+		}
+		buf = buf[n:]
+
+		field, wireType := int(key>>3), int(key&7)
+		switch wireType {
+		case pbWireVarint:
+			value, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return
+			}
+			buf = buf[n:]
+			fn(field, wireType, value, nil)
+		case pbWireFixed64:
+			if len(buf) < 8 {
+				return
+			}
+			fn(field, wireType, binary.LittleEndian.Uint64(buf), nil)
+			buf = buf[8:]
+		case pbWireLengthDelimited:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || length > uint64(len(buf)-n) {
+				return
+			}
+			buf = buf[n:]
+			fn(field, wireType, 0, buf[:length])
+			buf = buf[length:]
+		case pbWireFixed32:
+			if len(buf) < 4 {
+				return
+			}
+			fn(field, wireType, uint64(binary.LittleEndian.Uint32(buf)), nil)
+			buf = buf[4:]
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/carbonblack/cb-event-forwarder/sensor_events"
+	"github.com/golang/protobuf/proto"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+func TestPartialProtobufDecode(t *testing.T) {
+	timestamp := int64(130000000000000000)
+	pid := int32(4242)
+	sensorId := int32(17)
+	hostName := "WIN-TEST"
+	version := int32(4)
+
+	// a message with a header and environment but no event body
+	body, err := proto.Marshal(&sensor_events.CbEventMsg{
+		Header: &sensor_events.CbHeaderMsg{Version: &version, Timestamp: &timestamp, ProcessPid: &pid},
+		Env: &sensor_events.CbEnvironmentMsg{
+			Endpoint: &sensor_events.CbEndpointEnvironmentMsg{SensorId: &sensorId, SensorHostName: &hostName},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := ProcessProtobufMessage("ingress.event.process", body, amqp.Table{})
+	if err == nil {
+		t.Fatal("Expected an error for a message with no event body")
+	}
+	if msg["decode_error"] != true || msg["decode_error_reason"] != decodeErrorUnknownType {
+		t.Errorf("Expected an unknown_event_type decode error, got %v", msg)
+	}
+	if msg["sensor_id"] != sensorId || msg["computer_name"] != hostName || msg["pid"] != pid ||
+		msg["timestamp"] != WindowsTimeToUnixTime(timestamp) {
+		t.Errorf("Partial decode did not recover header and environment fields: %v", msg)
+	}
+
+	// corrupt the end of the message: the header is still recoverable
+	corrupt := append(append([]byte{}, body...), 0xff, 0xff)
+	msg, err = ProcessProtobufMessage("ingress.event.process", corrupt, amqp.Table{"sensorId": int64(99)})
+	if err == nil {
+		t.Fatal("Expected an error for a corrupt message")
+	}
+	if msg["decode_error_reason"] != decodeErrorUnmarshal || msg["timestamp"] != WindowsTimeToUnixTime(timestamp) {
+		t.Errorf("Expected an unmarshal decode error with the timestamp recovered, got %v", msg)
+	}
+
+	// a bundle whose last length prefix points past the end of the body
+	bundle := make([]byte, 4, 4+len(body)+4)
+	binary.LittleEndian.PutUint32(bundle, uint32(len(body)))
+	bundle = append(bundle, body...)
+	bundle = append(bundle, 0xff, 0x00, 0x00, 0x00)
+
+	truncatedCount := func() string {
+		if v := protobufDecodeErrors.Get(decodeErrorTruncated); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+
+	before := truncatedCount()
+	msgs, _ := ProcessProtobufBundle("ingress.event.process", bundle, amqp.Table{})
+	if len(msgs) != 2 || msgs[1]["decode_error_reason"] != decodeErrorTruncated {
+		t.Errorf("Expected a truncated_bundle event at the end of the bundle, got %v", msgs)
+	}
+	if before == truncatedCount() {
+		t.Error("Expected the truncated_bundle counter to be incremented")
+	}
+}
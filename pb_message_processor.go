@@ -49,12 +49,25 @@ func ProcessProtobufBundle(routingKey string, body []byte, headers amqp.Table) (
 	i := 0
 
 	for bytesRead := 0; bytesRead < totalLength; {
+		if totalLength-bytesRead < 4 {
+			log.Printf("Truncated protobuf bundle: %d trailing bytes after event index %d", totalLength-bytesRead, i)
+			protobufDecodeErrors.Add(decodeErrorTruncated, 1)
+			break
+		}
+
 		length := (int)(binary.LittleEndian.Uint32(body[bytesRead : bytesRead+4]))
+		if length < 0 || length > totalLength-bytesRead-4 {
+			err := fmt.Errorf("event index %d has length %d but only %d bytes remain", i, length, totalLength-bytesRead-4)
+			log.Printf("Truncated protobuf bundle: %s", err)
+			msgs = append(msgs, partialProtobufMessage(routingKey, body[bytesRead+4:], headers, decodeErrorTruncated, err))
+			break
+		}
 
 		msg, err := ProcessProtobufMessage(routingKey, body[bytesRead+4:bytesRead+length+4], headers)
 		if err != nil {
 			log.Printf("Error in ProcessProtobufMessage for event index %d: %s", i, err.Error())
-		} else if msg != nil {
+		}
+		if msg != nil {
 			msgs = append(msgs, msg)
 		}
 
@@ -144,11 +157,13 @@ func createEnvMessage(headers amqp.Table) (*sensor_events.CbEnvironmentMsg, erro
 	}, nil
 }
 
+// ProcessProtobufMessage converts a single protobuf sensor event. If the event cannot be decoded, a minimal event
+// flagged with decode_error is returned along with the error.
 func ProcessProtobufMessage(routingKey string, body []byte, headers amqp.Table) (map[string]interface{}, error) {
 	cbMessage := new(sensor_events.CbEventMsg)
 	err := proto.Unmarshal(body, cbMessage)
 	if err != nil {
-		return nil, err
+		return partialProtobufMessage(routingKey, body, headers, decodeErrorUnmarshal, err), err
 	}
 
 	if cbMessage.Env == nil {
@@ -156,7 +171,7 @@ func ProcessProtobufMessage(routingKey string, body []byte, headers amqp.Table)
 		// (the raw sensor exchange does not fill in the SensorEnv or ServerEnv messages)
 		cbMessage.Env, err = createEnvMessage(headers)
 		if err != nil {
-			return nil, err
+			return partialProtobufMessage(routingKey, body, headers, decodeErrorEnvironment, err), err
 		}
 	}
 
@@ -203,7 +218,8 @@ func ProcessProtobufMessage(routingKey string, body []byte, headers amqp.Table)
 		eventMsg = false
 		WriteModinfoMessage(inmsg, outmsg)
 	default:
-		return nil, errors.New("Unknown event type encountered")
+		err = errors.New("Unknown event type encountered")
+		return partialProtobufMessage(routingKey, body, headers, decodeErrorUnknownType, err), err
 	}
 
 	// write metadata about the process in case this message is generated by a process on an endpoint
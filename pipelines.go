@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// sections named pipeline.<name>.<section> configure one pipeline
+const pipelineSectionPrefix = "pipeline."
+
+var pipelineNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// PipelineStatus is shown for each pipeline on the status page as pipelines.
+type PipelineStatus struct {
+	ConfigFile    string    `json:"config_file"`
+	StatusURL     string    `json:"status_url"`
+	Running       bool      `json:"running"`
+	PID           int       `json:"pid,omitempty"`
+	StartTime     time.Time `json:"start_time,omitempty"`
+	Restarts      int       `json:"restarts"`
+	LastExitTime  time.Time `json:"last_exit_time,omitempty"`
+	LastExitError string    `json:"last_exit_error,omitempty"`
+}
+
+// pipeline is one of the forwarders run by the pipeline supervisor.
+type pipeline struct {
+	name       string
+	configFile string
+	status     PipelineStatus
+	sync.Mutex
+}
+
+// pipelineSupervisor runs several independent forwarders - pipelines, each with its own bindings, processing and
+// outputs - defined in one configuration, as in
+//
+//	[bridge]
+//	pipelines=alerts,netconns
+//
+//	[pipeline.alerts.bridge]
+//	events_alert=ALL
+//	output_type=syslog
+//
+//	[pipeline.netconns.bridge]
+//	events_raw_sensor=ingress.event.netconn
+//	output_type=s3
+//
+// Each pipeline's configuration is the rest of the file with its own sections laid over it, and is run by a forwarder
+// of its own, which the supervisor starts, restarts when it exits, and stops when it is asked to; the pipelines share
+// nothing but the connection settings they are given, so a slow output in one can't hold back another, and each
+// reports its statistics on its own status page.
+type pipelineSupervisor struct {
+	pipelines []*pipeline
+}
+
+// newPipelineSupervisor writes the configuration of each of the pipelines named in the file at configLocation to
+// directory, and checks them.
+func newPipelineSupervisor(configLocation string, names []string, directory string) (*pipelineSupervisor, error) {
+	input, err := loadConfigFile(configLocation)
+	if err != nil {
+		return nil, err
+	}
+	basePort := config.HTTPServerPort
+	files, err := pipelineConfigs(input, names, basePort)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &pipelineSupervisor{}
+	ports := map[int]string{basePort: "the supervisor"}
+	paths := make(map[string]string)
+	for _, name := range names {
+		fn := filepath.Join(directory, name+".conf")
+		if err := writeConfigFile(fn, files[name]); err != nil {
+			return nil, err
+		}
+		pipelineConfig, err := ParseConfig(fn)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline %s: %s", name, err)
+		}
+		if other, ok := ports[pipelineConfig.HTTPServerPort]; ok {
+			return nil, fmt.Errorf("Pipeline %s: http_server_port %d is already used by %s", name,
+				pipelineConfig.HTTPServerPort, other)
+		}
+		ports[pipelineConfig.HTTPServerPort] = "pipeline " + name
+
+		// settings inherited from the rest of the file, or left to their defaults, would have pipelines write over
+		// each other's files
+		own := pipelinePaths(pipelineConfig)
+		for option, path := range own {
+			if other, ok := paths[path]; ok {
+				return nil, fmt.Errorf("Pipeline %s: %s (%s) is already used by %s", name, path, option, other)
+			}
+		}
+		for _, path := range own {
+			paths[path] = "pipeline " + name
+		}
+
+		s.pipelines = append(s.pipelines, &pipeline{
+			name:       name,
+			configFile: fn,
+			status: PipelineStatus{
+				ConfigFile: fn,
+				StatusURL:  fmt.Sprintf("http://localhost:%d/debug/vars", pipelineConfig.HTTPServerPort),
+			},
+		})
+	}
+	return s, nil
+}
+
+// pipelinePaths returns the files and directories a pipeline configured with c writes to, by the option that sets
+// them.
+func pipelinePaths(c Configuration) map[string]string {
+	paths := make(map[string]string)
+	for option, path := range map[string]string{
+		"dead_letter_file":               c.DeadLetterFile,
+		"audit_file":                     c.AuditFile,
+		"stats_rollup_file":              c.StatsRollupFile,
+		"holding_area_archive_directory": c.HoldingAreaArchiveDirectory,
+	} {
+		if len(path) > 0 {
+			paths[option] = filepath.Clean(path)
+		}
+	}
+	if c.BufferMemorySize > 0 {
+		paths["buffer_spill_file"] = filepath.Clean(c.BufferSpillFile)
+	}
+	for _, output := range []struct{ option, outType, connString string }{
+		{"output_type", c.OutputType, c.OutputParameters},
+		{"shadow_output_type", c.ShadowOutputType, c.ShadowOutputParameters},
+		{"tier_output_type", c.TierOutputType, c.TierOutputParameters},
+	} {
+		for option, path := range outputPaths(c, output.option, output.outType, output.connString) {
+			paths[option] = path
+		}
+	}
+	return paths
+}
+
+// outputPaths returns where the output of outType, set by option, keeps events given its connection string: its
+// holding area or file, and its archive, by what they are.
+func outputPaths(c Configuration, option, outType, connString string) map[string]string {
+	paths := make(map[string]string)
+	registration, ok := LookupOutput(outType)
+	if !ok || len(connString) == 0 {
+		return paths
+	}
+	if registration.Location != nil {
+		paths["the files of "+option] = filepath.Clean(registration.Location(connString))
+	}
+	if registration.Archives && len(c.OutputArchiveDirectory) > 0 {
+		paths["the archive of "+option] = outputArchiveLocation(c.OutputArchiveDirectory, outType+":"+connString)
+	}
+	return paths
+}
+
+// pipelineConfigs returns the configuration of each of the named pipelines. Options for a pipeline are set in
+// sections named pipeline.<name>.<section>, or, in YAML and TOML, nested in a pipeline section:
+//
+//	pipeline:
+//	  alerts:
+//	    bridge:
+//	      output_type: syslog
+//
+// A pipeline that doesn't set http_server_port serves its status page on the next port after the supervisor's, in
+// the order the pipelines are listed. The files a pipeline would otherwise share with the others - buffer_spill_file
+// (or its default), and dead_letter_file, audit_file and stats_rollup_file if they are set for every pipeline - are
+// named after the pipeline unless it sets its own: cb-event-forwarder.spill becomes cb-event-forwarder-alerts.spill.
+func pipelineConfigs(input ini.File, names []string, basePort int) (map[string]ini.File, error) {
+	shared := make(ini.File)
+	own := make(map[string]ini.File)
+	addOption := func(name, section, key, val string) {
+		if _, ok := own[name]; !ok {
+			own[name] = make(ini.File)
+		}
+		if _, ok := own[name][section]; !ok {
+			own[name][section] = make(ini.Section)
+		}
+		own[name][section][key] = val
+	}
+
+	for sectionName, section := range input {
+		switch {
+		case sectionName == "pipeline":
+			for key, val := range section {
+				parts := strings.SplitN(key, ".", 3)
+				if len(parts) < 3 {
+					return nil, fmt.Errorf("Invalid option '%s' in [pipeline]: should be "+
+						"<pipeline>.<section>.<option>", key)
+				}
+				addOption(parts[0], parts[1], parts[2], val)
+			}
+		case strings.HasPrefix(sectionName, pipelineSectionPrefix):
+			parts := strings.SplitN(strings.TrimPrefix(sectionName, pipelineSectionPrefix), ".", 2)
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("Invalid section [%s]: should be [pipeline.<pipeline>.<section>]", sectionName)
+			}
+			for key, val := range section {
+				addOption(parts[0], parts[1], key, val)
+			}
+		default:
+			shared[sectionName] = section
+		}
+	}
+
+	files := make(map[string]ini.File, len(names))
+	for i, name := range names {
+		if _, ok := own[name]; !ok {
+			return nil, fmt.Errorf("Pipeline %s has no [pipeline.%s.<section>] sections", name, name)
+		}
+
+		file := make(ini.File)
+		for _, sections := range []ini.File{shared, own[name]} {
+			for sectionName, section := range sections {
+				if _, ok := file[sectionName]; !ok {
+					file[sectionName] = make(ini.Section)
+				}
+				for key, val := range section {
+					file[sectionName][key] = val
+				}
+			}
+		}
+		if _, ok := file["bridge"]; !ok {
+			file["bridge"] = make(ini.Section)
+		}
+		delete(file["bridge"], "pipelines")
+		delete(file["bridge"], "pipeline_directory")
+		file["bridge"]["pipeline_name"] = name
+		if _, ok := own[name]["bridge"]["http_server_port"]; !ok {
+			file["bridge"]["http_server_port"] = strconv.Itoa(basePort + i + 1)
+		}
+		for _, option := range []string{"buffer_spill_file", "dead_letter_file", "audit_file", "stats_rollup_file"} {
+			if _, ok := own[name]["bridge"][option]; ok {
+				continue
+			}
+			path, ok := file["bridge"][option]
+			if !ok && option == "buffer_spill_file" {
+				path, ok = defaultBufferSpillFile, true
+			}
+			if ok && len(path) > 0 {
+				extension := filepath.Ext(path)
+				file["bridge"][option] = strings.TrimSuffix(path, extension) + "-" + name + extension
+			}
+		}
+		files[name] = file
+	}
+	return files, nil
+}
+
+// writeConfigFile writes file as INI, with the sections and options in order; it may hold credentials, so only the
+// forwarder can read it.
+func writeConfigFile(fn string, file ini.File) error {
+	f, err := os.OpenFile(fn+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writeConfigSections(f, file)
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func writeConfigSections(w io.Writer, file ini.File) {
+	names := make([]string, 0, len(file))
+	for name := range file {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "[%s]\n", name)
+		keys := make([]string, 0, len(file[name]))
+		for key := range file[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s=%s\n", key, file[name][key])
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// run starts every pipeline, and stops them once ctx is done.
+func (s *pipelineSupervisor) run(ctx context.Context) {
+	var pipelines sync.WaitGroup
+	for _, p := range s.pipelines {
+		pipelines.Add(1)
+		go func(p *pipeline) {
+			defer pipelines.Done()
+			p.supervise(ctx)
+		}(p)
+	}
+	pipelines.Wait()
+}
+
+// supervise runs the pipeline's forwarder, restarting it with a growing delay each time it exits, until ctx is done.
+func (p *pipeline) supervise(ctx context.Context) {
+	delay := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := p.runForwarder(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a forwarder that ran for a while before exiting is started again right away
+		if time.Since(started) > time.Minute {
+			delay = time.Second
+		}
+		log.Printf("Pipeline %s exited (%v); restarting in %s", p.name, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > time.Minute {
+			delay = time.Minute
+		}
+
+		p.Lock()
+		p.status.Restarts++
+		p.Unlock()
+	}
+}
+
+func (p *pipeline) runForwarder(ctx context.Context) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	if *debug {
+		args = append(args, "-debug")
+	}
+	cmd := exec.Command(executable, append(args, p.configFile)...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		p.recordExit(err)
+		return err
+	}
+
+	p.Lock()
+	p.status.Running, p.status.PID, p.status.StartTime = true, cmd.Process.Pid, time.Now()
+	p.Unlock()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// the forwarder drains its output before exiting, as when the supervisor itself was asked to stop
+		cmd.Process.Signal(syscall.SIGTERM)
+		err = <-done
+	}
+	p.recordExit(err)
+	return err
+}
+
+func (p *pipeline) recordExit(err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Running, p.status.PID, p.status.LastExitTime = false, 0, time.Now()
+	if err != nil {
+		p.status.LastExitError = err.Error()
+	} else {
+		p.status.LastExitError = ""
+	}
+}
+
+func (s *pipelineSupervisor) Statistics() interface{} {
+	stats := make(map[string]PipelineStatus, len(s.pipelines))
+	for _, p := range s.pipelines {
+		p.Lock()
+		stats[p.name] = p.status
+		p.Unlock()
+	}
+	return stats
+}
+
+// runPipelines supervises the pipelines configured in configLocation until the supervisor is asked to exit, or with
+// -check, only checks their configuration.
+func runPipelines(configLocation string) error {
+	supervisor, err := newPipelineSupervisor(configLocation, config.Pipelines, config.PipelineDirectory)
+	if err != nil {
+		return err
+	}
+	if *checkConfiguration {
+		for _, p := range supervisor.pipelines {
+			log.Printf("Pipeline %s is configured in %s", p.name, p.configFile)
+		}
+		return nil
+	}
+
+	expvar.Publish("pipelines", expvar.Func(supervisor.Statistics))
+	go http.ListenAndServe(fmt.Sprintf(":%d", config.HTTPServerPort), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancelOnSignal(cancel)
+
+	log.Printf("Running %d pipelines: %s", len(supervisor.pipelines), strings.Join(config.Pipelines, ", "))
+	supervisor.run(ctx)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPipelineConfigs(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"forwarder.yaml": `
+bridge:
+  rabbit_mq_password: guest
+  pipelines: alerts,netconns
+  output_type: file
+  server_name: cbtest
+  dead_letter_file: /var/log/cb/dead-letters.log
+pipeline:
+  alerts:
+    bridge:
+      events_alert: ALL
+      output_type: syslog
+    transform:
+      rename:
+        computer_name: hostname
+`,
+		"netconns.ini": "[pipeline.netconns.bridge]\nevents_raw_sensor=ingress.event.netconn\nhttp_server_port=40000\n",
+	})
+	input, err := loadConfigFile(filepath.Join(dir, "forwarder.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	netconns, err := loadConfigFile(filepath.Join(dir, "netconns.ini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, section := range netconns {
+		input[name] = section
+	}
+
+	files, err := pipelineConfigs(input, []string{"alerts", "netconns"}, 33706)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{
+		"alerts": {
+			"bridge/output_type":             "syslog",
+			"bridge/events_alert":            "ALL",
+			"bridge/server_name":             "cbtest",
+			"bridge/pipeline_name":           "alerts",
+			"bridge/http_server_port":        "33707",
+			"transform/rename.computer_name": "hostname",
+			"bridge/buffer_spill_file":       "/var/cb/data/event-forwarder/cb-event-forwarder-alerts.spill",
+		},
+		"netconns": {
+			"bridge/output_type":       "file",
+			"bridge/events_raw_sensor": "ingress.event.netconn",
+			"bridge/pipeline_name":     "netconns",
+			"bridge/http_server_port":  "40000",
+			"bridge/buffer_spill_file": "/var/cb/data/event-forwarder/cb-event-forwarder-netconns.spill",
+			"bridge/dead_letter_file":  "/var/log/cb/dead-letters-netconns.log",
+		},
+	}
+	for name, options := range expected {
+		for option, val := range options {
+			parts := strings.SplitN(option, "/", 2)
+			if got, ok := files[name].Get(parts[0], parts[1]); !ok || got != val {
+				t.Errorf("Expected pipeline %s to have [%s] %s=%s, got %q", name, parts[0], parts[1], val, got)
+			}
+		}
+		if _, ok := files[name].Get("bridge", "pipelines"); ok {
+			t.Errorf("Expected pipeline %s not to run pipelines of its own", name)
+		}
+	}
+	if _, ok := files["netconns"].Get("bridge", "events_alert"); ok {
+		t.Error("Expected the alerts pipeline's options not to be used by the netconns pipeline")
+	}
+
+	if _, err := pipelineConfigs(input, []string{"alerts", "dns"}, 33706); err == nil ||
+		!strings.Contains(err.Error(), "Pipeline dns") {
+		t.Errorf("Expected an error for a pipeline without a configuration, got %v", err)
+	}
+}
+
+func TestPipelineSupervisor(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	dir := writeConfigFiles(t, map[string]string{
+		"forwarder.conf": "[bridge]\nrabbit_mq_password=guest\npipelines=alerts,netconns\n\n" +
+			"[pipeline.alerts.bridge]\nevents_alert=ALL\n\n" +
+			"[pipeline.netconns.bridge]\nevents_raw_sensor=ingress.event.netconn\n",
+	})
+	configLocation := filepath.Join(dir, "forwarder.conf")
+	var err error
+	config, err = ParseConfig(configLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Pipelines) != 2 {
+		t.Fatalf("Expected two pipelines, got %v", config.Pipelines)
+	}
+
+	supervisor, err := newPipelineSupervisor(configLocation, config.Pipelines, filepath.Join(dir, "pipelines"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range supervisor.pipelines {
+		pipelineConfig, err := ParseConfig(p.configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pipelineConfig.PipelineName != config.Pipelines[i] || len(pipelineConfig.Pipelines) != 0 ||
+			pipelineConfig.HTTPServerPort != config.HTTPServerPort+i+1 {
+			t.Errorf("Unexpected configuration for pipeline %s: %+v", p.name, pipelineConfig)
+		}
+	}
+
+	stats := supervisor.Statistics().(map[string]PipelineStatus)
+	if stats["netconns"].Running || !strings.HasSuffix(stats["netconns"].StatusURL, ":33708/debug/vars") {
+		t.Errorf("Unexpected status %+v", stats["netconns"])
+	}
+}
+
+func TestPipelineNames(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"forwarder.conf": "[bridge]\nrabbit_mq_password=guest\npipelines=alerts,net conns\n",
+	})
+	if _, err := ParseConfig(filepath.Join(dir, "forwarder.conf")); err == nil ||
+		!strings.Contains(err.Error(), "Invalid pipeline name 'net conns'") {
+		t.Errorf("Expected an invalid pipeline name to be rejected, got %v", err)
+	}
+}
+
+func TestPipelinePaths(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"forwarder.conf": "[bridge]\nrabbit_mq_password=guest\npipelines=alerts,netconns\noutput_type=s3\n" +
+			"s3out=cb-events\n\n[pipeline.alerts.bridge]\nevents_alert=ALL\n\n" +
+			"[pipeline.netconns.bridge]\nevents_raw_sensor=ingress.event.netconn\n",
+	})
+	_, err := newPipelineSupervisor(filepath.Join(dir, "forwarder.conf"), []string{"alerts", "netconns"},
+		filepath.Join(dir, "pipelines"))
+	if err == nil || !strings.Contains(err.Error(),
+		"Pipeline netconns: /var/cb/data/event-forwarder (the files of output_type) is already used by pipeline alerts") {
+		t.Errorf("Expected the pipelines' holding areas to collide, got %v", err)
+	}
+
+	// network outputs each archive events in a directory of their own
+	paths := pipelinePaths(Configuration{OutputType: TCPOutputType, OutputParameters: "siem:514",
+		OutputArchiveDirectory: "/var/cb/data/event-forwarder/archive"})
+	if path := paths["the archive of output_type"]; path != "/var/cb/data/event-forwarder/archive/tcp_siem_514" {
+		t.Errorf("Unexpected archive of the output %s in %v", path, paths)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// default routing keys of the events the process context is added to
+var defaultProcessContextTypes = []string{"ingress.event.childproc", "ingress.event.netconn", "ingress.event.filemod"}
+
+// processContext is what is remembered of a procstart event.
+type processContext struct {
+	guid       string
+	path       string
+	parentGUID string
+}
+
+// ProcessContextStatistics is shown on the status page as process_context.
+type ProcessContextStatistics struct {
+	Processes int   `json:"processes"`
+	Capacity  int   `json:"capacity"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// processContextCache remembers the most recent procstart events, by process_guid, so that the events a process
+// causes can name it and its parent without a join in the SIEM. Each event of one of the configured types gets
+//
+//	process_path, process_name: the process that caused the event (for a childproc, the parent of the new process)
+//	parent_path, parent_name:   that process's parent, if its procstart was seen too
+//
+// Procstart events get parent_path and parent_name as well. The cache holds at most capacity processes, forgetting
+// the ones least recently used; an event whose process started before the forwarder did, or was forgotten, is left
+// alone.
+type processContextCache struct {
+	capacity int
+	types    []string
+
+	processes map[string]*list.Element
+	recent    *list.List
+	stats     ProcessContextStatistics
+	sync.Mutex
+}
+
+var processContexts *processContextCache
+
+func newProcessContextCache(capacity int, types []string) *processContextCache {
+	if len(types) == 0 {
+		types = defaultProcessContextTypes
+	}
+	return &processContextCache{
+		capacity:  capacity,
+		types:     types,
+		processes: make(map[string]*list.Element),
+		recent:    list.New(),
+		stats:     ProcessContextStatistics{Capacity: capacity},
+	}
+}
+
+// processName returns the file name in a Windows or Unix path.
+func processName(path string) string {
+	return path[strings.LastIndexAny(path, `\/`)+1:]
+}
+
+func stringField(msg map[string]interface{}, field string) string {
+	if val, ok := msg[field]; ok && val != nil {
+		return fmt.Sprint(val)
+	}
+	return ""
+}
+
+// Enrich remembers msg if it is a procstart event, and adds the context of its process if it is of one of the
+// configured types.
+func (c *processContextCache) Enrich(msg map[string]interface{}) {
+	eventType, _ := msg["type"].(string)
+	guid := stringField(msg, "process_guid")
+	if len(guid) == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if eventType == "ingress.event.procstart" {
+		process := processContext{guid: guid, path: stringField(msg, "path"),
+			parentGUID: stringField(msg, "parent_process_guid")}
+		if parent, ok := c.lookup(process.parentGUID); ok {
+			msg["parent_path"] = parent.path
+			msg["parent_name"] = processName(parent.path)
+		}
+		c.remember(process)
+		return
+	}
+
+	matched := false
+	for _, pattern := range c.types {
+		if RoutingKeyMatches(pattern, eventType) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return
+	}
+
+	process, ok := c.lookup(guid)
+	if !ok {
+		c.stats.Misses++
+		return
+	}
+	c.stats.Hits++
+	msg["process_path"] = process.path
+	msg["process_name"] = processName(process.path)
+	if parent, ok := c.lookup(process.parentGUID); ok {
+		msg["parent_path"] = parent.path
+		msg["parent_name"] = processName(parent.path)
+	}
+}
+
+// lookup returns the process with guid, marking it as recently used; the lock must be held.
+func (c *processContextCache) lookup(guid string) (processContext, bool) {
+	element, ok := c.processes[guid]
+	if !ok || len(guid) == 0 {
+		return processContext{}, false
+	}
+	c.recent.MoveToFront(element)
+	return element.Value.(processContext), true
+}
+
+// remember adds a process to the cache, forgetting the least recently used one if it is full; the lock must be held.
+func (c *processContextCache) remember(process processContext) {
+	if element, ok := c.processes[process.guid]; ok {
+		element.Value = process
+		c.recent.MoveToFront(element)
+		return
+	}
+
+	c.processes[process.guid] = c.recent.PushFront(process)
+	if c.recent.Len() > c.capacity {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.processes, oldest.Value.(processContext).guid)
+		c.stats.Evictions++
+	}
+}
+
+func (c *processContextCache) Statistics() interface{} {
+	c.Lock()
+	defer c.Unlock()
+	stats := c.stats
+	stats.Processes = c.recent.Len()
+	return stats
+}
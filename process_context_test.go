@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProcessContextEnrichment(t *testing.T) {
+	cache := newProcessContextCache(10, nil)
+
+	explorer := map[string]interface{}{"type": "ingress.event.procstart", "process_guid": "0001-explorer",
+		"path": `c:\windows\explorer.exe`, "parent_process_guid": "0001-userinit"}
+	cache.Enrich(explorer)
+	if _, ok := explorer["parent_name"]; ok {
+		t.Errorf("Expected no parent for a process whose parent wasn't seen, got %v", explorer)
+	}
+
+	powershell := map[string]interface{}{"type": "ingress.event.procstart", "process_guid": "0001-powershell",
+		"path": `c:\windows\system32\windowspowershell\v1.0\powershell.exe`, "parent_process_guid": "0001-explorer"}
+	cache.Enrich(powershell)
+	if powershell["parent_name"] != "explorer.exe" || powershell["parent_path"] != `c:\windows\explorer.exe` {
+		t.Errorf("Expected the parent of the procstart, got %v", powershell)
+	}
+
+	netconn := map[string]interface{}{"type": "ingress.event.netconn", "process_guid": "0001-powershell"}
+	cache.Enrich(netconn)
+	if netconn["process_name"] != "powershell.exe" || netconn["parent_name"] != "explorer.exe" {
+		t.Errorf("Expected the process and parent of the netconn, got %v", netconn)
+	}
+
+	regmod := map[string]interface{}{"type": "ingress.event.regmod", "process_guid": "0001-powershell"}
+	cache.Enrich(regmod)
+	if _, ok := regmod["process_name"]; ok {
+		t.Errorf("Expected no context for an event type that isn't configured, got %v", regmod)
+	}
+
+	unknown := map[string]interface{}{"type": "ingress.event.filemod", "process_guid": "0001-svchost"}
+	cache.Enrich(unknown)
+	if _, ok := unknown["process_name"]; ok {
+		t.Errorf("Expected no context for a process that wasn't seen, got %v", unknown)
+	}
+
+	stats := cache.Statistics().(ProcessContextStatistics)
+	if stats.Processes != 2 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
+
+func TestProcessContextEviction(t *testing.T) {
+	cache := newProcessContextCache(2, []string{"ingress.event.*"})
+	for _, guid := range []string{"a", "b"} {
+		cache.Enrich(map[string]interface{}{"type": "ingress.event.procstart", "process_guid": guid,
+			"path": "/usr/bin/" + guid})
+	}
+
+	// using a keeps it, so b is the one forgotten
+	cache.Enrich(map[string]interface{}{"type": "ingress.event.netconn", "process_guid": "a"})
+	cache.Enrich(map[string]interface{}{"type": "ingress.event.procstart", "process_guid": "c", "path": "/usr/bin/c"})
+
+	for guid, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		msg := map[string]interface{}{"type": "ingress.event.regmod", "process_guid": guid}
+		cache.Enrich(msg)
+		if _, ok := msg["process_name"]; ok != expected {
+			t.Errorf("Expected process %s to be remembered: %v", guid, expected)
+		}
+	}
+	if stats := cache.Statistics().(ProcessContextStatistics); stats.Evictions != 1 || stats.Processes != 2 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
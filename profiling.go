@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// profilingHandler serves runtime profiles under /debug/pprof/, in the same formats as net/http/pprof (which is not
+// imported, since it would serve them on the status server to anyone). Requests need the management API token, so
+// profiles are downloaded with curl and then read with go tool pprof.
+type profilingHandler struct {
+	token string
+}
+
+func (p *profilingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, p.token) {
+		writeJSONError(w, http.StatusUnauthorized, errors.New("missing or invalid API token"))
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	switch name {
+	case "":
+		p.index(w)
+	case "profile":
+		p.timed(w, r, 30*time.Second, pprof.StartCPUProfile, pprof.StopCPUProfile)
+	case "trace":
+		p.timed(w, r, time.Second, trace.Start, trace.Stop)
+	default:
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown profile %s", name))
+			return
+		}
+		debug, _ := strconv.Atoi(r.FormValue("debug"))
+		if name == "heap" && r.FormValue("gc") == "1" {
+			runtime.GC()
+		}
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		profile.WriteTo(w, debug)
+	}
+}
+
+func (p *profilingHandler) index(w http.ResponseWriter) {
+	names := []string{"profile", "trace"}
+	for _, profile := range pprof.Profiles() {
+		names = append(names, profile.Name())
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintf(w, "/debug/pprof/%s\n", name)
+	}
+}
+
+// timed records a profile for the number of seconds in the "seconds" parameter, or until the client goes away.
+func (p *profilingHandler) timed(w http.ResponseWriter, r *http.Request, duration time.Duration,
+	start func(w io.Writer) error, stop func()) {
+	if val := r.FormValue("seconds"); len(val) > 0 {
+		seconds, err := strconv.ParseFloat(val, 64)
+		if err != nil || seconds <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Invalid seconds '%s': should be a number", val))
+			return
+		}
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := start(w); err != nil {
+		// only one CPU profile or trace can run at a time
+		w.Header().Set("Content-Type", "application/json")
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+
+	select {
+	case <-time.After(duration):
+	case <-r.Context().Done():
+	}
+	stop()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueueDepthStatus is shown on the status page as bus_queue.
+type QueueDepthStatus struct {
+	Queue          string    `json:"queue"`
+	Messages       int64     `json:"messages"`
+	Ready          int64     `json:"messages_ready"`
+	Unacknowledged int64     `json:"messages_unacknowledged"`
+	Consumers      int64     `json:"consumers"`
+	PublishRate    float64   `json:"publish_rate"`
+	DeliverRate    float64   `json:"deliver_rate"`
+	LastPollTime   time.Time `json:"last_poll_time,omitempty"`
+	LastErrorTime  time.Time `json:"last_error_time,omitempty"`
+	LastErrorText  string    `json:"last_error_text,omitempty"`
+}
+
+// queueDepthMonitor polls the RabbitMQ management API for the state of the forwarder's queue on the Cb Response
+// server: a growing number of messages ready means the forwarder isn't keeping up, and the bus is backing up.
+type queueDepthMonitor struct {
+	url                string
+	username, password string
+	client             *http.Client
+
+	status QueueDepthStatus
+	sync.Mutex
+}
+
+// busQueue is set if rabbit_mq_management_url is.
+var busQueue *queueDepthMonitor
+
+// newQueueDepthMonitor returns a monitor of queue in the default virtual host, through the management API at
+// managementURL (such as http://cb-server:15672).
+func newQueueDepthMonitor(managementURL, queue, username, password string) *queueDepthMonitor {
+	return &queueDepthMonitor{
+		url:      strings.TrimSuffix(managementURL, "/") + "/api/queues/%2F/" + url.PathEscape(queue),
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: httpTransport()},
+		status:   QueueDepthStatus{Queue: queue},
+	}
+}
+
+// run polls the queue every interval until ctx is cancelled.
+func (m *queueDepthMonitor) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.poll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Could not get the depth of queue %s: %s", m.status.Queue, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// the part of the management API's description of a queue that the forwarder reports
+type managementQueue struct {
+	Messages               int64 `json:"messages"`
+	MessagesReady          int64 `json:"messages_ready"`
+	MessagesUnacknowledged int64 `json:"messages_unacknowledged"`
+	Consumers              int64 `json:"consumers"`
+	MessageStats           struct {
+		PublishDetails struct {
+			Rate float64 `json:"rate"`
+		} `json:"publish_details"`
+		DeliverGetDetails struct {
+			Rate float64 `json:"rate"`
+		} `json:"deliver_get_details"`
+	} `json:"message_stats"`
+}
+
+func (m *queueDepthMonitor) poll(ctx context.Context) error {
+	err := m.fetch(ctx)
+
+	m.Lock()
+	defer m.Unlock()
+	if err != nil {
+		m.status.LastErrorTime = time.Now()
+		m.status.LastErrorText = err.Error()
+	}
+	return err
+}
+
+func (m *queueDepthMonitor) fetch(ctx context.Context) error {
+	req, err := http.NewRequest("GET", m.url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(m.username, m.password)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return fmt.Errorf("the management API refused the credentials of %s; it needs the monitoring tag", m.username)
+	case http.StatusNotFound:
+		return fmt.Errorf("the queue does not exist")
+	default:
+		return fmt.Errorf("the management API returned %s", resp.Status)
+	}
+
+	var queue managementQueue
+	if err := json.NewDecoder(resp.Body).Decode(&queue); err != nil {
+		return fmt.Errorf("could not read the management API's response: %s", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.status.Messages = queue.Messages
+	m.status.Ready = queue.MessagesReady
+	m.status.Unacknowledged = queue.MessagesUnacknowledged
+	m.status.Consumers = queue.Consumers
+	m.status.PublishRate = queue.MessageStats.PublishDetails.Rate
+	m.status.DeliverRate = queue.MessageStats.DeliverGetDetails.Rate
+	m.status.LastPollTime = time.Now()
+	m.status.LastErrorText = ""
+	return nil
+}
+
+func (m *queueDepthMonitor) Statistics() interface{} {
+	m.Lock()
+	defer m.Unlock()
+	return m.status
+}
+
+// annotate adds the depth of the queue to a heartbeat event, once it is known.
+func (m *queueDepthMonitor) annotate(msg map[string]interface{}) {
+	stats := m.Statistics().(QueueDepthStatus)
+	if stats.LastPollTime.IsZero() {
+		return
+	}
+	msg["bus_queue_depth"] = stats.Messages
+	msg["bus_queue_ready"] = stats.Ready
+}
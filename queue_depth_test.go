@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueueDepthMonitor(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/queues/%2F/cb-event-forwarder:cbtest:1234" {
+			t.Errorf("Unexpected request for %s", r.URL.EscapedPath())
+		}
+		if username, password, ok := r.BasicAuth(); !ok || username != "cb" || password != "secret" {
+			t.Errorf("Unexpected credentials %s:%s", username, password)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"messages": 1500, "messages_ready": 1400, "messages_unacknowledged": 100, "consumers": 1,
+			"message_stats": {"publish_details": {"rate": 250.5}, "deliver_get_details": {"rate": 200.0}}}`)
+	}))
+	defer server.Close()
+
+	monitor := newQueueDepthMonitor(server.URL+"/", "cb-event-forwarder:cbtest:1234", "cb", "secret")
+	msg := make(map[string]interface{})
+	monitor.annotate(msg)
+	if len(msg) != 0 {
+		t.Errorf("Expected no depth in heartbeats before the first poll, got %v", msg)
+	}
+
+	if err := monitor.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stats := monitor.Statistics().(QueueDepthStatus)
+	if stats.Messages != 1500 || stats.Ready != 1400 || stats.Unacknowledged != 100 || stats.Consumers != 1 ||
+		stats.PublishRate != 250.5 || stats.DeliverRate != 200 {
+		t.Errorf("Unexpected queue status %+v", stats)
+	}
+	monitor.annotate(msg)
+	if msg["bus_queue_depth"] != int64(1500) || msg["bus_queue_ready"] != int64(1400) {
+		t.Errorf("Expected the depth in heartbeats, got %v", msg)
+	}
+
+	status = http.StatusUnauthorized
+	if err := monitor.poll(context.Background()); err == nil || !strings.Contains(err.Error(), "monitoring tag") {
+		t.Errorf("Expected an error about the user's permissions, got %v", err)
+	}
+	if stats := monitor.Statistics().(QueueDepthStatus); stats.LastErrorText == "" || stats.Messages != 1500 {
+		t.Errorf("Expected the error to be reported with the last depth, got %+v", stats)
+	}
+}
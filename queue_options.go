@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"time"
+)
+
+// QueueOptions controls how the forwarder's AMQP queue is declared and consumed.
+type QueueOptions struct {
+	Durable    bool
+	AutoDelete bool
+	// messages older than MessageTTL are discarded by the broker; 0 for no limit
+	MessageTTL time.Duration
+	// once the queue holds MaxLength messages the oldest are discarded; 0 for no limit
+	MaxLength int
+	// maximum number, and total size in bytes, of unacknowledged messages delivered to the forwarder; 0 for no
+	// limit. They only limit deliveries that are acknowledged manually.
+	PrefetchCount int
+	PrefetchSize  int
+	// number of channels consuming from the queue over the connection
+	Channels int
+	// acknowledge each message once its events have been queued for the output, rather than on delivery
+	ManualAck bool
+}
+
+// durable queues are consumed with a limited prefetch so that the unacknowledged messages held by the forwarder
+// (which are redelivered if it stops) do not grow without bound
+const defaultDurablePrefetchCount = 1000
+
+// maxConsumerChannels limits consumer_channels; beyond a few channels the message processors are the bottleneck
+const maxConsumerChannels = 32
+
+// qosWarning explains why the prefetch limits of o have no effect, if they don't.
+func (o QueueOptions) qosWarning() string {
+	if !o.ManualAck && (o.PrefetchCount > 0 || o.PrefetchSize > 0) {
+		return "prefetch_count and prefetch_size have no effect, since messages are acknowledged on delivery; set " +
+			"durable_queue to acknowledge them once their events are queued for the output"
+	}
+	return ""
+}
+
+// arguments returns the queue arguments for the TTL and length limits.
+func (o QueueOptions) arguments() amqp.Table {
+	args := amqp.Table{}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(o.MessageTTL / time.Millisecond)
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = int64(o.MaxLength)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// forwarderQueue returns the name and options of the queue the forwarder consumes from. By default each forwarder
+// has a queue of its own, which is deleted when the forwarder disconnects; forwarders in a consumer group share a
+// durable queue. In durable queue mode the queue is named after the host, so that it outlives the forwarder, and
+// messages are acknowledged manually. The [bridge] queue_* options override all of these.
+func forwarderQueue(hostname string, pid int) (string, QueueOptions) {
+	queueName := fmt.Sprintf("cb-event-forwarder:%s:%d", hostname, pid)
+	options := QueueOptions{Durable: false, AutoDelete: true}
+	if config.DurableQueue {
+		queueName = fmt.Sprintf("cb-event-forwarder:%s", hostname)
+		if len(config.PipelineName) > 0 {
+			// each pipeline on the host gets every event
+			queueName += ":" + config.PipelineName
+		}
+		options = QueueOptions{
+			Durable:       true,
+			AutoDelete:    false,
+			ManualAck:     true,
+			PrefetchCount: defaultDurablePrefetchCount,
+		}
+	}
+	if len(config.ConsumerGroup) > 0 {
+		var groupOptions QueueOptions
+		queueName, groupOptions = consumerGroupQueue(config.ConsumerGroup, config.subscriptionKeys(),
+			config.UseRawSensorExchange)
+		options.Durable, options.AutoDelete = groupOptions.Durable, groupOptions.AutoDelete
+	}
+
+	if len(config.QueueName) > 0 {
+		queueName = config.QueueName
+	}
+	if config.QueueDurable != nil {
+		options.Durable = *config.QueueDurable
+	}
+	if config.QueueAutoDelete != nil {
+		options.AutoDelete = *config.QueueAutoDelete
+	}
+	options.MessageTTL = config.QueueMessageTTL
+	options.MaxLength = config.QueueMaxLength
+	if config.PrefetchCount != nil {
+		options.PrefetchCount = *config.PrefetchCount
+	}
+	options.PrefetchSize = config.PrefetchSize
+	options.Channels = config.ConsumerChannels
+
+	return queueName, options
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForwarderQueue(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	config = Configuration{}
+	name, options := forwarderQueue("fwd-1", 42)
+	if name != "cb-event-forwarder:fwd-1:42" || options.Durable || !options.AutoDelete || options.arguments() != nil {
+		t.Errorf("Unexpected default queue %s: %+v", name, options)
+	}
+
+	keep := false
+	config.ConsumerGroup = "soc"
+	config.QueueName = "forwarder"
+	config.QueueAutoDelete = &keep
+	config.QueueMessageTTL = time.Hour
+	config.QueueMaxLength = 1000000
+	name, options = forwarderQueue("fwd-1", 42)
+	if name != "forwarder" || !options.Durable || options.AutoDelete {
+		t.Errorf("Expected the configured options to override the consumer group: %s %+v", name, options)
+	}
+
+	args := options.arguments()
+	if args["x-message-ttl"] != int64(3600000) || args["x-max-length"] != int64(1000000) {
+		t.Errorf("Unexpected queue arguments %v", args)
+	}
+}
+
+func TestDurableQueue(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	config = Configuration{DurableQueue: true}
+	name, options := forwarderQueue("fwd-1", 42)
+	if name != "cb-event-forwarder:fwd-1" {
+		t.Errorf("Expected the durable queue to be named after the host, got %s", name)
+	}
+	if !options.Durable || options.AutoDelete || !options.ManualAck ||
+		options.PrefetchCount != defaultDurablePrefetchCount {
+		t.Errorf("Unexpected durable queue options %+v", options)
+	}
+
+	config.ConsumerGroup = "soc"
+	prefetch := 50
+	config.PrefetchCount = &prefetch
+	name, options = forwarderQueue("fwd-1", 42)
+	if name == "cb-event-forwarder:fwd-1" || !options.ManualAck || options.PrefetchCount != 50 {
+		t.Errorf("Expected a durable consumer group queue with manual acks: %s %+v", name, options)
+	}
+	if warning := options.qosWarning(); len(warning) > 0 {
+		t.Errorf("Expected no warning with manual acks, got %s", warning)
+	}
+
+	// the default prefetch limit can be lifted
+	prefetch = 0
+	config.PrefetchSize = 1 << 20
+	if _, options = forwarderQueue("fwd-1", 42); options.PrefetchCount != 0 || options.PrefetchSize != 1<<20 {
+		t.Errorf("Unexpected prefetch limits %+v", options)
+	}
+
+	config.DurableQueue, config.ConsumerGroup, config.ConsumerChannels = false, "", 4
+	if _, options = forwarderQueue("fwd-1", 42); options.Channels != 4 {
+		t.Errorf("Expected 4 consumer channels, got %d", options.Channels)
+	}
+	if len(options.qosWarning()) == 0 {
+		t.Error("Expected a warning that prefetch limits have no effect on messages acknowledged on delivery")
+	}
+}
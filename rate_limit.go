@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var rateLimitedEvents = expvar.NewInt("rate_limited_event_count")
+
+// eventRateLimiter delays events so that no more than the configured number per second are sent to the output. A
+// limit of zero disables it. The limit can be changed while the forwarder is running.
+type eventRateLimiter struct {
+	sync.Mutex
+	limit  float64
+	tokens float64
+	last   time.Time
+}
+
+func newEventRateLimiter(eventsPerSecond float64) *eventRateLimiter {
+	l := &eventRateLimiter{}
+	l.SetLimit(eventsPerSecond)
+	return l
+}
+
+func (l *eventRateLimiter) SetLimit(eventsPerSecond float64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.limit = eventsPerSecond
+	// allow a burst of up to one second's worth of events
+	l.tokens = eventsPerSecond
+	l.last = time.Now()
+}
+
+func (l *eventRateLimiter) Limit() float64 {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.limit
+}
+
+// reserve takes a token and returns how long the caller must wait before using it.
+func (l *eventRateLimiter) reserve(now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.limit <= 0 {
+		return 0
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * l.limit
+	if l.tokens > l.limit {
+		l.tokens = l.limit
+	}
+	l.last = now
+	l.tokens--
+
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.limit * float64(time.Second))
+}
+
+// Wait blocks until the next event may be sent or ctx is cancelled.
+func (l *eventRateLimiter) Wait(ctx context.Context) error {
+	delay := l.reserve(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	rateLimitedEvents.Add(1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	RedactDrop = iota
+	RedactMask
+	RedactHash
+)
+
+const redactedMask = "********"
+
+// RedactionRule removes or obscures a single field in events whose type matches one of EventTypes (routing key
+// patterns such as "ingress.event.*" or "watchlist.#").
+type RedactionRule struct {
+	Field      string
+	Action     int
+	EventTypes []string
+}
+
+type Redactions struct {
+	Rules []RedactionRule
+	Salt  string
+}
+
+// parseRedactions reads the [redact] section. Keys take the form drop.<field>, mask.<field> or hash.<field>, with
+// a comma-separated list of event types the rule applies to as the value ("all" applies to every event type). The
+// optional "salt" key is prepended to values before they are hashed.
+func parseRedactions(section ini.Section, errs *ConfigurationError) Redactions {
+	r := Redactions{}
+
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hasHash := false
+	for _, key := range keys {
+		val := section[key]
+		if key == "salt" {
+			r.Salt = val
+			continue
+		}
+
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid redaction key '%s': should look like (drop|mask|hash).(field)", key))
+			continue
+		}
+
+		rule := RedactionRule{Field: parts[1]}
+		switch parts[0] {
+		case "drop":
+			rule.Action = RedactDrop
+		case "mask":
+			rule.Action = RedactMask
+		case "hash":
+			rule.Action = RedactHash
+			hasHash = true
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown redaction '%s' in key %s: valid redactions are drop, mask, hash",
+				parts[0], key))
+			continue
+		}
+
+		for _, eventType := range strings.Split(val, ",") {
+			eventType = strings.TrimSpace(eventType)
+			if strings.ToLower(eventType) == "all" {
+				eventType = "#"
+			}
+			if len(eventType) > 0 {
+				rule.EventTypes = append(rule.EventTypes, eventType)
+			}
+		}
+		if len(rule.EventTypes) == 0 {
+			errs.addErrorString(fmt.Sprintf("Missing event types for redaction %s: use 'all' to apply to every event", key))
+			continue
+		}
+
+		r.Rules = append(r.Rules, rule)
+	}
+
+	if hasHash && len(r.Salt) == 0 {
+		log.Println("WARNING: hashing fields in the [redact] section without a salt; hashed values may be reversible")
+	}
+
+	return r
+}
+
+func (r *Redactions) Empty() bool {
+	return len(r.Rules) == 0
+}
+
+// Apply redacts the configured fields of msg in place, including fields inside "docs".
+func (r *Redactions) Apply(msg map[string]interface{}) {
+	eventType, _ := msg["type"].(string)
+
+	for _, rule := range r.Rules {
+		if !rule.appliesTo(eventType) {
+			continue
+		}
+
+		forEachContainer(msg, rule.Field, func(container map[string]interface{}) {
+			switch rule.Action {
+			case RedactDrop:
+				delete(container, rule.Field)
+			case RedactMask:
+				container[rule.Field] = redactedMask
+			case RedactHash:
+				container[rule.Field] = r.hash(container[rule.Field])
+			}
+		})
+	}
+}
+
+func (rule *RedactionRule) appliesTo(eventType string) bool {
+	for _, pattern := range rule.EventTypes {
+		if RoutingKeyMatches(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactions) hash(value interface{}) string {
+	sum := sha256.Sum256([]byte(r.Salt + fmt.Sprintf("%v", value)))
+	return hex.EncodeToString(sum[:])
+}
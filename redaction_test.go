@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/vaughan0/go-ini"
+	"strings"
+	"testing"
+)
+
+func TestRoutingKeyMatches(t *testing.T) {
+	tests := [...]struct {
+		pattern    string
+		routingKey string
+		expected   bool
+	}{
+		{"#", "ingress.event.procstart", true},
+		{"watchlist.#", "watchlist.hit.process", true},
+		{"watchlist.#", "watchlist", true},
+		{"watchlist.#", "feed.ingress.hit.process", false},
+		{"ingress.event.*", "ingress.event.netconn", true},
+		{"ingress.event.*", "ingress.event", false},
+		{"*.hit.#", "watchlist.hit.process", true},
+		{"ingress.event.procstart", "ingress.event.procstart", true},
+		{"ingress.event.procstart", "ingress.event.procend", false},
+	}
+
+	for _, test := range tests {
+		if RoutingKeyMatches(test.pattern, test.routingKey) != test.expected {
+			t.Errorf("RoutingKeyMatches(%s, %s) should be %v", test.pattern, test.routingKey, test.expected)
+		}
+	}
+}
+
+func TestRedactions(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[redact]
+salt=pepper
+hash.username=all
+mask.command_line=ingress.event.procstart
+drop.cmdline=watchlist.#
+`))
+	if err != nil {
+		t.Fatalf("Could not parse test configuration: %s", err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	redactions := parseRedactions(input.Section("redact"), &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %s", errs)
+	}
+
+	procstart := map[string]interface{}{
+		"type":         "ingress.event.procstart",
+		"username":     "SYSTEM",
+		"command_line": "C:\\Windows\\system32\\svchost.exe -k netsvcs",
+	}
+	redactions.Apply(procstart)
+
+	if procstart["command_line"] != redactedMask {
+		t.Errorf("Expected command_line to be masked, got %v", procstart["command_line"])
+	}
+	hashed, _ := procstart["username"].(string)
+	if len(hashed) != 64 || hashed == "SYSTEM" {
+		t.Errorf("Expected username to be hashed, got %v", procstart["username"])
+	}
+
+	hit := map[string]interface{}{
+		"type": "watchlist.hit.process",
+		"docs": []map[string]interface{}{
+			{"username": "SYSTEM", "cmdline": "googleupdate.exe /ua", "command_line": "left alone"},
+		},
+	}
+	redactions.Apply(hit)
+
+	doc := hit["docs"].([]map[string]interface{})[0]
+	if _, ok := doc["cmdline"]; ok {
+		t.Errorf("Expected cmdline to be dropped from docs")
+	}
+	if doc["username"] != hashed {
+		t.Errorf("Expected the same username to hash to the same value, got %v and %v", doc["username"], hashed)
+	}
+	if doc["command_line"] != "left alone" {
+		t.Errorf("command_line should only be masked in procstart events, got %v", doc["command_line"])
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+)
+
+type redeliveryKey [16]byte
+
+// RedeliveryStatistics is shown on the status page as redelivery.
+type RedeliveryStatistics struct {
+	Remembered  int   `json:"remembered"`
+	Redelivered int64 `json:"redelivered"`
+	Duplicates  int64 `json:"duplicates_skipped"`
+}
+
+type rememberedDelivery struct {
+	key  redeliveryKey
+	time time.Time
+}
+
+// redeliveryCache remembers the messages processed in the last window, so that the messages the broker delivers
+// again after a reconnect - those that were processed but whose acknowledgement was lost with the connection - are
+// not sent to the output twice. Messages are identified by their message ID, if the publisher set one, and
+// otherwise by a hash of the exchange, routing key and body. Only messages the broker marks as redelivered are
+// checked; at most capacity messages are remembered, the oldest forgotten first.
+type redeliveryCache struct {
+	window   time.Duration
+	capacity int
+
+	seen  map[redeliveryKey]*list.Element
+	order *list.List
+	stats RedeliveryStatistics
+	sync.Mutex
+}
+
+var redeliveries *redeliveryCache
+
+func newRedeliveryCache(window time.Duration, capacity int) *redeliveryCache {
+	return &redeliveryCache{
+		window:   window,
+		capacity: capacity,
+		seen:     make(map[redeliveryKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func deliveryKey(delivery amqp.Delivery) redeliveryKey {
+	h := sha256.New()
+	if len(delivery.MessageId) > 0 {
+		h.Write([]byte("id\x00" + delivery.MessageId))
+	} else {
+		h.Write([]byte(delivery.Exchange + "\x00" + delivery.RoutingKey + "\x00"))
+		h.Write(delivery.Body)
+	}
+	var key redeliveryKey
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// Duplicate reports whether delivery is a redelivery of a message already processed.
+func (c *redeliveryCache) Duplicate(delivery amqp.Delivery, key redeliveryKey, now time.Time) bool {
+	if !delivery.Redelivered {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.expire(now)
+	c.stats.Redelivered++
+	if _, ok := c.seen[key]; ok {
+		c.stats.Duplicates++
+		return true
+	}
+	return false
+}
+
+// Remember records that the message with key has been processed.
+func (c *redeliveryCache) Remember(key redeliveryKey, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, ok := c.seen[key]; ok {
+		c.order.Remove(element)
+	}
+	c.seen[key] = c.order.PushBack(rememberedDelivery{key, now})
+	for c.order.Len() > c.capacity {
+		c.forget(c.order.Front())
+	}
+	c.expire(now)
+}
+
+// expire forgets the messages processed before the window; the lock must be held.
+func (c *redeliveryCache) expire(now time.Time) {
+	for oldest := c.order.Front(); oldest != nil; oldest = c.order.Front() {
+		if now.Sub(oldest.Value.(rememberedDelivery).time) <= c.window {
+			return
+		}
+		c.forget(oldest)
+	}
+}
+
+func (c *redeliveryCache) forget(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.seen, element.Value.(rememberedDelivery).key)
+}
+
+func (c *redeliveryCache) Statistics() interface{} {
+	c.Lock()
+	defer c.Unlock()
+	stats := c.stats
+	stats.Remembered = c.order.Len()
+	return stats
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/streadway/amqp"
+	"testing"
+	"time"
+)
+
+func TestRedeliveryCache(t *testing.T) {
+	cache := newRedeliveryCache(10*time.Minute, 2)
+	now := time.Now()
+
+	first := amqp.Delivery{Exchange: "api.events", RoutingKey: "ingress.event.procstart", Body: []byte("one")}
+	second := amqp.Delivery{Exchange: "api.events", RoutingKey: "ingress.event.procstart", Body: []byte("two")}
+	if deliveryKey(first) == deliveryKey(second) {
+		t.Fatal("Expected messages with different bodies to have different keys")
+	}
+	if deliveryKey(amqp.Delivery{MessageId: "a", Body: []byte("one")}) !=
+		deliveryKey(amqp.Delivery{MessageId: "a", Body: []byte("two")}) {
+		t.Error("Expected messages to be identified by their message ID")
+	}
+
+	cache.Remember(deliveryKey(first), now)
+	if cache.Duplicate(first, deliveryKey(first), now) {
+		t.Error("Expected a message that wasn't redelivered not to be checked")
+	}
+	first.Redelivered, second.Redelivered = true, true
+	if !cache.Duplicate(first, deliveryKey(first), now) {
+		t.Error("Expected the redelivered message to be recognised")
+	}
+	if cache.Duplicate(second, deliveryKey(second), now) {
+		t.Error("Expected a redelivered message that wasn't processed to be processed")
+	}
+
+	// the oldest message is forgotten once the cache is full, and every message once the window has passed
+	cache.Remember(deliveryKey(second), now)
+	third := amqp.Delivery{Body: []byte("three"), Redelivered: true}
+	cache.Remember(deliveryKey(third), now)
+	if cache.Duplicate(first, deliveryKey(first), now) || !cache.Duplicate(second, deliveryKey(second), now) {
+		t.Error("Expected only the oldest message to be forgotten")
+	}
+	if cache.Duplicate(third, deliveryKey(third), now.Add(11*time.Minute)) {
+		t.Error("Expected messages processed before the window to be forgotten")
+	}
+
+	stats := cache.Statistics().(RedeliveryStatistics)
+	if stats.Remembered != 0 || stats.Redelivered != 5 || stats.Duplicates != 2 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the largest configuration fetched from a remote source
+const remoteConfigLimit = 10 * 1024 * 1024
+
+// RemoteConfigStatus is shown on the status page as remote_config.
+type RemoteConfigStatus struct {
+	Location      string    `json:"location"`
+	CacheFile     string    `json:"cache_file"`
+	Checksum      string    `json:"checksum"`
+	PollInterval  string    `json:"poll_interval"`
+	LastFetchTime time.Time `json:"last_fetch_time"`
+	LastChange    time.Time `json:"last_change_time,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitempty"`
+	LastErrorText string    `json:"last_error_text,omitempty"`
+}
+
+// remoteConfig fetches the forwarder's configuration from a central location, given as the forwarder's argument
+// instead of a file:
+//
+//	https://config.example.com/forwarders/dc1.yaml   an HTTP GET, with $CB_CONFIG_TOKEN as a bearer token if set
+//	s3://bucket/forwarders/dc1.yaml?region=us-west-2 an S3 object, with the usual AWS credentials
+//	consul://localhost:8500/forwarders/dc1.ini       a Consul key, with $CONSUL_HTTP_TOKEN if set; consul+https://
+//	                                                 for Consul over TLS
+//
+// The format (INI, YAML or TOML) is taken from the extension, as for a file; included files are read from the
+// forwarder's disk. Each configuration fetched is kept in a cache file, which is used if the source can't be reached
+// when the forwarder starts. While it runs, the source is polled, and a changed configuration that is valid is
+// applied by restarting the forwarder in place; one that isn't is logged and ignored.
+type remoteConfig struct {
+	location  *url.URL
+	cacheFile string
+
+	client   *http.Client
+	s3Client *s3.S3
+
+	checksum string
+	status   RemoteConfigStatus
+	sync.Mutex
+}
+
+// isRemoteConfig reports whether the forwarder's argument is a remote location rather than a file.
+func isRemoteConfig(location string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://", "consul://", "consul+https://"} {
+		if strings.HasPrefix(location, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRemoteConfig returns the source at location, cached as a file in cacheDirectory.
+func newRemoteConfig(location, cacheDirectory string) (*remoteConfig, error) {
+	u, err := url.Parse(location)
+	if err != nil || len(u.Host) == 0 || len(strings.Trim(u.Path, "/")) == 0 {
+		return nil, fmt.Errorf("Invalid configuration location '%s': should look like https://host/path, "+
+			"s3://bucket/key or consul://host:port/key", location)
+	}
+
+	r := &remoteConfig{
+		location:  u,
+		cacheFile: filepath.Join(cacheDirectory, "remote-config"+path.Ext(u.Path)),
+	}
+	r.status = RemoteConfigStatus{Location: r.String(), CacheFile: r.cacheFile}
+	// the shared transport takes its settings from the configuration, so until it is loaded, HTTP and S3 use a
+	// transport of their own, with the proxy from the environment and TLS restricted as it is once it is loaded
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = restrictTLSConfig(&tls.Config{})
+	r.newClients(transport)
+	return r, nil
+}
+
+func (r *remoteConfig) newClients(transport *http.Transport) {
+	r.client = &http.Client{Timeout: time.Minute, Transport: transport}
+	if r.location.Scheme == "s3" {
+		region := r.location.Query().Get("region")
+		if len(region) == 0 {
+			region = "us-east-1"
+		}
+		r.s3Client = newS3ClientWithTransport(region, transport)
+	}
+}
+
+// String returns the location, without credentials or query parameters.
+func (r *remoteConfig) String() string {
+	return r.location.Scheme + "://" + r.location.Host + r.location.Path
+}
+
+// load fetches the configuration, falling back to the cached copy, and returns the file to parse.
+func (r *remoteConfig) load(ctx context.Context) (string, error) {
+	contents, err := r.fetch(ctx)
+	if err != nil {
+		if cached, cacheErr := ioutil.ReadFile(r.cacheFile); cacheErr == nil {
+			log.Printf("Could not fetch the configuration from %s (%s); using the copy in %s", r, err, r.cacheFile)
+			r.recordFetch(cached, err)
+			return r.cacheFile, nil
+		}
+		return "", fmt.Errorf("Could not fetch the configuration from %s: %s", r, err)
+	}
+
+	if err := r.saveCache(contents); err != nil {
+		return "", err
+	}
+	r.recordFetch(contents, nil)
+	log.Printf("Fetched the configuration from %s (checksum %s)", r, r.checksum)
+	return r.cacheFile, nil
+}
+
+// watch polls the source every interval until ctx is done, and calls apply once a changed, valid configuration has
+// been saved to the cache file.
+func (r *remoteConfig) watch(ctx context.Context, interval time.Duration, apply func()) {
+	r.Lock()
+	r.newClients(httpTransport())
+	r.status.PollInterval = interval.String()
+	r.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if r.poll(ctx) {
+				apply()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll checks the source for a changed configuration, and reports whether it has been saved to be applied.
+func (r *remoteConfig) poll(ctx context.Context) bool {
+	contents, err := r.fetch(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Could not fetch the configuration from %s: %s", r, err)
+		}
+		r.recordFetch(nil, err)
+		return false
+	}
+	if configChecksum(contents) == r.currentChecksum() {
+		r.recordFetch(contents, nil)
+		return false
+	}
+
+	// check the new configuration before replacing the one running
+	candidate := strings.TrimSuffix(r.cacheFile, filepath.Ext(r.cacheFile)) + ".new" + filepath.Ext(r.cacheFile)
+	if err := ioutil.WriteFile(candidate, contents, 0600); err != nil {
+		r.recordFetch(nil, err)
+		return false
+	}
+	defer os.Remove(candidate)
+	if _, err := ParseConfig(candidate); err != nil {
+		log.Printf("Ignoring the changed configuration at %s: %s", r, err)
+		r.recordFetch(nil, fmt.Errorf("the changed configuration is not valid: %s", err))
+		return false
+	}
+	if err := r.saveCache(contents); err != nil {
+		r.recordFetch(nil, err)
+		return false
+	}
+
+	r.recordFetch(contents, nil)
+	r.Lock()
+	r.status.LastChange = time.Now()
+	r.Unlock()
+	log.Printf("The configuration at %s has changed (checksum %s); restarting to apply it", r, r.currentChecksum())
+	return true
+}
+
+func (r *remoteConfig) fetch(ctx context.Context) ([]byte, error) {
+	r.Lock()
+	client, s3Client := r.client, r.s3Client
+	r.Unlock()
+
+	switch r.location.Scheme {
+	case "s3":
+		obj, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(r.location.Host),
+			Key:    aws.String(strings.TrimPrefix(r.location.Path, "/")),
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer obj.Body.Close()
+		return readRemoteConfig(obj.Body)
+	}
+
+	target, header := *r.location, make(http.Header)
+	switch r.location.Scheme {
+	case "consul", "consul+https":
+		target.Scheme = "http"
+		if r.location.Scheme == "consul+https" {
+			target.Scheme = "https"
+		}
+		target.Path = "/v1/kv/" + strings.TrimPrefix(r.location.Path, "/")
+		query := target.Query()
+		query.Set("raw", "")
+		target.RawQuery = query.Encode()
+		if token := os.Getenv("CONSUL_HTTP_TOKEN"); len(token) > 0 {
+			header.Set("X-Consul-Token", token)
+		}
+	default:
+		if token := os.Getenv("CB_CONFIG_TOKEN"); len(token) > 0 {
+			header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header
+	req.Header.Set("User-Agent", "cb-event-forwarder/"+version)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", r, resp.Status)
+	}
+	return readRemoteConfig(resp.Body)
+}
+
+func readRemoteConfig(body io.Reader) ([]byte, error) {
+	contents, err := ioutil.ReadAll(io.LimitReader(body, remoteConfigLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > remoteConfigLimit {
+		return nil, fmt.Errorf("the configuration is larger than %d bytes", remoteConfigLimit)
+	}
+	if len(bytes.TrimSpace(contents)) == 0 {
+		return nil, fmt.Errorf("the configuration is empty")
+	}
+	return contents, nil
+}
+
+// saveCache replaces the cache file with contents; it holds credentials, so only the forwarder can read it.
+func (r *remoteConfig) saveCache(contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(r.cacheFile), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(r.cacheFile+".tmp", contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(r.cacheFile+".tmp", r.cacheFile)
+}
+
+// recordFetch updates the status after a fetch: contents is the configuration in use, if it was fetched.
+func (r *remoteConfig) recordFetch(contents []byte, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if contents != nil {
+		r.checksum = configChecksum(contents)
+		r.status.Checksum = r.checksum
+	}
+	if err != nil {
+		r.status.LastErrorTime = time.Now()
+		r.status.LastErrorText = err.Error()
+		return
+	}
+	r.status.LastFetchTime = time.Now()
+	r.status.LastErrorText = ""
+}
+
+func (r *remoteConfig) currentChecksum() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.checksum
+}
+
+func (r *remoteConfig) Statistics() interface{} {
+	r.Lock()
+	defer r.Unlock()
+	return r.status
+}
+
+func configChecksum(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:8])
+}
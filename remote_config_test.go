@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestIsRemoteConfig(t *testing.T) {
+	for location, expected := range map[string]bool{
+		"https://config.example.com/dc1.yaml":  true,
+		"s3://bucket/forwarders/dc1.ini":       true,
+		"consul://localhost:8500/dc1.ini":      true,
+		"consul+https://consul:8501/dc1.toml":  true,
+		"/etc/cb/integrations/cb.conf":         false,
+		"conf/cb-event-forwarder.example.yaml": false,
+	} {
+		if isRemoteConfig(location) != expected {
+			t.Errorf("Expected isRemoteConfig(%s) to be %v", location, expected)
+		}
+	}
+
+	if _, err := newRemoteConfig("https://config.example.com/", t.TempDir()); err == nil {
+		t.Error("Expected a location without a path to be rejected")
+	}
+}
+
+func TestRemoteConfig(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	os.Setenv("CB_CONFIG_TOKEN", "secret")
+	defer os.Unsetenv("CB_CONFIG_TOKEN")
+
+	dir := t.TempDir()
+	valid := fmt.Sprintf("[bridge]\nrabbit_mq_password=guest\noutput_type=file\noutfile=%s\n",
+		filepath.Join(dir, "events.json"))
+	var lock sync.Mutex
+	contents, status := valid, http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/forwarders/dc1.ini" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Unexpected request for %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		w.WriteHeader(status)
+		fmt.Fprint(w, contents)
+	}))
+	defer server.Close()
+
+	remote, err := newRemoteConfig(server.URL+"/forwarders/dc1.ini", filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, err := remote.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := ioutil.ReadFile(fn); string(cached) != valid || filepath.Ext(fn) != ".ini" {
+		t.Errorf("Expected the configuration to be cached in an .ini file, got %q in %s", cached, fn)
+	}
+	if _, err := ParseConfig(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	if remote.poll(context.Background()) {
+		t.Error("Expected an unchanged configuration not to be applied")
+	}
+
+	lock.Lock()
+	contents = "[bridge]\noutput_type=file\n"
+	lock.Unlock()
+	if remote.poll(context.Background()) {
+		t.Error("Expected an invalid configuration not to be applied")
+	}
+	if cached, _ := ioutil.ReadFile(fn); string(cached) != valid {
+		t.Errorf("Expected the invalid configuration not to be cached, got %q", cached)
+	}
+	if remote.Statistics().(RemoteConfigStatus).LastErrorText == "" {
+		t.Error("Expected the invalid configuration to be reported")
+	}
+
+	changed := valid + "server_name=dc1\n"
+	lock.Lock()
+	contents = changed
+	lock.Unlock()
+	if !remote.poll(context.Background()) {
+		t.Error("Expected the changed configuration to be applied")
+	}
+	if cached, _ := ioutil.ReadFile(fn); string(cached) != changed {
+		t.Errorf("Expected the changed configuration to be cached, got %q", cached)
+	}
+
+	// the cached copy is used when the location can't be reached
+	lock.Lock()
+	status = http.StatusServiceUnavailable
+	lock.Unlock()
+	restarted, _ := newRemoteConfig(server.URL+"/forwarders/dc1.ini", filepath.Join(dir, "cache"))
+	if fn, err := restarted.load(context.Background()); err != nil || fn != remote.cacheFile {
+		t.Errorf("Expected the cached configuration to be used, got %s, %v", fn, err)
+	}
+	if restarted.currentChecksum() != configChecksum([]byte(changed)) {
+		t.Error("Expected the checksum of the cached configuration")
+	}
+
+	empty, _ := newRemoteConfig(server.URL+"/forwarders/dc1.ini", filepath.Join(dir, "empty"))
+	if _, err := empty.load(context.Background()); err == nil {
+		t.Error("Expected an error without a cached configuration")
+	}
+}
+
+func TestRemoteConfigS3Transport(t *testing.T) {
+	remote, err := newRemoteConfig("s3://bucket/forwarders/dc1.ini?region=eu-west-1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the configuration isn't loaded yet, so the shared transport can't be built
+	if transport := remote.s3Client.Client.Config.HTTPClient.Transport; transport != remote.client.Transport {
+		t.Errorf("Expected S3 to use the transport of the configuration's HTTP client, got %v", transport)
+	}
+}
+
+func TestRemoteConfigConsul(t *testing.T) {
+	os.Setenv("CONSUL_HTTP_TOKEN", "consul-secret")
+	defer os.Unsetenv("CONSUL_HTTP_TOKEN")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/forwarders/dc1.yaml" || r.Header.Get("X-Consul-Token") != "consul-secret" {
+			t.Errorf("Unexpected request for %s with %q", r.URL.Path, r.Header.Get("X-Consul-Token"))
+		}
+		if _, ok := r.URL.Query()["raw"]; !ok {
+			t.Error("Expected the raw value to be requested")
+		}
+		fmt.Fprint(w, "bridge:\n  output_type: file\n")
+	}))
+	defer server.Close()
+
+	remote, err := newRemoteConfig("consul://"+server.Listener.Addr().String()+"/forwarders/dc1.yaml", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, err := remote.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := loadConfigFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := input.Get("bridge", "output_type"); val != "file" {
+		t.Errorf("Expected the YAML configuration from Consul, got output_type=%s", val)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"strconv"
+	"syscall"
+)
+
+// memoryBallast is never used; a large allocation raises the heap size at which the garbage collector runs, so it
+// runs less often on a host where CPU is scarcer than memory.
+var memoryBallast []byte
+
+// applyResourceLimits limits the CPU and memory the forwarder uses, since it usually shares a host with Cb Response.
+func applyResourceLimits() error {
+	if config.MaxProcs > 0 {
+		runtime.GOMAXPROCS(config.MaxProcs)
+		log.Printf("Using at most %d CPUs", config.MaxProcs)
+	}
+
+	if config.MemoryLimit > 0 {
+		runtimedebug.SetMemoryLimit(config.MemoryLimit)
+		log.Printf("Soft memory limit set to %d bytes", config.MemoryLimit)
+	}
+
+	if config.MemoryBallast > 0 {
+		memoryBallast = make([]byte, config.MemoryBallast)
+	}
+
+	if config.NiceLevel != 0 {
+		if err := setNiceLevel(config.NiceLevel); err != nil {
+			return err
+		}
+		log.Printf("Running at nice level %d", config.NiceLevel)
+	}
+
+	return nil
+}
+
+// setNiceLevel sets the scheduling priority of every thread of the process. On Linux each thread has its own
+// priority, and threads started later inherit the priority of the thread that starts them.
+func setNiceLevel(level int) error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, 0, level)
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		// the thread may have exited since the directory was read
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, level); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
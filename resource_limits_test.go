@@ -0,0 +1,19 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestApplyResourceLimits(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	config = Configuration{MaxProcs: 1}
+	if err := applyResourceLimits(); err != nil {
+		t.Fatal(err)
+	}
+	if count := messageProcessorCount(); count != 2 {
+		t.Errorf("Expected 2 message processors with max_procs=1, got %d", count)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3FailoverStatistics is shown in the S3 output's status as failover.
+type S3FailoverStatistics struct {
+	SecondaryBucket  string    `json:"secondary_bucket"`
+	SecondaryRegion  string    `json:"secondary_region"`
+	FailedOver       bool      `json:"failed_over"`
+	FailedOverAt     time.Time `json:"failed_over_at,omitempty"`
+	Failovers        int64     `json:"failovers"`
+	SecondaryUploads int64     `json:"secondary_uploads"`
+	Manifest         string    `json:"manifest"`
+}
+
+// s3ManifestEntry is a line of the manifest: where an object was uploaded.
+type s3ManifestEntry struct {
+	Time      time.Time `json:"time"`
+	Object    string    `json:"object"`
+	Bucket    string    `json:"bucket"`
+	Region    string    `json:"region"`
+	Secondary bool      `json:"secondary"`
+}
+
+// s3Failover uploads to a secondary bucket, typically in another region, while the primary bucket can't be reached.
+// After failoverAfter uploads to the primary fail in a row, uploads go to the secondary instead, starting with the
+// one that failed. Every failbackAfter, the next bundle is tried on the primary again, and uploads go back to it once
+// one succeeds. Each object uploaded is recorded in the manifest, a file of JSON lines, so that the bundles can be
+// found in whichever bucket they went to.
+type s3Failover struct {
+	bucketName string
+	region     string
+	out        *s3.S3
+
+	failoverAfter int
+	failbackAfter time.Duration
+	manifest      string
+
+	// consecutive failures of the primary, and when uploads to the secondary started or the primary last failed
+	failures int
+	since    time.Time
+	stats    S3FailoverStatistics
+	sync.Mutex
+}
+
+func newS3Failover(bucketName, region string, out *s3.S3, failoverAfter int, failbackAfter time.Duration,
+	manifest string) *s3Failover {
+	return &s3Failover{
+		bucketName:    bucketName,
+		region:        region,
+		out:           out,
+		failoverAfter: failoverAfter,
+		failbackAfter: failbackAfter,
+		manifest:      manifest,
+		stats:         S3FailoverStatistics{SecondaryBucket: bucketName, SecondaryRegion: region, Manifest: manifest},
+	}
+}
+
+// parseSecondaryBucket splits [s3] secondary_bucket, (region):(bucket-name) or a bucket name in the primary's region.
+func parseSecondaryBucket(val, primaryRegion string) (region, bucketName string) {
+	if parts := strings.SplitN(val, ":", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return primaryRegion, val
+}
+
+// upload uploads fp as key to the primary bucket of o, or to the secondary. Signatures pass tryPrimary false, so
+// that they follow their bundle rather than trying the primary again.
+func (f *s3Failover) upload(ctx context.Context, o *S3Behavior, fp *os.File, key string, tryPrimary bool) error {
+	now := time.Now()
+	if f.usePrimary(now, tryPrimary) {
+		_, err := o.out.PutObjectWithContext(ctx, o.putObjectInput(fp, key, now))
+		if err == nil {
+			f.primarySucceeded()
+			f.record(s3ManifestEntry{now, key, o.bucketName, o.region, false})
+			return nil
+		}
+		if ctx.Err() != nil || !f.primaryFailed(now, o, err) {
+			return err
+		}
+		if _, seekErr := fp.Seek(0, io.SeekStart); seekErr != nil {
+			return err
+		}
+	}
+
+	input := o.putObjectInput(fp, key, now)
+	input.Bucket = aws.String(f.bucketName)
+	if _, err := f.out.PutObjectWithContext(ctx, input); err != nil {
+		return err
+	}
+	f.Lock()
+	f.stats.SecondaryUploads++
+	f.Unlock()
+	f.record(s3ManifestEntry{now, key, f.bucketName, f.region, true})
+	return nil
+}
+
+func (f *s3Failover) usePrimary(now time.Time, tryPrimary bool) bool {
+	f.Lock()
+	defer f.Unlock()
+	return !f.stats.FailedOver || (tryPrimary && now.Sub(f.since) >= f.failbackAfter)
+}
+
+func (f *s3Failover) primarySucceeded() {
+	f.Lock()
+	defer f.Unlock()
+	if f.stats.FailedOver {
+		log.Printf("Uploads to the primary S3 bucket succeed again; no longer uploading to %s:%s", f.region,
+			f.bucketName)
+		f.stats.FailedOver = false
+	}
+	f.failures = 0
+}
+
+// primaryFailed counts a failed upload to the primary bucket, and returns whether to upload to the secondary.
+func (f *s3Failover) primaryFailed(now time.Time, o *S3Behavior, err error) bool {
+	f.Lock()
+	defer f.Unlock()
+	f.failures++
+	if f.stats.FailedOver {
+		f.since = now
+		return true
+	}
+	if f.failures < f.failoverAfter {
+		return false
+	}
+	f.failover(now, o, fmt.Sprintf("%d uploads to S3 bucket %s:%s failed in a row, the last with %s", f.failures,
+		o.region, o.bucketName, err))
+	return true
+}
+
+// failover starts uploading to the secondary bucket, because of reason; the lock must be held.
+func (f *s3Failover) failover(now time.Time, o *S3Behavior, reason string) {
+	log.Printf("WARNING: %s; uploading to %s:%s instead, and trying %s again every %s", reason, f.region,
+		f.bucketName, o.bucketName, f.failbackAfter)
+	f.since = now
+	f.stats.FailedOver = true
+	f.stats.FailedOverAt = now
+	f.stats.Failovers++
+}
+
+// record appends an uploaded object to the manifest.
+func (f *s3Failover) record(entry s3ManifestEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	fp, err := os.OpenFile(f.manifest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = fp.Write(append(b, '\n'))
+		if closeErr := fp.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("Could not record the upload of %s to %s in %s: %s", entry.Object, entry.Bucket, f.manifest, err)
+	}
+}
+
+func (f *s3Failover) Statistics() S3FailoverStatistics {
+	f.Lock()
+	defer f.Unlock()
+	return f.stats
+}
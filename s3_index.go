@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3IndexDirectory is where, in the temp-file-directory, the index objects are kept until they are final.
+const s3IndexDirectory = "s3-index"
+
+// S3IndexEntry is a line of an index object: a bundle uploaded to the prefix.
+type S3IndexEntry struct {
+	Object     string           `json:"object"`
+	Uploaded   time.Time        `json:"uploaded"`
+	Size       int64            `json:"size"`
+	SHA256     string           `json:"sha256"`
+	Events     int64            `json:"events"`
+	FirstEvent *time.Time       `json:"first_event,omitempty"`
+	LastEvent  *time.Time       `json:"last_event,omitempty"`
+	EventTypes map[string]int64 `json:"event_types"`
+}
+
+// S3IndexStatistics is shown in the S3 output's status as index.
+type S3IndexStatistics struct {
+	Entries        int64     `json:"entries"`
+	PendingObjects int       `json:"pending_objects"`
+	LastErrorTime  time.Time `json:"last_error_time,omitempty"`
+	LastErrorText  string    `json:"last_error_text,omitempty"`
+}
+
+// s3Index keeps, with [s3] index_objects, an index of the bundles uploaded to each prefix of the bucket, so that a
+// data lake catalog can find new data by reading the index rather than listing the bucket. The index of a prefix is
+// an object of JSON lines for each day (UTC) bundles were uploaded, <prefix>/_index/2006-01-02.jsonl, uploaded again
+// after each bundle. Each object is built up in the temp-file-directory, and removed from there once the day is
+// over and the object has been uploaded complete. An index object that could not be uploaded is tried again with the
+// next bundle.
+type s3Index struct {
+	directory string
+	// the keys of the index objects that have entries S3 doesn't have yet
+	pending map[string]bool
+	stats   S3IndexStatistics
+	sync.Mutex
+}
+
+func newS3Index(directory string) (*s3Index, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	x := &s3Index{directory: directory, pending: make(map[string]bool)}
+
+	// whatever was left by the last run may not have been uploaded
+	names, err := filepath.Glob(filepath.Join(directory, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if key, err := url.PathUnescape(filepath.Base(name)); err == nil {
+			x.pending[key] = true
+		}
+	}
+	return x, nil
+}
+
+// s3IndexKey returns the key of the index object listing object, uploaded at uploaded. The index of bundles uploaded
+// with partition_keys is kept above the partitions, by their objectName, where catalogs don't take it for data.
+func s3IndexKey(object string, uploaded time.Time) string {
+	return path.Join(path.Dir(object), "_index", uploaded.UTC().Format("2006-01-02")+".jsonl")
+}
+
+// isS3IndexKey reports whether key is that of an index object.
+func isS3IndexKey(key string) bool {
+	return strings.HasPrefix(key, "_index/") || strings.Contains(key, "/_index/")
+}
+
+func (x *s3Index) localFile(key string) string {
+	return filepath.Join(x.directory, url.PathEscape(key))
+}
+
+// add adds a bundle uploaded by o to the index object key, and uploads the index objects that are out of date.
+func (x *s3Index) add(ctx context.Context, o *S3Behavior, key string, entry S3IndexEntry) {
+	x.Lock()
+	defer x.Unlock()
+
+	line, _ := json.Marshal(entry)
+	fp, err := os.OpenFile(x.localFile(key), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = fp.Write(append(line, '\n'))
+		if closeErr := fp.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		x.failed(key, err)
+		return
+	}
+	x.stats.Entries++
+	x.pending[key] = true
+
+	keys := make([]string, 0, len(x.pending))
+	for key := range x.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	today := time.Now().UTC().Format("2006-01-02") + ".jsonl"
+	for _, key := range keys {
+		if err := x.upload(ctx, o, key); err != nil {
+			x.failed(key, err)
+			continue
+		}
+		delete(x.pending, key)
+		if path.Base(key) != today {
+			// the day is over: the object is complete
+			os.Remove(x.localFile(key))
+		}
+	}
+}
+
+func (x *s3Index) upload(ctx context.Context, o *S3Behavior, key string) error {
+	fp, err := os.Open(x.localFile(key))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	// the index follows the bundles to the secondary bucket, like their signatures
+	if o.failover != nil {
+		return o.failover.upload(ctx, o, fp, key, false)
+	}
+	_, err = o.out.PutObjectWithContext(ctx, o.putObjectInput(fp, key, time.Now()))
+	return err
+}
+
+func (x *s3Index) failed(key string, err error) {
+	log.Printf("WARNING: Could not update the index object %s: %s; it is tried again with the next upload", key, err)
+	x.stats.LastErrorTime, x.stats.LastErrorText = time.Now(), err.Error()
+}
+
+func (x *s3Index) Statistics() S3IndexStatistics {
+	x.Lock()
+	defer x.Unlock()
+	stats := x.stats
+	stats.PendingObjects = len(x.pending)
+	return stats
+}
+
+// summarizeBundle reads a bundle, in any of the formats the forwarder writes, for its index entry.
+func summarizeBundle(fileName string) (S3IndexEntry, error) {
+	entry := S3IndexEntry{EventTypes: make(map[string]int64)}
+
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return entry, err
+	}
+	h := sha256.New()
+	entry.Size, err = io.Copy(h, fp)
+	fp.Close()
+	if err != nil {
+		return entry, err
+	}
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	tally := &bundleTally{entry: &entry}
+	out := bufio.NewWriter(tally)
+	var summary eventExportSummary
+	if err := exportFile(fileName, eventExportFilter{}, out, &summary); err != nil {
+		return entry, err
+	}
+	if err := out.Flush(); err != nil {
+		return entry, err
+	}
+	entry.Events = summary.Events
+	return entry, nil
+}
+
+// bundleTally counts the events of a bundle, written to it one a line, by type, and finds their time range.
+type bundleTally struct {
+	entry   *S3IndexEntry
+	partial []byte
+}
+
+func (t *bundleTally) Write(p []byte) (int, error) {
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		t.event(string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+}
+
+func (t *bundleTally) event(event string) {
+	eventType, timestamp, hasTimestamp, _ := exportedEventFields(event)
+	if len(strings.TrimSpace(eventType)) == 0 {
+		eventType = "unknown"
+	}
+	t.entry.EventTypes[eventType]++
+	if !hasTimestamp {
+		return
+	}
+	timestamp = timestamp.UTC()
+	if t.entry.FirstEvent == nil || timestamp.Before(*t.entry.FirstEvent) {
+		t.entry.FirstEvent = &timestamp
+	}
+	if t.entry.LastEvent == nil || timestamp.After(*t.entry.LastEvent) {
+		last := timestamp
+		t.entry.LastEvent = &last
+	}
+}
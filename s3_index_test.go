@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSummarizeBundle(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "event-forwarder.2017-01-01T00:00:00")
+	events := `{"type":"ingress.event.procstart","timestamp":1500000002}
+{"type":"ingress.event.netconn","timestamp":1500000001}
+{"type":"ingress.event.procstart","timestamp":1500000003}
+{"cb_server":"cbserver"}
+`
+	if err := ioutil.WriteFile(fileName, []byte(events), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := summarizeBundle(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Events != 4 || entry.Size != int64(len(events)) || len(entry.SHA256) != 64 {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	expected := map[string]int64{"ingress.event.procstart": 2, "ingress.event.netconn": 1, "unknown": 1}
+	if len(entry.EventTypes) != len(expected) {
+		t.Errorf("Expected event types %v, got %v", expected, entry.EventTypes)
+	}
+	for eventType, count := range expected {
+		if entry.EventTypes[eventType] != count {
+			t.Errorf("Expected %d events of type %s, got %d", count, eventType, entry.EventTypes[eventType])
+		}
+	}
+	if entry.FirstEvent == nil || entry.FirstEvent.Unix() != 1500000001 || entry.LastEvent == nil ||
+		entry.LastEvent.Unix() != 1500000003 {
+		t.Errorf("Unexpected time range %v - %v", entry.FirstEvent, entry.LastEvent)
+	}
+}
+
+func TestS3Index(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+
+	var lock sync.Mutex
+	fail := false
+	objects := make(map[string]string)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Method != "PUT" {
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if fail && strings.Contains(r.URL.Path, "/_index/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		objects[r.URL.Path] = string(body)
+	}))
+	defer server.Close()
+
+	config.S3ForcePathStyle, config.S3TLSVerify, config.S3Endpoint = true, false, server.URL
+	prefix := "events"
+	config.S3ObjectPrefix = &prefix
+	dir := t.TempDir()
+	index, err := newS3Index(filepath.Join(dir, s3IndexDirectory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &S3Behavior{bucketName: "cb-events", region: "us-east-1", out: newS3Client("us-east-1"), index: index}
+
+	upload := func(name string) error {
+		fileName := filepath.Join(dir, name)
+		ioutil.WriteFile(fileName, []byte(`{"type":"alert.watchlist.hit.query.process","timestamp":1500000000}`+"\n"),
+			0600)
+		fp, _ := os.Open(fileName)
+		defer fp.Close()
+		return o.Upload(context.Background(), fileName, fp).result
+	}
+
+	// an index object that can't be uploaded is tried again with the next bundle
+	fail = true
+	if err := upload("event-forwarder.1"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := o.Statistics().(S3Statistics); stats.Index == nil || stats.Index.PendingObjects != 1 ||
+		len(stats.Index.LastErrorText) == 0 {
+		t.Errorf("Expected the index object to be pending, got %+v", stats.Index)
+	}
+	lock.Lock()
+	fail = false
+	lock.Unlock()
+	if err := upload("event-forwarder.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload("event-forwarder.2.sig"); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "/cb-events/" + s3IndexKey("events/event-forwarder.1", time.Now())
+	lock.Lock()
+	lines := strings.Split(strings.TrimSpace(objects[key]), "\n")
+	lock.Unlock()
+	if len(lines) != 2 {
+		t.Fatalf("Expected an index object %s of two entries, got %v", key, objects)
+	}
+	var entry S3IndexEntry
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Object != "events/event-forwarder.2" || entry.Events != 1 ||
+		entry.EventTypes["alert.watchlist.hit.query.process"] != 1 {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if stats := o.Statistics().(S3Statistics); stats.Index.PendingObjects != 0 || stats.Index.Entries != 2 {
+		t.Errorf("Unexpected index statistics %+v", stats.Index)
+	}
+
+	// the object of the day is kept, and picked up again by the next run
+	if index, err = newS3Index(filepath.Join(dir, s3IndexDirectory)); err != nil || len(index.pending) != 1 {
+		t.Errorf("Expected the object of the day to be pending again, got %v (%v)", index.pending, err)
+	}
+}
+
+func TestS3IndexNotQueued(t *testing.T) {
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+
+	// an index object of a prefix named like the bundles is not a bundle
+	index, err := newS3Index(filepath.Join(behavior.directory, s3IndexDirectory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	localFile := index.localFile("event-forwarder/_index/2026-10-14.jsonl")
+	entry := `{"object":"event-forwarder/event-forwarder.1"}` + "\n"
+	if err := ioutil.WriteFile(localFile, []byte(entry), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	defer output.closeBundles()
+	if len(output.filesToUpload) != 0 {
+		t.Errorf("Expected nothing queued, got %v", output.filesToUpload[0].fileName)
+	}
+	if _, err := os.Stat(localFile); err != nil {
+		t.Errorf("Expected the index object to be left alone: %s", err)
+	}
+}
@@ -1,135 +1,223 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"log"
+	"net/http"
 	"os"
-	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
-	"syscall"
 	"time"
 )
 
-type UploadStatus struct {
-	fileName string
-	result   error
-}
-
-type S3Output struct {
+type S3Behavior struct {
 	bucketName string
+	region     string
 	out        *s3.S3
 
-	tempFileDirectory string
-	tempFileOutput    *FileOutput
-	region            string
-	rollOverDuration  time.Duration
-	currentFileSize   int64
-	maxFileSize       int64
+	// set with [s3] instance_id, or in a consumer group, where every forwarder uploads to its own directory in the
+	// bucket
+	instance string
 
-	lastUploadError     string
-	lastUploadErrorTime time.Time
-	uploadErrors        int64
-	successfulUploads   int64
-	fileResultChan      chan UploadStatus
+	// set with [s3] secondary_bucket
+	failover *s3Failover
 
-	filesToUpload []string
+	// set with [s3] index_objects
+	index *s3Index
 
-	// TODO: make this thread-safe from the status page
-	sync.RWMutex
+	// set with [s3] glue_table
+	partitions *gluePartitions
 }
 
 type S3Statistics struct {
-	BucketName    string      `json:"bucket_name"`
-	Region        string      `json:"region"`
-	FilesUploaded int64       `json:"files_uploaded"`
-	UploadErrors  int64       `json:"upload_errors"`
-	LastErrorTime time.Time   `json:"last_error_time"`
-	LastErrorText string      `json:"last_error_text"`
-	HoldingArea   interface{} `json:"file_holding_area"`
-
-	EncryptionEnabled bool `json:"encryption_enabled"`
+	BucketName string `json:"bucket_name"`
+	Region     string `json:"region"`
+	InstanceID string `json:"instance_id,omitempty"`
+
+	EncryptionEnabled bool   `json:"encryption_enabled"`
+	Endpoint          string `json:"endpoint,omitempty"`
+	PathStyle         bool   `json:"path_style"`
+
+	ObjectLockMode      string `json:"object_lock_mode,omitempty"`
+	ObjectLockRetention string `json:"object_lock_retention,omitempty"`
+	LegalHold           bool   `json:"legal_hold"`
+
+	Failover *S3FailoverStatistics `json:"failover,omitempty"`
+	Index    *S3IndexStatistics    `json:"index,omitempty"`
+
+	PartitionKeys bool                     `json:"partition_keys"`
+	Glue          *GluePartitionStatistics `json:"glue,omitempty"`
 }
 
-func (o *S3Output) uploadOne(fileName string) {
-	var baseName string
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         S3OutputType,
+		ParameterKey: "s3out",
+		StatusType:   "s3",
+		WritesFiles:  true,
+		Location:     s3HoldingArea,
+		Factory:      func() OutputHandler { return NewBundledOutput(&S3Behavior{}) },
+	})
+}
 
-	fp, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
-	if err != nil {
-		o.fileResultChan <- UploadStatus{fileName: fileName, result: err}
+// s3HoldingArea returns the temp-file-directory of an s3out connection string.
+func s3HoldingArea(connString string) string {
+	if parts := strings.SplitN(connString, ":", 3); len(parts) == 3 {
+		return parts[0]
 	}
+	return "/var/cb/data/event-forwarder"
+}
 
-	//
-	// If a prefix is specified then concatenate it with the Base of the filename
-	//
-	if config.S3ObjectPrefix != nil {
-		s := []string{*config.S3ObjectPrefix, filepath.Base(fileName)}
-		baseName = strings.Join(s, "/")
+func (o *S3Behavior) Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus {
+	now := time.Now().UTC()
+	completed := now
+	if config.S3PartitionKeys {
+		completed = bundleCompleted(fileName, now)
+	}
+	baseName := o.objectKey(fileName, completed)
+
+	var err error
+	if o.failover != nil {
+		err = o.failover.upload(ctx, o, fp, baseName, !isSignatureFile(fileName))
 	} else {
-		baseName = filepath.Base(fileName)
+		_, err = o.out.PutObjectWithContext(ctx, o.putObjectInput(fp, baseName, now))
+	}
+	if err != nil || isSignatureFile(fileName) {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+
+	if o.index != nil {
+		if entry, err := summarizeBundle(fileName); err != nil {
+			log.Printf("WARNING: Could not read %s for the index of its prefix: %s", fileName, err)
+		} else {
+			entry.Object, entry.Uploaded = baseName, now
+			o.index.add(ctx, o, s3IndexKey(o.objectName(fileName), now), entry)
+		}
+	}
+	if o.partitions != nil {
+		o.partitions.add(ctx, s3PartitionValues(completed))
 	}
+	return UploadStatus{fileName: fileName, result: nil}
+}
 
-	_, err = o.out.PutObject(&s3.PutObjectInput{
+// putObjectInput returns the request uploading fp as key. With Object Lock configured, each bundle is retained until
+// object_lock_retention after now, and/or placed under a legal hold, so that the bucket needs no default retention
+// of its own. (The SDK adds the Content-MD5 header that S3 requires for objects uploaded with a retention period.)
+func (o *S3Behavior) putObjectInput(fp *os.File, key string, now time.Time) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
 		Body:                 fp,
 		Bucket:               &o.bucketName,
-		Key:                  &baseName,
+		Key:                  &key,
 		ServerSideEncryption: config.S3ServerSideEncryption,
 		ACL:                  config.S3ACLPolicy,
-	})
-	fp.Close()
+	}
+	if len(config.S3ObjectLockMode) > 0 {
+		input.ObjectLockMode = aws.String(config.S3ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(now.Add(config.S3ObjectLockRetention).UTC())
+	}
+	if config.S3LegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+	return input
+}
 
-	if err == nil {
-		err = os.Remove(fileName)
-		if err != nil {
-			log.Printf("error removing %s: %s", fileName, err.Error())
+// parseRetentionPeriod parses a period of days (90d) or years of 365 days (7y), or a Go duration such as 36h.
+func parseRetentionPeriod(val string) (time.Duration, error) {
+	unit := map[byte]time.Duration{'d': 24 * time.Hour, 'y': 365 * 24 * time.Hour}
+	if len(val) > 1 {
+		if multiplier, ok := unit[val[len(val)-1]]; ok {
+			n, err := strconv.Atoi(val[:len(val)-1])
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n) * multiplier, nil
 		}
 	}
+	return time.ParseDuration(val)
+}
+
+// keyPrefix returns the directory in the bucket the forwarder uploads to, <object_prefix>/<instance>/, where the
+// prefix and instance are omitted if not set.
+func (o *S3Behavior) keyPrefix() string {
+	var s []string
+
+	//
+	// If a prefix is specified then concatenate it with the Base of the filename
+	//
+	if config.S3ObjectPrefix != nil {
+		s = append(s, *config.S3ObjectPrefix)
+	}
+	if len(o.instance) > 0 {
+		s = append(s, o.instance)
+	}
+	return strings.Join(append(s, ""), "/")
+}
 
-	o.fileResultChan <- UploadStatus{fileName: fileName, result: err}
+// objectName returns the key in the bucket for fileName: <object_prefix>/<instance>/<bundle name>.
+func (o *S3Behavior) objectName(fileName string) string {
+	return o.keyPrefix() + bundleUploadName(fileName)
 }
 
-func (o *S3Output) queueStragglers() {
-	fp, err := os.Open(o.tempFileDirectory)
-	if err != nil {
-		return
+// objectKey returns the key fileName, completed at completed, is uploaded as: its objectName or, with partition_keys,
+// its name in the Hive-style partition of the hour, as in <object_prefix>/<instance>/dt=2006-01-02/hour=15/<name>.
+func (o *S3Behavior) objectKey(fileName string, completed time.Time) string {
+	if !config.S3PartitionKeys {
+		return o.objectName(fileName)
 	}
+	return o.keyPrefix() + s3PartitionPath(s3PartitionValues(completed)) + "/" + bundleUploadName(fileName)
+}
 
-	infos, err := fp.Readdir(0)
+// bundleCompleted returns when the bundle fileName, or the bundle of a signature, was last written, so that a bundle
+// is uploaded to the same partition however many times it is tried, and its signature to the same partition as it.
+func bundleCompleted(fileName string, now time.Time) time.Time {
+	info, err := os.Stat(strings.TrimSuffix(fileName, signatureSuffix))
 	if err != nil {
-		return
+		return now
 	}
+	return info.ModTime().UTC()
+}
 
-	for _, info := range infos {
-		if info.IsDir() {
-			continue
-		}
-
-		fn := info.Name()
-		if !strings.HasPrefix(fn, "event-forwarder") {
-			continue
+// ClassifyError maps AWS error codes and HTTP status codes returned by S3 to upload error categories.
+func (o *S3Behavior) ClassifyError(err error) UploadErrorCategory {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch code := reqErr.StatusCode(); {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return UploadErrorAuth
+		case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable ||
+			reqErr.Code() == "SlowDown" || reqErr.Code() == "Throttling":
+			return UploadErrorThrottled
+		case code >= 500:
+			return UploadErrorNetwork
+		case code >= 400:
+			return UploadErrorClient
 		}
+	}
 
-		if len(strings.TrimPrefix(fn, "event-forwarder")) > 0 {
-			o.filesToUpload = append(o.filesToUpload, filepath.Join(o.tempFileDirectory, fn))
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "NoCredentialProviders", "ExpiredToken", "InvalidAccessKeyId", "SignatureDoesNotMatch", "AccessDenied":
+			return UploadErrorAuth
+		case "SlowDown", "Throttling":
+			return UploadErrorThrottled
+		case "RequestError", "RequestCanceled":
+			return UploadErrorNetwork
 		}
 	}
-}
 
-func (o *S3Output) Initialize(connString string) error {
-	o.fileResultChan = make(chan UploadStatus)
-	o.filesToUpload = make([]string, 0)
-
-	// maximum file size before we trigger an upload is ~10MB.
-	o.maxFileSize = 10 * 1024 * 1024
+	return UploadErrorUnknown
+}
 
-	// roll over duration defaults to five minutes
-	o.rollOverDuration = 5 * time.Minute
+func (o *S3Behavior) Initialize(connString string) (string, error) {
+	var tempFileDirectory string
 
 	// bucketName can either be a single value (just the bucket name itself, defaulting to "/var/cb/data/event-forwarder" as the
 	// temporary file directory and "us-east-1" for the AWS region), or:
@@ -139,165 +227,176 @@ func (o *S3Output) Initialize(connString string) error {
 	parts := strings.SplitN(connString, ":", 3)
 	if len(parts) == 1 {
 		o.bucketName = connString
-		o.tempFileDirectory = "/var/cb/data/event-forwarder"
+		tempFileDirectory = "/var/cb/data/event-forwarder"
 		o.region = "us-east-1"
 	} else if len(parts) == 3 {
 		o.bucketName = parts[2]
-		o.tempFileDirectory = parts[0]
+		tempFileDirectory = parts[0]
 		o.region = parts[1]
 	} else {
-		return errors.New(fmt.Sprintf("Invalid connection string: '%s' should look like (temp-file-directory):(region):(bucket-name)",
+		return "", errors.New(fmt.Sprintf("Invalid connection string: '%s' should look like (temp-file-directory):(region):(bucket-name)",
 			connString))
 	}
 
-	awsConfig := &aws.Config{Region: aws.String(o.region)}
-	if config.S3CredentialProfileName != nil {
-		parts = strings.SplitN(*config.S3CredentialProfileName, ":", 2)
-		credentialProvider := credentials.SharedCredentialsProvider{}
-
-		if len(parts) == 2 {
-			credentialProvider.Filename = parts[0]
-			credentialProvider.Profile = parts[1]
-		} else {
-			credentialProvider.Profile = parts[0]
+	if len(config.S3InstanceID) > 0 {
+		instance, err := resolveInstanceID(config.S3InstanceID, tempFileDirectory)
+		if err != nil {
+			return "", fmt.Errorf("Could not find the instance ID: %s", err)
+		}
+		o.instance = instance
+	} else if len(config.ConsumerGroup) > 0 {
+		// bundles are named after the time they were started, so forwarders sharing a bucket could overwrite
+		// each other's files
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
 		}
+		o.instance = hostname
+	}
 
-		creds := credentials.NewCredentials(&credentialProvider)
-		awsConfig.Credentials = creds
+	if len(config.S3Region) > 0 {
+		o.region = config.S3Region
 	}
+	o.out = newS3Client(o.region)
 
-	sess := session.New(awsConfig)
-	o.out = s3.New(sess)
+	if len(config.S3SecondaryBucket) > 0 {
+		region, bucketName := parseSecondaryBucket(config.S3SecondaryBucket, o.region)
+		manifest := config.S3ManifestFile
+		if len(manifest) == 0 {
+			manifest = filepath.Join(tempFileDirectory, "s3-manifest.jsonl")
+		}
+		o.failover = newS3Failover(bucketName, region, newS3Client(region), config.S3FailoverAfter,
+			config.S3FailbackAfter, manifest)
+		if _, err := o.failover.out.HeadBucket(&s3.HeadBucketInput{Bucket: &bucketName}); err != nil {
+			log.Printf("WARNING: Could not open the secondary bucket %s:%s; uploads can't fail over to it: %s",
+				region, bucketName, err)
+		}
+	}
 
-	_, err := o.out.HeadBucket(&s3.HeadBucketInput{Bucket: &o.bucketName})
-	if err != nil {
-		return errors.New(fmt.Sprintf("Could not open bucket %s: %s", o.bucketName, err))
+	if config.S3IndexObjects {
+		index, err := newS3Index(filepath.Join(tempFileDirectory, s3IndexDirectory))
+		if err != nil {
+			return "", fmt.Errorf("Could not keep the index objects: %s", err)
+		}
+		o.index = index
 	}
 
-	if err = os.MkdirAll(o.tempFileDirectory, 0700); err != nil {
-		return err
+	if len(config.S3GlueTable) > 0 {
+		o.partitions = newGluePartitions(newGlueClient(o.region), config.S3GlueCatalogID, config.S3GlueDatabase,
+			config.S3GlueTable, "s3://"+o.bucketName+"/"+o.keyPrefix())
 	}
 
-	currentPath := filepath.Join(o.tempFileDirectory, "event-forwarder")
+	_, err := o.out.HeadBucket(&s3.HeadBucketInput{Bucket: &o.bucketName})
+	if err != nil && o.failover != nil {
+		// the forwarder can start while the primary is unavailable, which is what the secondary is for
+		o.failover.Lock()
+		o.failover.failover(time.Now(), o, fmt.Sprintf("Could not open S3 bucket %s:%s: %s", o.region,
+			o.bucketName, err))
+		o.failover.Unlock()
+	} else if err != nil {
+		if len(config.S3Endpoint) > 0 {
+			return "", fmt.Errorf("Could not open bucket %s at %s: %s", o.bucketName, config.S3Endpoint, err)
+		}
+		return "", errors.New(fmt.Sprintf("Could not open bucket %s: %s", o.bucketName, err))
+	}
 
-	o.tempFileOutput = &FileOutput{}
-	err = o.tempFileOutput.Initialize(currentPath)
+	if err == nil && (len(config.S3ObjectLockMode) > 0 || config.S3LegalHold) {
+		// S3 rejects every upload with Object Lock settings to a bucket without Object Lock; find out now
+		lock, err := o.out.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{Bucket: &o.bucketName})
+		if err != nil {
+			return "", fmt.Errorf("Could not read the Object Lock configuration of bucket %s: %s", o.bucketName, err)
+		}
+		if lock.ObjectLockConfiguration == nil ||
+			aws.StringValue(lock.ObjectLockConfiguration.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+			return "", fmt.Errorf("Bucket %s does not have Object Lock enabled, needed for object_lock_mode and "+
+				"legal_hold", o.bucketName)
+		}
+	}
 
-	// find files in the output directory that haven't been uploaded yet and add them to the list
-	// we ignore any errors that may occur during this process
-	o.queueStragglers()
+	return tempFileDirectory, nil
+}
 
-	return err
+// newS3Client connects to S3 in region, with the credentials in [s3] credential_profile if it is set. With [s3]
+// endpoint set, it connects to that S3-compatible store instead of AWS: path-style addressing (bucket in the path
+// rather than the host name) is used with force_path_style, which most on-premises stores need unless they have
+// wildcard DNS, and tls_verify=false accepts their self-signed certificates.
+func newS3Client(region string) *s3.S3 {
+	return newS3ClientWithTransport(region, httpTransport())
 }
 
-func (o *S3Output) output(message string) error {
-	if o.currentFileSize+int64(len(message)) > o.maxFileSize {
-		err := o.rollOver()
-		if err != nil {
-			return err
+// newS3ClientWithTransport is newS3Client sending requests with transport rather than the shared transport, which
+// can't be used before the configuration is loaded.
+func newS3ClientWithTransport(region string, transport *http.Transport) *s3.S3 {
+	awsConfig := &aws.Config{Region: aws.String(region), HTTPClient: &http.Client{Transport: transport}}
+	if len(config.S3Endpoint) > 0 {
+		awsConfig.Endpoint = aws.String(config.S3Endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(config.S3ForcePathStyle)
+		if !config.S3TLSVerify {
+			log.Printf("Disabling TLS verification for S3 endpoint %s", config.S3Endpoint)
+			transport := transport.Clone()
+			transport.TLSClientConfig.InsecureSkipVerify = true
+			awsConfig.HTTPClient = &http.Client{Transport: transport}
 		}
+	} else if fipsMode() {
+		awsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if config.S3CredentialProfileName != nil {
+		awsConfig.Credentials = s3Credentials(*config.S3CredentialProfileName)
 	}
 
-	// first try to write the message to our output file
-	o.currentFileSize += int64(len(message))
-	return o.tempFileOutput.output(message)
+	sess := session.New(awsConfig)
+	return s3.New(sess)
 }
 
-func (o *S3Output) rollOver() error {
-	fn, err := o.tempFileOutput.rollOverFile("2006-01-02T15:04:05")
+// s3Credentials returns the credentials for [s3] credential_profile: a profile name, or filename:profile.
+func s3Credentials(profile string) *credentials.Credentials {
+	parts := strings.SplitN(profile, ":", 2)
+	credentialProvider := credentials.SharedCredentialsProvider{}
 
-	if err != nil {
-		return err
+	if len(parts) == 2 {
+		credentialProvider.Filename = parts[0]
+		credentialProvider.Profile = parts[1]
+	} else {
+		credentialProvider.Profile = parts[0]
 	}
 
-	go o.uploadOne(fn)
-	o.currentFileSize = 0
-
-	return nil
+	return credentials.NewCredentials(&credentialProvider)
 }
 
-func (o *S3Output) Key() string {
-	return fmt.Sprintf("%s:%s:%s", o.region, o.bucketName, o.tempFileDirectory)
+func (o *S3Behavior) Key() string {
+	return fmt.Sprintf("%s:%s", o.region, o.bucketName)
 }
 
-func (o *S3Output) String() string {
+func (o *S3Behavior) String() string {
 	return "AWS S3 " + o.Key()
 }
 
-func (o *S3Output) Statistics() interface{} {
-	return S3Statistics{
+func (o *S3Behavior) Statistics() interface{} {
+	stats := S3Statistics{
 		BucketName:        o.bucketName,
 		Region:            o.region,
-		FilesUploaded:     o.successfulUploads,
-		LastErrorTime:     o.lastUploadErrorTime,
-		LastErrorText:     o.lastUploadError,
-		UploadErrors:      o.uploadErrors,
-		HoldingArea:       o.tempFileOutput.Statistics(),
+		InstanceID:        o.instance,
 		EncryptionEnabled: config.S3ServerSideEncryption != nil,
+		Endpoint:          config.S3Endpoint,
+		PathStyle:         config.S3ForcePathStyle,
+		LegalHold:         config.S3LegalHold,
+		PartitionKeys:     config.S3PartitionKeys,
 	}
-}
-
-func (o *S3Output) Go(messages <-chan string, errorChan chan<- error) error {
-	if o.out == nil || o.tempFileOutput == nil {
-		return errors.New("S3 output not initialized")
-	}
-
-	go func() {
-		refreshTicker := time.NewTicker(1 * time.Second)
-		defer refreshTicker.Stop()
-		defer o.tempFileOutput.close()
-
-		hup := make(chan os.Signal, 1)
-		signal.Notify(hup, syscall.SIGHUP)
-
-		defer signal.Stop(hup)
-
-		for {
-			select {
-			case message := <-messages:
-				if err := o.output(message); err != nil {
-					errorChan <- err
-					return
-				}
-
-			case <-refreshTicker.C:
-				if time.Now().Sub(o.tempFileOutput.lastRolledOver) > o.rollOverDuration {
-					if err := o.rollOver(); err != nil {
-						errorChan <- err
-						return
-					}
-				}
-
-				if len(o.filesToUpload) > 0 {
-					var fn string
-					fn, o.filesToUpload = o.filesToUpload[0], o.filesToUpload[1:]
-					go o.uploadOne(fn)
-				}
-
-			case fileResult := <-o.fileResultChan:
-				if fileResult.result != nil {
-					o.uploadErrors += 1
-					o.lastUploadError = fileResult.result.Error()
-					o.lastUploadErrorTime = time.Now()
-
-					o.filesToUpload = append(o.filesToUpload, fileResult.fileName)
-
-					log.Printf("Error uploading file %s: %s", fileResult.fileName, fileResult.result)
-				} else {
-					o.successfulUploads += 1
-					log.Printf("Successfully uploaded file %s to %s.", fileResult.fileName, o.bucketName)
-				}
-
-			case <-hup:
-				// flush to S3 immediately
-				log.Println("Received SIGHUP, sending data to S3 immediately.")
-				if err := o.rollOver(); err != nil {
-					errorChan <- err
-					return
-				}
-			}
-		}
-	}()
-
-	return nil
+	if len(config.S3ObjectLockMode) > 0 {
+		stats.ObjectLockMode = config.S3ObjectLockMode
+		stats.ObjectLockRetention = config.S3ObjectLockRetention.String()
+	}
+	if o.failover != nil {
+		failover := o.failover.Statistics()
+		stats.Failover = &failover
+	}
+	if o.index != nil {
+		index := o.index.Statistics()
+		stats.Index = &index
+	}
+	if o.partitions != nil {
+		glue := o.partitions.Statistics()
+		stats.Glue = &glue
+	}
+	return stats
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/vaughan0/go-ini"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestS3ObjectLock(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	input, err := ini.Load(strings.NewReader(`
+[s3]
+object_lock_mode=compliance
+object_lock_retention=7y
+legal_hold=true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := ConfigurationError{Empty: true}
+	config.parseOutputOptions(input, S3OutputType, &errs)
+	if !errs.Empty {
+		t.Fatal(errs.Errors)
+	}
+	if config.S3ObjectLockMode != "COMPLIANCE" || config.S3ObjectLockRetention != 7*365*24*time.Hour ||
+		!config.S3LegalHold {
+		t.Fatalf("Unexpected Object Lock settings %s, %s, %v", config.S3ObjectLockMode, config.S3ObjectLockRetention,
+			config.S3LegalHold)
+	}
+
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	o := &S3Behavior{bucketName: "cb-events"}
+	put := o.putObjectInput(nil, "event-forwarder.2026-10-14T12:00:00", now)
+	if aws.StringValue(put.ObjectLockMode) != "COMPLIANCE" || aws.StringValue(put.ObjectLockLegalHoldStatus) != "ON" {
+		t.Errorf("Expected a compliance lock and legal hold, got %v and %v", put.ObjectLockMode,
+			put.ObjectLockLegalHoldStatus)
+	}
+	if until := aws.TimeValue(put.ObjectLockRetainUntilDate); !until.Equal(now.AddDate(7, 0, -2)) {
+		// 7 years of 365 days, two days short of 7 calendar years with the leap days in 2028 and 2032
+		t.Errorf("Expected the bundle to be retained until %s, got %s", now.AddDate(7, 0, -2), until)
+	}
+
+	// without Object Lock, uploads carry no lock headers
+	config.S3ObjectLockMode, config.S3ObjectLockRetention, config.S3LegalHold = "", 0, false
+	put = o.putObjectInput(nil, "event-forwarder.2026-10-14T12:00:00", now)
+	if put.ObjectLockMode != nil || put.ObjectLockRetainUntilDate != nil || put.ObjectLockLegalHoldStatus != nil {
+		t.Errorf("Expected no Object Lock settings, got %+v", put)
+	}
+
+	// a mode needs a retention period
+	input, _ = ini.Load(strings.NewReader("[s3]\nobject_lock_mode=governance\n"))
+	errs = ConfigurationError{Empty: true}
+	config.parseOutputOptions(input, S3OutputType, &errs)
+	if errs.Empty {
+		t.Error("Expected object_lock_mode without object_lock_retention to be refused")
+	}
+
+	for val, expected := range map[string]time.Duration{"90d": 90 * 24 * time.Hour, "36h": 36 * time.Hour} {
+		if period, err := parseRetentionPeriod(val); err != nil || period != expected {
+			t.Errorf("parseRetentionPeriod(%s) = %s, %v; expected %s", val, period, err, expected)
+		}
+	}
+	if _, err := parseRetentionPeriod("sevend"); err == nil {
+		t.Error("Expected an invalid retention period to be refused")
+	}
+}
+
+func TestS3CompatibleEndpoint(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+
+	var lock sync.Mutex
+	var requests []string
+	objects := make(map[string]string)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, r.Method+" "+r.Host+r.URL.Path)
+		if r.Method == "PUT" {
+			body, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Path] = string(body)
+		}
+	}))
+	defer server.Close()
+
+	input, _ := ini.Load(strings.NewReader(`
+[s3]
+endpoint=` + server.URL + `
+force_path_style=true
+region=minio
+tls_verify=false
+`))
+	errs := ConfigurationError{Empty: true}
+	config.parseS3Endpoint(input, &errs)
+	if !errs.Empty {
+		t.Fatal(errs.Errors)
+	}
+
+	dir := t.TempDir()
+	o := &S3Behavior{}
+	if _, err := o.Initialize(dir + ":us-east-1:cb-events"); err != nil {
+		t.Fatal(err)
+	}
+	if o.region != "minio" {
+		t.Errorf("Expected the region to be overridden, got %s", o.region)
+	}
+
+	fileName := filepath.Join(dir, "event-forwarder.2026-10-14T12:00:00")
+	ioutil.WriteFile(fileName, []byte("{}\n"), 0644)
+	fp, _ := os.Open(fileName)
+	defer fp.Close()
+	if status := o.Upload(context.Background(), fileName, fp); status.result != nil {
+		t.Fatal(status.result)
+	}
+
+	// the bucket is in the path, not the host name
+	host := strings.TrimPrefix(server.URL, "https://")
+	expected := []string{"HEAD " + host + "/cb-events", "PUT " + host + "/cb-events/event-forwarder.2026-10-14T12:00:00"}
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected requests %v, got %v", expected, requests)
+	}
+	if objects["/cb-events/event-forwarder.2026-10-14T12:00:00"] != "{}\n" {
+		t.Errorf("Expected the bundle in the bucket, got %v", objects)
+	}
+
+	// with the certificate verified, the self-signed test server is refused at Initialize
+	config.S3TLSVerify = true
+	if _, err := (&S3Behavior{}).Initialize(dir + ":us-east-1:cb-events"); err == nil {
+		t.Error("Expected a certificate that doesn't verify to be refused")
+	}
+}
+
+func TestS3Failover(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+
+	var lock sync.Mutex
+	primaryDown := true
+	var puts []string
+	store := func(name string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if r.Method != "PUT" {
+				return
+			}
+			ioutil.ReadAll(r.Body)
+			if name == "primary" && primaryDown {
+				// a client error, which the SDK doesn't retry
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			puts = append(puts, name+" "+r.URL.Path)
+		}))
+	}
+	primary, secondary := store("primary"), store("secondary")
+	defer primary.Close()
+	defer secondary.Close()
+
+	config.S3ForcePathStyle, config.S3TLSVerify = true, false
+	config.S3Endpoint = primary.URL
+	o := &S3Behavior{bucketName: "cb-events", region: "us-east-1", out: newS3Client("us-east-1")}
+	config.S3Endpoint = secondary.URL
+	dir := t.TempDir()
+	o.failover = newS3Failover("cb-events-dr", "us-west-2", newS3Client("us-west-2"), 2, 15*time.Minute,
+		filepath.Join(dir, "s3-manifest.jsonl"))
+
+	upload := func(name string) error {
+		fileName := filepath.Join(dir, name)
+		ioutil.WriteFile(fileName, []byte("{}\n"), 0644)
+		fp, _ := os.Open(fileName)
+		defer fp.Close()
+		return o.Upload(context.Background(), fileName, fp).result
+	}
+
+	if upload("event-forwarder.1") == nil {
+		t.Fatal("Expected the first failure to be returned")
+	}
+	if err := upload("event-forwarder.1"); err != nil {
+		t.Fatalf("Expected the upload to fail over, got %s", err)
+	}
+	if err := upload("event-forwarder.2"); err != nil || !o.failover.Statistics().FailedOver {
+		t.Fatalf("Expected uploads to stay on the secondary, got %v", err)
+	}
+
+	// once failback_after has passed, the primary is tried again
+	lock.Lock()
+	primaryDown = false
+	lock.Unlock()
+	o.failover.Lock()
+	o.failover.since = o.failover.since.Add(-time.Hour)
+	o.failover.Unlock()
+	if err := upload("event-forwarder.3"); err != nil || o.failover.Statistics().FailedOver {
+		t.Fatalf("Expected uploads to fail back to the primary, got %v", err)
+	}
+
+	expected := []string{"secondary /cb-events-dr/event-forwarder.1", "secondary /cb-events-dr/event-forwarder.2",
+		"primary /cb-events/event-forwarder.3"}
+	if strings.Join(puts, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected uploads %v, got %v", expected, puts)
+	}
+	stats := o.Statistics().(S3Statistics)
+	if stats.Failover == nil || stats.Failover.Failovers != 1 || stats.Failover.SecondaryUploads != 2 {
+		t.Errorf("Unexpected failover statistics %+v", stats.Failover)
+	}
+
+	manifest, _ := ioutil.ReadFile(filepath.Join(dir, "s3-manifest.jsonl"))
+	lines := strings.Split(strings.TrimSpace(string(manifest)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `"bucket":"cb-events-dr","region":"us-west-2","secondary":true`) ||
+		!strings.Contains(lines[2], `"object":"event-forwarder.3","bucket":"cb-events","region":"us-east-1"`) {
+		t.Errorf("Unexpected manifest %s", manifest)
+	}
+
+	if region, bucketName := parseSecondaryBucket("cb-events-dr", "eu-west-1"); region != "eu-west-1" ||
+		bucketName != "cb-events-dr" {
+		t.Errorf("Expected a bucket in the primary's region, got %s:%s", region, bucketName)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+var s3ReplayStatistics = expvar.NewMap("s3_replay")
+
+// s3ReplaySource selects the bundles to replay: the objects in bucket whose keys start with prefix, uploaded from
+// from up to (but not including) to. A zero time leaves that end of the range open.
+type s3ReplaySource struct {
+	bucket string
+	prefix string
+	from   time.Time
+	to     time.Time
+}
+
+// parseS3ReplaySource parses a location such as s3://bucket/prefix (the s3:// is optional) and the times given to
+// -replay-from and -replay-to, each a date such as 2006-01-02 or an RFC 3339 time.
+func parseS3ReplaySource(location, from, to string) (s3ReplaySource, error) {
+	var source s3ReplaySource
+
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	source.bucket = parts[0]
+	if len(parts) == 2 {
+		source.prefix = parts[1]
+	}
+	if len(source.bucket) == 0 {
+		return source, fmt.Errorf("Invalid S3 location '%s': should look like s3://bucket/prefix", location)
+	}
+
+	var err error
+	if len(from) > 0 {
+		if source.from, err = parseDateOrTime(from); err != nil {
+			return source, fmt.Errorf("Invalid -replay-from '%s': should be a date such as 2006-01-02, or a time such "+
+				"as 2006-01-02T15:04:05Z", from)
+		}
+	}
+	if len(to) > 0 {
+		if source.to, err = parseDateOrTime(to); err != nil {
+			return source, fmt.Errorf("Invalid -replay-to '%s': should be a date such as 2006-01-02, or a time such "+
+				"as 2006-01-02T15:04:05Z", to)
+		}
+	}
+	if !source.from.IsZero() && !source.to.IsZero() && !source.from.Before(source.to) {
+		return source, errors.New("-replay-from must be before -replay-to")
+	}
+	return source, nil
+}
+
+func (source s3ReplaySource) includes(uploaded time.Time) bool {
+	return (source.from.IsZero() || !uploaded.Before(source.from)) && (source.to.IsZero() || uploaded.Before(source.to))
+}
+
+// runS3Replay sends the events in previously uploaded JSON bundles through the configured output, oldest bundle
+// first. The events have already been processed, so they are only formatted (in the configured output_format) and
+// sent; bundles written in LEEF cannot be read back.
+func runS3Replay(ctx context.Context, client s3iface.S3API, source s3ReplaySource) error {
+	var objects []*s3.Object
+	err := client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(source.bucket),
+		Prefix: aws.String(source.prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			// the index objects and signatures kept with the bundles aren't events
+			key := aws.StringValue(object.Key)
+			if isS3IndexKey(key) || isSignatureFile(key) {
+				continue
+			}
+			if source.includes(aws.TimeValue(object.LastModified)) {
+				objects = append(objects, object)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Could not list s3://%s/%s: %s", source.bucket, source.prefix, err)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		ti, tj := aws.TimeValue(objects[i].LastModified), aws.TimeValue(objects[j].LastModified)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return aws.StringValue(objects[i].Key) < aws.StringValue(objects[j].Key)
+	})
+
+	log.Printf("Replaying %d bundles from s3://%s/%s", len(objects), source.bucket, source.prefix)
+	for _, object := range objects {
+		if err := replayS3Object(ctx, client, source.bucket, aws.StringValue(object.Key)); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("Could not replay s3://%s/%s: %s", source.bucket, aws.StringValue(object.Key), err)
+			s3ReplayStatistics.Add("failed_bundles", 1)
+		}
+	}
+
+	log.Printf("Replay from s3://%s/%s complete", source.bucket, source.prefix)
+	return nil
+}
+
+func replayS3Object(ctx context.Context, client s3iface.S3API, bucket, key string) error {
+	object, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	// one formatted event per line, or per record of an indexed bundle
+	var events, invalid int64
+	replay := func(event []byte) error {
+		if len(bytes.TrimSpace(event)) == 0 {
+			return nil
+		}
+		var msg map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(event))
+		// keep numbers as they were written, rather than converting them to float64s
+		decoder.UseNumber()
+
+		if decoder.Decode(&msg) != nil {
+			invalid++
+			s3ReplayStatistics.Add("invalid_events", 1)
+			return nil
+		}
+		if err := outputMessage(ctx, msg); err != nil {
+			return err
+		}
+		events++
+		s3ReplayStatistics.Add("events", 1)
+		return nil
+	}
+
+	r := bufio.NewReader(object.Body)
+	if compression := bundleCompressionOf(r); len(compression) > 0 {
+		decompressed, err := newBundleDecompressor(r, compression, config.ZstdDictionary)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		r = bufio.NewReader(decompressed)
+	}
+	if header, _ := r.Peek(len(indexedBundleMagic)); string(header) == indexedBundleMagic {
+		if err := readIndexedBundleEvents(r, func(e indexedBundleEvent) error { return replay(e.Event) }); err != nil {
+			return err
+		}
+	} else {
+		for {
+			line, err := r.ReadBytes('\n')
+			if replayErr := replay(line); replayErr != nil {
+				return replayErr
+			}
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	if events == 0 && invalid > 0 {
+		return errors.New("no JSON events found; only bundles written with output_format=json can be replayed")
+	}
+	s3ReplayStatistics.Add("bundles", 1)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReplayBucket serves objects from memory; the other S3 calls are not implemented.
+type testReplayBucket struct {
+	s3iface.S3API
+	objects  map[string]string
+	uploaded map[string]time.Time
+}
+
+func (b *testReplayBucket) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	page := &s3.ListObjectsV2Output{}
+	for key := range b.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			page.Contents = append(page.Contents, &s3.Object{
+				Key:          aws.String(key),
+				LastModified: aws.Time(b.uploaded[key]),
+			})
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func (b *testReplayBucket) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput,
+	opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(strings.NewReader(b.objects[aws.StringValue(input.Key)])),
+	}, nil
+}
+
+func TestS3Replay(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OutputFormat = JSONOutputFormat
+
+	day := func(d int) time.Time { return time.Date(2026, 9, d, 12, 0, 0, 0, time.UTC) }
+	bucket := &testReplayBucket{
+		objects: map[string]string{
+			"events/b": `{"type":"ingress.event.procend","process_pid":2}` + "\n",
+			"events/a": `{"type":"ingress.event.procstart","process_pid":1}` + "\n\n" +
+				`{"type":"ingress.event.netconn","process_pid":1}` + "\n",
+			"events/old": `{"type":"ingress.event.filemod"}` + "\n",
+			"other/c":    `{"type":"ingress.event.regmod"}` + "\n",
+			// neither the index nor the signatures are replayed
+			"events/_index/2026-09-03.jsonl": `{"object":"events/b","events":1}` + "\n",
+			"events/b.sig":                   "signature",
+		},
+		uploaded: map[string]time.Time{"events/a": day(2), "events/b": day(3), "events/old": day(1), "other/c": day(2),
+			"events/_index/2026-09-03.jsonl": day(3), "events/b.sig": day(3)},
+	}
+
+	source, err := parseS3ReplaySource("s3://cb-events/events/", "2026-09-02", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runS3Replay(context.Background(), bucket, source); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ingress.event.procstart", "ingress.event.netconn", "ingress.event.procend"}
+	for _, eventType := range expected {
+		var msg map[string]interface{}
+		if err := json.Unmarshal([]byte(<-results), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["type"] != eventType {
+			t.Errorf("Expected a %s event, got %v", eventType, msg)
+		}
+	}
+	if len(results) != 0 {
+		t.Errorf("Expected %d events, got %d more", len(expected), len(results))
+		drainMessages(results, func(string) error { return nil })
+	}
+
+	if _, err := parseS3ReplaySource("s3://cb-events", "2026-09-02", "2026-09-01"); err == nil {
+		t.Error("Expected an error for an empty time range")
+	}
+}
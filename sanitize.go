@@ -0,0 +1,111 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// How invalid UTF-8 sequences in event fields are replaced by sanitizeMessage.
+const (
+	InvalidUTF8Replace       = "replace"
+	InvalidUTF8Transliterate = "transliterate"
+	InvalidUTF8Drop          = "drop"
+)
+
+// How control characters in event fields are handled by sanitizeMessage.
+const (
+	ControlCharactersEscape = "escape"
+	ControlCharactersStrip  = "strip"
+	ControlCharactersKeep   = "keep"
+)
+
+var sanitizedFields = expvar.NewInt("sanitized_field_count")
+
+// sanitizeMessage makes the text in msg, including in nested maps and lists, safe for SIEM parsers: invalid UTF-8
+// sequences are replaced according to sanitize_invalid_utf8, and control characters (C0, DEL and C1) are escaped or
+// stripped according to sanitize_control_characters.
+func sanitizeMessage(msg map[string]interface{}) {
+	for key, value := range msg {
+		msg[key] = sanitizeValue(value)
+	}
+}
+
+func sanitizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return sanitizeString(v)
+	case map[string]interface{}:
+		sanitizeMessage(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = sanitizeValue(v[i])
+		}
+	case []string:
+		for i := range v {
+			v[i] = sanitizeString(v[i])
+		}
+	}
+	return value
+}
+
+func sanitizeString(s string) string {
+	if cleanString(s) {
+		return s
+	}
+	sanitizedFields.Add(1)
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			switch config.SanitizeInvalidUTF8 {
+			case InvalidUTF8Transliterate:
+				// most invalid sequences in paths are single-byte (Latin-1 or Windows-1252) text
+				r = rune(s[i])
+			case InvalidUTF8Drop:
+				i++
+				continue
+			}
+		}
+		i += size
+
+		if isControlCharacter(r) {
+			switch config.SanitizeControlCharacters {
+			case ControlCharactersEscape:
+				fmt.Fprintf(&b, "\\x%02x", r)
+				continue
+			case ControlCharactersStrip:
+				continue
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// cleanString reports whether s is valid UTF-8 without any characters sanitizeString would change.
+func cleanString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7f {
+			// only the rest, which may hold multi-byte characters, needs decoding
+			return cleanRunes(s[i:])
+		}
+	}
+	return true
+}
+
+func cleanRunes(s string) bool {
+	for _, r := range s {
+		if r == utf8.RuneError || (isControlCharacter(r) && config.SanitizeControlCharacters != ControlCharactersKeep) {
+			return false
+		}
+	}
+	return true
+}
+
+func isControlCharacter(r rune) bool {
+	return r < 0x20 || (r >= 0x7f && r < 0xa0)
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestSanitizeMessage(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	tests := []struct {
+		invalidUTF8 string
+		control     string
+		expected    string
+	}{
+		{InvalidUTF8Replace, ControlCharactersEscape, "c:\\temp\\r\uFFFDsum\u00e9\\x1b[0m\\x00.txt"},
+		{InvalidUTF8Transliterate, ControlCharactersStrip, "c:\\temp\\r\u00e9sum\u00e9[0m.txt"},
+		{InvalidUTF8Drop, ControlCharactersKeep, "c:\\temp\\rsum\u00e9\x1b[0m\x00.txt"},
+	}
+	for _, test := range tests {
+		config.SanitizeInvalidUTF8 = test.invalidUTF8
+		config.SanitizeControlCharacters = test.control
+
+		msg := map[string]interface{}{
+			"path":        "c:\\temp\\r\xe9sum\u00e9\x1b[0m\x00.txt",
+			"process_pid": 1234,
+			"docs":        []interface{}{map[string]interface{}{"path": "c:\\temp\\r\xe9sum\u00e9\x1b[0m\x00.txt"}},
+			"clean":       "c:\\windows\\system32\\svchost.exe",
+		}
+		sanitizeMessage(msg)
+
+		if msg["path"] != test.expected {
+			t.Errorf("%s/%s: expected %q, got %q", test.invalidUTF8, test.control, test.expected, msg["path"])
+		}
+		if nested := msg["docs"].([]interface{})[0].(map[string]interface{}); nested["path"] != test.expected {
+			t.Errorf("%s/%s: nested field was not sanitized: %q", test.invalidUTF8, test.control, nested["path"])
+		}
+		if msg["clean"] != "c:\\windows\\system32\\svchost.exe" || msg["process_pid"] != 1234 {
+			t.Errorf("Fields without anything to sanitize were changed: %v", msg)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	schemaExamples      = 3
+	schemaExampleLength = 60
+)
+
+// fieldSchema describes one field of an event type: how many of its events had the field, the JSON types of its
+// values and a few distinct example values.
+type fieldSchema struct {
+	Count    int            `json:"count"`
+	Types    map[string]int `json:"types"`
+	Examples []string       `json:"examples,omitempty"`
+}
+
+type eventTypeSchema struct {
+	Count  int                     `json:"count"`
+	Fields map[string]*fieldSchema `json:"fields"`
+}
+
+// schemaReport describes the events observed by -schema-report. The fields of nested objects are named
+// <field>.<nested field>, and those of objects in arrays <field>[].<nested field>.
+type schemaReport struct {
+	Server     string                      `json:"cb_server"`
+	Start      time.Time                   `json:"start"`
+	Duration   string                      `json:"duration"`
+	Events     int                         `json:"events"`
+	Unreadable int                         `json:"unreadable_events,omitempty"`
+	EventTypes map[string]*eventTypeSchema `json:"event_types"`
+}
+
+func newSchemaReport() *schemaReport {
+	return &schemaReport{Server: config.ServerName, Start: time.Now(), EventTypes: make(map[string]*eventTypeSchema)}
+}
+
+// addFormatted adds an event formatted as JSON by outputMessage.
+func (r *schemaReport) addFormatted(formatted string) {
+	var msg map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(formatted))
+	decoder.UseNumber()
+	if err := decoder.Decode(&msg); err != nil {
+		r.Unreadable++
+		return
+	}
+	r.add(msg)
+}
+
+func (r *schemaReport) add(msg map[string]interface{}) {
+	eventType, _ := msg["type"].(string)
+	if len(eventType) == 0 {
+		eventType = "(no type)"
+	}
+	schema, ok := r.EventTypes[eventType]
+	if !ok {
+		schema = &eventTypeSchema{Fields: make(map[string]*fieldSchema)}
+		r.EventTypes[eventType] = schema
+	}
+	r.Events++
+	schema.Count++
+
+	// a field repeated in the objects of an array is counted once per event
+	seen := make(map[string]bool)
+	schema.addFields("", msg, seen)
+}
+
+func (s *eventTypeSchema) addFields(prefix string, obj map[string]interface{}, seen map[string]bool) {
+	for name, value := range obj {
+		s.addField(prefix+name, value, seen)
+	}
+}
+
+func (s *eventTypeSchema) addField(name string, value interface{}, seen map[string]bool) {
+	field, ok := s.Fields[name]
+	if !ok {
+		field = &fieldSchema{Types: make(map[string]int)}
+		s.Fields[name] = field
+	}
+	if !seen[name] {
+		seen[name] = true
+		field.Count++
+	}
+	field.Types[jsonType(value)]++
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		s.addFields(name+".", value, seen)
+	case []interface{}:
+		for _, element := range value {
+			if obj, ok := element.(map[string]interface{}); ok {
+				s.addFields(name+"[].", obj, seen)
+			} else {
+				field.addExample(element)
+			}
+		}
+	case []map[string]interface{}:
+		for _, obj := range value {
+			s.addFields(name+"[].", obj, seen)
+		}
+	case nil:
+	default:
+		field.addExample(value)
+	}
+}
+
+func (f *fieldSchema) addExample(value interface{}) {
+	if len(f.Examples) >= schemaExamples {
+		return
+	}
+	example := fmt.Sprint(value)
+	if len(example) > schemaExampleLength {
+		example = example[:schemaExampleLength] + "..."
+	}
+	for _, e := range f.Examples {
+		if e == example {
+			return
+		}
+	}
+	f.Examples = append(f.Examples, example)
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number, float64, int, int64:
+		return "number"
+	case []interface{}, []map[string]interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *schemaReport) writeJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// writeMarkdown writes a section per event type, most frequent first, with a table of its fields.
+func (r *schemaReport) writeMarkdown(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Event schema\n\n%d events of %d types forwarded by %s in %s from %s.\n", r.Events,
+		len(r.EventTypes), r.Server, r.Duration, r.Start.UTC().Format(time.RFC3339))
+
+	eventTypes := make([]string, 0, len(r.EventTypes))
+	for eventType := range r.EventTypes {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Slice(eventTypes, func(i, j int) bool {
+		a, b := r.EventTypes[eventTypes[i]], r.EventTypes[eventTypes[j]]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return eventTypes[i] < eventTypes[j]
+	})
+
+	for _, eventType := range eventTypes {
+		schema := r.EventTypes[eventType]
+		fmt.Fprintf(&b, "\n## %s\n\n%d events.\n\n| Field | Type | Present | Examples |\n| --- | --- | --- | --- |\n",
+			eventType, schema.Count)
+
+		names := make([]string, 0, len(schema.Fields))
+		for name := range schema.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field := schema.Fields[name]
+			examples := make([]string, len(field.Examples))
+			for i, example := range field.Examples {
+				examples[i] = "`" + markdownEscaper.Replace(example) + "`"
+			}
+			fmt.Fprintf(&b, "| `%s` | %s | %d%% | %s |\n", name, strings.Join(sortedKeys(field.Types), ", "),
+				100*field.Count/schema.Count, strings.Join(examples, ", "))
+		}
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// markdownEscaper keeps example values from breaking out of their table cell and code span.
+var markdownEscaper = strings.NewReplacer("|", "\\|", "`", "'", "\n", " ", "\r", " ")
+
+// runSchemaReport runs -schema-report: it subscribes a temporary queue to the forwarder's events, runs the events
+// received in duration through the configured processing, and writes a report of the fields of each event type to
+// outputFile, or to stdout if it is "-". The report describes the events as they would be forwarded, but always in
+// JSON.
+func runSchemaReport(ctx context.Context, duration time.Duration, format, outputFile string) error {
+	write := (*schemaReport).writeMarkdown
+	switch format {
+	case "markdown":
+	case "json":
+		write = (*schemaReport).writeJSON
+	default:
+		return fmt.Errorf("Invalid -schema-format '%s': should be markdown or json", format)
+	}
+
+	w := os.Stdout
+	if outputFile != "-" {
+		fp, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		w = fp
+	}
+
+	// the forwarder exits once the report is written, so the output settings can be overridden here
+	config.OutputFormat = JSONOutputFormat
+	eventEncoder = nil
+	eventAudit = nil
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	queueName := "cb-event-forwarder:schema-report:" + hex.EncodeToString(id)
+	c, deliveries, err := NewConsumer(config.AMQPURL(), queueName, "schema-report", QueueOptions{AutoDelete: true},
+		config.UseRawSensorExchange, config.EventTypes, config.CustomBindings)
+	if err != nil {
+		return err
+	}
+	defer c.Shutdown()
+
+	report := newSchemaReport()
+	var collected sync.WaitGroup
+	collected.Add(1)
+	go func() {
+		defer collected.Done()
+		for formatted := range results {
+			report.addFormatted(formatted)
+		}
+	}()
+
+	log.Printf("Watching %s for %s for events to report on...", config.AMQPHostname, duration)
+	observeCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	err = nil
+observe:
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				err = fmt.Errorf("the connection closed while waiting for events")
+				break observe
+			}
+			if perr := processMessage(observeCtx, delivery.Body, delivery.RoutingKey, delivery.ContentType,
+				delivery.Headers, delivery.Exchange); perr != nil && observeCtx.Err() == nil {
+				log.Printf("Could not process event: %s", perr)
+			}
+		case <-observeCtx.Done():
+			break observe
+		}
+	}
+	close(results)
+	collected.Wait()
+
+	report.Duration = time.Since(report.Start).Round(time.Second).String()
+	if werr := write(report, w); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Reported on %d events of %d types", report.Events, len(report.EventTypes))
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSchemaReport(t *testing.T) {
+	report := newSchemaReport()
+	report.Duration = "5m0s"
+	report.addFormatted(`{"type":"ingress.event.netconn","remote_port":443,"domain":"a|b.com","docs":[{"md5":"x"}]}`)
+	report.addFormatted(`{"type":"ingress.event.netconn","remote_port":"80","docs":[{"md5":"y"},{"md5":"z"}]}`)
+	report.addFormatted(`{"type":"ingress.event.procstart","cmdline":"` + strings.Repeat("a", 100) + `"}`)
+	report.addFormatted(`not json`)
+
+	if report.Events != 3 || report.Unreadable != 1 || len(report.EventTypes) != 2 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	netconn := report.EventTypes["ingress.event.netconn"]
+	if port := netconn.Fields["remote_port"]; port.Count != 2 || port.Types["number"] != 1 || port.Types["string"] != 1 {
+		t.Errorf("Unexpected remote_port schema %+v", port)
+	}
+	if md5 := netconn.Fields["docs[].md5"]; md5 == nil || md5.Count != 2 || len(md5.Examples) != 3 {
+		t.Errorf("Expected the fields of objects in arrays to be counted once per event, got %+v", md5)
+	}
+	if cmdline := report.EventTypes["ingress.event.procstart"].Fields["cmdline"]; len(cmdline.Examples[0]) !=
+		schemaExampleLength+3 {
+		t.Errorf("Expected long examples to be truncated, got %q", cmdline.Examples[0])
+	}
+
+	var markdown bytes.Buffer
+	if err := report.writeMarkdown(&markdown); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"## ingress.event.netconn\n\n2 events.", "| `domain` | string | 50% | `a\\|b.com` |",
+		"| `remote_port` | number, string | 100% | `443`, `80` |"} {
+		if !strings.Contains(markdown.String(), expected) {
+			t.Errorf("Expected %q in the report:\n%s", expected, markdown.String())
+		}
+	}
+	if strings.Index(markdown.String(), "ingress.event.netconn") > strings.Index(markdown.String(), "procstart") {
+		t.Error("Expected the most frequent event type first")
+	}
+
+	var encoded bytes.Buffer
+	if err := report.writeJSON(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	var decoded schemaReport
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.EventTypes["ingress.event.netconn"].Fields["docs"].Types["array"] != 2 {
+		t.Errorf("Unexpected JSON report %s", encoded.String())
+	}
+}
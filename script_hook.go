@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	scriptDroppedCount = expvar.NewInt("script_dropped_event_count")
+	scriptErrorCount   = expvar.NewInt("script_error_count")
+)
+
+// ScriptHook runs a user-supplied Lua script against each event. The script must define a global function
+// process(event) which receives the event as a table and returns either the (possibly modified) table, or nil/false
+// to drop the event.
+//
+// Lua states are not safe for concurrent use, so a pool of states is kept, one per message processor. Each call is
+// bounded by a timeout; the Lua VM checks for cancellation between instructions so this also bounds CPU use. Only the
+// base, table, string and math libraries are available to the script.
+type ScriptHook struct {
+	fileName string
+	proto    *lua.FunctionProto
+	timeout  time.Duration
+	states   chan *lua.LState
+}
+
+func NewScriptHook(fileName string, timeout time.Duration, poolSize int) (*ScriptHook, error) {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	chunk, err := parse.Parse(fp, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse script %s: %s", fileName, err)
+	}
+
+	proto, err := lua.Compile(chunk, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not compile script %s: %s", fileName, err)
+	}
+
+	h := &ScriptHook{
+		fileName: fileName,
+		proto:    proto,
+		timeout:  timeout,
+		states:   make(chan *lua.LState, poolSize),
+	}
+
+	for i := 0; i < poolSize; i++ {
+		L, err := h.newState()
+		if err != nil {
+			return nil, err
+		}
+		h.states <- L
+	}
+
+	return h, nil
+}
+
+func (h *ScriptHook) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: 64})
+
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(lib.fn), NRet: 0, Protect: true}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+
+	// no access to the filesystem from the script
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(h.proto))
+	err := L.PCall(0, lua.MultRet, nil)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return nil, fmt.Errorf("Could not run script %s: %s", h.fileName, err)
+	}
+
+	if _, ok := L.GetGlobal("process").(*lua.LFunction); !ok {
+		L.Close()
+		return nil, fmt.Errorf("Script %s does not define a process(event) function", h.fileName)
+	}
+
+	L.SetTop(0)
+	return L, nil
+}
+
+// Process runs the script against msg. A nil map with a nil error means the script dropped the event. If the script
+// fails or times out, the original message is returned along with the error so the event is not lost.
+func (h *ScriptHook) Process(msg map[string]interface{}) (map[string]interface{}, error) {
+	L := <-h.states
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal("process"), NRet: 1, Protect: true}, toLuaValue(L, msg))
+	L.RemoveContext()
+
+	if err != nil {
+		scriptErrorCount.Add(1)
+
+		// don't trust the state of a VM that was interrupted mid-script; replace it with a fresh one
+		L.Close()
+		if L, newErr := h.newState(); newErr == nil {
+			h.states <- L
+		} else {
+			// should not happen: the script already ran successfully at startup
+			log.Fatalf("Could not recreate Lua state for %s: %s", h.fileName, newErr)
+		}
+		return msg, err
+	}
+
+	ret := L.Get(-1)
+	L.SetTop(0)
+	h.states <- L
+
+	switch ret := ret.(type) {
+	case *lua.LTable:
+		newMsg, ok := fromLuaValue(ret).(map[string]interface{})
+		if !ok {
+			scriptErrorCount.Add(1)
+			return msg, errors.New("process() returned an array rather than an event table")
+		}
+		if docs, ok := newMsg["docs"].([]interface{}); ok {
+			newMsg["docs"] = toDocsSlice(docs)
+		}
+		return newMsg, nil
+	case *lua.LNilType:
+		scriptDroppedCount.Add(1)
+		return nil, nil
+	case lua.LBool:
+		if !bool(ret) {
+			scriptDroppedCount.Add(1)
+			return nil, nil
+		}
+	}
+
+	scriptErrorCount.Add(1)
+	return msg, fmt.Errorf("process() returned unexpected type %s", ret.Type().String())
+}
+
+func toLuaValue(L *lua.LState, value interface{}) lua.LValue {
+	switch value := value.(type) {
+	case nil:
+		return lua.LNil
+	case string:
+		return lua.LString(value)
+	case bool:
+		return lua.LBool(value)
+	case json.Number:
+		if f, err := value.Float64(); err == nil {
+			return lua.LNumber(f)
+		}
+		return lua.LString(value.String())
+	case int:
+		return lua.LNumber(value)
+	case int32:
+		return lua.LNumber(value)
+	case int64:
+		return lua.LNumber(value)
+	case uint16:
+		return lua.LNumber(value)
+	case uint32:
+		return lua.LNumber(value)
+	case uint64:
+		return lua.LNumber(value)
+	case float64:
+		return lua.LNumber(value)
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, v := range value {
+			t.RawSetString(k, toLuaValue(L, v))
+		}
+		return t
+	case []map[string]interface{}:
+		t := L.NewTable()
+		for _, v := range value {
+			t.Append(toLuaValue(L, v))
+		}
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, v := range value {
+			t.Append(toLuaValue(L, v))
+		}
+		return t
+	case []string:
+		t := L.NewTable()
+		for _, v := range value {
+			t.Append(lua.LString(v))
+		}
+		return t
+	}
+
+	return lua.LString(fmt.Sprintf("%v", value))
+}
+
+func fromLuaValue(value lua.LValue) interface{} {
+	switch value := value.(type) {
+	case lua.LString:
+		return string(value)
+	case lua.LBool:
+		return bool(value)
+	case lua.LNumber:
+		f := float64(value)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return json.Number(strconv.FormatInt(int64(f), 10))
+		}
+		return float64(value)
+	case *lua.LTable:
+		// tables with only a sequence of integer keys become arrays
+		if n := value.Len(); n > 0 {
+			count := 0
+			value.ForEach(func(lua.LValue, lua.LValue) { count++ })
+			if count == n {
+				ret := make([]interface{}, 0, n)
+				for i := 1; i <= n; i++ {
+					ret = append(ret, fromLuaValue(value.RawGetInt(i)))
+				}
+				return ret
+			}
+		}
+
+		ret := make(map[string]interface{})
+		value.ForEach(func(k lua.LValue, v lua.LValue) {
+			ret[k.String()] = fromLuaValue(v)
+		})
+		return ret
+	}
+
+	return nil
+}
+
+// toDocsSlice restores the []map[string]interface{} type used for "docs" elsewhere in the forwarder.
+func toDocsSlice(docs []interface{}) []map[string]interface{} {
+	ret := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		if doc, ok := doc.(map[string]interface{}); ok {
+			ret = append(ret, doc)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestScript(t *testing.T, script string) string {
+	dir, err := ioutil.TempDir("", "cb-event-forwarder-script")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+
+	fn := filepath.Join(dir, "transform.lua")
+	if err := ioutil.WriteFile(fn, []byte(script), 0644); err != nil {
+		t.Fatalf("Could not write test script: %s", err)
+	}
+	return fn
+}
+
+func TestScriptHook(t *testing.T) {
+	fn := writeTestScript(t, `
+function process(event)
+  if event.type == "ingress.event.moduleload" then
+    return nil
+  end
+  event.site = "datacenter-1"
+  event.port = event.port + 1
+  event.docs[1].tagged = true
+  return event
+end
+`)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	hook, err := NewScriptHook(fn, 100*time.Millisecond, 2)
+	if err != nil {
+		t.Fatalf("Could not load script: %s", err)
+	}
+
+	msg, err := hook.Process(map[string]interface{}{
+		"type": "ingress.event.netconn",
+		"port": uint16(442),
+		"docs": []map[string]interface{}{{"md5": "449571D58547F434FAF544F2BAF2FA4C"}},
+	})
+	if err != nil {
+		t.Fatalf("Error running script: %s", err)
+	}
+	if msg["site"] != "datacenter-1" {
+		t.Errorf("Expected site to be added, got %v", msg)
+	}
+	if msg["port"].(interface{ String() string }).String() != "443" {
+		t.Errorf("Expected port 443, got %v", msg["port"])
+	}
+	docs, ok := msg["docs"].([]map[string]interface{})
+	if !ok || docs[0]["tagged"] != true {
+		t.Errorf("Expected docs to be modified, got %#v", msg["docs"])
+	}
+
+	msg, err = hook.Process(map[string]interface{}{"type": "ingress.event.moduleload"})
+	if err != nil || msg != nil {
+		t.Errorf("Expected moduleload event to be dropped, got %v (%v)", msg, err)
+	}
+}
+
+func TestScriptHookTimeout(t *testing.T) {
+	fn := writeTestScript(t, `
+function process(event)
+  while true do end
+end
+`)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	hook, err := NewScriptHook(fn, 10*time.Millisecond, 1)
+	if err != nil {
+		t.Fatalf("Could not load script: %s", err)
+	}
+
+	original := map[string]interface{}{"type": "ingress.event.netconn"}
+	for i := 0; i < 2; i++ {
+		msg, err := hook.Process(original)
+		if err == nil {
+			t.Errorf("Expected a timeout error from the script")
+		}
+		if msg["type"] != "ingress.event.netconn" {
+			t.Errorf("Expected the original event to be returned, got %v", msg)
+		}
+	}
+}
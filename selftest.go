@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selfTestRoutingKey is the type of the events sent by the self-test. It matches none of the event types Cb Response
+// publishes, so no other consumer of api.events should be subscribed to it.
+const selfTestRoutingKey = "cb-event-forwarder.selftest"
+
+// selfTestTimeout limits how long each stage of the self-test waits for its event.
+var selfTestTimeout = 30 * time.Second
+
+type selfTestStage struct {
+	name string
+	run  func(test *selfTest, ctx context.Context) (string, error)
+}
+
+// selfTest sends a synthetic event through each stage of the pipeline in turn: the message bus, event processing
+// and the output. Each stage passes its result on to the next.
+type selfTest struct {
+	id        string
+	body      []byte
+	formatted string
+}
+
+var selfTestStages = []selfTestStage{
+	{"message bus", (*selfTest).checkBus},
+	{"processing", (*selfTest).checkProcessing},
+	{"output", (*selfTest).checkOutput},
+}
+
+func newSelfTest() (*selfTest, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	test := &selfTest{id: hex.EncodeToString(id)}
+	body, err := json.Marshal(map[string]interface{}{
+		"message":     "cb-event-forwarder self-test",
+		"selftest_id": test.id,
+		"timestamp":   time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	test.body = body
+	return test, nil
+}
+
+// runSelfTest runs each stage of the self-test and prints its result, stopping at the first failure. It returns
+// whether every stage passed.
+func runSelfTest(ctx context.Context) bool {
+	test, err := newSelfTest()
+	if err != nil {
+		fmt.Printf("FAIL  setup: %s\n", err)
+		return false
+	}
+
+	for _, stage := range selfTestStages {
+		stageCtx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+		detail, err := stage.run(test, stageCtx)
+		cancel()
+
+		if err != nil {
+			fmt.Printf("FAIL  %s: %s\n", stage.name, err)
+			return false
+		}
+		fmt.Printf("PASS  %s: %s\n", stage.name, detail)
+	}
+	return true
+}
+
+// checkBus publishes the test event to api.events and receives it back on a temporary queue, checking the
+// connection details and permissions in the configuration.
+func (test *selfTest) checkBus(ctx context.Context) (string, error) {
+	queueName := "cb-event-forwarder:selftest:" + test.id
+	c, deliveries, err := NewConsumer(config.AMQPURL(), queueName, "selftest", QueueOptions{AutoDelete: true}, false,
+		[]string{selfTestRoutingKey}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer c.Shutdown()
+
+	err = c.channel.Publish("api.events", selfTestRoutingKey, false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        test.body,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Publish: %s", err)
+	}
+
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return "", fmt.Errorf("connection closed before the event was received")
+			}
+			if string(delivery.Body) == string(test.body) {
+				return fmt.Sprintf("received event published to %s", config.AMQPHostname), nil
+			}
+		case <-ctx.Done():
+			return "", fmt.Errorf("published event was not received")
+		}
+	}
+}
+
+// checkProcessing runs the test event through the configured processing, as if it had been received from the bus.
+func (test *selfTest) checkProcessing(ctx context.Context) (string, error) {
+	if err := processMessage(ctx, test.body, selfTestRoutingKey, "application/json", nil, "api.events"); err != nil {
+		return "", err
+	}
+
+	select {
+	case formatted := <-results:
+		test.formatted = formatted
+		return fmt.Sprintf("formatted %d bytes", len(formatted)), nil
+	default:
+		return "", fmt.Errorf("the event was dropped; check the configured script and filters")
+	}
+}
+
+// checkOutput starts the configured output and waits for the event to reach it. Events written to a file are read
+// back; bundles are also uploaded. Network outputs can only be checked for errors.
+func (test *selfTest) checkOutput(ctx context.Context) (string, error) {
+	if err := startOutputs(ctx); err != nil {
+		return "", err
+	}
+	defer stopOutputs()
+
+	// the file the event should be appended to, if the output writes to one
+	var fileName string
+	switch output := outputHandler.(type) {
+	case *FileOutput:
+		fileName = output.outputFileName
+	case *BundledOutput:
+		fileName = filepath.Join(output.writingDirectory(), bundleFileName(output.bundleFamily(test.formatted)))
+	}
+	var offset int64
+	if info, err := os.Stat(fileName); err == nil {
+		offset = info.Size()
+	}
+
+	select {
+	case results <- test.formatted:
+	case <-ctx.Done():
+		return "", fmt.Errorf("the output did not accept the event")
+	}
+
+	switch output := outputHandler.(type) {
+	case *FileOutput:
+		if err := waitForEventInFile(ctx, fileName, offset, test.id); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("event written to %s", fileName), nil
+
+	case *BundledOutput:
+		if err := waitForEventInFile(ctx, fileName, offset, test.id); err != nil {
+			return "", err
+		}
+		return test.checkUpload(ctx, output)
+
+	default:
+		select {
+		case err := <-output_errors:
+			return "", err
+		case <-time.After(2 * time.Second):
+			return fmt.Sprintf("event sent to %s without errors; check that it arrived", outputHandler.String()), nil
+		}
+	}
+}
+
+func (test *selfTest) checkUpload(ctx context.Context, output *BundledOutput) (string, error) {
+	before := output.Snapshot()
+	if err := output.Flush(ctx); err != nil {
+		return "", err
+	}
+
+	for {
+		stats := output.Snapshot()
+		if stats.FilesUploaded > before.FilesUploaded {
+			return fmt.Sprintf("event uploaded to %s", output.String()), nil
+		}
+		if stats.UploadErrors > before.UploadErrors {
+			return "", fmt.Errorf("upload failed: %s", stats.LastErrorText)
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("upload did not finish")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// waitForEventInFile waits for the event with the given id to be written to fileName after offset.
+func waitForEventInFile(ctx context.Context, fileName string, offset int64, id string) error {
+	for {
+		if fp, err := os.Open(fileName); err == nil {
+			contents, _ := ioutil.ReadAll(io.NewSectionReader(fp, offset, math.MaxInt64-offset))
+			fp.Close()
+			if strings.Contains(string(contents), id) {
+				return nil
+			}
+		}
+
+		select {
+		case err := <-output_errors:
+			return err
+		case <-ctx.Done():
+			return fmt.Errorf("event was not written to %s", fileName)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the events given a severity: watchlist and feed hits, and the alerts raised for them
+var severityEventTypes = []string{"watchlist.#", "feed.#", "alert.#"}
+
+// the scale used for hits from feeds and watchlists without their own: report scores of 0-100 in steps of 10
+var defaultSeverityScale = SeverityScale{Thresholds: []SeverityThreshold{{90, 10}, {80, 9}, {70, 8}, {60, 7},
+	{50, 6}, {40, 5}, {30, 4}, {20, 3}, {10, 2}, {0, 1}}}
+
+// SeverityThreshold gives hits with a report score of at least Score the severity Severity.
+type SeverityThreshold struct {
+	Score    float64
+	Severity int
+}
+
+// SeverityScale maps the report score of a hit to a severity: hits are given Fixed, if it is set, or the severity
+// of the highest threshold their score reaches.
+type SeverityScale struct {
+	Fixed      int
+	Thresholds []SeverityThreshold
+}
+
+// SeverityScores holds the scales from the [severity] section, by feed and watchlist name in lower case.
+type SeverityScores struct {
+	Feeds      map[string]SeverityScale
+	Watchlists map[string]SeverityScale
+	Default    SeverityScale
+	enabled    bool
+}
+
+// parseSeverityScores reads the [severity] section. Keys take the form feed.<feed name> or
+// watchlist.<watchlist name>, or default for the scale of every other feed and watchlist; each value is either a
+// single severity from 1 to 10 or a list of <report score>:<severity> thresholds.
+func parseSeverityScores(section ini.Section, errs *ConfigurationError) SeverityScores {
+	s := SeverityScores{
+		Feeds:      make(map[string]SeverityScale),
+		Watchlists: make(map[string]SeverityScale),
+		Default:    defaultSeverityScale,
+		enabled:    len(section) > 0,
+	}
+
+	for key, val := range section {
+		scale, err := parseSeverityScale(val)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid severity %s: %s", key, err))
+			continue
+		}
+
+		if key == "default" {
+			s.Default = scale
+			continue
+		}
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid severity key '%s': should look like (feed|watchlist).(name)", key))
+			continue
+		}
+		switch parts[0] {
+		case "feed":
+			s.Feeds[strings.ToLower(parts[1])] = scale
+		case "watchlist":
+			s.Watchlists[strings.ToLower(parts[1])] = scale
+		default:
+			errs.addErrorString(fmt.Sprintf("Unknown severity key '%s': should look like (feed|watchlist).(name)", key))
+		}
+	}
+
+	return s
+}
+
+func parseSeverityValue(val string) (int, error) {
+	severity, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || severity < 1 || severity > 10 {
+		return 0, fmt.Errorf("severity '%s' should be a number from 1 to 10", val)
+	}
+	return severity, nil
+}
+
+func parseSeverityScale(val string) (SeverityScale, error) {
+	var scale SeverityScale
+	if !strings.Contains(val, ":") {
+		severity, err := parseSeverityValue(val)
+		scale.Fixed = severity
+		return scale, err
+	}
+
+	for _, pair := range strings.Split(val, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			return scale, fmt.Errorf("threshold '%s' should look like (report score):(severity)", pair)
+		}
+		score, err := strconv.ParseFloat(strings.TrimSpace(kv[0]), 64)
+		if err != nil {
+			return scale, fmt.Errorf("report score '%s' is not a number", kv[0])
+		}
+		severity, err := parseSeverityValue(kv[1])
+		if err != nil {
+			return scale, err
+		}
+		scale.Thresholds = append(scale.Thresholds, SeverityThreshold{score, severity})
+	}
+	sort.Slice(scale.Thresholds, func(i, j int) bool { return scale.Thresholds[i].Score > scale.Thresholds[j].Score })
+	return scale, nil
+}
+
+func (s *SeverityScores) Empty() bool {
+	return !s.enabled
+}
+
+// severity returns the severity of a hit with the given report score, which is nil if the hit has none.
+func (scale *SeverityScale) severity(score interface{}) (int, bool) {
+	if scale.Fixed > 0 {
+		return scale.Fixed, true
+	}
+	if score == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(fmt.Sprint(score), 64)
+	if err != nil {
+		return 0, false
+	}
+	for _, threshold := range scale.Thresholds {
+		if value >= threshold.Score {
+			return threshold.Severity, true
+		}
+	}
+	return 0, false
+}
+
+// Apply adds a "severity" field to msg if it is a watchlist or feed hit whose severity can be scored: from the scale
+// of its feed, or else of its watchlist, or else the default scale.
+func (s *SeverityScores) Apply(msg map[string]interface{}) {
+	eventType, _ := msg["type"].(string)
+	matched := false
+	for _, pattern := range severityEventTypes {
+		if RoutingKeyMatches(pattern, eventType) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return
+	}
+
+	scale, ok := s.Feeds[strings.ToLower(stringField(msg, "feed_name"))]
+	if !ok {
+		if scale, ok = s.Watchlists[strings.ToLower(stringField(msg, "watchlist_name"))]; !ok {
+			scale = s.Default
+		}
+	}
+	if severity, ok := scale.severity(msg["report_score"]); ok {
+		msg["severity"] = severity
+	}
+}
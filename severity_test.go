@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/vaughan0/go-ini"
+	"testing"
+)
+
+func TestParseSeverityScores(t *testing.T) {
+	errs := ConfigurationError{}
+	s := parseSeverityScores(ini.Section{}, &errs)
+	if !s.Empty() {
+		t.Error("Expected no severity without a [severity] section")
+	}
+
+	s = parseSeverityScores(ini.Section{
+		"feed.SRSThreat":         "0:2, 80:8,50:5",
+		"watchlist.Newly Loaded": "3",
+		"feed.broken":            "high",
+		"watchlist.out of range": "0:11",
+		"report.something":       "5",
+	}, &errs)
+	if len(errs.Errors) != 3 {
+		t.Errorf("Expected 3 errors, got %v", errs.Errors)
+	}
+	scale := s.Feeds["srsthreat"]
+	if len(scale.Thresholds) != 3 || scale.Thresholds[0] != (SeverityThreshold{80, 8}) {
+		t.Errorf("Expected thresholds sorted from the highest score, got %+v", scale)
+	}
+	if s.Watchlists["newly loaded"].Fixed != 3 {
+		t.Errorf("Expected a fixed severity, got %+v", s.Watchlists)
+	}
+}
+
+func TestSeverityScores(t *testing.T) {
+	errs := ConfigurationError{}
+	s := parseSeverityScores(ini.Section{
+		"feed.srsthreat":                  "0:2,50:5,80:8",
+		"feed.strict":                     "90:10",
+		"watchlist.suspicious powershell": "9",
+	}, &errs)
+
+	tests := []struct {
+		msg      map[string]interface{}
+		severity interface{}
+	}{
+		{map[string]interface{}{"type": "feed.ingress.hit.process", "feed_name": "SRSThreat", "report_score": 65}, 5},
+		{map[string]interface{}{"type": "feed.storage.hit.binary", "feed_name": "srsthreat",
+			"report_score": json.Number("80")}, 8},
+		{map[string]interface{}{"type": "alert.watchlist.hit.query.process", "feed_name": "My Watchlists",
+			"watchlist_name": "Suspicious PowerShell", "report_score": "10"}, 9},
+		// the default scale
+		{map[string]interface{}{"type": "feed.query.hit.process", "feed_name": "other", "report_score": 42.5}, 5},
+		{map[string]interface{}{"type": "watchlist.hit.process", "watchlist_name": "unknown"}, nil},
+		{map[string]interface{}{"type": "feed.ingress.hit.process", "feed_name": "strict", "report_score": 50}, nil},
+		{map[string]interface{}{"type": "ingress.event.procstart", "report_score": 100}, nil},
+	}
+	for _, test := range tests {
+		s.Apply(test.msg)
+		if test.msg["severity"] != test.severity {
+			t.Errorf("Expected severity %v for %v", test.severity, test.msg)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// status codes of SFTP errors; see draft-ietf-secsh-filexfer-02
+const (
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+)
+
+// SFTPBehavior uploads bundles to a transfer server over SFTP, authenticating with a private key (or a password).
+// Each bundle is uploaded to a temporary name next to its remote path and renamed into place once it has been
+// written completely, so that whatever collects files from the server never picks up a partial bundle. The SSH
+// connection is kept open between uploads and made again after an error.
+type SFTPBehavior struct {
+	host     string
+	user     string
+	hostname string
+
+	clientConfig *ssh.ClientConfig
+
+	// held for the whole of each upload, while the connection is in use
+	transfer sync.Mutex
+	conn     *ssh.Client
+	client   *sftp.Client
+
+	connected       bool
+	lastConnectTime time.Time
+	connectErrors   int64
+	sync.RWMutex
+}
+
+type SFTPStatistics struct {
+	Host            string    `json:"host"`
+	User            string    `json:"user"`
+	RemotePath      string    `json:"remote_path"`
+	Connected       bool      `json:"connected"`
+	LastConnectTime time.Time `json:"last_connect_time"`
+	ConnectErrors   int64     `json:"connect_errors"`
+}
+
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         SFTPOutputType,
+		ParameterKey: "sftpout",
+		StatusType:   "sftp",
+		WritesFiles:  true,
+		Location:     sftpHoldingArea,
+		Factory:      func() OutputHandler { return NewBundledOutput(&SFTPBehavior{}) },
+	})
+}
+
+// sftpHoldingArea returns the temp-file-directory of an sftpout connection string.
+func sftpHoldingArea(connString string) string {
+	tempFileDirectory, _ := splitTempFileDirectory(connString, "sftp")
+	return tempFileDirectory
+}
+
+// Initialize expects sftp://user@host[:port], optionally preceded by (temp-file-directory): to hold bundles
+// somewhere other than /var/cb/data/event-forwarder until they are uploaded. The options in the [sftp] section are
+// read from the configuration.
+func (o *SFTPBehavior) Initialize(connString string) (string, error) {
+	tempFileDirectory, location := splitTempFileDirectory(connString, "sftp")
+
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "sftp" || len(u.Hostname()) == 0 || u.User == nil || len(u.User.Username()) == 0 {
+		return "", fmt.Errorf("Invalid connection string: '%s' should look like "+
+			"(temp-file-directory):sftp://(user)@(host):(port)", connString)
+	}
+	o.user = u.User.Username()
+	o.host = u.Host
+	if len(u.Port()) == 0 {
+		o.host = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	if o.hostname, err = os.Hostname(); err != nil {
+		return "", err
+	}
+
+	if o.clientConfig, err = sftpClientConfig(o.user); err != nil {
+		return "", err
+	}
+	o.transfer.Lock()
+	defer o.transfer.Unlock()
+	if err := o.connect(context.Background()); err != nil {
+		return "", fmt.Errorf("Could not connect to %s: %w", o.host, err)
+	}
+	return tempFileDirectory, nil
+}
+
+// sftpClientConfig returns the SSH configuration for user: authenticating with [sftp] private_key and/or password,
+// and checking the server's host key against known_hosts.
+func sftpClientConfig(user string) (*ssh.ClientConfig, error) {
+	clientConfig := &ssh.ClientConfig{User: user, Timeout: config.SFTPTimeout}
+
+	if len(config.SFTPPrivateKey) > 0 {
+		pemBytes, err := ioutil.ReadFile(config.SFTPPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if len(config.SFTPPrivateKeyPassphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(config.SFTPPrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pemBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read private key %s: %s", config.SFTPPrivateKey, err)
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if len(config.SFTPPassword) > 0 {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(config.SFTPPassword))
+	}
+	if len(clientConfig.Auth) == 0 {
+		return nil, errors.New("The sftp output needs private_key or password in [sftp]")
+	}
+
+	if config.SFTPInsecureIgnoreHostKey {
+		clientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		callback, err := knownhosts.New(config.SFTPKnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read known_hosts %s: %s", config.SFTPKnownHosts, err)
+		}
+		clientConfig.HostKeyCallback = callback
+	}
+	if fipsMode() {
+		clientConfig.Config = fipsSSHConfig()
+	}
+	return clientConfig, nil
+}
+
+// connect makes the SSH connection and starts an SFTP session on it. The caller holds the transfer lock.
+func (o *SFTPBehavior) connect(ctx context.Context) error {
+	o.close()
+
+	err := func() error {
+		netConn, err := dialWith(ctx, &net.Dialer{Timeout: config.SFTPTimeout}, "tcp", o.host)
+		if err != nil {
+			return err
+		}
+		// the handshake isn't covered by the dialer's timeout
+		netConn.SetDeadline(time.Now().Add(config.SFTPTimeout))
+		sshConn, chans, reqs, err := ssh.NewClientConn(netConn, o.host, o.clientConfig)
+		if err != nil {
+			netConn.Close()
+			return err
+		}
+		netConn.SetDeadline(time.Time{})
+		o.conn = ssh.NewClient(sshConn, chans, reqs)
+
+		if o.client, err = sftp.NewClient(o.conn); err != nil {
+			o.conn.Close()
+			o.conn = nil
+			return err
+		}
+		return nil
+	}()
+
+	o.Lock()
+	defer o.Unlock()
+	if err != nil {
+		o.connectErrors++
+		return err
+	}
+	o.connected = true
+	o.lastConnectTime = time.Now()
+	return nil
+}
+
+// close drops the connection. The caller holds the transfer lock.
+func (o *SFTPBehavior) close() {
+	if o.client != nil {
+		o.client.Close()
+		o.client = nil
+	}
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+
+	o.Lock()
+	o.connected = false
+	o.Unlock()
+}
+
+func (o *SFTPBehavior) Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus {
+	o.transfer.Lock()
+	defer o.transfer.Unlock()
+
+	if o.client == nil {
+		if err := o.connect(ctx); err != nil {
+			return UploadStatus{fileName: fileName, result: err}
+		}
+	}
+
+	// the SFTP client doesn't take a context, so closing the connection is the only way to abandon a transfer
+	done := make(chan struct{})
+	defer close(done)
+	conn := o.conn
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err := o.upload(fileName, fp)
+	if err != nil && !isSFTPStatus(err) {
+		// the connection is broken; make it again for the next upload
+		o.close()
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return UploadStatus{fileName: fileName, result: err}
+}
+
+func (o *SFTPBehavior) upload(fileName string, fp *os.File) error {
+	remotePath := renderRemotePath(config.SFTPRemotePath, bundleUploadName(fileName), bundleNameFields{
+		Hostname:  o.hostname,
+		Tenant:    config.ServerName,
+		Timestamp: time.Now(),
+	})
+	tmpPath := path.Join(path.Dir(remotePath), "."+path.Base(remotePath)+".part")
+
+	if dir := path.Dir(remotePath); dir != "." && dir != "/" {
+		if err := o.client.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+
+	out, err := o.client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	written, err := out.ReadFrom(fp)
+	if err == nil {
+		if _, ok := o.client.HasExtension("fsync@openssh.com"); ok {
+			err = out.Sync()
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = o.checkUploaded(tmpPath, written, fp)
+	}
+	if err == nil {
+		err = o.rename(tmpPath, remotePath)
+	}
+	if err != nil {
+		o.client.Remove(tmpPath)
+	}
+	return err
+}
+
+// checkUploaded checks that the whole of fp arrived at remotePath.
+func (o *SFTPBehavior) checkUploaded(remotePath string, written int64, fp *os.File) error {
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	remote, err := o.client.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if written != info.Size() || remote.Size() != info.Size() {
+		return fmt.Errorf("%s holds %d bytes rather than %d", remotePath, remote.Size(), info.Size())
+	}
+	return nil
+}
+
+// rename moves the uploaded file into place, replacing a file of the same name (from an earlier upload that was
+// interrupted after the rename, but before its result was known). Plain SFTP renames fail if the target exists, so
+// OpenSSH's posix-rename extension is used where the server has it.
+func (o *SFTPBehavior) rename(from, to string) error {
+	if _, ok := o.client.HasExtension("posix-rename@openssh.com"); ok {
+		return o.client.PosixRename(from, to)
+	}
+	if _, err := o.client.Stat(to); err == nil {
+		if err := o.client.Remove(to); err != nil {
+			return err
+		}
+	}
+	return o.client.Rename(from, to)
+}
+
+func isSFTPStatus(err error) bool {
+	var status *sftp.StatusError
+	return errors.As(err, &status)
+}
+
+// ClassifyError treats failed authentication and permission errors on the server as auth errors, and a missing
+// remote directory that could not be created as a client error.
+func (o *SFTPBehavior) ClassifyError(err error) UploadErrorCategory {
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		switch status.Code {
+		case sftpPermissionDenied:
+			return UploadErrorAuth
+		case sftpNoSuchFile:
+			return UploadErrorClient
+		}
+		return UploadErrorUnknown
+	}
+
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) || strings.Contains(err.Error(), "unable to authenticate") {
+		return UploadErrorAuth
+	}
+	return UploadErrorUnknown
+}
+
+func (o *SFTPBehavior) Key() string {
+	return fmt.Sprintf("%s@%s", o.user, o.host)
+}
+
+func (o *SFTPBehavior) String() string {
+	return "SFTP " + o.Key()
+}
+
+func (o *SFTPBehavior) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return SFTPStatistics{
+		Host:            o.host,
+		User:            o.user,
+		RemotePath:      config.SFTPRemotePath,
+		Connected:       o.connected,
+		LastConnectTime: o.lastConnectTime,
+		ConnectErrors:   o.connectErrors,
+	}
+}
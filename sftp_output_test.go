@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSFTPServer serves SFTP from root to clients authenticating with clientKey, until the listener is closed.
+func testSFTPServer(t *testing.T, listener net.Listener, hostKey ssh.Signer, clientKey ssh.PublicKey, root string) {
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "cbforwarder" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					for req := range requests {
+						req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+						if req.Type == "subsystem" {
+							server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							server.Serve()
+							channel.Close()
+						}
+					}
+				}()
+			}
+		}()
+	}
+}
+
+func testSSHKey(t *testing.T) (ssh.Signer, []byte) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(block)
+}
+
+func TestSFTPBehaviorUpload(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.Mkdir(root, 0755)
+	hostKey, _ := testSSHKey(t)
+	clientKey, clientPEM := testSSHKey(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go testSFTPServer(t, listener, hostKey, clientKey.PublicKey(), root)
+
+	config.SFTPPrivateKey = filepath.Join(dir, "sftp_key")
+	ioutil.WriteFile(config.SFTPPrivateKey, clientPEM, 0600)
+	config.SFTPKnownHosts = filepath.Join(dir, "known_hosts")
+	ioutil.WriteFile(config.SFTPKnownHosts,
+		[]byte(knownhosts.Line([]string{listener.Addr().String()}, hostKey.PublicKey())+"\n"), 0644)
+	config.SFTPRemotePath = "incoming/{tenant}/{name}"
+	config.SFTPTimeout = 10 * time.Second
+	config.ServerName = "cbserver"
+
+	holdingArea := filepath.Join(dir, "holding")
+	os.Mkdir(holdingArea, 0755)
+	behavior := &SFTPBehavior{}
+	if _, err := behavior.Initialize(holdingArea + ":sftp://cbforwarder@" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(holdingArea, "event-forwarder.2026-10-14T12:00:00")
+	contents := "{\"type\":\"ingress.event.procstart\"}\n"
+	ioutil.WriteFile(fileName, []byte(contents), 0644)
+	for i := 0; i < 2; i++ {
+		// the second upload replaces the first, as after an interrupted upload
+		fp, err := os.Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := behavior.Upload(context.Background(), fileName, fp)
+		fp.Close()
+		if status.result != nil {
+			t.Fatal(status.result)
+		}
+	}
+
+	uploaded, err := ioutil.ReadFile(filepath.Join(root, "incoming", "cbserver", "event-forwarder.2026-10-14T12:00:00"))
+	if err != nil || string(uploaded) != contents {
+		t.Errorf("Expected the bundle on the server, got %q (%v)", uploaded, err)
+	}
+	if infos, _ := ioutil.ReadDir(filepath.Join(root, "incoming", "cbserver")); len(infos) != 1 {
+		t.Errorf("Expected only the bundle on the server, found %d files", len(infos))
+	}
+
+	// a server with a different host key is refused
+	wrongKey, _ := testSSHKey(t)
+	ioutil.WriteFile(config.SFTPKnownHosts,
+		[]byte(knownhosts.Line([]string{listener.Addr().String()}, wrongKey.PublicKey())+"\n"), 0644)
+	_, err = (&SFTPBehavior{}).Initialize("sftp://cbforwarder@" + listener.Addr().String())
+	if err == nil {
+		t.Fatal("Expected a host key mismatch to be refused")
+	}
+	if category := behavior.ClassifyError(err); category != UploadErrorAuth {
+		t.Errorf("Expected a host key mismatch to be an auth error, got %s", category)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShareBehavior copies bundles to a directory on a mounted network share (NFS or SMB/CIFS). Bundles are written
+// locally, like the S3 output's, and copied to the share once they are rolled over, so that the share going away
+// never holds up the forwarder or loses events. Each copy is written to a temporary file on the share, synced and
+// renamed into place, so readers never see a partial bundle, even when the file server fails over mid-write; a copy
+// that fails with a stale file handle is started again from scratch. Before each copy the share is checked: it must
+// respond within the health timeout, be writable, and (with require_mount) be a mount point rather than the empty
+// directory underneath it.
+type ShareBehavior struct {
+	directory string
+
+	// set in a consumer group, where every forwarder copies to its own directory on the share
+	instance string
+
+	// only one health check runs at a time: a check stuck on a hung mount is waited for, rather than piling up
+	checking chan struct{}
+
+	staleRetries    int64
+	lastHealthCheck time.Time
+	healthy         bool
+	lastHealthError string
+	sync.RWMutex
+}
+
+type ShareStatistics struct {
+	Directory       string    `json:"directory"`
+	Healthy         bool      `json:"healthy"`
+	LastHealthCheck time.Time `json:"last_health_check"`
+	LastHealthError string    `json:"last_health_error,omitempty"`
+	StaleRetries    int64     `json:"stale_handle_retries"`
+}
+
+// shareError is a failure of the share, rather than of the bundle being copied to it.
+type shareError struct {
+	err error
+}
+
+func (e *shareError) Error() string {
+	return e.err.Error()
+}
+
+func (e *shareError) Unwrap() error {
+	return e.err
+}
+
+// the name of the file written and removed by health checks
+const shareProbeFile = ".cb-event-forwarder-probe"
+
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         ShareOutputType,
+		ParameterKey: "shareout",
+		StatusType:   "share",
+		WritesFiles:  true,
+		Location:     shareHoldingArea,
+		Factory:      func() OutputHandler { return NewBundledOutput(&ShareBehavior{}) },
+	})
+}
+
+// shareHoldingArea returns the temp-file-directory of a shareout connection string.
+func shareHoldingArea(connString string) string {
+	tempFileDirectory, _ := splitTempFileDirectory(connString, "")
+	return tempFileDirectory
+}
+
+// Initialize expects the directory on the share, or (temp-file-directory):(share-directory) to hold bundles
+// somewhere other than /var/cb/data/event-forwarder until they are copied.
+func (o *ShareBehavior) Initialize(connString string) (string, error) {
+	var tempFileDirectory string
+	tempFileDirectory, o.directory = splitTempFileDirectory(connString, "")
+	if len(o.directory) == 0 || !filepath.IsAbs(o.directory) {
+		return "", fmt.Errorf("Invalid connection string: '%s' should look like (temp-file-directory):(share-directory),"+
+			" with an absolute path for the share", connString)
+	}
+	o.directory = filepath.Clean(o.directory)
+
+	if len(config.ConsumerGroup) > 0 {
+		// bundles are named after the time they were started, so forwarders sharing a directory could overwrite
+		// each other's files
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		o.instance = hostname
+	}
+
+	o.checking = make(chan struct{}, 1)
+	if err := o.checkHealth(); err != nil {
+		// the bundles wait in the holding area until the share is back
+		log.Printf("WARNING: %s is not available: %s", o.directory, err)
+	}
+	return tempFileDirectory, nil
+}
+
+// destination returns the directory bundles are copied to.
+func (o *ShareBehavior) destination() string {
+	if len(o.instance) > 0 {
+		return filepath.Join(o.directory, o.instance)
+	}
+	return o.directory
+}
+
+// checkHealth checks that the share is mounted, responding and writable, giving up after config.ShareHealthTimeout
+// (a hard NFS mount whose server has gone away blocks every call on it).
+func (o *ShareBehavior) checkHealth() error {
+	var err error
+	select {
+	case o.checking <- struct{}{}:
+		result := make(chan error, 1)
+		go func() {
+			defer func() { <-o.checking }()
+			result <- o.probe()
+		}()
+
+		select {
+		case err = <-result:
+		case <-time.After(config.ShareHealthTimeout):
+			err = fmt.Errorf("the share did not respond within %s", config.ShareHealthTimeout)
+		}
+	default:
+		err = errors.New("an earlier health check of the share has not returned")
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	o.lastHealthCheck = time.Now()
+	o.healthy = err == nil
+	if err != nil {
+		o.lastHealthError = err.Error()
+		return &shareError{err}
+	}
+	o.lastHealthError = ""
+	return nil
+}
+
+func (o *ShareBehavior) probe() error {
+	info, err := os.Stat(o.directory)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", o.directory)
+	}
+
+	if config.ShareRequireMount {
+		parent, err := os.Stat(filepath.Dir(o.directory))
+		if err != nil {
+			return err
+		}
+		// a mount point is on a different device to the directory it is mounted on
+		if sameDevice(info, parent) {
+			return fmt.Errorf("%s is not a mount point; is the share mounted?", o.directory)
+		}
+	}
+
+	if err := os.MkdirAll(o.destination(), 0755); err != nil {
+		return err
+	}
+	probeName := filepath.Join(o.destination(), shareProbeFile)
+	if err := ioutil.WriteFile(probeName, []byte(time.Now().Format(time.RFC3339)), 0644); err != nil {
+		return err
+	}
+	return os.Remove(probeName)
+}
+
+func sameDevice(a, b os.FileInfo) bool {
+	sa, ok := a.Sys().(*syscall.Stat_t)
+	sb, ok2 := b.Sys().(*syscall.Stat_t)
+	return ok && ok2 && sa.Dev == sb.Dev
+}
+
+// staleHandle reports whether err is one that a client sees while the file server fails over, after which the copy
+// can be started again.
+func staleHandle(err error) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENOTCONN) ||
+		errors.Is(err, syscall.EHOSTDOWN)
+}
+
+func (o *ShareBehavior) Upload(ctx context.Context, fileName string, fp *os.File) UploadStatus {
+	if err := o.checkHealth(); err != nil {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = o.copy(fileName, fp); err == nil || !staleHandle(err) || attempt >= config.ShareStaleRetries {
+			break
+		}
+
+		o.Lock()
+		o.staleRetries++
+		o.Unlock()
+		log.Printf("Copy of %s to %s failed: %s; starting it again", fileName, o.directory, err)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return UploadStatus{fileName: fileName, result: ctx.Err()}
+		}
+		if _, err = fp.Seek(0, io.SeekStart); err != nil {
+			break
+		}
+	}
+	return UploadStatus{fileName: fileName, result: err}
+}
+
+// copy writes the contents of fp to a temporary file on the share, syncs it and renames it into place, then checks
+// that the file on the share is complete.
+func (o *ShareBehavior) copy(fileName string, fp *os.File) error {
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(o.destination(), bundleUploadName(fileName))
+	tmpName := filepath.Join(o.destination(), "."+bundleUploadName(fileName)+".tmp")
+
+	out, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return &shareError{err}
+	}
+	_, err = io.Copy(out, fp)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, name)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return &shareError{err}
+	}
+
+	// make the rename durable, where the file system allows it (SMB mounts generally don't)
+	if dir, err := os.Open(o.destination()); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	copied, err := os.Stat(name)
+	if err != nil {
+		return &shareError{err}
+	}
+	if copied.Size() != info.Size() {
+		return &shareError{fmt.Errorf("%s holds %d bytes rather than %d", name, copied.Size(), info.Size())}
+	}
+	return nil
+}
+
+// ClassifyError treats failures of the share as network errors, so that the bundle is copied again once the share
+// is back, except for permission errors (auth) and a full share (throttled, so that it is retried more slowly).
+func (o *ShareBehavior) ClassifyError(err error) UploadErrorCategory {
+	var se *shareError
+	if !errors.As(err, &se) {
+		return UploadErrorUnknown
+	}
+	switch {
+	case errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM):
+		return UploadErrorAuth
+	case errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT):
+		return UploadErrorThrottled
+	}
+	return UploadErrorNetwork
+}
+
+func (o *ShareBehavior) Key() string {
+	return o.directory
+}
+
+func (o *ShareBehavior) String() string {
+	return "Share " + o.directory
+}
+
+func (o *ShareBehavior) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return ShareStatistics{
+		Directory:       o.directory,
+		Healthy:         o.healthy,
+		LastHealthCheck: o.lastHealthCheck,
+		LastHealthError: o.lastHealthError,
+		StaleRetries:    o.staleRetries,
+	}
+}
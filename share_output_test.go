@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShareBehaviorUpload(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.ShareRequireMount = false
+	config.ShareHealthTimeout = 5 * time.Second
+	config.ShareStaleRetries = 3
+
+	holdingArea := t.TempDir()
+	share := t.TempDir()
+	behavior := &ShareBehavior{}
+	if _, err := behavior.Initialize(holdingArea + ":" + share); err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(holdingArea, "event-forwarder.2026-10-14T12:00:00")
+	contents := "{\"type\":\"ingress.event.procstart\"}\n"
+	if err := ioutil.WriteFile(fileName, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	if status := behavior.Upload(context.Background(), fileName, fp); status.result != nil {
+		t.Fatal(status.result)
+	}
+	copied, err := ioutil.ReadFile(filepath.Join(share, "event-forwarder.2026-10-14T12:00:00"))
+	if err != nil || string(copied) != contents {
+		t.Errorf("Expected the bundle on the share, got %q (%v)", copied, err)
+	}
+	if infos, _ := ioutil.ReadDir(share); len(infos) != 1 {
+		t.Errorf("Expected only the bundle on the share, found %d files", len(infos))
+	}
+	if stats := behavior.Statistics().(ShareStatistics); !stats.Healthy {
+		t.Errorf("Expected the share to be healthy: %+v", stats)
+	}
+}
+
+func TestShareBehaviorHealth(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.ShareRequireMount = true
+	config.ShareHealthTimeout = 5 * time.Second
+
+	// a directory made by the test is on the same device as its parent, just like an unmounted share
+	behavior := &ShareBehavior{}
+	if _, err := behavior.Initialize(t.TempDir() + ":" + t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	err := behavior.checkHealth()
+	if err == nil {
+		t.Fatal("Expected a directory that is not a mount point to be unhealthy")
+	}
+	if category := classifyUploadError(behavior, err); category != UploadErrorNetwork {
+		t.Errorf("Expected an unhealthy share to be a network error, got %s", category)
+	}
+
+	behavior.directory = filepath.Join(t.TempDir(), "missing")
+	config.ShareRequireMount = false
+	if err := behavior.checkHealth(); err == nil {
+		t.Error("Expected a missing share to be unhealthy")
+	}
+
+	stale := &shareError{&os.PathError{Op: "write", Path: "bundle", Err: syscall.ESTALE}}
+	if !staleHandle(stale) || classifyUploadError(behavior, stale) != UploadErrorNetwork {
+		t.Error("Expected a stale file handle to be retried")
+	}
+	full := &shareError{&os.PathError{Op: "write", Path: "bundle", Err: syscall.ENOSPC}}
+	if classifyUploadError(behavior, full) != UploadErrorThrottled {
+		t.Error("Expected a full share to be throttled")
+	}
+}
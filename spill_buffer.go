@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventBuffer holds formatted events between the message processors and the output. Events are kept in memory up to
+// memoryLimit bytes; beyond that they are appended to a spill file, and read back once the output has caught up with
+// the events in memory. The buffer is first in, first out: while there are events in the spill file, new events are
+// spilled too. Events still buffered at shutdown are saved to the spill file and sent first when the forwarder
+// restarts.
+type eventBuffer struct {
+	memoryLimit int64
+	spillLimit  int64
+	spillPath   string
+
+	memory      []string
+	memoryBytes int64
+
+	// the spill file holds records from readOffset to writeOffset, each a big-endian uint32 length and the event
+	spill       *os.File
+	spillReader *bufio.Reader
+	readOffset  int64
+	writeOffset int64
+
+	// events that could not be written to the spill file; no more events are accepted until they have been
+	unspilled   []string
+	spillErrors int64
+	lastError   string
+
+	stop chan struct{}
+	done chan struct{}
+	sync.Mutex
+}
+
+type EventBufferStatistics struct {
+	MemoryEvents int    `json:"memory_events"`
+	MemoryBytes  int64  `json:"memory_bytes"`
+	SpilledBytes int64  `json:"spilled_bytes"`
+	SpillErrors  int64  `json:"spill_errors"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+// spillRetryInterval is how long the buffer waits to retry writing to the spill file after an error.
+const spillRetryInterval = time.Second
+
+func newEventBuffer(memoryLimit, spillLimit int64, spillPath string) (*eventBuffer, error) {
+	b := &eventBuffer{
+		memoryLimit: memoryLimit,
+		spillLimit:  spillLimit,
+		spillPath:   spillPath,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	// events left in the spill file by the last run are sent before any new ones
+	fp, err := os.OpenFile(spillPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	b.spill = fp
+	b.writeOffset = info.Size()
+	b.spillReader = newSpillReader(fp, 0)
+	if b.writeOffset > 0 {
+		log.Printf("Sending %d bytes of events saved in %s", b.writeOffset, spillPath)
+	}
+
+	return b, nil
+}
+
+// Go moves events from in to out until Shutdown is called.
+func (b *eventBuffer) Go(in <-chan string, out chan<- string) {
+	go func() {
+		defer close(b.done)
+
+		for {
+			next, ok := b.peek()
+			var send chan<- string
+			if ok {
+				send = out
+			}
+
+			receive := in
+			var retry <-chan time.Time
+			if len(b.unspilled) > 0 {
+				receive = nil
+				retry = time.After(spillRetryInterval)
+			} else if b.full() {
+				receive = nil
+			}
+
+			select {
+			case <-b.stop:
+				// take the events the message processors have already queued, as the output would have done
+				drainMessages(in, func(message string) error {
+					b.push(message)
+					return nil
+				})
+				if err := b.save(); err != nil {
+					log.Printf("Could not save buffered events to %s: %s", b.spillPath, err)
+				}
+				return
+			case message := <-receive:
+				b.push(message)
+			case send <- next:
+				b.pop()
+			case <-retry:
+				b.retrySpill()
+			}
+		}
+	}()
+}
+
+// Shutdown stops the buffer and saves any events the output has not taken to the spill file.
+func (b *eventBuffer) Shutdown() {
+	close(b.stop)
+	<-b.done
+	b.spill.Close()
+}
+
+func (b *eventBuffer) Statistics() interface{} {
+	b.Lock()
+	defer b.Unlock()
+
+	return EventBufferStatistics{
+		MemoryEvents: len(b.memory),
+		MemoryBytes:  b.memoryBytes,
+		SpilledBytes: b.writeOffset - b.readOffset,
+		SpillErrors:  b.spillErrors,
+		LastError:    b.lastError,
+	}
+}
+
+func (b *eventBuffer) spillEmpty() bool {
+	return b.readOffset == b.writeOffset && len(b.unspilled) == 0
+}
+
+// full reports whether the spill file has reached its limit, in which case the message processors have to wait.
+func (b *eventBuffer) full() bool {
+	return b.spillLimit > 0 && b.writeOffset-b.readOffset >= b.spillLimit
+}
+
+func (b *eventBuffer) push(message string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.spillEmpty() && b.memoryBytes+int64(len(message)) <= b.memoryLimit {
+		b.memory = append(b.memory, message)
+		b.memoryBytes += int64(len(message))
+		return
+	}
+
+	if len(b.unspilled) > 0 || !b.writeSpill(message) {
+		b.unspilled = append(b.unspilled, message)
+	}
+}
+
+func (b *eventBuffer) retrySpill() {
+	b.Lock()
+	defer b.Unlock()
+
+	for len(b.unspilled) > 0 && b.writeSpill(b.unspilled[0]) {
+		b.unspilled = b.unspilled[1:]
+	}
+}
+
+// peek returns the oldest event, reading more from the spill file once the events in memory have been sent.
+func (b *eventBuffer) peek() (string, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.memory) == 0 && b.readOffset < b.writeOffset {
+		b.readSpill()
+	}
+	if len(b.memory) == 0 {
+		return "", false
+	}
+	return b.memory[0], true
+}
+
+func (b *eventBuffer) pop() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.memoryBytes -= int64(len(b.memory[0]))
+	b.memory[0] = ""
+	b.memory = b.memory[1:]
+}
+
+func (b *eventBuffer) writeSpill(message string) bool {
+	record := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(record, uint32(len(message)))
+	copy(record[4:], message)
+
+	if _, err := b.spill.WriteAt(record, b.writeOffset); err != nil {
+		// don't leave part of the record behind
+		b.spill.Truncate(b.writeOffset)
+		b.spillErrors++
+		b.lastError = err.Error()
+		log.Printf("Could not write event to %s: %s", b.spillPath, err)
+		return false
+	}
+
+	if b.writeOffset == 0 {
+		// the first record since the file was emptied
+		b.spillReader = newSpillReader(b.spill, 0)
+	}
+	b.writeOffset += int64(len(record))
+	return true
+}
+
+// readSpill moves events from the spill file to memory, up to the memory limit.
+func (b *eventBuffer) readSpill() {
+	for b.readOffset < b.writeOffset && (len(b.memory) == 0 || b.memoryBytes < b.memoryLimit) {
+		message, n, err := readSpillRecord(b.spillReader)
+		if err != nil {
+			// the rest of the file was not written completely
+			b.spillErrors++
+			b.lastError = err.Error()
+			log.Printf("Discarding %d bytes of unreadable events in %s: %s", b.writeOffset-b.readOffset, b.spillPath,
+				err)
+			b.readOffset = b.writeOffset
+			break
+		}
+
+		b.readOffset += n
+		b.memory = append(b.memory, message)
+		b.memoryBytes += int64(len(message))
+	}
+
+	if b.readOffset == b.writeOffset {
+		b.spill.Truncate(0)
+		b.readOffset, b.writeOffset = 0, 0
+	}
+}
+
+// newSpillReader reads records from offset on, including those appended after it was created.
+func newSpillReader(fp *os.File, offset int64) *bufio.Reader {
+	return bufio.NewReader(io.NewSectionReader(fp, offset, math.MaxInt64-offset))
+}
+
+func readSpillRecord(r *bufio.Reader) (string, int64, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", 0, err
+	}
+	message := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return "", 0, err
+	}
+	return string(message), int64(4 + len(message)), nil
+}
+
+// save rewrites the spill file to hold every buffered event, oldest first: those in memory, then the rest of the
+// spill file.
+func (b *eventBuffer) save() error {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.memory) == 0 && len(b.unspilled) == 0 && b.readOffset == 0 {
+		return nil
+	}
+
+	tmpPath := b.spillPath + ".tmp"
+	fp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+
+	writeRecord := func(message string) {
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(message)))
+		w.Write(header[:])
+		w.WriteString(message)
+	}
+	for _, message := range b.memory {
+		writeRecord(message)
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(b.spill, b.readOffset, b.writeOffset-b.readOffset)); err != nil {
+		fp.Close()
+		return err
+	}
+	for _, message := range b.unspilled {
+		writeRecord(message)
+	}
+
+	if err := w.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, b.spillPath); err != nil {
+		return err
+	}
+	log.Printf("Saved buffered events to %s", b.spillPath)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func receiveEvents(t *testing.T, out <-chan string, count int) []string {
+	var events []string
+	for len(events) < count {
+		select {
+		case event := <-out:
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Received %d of %d events", len(events), count)
+		}
+	}
+	return events
+}
+
+func TestEventBufferSpillsInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill_buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// room for two events in memory
+	buffer, err := newEventBuffer(20, 0, filepath.Join(dir, "spill"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan string)
+	out := make(chan string)
+	buffer.Go(in, out)
+
+	// nothing is reading from the output, so most events go to the spill file
+	for i := 0; i < 10; i++ {
+		in <- fmt.Sprintf("event %04d", i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := buffer.Statistics().(EventBufferStatistics)
+		if stats.MemoryEvents == 2 && stats.SpilledBytes == 8*14 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected buffer statistics: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, event := range receiveEvents(t, out, 10) {
+		if event != fmt.Sprintf("event %04d", i) {
+			t.Errorf("Expected event %d, got %s", i, event)
+		}
+	}
+	buffer.Shutdown()
+}
+
+func TestEventBufferSavesOnShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill_buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spillPath := filepath.Join(dir, "spill")
+	buffer, err := newEventBuffer(20, 0, spillPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan string, 10)
+	out := make(chan string)
+	buffer.Go(in, out)
+	for i := 0; i < 5; i++ {
+		in <- fmt.Sprintf("event %04d", i)
+	}
+	if event := receiveEvents(t, out, 1)[0]; event != "event 0000" {
+		t.Errorf("Expected the first event, got %s", event)
+	}
+	buffer.Shutdown()
+
+	// the rest are sent after a restart
+	buffer, err = newEventBuffer(20, 0, spillPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Go(in, out)
+	defer buffer.Shutdown()
+	for i, event := range receiveEvents(t, out, 4) {
+		if event != fmt.Sprintf("event %04d", i+1) {
+			t.Errorf("Expected event %d, got %s", i+1, event)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// statusSchemaVersion is the version of the status served at /status/v1. Fields may be added to it in any release,
+// but none are renamed, removed or given a different meaning: a change that would need that is made in a new
+// version, served alongside this one, so that monitoring that reads the status keeps working across upgrades. The
+// statistics of the output are the exception, passed through as the output reports them.
+const statusSchemaVersion = 1
+
+type StatusV1 struct {
+	SchemaVersion int                 `json:"schema_version"`
+	Version       string              `json:"version"`
+	Hostname      string              `json:"hostname"`
+	Time          time.Time           `json:"time"`
+	UptimeSeconds float64             `json:"uptime_seconds"`
+	Connection    StatusV1Connection  `json:"connection"`
+	Events        StatusV1Events      `json:"events"`
+	InputRate     InputRateStatistics `json:"input_rate"`
+	Output        StatusV1Output      `json:"output"`
+	RecentErrors  []RecentError       `json:"recent_errors"`
+}
+
+type StatusV1Connection struct {
+	Connected       bool      `json:"connected"`
+	LastConnectTime time.Time `json:"last_connect_time"`
+	LastErrorTime   time.Time `json:"last_error_time"`
+	LastErrorText   string    `json:"last_error_text"`
+}
+
+type StatusV1Events struct {
+	Input  int64 `json:"input"`
+	Output int64 `json:"output"`
+	Errors int64 `json:"errors"`
+}
+
+type StatusV1Output struct {
+	Type             string      `json:"type"`
+	Description      string      `json:"description"`
+	HoldingAreaFiles *int        `json:"holding_area_files,omitempty"`
+	Statistics       interface{} `json:"statistics"`
+}
+
+// statusV1 gathers the status of the forwarder in the version 1 schema.
+func statusV1(output OutputHandler, errors *errorHistory, hostname string) StatusV1 {
+	now := time.Now()
+	s := StatusV1{
+		SchemaVersion: statusSchemaVersion,
+		Version:       version,
+		Hostname:      hostname,
+		Time:          now,
+		UptimeSeconds: now.Sub(status.StartTime).Seconds(),
+		Connection: StatusV1Connection{
+			Connected:       status.IsConnected,
+			LastConnectTime: status.LastConnectTime,
+			LastErrorTime:   status.ErrorTime,
+			LastErrorText:   status.LastConnectError,
+		},
+		Events: StatusV1Events{
+			Input:  status.InputEventCount.Value(),
+			Output: status.OutputEventCount.Value(),
+			Errors: status.ErrorCount.Value(),
+		},
+		InputRate:    ingestRate.Statistics().(InputRateStatistics),
+		RecentErrors: errors.Errors(),
+	}
+	if output != nil {
+		s.Output = StatusV1Output{Type: config.OutputType, Description: output.String(), Statistics: output.Statistics()}
+		if area, ok := output.(HoldingArea); ok {
+			files := len(area.HoldingAreaFiles())
+			s.Output.HoldingAreaFiles = &files
+		}
+	}
+	return s
+}
+
+// statusAPIHandler serves the status of the forwarder as JSON at /status/v1.
+func statusAPIHandler(output OutputHandler, errors *errorHistory, hostname string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Status-Schema-Version", strconv.Itoa(statusSchemaVersion))
+		writeJSON(w, http.StatusOK, statusV1(output, errors, hostname))
+	})
+}
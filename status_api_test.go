@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestStatusAPIHandler(t *testing.T) {
+	output, dir := newHoldingAreaTestOutput(t, "event-forwarder.2017-01-01T00:00:00")
+	defer os.RemoveAll(dir)
+	errors := newErrorHistory(10)
+	errors.add(ErrorCategoryOutput, "write failed")
+
+	server := httptest.NewServer(statusAPIHandler(output, errors, "forwarder1"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/status/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Status-Schema-Version") != "1" {
+		t.Errorf("Unexpected schema version header %q", resp.Header.Get("X-Status-Schema-Version"))
+	}
+
+	// read it as a monitoring integration would, without the types of this version
+	var s map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s["schema_version"] != 1.0 || s["hostname"] != "forwarder1" {
+		t.Errorf("Unexpected status %+v", s)
+	}
+	out, _ := s["output"].(map[string]interface{})
+	if out["holding_area_files"] != 1.0 || out["description"] != "test uploader" {
+		t.Errorf("Unexpected output status %+v", out)
+	}
+	recent, _ := s["recent_errors"].([]interface{})
+	if len(recent) != 1 {
+		t.Fatalf("Expected 1 recent error, got %+v", s["recent_errors"])
+	}
+	if e := recent[0].(map[string]interface{}); e["category"] != "output" || e["message"] != "write failed" ||
+		e["time"] == nil {
+		t.Errorf("Unexpected recent error %+v", e)
+	}
+	for _, field := range []string{"version", "time", "uptime_seconds", "connection", "events", "input_rate"} {
+		if _, ok := s[field]; !ok {
+			t.Errorf("Expected %s in the status", field)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the throughput graphs of the status dashboard get a new point, and how many they keep: an hour
+	dashboardSampleInterval = 10 * time.Second
+	dashboardSamples        = 360
+)
+
+// throughputSample is one point of the dashboard graphs: the rates, per second, over the interval ending at Time.
+type throughputSample struct {
+	Time   time.Time
+	Input  float64
+	Output float64
+	Errors float64
+}
+
+// dashboardHistory keeps the recent throughput the status dashboard graphs, in a ring buffer of samples, only in
+// memory.
+type dashboardHistory struct {
+	samples    []throughputSample
+	nextSample int
+
+	lastTick                         time.Time
+	lastInput, lastOutput, lastError int64
+	sync.Mutex
+}
+
+var dashboard = newDashboardHistory(time.Now())
+
+func newDashboardHistory(now time.Time) *dashboardHistory {
+	return &dashboardHistory{lastTick: now}
+}
+
+// run adds a sample of the event counters every dashboardSampleInterval until ctx is cancelled.
+func (d *dashboardHistory) run(ctx context.Context) {
+	ticker := time.NewTicker(dashboardSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			d.tick(now, status.InputEventCount.Value(), status.OutputEventCount.Value(), status.ErrorCount.Value())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tick adds a sample of the rates since the last tick, given the current values of the counters.
+func (d *dashboardHistory) tick(now time.Time, input, output, errors int64) {
+	d.Lock()
+	defer d.Unlock()
+
+	elapsed := now.Sub(d.lastTick).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	sample := throughputSample{
+		Time:   now,
+		Input:  float64(input-d.lastInput) / elapsed,
+		Output: float64(output-d.lastOutput) / elapsed,
+		Errors: float64(errors-d.lastError) / elapsed,
+	}
+	d.lastTick, d.lastInput, d.lastOutput, d.lastError = now, input, output, errors
+
+	if len(d.samples) < dashboardSamples {
+		d.samples = append(d.samples, sample)
+		return
+	}
+	d.samples[d.nextSample] = sample
+	d.nextSample = (d.nextSample + 1) % dashboardSamples
+}
+
+// history returns the samples, oldest first.
+func (d *dashboardHistory) history() []throughputSample {
+	d.Lock()
+	defer d.Unlock()
+
+	return append(append([]throughputSample(nil), d.samples[d.nextSample:]...), d.samples[:d.nextSample]...)
+}
+
+// sparkline is a graph of the values of one rate, drawn as an SVG polyline.
+type sparkline struct {
+	Title   string
+	Current float64
+	Peak    float64
+	Points  string
+}
+
+const (
+	sparklineWidth  = 360
+	sparklineHeight = 40
+)
+
+func newSparkline(title string, samples []throughputSample, value func(throughputSample) float64) sparkline {
+	s := sparkline{Title: title}
+	for _, sample := range samples {
+		if v := value(sample); v > s.Peak {
+			s.Peak = v
+		}
+	}
+	points := make([]string, 0, len(samples))
+	for i, sample := range samples {
+		y := float64(sparklineHeight)
+		if s.Peak > 0 {
+			y -= value(sample) / s.Peak * sparklineHeight
+		}
+		// the newest sample is at the right edge, however few there are yet
+		x := sparklineWidth - float64(len(samples)-1-i)*sparklineWidth/float64(dashboardSamples-1)
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	if len(samples) > 0 {
+		s.Current = value(samples[len(samples)-1])
+	}
+	s.Points = strings.Join(points, " ")
+	return s
+}
+
+type dashboardRow struct {
+	Key   string
+	Value string
+}
+
+// statisticsRows lays out the statistics of an output as rows of a table: the fields of a struct or map in order of
+// their names, with values that are themselves structures shown as JSON.
+func statisticsRows(stats interface{}) []dashboardRow {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return []dashboardRow{{Key: "error", Value: err.Error()}}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return []dashboardRow{{Key: "statistics", Value: string(b)}}
+	}
+
+	rows := make([]dashboardRow, 0, len(fields))
+	for key, value := range fields {
+		var s string
+		if json.Unmarshal(value, &s) != nil {
+			s = string(value)
+		}
+		rows = append(rows, dashboardRow{Key: key, Value: s})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+	return rows
+}
+
+type dashboardPage struct {
+	Version     string
+	Hostname    string
+	Generated   time.Time
+	Connected   bool
+	Uptime      time.Duration
+	LastError   string
+	LastErrorAt time.Time
+	Graphs      []sparkline
+	Output      string
+	OutputRows  []dashboardRow
+	HoldingArea []HoldingAreaFile
+	HasHolding  bool
+	Errors      []RecentError
+}
+
+// statusDashboardHandler serves /status, a page for people to read, refreshed every few seconds, with what the
+// JSON at /debug/vars shows that matters most: how fast events are flowing, how the output is doing, what waits in
+// the holding area and what has gone wrong lately.
+func statusDashboardHandler(d *dashboardHistory, errors *errorHistory, output OutputHandler,
+	hostname string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		samples := d.history()
+		page := dashboardPage{
+			Version:   version,
+			Hostname:  hostname,
+			Generated: time.Now(),
+			Connected: status.IsConnected,
+			Graphs: []sparkline{
+				newSparkline("Events received per second", samples, func(s throughputSample) float64 { return s.Input }),
+				newSparkline("Events sent per second", samples, func(s throughputSample) float64 { return s.Output }),
+				newSparkline("Errors per second", samples, func(s throughputSample) float64 { return s.Errors }),
+			},
+			Errors: errors.Errors(),
+		}
+		if status.IsConnected {
+			page.Uptime = time.Since(status.LastConnectTime).Round(time.Second)
+		}
+		if len(status.LastConnectError) > 0 {
+			page.LastError, page.LastErrorAt = status.LastConnectError, status.ErrorTime
+		}
+		if output != nil {
+			page.Output = output.String()
+			page.OutputRows = statisticsRows(output.Statistics())
+			if area, ok := output.(HoldingArea); ok {
+				page.HoldingArea, page.HasHolding = area.HoldingAreaFiles(), true
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"rate":  func(v float64) string { return fmt.Sprintf("%.1f", v) },
+	"stamp": func(t time.Time) string { return t.Format(time.RFC3339) },
+	"age":   func(secs float64) time.Duration { return (time.Duration(secs) * time.Second).Round(time.Second) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta http-equiv="refresh" content="10">
+<title>cb-event-forwarder on {{.Hostname}}</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+table { border-collapse: collapse; margin-bottom: 20px; }
+td, th { text-align: left; padding: 2px 12px 2px 0; vertical-align: top; }
+svg { background: #f4f4f4; }
+polyline { fill: none; stroke: #337ab7; stroke-width: 1.5; }
+.ok { color: #3c763d; } .bad { color: #a94442; }
+.value { font-family: monospace; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>cb-event-forwarder {{.Version}} on {{.Hostname}}</h1>
+<p>{{if .Connected}}<span class="ok">Connected</span> for {{.Uptime}}
+{{- else}}<span class="bad">Not connected</span>{{end}}
+{{- if .LastError}}; last connection error at {{stamp .LastErrorAt}}: {{.LastError}}{{end}}.
+Updated {{stamp .Generated}}; the raw statistics are at <a href="/debug/vars">/debug/vars</a>.</p>
+
+<h2>Throughput</h2>
+<table>
+{{range .Graphs}}<tr><td>{{.Title}}</td>
+<td><svg width="360" height="40" viewBox="0 0 360 40"><polyline points="{{.Points}}"/></svg></td>
+<td>{{rate .Current}} now, {{rate .Peak}} peak in the last hour</td></tr>
+{{end}}</table>
+
+<h2>Output</h2>
+<p>{{.Output}}</p>
+<table>
+{{range .OutputRows}}<tr><td>{{.Key}}</td><td class="value">{{.Value}}</td></tr>
+{{end}}</table>
+
+{{if .HasHolding}}<h2>Holding Area</h2>
+{{if .HoldingArea}}<table>
+<tr><th>File</th><th>Size</th><th>Age</th><th>Attempts</th><th>State</th></tr>
+{{range .HoldingArea}}<tr><td>{{.Name}}</td><td>{{.Size}}</td><td>{{age .AgeSeconds}}</td><td>{{.Attempts}}</td>
+<td>{{if .Uploading}}uploading{{else if .Held}}<span class="bad">held</span>
+{{- else if .Attempts}}retry at {{stamp .NextAttempt}}
+{{- else}}waiting{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No files are waiting to be uploaded.</p>
+{{end}}{{end}}
+<h2>Recent Errors</h2>
+{{if .Errors}}<table>
+{{range .Errors}}<tr><td>{{stamp .Time}}</td><td>{{.Category}}</td><td class="value">{{.Message}}</td></tr>
+{{end}}</table>
+{{else}}<p>No errors since the forwarder started.</p>
+{{end}}</body>
+</html>
+`))
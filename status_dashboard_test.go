@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboardHistory(t *testing.T) {
+	start := time.Now()
+	d := newDashboardHistory(start)
+	for i := 1; i <= dashboardSamples+5; i++ {
+		d.tick(start.Add(time.Duration(i)*dashboardSampleInterval), int64(i*i*10), int64(i*10), 0)
+	}
+
+	samples := d.history()
+	if len(samples) != dashboardSamples || !samples[0].Time.Equal(start.Add(6*dashboardSampleInterval)) {
+		t.Fatalf("Expected the last %d samples, oldest first, got %d starting at %s", dashboardSamples, len(samples),
+			samples[0].Time)
+	}
+	// the input rate grows by 2 events a sample
+	last := samples[len(samples)-1]
+	if last.Output != 1 || last.Input != float64(2*(dashboardSamples+5)-1) {
+		t.Errorf("Unexpected rates %+v", last)
+	}
+
+	line := newSparkline("input", samples, func(s throughputSample) float64 { return s.Input })
+	if line.Peak != last.Input || line.Current != last.Input || !strings.HasSuffix(line.Points, "360.0,0.0") {
+		t.Errorf("Unexpected sparkline %+v", line)
+	}
+}
+
+func TestStatusDashboardHandler(t *testing.T) {
+	name := "event-forwarder.2017-01-01T00:00:00"
+	output, dir := newHoldingAreaTestOutput(t, name)
+	defer os.RemoveAll(dir)
+
+	d := newDashboardHistory(time.Now())
+	d.tick(time.Now().Add(dashboardSampleInterval), 100, 90, 1)
+	errors := newErrorHistory(10)
+	errors.add(ErrorCategoryEvent, "Could not process body when processing <routing key>")
+
+	server := httptest.NewServer(statusDashboardHandler(d, errors, output, "forwarder1"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(b)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("Unexpected response %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	for _, expected := range []string{
+		"on forwarder1",
+		"<polyline points=",
+		name,
+		"files_queued",
+		"&lt;routing key&gt;",
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("Expected %q on the dashboard:\n%s", expected, page)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// the subdirectory of the holding area that corrupt files are moved to
+const quarantineDirectory = "quarantine"
+
+// the longest first or last line of a straggler that is checked; a file whose line is longer is treated as corrupt
+const stragglerLineLimit = 16 * 1024 * 1024
+
+// quarantineReport is written next to each quarantined file, as <name>.report.json, saying why it was quarantined.
+type quarantineReport struct {
+	FileName      string    `json:"file_name"`
+	OriginalPath  string    `json:"original_path"`
+	Size          int64     `json:"size"`
+	Reason        string    `json:"reason"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// checkStraggler returns why a file found in the holding area can't be a bundle of events, or nil if it looks like
+// one: it isn't empty, and its first and last lines are whole events, in JSON or LEEF, or it is an indexed bundle
+// with a readable index, or it is compressed and decompresses to the end. Files are checked rather than uploaded as
+// they are because a forwarder that crashed, or a disk that filled up, can leave a file truncated part way through
+// an event, and whatever loads the uploaded files typically rejects the whole file. Errors reading the file aren't
+// reported: they aren't a sign of corruption, and the upload will fail and be retried like any other.
+func checkStraggler(fileName string) error {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		return nil
+	}
+	size := info.Size()
+	if size == 0 {
+		return fmt.Errorf("the file is empty")
+	}
+
+	header := make([]byte, len(indexedBundleMagic))
+	fp.ReadAt(header, 0)
+	if compression := bundleCompressionOfHeader(header); len(compression) > 0 {
+		return checkCompressedStraggler(fp, compression)
+	}
+	if string(header) == indexedBundleMagic {
+		if _, err := readIndexedBundleIndex(fp, size); err != nil {
+			return fmt.Errorf("the file is not a whole indexed bundle: %s", err)
+		}
+		return nil
+	}
+
+	tail := make([]byte, size)
+	if size > stragglerLineLimit {
+		tail = tail[:stragglerLineLimit]
+	}
+	if _, err := fp.ReadAt(tail, size-int64(len(tail))); err != nil && err != io.EOF {
+		return nil
+	}
+	if tail[len(tail)-1] != '\n' {
+		return fmt.Errorf("the last line is incomplete: the file was truncated")
+	}
+
+	first, err := bufio.NewReader(io.LimitReader(fp, stragglerLineLimit)).ReadBytes('\n')
+	if err == io.EOF && size > stragglerLineLimit {
+		return fmt.Errorf("the first line is longer than %d bytes", stragglerLineLimit)
+	} else if err != nil && err != io.EOF {
+		return nil
+	}
+	if !validBundleLine(first) {
+		return fmt.Errorf("the first line is not a JSON or LEEF event")
+	}
+
+	tail = tail[:len(tail)-1]
+	i := bytes.LastIndexByte(tail, '\n')
+	if i < 0 && size > stragglerLineLimit {
+		return fmt.Errorf("the last line is longer than %d bytes", stragglerLineLimit)
+	}
+	if !validBundleLine(tail[i+1:]) {
+		return fmt.Errorf("the last line is not a JSON or LEEF event")
+	}
+	return nil
+}
+
+// validBundleLine reports whether line is an event in either output format, so that files written before the
+// format was changed still pass.
+func validBundleLine(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	return bytes.HasPrefix(line, []byte("LEEF:")) || (len(line) > 0 && json.Valid(line))
+}
+
+// quarantine moves a corrupt file, with its signature, out of the way of uploads into the quarantine subdirectory of
+// the holding area, and writes a report of why beside it. The file can be repaired and moved back by hand.
+func (o *BundledOutput) quarantine(fileName string, reason error) {
+	report := quarantineReport{
+		FileName:      filepath.Base(fileName),
+		OriginalPath:  fileName,
+		Reason:        reason.Error(),
+		QuarantinedAt: time.Now(),
+	}
+	if info, err := os.Stat(fileName); err == nil {
+		report.Size = info.Size()
+	}
+
+	destination, err := moveBundle(fileName, filepath.Join(o.tempFileDirectory, quarantineDirectory))
+	if err != nil {
+		log.Printf("Could not quarantine corrupt file %s (%s): %s", fileName, reason, err)
+		return
+	}
+	if contents, err := json.MarshalIndent(report, "", "  "); err == nil {
+		ioutil.WriteFile(destination+".report.json", append(contents, '\n'), 0600)
+	}
+	atomic.AddInt64(&o.filesQuarantined, 1)
+	log.Printf("WARNING: %s is corrupt (%s); it will not be uploaded, and has been moved to %s", fileName, reason,
+		destination)
+}
+
+// moveBundle moves a file out of the holding area into dir, along with its signature, and returns its new name. Its
+// retry state is removed. dir must be on the same filesystem as the holding area.
+func moveBundle(fileName, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	// a file of the same name may have been moved there before
+	destination := filepath.Join(dir, filepath.Base(fileName))
+	if _, err := os.Lstat(destination); err == nil {
+		destination = fmt.Sprintf("%s.%d", destination, time.Now().UnixNano())
+	}
+	if err := os.Rename(fileName, destination); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(signaturePath(fileName)); err == nil {
+		os.Rename(signaturePath(fileName), signaturePath(destination))
+	}
+	removeRetryState(fileName)
+	return destination, nil
+}
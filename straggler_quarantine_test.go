@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckStraggler(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		contents string
+		corrupt  bool
+	}{
+		{testBundleEvent + testBundleEvent, false},
+		{"LEEF:1.0|CB|CB|5.1|ingress.event.procstart|cb_server=cbserver\n", false},
+		{"", true},
+		{testBundleEvent + "{\"type\":\"ingress.ev", true},
+		{testBundleEvent + "{\"type\":\"ingress.ev\n", true},
+		{"ess.event.procstart\"}\n" + testBundleEvent, true},
+		{"\x00\x00\x00\x00\n", true},
+	}
+	for i, test := range tests {
+		fileName := filepath.Join(dir, "event-forwarder.test")
+		ioutil.WriteFile(fileName, []byte(test.contents), 0600)
+		if err := checkStraggler(fileName); (err != nil) != test.corrupt {
+			t.Errorf("%d: expected corrupt to be %v, got %v", i, test.corrupt, err)
+		}
+	}
+}
+
+func TestQuarantineStragglers(t *testing.T) {
+	behavior := newTestUploadBehavior(t, false)
+	dir := behavior.directory
+	defer os.RemoveAll(dir)
+
+	good := filepath.Join(dir, "event-forwarder.2026-10-14T00:00:00")
+	truncated := filepath.Join(dir, "event-forwarder.2026-10-14T00:05:00")
+	nested := filepath.Join(dir, "old", "event-forwarder.2026-10-13T00:00:00")
+	os.Mkdir(filepath.Join(dir, "old"), 0700)
+	ioutil.WriteFile(good, []byte(testBundleEvent), 0600)
+	ioutil.WriteFile(truncated, []byte(testBundleEvent+"{\"type\":"), 0600)
+	ioutil.WriteFile(signaturePath(truncated), []byte("signature"), 0600)
+	ioutil.WriteFile(nested, []byte(testBundleEvent), 0600)
+
+	// a file already in the quarantine is left there
+	os.Mkdir(filepath.Join(dir, quarantineDirectory), 0700)
+	ioutil.WriteFile(filepath.Join(dir, quarantineDirectory, "event-forwarder.2026-10-12T00:00:00"),
+		[]byte(testBundleEvent), 0600)
+
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+
+	var queued []string
+	for _, upload := range output.filesToUpload {
+		queued = append(queued, upload.fileName)
+	}
+	if len(queued) != 2 || queued[0] != nested || queued[1] != good {
+		t.Errorf("Expected the good files to be queued, got %v", queued)
+	}
+
+	quarantined := filepath.Join(dir, quarantineDirectory, filepath.Base(truncated))
+	if _, err := os.Stat(truncated); !os.IsNotExist(err) {
+		t.Errorf("Expected the truncated file to be moved")
+	}
+	if _, err := os.Stat(quarantined); err != nil {
+		t.Errorf("Expected the truncated file in the quarantine: %s", err)
+	}
+	if _, err := os.Stat(signaturePath(quarantined)); err != nil {
+		t.Errorf("Expected the signature to be moved with the file: %s", err)
+	}
+
+	var report quarantineReport
+	contents, err := ioutil.ReadFile(quarantined + ".report.json")
+	if err == nil {
+		err = json.Unmarshal(contents, &report)
+	}
+	if err != nil || report.OriginalPath != truncated || !strings.Contains(report.Reason, "incomplete") {
+		t.Errorf("Unexpected quarantine report %+v (%v)", report, err)
+	}
+
+	if stats := output.Snapshot(); stats.FilesQuarantined != 1 || stats.FilesQueued != 2 {
+		t.Errorf("Expected 1 file quarantined and 2 queued, got %d and %d", stats.FilesQuarantined,
+			stats.FilesQueued)
+	}
+}
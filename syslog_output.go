@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	syslog "github.com/RackSec/srslog"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -29,15 +31,31 @@ type SyslogOutput struct {
 	droppedEventCount           int64
 	droppedEventSinceConnection int64
 
+	// archives events while the connection is down, if output_archive_directory is set
+	fallback *outputFallback
+
+	loop *outputLoop
 	sync.RWMutex
 }
 
+func init() {
+	RegisterOutput(OutputRegistration{
+		Name:         SyslogOutputType,
+		ParameterKey: "syslogout",
+		StatusType:   "syslog",
+		Archives:     true,
+		Factory:      func() OutputHandler { return &SyslogOutput{} },
+	})
+}
+
 type SyslogStatistics struct {
 	LastOpenTime       time.Time `json:"last_open_time"`
 	Protocol           string    `json:"protocol"`
 	RemoteHostnamePort string    `json:"remote_hostname_port"`
 	DroppedEventCount  int64     `json:"dropped_event_count"`
 	Connected          bool      `json:"connected"`
+
+	Archive *OutputFallbackStatistics `json:"archive,omitempty"`
 }
 
 // Initialize() expects a connection string in the following format:
@@ -56,7 +74,14 @@ func (o *SyslogOutput) Initialize(netConn string) error {
 	o.protocol = connSpecification[0]
 	o.hostnamePort = connSpecification[1]
 
-	tlsConfig := &tls.Config{}
+	if o.fallback == nil {
+		var err error
+		if o.fallback, err = newOutputFallback(SyslogOutputType + ":" + netConn); err != nil {
+			return err
+		}
+	}
+
+	tlsConfig := restrictTLSConfig(&tls.Config{})
 
 	if config.SyslogTLSVerify == false {
 		log.Printf("Disabling TLS verification for syslog output at %s", netConn)
@@ -86,8 +111,16 @@ func (o *SyslogOutput) Initialize(netConn string) error {
 		tlsConfig.RootCAs = caCertPool
 	}
 
-	var err error
-	o.outputSocket, err = syslog.DialWithTLSConfig(o.protocol, o.hostnamePort, syslog.LOG_INFO, o.tag, tlsConfig)
+	// the certificate is checked against the host name, whatever address it resolves to
+	if host, _, err := net.SplitHostPort(o.hostnamePort); err == nil && net.ParseIP(host) == nil {
+		tlsConfig.ServerName = host
+	}
+	address, err := resolveAddress(context.Background(), o.hostnamePort)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error connecting to '%s': %s", netConn, err))
+	}
+
+	o.outputSocket, err = syslog.DialWithTLSConfig(o.protocol, address, syslog.LOG_INFO, o.tag, tlsConfig)
 
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error connecting to '%s': %s", netConn, err))
@@ -113,13 +146,18 @@ func (o *SyslogOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return SyslogStatistics{
+	stats := SyslogStatistics{
 		LastOpenTime:       o.connectTime,
 		Protocol:           o.protocol,
 		RemoteHostnamePort: o.hostnamePort,
 		DroppedEventCount:  o.droppedEventCount,
 		Connected:          o.connected,
 	}
+	if o.fallback != nil {
+		archive := o.fallback.Statistics()
+		stats.Archive = &archive
+	}
+	return stats
 }
 
 func (o *SyslogOutput) markConnected() {
@@ -148,12 +186,19 @@ func (o *SyslogOutput) closeAndScheduleReconnection() {
 }
 
 func (o *SyslogOutput) output(m string) error {
+	if o.fallback != nil {
+		return o.fallback.Send(m, o.connected, o.write)
+	}
+
 	if !o.connected {
 		// drop this event on the floor...
 		atomic.AddInt64(&o.droppedEventCount, 1)
 		return nil
 	}
+	return o.write(m)
+}
 
+func (o *SyslogOutput) write(m string) error {
 	err := o.outputSocket.Info(m)
 	if err != nil {
 		o.closeAndScheduleReconnection()
@@ -162,12 +207,16 @@ func (o *SyslogOutput) output(m string) error {
 	return err
 }
 
-func (o *SyslogOutput) Go(messages <-chan string, errorChan chan<- error) error {
+func (o *SyslogOutput) Go(ctx context.Context, messages <-chan string, errorChan chan<- error) error {
 	if o.outputSocket == nil {
 		return errors.New("Output socket not open")
 	}
 
+	o.loop = newOutputLoop(ctx)
+
 	go func() {
+		defer o.loop.exited()
+
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer refreshTicker.Stop()
 
@@ -178,18 +227,25 @@ func (o *SyslogOutput) Go(messages <-chan string, errorChan chan<- error) error
 
 		for {
 			select {
+			case <-o.loop.ctx.Done():
+				if err := drainMessages(messages, o.output); err != nil {
+					log.Printf("Error writing to %s during shutdown: %s", o.String(), err)
+				}
+				return
+
 			case message := <-messages:
 				if err := o.output(message); err != nil {
 					errorChan <- err
 				}
 
-			case <-refreshTicker.C:
-				if !o.connected && time.Now().After(o.reconnectTime) {
+			case now := <-refreshTicker.C:
+				if !o.connected && now.After(o.reconnectTime) && !o.fallback.Open(now) {
 					err := o.Initialize(o.String())
 					if err != nil {
 						o.closeAndScheduleReconnection()
 					}
 				}
+				o.fallback.Replay(o.connected, o.write)
 			}
 		}
 
@@ -197,3 +253,17 @@ func (o *SyslogOutput) Go(messages <-chan string, errorChan chan<- error) error
 
 	return nil
 }
+
+func (o *SyslogOutput) Shutdown() error {
+	o.loop.Shutdown()
+	o.fallback.Close()
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.connected = false
+		return o.outputSocket.Close()
+	}
+	return nil
+}
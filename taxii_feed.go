@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const taxiiMediaType = "application/taxii+json;version=2.1"
+
+// comparison expressions in STIX patterns that can be matched against event fields
+var stixComparison = regexp.MustCompile(
+	`(?i)(file:hashes\.(?:'MD5'|MD5)|domain-name:value|ipv4-addr:value|ipv6-addr:value)\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+// TAXIIFeed pulls STIX indicators from a TAXII 2.1 collection. Each poll fetches the whole collection (following
+// "next" pagination), so indicators removed or revoked upstream drop out of the list on the next refresh.
+type TAXIIFeed struct {
+	list   IndicatorListConfig
+	url    string
+	client *http.Client
+}
+
+type taxiiEnvelope struct {
+	More    bool         `json:"more"`
+	Next    string       `json:"next"`
+	Objects []stixObject `json:"objects"`
+}
+
+type stixObject struct {
+	Type        string `json:"type"`
+	Pattern     string `json:"pattern"`
+	PatternType string `json:"pattern_type"`
+	Revoked     bool   `json:"revoked"`
+	ValidUntil  string `json:"valid_until"`
+}
+
+// NewTAXIIFeed creates a feed for the collection at list.TAXIIURL, for example
+// https://taxii.example.com/api1/collections/91a7b528-80eb-42ed-a74d-c6fbd5a26116/
+func NewTAXIIFeed(list IndicatorListConfig) *TAXIIFeed {
+	return &TAXIIFeed{
+		list:   list,
+		url:    strings.TrimSuffix(list.TAXIIURL, "/") + "/objects/",
+		client: &http.Client{Timeout: 60 * time.Second, Transport: httpTransport()},
+	}
+}
+
+func (f *TAXIIFeed) Poll() (*IndicatorList, error) {
+	list := NewIndicatorList(f.list.Name, f.list.TAXIIURL, f.list.Confidence)
+	now := time.Now()
+
+	next := ""
+	for {
+		envelope, err := f.fetch(next)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range envelope.Objects {
+			addSTIXIndicator(list, obj, now)
+		}
+
+		if !envelope.More || len(envelope.Next) == 0 || envelope.Next == next {
+			break
+		}
+		next = envelope.Next
+	}
+
+	return list, nil
+}
+
+func (f *TAXIIFeed) fetch(next string) (*taxiiEnvelope, error) {
+	params := url.Values{}
+	params.Set("match[type]", "indicator")
+	if len(next) > 0 {
+		params.Set("next", next)
+	}
+
+	req, err := http.NewRequest("GET", f.url+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", taxiiMediaType)
+	if len(f.list.TAXIIUsername) > 0 {
+		req.SetBasicAuth(f.list.TAXIIUsername, f.list.TAXIIPassword)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("TAXII server returned %s", resp.Status)
+	}
+
+	envelope := &taxiiEnvelope{}
+	if err := json.NewDecoder(resp.Body).Decode(envelope); err != nil {
+		return nil, fmt.Errorf("Could not parse TAXII envelope: %s", err)
+	}
+	return envelope, nil
+}
+
+// addSTIXIndicator adds the md5s, domains and IP addresses compared against in a STIX indicator's pattern. Revoked
+// and expired indicators, and indicators using other pattern languages, are skipped.
+func addSTIXIndicator(list *IndicatorList, obj stixObject, now time.Time) {
+	if obj.Type != "indicator" || obj.Revoked {
+		return
+	}
+	if len(obj.PatternType) > 0 && obj.PatternType != "stix" {
+		return
+	}
+	if len(obj.ValidUntil) > 0 {
+		if validUntil, err := time.Parse(time.RFC3339Nano, obj.ValidUntil); err == nil && validUntil.Before(now) {
+			return
+		}
+	}
+
+	for _, match := range stixComparison.FindAllStringSubmatch(obj.Pattern, -1) {
+		value := strings.Replace(strings.Replace(match[2], "\\'", "'", -1), "\\\\", "\\", -1)
+
+		if strings.HasSuffix(strings.ToLower(match[1]), "-addr:value") {
+			// only single addresses can be matched; skip network ranges
+			if idx := strings.Index(value, "/"); idx >= 0 {
+				if value[idx+1:] != "32" && value[idx+1:] != "128" {
+					continue
+				}
+				value = value[:idx]
+			}
+		}
+
+		list.Add(value)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tierQueueSize is the number of events the tier output can fall behind by before events are dropped for it.
+const tierQueueSize = 10000
+
+// tierSummaryEventType is the type of the events counting the events of a type summarized in an interval.
+const tierSummaryEventType = "cb-event-forwarder.summary"
+
+// The ways a [tier] policy sends the events of a type to the tier output.
+const (
+	TierFull    = "full"
+	TierFields  = "fields"
+	TierSummary = "summary"
+	TierDrop    = "drop"
+)
+
+// TierPolicy decides what the tier output receives of the events matching EventType: every event (full), the event
+// with only Fields, a count of the events per interval (summary), optionally by the value of GroupBy, or nothing.
+type TierPolicy struct {
+	EventType string
+	Action    string
+	Fields    []string
+	GroupBy   string
+}
+
+// TierPolicies is the [tier] section. An event type is sent by the policy naming it, or else by the longest pattern
+// matching it, or else by Default.
+type TierPolicies struct {
+	Rules           []TierPolicy
+	Default         TierPolicy
+	SummaryInterval time.Duration
+}
+
+func parseTierPolicy(eventType, val string) (TierPolicy, error) {
+	policy := TierPolicy{EventType: eventType}
+	parts := strings.SplitN(strings.TrimSpace(val), ":", 2)
+	policy.Action = strings.ToLower(strings.TrimSpace(parts[0]))
+
+	switch policy.Action {
+	case TierFull, TierDrop:
+		if len(parts) > 1 {
+			return policy, fmt.Errorf("%s takes no fields", policy.Action)
+		}
+	case TierFields:
+		if len(parts) > 1 {
+			policy.Fields = splitList(parts[1])
+		}
+		if len(policy.Fields) == 0 {
+			return policy, errors.New("fields needs a list of fields, such as fields:process_path,cmdline")
+		}
+	case TierSummary:
+		if len(parts) > 1 {
+			policy.GroupBy = strings.TrimSpace(parts[1])
+		}
+	default:
+		return policy, errors.New("should be full, fields:<fields>, summary, summary:<field> or drop")
+	}
+	return policy, nil
+}
+
+func parseTierPolicies(section ini.Section, errs *ConfigurationError) TierPolicies {
+	p := TierPolicies{Default: TierPolicy{Action: TierFull}, SummaryInterval: 5 * time.Minute}
+
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		val := section[key]
+		if key == "summary_interval" {
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval < time.Second {
+				errs.addErrorString(fmt.Sprintf("Invalid summary_interval '%s' in [tier]: should be a duration of "+
+					"at least 1s, such as 5m", val))
+			} else {
+				p.SummaryInterval = interval
+			}
+			continue
+		}
+
+		policy, err := parseTierPolicy(key, val)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid policy '%s' for %s in [tier]: %s", val, key, err))
+		} else if key == "default" {
+			policy.EventType = ""
+			p.Default = policy
+		} else {
+			p.Rules = append(p.Rules, policy)
+		}
+	}
+	return p
+}
+
+// policy returns the policy for eventType.
+func (p TierPolicies) policy(eventType string) TierPolicy {
+	best := -1
+	for i, rule := range p.Rules {
+		if rule.EventType == eventType {
+			return rule
+		}
+		if RoutingKeyMatches(rule.EventType, eventType) && (best < 0 || len(rule.EventType) >
+			len(p.Rules[best].EventType)) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return p.Rules[best]
+	}
+	return p.Default
+}
+
+type tierSummaryKey struct {
+	eventType string
+	group     string
+}
+
+type TieredOutputStatistics struct {
+	Output           string      `json:"output"`
+	Events           int64       `json:"events"`
+	Summarized       int64       `json:"summarized_events"`
+	SummaryEvents    int64       `json:"summary_events"`
+	Excluded         int64       `json:"excluded_events"`
+	Dropped          int64       `json:"dropped_events"`
+	Errors           int64       `json:"errors"`
+	LastError        string      `json:"last_error,omitempty"`
+	OutputStatistics interface{} `json:"output_status,omitempty"`
+}
+
+// tieredOutput sends the events sent to the main output - typically a data lake such as S3, which is cheap to store
+// everything in - to a second output, typically a SIEM licensed by volume, according to the [tier] policy of each
+// event type: in full, with only some fields, as counts per summary interval, or not at all. Events are formatted
+// like those of the main output. Like the shadow output, the tier output never holds up the main output: events it
+// falls behind on are dropped and counted.
+type tieredOutput struct {
+	output   OutputHandler
+	policies TierPolicies
+
+	messages  chan string
+	errors    chan error
+	summaries map[tierSummaryKey]int64
+	stats     TieredOutputStatistics
+
+	stop    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	sync.Mutex
+}
+
+var tier *tieredOutput
+
+func newTieredOutput(outputType, parameters string, policies TierPolicies) (*tieredOutput, error) {
+	registration, ok := LookupOutput(outputType)
+	if !ok {
+		return nil, errors.New("No valid output handler found (" + outputType + ")")
+	}
+
+	output := registration.Factory()
+	if err := output.Initialize(parameters); err != nil {
+		return nil, err
+	}
+
+	return &tieredOutput{
+		output:    output,
+		policies:  policies,
+		messages:  make(chan string, tierQueueSize),
+		errors:    make(chan error),
+		summaries: make(map[tierSummaryKey]int64),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}, nil
+}
+
+// Go starts the tier output, and sends summaries every summary interval until Shutdown.
+func (t *tieredOutput) Go(ctx context.Context) error {
+	if err := t.output.Go(ctx, t.messages, t.errors); err != nil {
+		return err
+	}
+	log.Printf("Sending events to tier output %s", t.output.String())
+
+	go t.countErrors()
+	go t.run()
+	return nil
+}
+
+// Send sends msg, received at received and formatted as formatted for the main output, to the tier output according
+// to its policy.
+func (t *tieredOutput) Send(msg map[string]interface{}, formatted string, received time.Time) {
+	eventType, _ := msg["type"].(string)
+	policy := t.policies.policy(eventType)
+
+	switch policy.Action {
+	case TierFull:
+		t.enqueue(formatted, &t.stats.Events)
+	case TierFields:
+		projected := map[string]interface{}{"type": eventType}
+		for _, field := range policy.Fields {
+			if value, ok := msg[field]; ok {
+				projected[field] = value
+			}
+		}
+		t.format(projected, received, &t.stats.Events)
+	case TierSummary:
+		key := tierSummaryKey{eventType: eventType}
+		if len(policy.GroupBy) > 0 {
+			key.group = fmt.Sprint(msg[policy.GroupBy])
+		}
+		t.Lock()
+		t.summaries[key]++
+		t.stats.Summarized++
+		t.Unlock()
+	default:
+		t.Lock()
+		t.stats.Excluded++
+		t.Unlock()
+	}
+}
+
+func (t *tieredOutput) format(msg map[string]interface{}, received time.Time, counter *int64) {
+	msg["cb_server"] = config.ServerName
+	formatted, err := formatMessage(msg, received)
+	if err != nil || len(formatted) == 0 {
+		return
+	}
+	t.enqueue(formatted, counter)
+}
+
+// enqueue queues an event for the tier output, and counts it, unless the output has fallen too far behind.
+func (t *tieredOutput) enqueue(formatted string, counter *int64) {
+	if eventEncoder != nil {
+		formatted = eventEncoder.Encode(formatted)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	select {
+	case t.messages <- formatted:
+		*counter++
+	default:
+		t.stats.Dropped++
+	}
+}
+
+// summarize sends a summary event for each event type, and group, counted in the interval ending at now.
+func (t *tieredOutput) summarize(now time.Time) {
+	t.Lock()
+	summaries := t.summaries
+	t.summaries = make(map[tierSummaryKey]int64)
+	t.Unlock()
+
+	interval := int64(t.policies.SummaryInterval.Seconds())
+	for key, count := range summaries {
+		msg := map[string]interface{}{
+			"type":       tierSummaryEventType,
+			"timestamp":  now.Unix(),
+			"event_type": key.eventType,
+			"count":      count,
+			"interval":   interval,
+		}
+		if groupBy := t.policies.policy(key.eventType).GroupBy; len(groupBy) > 0 {
+			msg[groupBy] = key.group
+		}
+		t.format(msg, now, &t.stats.SummaryEvents)
+	}
+}
+
+func (t *tieredOutput) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.policies.SummaryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			t.summarize(now)
+		case <-t.stop:
+			t.summarize(time.Now())
+			return
+		}
+	}
+}
+
+// countErrors counts and logs the errors of the tier output, which can't affect the main output.
+func (t *tieredOutput) countErrors() {
+	for {
+		select {
+		case err := <-t.errors:
+			t.Lock()
+			t.stats.Errors++
+			t.stats.LastError = err.Error()
+			t.Unlock()
+
+			log.Printf("Error from tier output %s: %s", t.output.String(), err)
+		case <-t.stopped:
+			return
+		}
+	}
+}
+
+// Shutdown sends the summaries of the events counted so far, and stops the tier output.
+func (t *tieredOutput) Shutdown() {
+	close(t.stop)
+	<-t.done
+
+	if err := t.output.Shutdown(); err != nil {
+		log.Printf("Error shutting down tier output %s: %s", t.output.String(), err)
+	}
+	close(t.stopped)
+}
+
+func (t *tieredOutput) Statistics() interface{} {
+	t.Lock()
+	defer t.Unlock()
+	stats := t.stats
+	stats.Output = t.output.String()
+	stats.OutputStatistics = t.output.Statistics()
+	return stats
+}
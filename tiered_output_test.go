@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/vaughan0/go-ini"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTierPolicies(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[tier]
+default=drop
+summary_interval=1m
+alert.#=full
+ingress.event.*=summary
+ingress.event.netconn=summary:computer_name
+ingress.event.procstart=fields:process_path, cmdline
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := ConfigurationError{Empty: true}
+	policies := parseTierPolicies(input.Section("tier"), &errs)
+	if !errs.Empty {
+		t.Fatal(errs.Errors)
+	}
+	if policies.SummaryInterval != time.Minute || policies.Default.Action != TierDrop {
+		t.Errorf("Unexpected policies %+v", policies)
+	}
+
+	for eventType, expected := range map[string]TierPolicy{
+		"alert.watchlist.hit.query.process": {EventType: "alert.#", Action: TierFull},
+		"ingress.event.netconn": {EventType: "ingress.event.netconn", Action: TierSummary,
+			GroupBy: "computer_name"},
+		"ingress.event.filemod": {EventType: "ingress.event.*", Action: TierSummary},
+		"ingress.event.procstart": {EventType: "ingress.event.procstart", Action: TierFields,
+			Fields: []string{"process_path", "cmdline"}},
+		"feed.ingress.hit.process": {Action: TierDrop},
+	} {
+		if policy := policies.policy(eventType); policy.EventType != expected.EventType ||
+			policy.Action != expected.Action || policy.GroupBy != expected.GroupBy ||
+			strings.Join(policy.Fields, ",") != strings.Join(expected.Fields, ",") {
+			t.Errorf("Expected %s events to follow %+v, got %+v", eventType, expected, policy)
+		}
+	}
+
+	for _, val := range []string{"everything", "fields", "full:type"} {
+		input, _ := ini.Load(strings.NewReader("[tier]\ningress.event.netconn=" + val + "\n"))
+		errs := ConfigurationError{Empty: true}
+		parseTierPolicies(input.Section("tier"), &errs)
+		if errs.Empty {
+			t.Errorf("Expected the policy %s to be refused", val)
+		}
+	}
+}
+
+func TestTieredOutput(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	config.OutputFormat = JSONOutputFormat
+	config.ServerName = "cbserver"
+
+	input, _ := ini.Load(strings.NewReader(`
+[tier]
+default=drop
+alert.#=full
+ingress.event.netconn=summary:computer_name
+ingress.event.procstart=fields:process_path
+`))
+	errs := ConfigurationError{Empty: true}
+	tier := &tieredOutput{policies: parseTierPolicies(input.Section("tier"), &errs), messages: make(chan string, 2),
+		summaries: make(map[tierSummaryKey]int64)}
+	now := time.Unix(1800000000, 0)
+
+	tier.Send(map[string]interface{}{"type": "alert.watchlist.hit.query.process"}, "formatted alert", now)
+	tier.Send(map[string]interface{}{"type": "ingress.event.procstart", "process_path": "c:\\windows\\cmd.exe",
+		"cmdline": "cmd.exe /c secret"}, "", now)
+	for i := 0; i < 3; i++ {
+		tier.Send(map[string]interface{}{"type": "ingress.event.netconn", "computer_name": "host1"}, "", now)
+	}
+	tier.Send(map[string]interface{}{"type": "ingress.event.filemod"}, "", now)
+
+	if msg := <-tier.messages; msg != "formatted alert" {
+		t.Errorf("Expected the alert as formatted for the main output, got %s", msg)
+	}
+	var procstart map[string]interface{}
+	json.Unmarshal([]byte(<-tier.messages), &procstart)
+	if len(procstart) != 3 || procstart["process_path"] != "c:\\windows\\cmd.exe" {
+		t.Errorf("Expected only the listed fields, got %v", procstart)
+	}
+
+	tier.summarize(now)
+	var summary map[string]interface{}
+	json.Unmarshal([]byte(<-tier.messages), &summary)
+	if summary["type"] != tierSummaryEventType || summary["event_type"] != "ingress.event.netconn" ||
+		summary["computer_name"] != "host1" || summary["count"] != float64(3) || summary["interval"] != float64(300) {
+		t.Errorf("Unexpected summary %v", summary)
+	}
+
+	// a full queue drops events for the tier output rather than holding up the main output
+	tier.Send(map[string]interface{}{"type": "alert.watchlist.hit.query.process"}, "1", now)
+	tier.Send(map[string]interface{}{"type": "alert.watchlist.hit.query.process"}, "2", now)
+	tier.Send(map[string]interface{}{"type": "alert.watchlist.hit.query.process"}, "3", now)
+	stats := tier.stats
+	if stats.Events != 4 || stats.Summarized != 3 || stats.SummaryEvents != 1 || stats.Excluded != 1 ||
+		stats.Dropped != 1 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
+
+func TestTierOutputPaths(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+	base := "[bridge]\nrabbit_mq_password=guest\noutput_type=tcp\ntcpout=siem.example.com:514\n" +
+		"output_archive_directory=/var/cb/data/event-forwarder/archive\ntier_output_type=tcp\n"
+	dir := writeConfigFiles(t, map[string]string{
+		"shared.conf": base + "tier_output=siem.example.com:514\n",
+		"own.conf":    base + "tier_output=lake.example.com:514\n",
+	})
+
+	if _, err := ParseConfig(filepath.Join(dir, "shared.conf")); err == nil || !strings.Contains(err.Error(),
+		"/var/cb/data/event-forwarder/archive/tcp_siem.example.com_514 (the archive of tier_output_type) is already "+
+			"used by the archive of output_type") {
+		t.Errorf("Expected the tier output's archive to be refused, got %v", err)
+	}
+	if _, err := ParseConfig(filepath.Join(dir, "own.conf")); err != nil {
+		t.Errorf("Expected a tier output to another destination to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// UploadErrorCategory classifies why an upload failed, which determines when (and whether) it is retried.
+type UploadErrorCategory int
+
+const (
+	UploadErrorUnknown UploadErrorCategory = iota
+	// credentials missing, expired or not authorized for the destination
+	UploadErrorAuth
+	// the destination asked us to slow down
+	UploadErrorThrottled
+	// connection failures, timeouts and server-side errors
+	UploadErrorNetwork
+	// the request was rejected as invalid; retrying the same request will not help
+	UploadErrorClient
+)
+
+var uploadErrorCategoryNames = [...]string{"unknown", "auth", "throttled", "network", "client"}
+
+func (c UploadErrorCategory) String() string {
+	if int(c) < len(uploadErrorCategoryNames) {
+		return uploadErrorCategoryNames[c]
+	}
+	return "unknown"
+}
+
+// UploadErrorClassifier may be implemented by an UploadBehavior to classify errors specific to its destination.
+// Errors classified as UploadErrorUnknown fall back to the generic classification of network and local file errors.
+type UploadErrorClassifier interface {
+	ClassifyError(err error) UploadErrorCategory
+}
+
+var uploadErrorCategories = expvar.NewMap("upload_error_categories")
+
+// uploadRetryPolicy gives the delay before a failed upload is retried: initialDelay after the first failure, doubling
+// with each further failure up to maxDelay. Files that fail with a category that is not retried stay in the holding
+// area until the forwarder is restarted.
+type uploadRetryPolicy struct {
+	retry        bool
+	initialDelay time.Duration
+	maxDelay     time.Duration
+}
+
+var uploadRetryPolicies = map[UploadErrorCategory]uploadRetryPolicy{
+	UploadErrorUnknown:   {retry: true, initialDelay: 5 * time.Second, maxDelay: 5 * time.Minute},
+	UploadErrorAuth:      {retry: true, initialDelay: 5 * time.Minute, maxDelay: 30 * time.Minute},
+	UploadErrorThrottled: {retry: true, initialDelay: 10 * time.Second, maxDelay: 10 * time.Minute},
+	UploadErrorNetwork:   {retry: true, initialDelay: 5 * time.Second, maxDelay: 5 * time.Minute},
+	UploadErrorClient:    {retry: false},
+}
+
+func (p uploadRetryPolicy) delay(attempts int) time.Duration {
+	delay := p.initialDelay
+	for i := 1; i < attempts && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	return delay
+}
+
+func classifyUploadError(behavior UploadBehavior, err error) UploadErrorCategory {
+	if classifier, ok := behavior.(UploadErrorClassifier); ok {
+		if category := classifier.ClassifyError(err); category != UploadErrorUnknown {
+			return category
+		}
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	switch err.(type) {
+	case net.Error:
+		return UploadErrorNetwork
+	case *os.PathError:
+		// the file in the holding area could not be read
+		return UploadErrorClient
+	}
+
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return UploadErrorNetwork
+	}
+
+	return UploadErrorUnknown
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClassifyUploadError(t *testing.T) {
+	s3 := &S3Behavior{}
+	cases := []struct {
+		err      error
+		expected UploadErrorCategory
+	}{
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "req"), UploadErrorAuth},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "req"), UploadErrorThrottled},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "req"), UploadErrorNetwork},
+		{awserr.NewRequestFailure(awserr.New("EntityTooLarge", "too big", nil), 400, "req"), UploadErrorClient},
+		{awserr.New("NoCredentialProviders", "no credentials", nil), UploadErrorAuth},
+		{&url.Error{Op: "Put", URL: "https://bucket", Err: &net.OpError{Op: "dial", Err: errors.New("refused")}},
+			UploadErrorNetwork},
+		{&os.PathError{Op: "open", Path: "/nonexistent", Err: os.ErrNotExist}, UploadErrorClient},
+		{context.DeadlineExceeded, UploadErrorNetwork},
+		{errors.New("something else"), UploadErrorUnknown},
+	}
+
+	for _, c := range cases {
+		if category := classifyUploadError(s3, c.err); category != c.expected {
+			t.Errorf("Expected %v to be classified as %s, got %s", c.err, c.expected, category)
+		}
+	}
+}
+
+func TestUploadRetryPolicyDelay(t *testing.T) {
+	policy := uploadRetryPolicy{retry: true, initialDelay: time.Second, maxDelay: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second,
+		10 * time.Second}
+	for i, delay := range expected {
+		if actual := policy.delay(i + 1); actual != delay {
+			t.Errorf("Expected a delay of %s after %d attempts, got %s", delay, i+1, actual)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/vaughan0/go-ini"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	uploadHookSentCount    = expvar.NewInt("upload_hook_sent_count")
+	uploadHookErrorCount   = expvar.NewInt("upload_hook_error_count")
+	uploadHookDroppedCount = expvar.NewInt("upload_hook_dropped_count")
+)
+
+const (
+	// the number of notifications that can wait for the hooks before they are dropped
+	uploadHookQueueSize = 100
+	// how long the hooks have, once the output is stopped, to send the notifications still queued
+	uploadHookShutdownTimeout = 10 * time.Second
+)
+
+// UploadHookConfig is the [upload_hooks] section: where to send a notification of each upload by a bundled output.
+type UploadHookConfig struct {
+	Command   string
+	Webhook   string
+	SNSTopic  string
+	OnSuccess bool
+	OnFailure bool
+	Timeout   time.Duration
+}
+
+func (c UploadHookConfig) enabled() bool {
+	return len(c.Command) > 0 || len(c.Webhook) > 0 || len(c.SNSTopic) > 0
+}
+
+// UploadNotification describes the result of an upload, as sent to the hooks.
+type UploadNotification struct {
+	Result        string    `json:"result"`
+	FileName      string    `json:"file_name"`
+	Size          int64     `json:"size"`
+	Destination   string    `json:"destination"`
+	Time          time.Time `json:"time"`
+	Error         string    `json:"error,omitempty"`
+	ErrorCategory string    `json:"error_category,omitempty"`
+	Retrying      bool      `json:"retrying,omitempty"`
+}
+
+// uploadHooks sends notifications of upload results to the configured hooks - running a command, POSTing to a
+// webhook and publishing to an SNS topic - so that whatever processes the uploaded files (a loader job, say) can be
+// triggered rather than polling the destination. Notifications are sent one at a time, in the order of the uploads,
+// by a goroutine of their own so that a slow hook never holds up the output; if the hooks fall too far behind,
+// notifications are dropped. A hook that fails is logged and not retried. When the output stops, the notifications
+// still queued are sent within uploadHookShutdownTimeout, and the rest dropped.
+type uploadHooks struct {
+	config UploadHookConfig
+	client *http.Client
+	sns    *sns.SNS
+	queue  chan UploadNotification
+	// closed once run has returned
+	done chan struct{}
+}
+
+// newUploadHooks returns the hooks in [upload_hooks], or nil if there are none.
+func newUploadHooks(hookConfig UploadHookConfig) (*uploadHooks, error) {
+	if !hookConfig.enabled() {
+		return nil, nil
+	}
+
+	h := &uploadHooks{
+		config: hookConfig,
+		client: &http.Client{Timeout: hookConfig.Timeout, Transport: httpTransport()},
+		queue:  make(chan UploadNotification, uploadHookQueueSize),
+		done:   make(chan struct{}),
+	}
+	if len(hookConfig.SNSTopic) > 0 {
+		topic, err := arn.Parse(hookConfig.SNSTopic)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sns_topic '%s' in [upload_hooks]: %s", hookConfig.SNSTopic, err)
+		}
+		h.sns = newSNSClient(topic.Region)
+	}
+	return h, nil
+}
+
+// newSNSClient connects to SNS in region, with the credentials in [s3] credential_profile if it is set.
+func newSNSClient(region string) *sns.SNS {
+	awsConfig := &aws.Config{Region: aws.String(region), HTTPClient: &http.Client{Transport: httpTransport()}}
+	if fipsMode() {
+		awsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if config.S3CredentialProfileName != nil {
+		awsConfig.Credentials = s3Credentials(*config.S3CredentialProfileName)
+	}
+	return sns.New(session.New(awsConfig))
+}
+
+// notify queues a notification, unless the result isn't one the hooks are sent.
+func (h *uploadHooks) notify(notification UploadNotification) {
+	if (notification.Result == "success" && !h.config.OnSuccess) ||
+		(notification.Result == "failure" && !h.config.OnFailure) {
+		return
+	}
+
+	select {
+	case h.queue <- notification:
+	default:
+		uploadHookDroppedCount.Add(1)
+		log.Printf("Upload hooks are falling behind; dropped the notification for %s", notification.FileName)
+	}
+}
+
+// run sends queued notifications until ctx is done, then those still queued. Notifications are sent with a context
+// of their own, so that the one being sent when ctx is done isn't interrupted; it is cancelled
+// uploadHookShutdownTimeout later.
+func (h *uploadHooks) run(ctx context.Context) {
+	defer close(h.done)
+
+	sendCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			time.AfterFunc(uploadHookShutdownTimeout, cancel)
+		case <-sendCtx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			h.drain(sendCtx)
+			return
+		case notification := <-h.queue:
+			h.send(sendCtx, notification)
+		}
+	}
+}
+
+// drain sends the notifications still queued until ctx is done, and drops the rest.
+func (h *uploadHooks) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		select {
+		case notification := <-h.queue:
+			h.send(ctx, notification)
+		default:
+			return
+		}
+	}
+	if dropped := len(h.queue); dropped > 0 {
+		uploadHookDroppedCount.Add(int64(dropped))
+		log.Printf("Upload hooks did not finish during shutdown; dropped %d notifications", dropped)
+	}
+}
+
+// wait waits for run to send the notifications still queued once the output has stopped.
+func (h *uploadHooks) wait() {
+	<-h.done
+}
+
+func (h *uploadHooks) send(ctx context.Context, notification UploadNotification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return
+	}
+
+	hooks := []struct {
+		name    string
+		enabled bool
+		send    func(context.Context, UploadNotification, []byte) error
+	}{
+		{"command", len(h.config.Command) > 0, h.runCommand},
+		{"webhook", len(h.config.Webhook) > 0, h.postWebhook},
+		{"SNS", h.sns != nil, h.publishSNS},
+	}
+	for _, hook := range hooks {
+		if !hook.enabled {
+			continue
+		}
+		hookCtx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+		err := hook.send(hookCtx, notification, body)
+		cancel()
+		if err != nil {
+			uploadHookErrorCount.Add(1)
+			log.Printf("Upload %s hook for %s failed: %s", hook.name, notification.FileName, err)
+		} else {
+			uploadHookSentCount.Add(1)
+		}
+	}
+}
+
+// runCommand runs the command with the notification on its standard input, and its fields in the environment as
+// CB_UPLOAD_RESULT, CB_UPLOAD_FILE, CB_UPLOAD_SIZE, CB_UPLOAD_DESTINATION and CB_UPLOAD_ERROR.
+func (h *uploadHooks) runCommand(ctx context.Context, notification UploadNotification, body []byte) error {
+	cmd := exec.CommandContext(ctx, h.config.Command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"CB_UPLOAD_RESULT="+notification.Result,
+		"CB_UPLOAD_FILE="+notification.FileName,
+		"CB_UPLOAD_SIZE="+strconv.FormatInt(notification.Size, 10),
+		"CB_UPLOAD_DESTINATION="+notification.Destination,
+		"CB_UPLOAD_ERROR="+notification.Error,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if len(output) > 512 {
+			output = output[:512]
+		}
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (h *uploadHooks) postWebhook(ctx context.Context, notification UploadNotification, body []byte) error {
+	req, err := http.NewRequest("POST", h.config.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", h.config.Webhook, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// publishSNS publishes the notification, with its result and destination as message attributes that subscriptions
+// can filter on.
+func (h *uploadHooks) publishSNS(ctx context.Context, notification UploadNotification, body []byte) error {
+	_, err := h.sns.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(h.config.SNSTopic),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"result":      {DataType: aws.String("String"), StringValue: aws.String(notification.Result)},
+			"destination": {DataType: aws.String("String"), StringValue: aws.String(notification.Destination)},
+		},
+	})
+	return err
+}
+
+// parseUploadHooks reads the [upload_hooks] section.
+func parseUploadHooks(section ini.Section, errs *ConfigurationError) UploadHookConfig {
+	hookConfig := UploadHookConfig{
+		Command:   section["command"],
+		SNSTopic:  section["sns_topic"],
+		OnSuccess: true,
+		OnFailure: true,
+		Timeout:   30 * time.Second,
+	}
+
+	if val, ok := section["webhook"]; ok && len(val) > 0 {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid webhook '%s' in [upload_hooks]: should be an http or https URL",
+				val))
+		} else {
+			hookConfig.Webhook = val
+		}
+	}
+	if val, ok := section["sns_topic"]; ok && len(val) > 0 {
+		if topic, err := arn.Parse(val); err != nil || topic.Service != "sns" {
+			errs.addErrorString(fmt.Sprintf("Invalid sns_topic '%s' in [upload_hooks]: should be the ARN of an SNS "+
+				"topic", val))
+			hookConfig.SNSTopic = ""
+		}
+	}
+
+	if val, ok := section["on"]; ok {
+		hookConfig.OnSuccess, hookConfig.OnFailure = false, false
+		for _, result := range strings.Split(val, ",") {
+			switch strings.TrimSpace(result) {
+			case "success":
+				hookConfig.OnSuccess = true
+			case "failure":
+				hookConfig.OnFailure = true
+			default:
+				errs.addErrorString(fmt.Sprintf("Unknown result '%s' for 'on' in [upload_hooks]: valid values are "+
+					"success, failure", result))
+			}
+		}
+	}
+
+	if val, ok := section["timeout"]; ok {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout <= 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid timeout '%s' in [upload_hooks]: should be a duration such as 30s",
+				val))
+		} else {
+			hookConfig.Timeout = timeout
+		}
+	}
+	return hookConfig
+}
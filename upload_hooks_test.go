@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadHooks(t *testing.T) {
+	defer func(saved Configuration) { config = saved }(config)
+
+	notifications := make(chan UploadNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification UploadNotification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			t.Error(err)
+		}
+		notifications <- notification
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$CB_UPLOAD_RESULT $CB_UPLOAD_FILE $CB_UPLOAD_SIZE\" >> "+
+		filepath.Join(dir, "hook.log")+"\n"), 0755)
+
+	input, _ := ini.Load(strings.NewReader(`
+[upload_hooks]
+command=` + script + `
+webhook=` + server.URL + `
+timeout=5s
+`))
+	errs := ConfigurationError{Empty: true}
+	config.UploadHooks = parseUploadHooks(input.Section("upload_hooks"), &errs)
+	if !errs.Empty {
+		t.Fatal(errs.Errors)
+	}
+
+	behavior := newTestUploadBehavior(t, false)
+	defer os.RemoveAll(behavior.directory)
+	output := NewBundledOutput(behavior)
+	if err := output.Initialize(""); err != nil {
+		t.Fatal(err)
+	}
+	output.rollOverDuration = 0
+
+	messages := make(chan string)
+	errors := make(chan error, 1)
+	if err := output.Go(context.Background(), messages, errors); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Shutdown()
+
+	messages <- "event"
+
+	var notification UploadNotification
+	select {
+	case notification = <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No notification of the upload")
+	}
+	if notification.Result != "success" || !strings.HasPrefix(notification.FileName, "event-forwarder.") ||
+		notification.Size != int64(len("event\n")) || notification.Destination != "test uploader" {
+		t.Errorf("Unexpected notification %+v", notification)
+	}
+
+	// the command runs before the webhook is sent
+	logged, _ := ioutil.ReadFile(filepath.Join(dir, "hook.log"))
+	if expected := "success " + notification.FileName + " 6\n"; string(logged) != expected {
+		t.Errorf("Expected the command to log %q, got %q", expected, logged)
+	}
+}
+
+func TestUploadHooksShutdown(t *testing.T) {
+	var lock sync.Mutex
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification UploadNotification
+		json.NewDecoder(r.Body).Decode(&notification)
+		lock.Lock()
+		sent = append(sent, notification.FileName)
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	hooks, err := newUploadHooks(UploadHookConfig{Webhook: server.URL, OnSuccess: true, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		hooks.notify(UploadNotification{Result: "success", FileName: fmt.Sprintf("event-forwarder.%d", i)})
+	}
+
+	// the notifications queued when the output stops are still sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	go hooks.run(ctx)
+	hooks.wait()
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(sent, ",") != "event-forwarder.0,event-forwarder.1,event-forwarder.2" {
+		t.Errorf("Expected the queued notifications to be sent, got %v", sent)
+	}
+}
+
+func TestParseUploadHooks(t *testing.T) {
+	input, _ := ini.Load(strings.NewReader(`
+[upload_hooks]
+sns_topic=arn:aws:sns:eu-west-1:123456789012:cb-event-uploads
+on=failure
+`))
+	errs := ConfigurationError{Empty: true}
+	hookConfig := parseUploadHooks(input.Section("upload_hooks"), &errs)
+	if !errs.Empty || hookConfig.OnSuccess || !hookConfig.OnFailure || !hookConfig.enabled() {
+		t.Errorf("Unexpected hooks %+v (%v)", hookConfig, errs.Errors)
+	}
+
+	hooks := &uploadHooks{config: hookConfig, queue: make(chan UploadNotification, 1)}
+	hooks.notify(UploadNotification{Result: "success"})
+	if len(hooks.queue) != 0 {
+		t.Error("Expected successful uploads not to be notified")
+	}
+
+	input, _ = ini.Load(strings.NewReader(`
+[upload_hooks]
+webhook=ftp://orchestrator
+sns_topic=cb-event-uploads
+on=always
+`))
+	errs = ConfigurationError{Empty: true}
+	parseUploadHooks(input.Section("upload_hooks"), &errs)
+	if len(errs.Errors) != 3 {
+		t.Errorf("Expected the webhook, sns_topic and on to be refused, got %v", errs.Errors)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Retry state for a file in the holding area is kept next to it, in a file with the same name and this suffix, so
+// that attempt counts and backoff survive a restart of the forwarder.
+const retryStateSuffix = ".retry"
+
+type uploadRetryState struct {
+	Attempts      int       `json:"attempts"`
+	NextAttempt   time.Time `json:"next_attempt"`
+	Held          bool      `json:"held"`
+	ErrorCategory string    `json:"error_category"`
+	LastError     string    `json:"last_error"`
+}
+
+func retryStatePath(fileName string) string {
+	return fileName + retryStateSuffix
+}
+
+func isRetryStateFile(fileName string) bool {
+	return strings.HasSuffix(fileName, retryStateSuffix)
+}
+
+// saveRetryState writes the retry state through a temporary file, so that a crash never leaves a truncated file behind.
+func saveRetryState(upload *queuedUpload, category UploadErrorCategory, uploadErr error) error {
+	state := uploadRetryState{
+		Attempts:      upload.attempts,
+		NextAttempt:   upload.nextAttempt,
+		Held:          upload.held,
+		ErrorCategory: category.String(),
+		LastError:     uploadErr.Error(),
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	path := retryStatePath(upload.fileName)
+	if err = ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadRetryState returns the queue entry for a file found in the holding area at startup. Files without (readable)
+// retry state have never failed and are due immediately. Files that were held are retried once after a restart, since
+// the configuration may have been corrected in the meantime.
+func loadRetryState(fileName string) *queuedUpload {
+	upload := &queuedUpload{fileName: fileName}
+
+	b, err := ioutil.ReadFile(retryStatePath(fileName))
+	if err != nil {
+		return upload
+	}
+
+	var state uploadRetryState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return upload
+	}
+
+	upload.attempts = state.Attempts
+	if !state.Held {
+		upload.nextAttempt = state.NextAttempt
+	}
+	return upload
+}
+
+func removeRetryState(fileName string) {
+	if err := os.Remove(retryStatePath(fileName)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing retry state for %s: %s", fileName, err.Error())
+	}
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
@@ -75,3 +79,93 @@ func GetMd5Hexdigest(src []byte) string {
 func GetUnicodeFromUTF8(src []byte) string {
 	return string(src)
 }
+
+// RoutingKeyMatches reports whether routingKey matches pattern using AMQP topic exchange rules: words are separated
+// by dots, "*" matches exactly one word and "#" matches zero or more words.
+func RoutingKeyMatches(pattern, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			for i := 0; i <= len(words); i++ {
+				if matchWords(pattern[1:], words[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(words) == 0 {
+				return false
+			}
+		default:
+			if len(words) == 0 || pattern[0] != words[0] {
+				return false
+			}
+		}
+		pattern, words = pattern[1:], words[1:]
+	}
+	return len(words) == 0
+}
+
+// parseDateOrTime accepts a date, which is taken as midnight UTC at its start, or an RFC 3339 time.
+func parseDateOrTime(val string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", val); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+// formattedEventFields returns the fields of a formatted event: those of a JSON event, or the attributes of a LEEF event.
+func formattedEventFields(message string) map[string]interface{} {
+	if strings.HasPrefix(message, "LEEF:") {
+		fields := make(map[string]interface{})
+		header := strings.SplitN(message, "|", 6)
+		if len(header) < 6 {
+			return fields
+		}
+		fields["type"] = header[4]
+		for _, attribute := range strings.Split(header[5], "\t") {
+			if parts := strings.SplitN(attribute, "=", 2); len(parts) == 2 {
+				fields[parts[0]] = parts[1]
+			}
+		}
+		return fields
+	}
+
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	decoder.Decode(&fields)
+	return fields
+}
+
+// lookupField returns the value at a dotted path such as process.pid or docs.0.md5, or, if the event has a field
+// with that name (from json_flatten, or in a LEEF event), that field's value.
+func lookupField(fields map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := fields[path]; ok {
+		return value, true
+	}
+
+	var value interface{} = fields
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[part]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildInfo describes the build of the forwarder, for -version and the status page.
+type BuildInfo struct {
+	Version      string            `json:"version"`
+	GoVersion    string            `json:"go_version"`
+	Platform     string            `json:"platform"`
+	CryptoModule string            `json:"crypto_module"`
+	Revision     string            `json:"vcs_revision,omitempty"`
+	RevisionTime string            `json:"vcs_time,omitempty"`
+	Modified     bool              `json:"vcs_modified,omitempty"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+}
+
+// buildInfo returns the version set by the Makefile, with what the Go toolchain recorded in the binary: the commit
+// it was built from and the versions of its dependencies, where the build had them.
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:      version,
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		CryptoModule: cryptoModule,
+	}
+
+	recorded, ok := runtimedebug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range recorded.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.RevisionTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	for _, dep := range recorded.Deps {
+		if info.Dependencies == nil {
+			info.Dependencies = make(map[string]string)
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		info.Dependencies[dep.Path] = dep.Version
+	}
+	return info
+}
+
+// UpdateCheckStatus is the result of the latest check of update_check_url, shown on the status page as update_check.
+type UpdateCheckStatus struct {
+	URL             string    `json:"url"`
+	CurrentVersion  string    `json:"current_version"`
+	LatestVersion   string    `json:"latest_version,omitempty"`
+	ReleaseURL      string    `json:"release_url,omitempty"`
+	UpdateAvailable bool      `json:"update_available"`
+	LastCheckTime   time.Time `json:"last_check_time"`
+	LastErrorText   string    `json:"last_error_text,omitempty"`
+}
+
+// updateChecker periodically fetches a JSON document describing the latest release from update_check_url, so that
+// the status page of each forwarder in a fleet shows whether it runs an outdated build. The document is
+// {"version": "3.9.0", "url": "<release notes>"}; GitHub's latest release API, with tag_name and html_url, works too.
+// Nothing is downloaded or installed: updating is left to the admin.
+type updateChecker struct {
+	url    string
+	client *http.Client
+
+	status UpdateCheckStatus
+	sync.Mutex
+}
+
+func newUpdateChecker(url string) *updateChecker {
+	return &updateChecker{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second, Transport: httpTransport()},
+		status: UpdateCheckStatus{URL: url, CurrentVersion: version},
+	}
+}
+
+// run checks for an update now, and then every interval until ctx is done.
+func (c *updateChecker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *updateChecker) check(ctx context.Context) {
+	latest, releaseURL, err := c.fetch(ctx)
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.status.LastCheckTime = time.Now()
+	if err != nil {
+		c.status.LastErrorText = err.Error()
+		log.Printf("Could not check %s for updates: %s", c.url, err)
+		return
+	}
+	c.status.LastErrorText = ""
+
+	newer := false
+	if cmp, ok := compareVersions(latest, version); ok && cmp > 0 {
+		newer = true
+	}
+	if newer && latest != c.status.LatestVersion {
+		log.Printf("cb-event-forwarder %s is available; this forwarder is running %s", latest, version)
+	}
+	c.status.LatestVersion = latest
+	c.status.ReleaseURL = releaseURL
+	c.status.UpdateAvailable = newer
+}
+
+func (c *updateChecker) fetch(ctx context.Context) (string, string, error) {
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "cb-event-forwarder/"+version)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("%s returned %s", c.url, resp.Status)
+	}
+
+	var release struct {
+		Version string `json:"version"`
+		URL     string `json:"url"`
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&release); err != nil {
+		return "", "", fmt.Errorf("could not parse the response from %s: %s", c.url, err)
+	}
+	if len(release.Version) == 0 {
+		release.Version, release.URL = strings.TrimPrefix(release.TagName, "v"), release.HTMLURL
+	}
+	if len(release.Version) == 0 {
+		return "", "", fmt.Errorf("the response from %s has no version", c.url)
+	}
+	return release.Version, release.URL, nil
+}
+
+func (c *updateChecker) Statistics() interface{} {
+	c.Lock()
+	defer c.Unlock()
+	return c.status
+}
+
+// compareVersions compares dotted version numbers such as 3.8.1, ignoring a leading v and anything after a - or +
+// (3.8.1-1 is 3.8.1). It returns -1, 0 or 1 as a is older than, the same as or newer than b, and false if either
+// isn't a version number, as in a build not made for release.
+func compareVersions(a, b string) (int, bool) {
+	parse := func(v string) ([]int, bool) {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		var parts []int
+		for _, part := range strings.Split(v, ".") {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			parts = append(parts, n)
+		}
+		return parts, true
+	}
+
+	pa, ok := parse(a)
+	if !ok {
+		return 0, false
+	}
+	pb, ok := parse(b)
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+		ok       bool
+	}{
+		{"3.8.1", "3.8.1", 0, true},
+		{"3.9.0", "3.8.12", 1, true},
+		{"3.8", "3.8.1", -1, true},
+		{"v3.8.1", "3.8.1-1", 0, true},
+		{"3.10.0", "3.9.9", 1, true},
+		{"3.8.1", "NOT FOR RELEASE", 0, false},
+	}
+	for _, test := range tests {
+		if cmp, ok := compareVersions(test.a, test.b); cmp != test.expected || ok != test.ok {
+			t.Errorf("compareVersions(%s, %s) = %d, %v; expected %d, %v", test.a, test.b, cmp, ok, test.expected,
+				test.ok)
+		}
+	}
+}
+
+func TestUpdateChecker(t *testing.T) {
+	defer func(saved string) { version = saved }(version)
+	version = "3.8.1"
+
+	latest := `{"version": "3.9.0", "url": "https://example.com/3.9.0"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "cb-event-forwarder/3.8.1" {
+			t.Errorf("Unexpected User-Agent %s", r.Header.Get("User-Agent"))
+		}
+		fmt.Fprint(w, latest)
+	}))
+	defer server.Close()
+
+	checker := newUpdateChecker(server.URL)
+	checker.check(context.Background())
+	status := checker.Statistics().(UpdateCheckStatus)
+	if !status.UpdateAvailable || status.LatestVersion != "3.9.0" || status.ReleaseURL != "https://example.com/3.9.0" {
+		t.Errorf("Expected 3.9.0 to be available, got %+v", status)
+	}
+
+	// GitHub's release API
+	latest = `{"tag_name": "v3.8.1", "html_url": "https://github.com/releases/v3.8.1"}`
+	checker.check(context.Background())
+	if status := checker.Statistics().(UpdateCheckStatus); status.UpdateAvailable || status.LatestVersion != "3.8.1" {
+		t.Errorf("Expected no update to be available, got %+v", status)
+	}
+
+	latest = `{}`
+	checker.check(context.Background())
+	if status := checker.Statistics().(UpdateCheckStatus); len(status.LastErrorText) == 0 {
+		t.Errorf("Expected a response without a version to be an error")
+	}
+}